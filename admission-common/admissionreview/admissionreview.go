@@ -0,0 +1,65 @@
+// Package admissionreview writes the AdmissionReview responses of the
+// admission webhooks in this repository, so that every one of them answers
+// in the envelope the API server requires.
+package admissionreview
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// NewResponse starts the response to a request. The API server matches
+// responses to requests by UID, so every response must echo it.
+func NewResponse(req *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	response := &admissionv1.AdmissionResponse{Allowed: true}
+	if req != nil {
+		response.UID = req.UID
+	}
+	return response
+}
+
+// WriteError denies the request in a well-formed envelope. Any status other
+// than 200 still makes the API server apply the webhook's failurePolicy.
+func WriteError(w http.ResponseWriter, response *admissionv1.AdmissionResponse, status int, format string, args ...interface{}) error {
+	response.Allowed = false
+	response.Patch = nil
+	response.PatchType = nil
+	response.Result = &metav1.Status{
+		Status:  metav1.StatusFailure,
+		Code:    int32(status),
+		Message: fmt.Sprintf(format, args...),
+	}
+	return Write(w, response, status)
+}
+
+// Write wraps the response in an AdmissionReview with the apiVersion and kind
+// the API server requires. The error is only for logging: a response that
+// cannot be encoded has already been answered with status 500, and one that
+// cannot be written has no one left to read it.
+func Write(w http.ResponseWriter, response *admissionv1.AdmissionResponse, status int) error {
+	body, err := json.Marshal(admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "admission.k8s.io/v1",
+			Kind:       "AdmissionReview",
+		},
+		Response: response,
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("could not encode response: %v", err), http.StatusInternalServerError)
+		return fmt.Errorf("could not encode response: %v", err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	// Every review is unique; nothing between us and the API server may cache it
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if _, err := w.Write(body); err != nil {
+		return fmt.Errorf("could not write response: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+package admissionreview
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+)
+
+func TestWriteError(t *testing.T) {
+	w := httptest.NewRecorder()
+	response := NewResponse(&admissionv1.AdmissionRequest{UID: "uid-1"})
+	if err := WriteError(w, response, http.StatusBadRequest, "bad %s", "request"); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusBadRequest || w.Header().Get("Content-Type") != "application/json" || w.Header().Get("Cache-Control") != "no-store" {
+		t.Errorf("status %d, headers %v", w.Code, w.Header())
+	}
+	var out admissionv1.AdmissionReview
+	if err := json.Unmarshal(w.Body.Bytes(), &out); err != nil {
+		t.Fatal(err)
+	}
+	switch {
+	case out.APIVersion != "admission.k8s.io/v1" || out.Kind != "AdmissionReview":
+		t.Errorf("response has type %s/%s", out.APIVersion, out.Kind)
+	case out.Response == nil || out.Response.UID != "uid-1" || out.Response.Allowed:
+		t.Errorf("response %+v does not deny uid-1", out.Response)
+	case out.Response.Result.Message != "bad request" || out.Response.Result.Code != http.StatusBadRequest:
+		t.Errorf("result %+v", out.Response.Result)
+	}
+}
@@ -0,0 +1,56 @@
+// Package logging builds the zap logger of the admission webhooks from
+// their --log-* flags.
+package logging
+
+import (
+	"flag"
+	"fmt"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Options are the logger settings exposed as command line flags.
+type Options struct {
+	Level              string
+	Format             string
+	SamplingInitial    int
+	SamplingThereafter int
+	Caller             bool
+}
+
+// RegisterFlags binds the logger options to flags on fs.
+func (o *Options) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.Level, "log-level", "info", "minimum log level: debug, info, warn or error")
+	fs.StringVar(&o.Format, "log-format", "json", "log encoding: json or console")
+	fs.IntVar(&o.SamplingInitial, "log-sampling-initial", 100, "log the first N identical entries per second before sampling; 0 disables sampling")
+	fs.IntVar(&o.SamplingThereafter, "log-sampling-thereafter", 100, "after the initial entries, log every Nth identical entry per second")
+	fs.BoolVar(&o.Caller, "log-caller", true, "annotate log entries with the calling file and line")
+}
+
+// New builds a logger from the options, starting from zap's production
+// defaults.
+func New(o Options) (*zap.Logger, error) {
+	level, err := zapcore.ParseLevel(o.Level)
+	if err != nil {
+		return nil, fmt.Errorf("invalid log level %q: %v", o.Level, err)
+	}
+
+	cfg := zap.NewProductionConfig()
+	cfg.Level = zap.NewAtomicLevelAt(level)
+	switch o.Format {
+	case "json":
+	case "console":
+		cfg.Encoding = "console"
+		cfg.EncoderConfig = zap.NewDevelopmentEncoderConfig()
+	default:
+		return nil, fmt.Errorf("invalid log format %q: must be json or console", o.Format)
+	}
+	if o.SamplingInitial > 0 {
+		cfg.Sampling = &zap.SamplingConfig{Initial: o.SamplingInitial, Thereafter: o.SamplingThereafter}
+	} else {
+		cfg.Sampling = nil
+	}
+	cfg.DisableCaller = !o.Caller
+	return cfg.Build()
+}
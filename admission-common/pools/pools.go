@@ -0,0 +1,7 @@
+// Package pools holds the IPPool labels the admission webhooks in this
+// repository share, so that pools written by one are understood by the
+// others.
+package pools
+
+// ParentLabel records on a child pool the master pool it was split from.
+const ParentLabel = "ipam.example.com/parent"
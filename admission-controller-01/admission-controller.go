@@ -3,8 +3,15 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"net/http"
+	"os"
+
+	"go.uber.org/zap"
+
+	"admission-common/admissionreview"
+	"admission-common/logging"
 
 	admissionv1 "k8s.io/api/admission/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -12,26 +19,33 @@ import (
 	"k8s.io/client-go/rest"
 )
 
+var logger = zap.NewNop()
+
 func handleAdmissionReview(w http.ResponseWriter, r *http.Request) {
 	var admissionReviewReq admissionv1.AdmissionReview
 	if err := json.NewDecoder(r.Body).Decode(&admissionReviewReq); err != nil {
-		http.Error(w, fmt.Sprintf("could not decode request: %v", err), http.StatusBadRequest)
+		writeAdmissionError(w, admissionreview.NewResponse(nil), http.StatusBadRequest, "could not decode request: %v", err)
 		return
 	}
-
-	admissionResponse := admissionv1.AdmissionResponse{
-		Allowed: true,
+	admissionResponse := admissionreview.NewResponse(admissionReviewReq.Request)
+	if admissionReviewReq.Request == nil {
+		writeAdmissionError(w, admissionResponse, http.StatusBadRequest, "admission review has no request")
+		return
 	}
 
 	if admissionReviewReq.Request.Kind.Kind == "Namespace" {
 		config, err := rest.InClusterConfig()
 		if err != nil {
-			panic(err.Error())
+			logger.Error("could not load in-cluster config", zap.Error(err))
+			writeAdmissionError(w, admissionResponse, http.StatusInternalServerError, "could not load in-cluster config: %v", err)
+			return
 		}
 
 		clientset, err := kubernetes.NewForConfig(config)
 		if err != nil {
-			panic(err.Error())
+			logger.Error("could not create clientset", zap.Error(err))
+			writeAdmissionError(w, admissionResponse, http.StatusInternalServerError, "could not create clientset: %v", err)
+			return
 		}
 
 		// Example: Use clientset to check if the namespace exists
@@ -48,24 +62,28 @@ func handleAdmissionReview(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	admissionReviewRes := admissionv1.AdmissionReview{
-		Response: &admissionResponse,
-	}
-	admissionReviewRes.Response.UID = admissionReviewReq.Request.UID
-
-	if err := json.NewEncoder(w).Encode(admissionReviewRes); err != nil {
-		http.Error(w, fmt.Sprintf("could not encode response: %v", err), http.StatusInternalServerError)
-		return
-	}
+	writeAdmissionResponse(w, admissionResponse, http.StatusOK)
 }
 
 func main() {
+	var logOptions logging.Options
+	logOptions.RegisterFlags(flag.CommandLine)
+	flag.Parse()
+
+	l, err := logging.New(logOptions)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Can't initialize zap logger: %v\n", err)
+		os.Exit(1)
+	}
+	logger = l
+	defer logger.Sync()
+
 	http.HandleFunc("/mutate", handleAdmissionReview)
 	server := &http.Server{
 		Addr: ":8443",
 	}
-	fmt.Println("Starting webhook server on port 8443...")
+	logger.Info("Starting webhook server", zap.String("addr", server.Addr))
 	if err := server.ListenAndServeTLS("/tls/tls.crt", "/tls/tls.key"); err != nil {
-		panic(err.Error())
+		logger.Fatal("Server failed", zap.Error(err))
 	}
 }
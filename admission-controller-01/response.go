@@ -0,0 +1,27 @@
+package main
+
+import (
+	"net/http"
+
+	"go.uber.org/zap"
+
+	"admission-common/admissionreview"
+
+	admissionv1 "k8s.io/api/admission/v1"
+)
+
+// writeAdmissionError denies the request, see admissionreview.WriteError, and
+// logs a response that could not be sent.
+func writeAdmissionError(w http.ResponseWriter, response *admissionv1.AdmissionResponse, status int, format string, args ...interface{}) {
+	if err := admissionreview.WriteError(w, response, status, format, args...); err != nil {
+		logger.Error("could not send admission response", zap.Error(err))
+	}
+}
+
+// writeAdmissionResponse answers the request, see admissionreview.Write, and
+// logs a response that could not be sent.
+func writeAdmissionResponse(w http.ResponseWriter, response *admissionv1.AdmissionResponse, status int) {
+	if err := admissionreview.Write(w, response, status); err != nil {
+		logger.Error("could not send admission response", zap.Error(err))
+	}
+}
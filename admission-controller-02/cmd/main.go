@@ -1,19 +1,36 @@
 package main
 
 import (
-	"log"
+	"flag"
+	"fmt"
 	"net/http"
+	"os"
 
+	"go.uber.org/zap"
+
+	"admission-common/logging"
 	"admission-controller-02/pkg/admission"
 )
 
 func main() {
+	var logOptions logging.Options
+	logOptions.RegisterFlags(flag.CommandLine)
+	flag.Parse()
+
+	logger, err := logging.New(logOptions)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Can't initialize zap logger: %v\n", err)
+		os.Exit(1)
+	}
+	defer logger.Sync()
+	admission.Logger = logger
+
 	http.HandleFunc("/mutate", admission.HandleAdmissionReview)
 	server := &http.Server{
 		Addr: ":8443",
 	}
-	log.Println("Starting webhook server on port 8443...")
+	logger.Info("Starting webhook server", zap.String("addr", server.Addr))
 	if err := server.ListenAndServeTLS("/tls/tls.crt", "/tls/tls.key"); err != nil {
-		log.Fatalf("Server failed: %v", err)
+		logger.Fatal("Server failed", zap.Error(err))
 	}
 }
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net/http"
 
+	"admission-common/admissionreview"
 	"admission-controller-02/pkg/calico"
 	"admission-controller-02/pkg/utils"
 
@@ -16,51 +17,51 @@ import (
 func HandleAdmissionReview(w http.ResponseWriter, r *http.Request) {
 	var admissionReviewReq admissionv1.AdmissionReview
 	if err := json.NewDecoder(r.Body).Decode(&admissionReviewReq); err != nil {
-		http.Error(w, fmt.Sprintf("could not decode request: %v", err), http.StatusBadRequest)
+		writeAdmissionError(w, admissionreview.NewResponse(nil), http.StatusBadRequest, "could not decode request: %v", err)
 		return
 	}
-
-	admissionResponse := &admissionv1.AdmissionResponse{
-		UID:     admissionReviewReq.Request.UID,
-		Allowed: true,
+	admissionResponse := admissionreview.NewResponse(admissionReviewReq.Request)
+	if admissionReviewReq.Request == nil {
+		writeAdmissionError(w, admissionResponse, http.StatusBadRequest, "admission review has no request")
+		return
 	}
 
 	if admissionReviewReq.Request.Kind.Kind == "Namespace" {
 		config, err := rest.InClusterConfig()
 		if err != nil {
-			http.Error(w, fmt.Sprintf("could not get in-cluster config: %v", err), http.StatusInternalServerError)
+			writeAdmissionError(w, admissionResponse, http.StatusInternalServerError, "could not get in-cluster config: %v", err)
 			return
 		}
 
 		k8sClient, err := kubernetes.NewForConfig(config)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("could not create Kubernetes client: %v", err), http.StatusInternalServerError)
+			writeAdmissionError(w, admissionResponse, http.StatusInternalServerError, "could not create Kubernetes client: %v", err)
 			return
 		}
 
 		calicoClient, err := calico.NewClient(config)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("could not create Calico client: %v", err), http.StatusInternalServerError)
+			writeAdmissionError(w, admissionResponse, http.StatusInternalServerError, "could not create Calico client: %v", err)
 			return
 		}
 
 		if admissionReviewReq.Request.Operation == admissionv1.Create {
 			labelSelector := "location=my-location"
-			masterPool, err := calico.GetMasterPool(calicoClient, labelSelector, "/16")
+			masterPool, err := calico.GetMasterPool(r.Context(), calicoClient, labelSelector, "/16")
 			if err != nil {
-				http.Error(w, fmt.Sprintf("could not find master IP pool: %v", err), http.StatusInternalServerError)
+				writeAdmissionError(w, admissionResponse, http.StatusInternalServerError, "could not find master IP pool: %v", err)
 				return
 			}
 
-			subnets, err := calico.SplitMasterPool(masterPool.Spec.CIDR, "/26")
+			subnets, err := calico.ChildPools(r.Context(), calicoClient, masterPool)
 			if err != nil {
-				http.Error(w, fmt.Sprintf("could not split master pool: %v", err), http.StatusInternalServerError)
+				writeAdmissionError(w, admissionResponse, http.StatusInternalServerError, "could not list child pools of master pool: %v", err)
 				return
 			}
 
 			availablePool := utils.SelectAvailableSubnet(subnets)
 			if availablePool == "" {
-				http.Error(w, "no available subnets found", http.StatusInternalServerError)
+				writeAdmissionError(w, admissionResponse, http.StatusInternalServerError, "no available subnets found")
 				return
 			}
 
@@ -69,20 +70,13 @@ func HandleAdmissionReview(w http.ResponseWriter, r *http.Request) {
 			admissionResponse.PatchType = &patchType
 		} else if admissionReviewReq.Request.Operation == admissionv1.Delete {
 			namespace := admissionReviewReq.Request.Name
-			err := calico.MarkPoolAsAvailable(calicoClient, namespace)
+			err := calico.MarkPoolAsAvailable(r.Context(), calicoClient, namespace)
 			if err != nil {
-				http.Error(w, fmt.Sprintf("could not mark pool as available: %v", err), http.StatusInternalServerError)
+				writeAdmissionError(w, admissionResponse, http.StatusInternalServerError, "could not mark pool as available: %v", err)
 				return
 			}
 		}
 	}
 
-	admissionReviewRes := admissionv1.AdmissionReview{
-		Response: admissionResponse,
-	}
-
-	if err := json.NewEncoder(w).Encode(admissionReviewRes); err != nil {
-		http.Error(w, fmt.Sprintf("could not encode response: %v", err), http.StatusInternalServerError)
-		return
-	}
+	writeAdmissionResponse(w, admissionResponse, http.StatusOK)
 }
@@ -2,17 +2,19 @@ package calico
 
 import (
 	"context"
+	"encoding/binary"
 	"fmt"
-	"os/exec"
-	"strings"
+	"net/netip"
+
+	"admission-common/pools"
 
 	calicoApi "github.com/projectcalico/calico/tree/master/libcalico-go/lib/apis/v3"
 	calicoClient "github.com/projectcalico/calico/tree/master/libcalico-go/lib/clientv3"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
-func GetMasterPool(client calicoClient.Interface, labelSelector, cidr string) (*calicoApi.IPPool, error) {
-	ipPools, err := client.IPPools().List(context.Background(), metav1.ListOptions{
+func GetMasterPool(ctx context.Context, client calicoClient.Interface, labelSelector, cidr string) (*calicoApi.IPPool, error) {
+	ipPools, err := client.IPPools().List(ctx, metav1.ListOptions{
 		LabelSelector: labelSelector,
 	})
 	if err != nil {
@@ -27,25 +29,62 @@ func GetMasterPool(client calicoClient.Interface, labelSelector, cidr string) (*
 	return nil, fmt.Errorf("no matching IP pool found")
 }
 
-func SplitMasterPool(cidr, newSubnetSize string) ([]string, error) {
-	cmd := exec.Command("calicoctl", "ipam", "split", cidr, newSubnetSize)
-	output, err := cmd.Output()
+// childPrefixLength is the size of the subnets a master pool is split into
+// when no child pools exist.
+const childPrefixLength = 26
+
+// ChildPools returns the CIDRs of the child pools split from the master pool
+// by the pool splitter of admission-controller-03. Where the splitter does
+// not run, there are none, and the master CIDR is split locally instead.
+func ChildPools(ctx context.Context, client calicoClient.Interface, masterPool *calicoApi.IPPool) ([]string, error) {
+	ipPools, err := client.IPPools().List(ctx, metav1.ListOptions{
+		LabelSelector: pools.ParentLabel + "=" + masterPool.Name,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not list child IP pools: %v", err)
+	}
+
+	var subnets []string
+	for _, pool := range ipPools.Items {
+		subnets = append(subnets, pool.Spec.CIDR)
+	}
+	if len(subnets) == 0 {
+		return SplitMasterPool(masterPool.Spec.CIDR, childPrefixLength)
+	}
+	return subnets, nil
+}
+
+// SplitMasterPool splits an IPv4 CIDR into its subnets of the given prefix
+// length, in address order.
+func SplitMasterPool(cidr string, prefixLength int) ([]string, error) {
+	master, err := netip.ParsePrefix(cidr)
 	if err != nil {
-		return nil, fmt.Errorf("failed to split IP pool: %v", err)
+		return nil, fmt.Errorf("could not parse master pool CIDR %q: %v", cidr, err)
+	}
+	if !master.Addr().Is4() || prefixLength < master.Bits() || prefixLength > 32 {
+		return nil, fmt.Errorf("cannot split master pool %s into /%d subnets", cidr, prefixLength)
 	}
 
-	subnets := strings.Split(strings.TrimSpace(string(output)), "\n")
+	base := binary.BigEndian.Uint32(master.Masked().Addr().AsSlice())
+	size := uint32(1) << (32 - prefixLength)
+	count := uint32(1) << (prefixLength - master.Bits())
+	subnets := make([]string, 0, count)
+	for i := uint32(0); i < count; i++ {
+		var addr [4]byte
+		binary.BigEndian.PutUint32(addr[:], base+i*size)
+		subnets = append(subnets, netip.PrefixFrom(netip.AddrFrom4(addr), prefixLength).String())
+	}
 	return subnets, nil
 }
 
-func MarkPoolAsAvailable(client calicoClient.Interface, namespace string) error {
-	ipPool, err := client.IPPools().Get(context.Background(), namespace, metav1.GetOptions{})
+func MarkPoolAsAvailable(ctx context.Context, client calicoClient.Interface, namespace string) error {
+	ipPool, err := client.IPPools().Get(ctx, namespace, metav1.GetOptions{})
 	if err != nil {
 		return fmt.Errorf("could not fetch IP pool for namespace: %v", err)
 	}
 
 	patch := []byte(`[{"op": "remove", "path": "/metadata/annotations/ip-pool"}]`)
-	_, err = client.IPPools().Patch(context.Background(), ipPool.Name, metav1.PatchTypeJSONPatch, patch, metav1.PatchOptions{})
+	_, err = client.IPPools().Patch(ctx, ipPool.Name, metav1.PatchTypeJSONPatch, patch, metav1.PatchOptions{})
 	if err != nil {
 		return fmt.Errorf("could not remove annotation from IP pool: %v", err)
 	}
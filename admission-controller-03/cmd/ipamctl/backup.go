@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+
+	"sigs.k8s.io/yaml"
+
+	"admission-controller-03/pkg/admission"
+)
+
+// exportState writes a backup of the allocation state to path, "-" for
+// stdout, as YAML when format is "yaml" or the file is named *.yaml or *.yml,
+// as JSON otherwise. With format "csv" or "textfile", or a file named *.csv or
+// *.prom, it writes the allocations in that export format instead.
+func exportState(ctx context.Context, controller *admission.AdmissionController, path, format string) error {
+	if format == "" {
+		switch filepath.Ext(path) {
+		case ".csv":
+			format = admission.ExportCSV
+		case ".prom":
+			format = admission.ExportTextfile
+		}
+	}
+	if format == admission.ExportCSV || format == admission.ExportTextfile {
+		return exportAllocations(ctx, controller, path, format)
+	}
+
+	backup, err := controller.ExportState(ctx)
+	if err != nil {
+		return err
+	}
+	if format == "" {
+		format = "json"
+		if ext := filepath.Ext(path); ext == ".yaml" || ext == ".yml" {
+			format = "yaml"
+		}
+	}
+	var data []byte
+	switch format {
+	case "json":
+		data, err = json.MarshalIndent(backup, "", "  ")
+		data = append(data, '\n')
+	case "yaml":
+		data, err = yaml.Marshal(backup)
+	default:
+		return fmt.Errorf("unknown format %q, must be json, yaml, csv or textfile", format)
+	}
+	if err != nil {
+		return fmt.Errorf("could not encode backup: %v", err)
+	}
+
+	if path == "-" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		return fmt.Errorf("could not write backup: %v", err)
+	}
+	fmt.Fprintf(os.Stderr, "Exported %d pools, %d namespaces and %d allocation records to %s.\n",
+		len(backup.Pools), len(backup.Namespaces), len(backup.Allocations), path)
+	return nil
+}
+
+// exportAllocations writes the allocations to path, "-" for stdout, in an
+// export format. A textfile is renamed into place, so that the node-exporter
+// textfile collector never reads it half written.
+func exportAllocations(ctx context.Context, controller *admission.AdmissionController, path, format string) error {
+	allocations, err := controller.Allocations(ctx)
+	if err != nil {
+		return err
+	}
+	if path == "-" {
+		return admission.WriteAllocations(os.Stdout, allocations, format)
+	}
+
+	file, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("could not write export: %v", err)
+	}
+	defer os.Remove(file.Name())
+	if err := admission.WriteAllocations(file, allocations, format); err != nil {
+		file.Close()
+		return fmt.Errorf("could not write export: %v", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("could not write export: %v", err)
+	}
+	if err := os.Chmod(file.Name(), 0o644); err != nil {
+		return fmt.Errorf("could not write export: %v", err)
+	}
+	if err := os.Rename(file.Name(), path); err != nil {
+		return fmt.Errorf("could not write export: %v", err)
+	}
+	fmt.Fprintf(os.Stderr, "Exported %d allocations to %s.\n", len(allocations), path)
+	return nil
+}
+
+// importState restores a backup written by export, JSON or YAML, and prints
+// what was done with every object.
+func importState(ctx context.Context, controller *admission.AdmissionController, path, actor string) error {
+	var data []byte
+	var err error
+	if path == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return fmt.Errorf("could not read backup: %v", err)
+	}
+	var backup admission.Backup
+	if err := yaml.Unmarshal(data, &backup); err != nil {
+		return fmt.Errorf("could not decode backup: %v", err)
+	}
+
+	results, restoreErr := controller.RestoreState(ctx, &backup, actor)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "KIND\tNAME\tACTION\tDETAIL")
+	skipped := 0
+	for _, result := range results {
+		if result.Action == admission.RestoreSkipped {
+			skipped++
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", result.Kind, result.Name, result.Action, orNone(result.Detail))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if restoreErr != nil {
+		return restoreErr
+	}
+	if skipped > 0 {
+		fmt.Printf("\n%d objects skipped, see DETAIL.\n", skipped)
+	}
+	return nil
+}
@@ -0,0 +1,313 @@
+// Command ipamctl makes the operational fixes that otherwise mean editing
+// pool labels and namespace annotations by hand, through the same code paths
+// as the webhook:
+//
+//	ipamctl list [--zone ZONE] [--status STATUS]  list pools
+//	ipamctl assign NAMESPACE POOL                 assign a pool to a namespace holding none
+//	ipamctl release POOL [--override] [--yes]     release a pool no namespace references
+//	ipamctl cordon POOL                           never assign a pool again, keeping it bound
+//	ipamctl uncordon POOL                         make a cordoned pool assignable again
+//	ipamctl audit                                 print drift between namespaces and pools
+//	ipamctl simulate --demand [TENANT@]ZONE=N     replay new namespaces against the current pools
+//	ipamctl export FILE                           back up pools, namespace assignments and allocation records
+//	ipamctl export FILE --format csv|textfile     export allocations for spreadsheets or the node-exporter textfile collector
+//	ipamctl import FILE                           restore a backup, e.g. into a rebuilt cluster
+//
+// assign, release, cordon and uncordon post an event. They and import append,
+// with --audit-log, an audit record naming the caller.
+//
+// Run it with the webhook's config file and lease namespace, so that manual
+// assignments honor the same tenants and serialize with the webhook's own.
+// assign writes the protected pool annotations: the caller must be one of
+// the configured annotation editors.
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/user"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"go.uber.org/zap"
+
+	clientset "github.com/projectcalico/api/pkg/client/clientset_generated/clientset"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+
+	"admission-controller-03/pkg/admission"
+	"admission-controller-03/pkg/audit"
+	"admission-controller-03/pkg/config"
+)
+
+const usage = `Administer the IP pools assigned by the IPAM webhook.
+
+Usage:
+  ipamctl list [--zone ZONE] [--status STATUS]
+  ipamctl assign NAMESPACE POOL
+  ipamctl release POOL [--override] [--yes]
+  ipamctl cordon POOL
+  ipamctl uncordon POOL
+  ipamctl audit
+  ipamctl simulate --demand [TENANT@]ZONE=COUNT[,...]
+  ipamctl export FILE|- [--format json|yaml|csv|textfile]
+  ipamctl import FILE|-
+
+Flags:
+`
+
+func main() {
+	if len(os.Args) < 2 || os.Args[1] == "-h" || os.Args[1] == "--help" || os.Args[1] == "help" {
+		printUsage(newFlags(""))
+		os.Exit(0)
+	}
+	command := os.Args[1]
+	flags := newFlags(command)
+	kubeconfig := flags.String("kubeconfig", "", "path to the kubeconfig file, $KUBECONFIG or ~/.kube/config by default")
+	kubeContext := flags.String("context", "", "kubeconfig context to use")
+	configPath := flags.String("config", "", "path to the webhook's JSON allocation policy config file")
+	leaseNamespace := flags.String("lease-namespace", "", "namespace of the webhook's per-pool Leases; assignments are not serialized with the webhook's when empty")
+	recordAllocations := flags.Bool("record-allocations", false, "record assignments as IPPoolAllocations, as the webhook does with --record-allocations")
+	zone := flags.String("zone", "", "only list pools of this zone")
+	status := flags.String("status", "", "only list pools with this status label")
+	yes := flags.Bool("yes", false, "release without asking for confirmation")
+	override := flags.Bool("override", false, "release even if Calico IPAM still has addresses allocated from the pool")
+	auditLog := flags.String("audit-log", "", "append a JSON line per admin verb to this file (\"-\" for stdout)")
+	format := flags.String("format", "", "export format: json or yaml for a backup, csv or textfile for the allocations; by the file extension by default")
+	var demands []demand
+	flags.Func("demand", "hypothetical new namespaces to simulate, as [TENANT@]ZONE=COUNT; repeatable", func(value string) error {
+		return parseDemand(value, &demands)
+	})
+	if err := flags.Parse(os.Args[2:]); err != nil {
+		os.Exit(2)
+	}
+	args := flags.Args()
+	switch {
+	case command == "list" && len(args) == 0:
+	case command == "assign" && len(args) == 2:
+	case command == "release" && len(args) == 1:
+	case command == "cordon" && len(args) == 1:
+	case command == "uncordon" && len(args) == 1:
+	case command == "audit" && len(args) == 0:
+	case command == "simulate" && len(args) == 0:
+	case command == "export" && len(args) == 1:
+	case command == "import" && len(args) == 1:
+	default:
+		printUsage(flags)
+		os.Exit(2)
+	}
+
+	cfg, err := config.Load(*configPath, false)
+	if err != nil {
+		fmt.Println("Error loading config:", err)
+		os.Exit(1)
+	}
+	restConfig, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+		&clientcmd.ClientConfigLoadingRules{ExplicitPath: *kubeconfig, Precedence: clientcmd.NewDefaultClientConfigLoadingRules().Precedence},
+		&clientcmd.ConfigOverrides{CurrentContext: *kubeContext},
+	).ClientConfig()
+	if err != nil {
+		fmt.Println("Error building kubeconfig:", err)
+		os.Exit(1)
+	}
+	calicoClient, err := clientset.NewForConfig(restConfig)
+	if err != nil {
+		fmt.Println("Error creating Calico client:", err)
+		os.Exit(1)
+	}
+	k8sClient, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		fmt.Println("Error creating Kubernetes client:", err)
+		os.Exit(1)
+	}
+	dynamicClient, err := dynamic.NewForConfig(restConfig)
+	if err != nil {
+		fmt.Println("Error creating dynamic client:", err)
+		os.Exit(1)
+	}
+
+	controller := admission.NewAdmissionControllerFromClients(zap.NewNop(), cfg, calicoClient, k8sClient)
+	// Flushes the events of the admin verbs
+	defer controller.Shutdown()
+	controller.DynamicClient = dynamicClient
+	controller.DynamicReader = dynamicClient
+	controller.LeaseNamespace = *leaseNamespace
+	controller.RecordAllocations = *recordAllocations
+	if *auditLog != "" {
+		controller.Audit, err = audit.Open(*auditLog)
+		if err != nil {
+			fmt.Println("Error opening audit log:", err)
+			os.Exit(1)
+		}
+		defer controller.Audit.Close()
+	}
+
+	ctx := context.Background()
+	switch command {
+	case "list":
+		err = list(ctx, calicoClient, *zone, *status)
+	case "assign":
+		var cidr string
+		cidr, err = controller.AssignPool(ctx, args[0], args[1], caller(ctx, k8sClient))
+		if err == nil {
+			fmt.Printf("Assigned IP pool %s (%s) to namespace %s.\n", args[1], cidr, args[0])
+		}
+	case "release":
+		err = release(ctx, controller, calicoClient, args[0], caller(ctx, k8sClient), *override, *yes)
+	case "cordon":
+		if err = controller.CordonPool(ctx, args[0], caller(ctx, k8sClient)); err == nil {
+			fmt.Printf("Cordoned IP pool %s.\n", args[0])
+		}
+	case "uncordon":
+		if err = controller.UncordonPool(ctx, args[0], caller(ctx, k8sClient)); err == nil {
+			fmt.Printf("Uncordoned IP pool %s.\n", args[0])
+		}
+	case "audit":
+		err = auditDrift(ctx, controller)
+	case "simulate":
+		err = simulate(ctx, calicoClient, cfg, demands)
+	case "export":
+		err = exportState(ctx, controller, args[0], *format)
+	case "import":
+		err = importState(ctx, controller, args[0], caller(ctx, k8sClient))
+	}
+	if err != nil {
+		fmt.Println("Error:", err)
+		controller.Shutdown()
+		if controller.Audit != nil {
+			controller.Audit.Close()
+		}
+		os.Exit(1)
+	}
+}
+
+// caller returns the user the cluster authenticates the kubeconfig as, for
+// the audit record and events, or the local user when the cluster cannot
+// say.
+func caller(ctx context.Context, k8sClient kubernetes.Interface) string {
+	review, err := k8sClient.AuthenticationV1().SelfSubjectReviews().Create(ctx, &authenticationv1.SelfSubjectReview{}, metav1.CreateOptions{})
+	if err == nil && review.Status.UserInfo.Username != "" {
+		return review.Status.UserInfo.Username
+	}
+	if local, err := user.Current(); err == nil {
+		return "local:" + local.Username
+	}
+	return "unknown"
+}
+
+func newFlags(command string) *flag.FlagSet {
+	flags := flag.NewFlagSet("ipamctl "+command, flag.ContinueOnError)
+	flags.Usage = func() { printUsage(flags) }
+	return flags
+}
+
+func printUsage(flags *flag.FlagSet) {
+	fmt.Fprint(os.Stderr, usage)
+	flags.SetOutput(os.Stderr)
+	flags.PrintDefaults()
+}
+
+func list(ctx context.Context, calicoClient clientset.Interface, zone, status string) error {
+	ipPools, err := calicoClient.ProjectcalicoV3().IPPools().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("could not list IP pools: %v", err)
+	}
+	type row struct {
+		pool, cidr, zone, status, namespace, tenant string
+		cordoned                                    bool
+	}
+	var rows []row
+	for i := range ipPools.Items {
+		pool := &ipPools.Items[i]
+		labels := map[string]string{}
+		for key, value := range pool.Labels {
+			labels[strings.ToLower(key)] = value
+		}
+		if (zone != "" && labels["location"] != zone) || (status != "" && labels["status"] != status) {
+			continue
+		}
+		r := row{pool: pool.Name, cidr: pool.Spec.CIDR, zone: labels["location"], status: labels["status"], cordoned: labels[admission.PoolCordonedLabel] == "true"}
+		if alloc, ok := admission.PoolAllocation(pool); ok {
+			r.namespace, r.tenant = alloc.Namespace, alloc.Tenant
+		}
+		rows = append(rows, r)
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].zone != rows[j].zone {
+			return rows[i].zone < rows[j].zone
+		}
+		if rows[i].status != rows[j].status {
+			return rows[i].status < rows[j].status
+		}
+		return rows[i].pool < rows[j].pool
+	})
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "POOL\tCIDR\tZONE\tSTATUS\tCORDONED\tNAMESPACE\tTENANT")
+	for _, r := range rows {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%t\t%s\t%s\n", r.pool, r.cidr, orNone(r.zone), orNone(r.status), r.cordoned, orNone(r.namespace), orNone(r.tenant))
+	}
+	return tw.Flush()
+}
+
+func release(ctx context.Context, controller *admission.AdmissionController, calicoClient clientset.Interface, poolName, actor string, override, yes bool) error {
+	if !yes {
+		pool, err := calicoClient.ProjectcalicoV3().IPPools().Get(ctx, poolName, metav1.GetOptions{})
+		if err != nil {
+			return fmt.Errorf("could not get IP pool: %v", err)
+		}
+		owner := "<none>"
+		if alloc, ok := admission.PoolAllocation(pool); ok && alloc.Namespace != "" {
+			owner = alloc.Namespace
+		}
+		question := fmt.Sprintf("Release IP pool %s (%s), status %q, owner %s", poolName, pool.Spec.CIDR, pool.Labels["status"], owner)
+		if override {
+			question += ", even if addresses are still allocated from it"
+		}
+		fmt.Print(question + "? [y/N] ")
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if answer = strings.ToLower(strings.TrimSpace(answer)); answer != "y" && answer != "yes" {
+			fmt.Println("Aborted.")
+			return nil
+		}
+	}
+	if err := controller.ForceReleasePool(ctx, poolName, actor, override); err != nil {
+		return err
+	}
+	fmt.Printf("Released IP pool %s.\n", poolName)
+	return nil
+}
+
+func auditDrift(ctx context.Context, controller *admission.AdmissionController) error {
+	drifts, err := controller.DetectDrift(ctx)
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "KIND\tNAMESPACE\tPOOL\tDETAIL")
+	for _, drift := range drifts {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", drift.Kind, orNone(drift.Namespace), orNone(drift.Pool), drift.Detail)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if len(drifts) > 0 {
+		return fmt.Errorf("%d discrepancies found", len(drifts))
+	}
+	fmt.Println("\nNo drift found.")
+	return nil
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "<none>"
+	}
+	return s
+}
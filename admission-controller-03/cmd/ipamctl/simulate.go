@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"go.uber.org/zap"
+
+	crdv1 "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
+	clientset "github.com/projectcalico/api/pkg/client/clientset_generated/clientset"
+	calicofake "github.com/projectcalico/api/pkg/client/clientset_generated/clientset/fake"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8sruntime "k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+
+	"admission-controller-03/pkg/admission"
+	"admission-controller-03/pkg/config"
+)
+
+// Reasons the webhook denies a namespace with when there is no pool left for
+// it.
+const (
+	reasonPoolsExhausted            = "PoolsExhausted"
+	reasonAggregateAllocationFailed = "AggregateAllocationFailed"
+)
+
+// demand is a number of hypothetical new namespaces of a tenant, or of no
+// tenant, in a zone.
+type demand struct {
+	tenant, zone string
+	count        int
+}
+
+func (d demand) String() string {
+	if d.tenant == "" {
+		return d.zone
+	}
+	return d.tenant + "@" + d.zone
+}
+
+// parseDemand parses [TENANT@]ZONE=COUNT, comma separated.
+func parseDemand(value string, demands *[]demand) error {
+	for _, item := range strings.Split(value, ",") {
+		target, count, ok := strings.Cut(strings.TrimSpace(item), "=")
+		n, err := strconv.Atoi(count)
+		if !ok || err != nil || n <= 0 {
+			return fmt.Errorf("invalid demand %q: must be [TENANT@]ZONE=COUNT", item)
+		}
+		d := demand{zone: target, count: n}
+		if tenant, zone, found := strings.Cut(target, "@"); found {
+			d.tenant, d.zone = tenant, zone
+		}
+		if d.zone == "" {
+			return fmt.Errorf("invalid demand %q: no zone", item)
+		}
+		*demands = append(*demands, d)
+	}
+	return nil
+}
+
+// outcome is how a demand fared in one simulation run.
+type outcome struct {
+	assigned int
+	// failedAt is the namespace of the demand the first denial was for, 0
+	// when every namespace got a pool
+	failedAt int
+	reason   string
+}
+
+// simulate replays the demands against a copy of the current pool inventory
+// through the webhook's own admission handler, and with the hierarchy model
+// repeats it under alternative prefix lengths.
+func simulate(ctx context.Context, calicoClient clientset.Interface, cfg *config.Config, demands []demand) error {
+	if len(demands) == 0 {
+		return fmt.Errorf("nothing to simulate, set --demand")
+	}
+	ipPools, err := calicoClient.ProjectcalicoV3().IPPools().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("could not list IP pools: %v", err)
+	}
+
+	outcomes, remaining, err := runSimulation(ipPools.Items, cfg, demands)
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "DEMAND\tREQUESTED\tASSIGNED\tFAILS AT\tREASON")
+	for i, d := range demands {
+		o := outcomes[i]
+		failsAt := "-"
+		if o.failedAt > 0 {
+			failsAt = fmt.Sprintf("namespace %d", o.failedAt)
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%s\t%s\n", d, d.count, o.assigned, failsAt, orNone(o.reason))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	// When each zone runs out, counting the zone's namespaces in the order
+	// they were admitted
+	fmt.Println()
+	zones := map[string]bool{}
+	for _, d := range demands {
+		zones[d.zone] = true
+	}
+	for _, zone := range sortedKeys(zones) {
+		assigned, requested, exhausted := 0, 0, false
+		for i, d := range demands {
+			if d.zone != zone {
+				continue
+			}
+			assigned += outcomes[i].assigned
+			requested += d.count
+			exhausted = exhausted || outcomes[i].reason == reasonPoolsExhausted || outcomes[i].reason == reasonAggregateAllocationFailed
+		}
+		if exhausted {
+			fmt.Printf("Zone %s exhausts after %d of %d new namespaces.\n", zone, assigned, requested)
+		} else {
+			fmt.Printf("Zone %s takes all %d new namespaces, %d pools stay available.\n", zone, requested, remaining[zone])
+		}
+	}
+
+	if satisfied(demands, outcomes) {
+		return nil
+	}
+	if cfg.Hierarchy == nil {
+		fmt.Println("\nPools are static without the hierarchy model: more namespaces only fit with more pools, e.g. a smaller splitter.childPrefixLength.")
+		return nil
+	}
+	return simulateAlternatives(ipPools.Items, cfg, demands)
+}
+
+// simulateAlternatives reruns the simulation with smaller namespace pools and
+// with larger team aggregates, and reports which would satisfy the demand.
+func simulateAlternatives(pools []crdv1.IPPool, cfg *config.Config, demands []demand) error {
+	type alternative struct {
+		policy string
+		change func(*config.Config)
+	}
+	h := cfg.Hierarchy
+	var alternatives []alternative
+	for length := h.NamespacePrefixLength + 1; length <= min(h.NamespacePrefixLength+3, 32); length++ {
+		alternatives = append(alternatives, alternative{fmt.Sprintf("hierarchy.namespacePrefixLength /%d", length), func(c *config.Config) {
+			c.Hierarchy.NamespacePrefixLength = length
+			// The tenant defaults would override the change
+			for name, t := range c.Tenants {
+				t.DefaultPrefixLength = 0
+				c.Tenants[name] = t
+			}
+		}})
+	}
+	for length := h.TeamPrefixLength - 1; length >= max(h.TeamPrefixLength-2, 1); length-- {
+		alternatives = append(alternatives, alternative{fmt.Sprintf("hierarchy.teamPrefixLength /%d", length), func(c *config.Config) {
+			c.Hierarchy.TeamPrefixLength = length
+		}})
+	}
+
+	fmt.Println("\nPrefix-length changes:")
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "POLICY\tASSIGNED\tSATISFIES DEMAND")
+	for _, alt := range alternatives {
+		changed, err := cloneConfig(cfg)
+		if err != nil {
+			return err
+		}
+		alt.change(changed)
+		if err := changed.Validate(); err != nil {
+			continue
+		}
+		outcomes, _, err := runSimulation(pools, changed, demands)
+		if err != nil {
+			return err
+		}
+		assigned, requested := 0, 0
+		for i, d := range demands {
+			assigned += outcomes[i].assigned
+			requested += d.count
+		}
+		fmt.Fprintf(tw, "%s\t%d/%d\t%t\n", alt.policy, assigned, requested, satisfied(demands, outcomes))
+	}
+	return tw.Flush()
+}
+
+// runSimulation admits the demands' namespaces one at a time, round robin
+// across the demands so that they compete for shared pools as they would in
+// production, each through a controller serving the demand's zone. It
+// returns the outcome of every demand and the pools left available per zone.
+func runSimulation(pools []crdv1.IPPool, cfg *config.Config, demands []demand) ([]outcome, map[string]int, error) {
+	objects := make([]k8sruntime.Object, 0, len(pools))
+	for i := range pools {
+		objects = append(objects, pools[i].DeepCopy())
+	}
+	calicoClient := calicofake.NewSimpleClientset(objects...)
+	k8sClient := k8sfake.NewSimpleClientset()
+
+	controllers := make([]*admission.AdmissionController, len(demands))
+	for i, d := range demands {
+		zoneConfig, err := cloneConfig(cfg)
+		if err != nil {
+			return nil, nil, err
+		}
+		zoneConfig.Location = d.zone
+		if t, ok := zoneConfig.Tenants[d.tenant]; ok {
+			t.AllowedZones = []string{d.zone}
+			zoneConfig.Tenants[d.tenant] = t
+		}
+		controller := admission.NewAdmissionControllerFromClients(zap.NewNop(), zoneConfig, calicoClient, k8sClient)
+		controller.Shutdown()
+		controller.Recorder = &record.FakeRecorder{}
+		controllers[i] = controller
+	}
+
+	outcomes := make([]outcome, len(demands))
+	for n, pending := 1, true; pending; n++ {
+		pending = false
+		for i, d := range demands {
+			if n > d.count || outcomes[i].failedAt > 0 {
+				continue
+			}
+			pending = true
+			ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("simulated-%d-%d", i, n)}}
+			if d.tenant != "" {
+				ns.Labels = map[string]string{cfg.TenantLabel: d.tenant}
+			}
+			response, err := admit(controllers[i], ns)
+			if err != nil {
+				return nil, nil, err
+			}
+			if response.Allowed {
+				outcomes[i].assigned++
+				continue
+			}
+			outcomes[i].failedAt = n
+			if response.Result != nil {
+				outcomes[i].reason = string(response.Result.Reason)
+			}
+		}
+	}
+
+	left, err := calicoClient.ProjectcalicoV3().IPPools().List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not list simulated IP pools: %v", err)
+	}
+	remaining := map[string]int{}
+	for _, pool := range left.Items {
+		labels := map[string]string{}
+		for key, value := range pool.Labels {
+			labels[strings.ToLower(key)] = value
+		}
+		if labels["status"] == "available" && labels[admission.PoolCordonedLabel] != "true" {
+			remaining[labels["location"]]++
+		}
+	}
+	return outcomes, remaining, nil
+}
+
+// admit sends the CREATE of a namespace through the controller's admission
+// handler.
+func admit(controller *admission.AdmissionController, ns *corev1.Namespace) (*admissionv1.AdmissionResponse, error) {
+	raw, err := json.Marshal(ns)
+	if err != nil {
+		return nil, err
+	}
+	body, err := json.Marshal(admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+		Request: &admissionv1.AdmissionRequest{
+			UID:       types.UID(ns.Name),
+			Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Namespace"},
+			Name:      ns.Name,
+			Operation: admissionv1.Create,
+			Object:    k8sruntime.RawExtension{Raw: raw},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	w := httptest.NewRecorder()
+	controller.HandleAdmissionReview(w, httptest.NewRequest("POST", "/mutate", bytes.NewReader(body)))
+	var review admissionv1.AdmissionReview
+	if err := json.NewDecoder(w.Body).Decode(&review); err != nil {
+		return nil, fmt.Errorf("could not decode simulated admission response: %v", err)
+	}
+	if review.Response == nil {
+		return nil, fmt.Errorf("empty simulated admission response")
+	}
+	return review.Response, nil
+}
+
+func satisfied(demands []demand, outcomes []outcome) bool {
+	for i, d := range demands {
+		if outcomes[i].assigned < d.count {
+			return false
+		}
+	}
+	return true
+}
+
+// cloneConfig returns a deep copy of cfg, to change per run.
+func cloneConfig(cfg *config.Config) (*config.Config, error) {
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("could not copy config: %v", err)
+	}
+	var clone config.Config
+	if err := json.Unmarshal(data, &clone); err != nil {
+		return nil, fmt.Errorf("could not copy config: %v", err)
+	}
+	return &clone, nil
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,323 @@
+// Command kubectl-ippool is a kubectl plugin that shows the webhook's IP pool
+// inventory and assignments as tables, from the pool labels and allocation
+// records, so that they need not be decoded by hand. Install it on the PATH
+// and run it as kubectl ippool:
+//
+//	kubectl ippool status               pools per zone by status
+//	kubectl ippool get <namespace>      the pools a namespace holds
+//	kubectl ippool free                 the pools available for assignment
+//	kubectl ippool history [namespace]  allocation records, oldest first
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	crdv1 "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
+	clientset "github.com/projectcalico/api/pkg/client/clientset_generated/clientset"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/duration"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+
+	"admission-controller-03/pkg/admission"
+	"admission-controller-03/pkg/allocation"
+)
+
+// statusColumns are the pool statuses status shows a column for; any other
+// status is counted under OTHER.
+var statusColumns = []string{"available", "pending", "used", "external", "quarantined"}
+
+const usage = `Show the IP pools assigned by the IPAM webhook.
+
+Usage:
+  kubectl ippool status [--zone ZONE]
+  kubectl ippool get NAMESPACE
+  kubectl ippool free [--zone ZONE]
+  kubectl ippool history [NAMESPACE]
+
+Flags:
+`
+
+func main() {
+	if len(os.Args) < 2 || os.Args[1] == "-h" || os.Args[1] == "--help" || os.Args[1] == "help" {
+		printUsage(newFlags(""))
+		os.Exit(0)
+	}
+	command := os.Args[1]
+	flags := newFlags(command)
+	kubeconfig := flags.String("kubeconfig", "", "path to the kubeconfig file, $KUBECONFIG or ~/.kube/config by default")
+	kubeContext := flags.String("context", "", "kubeconfig context to use")
+	zone := flags.String("zone", "", "only show pools of this zone (status, free)")
+	if err := flags.Parse(os.Args[2:]); err != nil {
+		os.Exit(2)
+	}
+
+	restConfig, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+		&clientcmd.ClientConfigLoadingRules{ExplicitPath: *kubeconfig, Precedence: clientcmd.NewDefaultClientConfigLoadingRules().Precedence},
+		&clientcmd.ConfigOverrides{CurrentContext: *kubeContext},
+	).ClientConfig()
+	if err != nil {
+		fmt.Println("Error building kubeconfig:", err)
+		os.Exit(1)
+	}
+
+	ctx := context.Background()
+	args := flags.Args()
+	switch {
+	case command == "status" && len(args) == 0:
+		err = status(ctx, restConfig, *zone)
+	case command == "get" && len(args) == 1:
+		err = get(ctx, restConfig, args[0])
+	case command == "free" && len(args) == 0:
+		err = free(ctx, restConfig, *zone)
+	case command == "history" && len(args) <= 1:
+		namespace := ""
+		if len(args) == 1 {
+			namespace = args[0]
+		}
+		err = history(ctx, restConfig, namespace)
+	default:
+		printUsage(flags)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+}
+
+func newFlags(command string) *flag.FlagSet {
+	flags := flag.NewFlagSet("kubectl ippool "+command, flag.ContinueOnError)
+	flags.Usage = func() { printUsage(flags) }
+	return flags
+}
+
+func printUsage(flags *flag.FlagSet) {
+	fmt.Fprint(os.Stderr, usage)
+	flags.SetOutput(os.Stderr)
+	flags.PrintDefaults()
+}
+
+func listPools(ctx context.Context, restConfig *rest.Config) ([]crdv1.IPPool, error) {
+	calicoClient, err := clientset.NewForConfig(restConfig)
+	if err != nil {
+		return nil, fmt.Errorf("could not create Calico clientset: %v", err)
+	}
+	pools, err := calicoClient.ProjectcalicoV3().IPPools().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("could not list IP pools: %v", err)
+	}
+	return pools.Items, nil
+}
+
+// listRecords lists the allocation records. errNoRecords reports that the
+// IPPoolAllocation CRD is not installed, i.e. the webhook does not record
+// assignments.
+func listRecords(ctx context.Context, restConfig *rest.Config) ([]*allocation.IPPoolAllocation, error) {
+	dynamicClient, err := dynamic.NewForConfig(restConfig)
+	if err != nil {
+		return nil, fmt.Errorf("could not create dynamic client: %v", err)
+	}
+	list, err := dynamicClient.Resource(allocation.Resource).List(ctx, metav1.ListOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, errNoRecords
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not list IP pool allocations: %v", err)
+	}
+	records := make([]*allocation.IPPoolAllocation, 0, len(list.Items))
+	for i := range list.Items {
+		record, err := allocation.FromUnstructured(&list.Items[i])
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+var errNoRecords = errors.New("allocation records are not enabled, the IPPoolAllocation CRD is not installed")
+
+func status(ctx context.Context, restConfig *rest.Config, zone string) error {
+	pools, err := listPools(ctx, restConfig)
+	if err != nil {
+		return err
+	}
+	counts := map[string]map[string]int{}
+	for _, pool := range pools {
+		labels := poolLabels(&pool)
+		poolZone, poolStatus := labels["location"], labels["status"]
+		if zone != "" && poolZone != zone {
+			continue
+		}
+		if counts[poolZone] == nil {
+			counts[poolZone] = map[string]int{}
+		}
+		counts[poolZone][poolStatus]++
+	}
+	zones := make([]string, 0, len(counts))
+	for z := range counts {
+		zones = append(zones, z)
+	}
+	sort.Strings(zones)
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ZONE\tAVAILABLE\tPENDING\tUSED\tEXTERNAL\tQUARANTINED\tOTHER\tTOTAL")
+	for _, z := range zones {
+		total := 0
+		for _, count := range counts[z] {
+			total += count
+		}
+		other := total
+		fmt.Fprint(tw, orNone(z))
+		for _, s := range statusColumns {
+			fmt.Fprintf(tw, "\t%d", counts[z][s])
+			other -= counts[z][s]
+		}
+		fmt.Fprintf(tw, "\t%d\t%d\n", other, total)
+	}
+	return tw.Flush()
+}
+
+func get(ctx context.Context, restConfig *rest.Config, namespace string) error {
+	pools, err := listPools(ctx, restConfig)
+	if err != nil {
+		return err
+	}
+	var held []admission.Allocation
+	for i := range pools {
+		if alloc, ok := admission.PoolAllocation(&pools[i]); ok && alloc.Namespace == namespace {
+			held = append(held, alloc)
+		}
+	}
+	if len(held) == 0 {
+		return fmt.Errorf("namespace %s holds no IP pool", namespace)
+	}
+
+	// The phase comes from the pool's unfinished record, if recorded
+	phases := map[string]allocation.Phase{}
+	records, err := listRecords(ctx, restConfig)
+	if err != nil && !errors.Is(err, errNoRecords) {
+		return err
+	}
+	for _, record := range records {
+		if record.Spec.Namespace == namespace && !record.Status.Finished() {
+			phases[record.Status.Pool] = record.Status.Phase
+		}
+	}
+
+	sort.Slice(held, func(i, j int) bool { return held[i].Pool < held[j].Pool })
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "POOL\tCIDR\tZONE\tTENANT\tSTATE\tPHASE\tADDRESSES\tAGE")
+	for _, alloc := range held {
+		age := "<unknown>"
+		if alloc.AssignedAt != nil {
+			age = duration.HumanDuration(time.Since(*alloc.AssignedAt))
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", alloc.Pool, alloc.CIDR, orNone(alloc.Zone), orNone(alloc.Tenant),
+			alloc.State, orNone(string(phases[alloc.Pool])), addresses(alloc.CIDR), age)
+	}
+	return tw.Flush()
+}
+
+func free(ctx context.Context, restConfig *rest.Config, zone string) error {
+	pools, err := listPools(ctx, restConfig)
+	if err != nil {
+		return err
+	}
+	type freePool struct {
+		name, cidr, zone string
+	}
+	var available []freePool
+	for i := range pools {
+		labels := poolLabels(&pools[i])
+		if labels["status"] == "available" && labels[admission.PoolCordonedLabel] != "true" && (zone == "" || labels["location"] == zone) {
+			available = append(available, freePool{pools[i].Name, pools[i].Spec.CIDR, labels["location"]})
+		}
+	}
+	sort.Slice(available, func(i, j int) bool {
+		if available[i].zone != available[j].zone {
+			return available[i].zone < available[j].zone
+		}
+		return available[i].name < available[j].name
+	})
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "POOL\tCIDR\tZONE\tADDRESSES")
+	for _, pool := range available {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", pool.name, pool.cidr, orNone(pool.zone), addresses(pool.cidr))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	fmt.Printf("\n%d pool(s) available.\n", len(available))
+	return nil
+}
+
+func history(ctx context.Context, restConfig *rest.Config, namespace string) error {
+	records, err := listRecords(ctx, restConfig)
+	if err != nil {
+		return err
+	}
+	var shown []*allocation.IPPoolAllocation
+	for _, record := range records {
+		if namespace == "" || record.Spec.Namespace == namespace {
+			shown = append(shown, record)
+		}
+	}
+	sort.Slice(shown, func(i, j int) bool {
+		return shown[i].CreationTimestamp.Before(&shown[j].CreationTimestamp)
+	})
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "CREATED\tNAMESPACE\tPOOL\tCIDR\tPHASE\tREASON\tSINCE")
+	for _, record := range shown {
+		since := "<unknown>"
+		if t := record.Status.LastPhaseTransitionTime; t != nil {
+			since = duration.HumanDuration(time.Since(t.Time))
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", record.CreationTimestamp.UTC().Format(time.RFC3339),
+			orNone(record.Spec.Namespace), orNone(record.Status.Pool), orNone(record.Status.CIDR),
+			orNone(string(record.Status.Phase)), orNone(record.Status.Reason), since)
+	}
+	return tw.Flush()
+}
+
+// poolLabels returns a pool's labels with lower-case keys, as the webhook
+// reads them.
+func poolLabels(pool *crdv1.IPPool) map[string]string {
+	labels := make(map[string]string, len(pool.Labels))
+	for key, value := range pool.Labels {
+		labels[strings.ToLower(key)] = value
+	}
+	return labels
+}
+
+// addresses returns the number of addresses of an IPv4 CIDR, or "-" for
+// anything else.
+func addresses(cidr string) string {
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil || ipNet.IP.To4() == nil {
+		return "-"
+	}
+	ones, bits := ipNet.Mask.Size()
+	return fmt.Sprint(1 << (bits - ones))
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "<none>"
+	}
+	return s
+}
@@ -1,43 +1,345 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"strings"
+	"time"
 
+	"github.com/go-logr/zapr"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	ctrl "sigs.k8s.io/controller-runtime"
+	ctrlmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
 
+	"admission-common/logging"
 	"admission-controller-03/pkg/admission"
+	"admission-controller-03/pkg/alert"
+	"admission-controller-03/pkg/allocator"
+	"admission-controller-03/pkg/apimetrics"
+	"admission-controller-03/pkg/audit"
+	"admission-controller-03/pkg/backend"
+	"admission-controller-03/pkg/certs"
+	"admission-controller-03/pkg/cni"
+	"admission-controller-03/pkg/config"
+	"admission-controller-03/pkg/notify"
+	"admission-controller-03/pkg/policy"
+	"admission-controller-03/pkg/region"
+	"admission-controller-03/pkg/rules"
+	"admission-controller-03/pkg/sink"
+	"admission-controller-03/pkg/tracing"
+	"admission-controller-03/pkg/version"
 )
 
 func main() {
+	configPath := flag.String("config", "", "path to the JSON allocation policy config file")
+	scanWorkers := flag.Int("scan-workers", 8, "number of concurrent workers used by the startup consistency scan")
+	scanTimeout := flag.Duration("startup-scan-timeout", 0, "report ready after this long even if the startup scan is unfinished; the remainder continues in the background (0 waits for the full scan)")
+	strict := flag.Bool("strict", false, "deny unexpected kinds/operations, reject unknown config fields and fail readiness on webhook misconfiguration")
+	webhookConfigName := flag.String("webhook-config-name", "", "name of the MutatingWebhookConfiguration verified in strict mode; with --install-crds, the CRD conversion webhook is reached through its service")
+	readTokenFile := flag.String("read-token-file", "", "service account token used for list/get calls (defaults to the pod's own identity)")
+	writeTokenFile := flag.String("write-token-file", "", "service account token used for IP pool mutations (defaults to the pod's own identity)")
+	releaseInterval := flag.Duration("release-interval", 15*time.Second, "how long a failed release of a terminating namespace's pools, or a namespace whose workload endpoints are still draining, waits before it is retried")
+	releaseStuckAfter := flag.Duration("release-stuck-after", 10*time.Minute, "how long a terminating namespace may be held by the release finalizer before it is reported as stuck (0 never reports)")
+	gcInterval := flag.Duration("gc-interval", 10*time.Minute, "how often pools leaked by namespaces deleted while the webhook was down are reclaimed (0 disables)")
+	driftAuditInterval := flag.Duration("drift-audit-interval", 15*time.Minute, "how often namespace annotations and pool labels are audited for drift after the startup scan (0 disables)")
+	failurePolicy := flag.String("failure-policy", "", "per-operation behavior on internal errors such as an unreachable Calico API, e.g. \"CREATE=open,DELETE=closed\": closed denies the request, open admits it with a warning; namespaces created open are assigned a pool later (unlisted operations are closed)")
+	claimBindInterval := flag.Duration("claim-bind-interval", 10*time.Second, "how often pending PoolClaims are bound when assignmentMode is \"claim\"")
+	deferredInterval := flag.Duration("deferred-assignment-interval", 30*time.Second, "how often namespaces admitted without a pool under --failure-policy CREATE=open are retried")
+	recordAllocations := flag.Bool("record-allocations", false, "record every pool assignment as a cluster-scoped IPPoolAllocation; the CRD must be installed, see --install-crds")
+	installCRDs := flag.Bool("install-crds", false, "create or update the IPPoolAllocation, Tenant and PoolClaim CRDs at startup through the write identity")
+	tenantSyncInterval := flag.Duration("tenant-sync-interval", 30*time.Second, "how often Tenant resources are read; they take precedence over the tenants of the config file")
+	growthInterval := flag.Duration("growth-interval", 5*time.Minute, "how often namespace address utilization is checked for allocation growth")
+	autoscaleInterval := flag.Duration("autoscale-interval", 2*time.Minute, "how often tenant pool utilization is checked for autoscaling when it is configured")
+	egressInterval := flag.Duration("egress-interval", time.Minute, "how often namespaces are given egress gateway pools when egress is configured")
+	grpcAddr := flag.String("grpc-addr", "", "address the gRPC allocation service for consumers outside Kubernetes, and its grpc.health.v1 service, listen on, e.g. :9443 (empty disables; requires api.tokenFile)")
+	regionSyncInterval := flag.Duration("region-sync-interval", 30*time.Second, "how often region state is exchanged with peer regions")
+	otlpEndpoint := flag.String("otlp-endpoint", "", "OTLP/HTTP collector (host:port) to export traces to; tracing is off when empty")
+	otlpInsecure := flag.Bool("otlp-insecure", false, "export traces over plain HTTP")
+	auditLog := flag.String("audit-log", "", "append a JSON line per admission decision to this file (\"-\" for stdout); auditing is off when empty")
+	requestTimeout := flag.Duration("request-timeout", 10*time.Second, "deadline for the API calls of one admission request; the API server's webhook timeout lowers it further")
+	leaderElect := flag.Bool("leader-elect", true, "run the background loops only on the replica holding the leader Lease in the lease namespace; admission is served by every replica")
+	leaseNamespace := flag.String("lease-namespace", "", "namespace of the leader Lease and the per-pool Leases that serialize concurrent assignments (defaults to the pod's namespace)")
+	healthProbeAddr := flag.String("health-probe-bind-address", ":8081", "address the /healthz and /readyz probes of the controller manager are served on")
+	certExpiryWarning := flag.Duration("cert-expiry-warning", 30*24*time.Hour, "warn when the serving certificate expires within this window")
+	var logOptions logging.Options
+	logOptions.RegisterFlags(flag.CommandLine)
+	var vaultOptions certs.VaultOptions
+	vaultOptions.RegisterFlags(flag.CommandLine)
+	flag.Parse()
+
 	// Create a logger
-	logger, err := zap.NewProduction()
+	logger, err := logging.New(logOptions)
 	if err != nil {
 		log.Fatalf("Can't initialize zap logger: %v", err)
 	}
 	defer logger.Sync() // flushes buffer, if any
-	controller, err := admission.NewAdmissionController(logger)
+	if *otlpEndpoint != "" {
+		shutdown, err := tracing.Setup(context.Background(), *otlpEndpoint, *otlpInsecure)
+		if err != nil {
+			logger.Fatal("could not set up tracing", zap.Error(err))
+		}
+		defer shutdown(context.Background())
+	}
+	cfg, err := config.Load(*configPath, *strict)
+	if err != nil {
+		logger.Fatal("could not load config", zap.Error(err))
+	}
+	controller, err := admission.NewAdmissionController(logger, cfg, admission.Identities{
+		ReadTokenFile:  *readTokenFile,
+		WriteTokenFile: *writeTokenFile,
+	})
 	if err != nil {
 		logger.Error("could not create admission controller", zap.Error(err))
 		panic(fmt.Sprintf("Failed to create admission controller: %v", err))
 
 	}
+	controller.RequestTimeout = *requestTimeout
+	controller.FailOpen, err = admission.ParseFailurePolicy(*failurePolicy)
+	if err != nil {
+		logger.Fatal("could not parse failure policy", zap.Error(err))
+	}
+	controller.LeaseNamespace = *leaseNamespace
+	if controller.LeaseNamespace == "" {
+		namespace, err := os.ReadFile(admission.ServiceAccountNamespaceFile)
+		if err != nil {
+			logger.Fatal("could not determine the lease namespace, set --lease-namespace", zap.Error(err))
+		}
+		controller.LeaseNamespace = strings.TrimSpace(string(namespace))
+	}
+	controller.RecordAllocations = *recordAllocations
+	if err := controller.VerifyIdentities(context.Background()); err != nil {
+		logger.Fatal("could not verify service account permissions", zap.Error(err))
+	}
+	if *installCRDs {
+		if err := controller.InstallCRDs(context.Background(), *webhookConfigName); err != nil {
+			logger.Fatal("could not install CRDs", zap.Error(err))
+		}
+	}
 
-	http.HandleFunc("/mutate", controller.HandleAdmissionReview)
-	server := &http.Server{
-		Addr: ":8443",
+	logger.Info("Loaded allocation policy", zap.String("policyVersion", cfg.Hash()), zap.String("webhookVersion", version.Version))
+	controller.Strict = *strict
+	if *auditLog != "" {
+		controller.Audit, err = audit.Open(*auditLog)
+		if err != nil {
+			logger.Fatal("could not open audit log", zap.Error(err))
+		}
+		defer controller.Audit.Close()
+	}
+	if cfg.Notifications != nil {
+		controller.Notifier, err = notify.New(logger, cfg.Notifications)
+		if err != nil {
+			logger.Fatal("could not set up owner notifications", zap.Error(err))
+		}
+	}
+	if cfg.Alerts != nil {
+		controller.Alerter, err = alert.New(logger, cfg.Alerts)
+		if err != nil {
+			logger.Fatal("could not set up alerts", zap.Error(err))
+		}
+	}
+	if cfg.Policy != nil {
+		controller.Policy = policy.New(cfg.Policy)
+	}
+	if len(cfg.SelectionRules) > 0 {
+		controller.SelectionRules, err = rules.New(cfg.SelectionRules)
+		if err != nil {
+			logger.Fatal("could not compile selection rules", zap.Error(err))
+		}
+	}
+	if cfg.API != nil && cfg.API.TokenFile != "" {
+		token, err := os.ReadFile(cfg.API.TokenFile)
+		if err != nil {
+			logger.Fatal("could not read API token", zap.Error(err))
+		}
+		controller.APIToken = strings.TrimSpace(string(token))
+	}
+	if cfg.API != nil {
+		controller.APIKubernetesAuth = cfg.API.KubernetesAuth
+		controller.APIAudience = cfg.API.Audience
+	}
+	if cfg.Backend != nil {
+		controller.Backend, err = backend.New(cfg.Backend, cfg.Location)
+		if err != nil {
+			logger.Fatal("could not set up IPAM backend", zap.Error(err))
+		}
+	}
+	controller.CNI = cni.New(cfg.CNI, controller.DynamicClient)
+	logger.Info("Applying namespace subnets to CNI", zap.String("cni", controller.CNI.Name()))
+	if cfg.Sink != nil {
+		controller.Sink, err = sink.New(cfg.Sink)
+		if err != nil {
+			logger.Fatal("could not set up allocation sink", zap.Error(err))
+		}
+		defer controller.Sink.Close()
+	}
+	ctrl.SetLogger(zapr.NewLogger(logger))
+	options := controller.ManagerOptions(*leaderElect)
+	options.HealthProbeBindAddress = *healthProbeAddr
+	mgr, err := ctrl.NewManager(controller.ReadConfig, options)
+	if err != nil {
+		logger.Fatal("could not create controller manager", zap.Error(err))
+	}
+	if *strict && *webhookConfigName != "" {
+		err = controller.AddLoops(mgr, func(ctx context.Context) {
+			controller.WatchWebhookConfiguration(ctx, *webhookConfigName, time.Minute)
+		})
+		if err != nil {
+			logger.Fatal("could not add webhook configuration watch", zap.Error(err))
+		}
+	} else if *strict {
+		logger.Warn("Strict mode without --webhook-config-name, live webhook configuration is not verified")
+	}
+
+	err = controller.SetupManager(mgr, admission.Loops{
+		ReleaseRetry:       *releaseInterval,
+		ReleaseStuckAfter:  *releaseStuckAfter,
+		Bind:               time.Minute,
+		GC:                 *gcInterval,
+		DeferredAssignment: *deferredInterval,
+		ClaimBind:          *claimBindInterval,
+		Allocation:         time.Minute,
+		Cleanup:            time.Minute,
+		Growth:             *growthInterval,
+		Autoscale:          *autoscaleInterval,
+		Exhaustion:         time.Minute,
+		DriftAudit:         *driftAuditInterval,
+		ServiceIPSweep:     time.Minute,
+		Egress:             *egressInterval,
+		TenantSync:         *tenantSyncInterval,
+		ScanWorkers:        *scanWorkers,
+		ScanTimeout:        *scanTimeout,
+	})
+	if err != nil {
+		logger.Fatal("could not set up controller manager", zap.Error(err))
+	}
+
+	var reloader *certs.Reloader
+	if vaultOptions.Enabled() {
+		if err := vaultOptions.Validate(); err != nil {
+			logger.Fatal("invalid Vault options", zap.Error(err))
+		}
+		issuer, err := certs.NewVaultIssuer(vaultOptions)
+		if err != nil {
+			logger.Fatal("could not set up Vault issuer", zap.Error(err))
+		}
+		reloader, err = certs.NewVaultReloader(context.Background(), issuer, *certExpiryWarning, logger)
+		if err != nil {
+			logger.Fatal("could not issue serving certificate from Vault", zap.Error(err))
+		}
+	} else {
+		// Use the default file paths where the secrets are mounted in Kubernetes
+		certPath := "/etc/webhook/certs/tls.crt"
+		keyPath := "/etc/webhook/certs/tls.key"
+
+		reloader, err = certs.NewReloader(certPath, keyPath, *certExpiryWarning, logger)
+		if err != nil {
+			logger.Fatal("could not load serving certificate", zap.Error(err))
+		}
+	}
+	prometheus.MustRegister(reloader)
+	if err := controller.AddLoops(mgr, func(ctx context.Context) { reloader.Run(ctx, time.Minute) }); err != nil {
+		logger.Fatal("could not add certificate reloader", zap.Error(err))
+	}
+	server := webhook.NewServer(webhook.Options{
+		Port: 8443,
+		TLSOpts: []func(*tls.Config){func(c *tls.Config) {
+			c.GetCertificate = reloader.GetCertificate
+		}},
+	})
+	if err := mgr.Add(server); err != nil {
+		logger.Fatal("could not add webhook server", zap.Error(err))
 	}
-	fmt.Println("Starting webhook server on port 8443...")
-	// Update the path to the absolute path on your Windows system
-	// certPath := "C:\\Users\\Mansoor\\Desktop\\kube\\admission_controller.crt"
-	// keyPath := "C:\\Users\\Mansoor\\Desktop\\kube\\admission_controller.key"
 
-	// Use the default file paths where the secrets are mounted in Kubernetes
-	certPath := "/etc/webhook/certs/tls.crt"
-	keyPath := "/etc/webhook/certs/tls.key"
+	// otelhttp continues traces propagated by the API server
+	server.Register("/mutate", otelhttp.NewHandler(http.HandlerFunc(controller.HandleAdmissionReview), "mutate"))
+	server.Register("/validate", otelhttp.NewHandler(http.HandlerFunc(controller.HandleValidation), "validate"))
+	server.Register("/default", otelhttp.NewHandler(http.HandlerFunc(controller.HandleDefaulting), "default"))
+	server.Register(admission.ConversionPath, otelhttp.NewHandler(http.HandlerFunc(controller.HandleConversion), "convert"))
+	server.Register("/readyz", http.HandlerFunc(controller.HandleReadyz))
+	server.Register(admission.AllocationsPath, http.HandlerFunc(controller.HandleAllocations))
+	server.Register(admission.AllocationsPath+"/", http.HandlerFunc(controller.HandleAllocations))
+	server.Register(admission.PoolsPath, http.HandlerFunc(controller.HandlePools))
+	server.Register(admission.PoolsPath+"/", http.HandlerFunc(controller.HandlePoolAction))
+	server.Register(admission.OpenAPIPath, http.HandlerFunc(controller.HandleOpenAPI))
+	server.Register(admission.UIPath, http.HandlerFunc(controller.HandleUI))
+	server.Register(admission.UIPath+"/", http.HandlerFunc(controller.HandleUI))
+	prometheus.MustRegister(controller.NewPoolCollector())
+	prometheus.MustRegister(admission.AllocationCollectors()...)
+	prometheus.MustRegister(admission.GCCollectors()...)
+	prometheus.MustRegister(admission.TerminationCollectors()...)
+	prometheus.MustRegister(admission.DriftCollectors()...)
+	prometheus.MustRegister(admission.LeaderCollectors()...)
+	if err := apimetrics.Register(prometheus.DefaultRegisterer); err != nil {
+		logger.Fatal("could not register API client metrics", zap.Error(err))
+	}
+	// The manager's own controller and webhook metrics live in its registry
+	server.Register("/metrics", promhttp.HandlerFor(prometheus.Gatherers{prometheus.DefaultGatherer, ctrlmetrics.Registry}, promhttp.HandlerOpts{}))
+	if cfg.Region != nil {
+		localRange, _ := cfg.Region.Range()
+		var syncToken string
+		if cfg.Region.TokenFile != "" {
+			token, err := os.ReadFile(cfg.Region.TokenFile)
+			if err != nil {
+				logger.Fatal("could not read region sync token", zap.Error(err))
+			}
+			syncToken = strings.TrimSpace(string(token))
+		}
+		syncer := &region.Syncer{
+			Region: cfg.Region.Name,
+			Range:  localRange,
+			Peers:  cfg.Region.Peers,
+			State:  region.NewState(),
+			Local:  controller.RegionEntries,
+			Token:  syncToken,
+			Logger: logger,
+		}
+		controller.RegionState = syncer.State
+		logger.Info("Allocating from region range", zap.String("region", cfg.Region.Name), zap.String("range", localRange))
+		if err := controller.AddLoops(mgr, func(ctx context.Context) { syncer.Run(ctx, *regionSyncInterval) }); err != nil {
+			logger.Fatal("could not add region sync", zap.Error(err))
+		}
+		server.Register(region.SyncPath, controller.HandleRegionSync(syncer))
+	}
+
+	if *grpcAddr != "" {
+		if controller.APIToken == "" {
+			logger.Fatal("the gRPC allocation service requires api.tokenFile in the config")
+		}
+		grpcServer := grpc.NewServer(
+			grpc.Creds(credentials.NewTLS(&tls.Config{MinVersion: tls.VersionTLS12, GetCertificate: reloader.GetCertificate})),
+			grpc.ChainUnaryInterceptor(controller.AuthenticateUnary),
+			grpc.ChainStreamInterceptor(controller.AuthenticateStream),
+		)
+		allocator.RegisterAllocatorServer(grpcServer, controller.AllocatorServer())
+		grpcHealth := admission.RegisterGRPCHealth(grpcServer)
+		if err := controller.AddLoops(mgr,
+			func(ctx context.Context) { controller.ServeGRPC(ctx, grpcServer, *grpcAddr) },
+			func(ctx context.Context) { controller.RunGRPCHealth(ctx, grpcHealth) },
+		); err != nil {
+			logger.Fatal("could not add gRPC allocation service", zap.Error(err))
+		}
+	}
 
-	if err := server.ListenAndServeTLS(certPath, keyPath); err != nil {
-		panic(fmt.Sprintf("Failed to start server: %v", err))
+	if err := mgr.AddHealthzCheck("webhook", server.StartedChecker()); err != nil {
+		logger.Fatal("could not add liveness check", zap.Error(err))
+	}
+	if err := mgr.AddReadyzCheck("admission", controller.ReadyCheck); err != nil {
+		logger.Fatal("could not add readiness check", zap.Error(err))
+	}
+
+	fmt.Println("Starting webhook server on port 8443...")
+	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
+		logger.Fatal("controller manager stopped", zap.Error(err))
 	}
 }
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/util/homedir"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	"admission-controller-03/pkg/admission"
+	"admission-controller-03/pkg/config"
+)
+
+// policy-report lists namespaces whose IP pool was assigned under a policy
+// other than the current one, so they can be reviewed for remediation.
+func main() {
+	var kubeconfig *string
+	if home := homedir.HomeDir(); home != "" {
+		kubeconfig = flag.String("kubeconfig", filepath.Join(home, ".kube", "config"), "(optional) absolute path to the kubeconfig file")
+	} else {
+		kubeconfig = flag.String("kubeconfig", "", "absolute path to the kubeconfig file")
+	}
+	configPath := flag.String("config", "", "path to the current JSON allocation policy config file")
+	flag.Parse()
+
+	cfg, err := config.Load(*configPath, false)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error loading config:", err)
+		os.Exit(1)
+	}
+	current := cfg.Hash()
+
+	restConfig, err := clientcmd.BuildConfigFromFlags("", *kubeconfig)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error building kubeconfig:", err)
+		os.Exit(1)
+	}
+
+	clientset, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error creating Kubernetes client:", err)
+		os.Exit(1)
+	}
+
+	// Cancelled on SIGINT or SIGTERM, so an interrupted list exits with an
+	// error instead of a partial report
+	ctx := ctrl.SetupSignalHandler()
+	namespaces, err := clientset.CoreV1().Namespaces().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error listing namespaces:", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Current policy version: %s\n\n", current)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAMESPACE\tPOOLS\tPOLICY\tWEBHOOK")
+	outdated := 0
+	for _, ns := range namespaces.Items {
+		pools, ok := ns.Annotations["cni.projectcalico.org/ipv4pools"]
+		if !ok {
+			continue
+		}
+		policy := ns.Annotations[admission.PolicyVersionAnnotation]
+		if policy == current {
+			continue
+		}
+		if policy == "" {
+			policy = "<none>"
+		}
+		webhook := ns.Annotations[admission.WebhookVersionAnnotation]
+		if webhook == "" {
+			webhook = "<none>"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", ns.Name, pools, policy, webhook)
+		outdated++
+	}
+	if err := tw.Flush(); err != nil {
+		fmt.Fprintln(os.Stderr, "Error writing report:", err)
+		os.Exit(1)
+	}
+	fmt.Printf("\n%d namespace(s) provisioned under an outdated policy.\n", outdated)
+}
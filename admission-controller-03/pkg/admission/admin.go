@@ -0,0 +1,276 @@
+package admission
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+
+	"admission-controller-03/pkg/audit"
+	"admission-controller-03/pkg/notify"
+	"admission-controller-03/pkg/sink"
+
+	crdv1 "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/uuid"
+)
+
+// PoolCordonedLabel takes a pool out of selection without touching its
+// binding: a cordoned pool is never assigned again, even once released, until
+// it is uncordoned.
+const PoolCordonedLabel = "ipam.example.com/cordoned"
+
+// Event reasons of the admin verbs, posted on the pool.
+const (
+	reasonPoolCordoned      = "PoolCordoned"
+	reasonPoolUncordoned    = "PoolUncordoned"
+	reasonPoolForceReleased = "PoolForceReleased"
+)
+
+// Admin operations, as audited.
+const (
+	AdminAssign       = "ASSIGN"
+	AdminCordon       = "CORDON"
+	AdminUncordon     = "UNCORDON"
+	AdminForceRelease = "FORCE_RELEASE"
+)
+
+// refusedError is an admin verb refused for the state of the pool or
+// namespace, rather than failed.
+type refusedError struct {
+	message string
+}
+
+func (e *refusedError) Error() string {
+	return e.message
+}
+
+func refused(format string, args ...interface{}) error {
+	return &refusedError{message: fmt.Sprintf(format, args...)}
+}
+
+// poolCordoned reports whether a pool is cordoned.
+func poolCordoned(poolLabels map[string]string) bool {
+	return poolLabels[PoolCordonedLabel] == "true"
+}
+
+// AssignPool assigns a specific pool to an existing namespace that holds
+// none, as if the namespace had been created requesting it: the pool must be
+// available and allowed for the namespace's tenant. It is how operators
+// repair a namespace admitted without a pool, rather than editing labels and
+// annotations by hand; the caller must be allowed to edit the protected
+// annotations. actor is the user the assignment is audited under.
+func (a *AdmissionController) AssignPool(ctx context.Context, namespace, poolName, actor string) (string, error) {
+	poolCIDR, err := a.assignPoolManually(ctx, namespace, poolName)
+	a.auditAdmin(AdminAssign, poolName, namespace, actor, "", err)
+	return poolCIDR, err
+}
+
+func (a *AdmissionController) assignPoolManually(ctx context.Context, namespace, poolName string) (string, error) {
+	ns, err := a.K8sReader.CoreV1().Namespaces().Get(ctx, namespace, metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("could not get namespace: %v", err)
+	}
+	if ns.DeletionTimestamp != nil {
+		return "", refused("namespace %s is terminating", namespace)
+	}
+	if held := ns.Annotations[ipv4PoolsAnnotation]; held != "" {
+		return "", refused("namespace %s already holds IP pools %s", namespace, held)
+	}
+
+	ipPools, err := a.CalicoReader.ProjectcalicoV3().IPPools().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return "", fmt.Errorf("could not list IP pools: %v", err)
+	}
+	tenant := ns.Labels[a.Config.TenantLabel]
+	selectors, err := a.tenantSelectors(tenant)
+	if err != nil {
+		return "", err
+	}
+	requested, err := json.Marshal([]string{poolName})
+	if err != nil {
+		return "", fmt.Errorf("could not encode IP pool annotation: %v", err)
+	}
+	if _, denied := a.validateRequestedPool(string(requested), tenant, selectors, ipPools.Items); denied != nil {
+		return "", refused("%s", denied.Message)
+	}
+
+	delete(ns.Annotations, deferredAnnotation)
+	poolCIDR, err := a.assignNamespacePool(ctx, ns, ns.UID, "manual/"+ns.Name, tenant, poolName, ipPools.Items)
+	if errors.Is(err, errPoolLocked) {
+		return "", refused("IP pool %s is being assigned concurrently", poolName)
+	}
+	if err != nil {
+		return "", err
+	}
+	a.Logger.Info("Manually assigned pool to namespace", zap.String("namespace", ns.Name), zap.String("poolName", poolName))
+	a.Recorder.Eventf(ns, corev1.EventTypeNormal, reasonPoolAssigned, "Assigned IP pool %s (%s) manually", poolName, poolCIDR)
+	return poolCIDR, nil
+}
+
+// CordonPool stops a pool from ever being assigned again, while it stays
+// bound to whoever holds it, e.g. before retiring its range. The owner of the
+// namespace holding it is told its pool is cordoned.
+func (a *AdmissionController) CordonPool(ctx context.Context, poolName, actor string) error {
+	err := a.setCordoned(ctx, poolName, true)
+	a.auditAdmin(AdminCordon, poolName, "", actor, "", err)
+	if err != nil {
+		return err
+	}
+	a.Logger.Info("Cordoned IP pool", zap.String("poolName", poolName), zap.String("user", actor))
+	a.Recorder.Eventf(poolReference(poolName), corev1.EventTypeNormal, reasonPoolCordoned, "IP pool cordoned by %s, it is no longer assigned", actor)
+	a.notifyRotation(ctx, poolName)
+	return nil
+}
+
+// notifyRotation tells the owner of the namespace bound to a pool that it was
+// cordoned: the namespace keeps it, but it is no longer assigned and the
+// namespace is to be moved off it. Failures are only logged.
+func (a *AdmissionController) notifyRotation(ctx context.Context, poolName string) {
+	if a.Notifier == nil {
+		return
+	}
+	pool, err := a.CalicoReader.ProjectcalicoV3().IPPools().Get(ctx, poolName, metav1.GetOptions{})
+	if err != nil {
+		a.Logger.Warn("could not get cordoned pool to notify its owner", zap.String("poolName", poolName), zap.Error(err))
+		return
+	}
+	poolLabels := normalizeLabels(pool.ObjectMeta.Labels)
+	namespace := poolLabels[poolNamespaceLabel]
+	if namespace == "" || poolLabels["status"] != "used" {
+		return
+	}
+	ns, err := a.K8sReader.CoreV1().Namespaces().Get(ctx, namespace, metav1.GetOptions{})
+	if err != nil {
+		a.Logger.Warn("could not get namespace of cordoned pool to notify its owner", zap.String("namespace", namespace), zap.Error(err))
+		return
+	}
+	a.notifyOwner(namespace, ns, notify.EventForcedRotation, pool.Name, pool.Spec.CIDR, poolLabels[poolTenantLabel])
+}
+
+// UncordonPool makes a cordoned pool eligible for assignment again.
+func (a *AdmissionController) UncordonPool(ctx context.Context, poolName, actor string) error {
+	err := a.setCordoned(ctx, poolName, false)
+	a.auditAdmin(AdminUncordon, poolName, "", actor, "", err)
+	if err != nil {
+		return err
+	}
+	a.Logger.Info("Uncordoned IP pool", zap.String("poolName", poolName), zap.String("user", actor))
+	a.Recorder.Eventf(poolReference(poolName), corev1.EventTypeNormal, reasonPoolUncordoned, "IP pool uncordoned by %s", actor)
+	return nil
+}
+
+func (a *AdmissionController) setCordoned(ctx context.Context, poolName string, cordoned bool) error {
+	return a.updateIPPool(ctx, poolName, func(ipPool *crdv1.IPPool) error {
+		labels := normalizeLabels(ipPool.ObjectMeta.Labels)
+		if cordoned {
+			labels[PoolCordonedLabel] = "true"
+		} else {
+			delete(labels, PoolCordonedLabel)
+		}
+		ipPool.ObjectMeta.Labels = labels
+		return nil
+	})
+}
+
+// ForceReleasePool puts a pool that is marked taken but referenced by no
+// namespace back into circulation, applying the cleanup policy as if its
+// namespace had been deleted. A pool some namespace references is never
+// released: the namespace would keep handing out its addresses. Nor is a pool
+// Calico IPAM still has addresses allocated from, unless override is set,
+// e.g. for addresses of nodes that are gone.
+func (a *AdmissionController) ForceReleasePool(ctx context.Context, poolName, actor string, override bool) error {
+	owner, err := a.forceRelease(ctx, poolName, override)
+	detail := ""
+	if override {
+		detail = "emptiness check overridden"
+	}
+	a.auditAdmin(AdminForceRelease, poolName, owner, actor, detail, err)
+	if err != nil {
+		return err
+	}
+	a.Logger.Warn("Force-released IP pool", zap.String("poolName", poolName), zap.String("owner", owner),
+		zap.String("user", actor), zap.Bool("override", override))
+	message := fmt.Sprintf("IP pool force-released by %s", actor)
+	if override {
+		message += ", skipping the check for allocated addresses"
+	}
+	a.Recorder.Event(poolReference(poolName), corev1.EventTypeWarning, reasonPoolForceReleased, message)
+	return nil
+}
+
+// forceRelease releases the pool and returns the namespace it was bound to.
+func (a *AdmissionController) forceRelease(ctx context.Context, poolName string, override bool) (string, error) {
+	pool, err := a.CalicoReader.ProjectcalicoV3().IPPools().Get(ctx, poolName, metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("could not get IP pool: %v", err)
+	}
+	poolLabels := normalizeLabels(pool.ObjectMeta.Labels)
+	owner, _ := poolOwner(*pool)
+	if status := poolLabels["status"]; status == "available" || status == "" {
+		return owner, refused("IP pool %s is not taken (status %q)", poolName, status)
+	}
+	nsList, err := a.K8sReader.CoreV1().Namespaces().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return owner, fmt.Errorf("could not list namespaces: %v", err)
+	}
+	for i := range nsList.Items {
+		if referencesPool(&nsList.Items[i], poolName) {
+			return owner, refused("IP pool %s is referenced by namespace %s", poolName, nsList.Items[i].Name)
+		}
+	}
+	if !override {
+		ipPools, err := a.CalicoReader.ProjectcalicoV3().IPPools().List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return owner, fmt.Errorf("could not list IP pools: %v", err)
+		}
+		usage, err := a.poolUtilization(ctx, ipPools.Items)
+		if err != nil {
+			return owner, fmt.Errorf("could not check IP pool for allocated addresses: %v", err)
+		}
+		if allocated := usage[poolName].Allocated; allocated > 0 {
+			return owner, refused("IP pool %s still has %d allocated addresses", poolName, allocated)
+		}
+	}
+
+	if err := a.releasePool(ctx, pool, owner); err != nil {
+		return owner, fmt.Errorf("could not release IP pool %s: %v", poolName, err)
+	}
+	a.publishAllocation(sink.EventReleased, owner, poolName, pool.Spec.CIDR, poolLabels[poolTenantLabel])
+	return owner, nil
+}
+
+// auditAdmin appends the record of an admin verb to the audit log, if one is
+// configured.
+func (a *AdmissionController) auditAdmin(operation, poolName, namespace, actor, detail string, err error) {
+	if a.Audit == nil {
+		return
+	}
+	record := &audit.Record{
+		Time:      time.Now(),
+		UID:       string(uuid.NewUUID()),
+		Kind:      "IPPool",
+		Operation: operation,
+		Namespace: namespace,
+		User:      actor,
+		Pool:      poolName,
+		Decision:  audit.DecisionAllowed,
+		Reason:    detail,
+	}
+	if err != nil {
+		record.Decision = audit.DecisionError
+		record.Reason = err.Error()
+	}
+	if err := a.Audit.Write(record); err != nil {
+		a.Logger.Error("could not write audit record", zap.String("uid", record.UID), zap.Error(err))
+	}
+}
+
+// poolReference is the object events about a pool are posted on.
+func poolReference(poolName string) *corev1.ObjectReference {
+	return &corev1.ObjectReference{APIVersion: "projectcalico.org/v3", Kind: "IPPool", Name: poolName}
+}
@@ -0,0 +1,120 @@
+package admission
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	crdv1 "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
+	calicofake "github.com/projectcalico/api/pkg/client/clientset_generated/clientset/fake"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+
+	"admission-controller-03/pkg/config"
+	"admission-controller-03/pkg/notify"
+)
+
+// sentNotifications is a notify.Sender that hands every subject it sends to
+// a channel.
+type sentNotifications chan string
+
+func (s sentNotifications) Send(_ context.Context, _ notify.Contact, subject, _ string) error {
+	s <- subject
+	return nil
+}
+
+func TestCordonPoolNotifiesOwner(t *testing.T) {
+	pools := []*crdv1.IPPool{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "pool-used", Labels: map[string]string{"status": "used", poolNamespaceLabel: "web"}},
+			Spec:       crdv1.IPPoolSpec{CIDR: "10.0.0.0/26"},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "pool-free", Labels: map[string]string{"status": "available"}},
+			Spec:       crdv1.IPPoolSpec{CIDR: "10.0.1.0/26"},
+		},
+	}
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+		Name:        "web",
+		Annotations: map[string]string{notify.OwnerContactAnnotation: "jane@example.com"},
+	}}
+	a := NewAdmissionControllerFromClients(zap.NewNop(), config.Default(), calicofake.NewSimpleClientset(pools[0], pools[1]), k8sfake.NewSimpleClientset(ns))
+	a.Shutdown()
+	a.Recorder = &record.FakeRecorder{}
+	sent := make(sentNotifications, 2)
+	a.Notifier = notify.NewOwnerNotifier(zap.NewNop(), "", nil, map[string]notify.Sender{"email": sent})
+
+	for _, pool := range pools {
+		if err := a.CordonPool(context.Background(), pool.Name, "admin"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case subject := <-sent:
+		if want := "IP pool of namespace web is cordoned"; subject != want {
+			t.Errorf("sent %q, want %q", subject, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the owner was not notified")
+	}
+	select {
+	case subject := <-sent:
+		t.Errorf("cordoning an unbound pool sent %q", subject)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestExpiringReservationNotifiesOwnerOnce(t *testing.T) {
+	reservedAt := time.Now().Add(-40 * time.Minute)
+	pool := &crdv1.IPPool{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "pool-0",
+			Labels: map[string]string{
+				"status":            "pending",
+				poolRequestLabel:    "uid-1",
+				poolNamespaceLabel:  "web",
+				poolAssignedAtLabel: strconv.FormatInt(reservedAt.Unix(), 10),
+			},
+			Annotations: map[string]string{notify.OwnerContactAnnotation: "jane@example.com"},
+		},
+		Spec: crdv1.IPPoolSpec{CIDR: "10.0.0.0/26"},
+	}
+	cfg := config.Default()
+	cfg.ReservationTTLSeconds = 3600
+	calicoClient := calicofake.NewSimpleClientset(pool)
+	a := NewAdmissionControllerFromClients(zap.NewNop(), cfg, calicoClient, k8sfake.NewSimpleClientset())
+	a.Shutdown()
+	sent := make(sentNotifications, 2)
+	a.Notifier = notify.NewOwnerNotifier(zap.NewNop(), "", nil, map[string]notify.Sender{"email": sent})
+
+	for i := 0; i < 2; i++ {
+		if err := a.bindPools(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case subject := <-sent:
+		if want := "IP pool reservation of namespace web expires soon"; subject != want {
+			t.Errorf("sent %q, want %q", subject, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the owner was not notified")
+	}
+	select {
+	case subject := <-sent:
+		t.Errorf("the notice was sent again: %q", subject)
+	case <-time.After(100 * time.Millisecond):
+	}
+	got, err := calicoClient.ProjectcalicoV3().IPPools().Get(context.Background(), "pool-0", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Labels["status"] != "pending" || got.Annotations[expiryNoticeAnnotation] == "" {
+		t.Errorf("pool after the notice: labels %v, annotations %v", got.Labels, got.Annotations)
+	}
+}
@@ -3,235 +3,970 @@ package admission
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
 	"go.uber.org/zap"
 
+	"admission-common/admissionreview"
+	"admission-controller-03/pkg/alert"
+	"admission-controller-03/pkg/allocation"
+	"admission-controller-03/pkg/apimetrics"
+	"admission-controller-03/pkg/audit"
+	"admission-controller-03/pkg/backend"
+	"admission-controller-03/pkg/cni"
+	"admission-controller-03/pkg/config"
+	"admission-controller-03/pkg/notify"
+	"admission-controller-03/pkg/policy"
+	"admission-controller-03/pkg/region"
+	"admission-controller-03/pkg/rules"
+	"admission-controller-03/pkg/sink"
+	"admission-controller-03/pkg/version"
+
 	// crdv1 "github.com/projectcalico/api/pkg/apis/crd.projectcalico.org/v1"
 	crdv1 "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
 	"github.com/projectcalico/api/pkg/client/clientset_generated/clientset"
 	admissionv1 "k8s.io/api/admission/v1"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	ipv4PoolsAnnotation = "cni.projectcalico.org/ipv4pools"
+	// poolTenantLabel records on an IP pool which tenant it is assigned to
+	poolTenantLabel = "ipam.example.com/tenant"
+	// PolicyVersionAnnotation and WebhookVersionAnnotation record on a
+	// namespace which policy and webhook build made its assignment
+	PolicyVersionAnnotation  = "ipam.example.com/policy-version"
+	WebhookVersionAnnotation = "ipam.example.com/webhook-version"
+	// poolRequestLabel records the UID of the admission request that claimed
+	// a pool so that retries of that request are idempotent
+	poolRequestLabel = "ipam.example.com/request-uid"
+	// skipAnnotation set to "true" opts a namespace out of pool assignment so
+	// it keeps using the default cluster pool
+	skipAnnotation = "ipam.example.com/skip"
+	// CIDRAnnotation exposes the assigned pools' subnets, comma separated, to
+	// users and tooling that cannot read IPPools
+	CIDRAnnotation = "ipam.example.com/cidr"
 )
 
+var tracer = otel.Tracer("admission-controller-03/pkg/admission")
+
 type AdmissionController struct {
-	Clientset    *clientset.Clientset
-	K8sClientset *kubernetes.Clientset
+	// Clientset and K8sClientset carry the write identity and are only used
+	// for mutations; list/get paths go through the read-only readers.
+	Clientset    clientset.Interface
+	K8sClientset kubernetes.Interface
+	CalicoReader clientset.Interface
+	K8sReader    kubernetes.Interface
+	// PoolCache, when set, serves the pools namespace admission selects
+	// from. See SetupPoolCache.
+	PoolCache client.Reader
+	// DynamicReader reads Calico IPAM blocks, which have no typed client. It
+	// is nil when built from clients, and utilization is then unknown.
+	DynamicReader dynamic.Interface
+	// DynamicClient writes IPPoolAllocations and PoolClaims through the write
+	// identity. It is nil when built from clients.
+	DynamicClient dynamic.Interface
+	// ReadConfig and WriteConfig are the REST configs of the two identities.
+	// They are nil when built from clients.
+	ReadConfig  *rest.Config
+	WriteConfig *rest.Config
+	// RecordAllocations records every assignment as an IPPoolAllocation.
+	RecordAllocations bool
+	// tenants holds the Tenant resources last synced by RunTenantSync; nil
+	// until the first sync, or when the CRD is not installed.
+	tenants atomic.Pointer[map[string]config.Tenant]
+	// skipReservations is set by VerifyIdentities when the config file
+	// reserves no ranges and the identities cannot manage IPReservations.
+	skipReservations bool
+	// elected is closed once this replica leads, see leading.
+	elected <-chan struct{}
+	// WriteUser is the username of the write identity, once resolved.
+	WriteUser    string
 	Logger       *zap.Logger
+	Scan         *ScanStatus
+	Config       *config.Config
+	Strict       bool
+	WebhookCheck *WebhookCheck
+	// Recorder posts events on namespaces through the write identity.
+	Recorder      record.EventRecorder
+	broadcaster   record.EventBroadcaster
+	pendingEvents chan pendingEvent
+	// Notifier, when set, tells namespace owners about their assignments.
+	Notifier *notify.OwnerNotifier
+	// Audit, when set, receives a record of every admission decision.
+	Audit *audit.Log
+	// Backend, when set, is the external IPAM namespace subnets are drawn
+	// from. Nil means the Calico-native backend, see IPAMBackend.
+	Backend backend.IPAMBackend
+	// CNI, when set, is the CNI namespace subnets are applied to. Nil means
+	// Calico, see cniPlugin.
+	CNI cni.Plugin
+	// Sink, when set, streams pool assignments and releases.
+	Sink sink.Sink
+	// Alerter, when set, tells operators about exhaustion and failures.
+	Alerter *alert.Alerter
+	// Policy, when set, decides on every namespace assignment before it is
+	// committed. See checkPolicy.
+	Policy *policy.Client
+	// SelectionRules, when set, narrow down the pools selected for a
+	// namespace. See selectionCandidates.
+	SelectionRules *rules.Rules
+	// RegionState, when set, holds what the other regions report; local
+	// pools a peer reports are not allocated.
+	RegionState *region.State
+	// APIToken authenticates clients of the allocations API, as does
+	// APIKubernetesAuth by TokenReview, authorizing every call by
+	// SubjectAccessReview. The API is off without either. APIAudience, when
+	// set, is the audience reviewed tokens must be issued for.
+	APIToken           string
+	APIKubernetesAuth  bool
+	APIAudience        string
+	apiTokens          tokenCache
+	allocationFailures atomic.Int32
+	// RequestTimeout caps the time one admission request may spend on API
+	// calls. Zero leaves only the API server's webhook timeout.
+	RequestTimeout time.Duration
+	// LeaseNamespace holds the per-pool allocation leases that serialize
+	// concurrent assignments. Locking is disabled when it is empty.
+	LeaseNamespace string
+	// FailOpen lists the operations admitted with a warning, rather than
+	// denied, when an internal error gets in the way. See ParseFailurePolicy.
+	FailOpen map[admissionv1.Operation]bool
 }
 
-func NewAdmissionController(logger *zap.Logger) (*AdmissionController, error) {
-	config, err := rest.InClusterConfig()
+// Identities names the mounted service account tokens used for reads and
+// writes. An empty path falls back to the pod's own service account.
+type Identities struct {
+	ReadTokenFile  string
+	WriteTokenFile string
+}
+
+func NewAdmissionController(logger *zap.Logger, cfg *config.Config, identities Identities) (*AdmissionController, error) {
+	restConfig, err := rest.InClusterConfig()
 	if err != nil {
 		logger.Error("could not get in-cluster config", zap.Error(err))
 		return nil, fmt.Errorf("could not get in-cluster config: %v", err)
 	}
+	return NewAdmissionControllerForConfig(logger, cfg, restConfig, identities)
+}
+
+// NewAdmissionControllerForConfig builds a controller talking to the API
+// server of restConfig, e.g. a test control plane, through the identities.
+func NewAdmissionControllerForConfig(logger *zap.Logger, cfg *config.Config, restConfig *rest.Config, identities Identities) (*AdmissionController, error) {
+	restConfig = rest.CopyConfig(restConfig)
 
-	// config, err := clientcmd.BuildConfigFromFlags("", "C:\\Users\\aaaaaa\\Desktop\\kube\\config")
+	// restConfig, err := clientcmd.BuildConfigFromFlags("", "C:\\Users\\aaaaaa\\Desktop\\kube\\config")
 	// if err != nil {
 	// 	panic(err.Error())
 	// }
 
-	clientset, err := clientset.NewForConfig(config)
+	// Every API call becomes a span under the admission request's trace, and
+	// is measured per verb and resource
+	restConfig.Wrap(func(rt http.RoundTripper) http.RoundTripper {
+		return otelhttp.NewTransport(apimetrics.NewTransport(rt))
+	})
+
+	clientset, k8sClientset, err := newClients(withTokenFile(restConfig, identities.WriteTokenFile))
 	if err != nil {
-		logger.Error("could not create Calico clientset", zap.Error(err))
-		return nil, fmt.Errorf("could not create Calico clientset: %v", err)
+		logger.Error("could not create write clients", zap.Error(err))
+		return nil, err
 	}
-
-	k8sClientset, err := kubernetes.NewForConfig(config)
+	calicoReader, k8sReader, err := newClients(withTokenFile(restConfig, identities.ReadTokenFile))
 	if err != nil {
-		logger.Error("could not create Kubernetes clientset", zap.Error(err))
-		return nil, fmt.Errorf("could not create Kubernetes clientset: %v", err)
+		logger.Error("could not create read clients", zap.Error(err))
+		return nil, err
 	}
 
 	// logger, _ := zap.NewProduction() // Create a logger
 	// defer logger.Sync()              // Flushes buffer, if any
 
+	dynamicReader, err := dynamic.NewForConfig(withTokenFile(restConfig, identities.ReadTokenFile))
+	if err != nil {
+		logger.Error("could not create dynamic read client", zap.Error(err))
+		return nil, fmt.Errorf("could not create dynamic client: %v", err)
+	}
+
+	dynamicClient, err := dynamic.NewForConfig(withTokenFile(restConfig, identities.WriteTokenFile))
+	if err != nil {
+		logger.Error("could not create dynamic write client", zap.Error(err))
+		return nil, fmt.Errorf("could not create dynamic client: %v", err)
+	}
+
+	a := NewAdmissionControllerFromClients(logger, cfg, clientset, k8sClientset)
+	a.CalicoReader = calicoReader
+	a.K8sReader = k8sReader
+	a.DynamicReader = dynamicReader
+	a.DynamicClient = dynamicClient
+	a.ReadConfig = withTokenFile(restConfig, identities.ReadTokenFile)
+	a.WriteConfig = withTokenFile(restConfig, identities.WriteTokenFile)
+	return a, nil
+}
+
+// NewAdmissionControllerFromClients builds a controller around existing
+// clientsets, e.g. fakes when driving the handler outside a cluster. The same
+// clients serve both reads and writes.
+func NewAdmissionControllerFromClients(logger *zap.Logger, cfg *config.Config, calicoClient clientset.Interface, k8sClient kubernetes.Interface) *AdmissionController {
+	broadcaster, recorder := newEventRecorder(k8sClient)
 	return &AdmissionController{
-		Clientset:    clientset,
-		K8sClientset: k8sClientset,
-		Logger:       logger,
-	}, nil
+		Clientset:     calicoClient,
+		K8sClientset:  k8sClient,
+		CalicoReader:  calicoClient,
+		K8sReader:     k8sClient,
+		Logger:        logger,
+		Scan:          &ScanStatus{},
+		Config:        cfg,
+		WebhookCheck:  &WebhookCheck{},
+		Recorder:      recorder,
+		broadcaster:   broadcaster,
+		pendingEvents: make(chan pendingEvent, pendingEventsSize),
+	}
+}
+
+func newClients(restConfig *rest.Config) (clientset.Interface, kubernetes.Interface, error) {
+	calicoClient, err := clientset.NewForConfig(restConfig)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not create Calico clientset: %v", err)
+	}
+
+	k8sClient, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not create Kubernetes clientset: %v", err)
+	}
+	return calicoClient, k8sClient, nil
+}
+
+// withTokenFile returns a copy of the config authenticating with the token
+// mounted at path, or the config itself when path is empty.
+func withTokenFile(restConfig *rest.Config, path string) *rest.Config {
+	if path == "" {
+		return restConfig
+	}
+	identity := rest.CopyConfig(restConfig)
+	identity.BearerToken = ""
+	identity.BearerTokenFile = path
+	return identity
 }
 
 // Implement your logic for handling admission requests
 func (a *AdmissionController) HandleAdmissionReview(w http.ResponseWriter, r *http.Request) {
 	a.Logger.Info("Handling admission review request")
+	start := time.Now()
+	ctx, span := tracer.Start(r.Context(), "HandleAdmissionReview")
+	defer span.End()
+	// Past the API server's webhook timeout the request fails anyway, so
+	// nothing should still be running against the cluster by then
+	if timeout := a.requestTimeout(r); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	_, decodeSpan := tracer.Start(ctx, "decode")
+	admissionReviewReq, err := decodeAdmissionReview(w, r)
+	if err != nil {
+		decodeSpan.RecordError(err)
+		decodeSpan.End()
+		a.writeMalformedReview(w, admissionReviewReq, err)
+		return
+	}
+	decodeSpan.End()
+
+	admissionResponse := admissionreview.NewResponse(admissionReviewReq.Request)
+	span.SetAttributes(
+		attribute.String("uid", string(admissionReviewReq.Request.UID)),
+		attribute.String("kind", admissionReviewReq.Request.Kind.Kind),
+		attribute.String("operation", string(admissionReviewReq.Request.Operation)),
+		attribute.String("name", admissionReviewReq.Request.Name),
+	)
+	defer func() { span.SetAttributes(attribute.Bool("allowed", admissionResponse.Allowed)) }()
+
+	// Every decision from here on is audited, including HTTP errors
+	record := newAuditRecord(admissionReviewReq.Request, start)
+	ctx = audit.NewContext(ctx, record)
+	sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+	w = sw
+	defer func() { a.writeAudit(record, admissionResponse, sw.status, start) }()
+
+	// kubectl --dry-run=server must get the would-be patch without consuming
+	// a pool or creating anything
+	if dryRun := admissionReviewReq.Request.DryRun; dryRun != nil && *dryRun {
+		ctx = withDryRun(ctx)
+		record.DryRun = true
+		span.SetAttributes(attribute.Bool("dryRun", true))
+	}
+
+	// Cluster-critical namespaces are always admitted untouched; this runs
+	// before anything that could deny, so even a misrouted request is safe
+	if a.isCritical(admissionReviewReq.Request) {
+		a.Logger.Info("Admitting request in critical namespace untouched",
+			zap.String("kind", admissionReviewReq.Request.Kind.Kind), zap.String("name", admissionReviewReq.Request.Name), zap.String("namespace", admissionReviewReq.Request.Namespace))
+		a.writeAdmissionResponse(w, admissionResponse)
+		return
+	}
 
-	var admissionReviewReq admissionv1.AdmissionReview
-	if err := json.NewDecoder(r.Body).Decode(&admissionReviewReq); err != nil {
-		a.Logger.Error("could not decode request", zap.Error(err))
-		http.Error(w, fmt.Sprintf("could not decode request: %v", err), http.StatusBadRequest)
+	// Requests outside the configured operations pass through untouched; in
+	// strict mode anything we were not meant to receive is a misdeployment
+	kind, operation := admissionReviewReq.Request.Kind.Kind, admissionReviewReq.Request.Operation
+	if !a.handles(kind, operation) {
+		if a.Strict {
+			a.Logger.Warn("Strict mode: denying unexpected request", zap.String("kind", kind), zap.String("operation", string(operation)))
+			admissionResponse.Allowed = false
+			admissionResponse.Result = denial(statusUnsupportedKind, "strict mode: this webhook does not handle %s %s requests, check the webhook configuration rules", operation, kind)
+		} else {
+			a.Logger.Warn("Admitting request the webhook is not configured to handle", zap.String("kind", kind), zap.String("operation", string(operation)))
+			addWarning(admissionResponse, "the IP pool webhook is not configured to handle %s %s requests, admitted untouched", operation, kind)
+		}
+		a.writeAdmissionResponse(w, admissionResponse)
 		return
 	}
 
-	admissionResponse := &admissionv1.AdmissionResponse{
-		UID:     admissionReviewReq.Request.UID,
-		Allowed: true,
+	if admissionReviewReq.Request.Kind.Kind == "Namespace" && a.isExempt(admissionReviewReq.Request) {
+		a.Logger.Info("Namespace is exempt from IP pool assignment", zap.String("namespace", admissionReviewReq.Request.Name))
+		if admissionReviewReq.Request.Operation == admissionv1.Create {
+			addWarning(admissionResponse, "namespace %s is exempt, no IP pool was assigned", admissionReviewReq.Request.Name)
+		}
+		a.writeAdmissionResponse(w, admissionResponse)
+		return
 	}
 
 	if admissionReviewReq.Request.Kind.Kind == "Namespace" {
 		if admissionReviewReq.Request.Operation == admissionv1.Create {
-			// Handle namespace creation logic
-			// a.Logger.Info("Handling namespace creation")
-			a.Logger.Info("Processing namespace creation", zap.String("namespace", admissionReviewReq.Request.Name))
-			// Fetch the available IP pools
-			ipPools, err := a.Clientset.ProjectcalicoV3().IPPools().List(context.TODO(), metav1.ListOptions{})
-			if err != nil {
-				a.Logger.Error("could not list IP pools", zap.Error(err))
-				admissionResponse.Allowed = false
-				admissionResponse.Result = &metav1.Status{
-					Message: fmt.Sprintf("could not list IP pools: %v", err),
-				}
-				a.writeAdmissionResponse(w, admissionResponse)
-				return
-			}
+			a.handleNamespaceCreation(ctx, w, admissionReviewReq.Request, admissionResponse)
+			return
+		} else if admissionReviewReq.Request.Operation == admissionv1.Update {
+			a.handleNamespaceUpdate(w, admissionReviewReq.Request, admissionResponse)
+			return
+		} else if admissionReviewReq.Request.Operation == admissionv1.Delete {
+			a.handleNamespaceDeletion(ctx, w, admissionReviewReq.Request, admissionResponse)
+			return
+		}
+	}
+
+	if admissionReviewReq.Request.Kind.Kind == "Service" {
+		if admissionReviewReq.Request.Operation == admissionv1.Create {
+			a.handleServiceCreation(ctx, w, admissionReviewReq.Request, admissionResponse)
+			return
+		} else if admissionReviewReq.Request.Operation == admissionv1.Update {
+			a.handleServiceUpdate(ctx, w, admissionReviewReq.Request, admissionResponse)
+			return
+		} else if admissionReviewReq.Request.Operation == admissionv1.Delete {
+			a.handleServiceDeletion(ctx, w, admissionReviewReq.Request, admissionResponse)
+			return
+		}
+	}
+
+	if admissionReviewReq.Request.Kind.Kind == "Pod" && admissionReviewReq.Request.Operation == admissionv1.Create {
+		a.handlePodCreation(ctx, w, admissionReviewReq.Request, admissionResponse)
+		return
+	}
+
+	a.writeAdmissionResponse(w, admissionResponse)
+}
+
+func (a *AdmissionController) handleNamespaceCreation(ctx context.Context, w http.ResponseWriter, req *admissionv1.AdmissionRequest, admissionResponse *admissionv1.AdmissionResponse) {
+	var ns corev1.Namespace
+	if err := json.Unmarshal(req.Object.Raw, &ns); err != nil {
+		a.denyMalformedObject(w, admissionResponse, "namespace", err)
+		return
+	}
+	name := namespaceName(req, &ns)
+	audit.FromContext(ctx).Namespace = name
+	a.Logger.Info("Processing namespace creation", zap.String("namespace", name), zap.String("uid", string(req.UID)))
+
+	if ns.Annotations[skipAnnotation] == "true" {
+		a.Logger.Info("Namespace opted out of IP pool assignment", zap.String("namespace", name), zap.String("annotation", skipAnnotation))
+		addWarning(admissionResponse, "namespace %s opted out via %s, no IP pool was assigned", name, skipAnnotation)
+		a.writeAdmissionResponse(w, admissionResponse)
+		return
+	}
+
+	// Namespaces of a configured tenant only draw from that tenant's pools
+	tenant := ns.Labels[a.Config.TenantLabel]
+	selectors, err := a.tenantSelectors(tenant)
+	if err != nil {
+		a.Logger.Error("could not resolve tenant pool selectors", zap.String("tenant", tenant), zap.Error(err))
+		a.deny(w, req, admissionResponse, denial(statusTenantUnresolved, "could not resolve pools for tenant %s: %v", tenant, err), deferAssignment(req, &ns))
+		return
+	}
+
+	// A requested pool is still validated and assigned synchronously
+	if _, isRequested := ns.Annotations[ipv4PoolsAnnotation]; !isRequested && a.claimsPools() {
+		a.handleNamespaceClaim(ctx, w, req, admissionResponse, &ns, tenant)
+		return
+	}
 
-			// Select an available subnet
-			availableSubnet := a.selectAvailableSubnet(ipPools.Items)
-			if availableSubnet == "" {
-				a.Logger.Warn("No available subnets found")
-				admissionResponse.Allowed = false
-				admissionResponse.Result = &metav1.Status{
-					Message: "No available subnets found.",
+	// Ended explicitly once a pool is chosen; the deferred End only covers
+	// the early returns
+	selectCtx, selectSpan := tracer.Start(ctx, "select")
+	defer selectSpan.End()
+
+	// Fetch the available IP pools
+	ipPools, err := a.listPools(selectCtx)
+	if err != nil {
+		a.Logger.Error("could not list IP pools", zap.Error(err))
+		denied := denial(statusPoolListFailed, "could not list IP pools: %v", err)
+		// A dry run never reaches the allocation, nor does it count towards
+		// the failure alert
+		if !isDryRun(ctx) {
+			a.allocationFailed(name, denied.Message)
+		}
+		a.deny(w, req, admissionResponse, denied, deferAssignment(req, &ns))
+		return
+	}
+
+	// A retried request (same UID, e.g. after a timeout or a connection reset
+	// mid-response) gets the pool its first attempt already claimed
+	availableSubnet := claimedPool(ipPools.Items, req.UID)
+	retried := availableSubnet != ""
+	if retried {
+		a.Logger.Info("Retried request, reusing the pool claimed by its first attempt", zap.String("uid", string(req.UID)), zap.String("subnet", availableSubnet))
+	} else {
+		// Selection and the label update are not atomic: lock the selected
+		// pool, and move on to another one if a concurrent request has it
+		requested, isRequested := ns.Annotations[ipv4PoolsAnnotation]
+		candidates := ipPools.Items
+		for attempt := 1; ; attempt++ {
+			var denied *metav1.Status
+			if isRequested {
+				availableSubnet, denied = a.validateRequestedPool(requested, tenant, selectors, candidates)
+			} else {
+				availableSubnet, denied = a.selectPoolForNamespace(selectCtx, &ns, tenant, selectors, candidates, admissionResponse)
+			}
+			if denied == nil {
+				availableSubnet, denied = a.checkPolicy(selectCtx, &ns, tenant, availableSubnet, isRequested, candidates)
+			}
+			if denied == nil {
+				var lease *coordinationv1.Lease
+				lease, err = a.lockPool(selectCtx, availableSubnet, string(req.UID))
+				if err == nil {
+					// The cached pool may already be taken; checked once
+					// the pool is locked, so no other request takes it next
+					if err = a.confirmPoolAvailable(selectCtx, availableSubnet); err == nil {
+						defer a.unlockPool(ctx, lease)
+						break
+					}
+					a.unlockPool(ctx, lease)
+				}
+				switch {
+				case !errors.Is(err, errPoolLocked):
+					a.Logger.Error("could not lock IP pool", zap.String("poolName", availableSubnet), zap.Error(err))
+					denied = denial(statusPoolUpdateFailed, "could not lock IP pool %s: %v", availableSubnet, err)
+				case isRequested:
+					denied = denial(statusPoolUnavailable, "Requested IP pool %s is being assigned to another namespace.", availableSubnet)
+				case attempt == maxAllocationAttempts:
+					denied = denial(statusPoolContention, "Gave up after %d IP pools were taken by concurrent requests, retry the request.", attempt)
+				default:
+					a.Logger.Info("Selected pool is taken by a concurrent request, selecting another", zap.String("poolName", availableSubnet))
+					candidates = withoutPool(candidates, availableSubnet)
+					continue
 				}
-				a.writeAdmissionResponse(w, admissionResponse)
-				return
 			}
-			a.Logger.Info("Selected subnet for namespace", zap.String("subnet", availableSubnet))
-			// Step 4: Patch the namespace with the selected IP pool
-			annotationValue := fmt.Sprintf(`["%s"]`, availableSubnet)
-
-			patch := []map[string]interface{}{
-				{
-					"op":    "add",
-					"path":  "/metadata/annotations",
-					"value": map[string]string{}, // This will create an empty annotations map if it doesn't exist
-				},
-				{
-					"op":    "add",
-					"path":  "/metadata/annotations/cni.projectcalico.org~1ipv4pools", // Escaping the "/" character
-					"value": annotationValue,
-				},
+			if !isDryRun(ctx) && (denied.Reason == statusAggregateAllocFailed || denied.Reason == statusBackendAllocFailed || denied.Reason == statusPoolUpdateFailed) {
+				a.allocationFailed(name, denied.Message)
 			}
+			a.deny(w, req, admissionResponse, denied, deferAssignment(req, &ns))
+			return
+		}
+		a.assignmentWarnings(selectCtx, admissionResponse, availableSubnet, tenant, ipPools.Items)
+	}
+	a.Logger.Info("Selected subnet for namespace", zap.String("subnet", availableSubnet))
+	poolCIDR, err := a.poolCIDR(selectCtx, availableSubnet, ipPools.Items)
+	if err != nil {
+		a.Logger.Error("could not resolve pool CIDR", zap.String("poolName", availableSubnet), zap.Error(err))
+		denied := denial(statusPoolCIDRUnresolved, "could not resolve CIDR of IP pool %s: %v", availableSubnet, err)
+		if !isDryRun(ctx) {
+			a.allocationFailed(name, denied.Message)
+		}
+		a.deny(w, req, admissionResponse, denied, deferAssignment(req, &ns))
+		return
+	}
+	audit.FromContext(ctx).Pool = availableSubnet
+	selectSpan.SetAttributes(attribute.String("pool", availableSubnet), attribute.String("cidr", poolCIDR), attribute.Bool("retried", retried))
+	selectSpan.End()
 
-			patchBytes, err := json.Marshal(patch)
-			if err != nil {
-				a.Logger.Error("could not marshal patch", zap.Error(err))
-				http.Error(w, fmt.Sprintf("could not marshal patch: %v", err), http.StatusInternalServerError)
-				return
-			}
+	// Step 4: Patch the namespace with the selected IP pool. For a requested
+	// pool this writes back the user's validated choice.
+	_, patchSpan := tracer.Start(ctx, "patch")
+	annotations := map[string]string{
+		ipv4PoolsAnnotation:      fmt.Sprintf(`["%s"]`, availableSubnet),
+		PolicyVersionAnnotation:  a.Config.Hash(),
+		WebhookVersionAnnotation: version.Version,
+		CIDRAnnotation:           poolCIDR,
+		// Lets RunPoolBinder find the namespace of a generateName request
+		requestAnnotation: string(req.UID),
+	}
+	selected := []cni.Pool{{Name: availableSubnet, CIDR: poolCIDR}}
+	for key, value := range a.cniPlugin().NamespaceAnnotations(selected) {
+		annotations[key] = value
+	}
+	// The namespace is held on deletion until its pools are released, from
+	// the moment it exists
+	finalizers := []string{releaseFinalizer}
+	patchBytes, err := namespacePatch(&ns, annotations, finalizers)
+	if err != nil {
+		patchSpan.End()
+		a.Logger.Error("could not marshal patch", zap.Error(err))
+		a.writeInternalError(w, admissionResponse, "could not marshal patch: %v", err)
+		return
+	}
+	a.logPatchDiff(name, req.Object.Raw, patchBytes)
+	if err := verifyPatch(req.Object.Raw, patchBytes, annotations, finalizers); err != nil {
+		patchSpan.End()
+		a.Logger.Error("patch verification failed", zap.ByteString("patch", patchBytes), zap.Error(err))
+		a.writeInternalError(w, admissionResponse, "patch verification failed: %v", err)
+		return
+	}
 
-			admissionResponse.Patch = patchBytes
-			admissionResponse.PatchType = func() *admissionv1.PatchType {
-				pt := admissionv1.PatchTypeJSONPatch
-				return &pt
-			}()
-
-			// Update the IP pool label to "used"
-			if err := a.updateIPPoolLabel(availableSubnet, "used"); err != nil {
-				a.Logger.Error("could not update IP pool label", zap.Error(err))
-				admissionResponse.Allowed = false
-				admissionResponse.Result = &metav1.Status{
-					Message: fmt.Sprintf("could not update IP pool label: %v", err),
-				}
-				a.writeAdmissionResponse(w, admissionResponse)
-				return
-			}
+	patchSpan.End()
 
-		} else if admissionReviewReq.Request.Operation == admissionv1.Delete {
-			// Handle namespace deletion logic
-			namespace := admissionReviewReq.Request.Name
-			a.Logger.Info("Handling namespace deletion", zap.String("namespace", namespace))
-
-			// Fetch the namespace to get the IP pool annotation
-			ns, err := a.K8sClientset.CoreV1().Namespaces().Get(context.TODO(), namespace, metav1.GetOptions{})
-			if err != nil {
-				a.Logger.Error("could not fetch namespace", zap.Error(err))
-				http.Error(w, fmt.Sprintf("could not fetch namespace: %v", err), http.StatusInternalServerError)
-				return
-			}
+	admissionResponse.Patch = patchBytes
+	admissionResponse.PatchType = func() *admissionv1.PatchType {
+		pt := admissionv1.PatchTypeJSONPatch
+		return &pt
+	}()
 
-			// Fetch the annotation value
-			ipPoolAnnotation, found := ns.Annotations["cni.projectcalico.org/ipv4pools"]
-			if !found || ipPoolAnnotation == "" {
-				a.Logger.Warn("No IP pool annotation found, nothing to update")
-				a.writeAdmissionResponse(w, admissionResponse)
-				return
-			}
+	// Reserve the pool as "pending" and record the owning tenant and the
+	// request that claimed it. The namespace creation can still fail after
+	// admission, so RunPoolBinder only marks the pool "used" once the
+	// namespace exists, and hands it back when it never appears. The
+	// namespace is only known by name once it has one; generated names are
+	// bound later by RunPoolBinder.
+	owner := map[string]string{
+		poolRequestLabel:    string(req.UID),
+		poolAssignedAtLabel: strconv.FormatInt(time.Now().Unix(), 10),
+	}
+	if tenant != "" {
+		owner[poolTenantLabel] = tenant
+	}
+	if ns.Name != "" {
+		owner[poolNamespaceLabel] = ns.Name
+	}
+	// The owner is told before the reservation expires, while only the pool
+	// knows whom to tell
+	contact := reservationContact(&ns)
+	if isDryRun(ctx) {
+		a.Logger.Info("Dry run, not assigning IP pool", zap.String("namespace", name), zap.String("poolName", availableSubnet))
+		a.writeAdmissionResponse(w, admissionResponse)
+		return
+	}
+	labelCtx, labelSpan := tracer.Start(ctx, "label-update")
+	if err := a.recordAllocation(labelCtx, &ns, req.UID, tenant, availableSubnet, poolCIDR, ipPools.Items, allocation.PhasePending); err != nil {
+		labelSpan.End()
+		a.Logger.Error("could not record IP pool allocation", zap.Error(err))
+		a.deny(w, req, admissionResponse, denial(statusAllocationRecordFailed, "could not record IP pool allocation: %v", err), deferAssignment(req, &ns))
+		return
+	}
+	// The CNI serves the pool before the namespace selecting it exists
+	if err := a.cniPlugin().EnsurePools(labelCtx, selected); err != nil {
+		labelSpan.End()
+		a.Logger.Error("could not apply IP pool to CNI", zap.String("cni", a.cniPlugin().Name()), zap.Error(err))
+		denied := denial(statusCNIPoolFailed, "could not apply IP pool %s to %s: %v", availableSubnet, a.cniPlugin().Name(), err)
+		a.allocationFailed(name, denied.Message)
+		a.failAllocation(ctx, &ns, req.UID, denied.Message)
+		a.deny(w, req, admissionResponse, denied, deferAssignment(req, &ns))
+		return
+	}
+	err = a.assignPool(labelCtx, availableSubnet, "pending", owner, contact)
+	if err == nil {
+		a.allocationSucceeded()
+	}
+	labelSpan.End()
+	if err != nil {
+		a.Logger.Error("could not update IP pool label", zap.Error(err))
+		denied := denial(statusPoolContention, "IP pool %s was taken by a concurrent request, retry the request.", availableSubnet)
+		if !errors.Is(err, errPoolLocked) {
+			denied = denial(statusPoolUpdateFailed, "could not update IP pool label: %v", err)
+			a.allocationFailed(name, denied.Message)
+		}
+		a.failAllocation(ctx, &ns, req.UID, denied.Message)
+		a.deny(w, req, admissionResponse, denied, deferAssignment(req, &ns))
+		return
+	}
 
-			// Decode JSON array from annotation
-			var ipPools []string
-			if err := json.Unmarshal([]byte(ipPoolAnnotation), &ipPools); err != nil {
-				a.Logger.Error("Failed to decode IP pool annotation", zap.String("annotation", ipPoolAnnotation), zap.Error(err))
-				http.Error(w, fmt.Sprintf("could not decode IP pool annotation: %v", err), http.StatusInternalServerError)
-				return
-			}
+	// The first attempt of a retried request already notified the owner
+	if !retried {
+		a.notifyOwner(name, &ns, notify.EventAssigned, availableSubnet, poolCIDR, tenant)
+		a.publishAllocation(sink.EventAssigned, name, availableSubnet, poolCIDR, tenant)
+		a.recordEventOnceCreated(ns.Name, corev1.EventTypeNormal, reasonPoolAssigned, "Assigned IP pool %s (%s)", availableSubnet, poolCIDR)
+	}
 
-			// Use the first item from the list if it's not empty
-			if len(ipPools) > 0 {
-				ipPoolName := ipPools[0]
-				a.Logger.Info("Selected IP pool name", zap.String("poolName", ipPoolName))
+	a.writeAdmissionResponse(w, admissionResponse)
+}
 
-				// Update the IP pool label to "available"
-				if err := a.updateIPPoolLabel(ipPoolName, "available"); err != nil {
-					a.Logger.Error("could not update IP pool label", zap.Error(err))
-					http.Error(w, fmt.Sprintf("could not update IP pool label: %v", err), http.StatusInternalServerError)
-					return
-				}
-			} else {
-				a.Logger.Warn("No IP pools found in annotation")
+// selectPoolForNamespace enforces the tenant's quota and picks a pool, carving
+// one from the tenant's aggregate when hierarchical allocation is configured.
+// It returns the pool name, or the status to deny the request with. Non-fatal
+// conditions are added to the response warnings.
+func (a *AdmissionController) selectPoolForNamespace(ctx context.Context, ns *corev1.Namespace, tenant string, selectors []labels.Selector, pools []crdv1.IPPool, admissionResponse *admissionv1.AdmissionResponse) (string, *metav1.Status) {
+	// Enforce the tenant's pool quota before handing out another pool
+	if t, _ := a.tenantPolicy(tenant); t.MaxPools > 0 {
+		maxPools := t.MaxPools
+		held := countTenantPools(pools, tenant)
+		if held >= maxPools {
+			message := fmt.Sprintf("tenant %s holds %d of its %d allowed IP pools", tenant, held, maxPools)
+			if a.Config.QuotaMode != config.QuotaModeWarn {
+				a.Logger.Warn("Tenant pool quota exceeded, denying", zap.String("tenant", tenant), zap.Int("held", held), zap.Int("max", maxPools))
+				return "", denial(statusQuotaExceeded, "Pool quota exceeded: %s.", message)
 			}
-			// Do not attempt to patch the namespace during deletion
-			// a.writeAdmissionResponse(w, admissionResponse)
+			a.Logger.Warn("Tenant pool quota exceeded, allowing", zap.String("tenant", tenant), zap.Int("held", held), zap.Int("max", maxPools))
+			addWarning(admissionResponse, "%s", message)
+		}
+	}
 
-			// // Remove the annotation from the namespace
-			// patch := []map[string]interface{}{
-			// 	{
-			// 		"op":   "remove",
-			// 		"path": "/metadata/annotations/cni.projectcalico.org~1ipv4pools", // remove annotation key
-			// 	},
-			// }
+	var availableSubnet string
+	if a.Config.Hierarchy != nil && tenant != "" {
+		var err error
+		availableSubnet, err = a.allocateFromHierarchy(ctx, tenant, pools)
+		if err != nil {
+			a.Logger.Error("could not allocate from team aggregate", zap.String("tenant", tenant), zap.Error(err))
+			return "", denial(statusAggregateAllocFailed, "could not allocate from team aggregate: %v", err)
+		}
+	} else {
+		var err error
+		availableSubnet, err = a.allocateSubnet(ctx, namespaceName(&admissionv1.AdmissionRequest{}, ns), tenant, selectors, a.selectionCandidates(ns, pools))
+		if err != nil {
+			a.Logger.Error("could not allocate from IPAM backend", zap.String("tenant", tenant), zap.Error(err))
+			return "", denial(statusBackendAllocFailed, "could not allocate from IPAM backend: %v", err)
+		}
+	}
+	if availableSubnet == "" {
+		a.Logger.Warn("No available subnets found", zap.String("tenant", tenant))
+		if !isDryRun(ctx) {
+			a.Recorder.Eventf(ns, corev1.EventTypeWarning, reasonPoolExhausted, "No available IP pool for tenant %q", tenant)
+			a.Alerter.Fire(alert.KindPoolExhausted, tenant, "No available IP pool in zone %s for tenant %q", a.Config.Location, tenant)
+		}
+		if selectors != nil {
+			return "", denial(statusPoolsExhausted, "No available subnets found for tenant %s.", tenant)
+		}
+		return "", denial(statusPoolsExhausted, "No available subnets found.")
+	}
+	return availableSubnet, nil
+}
 
-			// patchBytes, err := json.Marshal(patch)
-			// if err != nil {
-			// 	a.Logger.Error("could not marshal patch", zap.Error(err))
-			// 	http.Error(w, fmt.Sprintf("could not marshal patch: %v", err), http.StatusInternalServerError)
-			// 	return
-			// }
+// validateRequestedPool checks a pool the user pre-set in the ipv4pools
+// annotation: it must exist, be within the tenant's (or the default zone's)
+// pools and be available. It returns the pool name, or the status to deny the
+// request with.
+func (a *AdmissionController) validateRequestedPool(requested, tenant string, selectors []labels.Selector, pools []crdv1.IPPool) (string, *metav1.Status) {
+	var names []string
+	if err := json.Unmarshal([]byte(requested), &names); err != nil {
+		return "", denial(statusInvalidPoolAnnotation, "invalid %s annotation %q: must be a JSON list of pool names", ipv4PoolsAnnotation, requested)
+	}
+	if len(names) != 1 {
+		return "", denial(statusInvalidPoolAnnotation, "invalid %s annotation %q: exactly one requested pool is supported", ipv4PoolsAnnotation, requested)
+	}
 
-			// admissionResponse.Patch = patchBytes
-			// admissionResponse.PatchType = func() *admissionv1.PatchType {
-			// 	pt := admissionv1.PatchTypeJSONPatch
-			// 	return &pt
-			// }()
+	name := names[0]
+	for _, pool := range pools {
+		if pool.Name != name {
+			continue
+		}
+		poolLabels := normalizeLabels(pool.ObjectMeta.Labels)
+		inScope := a.poolInScope(poolLabels, tenant, selectors)
+		if a.Config.Hierarchy != nil && tenant != "" {
+			inScope = poolLabels[poolTeamLabel] == tenant
+		}
+		if !inScope || !a.inLocalRegion(pool.Spec.CIDR) {
+			a.Logger.Warn("Requested pool is outside the namespace's allowed pools", zap.String("poolName", name), zap.String("tenant", tenant))
+			return "", denial(statusPoolNotAllowed, "Requested IP pool %s is not allowed for this namespace (tenant %q).", name, tenant)
+		}
+		if status := poolLabels["status"]; status != "available" {
+			a.Logger.Warn("Requested pool is not available", zap.String("poolName", name), zap.String("status", status))
+			return "", denial(statusPoolUnavailable, "Requested IP pool %s is not available (status %q).", name, status)
+		}
+		if poolCordoned(poolLabels) {
+			a.Logger.Warn("Requested pool is cordoned", zap.String("poolName", name))
+			return "", denial(statusPoolUnavailable, "Requested IP pool %s is cordoned.", name)
+		}
+		a.Logger.Info("Honoring requested pool", zap.String("poolName", name))
+		return name, nil
+	}
+	return "", denial(statusPoolNotFound, "Requested IP pool %s does not exist.", name)
+}
+
+// poolCIDR returns the CIDR of a pool from the listed pools, or fetches it for
+// a pool created after the list, e.g. a new child pool of a team aggregate.
+func (a *AdmissionController) poolCIDR(ctx context.Context, poolName string, pools []crdv1.IPPool) (string, error) {
+	for _, pool := range pools {
+		if pool.Name == poolName {
+			return pool.Spec.CIDR, nil
+		}
+	}
+	if cidr, ok := carvedCIDR(ctx, poolName); ok {
+		return cidr, nil
+	}
+	pool, err := a.CalicoReader.ProjectcalicoV3().IPPools().Get(ctx, poolName, metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("could not get IP pool: %v", err)
+	}
+	return pool.Spec.CIDR, nil
+}
 
+// claimedPool returns the pending or used pool already claimed by the request
+// with the given UID, if any.
+func claimedPool(pools []crdv1.IPPool, uid types.UID) string {
+	for _, pool := range pools {
+		poolLabels := normalizeLabels(pool.ObjectMeta.Labels)
+		if status := poolLabels["status"]; (status == "pending" || status == "used") && poolLabels[poolRequestLabel] == string(uid) {
+			return pool.Name
 		}
 	}
+	return ""
+}
+
+func (a *AdmissionController) handleNamespaceDeletion(ctx context.Context, w http.ResponseWriter, req *admissionv1.AdmissionRequest, admissionResponse *admissionv1.AdmissionResponse) {
+	namespace := req.Name
+	a.Logger.Info("Handling namespace deletion", zap.String("namespace", namespace))
+
+	// Fetch the namespace to get the IP pool annotation
+	ns, err := a.K8sReader.CoreV1().Namespaces().Get(ctx, namespace, metav1.GetOptions{})
+	if err != nil {
+		a.Logger.Error("could not fetch namespace", zap.Error(err))
+		// Failing open leaves the pools to the release finalizer or the GC
+		a.deny(w, req, admissionResponse, denial(statusInternalError, "could not fetch namespace: %v", err), nil)
+		return
+	}
 
+	// Fetch the annotation value
+	ipPoolAnnotation, found := ns.Annotations[ipv4PoolsAnnotation]
+	if !found || ipPoolAnnotation == "" {
+		a.Logger.Warn("No IP pool annotation found, nothing to update")
+		a.writeAdmissionResponse(w, admissionResponse)
+		return
+	}
+
+	// Decode JSON array from annotation
+	var ipPools []string
+	if err := json.Unmarshal([]byte(ipPoolAnnotation), &ipPools); err != nil {
+		a.Logger.Error("Failed to decode IP pool annotation", zap.String("annotation", ipPoolAnnotation), zap.Error(err))
+		a.writeInternalError(w, admissionResponse, "could not decode IP pool annotation: %v", err)
+		return
+	}
+
+	if len(ipPools) == 0 {
+		a.Logger.Warn("No IP pools found in annotation")
+	}
+
+	// A namespace carrying the finalizer is released during its termination
+	// by the release reconciler, which does not depend on seeing this request
+	if hasReleaseFinalizer(ns) {
+		a.Logger.Info("Namespace pools are released by the finalizer", zap.String("namespace", namespace))
+		a.writeAdmissionResponse(w, admissionResponse)
+		return
+	}
+	if err := a.releaseNamespacePools(ctx, ns, ipPools); err != nil {
+		a.Logger.Error("could not release IP pools", zap.Error(err))
+		a.deny(w, req, admissionResponse, denial(statusInternalError, "%v", err), nil)
+		return
+	}
+
+	// Do not attempt to patch the namespace during deletion
 	a.writeAdmissionResponse(w, admissionResponse)
-	a.Logger.Info("Admission review request handled successfully")
 }
 
-// Select an available subnet
-func (a *AdmissionController) selectAvailableSubnet(subnets []crdv1.IPPool) string {
-	for _, subnet := range subnets {
-		labels := normalizeLabels(subnet.ObjectMeta.Labels)
-		if location, ok := labels["location"]; ok && location == "zone-lhr" {
-			if status, ok := labels["status"]; ok && status == "available" {
-				a.Logger.Info("Found available subnet", zap.String("subnet", subnet.Name))
-				return subnet.Name
+// releaseNamespacePools releases the pools of a deleted namespace. Pools the
+// namespace does not own are left alone and reported.
+func (a *AdmissionController) releaseNamespacePools(ctx context.Context, ns *corev1.Namespace, ipPools []string) error {
+	namespace := ns.Name
+
+	// Release every pool, the namespace may have been grown beyond its first
+	for _, ipPoolName := range ipPools {
+		a.Logger.Info("Selected IP pool name", zap.String("poolName", ipPoolName))
+
+		// The annotation is user-editable, so only free a pool that is
+		// actually ours; never hand out another namespace's subnet
+		pool, err := a.verifyPoolOwner(ctx, ipPoolName, ns)
+		if err != nil {
+			a.Logger.Warn("Not releasing IP pool owned by someone else", zap.String("namespace", namespace), zap.String("poolName", ipPoolName), zap.Error(err))
+			if isDryRun(ctx) {
+				continue
 			}
+			a.Recorder.Eventf(ns, corev1.EventTypeWarning, reasonReleaseBlocked, "IP pool %s was not released: %v", ipPoolName, err)
+			a.Alerter.Fire(alert.KindReleaseBlocked, namespace+"/"+ipPoolName, "IP pool %s was not released on deletion of namespace %s: %v", ipPoolName, namespace, err)
+			continue
+		}
+		if isDryRun(ctx) {
+			a.Logger.Info("Dry run, not releasing IP pool", zap.String("namespace", namespace), zap.String("poolName", ipPoolName))
+			continue
+		}
+
+		labelCtx, labelSpan := tracer.Start(ctx, "label-update")
+		err = a.releasePool(labelCtx, pool, namespace)
+		labelSpan.End()
+		if err != nil {
+			a.Recorder.Eventf(ns, corev1.EventTypeWarning, reasonReleaseBlocked, "IP pool %s was not released: %v", ipPoolName, err)
+			return fmt.Errorf("could not release IP pool %s: %v", ipPoolName, err)
+		}
+		a.Recorder.Eventf(ns, corev1.EventTypeNormal, reasonPoolReleased, "Released IP pool %s", ipPoolName)
+		a.publishAllocation(sink.EventReleased, namespace, ipPoolName, pool.Spec.CIDR, normalizeLabels(pool.ObjectMeta.Labels)[poolTenantLabel])
+		if record := audit.FromContext(ctx); record.Pool == "" {
+			record.Pool = ipPoolName
+		} else {
+			record.Pool += "," + ipPoolName
+		}
+	}
+	return nil
+}
+
+// verifyPoolOwner checks that a pool is bound to the namespace being deleted.
+// Pools without an owner label predate ownership tracking, or belong to a
+// generateName namespace that was never bound; those are matched by the
+// request UID where both sides record it.
+func (a *AdmissionController) verifyPoolOwner(ctx context.Context, poolName string, ns *corev1.Namespace) (*crdv1.IPPool, error) {
+	pool, err := a.CalicoReader.ProjectcalicoV3().IPPools().Get(ctx, poolName, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("could not get IP pool: %v", err)
+	}
+	poolLabels := normalizeLabels(pool.ObjectMeta.Labels)
+	if status := poolLabels["status"]; status != "used" && status != "pending" {
+		return nil, fmt.Errorf("pool is not in use (status %q)", status)
+	}
+	if owner := poolLabels[poolNamespaceLabel]; owner != "" {
+		if owner != ns.Name {
+			return nil, fmt.Errorf("pool is owned by namespace %s", owner)
+		}
+		return pool, nil
+	}
+	poolUID, nsUID := poolLabels[poolRequestLabel], ns.Annotations[requestAnnotation]
+	if poolUID != "" && nsUID != "" && poolUID != nsUID {
+		return nil, fmt.Errorf("pool was claimed by request %s, namespace by request %s", poolUID, nsUID)
+	}
+	return pool, nil
+}
+
+// Select an available subnet for the tenant. Without tenant selectors any
+// pool in the configured location is eligible; with selectors only matching
+// pools are. Eligible pools are tried in priority order, see rankPools.
+func (a *AdmissionController) selectAvailableSubnet(subnets []crdv1.IPPool, tenant string, selectors []labels.Selector) string {
+	var candidates []crdv1.IPPool
+	for _, subnet := range subnets {
+		poolLabels := normalizeLabels(subnet.ObjectMeta.Labels)
+		if !a.poolInScope(poolLabels, tenant, selectors) || !a.inLocalRegion(subnet.Spec.CIDR) {
+			continue
+		}
+		if status, ok := poolLabels["status"]; ok && status == "available" && !poolCordoned(poolLabels) {
+			candidates = append(candidates, subnet)
+		}
+	}
+	if len(candidates) == 0 {
+		a.Logger.Warn("No available subnet found")
+		return ""
+	}
+
+	ranked := a.rankPools(candidates)
+	a.Logger.Info("Found available subnet", zap.String("subnet", ranked[0].Name))
+	return ranked[0].Name
+}
+
+// poolInScope reports whether a pool may be handed out to the tenant: a nil
+// selector list means the global location model, otherwise any matching
+// selector admits it. Child pools carved from a team aggregate are only ever
+// the team's, whatever the selectors.
+func (a *AdmissionController) poolInScope(poolLabels map[string]string, tenant string, selectors []labels.Selector) bool {
+	if team := poolLabels[poolTeamLabel]; team != "" || a.carvedFromHierarchy(poolLabels) {
+		return team != "" && team == tenant
+	}
+	if selectors == nil {
+		location, ok := poolLabels["location"]
+		return ok && location == a.Config.Location
+	}
+	for _, selector := range selectors {
+		if selector.Matches(labels.Set(poolLabels)) {
+			return true
 		}
 	}
-	a.Logger.Warn("No available subnet found")
+	return false
+}
+
+// isExempt checks the namespace in a request against the configured
+// exemptions. Labels come from the new object, or the old one on DELETE.
+func (a *AdmissionController) isExempt(req *admissionv1.AdmissionRequest) bool {
+	raw := req.Object.Raw
+	if len(raw) == 0 {
+		raw = req.OldObject.Raw
+	}
+	var ns corev1.Namespace
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &ns); err != nil {
+			a.Logger.Warn("could not decode namespace for exemption check", zap.Error(err))
+		}
+	}
+	name := req.Name
+	if name == "" {
+		name = ns.Name
+	}
+	return a.Config.IsExempt(name, ns.Labels)
+}
+
+// isCritical checks the namespace a request is about, or the namespace of a
+// namespaced object, against the critical namespaces.
+func (a *AdmissionController) isCritical(req *admissionv1.AdmissionRequest) bool {
+	if req.Namespace != "" {
+		return a.Config.IsCritical(req.Namespace, nil)
+	}
+	if req.Kind.Kind != "Namespace" {
+		return false
+	}
+	raw := req.Object.Raw
+	if len(raw) == 0 {
+		raw = req.OldObject.Raw
+	}
+	var ns corev1.Namespace
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &ns); err != nil {
+			a.Logger.Warn("could not decode namespace for critical namespace check", zap.Error(err))
+		}
+	}
+	return a.Config.IsCritical(namespaceName(req, &ns), ns.Labels)
+}
+
+// namespaceName names the namespace of a request for logging. Namespaces
+// created with generateName have no name until the API server commits them,
+// so those are shown by their prefix.
+func namespaceName(req *admissionv1.AdmissionRequest, ns *corev1.Namespace) string {
+	switch {
+	case req.Name != "":
+		return req.Name
+	case ns.Name != "":
+		return ns.Name
+	case ns.GenerateName != "":
+		return ns.GenerateName + "*"
+	}
 	return ""
 }
 
+// countTenantPools counts the used pools currently owned by a tenant.
+func countTenantPools(pools []crdv1.IPPool, tenant string) int {
+	count := 0
+	for _, pool := range pools {
+		poolLabels := normalizeLabels(pool.ObjectMeta.Labels)
+		if status := poolLabels["status"]; poolLabels[poolTenantLabel] == tenant && (status == "used" || status == "pending" || status == statusExternal) {
+			count++
+		}
+	}
+	return count
+}
+
 func normalizeLabels(labels map[string]string) map[string]string {
 	normalized := make(map[string]string)
 	for key, value := range labels {
@@ -240,44 +975,135 @@ func normalizeLabels(labels map[string]string) map[string]string {
 	return normalized
 }
 
-func (a *AdmissionController) updateIPPoolLabel(poolName, newStatus string) error {
-	ipPool, err := a.Clientset.ProjectcalicoV3().IPPools().Get(context.TODO(), poolName, metav1.GetOptions{})
-	if err != nil {
-		a.Logger.Error("could not get IP pool", zap.Error(err))
-		return fmt.Errorf("could not get IP pool: %v", err)
-	}
+// updateIPPoolLabels sets the status label of a pool together with any extra
+// labels, and removes the labels listed in remove.
+func (a *AdmissionController) updateIPPoolLabels(ctx context.Context, poolName, newStatus string, set map[string]string, remove []string) error {
+	return a.updateIPPool(ctx, poolName, func(ipPool *crdv1.IPPool) error {
+		labels := normalizeLabels(ipPool.ObjectMeta.Labels)
+
+		if labels == nil {
+			labels = make(map[string]string)
+		}
+
+		labels["status"] = newStatus
+		for key, value := range set {
+			labels[key] = value
+		}
+		for _, key := range remove {
+			delete(labels, key)
+		}
+		ipPool.ObjectMeta.Labels = labels
+		return nil
+	})
+}
 
-	labels := normalizeLabels(ipPool.ObjectMeta.Labels)
+// assignPool marks a pool pending or used with the given owner labels and
+// annotations. When the pool's zone template pins pools to nodes, the
+// nodeSelector is applied as well so pods only get addresses from the subnet
+// on nodes in that zone. Only pools the controller created are pinned; static
+// pools keep the nodeSelector their operators gave them, as nothing would
+// restore it on release.
+func (a *AdmissionController) assignPool(ctx context.Context, poolName, status string, owner, annotations map[string]string) error {
+	err := a.updateIPPool(ctx, poolName, func(ipPool *crdv1.IPPool) error {
+		labels := normalizeLabels(ipPool.ObjectMeta.Labels)
+		// Re-checked on every attempt: a concurrent writer may have taken
+		// the pool since it was selected
+		if (labels["status"] != "available" || poolCordoned(labels)) && !claimedBy(labels, owner) {
+			return errPoolLocked
+		}
+		labels["status"] = status
+		for key, value := range owner {
+			labels[key] = value
+		}
+		ipPool.ObjectMeta.Labels = labels
+		for key, value := range annotations {
+			if ipPool.ObjectMeta.Annotations == nil {
+				ipPool.ObjectMeta.Annotations = map[string]string{}
+			}
+			ipPool.ObjectMeta.Annotations[key] = value
+		}
 
-	if labels == nil {
-		labels = make(map[string]string)
+		if selector := a.Config.PoolTemplateFor(labels["location"]).NodeSelector; selector != "" && createdPool(labels) {
+			ipPool.Spec.NodeSelector = selector
+		}
+		return nil
+	})
+	if errors.Is(err, errPoolLocked) {
+		allocationsLost.Inc()
 	}
+	return err
+}
 
-	labels["status"] = newStatus
-	ipPool.ObjectMeta.Labels = labels
+// createdPool reports whether the controller created the pool: split or
+// carved from a master pool, or created for a subnet of the external backend.
+func createdPool(poolLabels map[string]string) bool {
+	return poolLabels[poolParentLabel] != "" || poolLabels[poolBackendLabel] != ""
+}
+
+// claimedBy reports whether the pool labels already name owner, i.e. an
+// earlier attempt of the same assignment went through.
+func claimedBy(poolLabels, owner map[string]string) bool {
+	if uid := owner[poolRequestLabel]; uid != "" {
+		return poolLabels[poolRequestLabel] == uid
+	}
+	namespace := owner[poolNamespaceLabel]
+	return namespace != "" && poolLabels[poolNamespaceLabel] == namespace
+}
 
-	_, err = a.Clientset.ProjectcalicoV3().IPPools().Update(context.TODO(), ipPool, metav1.UpdateOptions{})
+// updateIPPool fetches a pool, applies mutate to it and patches the changes
+// back. On a conflict the pool is re-read and mutate applied again, with
+// bounded backoff, so a concurrent change to the pool is never overwritten.
+// mutate can abort the update by returning an error, which is returned as is.
+func (a *AdmissionController) updateIPPool(ctx context.Context, poolName string, mutate func(ipPool *crdv1.IPPool) error) error {
+	var ipPool *crdv1.IPPool
+	attempt := 0
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		attempt++
+		if attempt > 1 {
+			poolUpdateRetries.Inc()
+		}
+		original, err := a.Clientset.ProjectcalicoV3().IPPools().Get(ctx, poolName, metav1.GetOptions{})
+		if err != nil {
+			return fmt.Errorf("could not get IP pool: %v", err)
+		}
+		ipPool = original.DeepCopy()
+		if err := mutate(ipPool); err != nil {
+			return err
+		}
+		err = a.patchIPPool(ctx, original, ipPool)
+		if apierrors.IsConflict(err) {
+			poolUpdateConflicts.Inc()
+			a.Logger.Info("IP pool changed concurrently, retrying update", zap.String("poolName", poolName), zap.Int("attempt", attempt))
+			return err
+		}
+		if err != nil {
+			return fmt.Errorf("could not update IP pool: %v", err)
+		}
+		return nil
+	})
+	if apierrors.IsConflict(err) {
+		err = fmt.Errorf("could not update IP pool after %d conflicting attempts: %v", attempt, err)
+	}
 	if err != nil {
-		a.Logger.Error("could not update IP pool", zap.Error(err))
-		return fmt.Errorf("could not update IP pool: %v", err)
+		a.Logger.Error("could not update IP pool", zap.String("poolName", poolName), zap.Error(err))
+		return err
 	}
-	a.Logger.Info("Successfully updated IP pool label", zap.String("poolName", poolName), zap.String("newStatus", newStatus))
+	a.Logger.Info("Successfully updated IP pool", zap.String("poolName", poolName), zap.Any("labels", ipPool.ObjectMeta.Labels))
 	return nil
 }
 
+// writeAdmissionResponse buffers the whole review before writing anything, so
+// an encoding failure can still become a clean error response and the API
+// server never sees a truncated body. Content-Length is always set.
 func (a *AdmissionController) writeAdmissionResponse(w http.ResponseWriter, admissionResponse *admissionv1.AdmissionResponse) {
-	a.Logger.Info("Writing admission response")
-	admissionReview := admissionv1.AdmissionReview{
-		TypeMeta: metav1.TypeMeta{
-			APIVersion: "admission.k8s.io/v1",
-			Kind:       "AdmissionReview",
-		},
-		Response: admissionResponse,
-	}
+	a.writeAdmissionResponseStatus(w, admissionResponse, http.StatusOK)
+}
 
-	if err := json.NewEncoder(w).Encode(admissionReview); err != nil {
-		a.Logger.Error("could not encode response", zap.Error(err))
-		http.Error(w, fmt.Sprintf("could not encode response: %v", err), http.StatusInternalServerError)
+func (a *AdmissionController) writeAdmissionResponseStatus(w http.ResponseWriter, admissionResponse *admissionv1.AdmissionResponse, status int) {
+	a.Logger.Info("Writing admission response")
+	if err := admissionreview.Write(w, admissionResponse, status); err != nil {
+		a.Logger.Error("could not send admission response", zap.Error(err))
+		return
 	}
 
 	a.Logger.Info("Admission review request handled successfully")
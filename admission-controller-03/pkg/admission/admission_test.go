@@ -0,0 +1,261 @@
+package admission
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"go.uber.org/zap"
+
+	crdv1 "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
+	calicofake "github.com/projectcalico/api/pkg/client/clientset_generated/clientset/fake"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8sruntime "k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
+
+	"admission-controller-03/pkg/config"
+)
+
+// newPoolController returns a controller over fake clientsets holding n
+// available pools in the default zone, like ipamctl simulate builds one.
+func newPoolController(n int) (*AdmissionController, *calicofake.Clientset, *k8sfake.Clientset) {
+	pools := make([]k8sruntime.Object, 0, n)
+	for i := 0; i < n; i++ {
+		pools = append(pools, &crdv1.IPPool{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   fmt.Sprintf("pool-%d", i),
+				Labels: map[string]string{"location": "zone-lhr", "status": "available"},
+			},
+			Spec: crdv1.IPPoolSpec{CIDR: fmt.Sprintf("10.0.%d.0/26", i)},
+		})
+	}
+	calicoClient := calicofake.NewSimpleClientset(pools...)
+	k8sClient := k8sfake.NewSimpleClientset()
+	a := NewAdmissionControllerFromClients(zap.NewNop(), config.Default(), calicoClient, k8sClient)
+	a.Shutdown()
+	a.Recorder = &record.FakeRecorder{}
+	a.LeaseNamespace = "ipam-system"
+	return a, calicoClient, k8sClient
+}
+
+// admit sends a namespace review with the given UID through the mutating
+// handler and returns the response.
+func admit(t *testing.T, a *AdmissionController, uid types.UID, operation admissionv1.Operation, ns *corev1.Namespace) *admissionv1.AdmissionResponse {
+	t.Helper()
+	resp, err := review(a, uid, operation, ns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func review(a *AdmissionController, uid types.UID, operation admissionv1.Operation, ns *corev1.Namespace) (*admissionv1.AdmissionResponse, error) {
+	body, err := reviewBody(uid, operation, ns)
+	if err != nil {
+		return nil, err
+	}
+	w := httptest.NewRecorder()
+	a.HandleAdmissionReview(w, httptest.NewRequest(http.MethodPost, "/mutate", body))
+	var out admissionv1.AdmissionReview
+	if err := json.Unmarshal(w.Body.Bytes(), &out); err != nil {
+		return nil, fmt.Errorf("response is not an AdmissionReview: %v", err)
+	}
+	if out.Response == nil {
+		return nil, fmt.Errorf("empty %s response", operation)
+	}
+	return out.Response, nil
+}
+
+// reviewBody encodes a namespace review with the given UID; options adjust
+// the request, e.g. to mark it a dry run.
+func reviewBody(uid types.UID, operation admissionv1.Operation, ns *corev1.Namespace, options ...func(*admissionv1.AdmissionRequest)) (io.Reader, error) {
+	raw, err := json.Marshal(ns)
+	if err != nil {
+		return nil, err
+	}
+	req := &admissionv1.AdmissionRequest{
+		UID:       uid,
+		Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Namespace"},
+		Name:      ns.Name,
+		Operation: operation,
+		Object:    k8sruntime.RawExtension{Raw: raw},
+	}
+	for _, option := range options {
+		option(req)
+	}
+	body, err := json.Marshal(admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+		Request:  req,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(body), nil
+}
+
+// patchedPools extracts the ipv4pools annotation value from a JSON patch.
+func patchedPools(patch []byte) string {
+	var ops []patchOperation
+	if err := json.Unmarshal(patch, &ops); err != nil {
+		return ""
+	}
+	for _, op := range ops {
+		if value, ok := op.Value.(string); ok && op.Path == annotationPath(ipv4PoolsAnnotation) {
+			return value
+		}
+	}
+	return ""
+}
+
+// claims lists the pools claimed by a request UID.
+func claims(t *testing.T, calicoClient *calicofake.Clientset, uid types.UID) []string {
+	t.Helper()
+	pools, err := calicoClient.ProjectcalicoV3().IPPools().List(context.Background(), metav1.ListOptions{
+		LabelSelector: poolRequestLabel + "=" + string(uid),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, pool := range pools.Items {
+		names = append(names, pool.Name)
+	}
+	return names
+}
+
+func TestHandleAdmissionReviewAssignsPool(t *testing.T) {
+	a, calicoClient, _ := newPoolController(2)
+	resp := admit(t, a, "uid-1", admissionv1.Create, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a"}})
+	if !resp.Allowed {
+		t.Fatalf("denied: %v", resp.Result)
+	}
+	pools := patchedPools(resp.Patch)
+	if claimed := claims(t, calicoClient, "uid-1"); len(claimed) != 1 || pools != `["`+claimed[0]+`"]` {
+		t.Errorf("patch assigns %s, request claimed %v", pools, claimed)
+	}
+}
+
+func TestHandleAdmissionReviewRetriedUID(t *testing.T) {
+	a, calicoClient, _ := newPoolController(4)
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a"}}
+	first := admit(t, a, "uid-1", admissionv1.Create, ns)
+	if !first.Allowed {
+		t.Fatalf("denied: %v", first.Result)
+	}
+	want := patchedPools(first.Patch)
+
+	// The API server retries a timed-out request with the same UID, possibly
+	// while the first attempt is still running on another replica
+	var wg sync.WaitGroup
+	got := make([]string, 4)
+	errs := make([]error, len(got))
+	for i := range got {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resp, err := review(a, "uid-1", admissionv1.Create, ns)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			got[i] = patchedPools(resp.Patch)
+		}(i)
+	}
+	wg.Wait()
+	for i, pools := range got {
+		if errs[i] != nil {
+			t.Errorf("retry %d: %v", i, errs[i])
+		} else if pools != want {
+			t.Errorf("retry %d got %s, first attempt %s", i, pools, want)
+		}
+	}
+	if claimed := claims(t, calicoClient, "uid-1"); len(claimed) != 1 {
+		t.Errorf("request claimed %d pools: %v", len(claimed), claimed)
+	}
+
+	// A different request gets a different pool
+	other := admit(t, a, "uid-2", admissionv1.Create, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-b"}})
+	if !other.Allowed {
+		t.Fatalf("denied: %v", other.Result)
+	}
+	if pools := patchedPools(other.Patch); pools == want || !strings.HasPrefix(pools, `["pool-`) {
+		t.Errorf("second namespace got %s, first %s", pools, want)
+	}
+}
+
+func TestDryRunFailureNotCounted(t *testing.T) {
+	a, calicoClient, _ := newPoolController(1)
+	calicoClient.PrependReactor("list", "ippools", func(k8stesting.Action) (bool, k8sruntime.Object, error) {
+		return true, nil, errors.New("apiserver unavailable")
+	})
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a"}}
+	for _, dryRun := range []bool{true, false} {
+		body, err := reviewBody(types.UID(fmt.Sprintf("uid-%v", dryRun)), admissionv1.Create, ns, func(req *admissionv1.AdmissionRequest) {
+			req.DryRun = &dryRun
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		a.HandleAdmissionReview(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/mutate", body))
+		want := int32(1)
+		if dryRun {
+			want = 0
+		}
+		if got := a.allocationFailures.Load(); got != want {
+			t.Errorf("dry run %v: %d failed allocations counted, want %d", dryRun, got, want)
+		}
+	}
+}
+
+func TestAssignPoolNodeSelector(t *testing.T) {
+	pools := []k8sruntime.Object{
+		&crdv1.IPPool{
+			ObjectMeta: metav1.ObjectMeta{Name: "static", Labels: map[string]string{"location": "zone-lhr", "status": "available"}},
+			Spec:       crdv1.IPPoolSpec{CIDR: "10.0.0.0/26", NodeSelector: "rack == 'r1'"},
+		},
+		&crdv1.IPPool{
+			ObjectMeta: metav1.ObjectMeta{Name: "child", Labels: map[string]string{"location": "zone-lhr", "status": "available", poolParentLabel: "master"}},
+			Spec:       crdv1.IPPoolSpec{CIDR: "10.0.1.0/26", NodeSelector: "all()"},
+		},
+	}
+	cfg := config.Default()
+	cfg.PoolTemplate.NodeSelector = "zone == 'lhr'"
+	calicoClient := calicofake.NewSimpleClientset(pools...)
+	a := NewAdmissionControllerFromClients(zap.NewNop(), cfg, calicoClient, k8sfake.NewSimpleClientset())
+	a.Shutdown()
+
+	tests := []struct {
+		pool string
+		want string
+	}{
+		{pool: "static", want: "rack == 'r1'"},
+		{pool: "child", want: "zone == 'lhr'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pool, func(t *testing.T) {
+			if err := a.assignPool(context.Background(), tt.pool, "used", map[string]string{poolNamespaceLabel: "web"}, nil); err != nil {
+				t.Fatal(err)
+			}
+			pool, err := calicoClient.ProjectcalicoV3().IPPools().Get(context.Background(), tt.pool, metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if pool.Spec.NodeSelector != tt.want {
+				t.Errorf("nodeSelector %q, want %q", pool.Spec.NodeSelector, tt.want)
+			}
+		})
+	}
+}
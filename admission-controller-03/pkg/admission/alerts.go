@@ -0,0 +1,24 @@
+package admission
+
+import (
+	"admission-controller-03/pkg/alert"
+)
+
+// allocationFailureAlertThreshold is the number of consecutive failed
+// allocations that raises an alert; a single failure is usually a transient
+// API error.
+const allocationFailureAlertThreshold = 3
+
+// allocationFailed counts a failed allocation and alerts operators once
+// failures repeat.
+func (a *AdmissionController) allocationFailed(namespace, reason string) {
+	if n := a.allocationFailures.Add(1); n >= allocationFailureAlertThreshold {
+		a.Alerter.Fire(alert.KindAllocationFailing, a.Config.Location,
+			"%d consecutive pool allocations failed, the last for namespace %s: %s", n, namespace, reason)
+	}
+}
+
+// allocationSucceeded resets the consecutive failure count.
+func (a *AdmissionController) allocationSucceeded() {
+	a.allocationFailures.Store(0)
+}
@@ -0,0 +1,377 @@
+package admission
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+
+	"admission-controller-03/pkg/allocation"
+	"admission-controller-03/pkg/claim"
+	"admission-controller-03/pkg/tenant"
+
+	crdv1 "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// allocationPoolLabel records on an IPPoolAllocation the pool it assigned, so
+// the history of a pool can be listed with a label selector.
+const allocationPoolLabel = "ipam.example.com/pool"
+
+// allocationRetention is how long released and failed allocations are kept
+// as history.
+const allocationRetention = 7 * 24 * time.Hour
+
+// Reasons of the allocation phases.
+const (
+	allocationReasonReserved          = "Reserved"
+	allocationReasonBound             = "Bound"
+	allocationReasonQuarantined       = "PoolQuarantined"
+	allocationReasonReleased          = "Released"
+	allocationReasonPoolDeleted       = "PoolDeleted"
+	allocationReasonAssignmentFailed  = "AssignmentFailed"
+	allocationReasonReservationLapsed = "ReservationLapsed"
+)
+
+var customResourceDefinitions = schema.GroupVersionResource{Group: "apiextensions.k8s.io", Version: "v1", Resource: "customresourcedefinitions"}
+
+// recordsAllocations reports whether assignments are recorded as
+// IPPoolAllocations.
+func (a *AdmissionController) recordsAllocations() bool {
+	return a.RecordAllocations && a.DynamicClient != nil && a.DynamicReader != nil
+}
+
+// InstallCRDs creates or updates the IPPoolAllocation, Tenant and PoolClaim
+// CRDs. With a webhook configuration name, their versions besides the storage
+// version are served and converted by this webhook, reached through the
+// configuration's service.
+func (a *AdmissionController) InstallCRDs(ctx context.Context, webhookConfigName string) error {
+	var conversion map[string]interface{}
+	if webhookConfigName != "" {
+		var err error
+		if conversion, err = a.conversionWebhook(ctx, webhookConfigName); err != nil {
+			return err
+		}
+	} else {
+		a.Logger.Warn("No webhook configuration to reach the conversion webhook through, only v1alpha1 of the CRDs is served")
+	}
+	for _, manifest := range []func() (*unstructured.Unstructured, error){allocation.CRD, tenant.CRD, claim.CRD} {
+		crd, err := manifest()
+		if err != nil {
+			return err
+		}
+		if err := serveConvertedVersions(crd, conversion); err != nil {
+			return fmt.Errorf("could not configure conversion of CRD %s: %v", crd.GetName(), err)
+		}
+		_, err = a.DynamicClient.Resource(customResourceDefinitions).Apply(ctx, crd.GetName(), crd, metav1.ApplyOptions{FieldManager: fieldManager, Force: true})
+		if err != nil {
+			return fmt.Errorf("could not apply CRD %s: %v", crd.GetName(), err)
+		}
+	}
+	return nil
+}
+
+// recordAllocation creates the IPPoolAllocation of an assignment. At admission
+// it is created before the pool is claimed, so no pool is ever held without a
+// record; its name is unique per request, so a retried request finds the
+// record of its first attempt.
+func (a *AdmissionController) recordAllocation(ctx context.Context, ns *corev1.Namespace, uid types.UID, tenant, poolName, poolCIDR string, pools []crdv1.IPPool, phase allocation.Phase) error {
+	if !a.recordsAllocations() {
+		return nil
+	}
+	record := &allocation.IPPoolAllocation{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   allocation.Name(ns.Name, ns.GenerateName, uid),
+			Labels: map[string]string{allocationPoolLabel: poolName, poolRequestLabel: string(uid)},
+		},
+		Spec: allocation.Spec{
+			Namespace:  ns.Name,
+			RequestUID: uid,
+			Tenant:     tenant,
+		},
+		Status: allocation.Status{
+			Pool: poolName,
+			CIDR: poolCIDR,
+		},
+	}
+	if ns.Name != "" {
+		record.Labels[poolNamespaceLabel] = ns.Name
+	}
+	if a.Config.Hierarchy != nil {
+		record.Spec.PrefixLength = a.namespacePrefixLength(tenant)
+	}
+	for _, pool := range pools {
+		if pool.Name == poolName {
+			record.Spec.Zone = normalizeLabels(pool.ObjectMeta.Labels)["location"]
+			break
+		}
+	}
+	if phase == allocation.PhaseBound {
+		setAllocationPhase(record, phase, allocationReasonBound, fmt.Sprintf("Namespace %s holds IP pool %s", ns.Name, poolName))
+	} else {
+		setAllocationPhase(record, phase, allocationReasonReserved, fmt.Sprintf("IP pool %s is reserved until the namespace exists", poolName))
+	}
+
+	object, err := allocation.ToUnstructured(record)
+	if err != nil {
+		return err
+	}
+	_, err = a.DynamicClient.Resource(allocation.Resource).Create(ctx, object, metav1.CreateOptions{FieldManager: fieldManager})
+	if apierrors.IsAlreadyExists(err) {
+		return a.retryFailedAllocation(ctx, record)
+	}
+	if err != nil {
+		return fmt.Errorf("could not create IPPoolAllocation %s: %v", record.Name, err)
+	}
+	return nil
+}
+
+// retryFailedAllocation makes the failed allocation of an earlier attempt of
+// the same request record the new one, which may have selected another pool.
+// An allocation in any other phase is the request's own and kept.
+func (a *AdmissionController) retryFailedAllocation(ctx context.Context, record *allocation.IPPoolAllocation) error {
+	object, err := a.DynamicClient.Resource(allocation.Resource).Get(ctx, record.Name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("could not get IPPoolAllocation %s: %v", record.Name, err)
+	}
+	existing, err := allocation.FromUnstructured(object)
+	if err != nil {
+		return err
+	}
+	if existing.Status.Phase != allocation.PhaseFailed {
+		return nil
+	}
+	existing.Labels, existing.Spec = record.Labels, record.Spec
+	existing.Status.Pool, existing.Status.CIDR, existing.Status.ReleasedAt = record.Status.Pool, record.Status.CIDR, nil
+	setAllocationPhase(existing, record.Status.Phase, record.Status.Reason, record.Status.Message)
+	if object, err = allocation.ToUnstructured(existing); err != nil {
+		return err
+	}
+	if _, err := a.DynamicClient.Resource(allocation.Resource).Update(ctx, object, metav1.UpdateOptions{FieldManager: fieldManager}); err != nil {
+		return fmt.Errorf("could not update IPPoolAllocation %s: %v", record.Name, err)
+	}
+	return nil
+}
+
+// failAllocation marks the allocation of a request whose assignment failed as
+// Failed. It is best effort: an allocation left Pending fails once its
+// reservation lapses.
+func (a *AdmissionController) failAllocation(ctx context.Context, ns *corev1.Namespace, uid types.UID, message string) {
+	if !a.recordsAllocations() {
+		return
+	}
+	name := allocation.Name(ns.Name, ns.GenerateName, uid)
+	object, err := a.DynamicClient.Resource(allocation.Resource).Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return
+	}
+	if err != nil {
+		a.Logger.Error("could not get IP pool allocation", zap.String("allocation", name), zap.Error(err))
+		return
+	}
+	record, err := allocation.FromUnstructured(object)
+	if err != nil {
+		a.Logger.Error("could not decode IP pool allocation", zap.Error(err))
+		return
+	}
+	if record.Status.Finished() {
+		return
+	}
+	setAllocationPhase(record, allocation.PhaseFailed, allocationReasonAssignmentFailed, message)
+	if object, err = allocation.ToUnstructured(record); err != nil {
+		a.Logger.Error("could not encode IP pool allocation", zap.Error(err))
+		return
+	}
+	if _, err := a.DynamicClient.Resource(allocation.Resource).Update(ctx, object, metav1.UpdateOptions{FieldManager: fieldManager}); err != nil {
+		a.Logger.Error("could not mark IP pool allocation failed", zap.String("allocation", name), zap.Error(err))
+	}
+}
+
+// setAllocationPhase moves an allocation to a phase and derives its
+// conditions from it. The phase transition time only changes with the phase,
+// each condition's transition time only with the condition's status.
+func setAllocationPhase(record *allocation.IPPoolAllocation, phase allocation.Phase, reason, message string) {
+	now := metav1.Now()
+	if record.Status.Phase != phase || record.Status.LastPhaseTransitionTime == nil {
+		record.Status.LastPhaseTransitionTime = &now
+	}
+	if phase == allocation.PhaseReleased && record.Status.ReleasedAt == nil {
+		record.Status.ReleasedAt = &now
+	}
+	record.Status.Phase, record.Status.Reason, record.Status.Message = phase, reason, message
+
+	reserved, ready, quarantined := metav1.ConditionFalse, metav1.ConditionFalse, metav1.ConditionFalse
+	switch phase {
+	case allocation.PhasePending:
+		reserved = metav1.ConditionTrue
+	case allocation.PhaseBound:
+		reserved, ready = metav1.ConditionTrue, metav1.ConditionTrue
+	case allocation.PhaseQuarantined:
+		reserved, quarantined = metav1.ConditionTrue, metav1.ConditionTrue
+	}
+	for _, condition := range []metav1.Condition{
+		{Type: allocation.ConditionReserved, Status: reserved},
+		{Type: allocation.ConditionReady, Status: ready},
+		{Type: allocation.ConditionQuarantined, Status: quarantined},
+	} {
+		condition.Reason, condition.Message = reason, message
+		meta.SetStatusCondition(&record.Status.Conditions, condition)
+	}
+}
+
+// RunAllocationController periodically moves IPPoolAllocations through their
+// phases as namespaces appear and pools are released, and deletes released
+// allocations once they are past the retention.
+func (a *AdmissionController) RunAllocationController(ctx context.Context, interval time.Duration) {
+	if !a.recordsAllocations() {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := a.reconcileAllocations(ctx); err != nil {
+			a.Logger.Error("could not reconcile IP pool allocations", zap.Error(err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (a *AdmissionController) reconcileAllocations(ctx context.Context) error {
+	records, err := a.DynamicReader.Resource(allocation.Resource).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("could not list IP pool allocations: %v", err)
+	}
+	if len(records.Items) == 0 {
+		return nil
+	}
+	ipPools, err := a.CalicoReader.ProjectcalicoV3().IPPools().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("could not list IP pools: %v", err)
+	}
+	nsList, err := a.K8sReader.CoreV1().Namespaces().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("could not list namespaces: %v", err)
+	}
+	pools := make(map[string]crdv1.IPPool, len(ipPools.Items))
+	for _, pool := range ipPools.Items {
+		pools[pool.Name] = pool
+	}
+	namespaces := make(map[string]bool, len(nsList.Items))
+	for _, ns := range nsList.Items {
+		namespaces[ns.Name] = true
+	}
+
+	for i := range records.Items {
+		record, err := allocation.FromUnstructured(&records.Items[i])
+		if err != nil {
+			a.Logger.Error("could not decode IP pool allocation", zap.Error(err))
+			continue
+		}
+		if record.Status.Finished() {
+			// Released allocations written before the phase transition time
+			// have only the release time
+			finishedAt := record.Status.LastPhaseTransitionTime
+			if finishedAt == nil {
+				finishedAt = record.Status.ReleasedAt
+			}
+			if finishedAt != nil && time.Since(finishedAt.Time) > allocationRetention {
+				err := a.DynamicClient.Resource(allocation.Resource).Delete(ctx, record.Name, metav1.DeleteOptions{})
+				if err != nil && !apierrors.IsNotFound(err) {
+					a.Logger.Error("could not delete finished IP pool allocation", zap.String("allocation", record.Name), zap.Error(err))
+				}
+			}
+			continue
+		}
+		if !a.advanceAllocation(record, pools, namespaces) {
+			continue
+		}
+		object, err := allocation.ToUnstructured(record)
+		if err != nil {
+			a.Logger.Error("could not encode IP pool allocation", zap.Error(err))
+			continue
+		}
+		// Carries the resourceVersion it was read at; a conflict is retried
+		// on the next pass
+		if _, err := a.DynamicClient.Resource(allocation.Resource).Update(ctx, object, metav1.UpdateOptions{FieldManager: fieldManager}); err != nil {
+			a.Logger.Error("could not update IP pool allocation", zap.String("allocation", record.Name), zap.Error(err))
+			continue
+		}
+		a.Logger.Info("IP pool allocation changed phase", zap.String("allocation", record.Name),
+			zap.String("poolName", record.Status.Pool), zap.String("phase", string(record.Status.Phase)),
+			zap.String("reason", record.Status.Reason))
+	}
+	return nil
+}
+
+// advanceAllocation derives an allocation's phase from its pool and namespace
+// and reports whether the allocation changed. A pool that no longer carries
+// the allocation's request or namespace was released, unless the reservation
+// is young enough that its claim may still be in flight; a reservation that
+// lapsed before its namespace was bound failed.
+func (a *AdmissionController) advanceAllocation(record *allocation.IPPoolAllocation, pools map[string]crdv1.IPPool, namespaces map[string]bool) bool {
+	pool, exists := pools[record.Status.Pool]
+	poolLabels := normalizeLabels(pool.ObjectMeta.Labels)
+	status := poolLabels["status"]
+	carried := exists && (poolLabels[poolRequestLabel] == string(record.Spec.RequestUID) ||
+		(record.Spec.Namespace != "" && poolLabels[poolNamespaceLabel] == record.Spec.Namespace))
+
+	phase, namespace := record.Status.Phase, record.Spec.Namespace
+	var reason, message string
+	switch {
+	case carried && status == "quarantined":
+		phase, reason = allocation.PhaseQuarantined, allocationReasonQuarantined
+		message = fmt.Sprintf("IP pool %s was quarantined", record.Status.Pool)
+		if why := pool.Annotations[quarantineReasonAnnotation]; why != "" {
+			message += ": " + why
+		}
+	case !carried || (status != "pending" && status != "used"):
+		ttl := time.Duration(a.Config.ReservationTTLSeconds) * time.Second
+		young := time.Since(record.CreationTimestamp.Time) < ttl
+		switch {
+		case phase == allocation.PhasePending && young && exists:
+			return false
+		case phase == allocation.PhasePending:
+			phase, reason = allocation.PhaseFailed, allocationReasonReservationLapsed
+			message = fmt.Sprintf("Reservation of IP pool %s lapsed before the namespace was bound", record.Status.Pool)
+		case !exists:
+			phase, reason = allocation.PhaseReleased, allocationReasonPoolDeleted
+			message = fmt.Sprintf("IP pool %s was deleted", record.Status.Pool)
+		default:
+			phase, reason = allocation.PhaseReleased, allocationReasonReleased
+			message = fmt.Sprintf("IP pool %s was released", record.Status.Pool)
+		}
+	case status == "used" && namespaces[poolLabels[poolNamespaceLabel]]:
+		phase, namespace, reason = allocation.PhaseBound, poolLabels[poolNamespaceLabel], allocationReasonBound
+		message = fmt.Sprintf("Namespace %s holds IP pool %s", namespace, record.Status.Pool)
+	default:
+		phase, reason = allocation.PhasePending, allocationReasonReserved
+		message = fmt.Sprintf("IP pool %s is reserved until the namespace exists", record.Status.Pool)
+	}
+	if phase == record.Status.Phase && namespace == record.Spec.Namespace &&
+		reason == record.Status.Reason && message == record.Status.Message {
+		return false
+	}
+
+	if namespace != record.Spec.Namespace {
+		// Filled in for namespaces created with generateName
+		record.Spec.Namespace = namespace
+		if record.Labels == nil {
+			record.Labels = map[string]string{}
+		}
+		record.Labels[poolNamespaceLabel] = namespace
+	}
+	setAllocationPhase(record, phase, reason, message)
+	return true
+}
@@ -0,0 +1,84 @@
+package admission
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// The export formats of the allocations, besides the API's JSON: CSV for
+// spreadsheets and the node-exporter textfile collector format for
+// monitoring that does not scrape the webhook.
+const (
+	ExportCSV      = "csv"
+	ExportTextfile = "textfile"
+)
+
+// ExportContentTypes are the Content-Types the export formats are served as.
+var ExportContentTypes = map[string]string{
+	ExportCSV:      "text/csv; charset=utf-8",
+	ExportTextfile: "text/plain; version=0.0.4; charset=utf-8",
+}
+
+// WriteAllocations writes allocations in an export format.
+func WriteAllocations(w io.Writer, allocations []Allocation, format string) error {
+	switch format {
+	case ExportCSV:
+		return writeAllocationsCSV(w, allocations)
+	case ExportTextfile:
+		return writeAllocationsTextfile(w, allocations)
+	}
+	return fmt.Errorf("unknown export format %q, must be %s or %s", format, ExportCSV, ExportTextfile)
+}
+
+// writeAllocationsCSV writes a row per allocation, with the assignment time in
+// RFC 3339 and empty when the pool carries none.
+func writeAllocationsCSV(w io.Writer, allocations []Allocation) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"namespace", "cidr", "tenant", "zone", "assigned_at"}); err != nil {
+		return err
+	}
+	for _, alloc := range allocations {
+		assignedAt := ""
+		if alloc.AssignedAt != nil {
+			assignedAt = alloc.AssignedAt.UTC().Format(time.RFC3339)
+		}
+		if err := cw.Write([]string{alloc.Namespace, alloc.CIDR, alloc.Tenant, alloc.Zone, assignedAt}); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// writeAllocationsTextfile writes an info series per allocation and, for
+// those with an assignment time, its Unix timestamp, in the Prometheus text
+// format the node-exporter textfile collector reads.
+func writeAllocationsTextfile(w io.Writer, allocations []Allocation) error {
+	var b strings.Builder
+	b.WriteString("# HELP ipam_allocation_info IP pool held by a namespace, or by a request whose namespace is pending.\n")
+	b.WriteString("# TYPE ipam_allocation_info gauge\n")
+	for _, alloc := range allocations {
+		fmt.Fprintf(&b, "ipam_allocation_info{namespace=%s,pool=%s,cidr=%s,tenant=%s,zone=%s,state=%s} 1\n",
+			labelValue(alloc.Namespace), labelValue(alloc.Pool), labelValue(alloc.CIDR),
+			labelValue(alloc.Tenant), labelValue(alloc.Zone), labelValue(alloc.State))
+	}
+	b.WriteString("# HELP ipam_allocation_assigned_timestamp_seconds Unix time the IP pool was assigned.\n")
+	b.WriteString("# TYPE ipam_allocation_assigned_timestamp_seconds gauge\n")
+	for _, alloc := range allocations {
+		if alloc.AssignedAt == nil {
+			continue
+		}
+		fmt.Fprintf(&b, "ipam_allocation_assigned_timestamp_seconds{namespace=%s,pool=%s} %d\n",
+			labelValue(alloc.Namespace), labelValue(alloc.Pool), alloc.AssignedAt.Unix())
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// labelValue quotes a label value as the Prometheus text format escapes it.
+func labelValue(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+}
@@ -0,0 +1,388 @@
+package admission
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"admission-controller-03/pkg/allocation"
+
+	crdv1 "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// AllocationsPath serves the allocations API: GET lists every allocation,
+// GET AllocationsPath/<namespace> those of one namespace. Both answer in JSON
+// or, with ?format=csv or ?format=textfile, in an export format.
+const AllocationsPath = "/api/v1/allocations"
+
+// PoolsPath serves the pool inventory, GET PoolsPath, and the admin verbs on
+// pools: POST PoolsPath/<pool>/cordon, PoolsPath/<pool>/uncordon and
+// PoolsPath/<pool>/release, the latter with ?override=true to skip the check
+// for allocated addresses.
+const PoolsPath = "/api/v1/pools"
+
+// apiUser is who the admin verbs called with the static API token are
+// audited as.
+const apiUser = "api-token"
+
+// Allocation is a pool held by a namespace, as served by the allocations API.
+type Allocation struct {
+	// Namespace is empty while a namespace created with generateName is
+	// pending.
+	Namespace string `json:"namespace,omitempty"`
+	Pool      string `json:"pool"`
+	CIDR      string `json:"cidr"`
+	Zone      string `json:"zone,omitempty"`
+	Tenant    string `json:"tenant,omitempty"`
+	// State is the pool's status label: pending, used, retained, deleting or
+	// quarantined.
+	State      string     `json:"state"`
+	AssignedAt *time.Time `json:"assignedAt,omitempty"`
+	// Phase and Since come from the allocation record, when assignments are
+	// recorded.
+	Phase allocation.Phase `json:"phase,omitempty"`
+	Since *time.Time       `json:"since,omitempty"`
+}
+
+// AllocationList is the body of every allocations API response.
+type AllocationList struct {
+	Items []Allocation `json:"items"`
+}
+
+// HandleAllocations serves the allocations API from the pool cache, so that
+// network tooling and dashboards need no Calico RBAC of their own. Requests
+// must carry the configured API token or, with Kubernetes authentication, a
+// token of a user allowed to list allocations, or get the namespace's.
+func (a *AdmissionController) HandleAllocations(w http.ResponseWriter, r *http.Request) {
+	namespace := strings.Trim(strings.TrimPrefix(r.URL.Path, AllocationsPath), "/")
+	access := apiAccess{resource: apiResourceAllocations, verb: "list"}
+	if namespace != "" {
+		access = apiAccess{resource: apiResourceAllocations, verb: "get", name: namespace}
+	}
+	if _, ok := a.authorizeAPI(w, r, access); !ok {
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if strings.Contains(namespace, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if _, ok := ExportContentTypes[format]; !ok && format != "" && format != "json" {
+		http.Error(w, fmt.Sprintf("unknown format %q, must be json, %s or %s", format, ExportCSV, ExportTextfile), http.StatusBadRequest)
+		return
+	}
+
+	allocations, err := a.Allocations(r.Context())
+	if err != nil {
+		a.Logger.Error("could not list allocations", zap.Error(err))
+		http.Error(w, fmt.Sprintf("could not list allocations: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if namespace != "" {
+		var held []Allocation
+		for _, alloc := range allocations {
+			if alloc.Namespace == namespace {
+				held = append(held, alloc)
+			}
+		}
+		if len(held) == 0 {
+			http.Error(w, fmt.Sprintf("namespace %s holds no IP pool", namespace), http.StatusNotFound)
+			return
+		}
+		allocations = held
+	}
+	if contentType, ok := ExportContentTypes[format]; ok {
+		var body strings.Builder
+		if err := WriteAllocations(&body, allocations, format); err != nil {
+			a.Logger.Error("could not export allocations", zap.String("format", format), zap.Error(err))
+			http.Error(w, fmt.Sprintf("could not export allocations: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Length", strconv.Itoa(body.Len()))
+		if _, err := io.WriteString(w, body.String()); err != nil {
+			a.Logger.Error("could not write API response", zap.Error(err))
+		}
+		return
+	}
+	a.writeJSON(w, AllocationList{Items: allocations})
+}
+
+// Pool is a pool of the inventory, as served by the pools API.
+type Pool struct {
+	Name     string `json:"name"`
+	CIDR     string `json:"cidr"`
+	Zone     string `json:"zone,omitempty"`
+	Status   string `json:"status,omitempty"`
+	Cordoned bool   `json:"cordoned"`
+	// Namespace and Tenant name the holder of a taken pool.
+	Namespace string `json:"namespace,omitempty"`
+	Tenant    string `json:"tenant,omitempty"`
+	// Capacity is the number of addresses of an IPv4 pool. Allocated is the
+	// number Calico IPAM handed out, absent when unknown.
+	Capacity  int  `json:"capacity,omitempty"`
+	Allocated *int `json:"allocated,omitempty"`
+}
+
+// PoolList is the body of the pools API response. Warnings are the
+// conditions operators should look at now: zones running out of pools,
+// namespaces outgrowing theirs and drift between namespaces and pools.
+type PoolList struct {
+	Items    []Pool   `json:"items"`
+	Warnings []string `json:"warnings"`
+}
+
+// HandlePools serves the pool inventory, to users allowed to list
+// ippools.ipam.example.com with Kubernetes authentication.
+func (a *AdmissionController) HandlePools(w http.ResponseWriter, r *http.Request) {
+	if _, ok := a.authorizeAPI(w, r, apiAccess{resource: apiResourcePools, verb: "list"}); !ok {
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	pools, err := a.inventory(r.Context())
+	if err != nil {
+		a.Logger.Error("could not list pool inventory", zap.Error(err))
+		http.Error(w, fmt.Sprintf("could not list pool inventory: %v", err), http.StatusInternalServerError)
+		return
+	}
+	a.writeJSON(w, pools)
+}
+
+// inventory returns every pool, ordered by zone and name, with the current
+// warnings.
+func (a *AdmissionController) inventory(ctx context.Context) (PoolList, error) {
+	ipPools, err := a.listPools(ctx)
+	if err != nil {
+		return PoolList{}, fmt.Errorf("could not list IP pools: %v", err)
+	}
+	usage, err := a.poolUtilization(ctx, ipPools.Items)
+	if err != nil {
+		// The inventory is still served, without utilization
+		a.Logger.Warn("could not read pool utilization for the pool inventory", zap.Error(err))
+	}
+
+	list := PoolList{Items: []Pool{}, Warnings: []string{}}
+	available, zones := map[string]int{}, map[string]bool{}
+	for i := range ipPools.Items {
+		pool := &ipPools.Items[i]
+		poolLabels := normalizeLabels(pool.ObjectMeta.Labels)
+		item := Pool{
+			Name:     pool.Name,
+			CIDR:     pool.Spec.CIDR,
+			Zone:     poolLabels["location"],
+			Status:   poolLabels["status"],
+			Cordoned: poolCordoned(poolLabels),
+		}
+		if alloc, ok := PoolAllocation(pool); ok {
+			item.Namespace, item.Tenant = alloc.Namespace, alloc.Tenant
+		}
+		if u, ok := usage[pool.Name]; ok {
+			allocated := u.Allocated
+			item.Capacity, item.Allocated = u.Capacity, &allocated
+			if g := a.Config.Growth; g != nil && item.Namespace != "" && u.Ratio() >= g.Threshold {
+				list.Warnings = append(list.Warnings, fmt.Sprintf("IP pool %s of namespace %s has %d of %d addresses allocated",
+					pool.Name, item.Namespace, u.Allocated, u.Capacity))
+			}
+		} else if prefix, err := netip.ParsePrefix(pool.Spec.CIDR); err == nil && prefix.Addr().Is4() {
+			item.Capacity = 1 << (32 - prefix.Bits())
+		}
+		zones[item.Zone] = true
+		if item.Status == "available" && !item.Cordoned {
+			available[item.Zone]++
+		}
+		list.Items = append(list.Items, item)
+	}
+	sort.Slice(list.Items, func(i, j int) bool {
+		if list.Items[i].Zone != list.Items[j].Zone {
+			return list.Items[i].Zone < list.Items[j].Zone
+		}
+		return list.Items[i].Name < list.Items[j].Name
+	})
+
+	var low []string
+	for zone := range zones {
+		if threshold := a.Config.LowPoolThresholdFor(zone); threshold > 0 && available[zone] < threshold {
+			low = append(low, fmt.Sprintf("zone %s has %d available IP pools, below the threshold of %d", zone, available[zone], threshold))
+		}
+	}
+	sort.Strings(low)
+	list.Warnings = append(low, list.Warnings...)
+
+	drifts, err := a.DetectDrift(ctx)
+	if err != nil {
+		return PoolList{}, err
+	}
+	for _, drift := range drifts {
+		list.Warnings = append(list.Warnings, fmt.Sprintf("drift (%s): %s", drift.Kind, drift.Detail))
+	}
+	return list, nil
+}
+
+// PoolAction is the body of a successful admin verb response.
+type PoolAction struct {
+	Pool   string `json:"pool"`
+	Action string `json:"action"`
+}
+
+// HandlePoolAction serves the admin verbs. With Kubernetes authentication the
+// user must be allowed the verb on the pool, as a custom verb of
+// ippools.ipam.example.com. A verb refused for the pool's state is answered
+// with 409 Conflict.
+func (a *AdmissionController) HandlePoolAction(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, PoolsPath), "/"), "/")
+	if len(parts) != 2 || parts[0] == "" {
+		http.NotFound(w, r)
+		return
+	}
+	poolName, action := parts[0], parts[1]
+	if action != "cordon" && action != "uncordon" && action != "release" {
+		http.NotFound(w, r)
+		return
+	}
+	actor, ok := a.authorizeAPI(w, r, apiAccess{resource: apiResourcePools, verb: action, name: poolName})
+	if !ok {
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	_, err := a.CalicoReader.ProjectcalicoV3().IPPools().Get(r.Context(), poolName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		http.Error(w, fmt.Sprintf("IP pool %s does not exist", poolName), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("could not get IP pool: %v", err), http.StatusInternalServerError)
+		return
+	}
+	switch action {
+	case "cordon":
+		err = a.CordonPool(r.Context(), poolName, actor)
+	case "uncordon":
+		err = a.UncordonPool(r.Context(), poolName, actor)
+	case "release":
+		override, _ := strconv.ParseBool(r.URL.Query().Get("override"))
+		err = a.ForceReleasePool(r.Context(), poolName, actor, override)
+	}
+	var refusal *refusedError
+	if errors.As(err, &refusal) {
+		http.Error(w, refusal.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		a.Logger.Error("could not run admin verb", zap.String("poolName", poolName), zap.String("action", action), zap.Error(err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	a.writeJSON(w, PoolAction{Pool: poolName, Action: action})
+}
+
+// Allocations returns the pools held by a namespace, or by a request whose
+// namespace is pending, ordered by namespace and pool.
+func (a *AdmissionController) Allocations(ctx context.Context) ([]Allocation, error) {
+	ipPools, err := a.listPools(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not list IP pools: %v", err)
+	}
+	records := map[string]*allocation.IPPoolAllocation{}
+	if a.recordsAllocations() {
+		list, err := a.DynamicReader.Resource(allocation.Resource).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("could not list IP pool allocations: %v", err)
+		}
+		for i := range list.Items {
+			record, err := allocation.FromUnstructured(&list.Items[i])
+			if err != nil || record.Status.Pool == "" || record.Status.Finished() {
+				continue
+			}
+			records[record.Status.Pool+"/"+string(record.Spec.RequestUID)] = record
+		}
+	}
+
+	allocations := []Allocation{}
+	for i := range ipPools.Items {
+		pool := &ipPools.Items[i]
+		alloc, ok := PoolAllocation(pool)
+		if !ok {
+			continue
+		}
+		request := normalizeLabels(pool.ObjectMeta.Labels)[poolRequestLabel]
+		if record := records[pool.Name+"/"+request]; record != nil {
+			alloc.Phase = record.Status.Phase
+			if t := record.Status.LastPhaseTransitionTime; t != nil {
+				since := t.UTC()
+				alloc.Since = &since
+			}
+		}
+		allocations = append(allocations, alloc)
+	}
+	sort.Slice(allocations, func(i, j int) bool {
+		if allocations[i].Namespace != allocations[j].Namespace {
+			return allocations[i].Namespace < allocations[j].Namespace
+		}
+		return allocations[i].Pool < allocations[j].Pool
+	})
+	return allocations, nil
+}
+
+// PoolAllocation returns the allocation a pool's labels describe, and false
+// when the pool is held by no namespace or request.
+func PoolAllocation(pool *crdv1.IPPool) (Allocation, bool) {
+	poolLabels := normalizeLabels(pool.ObjectMeta.Labels)
+	namespace, request := poolLabels[poolNamespaceLabel], poolLabels[poolRequestLabel]
+	if namespace == "" && request == "" {
+		return Allocation{}, false
+	}
+	alloc := Allocation{
+		Namespace: namespace,
+		Pool:      pool.Name,
+		CIDR:      pool.Spec.CIDR,
+		Zone:      poolLabels["location"],
+		Tenant:    poolLabels[poolTenantLabel],
+		State:     poolLabels["status"],
+	}
+	if seconds, err := strconv.ParseInt(poolLabels[poolAssignedAtLabel], 10, 64); err == nil {
+		assignedAt := time.Unix(seconds, 0).UTC()
+		alloc.AssignedAt = &assignedAt
+	}
+	return alloc, true
+}
+
+// writeJSON writes a response body as JSON with its Content-Length.
+func (a *AdmissionController) writeJSON(w http.ResponseWriter, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		a.Logger.Error("could not encode API response", zap.Error(err))
+		http.Error(w, fmt.Sprintf("could not encode response: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	if _, err := w.Write(body); err != nil {
+		a.Logger.Error("could not write API response", zap.Error(err))
+	}
+}
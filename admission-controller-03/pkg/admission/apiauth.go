@@ -0,0 +1,192 @@
+package admission
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// apiGroup is the API group of the resources API calls are authorized
+// against. They exist only for RBAC, nothing serves them.
+const apiGroup = "ipam.example.com"
+
+// Resources API calls are authorized against.
+const (
+	apiResourceAllocations = "allocations"
+	apiResourcePools       = "ippools"
+	apiResourceRegions     = "regions"
+)
+
+// tokenReviewTTL is how long an authenticated token is trusted without a new
+// TokenReview.
+const tokenReviewTTL = 10 * time.Second
+
+// apiAccess is what an API call does, as authorized by SubjectAccessReview.
+type apiAccess struct {
+	resource, verb, name string
+}
+
+// apiUserInfo is an authenticated API client.
+type apiUserInfo struct {
+	name   string
+	uid    string
+	groups []string
+	extra  map[string]authorizationv1.ExtraValue
+	// static is the holder of the static token, who may do everything
+	static bool
+}
+
+type reviewedToken struct {
+	user    apiUserInfo
+	expires time.Time
+}
+
+// tokenCache remembers the users of recently reviewed tokens, by token hash.
+type tokenCache struct {
+	mu     sync.Mutex
+	tokens map[[sha256.Size]byte]reviewedToken
+}
+
+func (c *tokenCache) get(key [sha256.Size]byte) (apiUserInfo, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	reviewed, ok := c.tokens[key]
+	if !ok || time.Now().After(reviewed.expires) {
+		delete(c.tokens, key)
+		return apiUserInfo{}, false
+	}
+	return reviewed.user, true
+}
+
+func (c *tokenCache) put(key [sha256.Size]byte, user apiUserInfo) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.tokens == nil {
+		c.tokens = map[[sha256.Size]byte]reviewedToken{}
+	}
+	// Expired entries of tokens never seen again go with the next put
+	now := time.Now()
+	for k, reviewed := range c.tokens {
+		if now.After(reviewed.expires) {
+			delete(c.tokens, k)
+		}
+	}
+	c.tokens[key] = reviewedToken{user: user, expires: now.Add(tokenReviewTTL)}
+}
+
+// apiEnabled reports whether the API is served, i.e. some way of
+// authenticating its clients is configured.
+func (a *AdmissionController) apiEnabled() bool {
+	return a.APIToken != "" || a.APIKubernetesAuth
+}
+
+// authorizeAPI authenticates the request's bearer token and authorizes the
+// access, and returns the user the call is made and audited as. It answers
+// the request itself when the call may not go ahead.
+func (a *AdmissionController) authorizeAPI(w http.ResponseWriter, r *http.Request, access apiAccess) (string, bool) {
+	if !a.apiEnabled() {
+		http.Error(w, "the API is not enabled", http.StatusNotFound)
+		return "", false
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		unauthorized(w)
+		return "", false
+	}
+	user, ok, err := a.authenticateToken(r, token)
+	if err != nil {
+		a.Logger.Error("could not review API token", zap.Error(err))
+		http.Error(w, fmt.Sprintf("could not review token: %v", err), http.StatusInternalServerError)
+		return "", false
+	}
+	if !ok {
+		unauthorized(w)
+		return "", false
+	}
+	if user.static {
+		return apiUser, true
+	}
+
+	review, err := a.K8sReader.AuthorizationV1().SubjectAccessReviews().Create(r.Context(), &authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			User:   user.name,
+			UID:    user.uid,
+			Groups: user.groups,
+			Extra:  user.extra,
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Group:    apiGroup,
+				Resource: access.resource,
+				Verb:     access.verb,
+				Name:     access.name,
+			},
+		},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		a.Logger.Error("could not review API access", zap.String("user", user.name), zap.Error(err))
+		http.Error(w, fmt.Sprintf("could not review access: %v", err), http.StatusInternalServerError)
+		return "", false
+	}
+	if !review.Status.Allowed {
+		a.Logger.Warn("Denied API access", zap.String("user", user.name), zap.String("resource", access.resource),
+			zap.String("verb", access.verb), zap.String("name", access.name), zap.String("reason", review.Status.Reason))
+		http.Error(w, fmt.Sprintf("user %s may not %s %s.%s %s", user.name, access.verb, access.resource, apiGroup, access.name), http.StatusForbidden)
+		return "", false
+	}
+	return user.name, true
+}
+
+// authenticateToken checks a bearer token against the static token, then by
+// TokenReview. A reviewed token must be issued for APIAudience, when set.
+func (a *AdmissionController) authenticateToken(r *http.Request, token string) (apiUserInfo, bool, error) {
+	if a.APIToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(a.APIToken)) == 1 {
+		return apiUserInfo{name: apiUser, static: true}, true, nil
+	}
+	if !a.APIKubernetesAuth {
+		return apiUserInfo{}, false, nil
+	}
+	key := sha256.Sum256([]byte(token))
+	if user, ok := a.apiTokens.get(key); ok {
+		return user, true, nil
+	}
+	spec := authenticationv1.TokenReviewSpec{Token: token}
+	if a.APIAudience != "" {
+		spec.Audiences = []string{a.APIAudience}
+	}
+	review, err := a.K8sReader.AuthenticationV1().TokenReviews().Create(r.Context(), &authenticationv1.TokenReview{
+		Spec: spec,
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return apiUserInfo{}, false, err
+	}
+	if !review.Status.Authenticated {
+		return apiUserInfo{}, false, nil
+	}
+	if a.APIAudience != "" && !slices.Contains(review.Status.Audiences, a.APIAudience) {
+		a.Logger.Warn("Rejected API token issued for another audience",
+			zap.String("user", review.Status.User.Username), zap.Strings("audiences", review.Status.Audiences))
+		return apiUserInfo{}, false, nil
+	}
+	info := review.Status.User
+	user := apiUserInfo{name: info.Username, uid: info.UID, groups: info.Groups, extra: map[string]authorizationv1.ExtraValue{}}
+	for key, value := range info.Extra {
+		user.extra[key] = authorizationv1.ExtraValue(value)
+	}
+	a.apiTokens.put(key, user)
+	return user, true, nil
+}
+
+func unauthorized(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="ipam"`)
+	http.Error(w, "unauthorized", http.StatusUnauthorized)
+}
@@ -0,0 +1,55 @@
+package admission
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"go.uber.org/zap"
+
+	calicofake "github.com/projectcalico/api/pkg/client/clientset_generated/clientset/fake"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	k8sruntime "k8s.io/apimachinery/pkg/runtime"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"admission-controller-03/pkg/config"
+)
+
+func TestAuthenticateTokenAudience(t *testing.T) {
+	// Tokens are named after the audience they were issued for
+	k8sClient := k8sfake.NewSimpleClientset()
+	k8sClient.PrependReactor("create", "tokenreviews", func(action k8stesting.Action) (bool, k8sruntime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authenticationv1.TokenReview)
+		if len(review.Spec.Audiences) == 0 || slices.Contains(review.Spec.Audiences, review.Spec.Token) {
+			review.Status.Authenticated = true
+			review.Status.User.Username = "system:serviceaccount:tools:client"
+			review.Status.Audiences = []string{review.Spec.Token}
+		}
+		return true, review, nil
+	})
+	a := NewAdmissionControllerFromClients(zap.NewNop(), config.Default(), calicofake.NewSimpleClientset(), k8sClient)
+	a.Shutdown()
+	a.APIKubernetesAuth = true
+	a.APIAudience = "ipam.example.com"
+
+	tests := []struct {
+		token  string
+		wantOK bool
+	}{
+		{token: "ipam.example.com", wantOK: true},
+		{token: "https://kubernetes.default.svc"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.token, func(t *testing.T) {
+			_, ok, err := a.authenticateToken(httptest.NewRequest(http.MethodGet, "/api/v1/allocations", nil), tt.token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != tt.wantOK {
+				t.Errorf("authenticated %v, want %v", ok, tt.wantOK)
+			}
+		})
+	}
+}
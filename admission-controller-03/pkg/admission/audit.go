@@ -0,0 +1,66 @@
+package admission
+
+import (
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+
+	"admission-controller-03/pkg/audit"
+
+	admissionv1 "k8s.io/api/admission/v1"
+)
+
+// statusWriter remembers the status code written, so requests that ended in
+// an HTTP error are audited as such.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// newAuditRecord starts the audit record of a request.
+func newAuditRecord(req *admissionv1.AdmissionRequest, start time.Time) *audit.Record {
+	namespace := req.Namespace
+	if req.Kind.Kind == "Namespace" {
+		namespace = req.Name
+	}
+	return &audit.Record{
+		Time:      start,
+		UID:       string(req.UID),
+		Kind:      req.Kind.Kind,
+		Operation: string(req.Operation),
+		Namespace: namespace,
+		User:      req.UserInfo.Username,
+	}
+}
+
+// writeAudit completes the record with the outcome and appends it to the
+// audit log, if one is configured.
+func (a *AdmissionController) writeAudit(record *audit.Record, admissionResponse *admissionv1.AdmissionResponse, status int, start time.Time) {
+	if a.Audit == nil {
+		return
+	}
+	record.LatencyMS = float64(time.Since(start).Microseconds()) / 1000
+	switch {
+	case status != http.StatusOK:
+		record.Decision = audit.DecisionError
+	case admissionResponse.Allowed:
+		record.Decision = audit.DecisionAllowed
+		record.Patch = admissionResponse.Patch
+	default:
+		record.Decision = audit.DecisionDenied
+	}
+	record.Warnings = admissionResponse.Warnings
+	if admissionResponse.Result != nil {
+		record.Reason = admissionResponse.Result.Message
+		record.Code = string(admissionResponse.Result.Reason)
+	}
+	if err := a.Audit.Write(record); err != nil {
+		a.Logger.Error("could not write audit record", zap.String("uid", record.UID), zap.Error(err))
+	}
+}
@@ -0,0 +1,112 @@
+package admission
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	reasonPoolAutoscaled       = "PoolAutoscaled"
+	reasonPoolAutoscaleLimited = "PoolAutoscaleLimited"
+)
+
+// RunPoolAutoscaler periodically measures the address utilization of every
+// tenant's child pools in the zone and carves another one from the tenant's
+// aggregate once it crosses the configured threshold, so namespaces find a
+// pool ready instead of carving one at admission. Every scaling action, and
+// every first refusal at a limit, is posted as an event on a pool.
+func (a *AdmissionController) RunPoolAutoscaler(ctx context.Context, interval time.Duration) {
+	if a.Config.Autoscaling == nil || a.Config.Hierarchy == nil {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	limited := map[string]bool{}
+	for {
+		if err := a.autoscalePools(ctx, limited); err != nil {
+			a.Logger.Error("could not autoscale IP pools", zap.Error(err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (a *AdmissionController) autoscalePools(ctx context.Context, limited map[string]bool) error {
+	ipPools, err := a.CalicoReader.ProjectcalicoV3().IPPools().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("could not list IP pools: %v", err)
+	}
+	usage, err := a.poolUtilization(ctx, ipPools.Items)
+	if err != nil {
+		return err
+	}
+
+	// A tenant's utilization is that of all of its child pools in the zone,
+	// the available ones included
+	perTenant := map[string]Utilization{}
+	pools := map[string]int{}
+	anchors := map[string]string{}
+	for _, pool := range ipPools.Items {
+		poolLabels := normalizeLabels(pool.ObjectMeta.Labels)
+		tenant := poolLabels[poolTeamLabel]
+		if tenant == "" || poolLabels["location"] != a.Config.Location || poolLabels["status"] == "quarantined" {
+			continue
+		}
+		u := perTenant[tenant]
+		u.Allocated += usage[pool.Name].Allocated
+		u.Capacity += usage[pool.Name].Capacity
+		perTenant[tenant] = u
+		pools[tenant]++
+		if anchors[tenant] == "" || pool.Name < anchors[tenant] {
+			anchors[tenant] = pool.Name
+		}
+	}
+
+	s := a.Config.Autoscaling
+	for tenant, u := range perTenant {
+		if u.Ratio() < s.Threshold {
+			limited[tenant] = false
+			continue
+		}
+		anchor := &corev1.ObjectReference{APIVersion: "projectcalico.org/v3", Kind: "IPPool", Name: anchors[tenant]}
+		var limit string
+		switch size := 1 << (32 - a.namespacePrefixLength(tenant)); {
+		case s.MaxPools > 0 && pools[tenant] >= s.MaxPools:
+			limit = fmt.Sprintf("it holds %d child pools, the maximum", pools[tenant])
+		case s.MaxAddresses > 0 && u.Capacity+size > s.MaxAddresses:
+			limit = fmt.Sprintf("another /%d would exceed the maximum of %d addresses", a.namespacePrefixLength(tenant), s.MaxAddresses)
+		}
+		if limit != "" {
+			if !limited[tenant] {
+				a.Logger.Warn("Tenant pools are past the autoscaling threshold but at a limit",
+					zap.String("tenant", tenant), zap.Int("allocated", u.Allocated), zap.Int("capacity", u.Capacity), zap.String("limit", limit))
+				a.Recorder.Eventf(anchor, corev1.EventTypeWarning, reasonPoolAutoscaleLimited,
+					"Tenant %s uses %d of %d addresses in zone %s but is not scaled up: %s", tenant, u.Allocated, u.Capacity, a.Config.Location, limit)
+			}
+			limited[tenant] = true
+			continue
+		}
+		limited[tenant] = false
+
+		name, subnet, err := a.carveChildPool(ctx, tenant, ipPools.Items)
+		if err != nil {
+			a.Logger.Error("could not carve child pool for tenant", zap.String("tenant", tenant), zap.Error(err))
+			continue
+		}
+		a.Logger.Info("Autoscaled tenant pools", zap.String("tenant", tenant), zap.String("poolName", name), zap.String("cidr", subnet),
+			zap.Int("allocated", u.Allocated), zap.Int("capacity", u.Capacity))
+		a.Recorder.Eventf(&corev1.ObjectReference{APIVersion: "projectcalico.org/v3", Kind: "IPPool", Name: name}, corev1.EventTypeNormal, reasonPoolAutoscaled,
+			"Carved IP pool %s (%s) for tenant %s, which uses %d of %d addresses in zone %s", name, subnet, tenant, u.Allocated, u.Capacity, a.Config.Location)
+	}
+	return nil
+}
@@ -0,0 +1,199 @@
+package admission
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"admission-controller-03/pkg/backend"
+
+	crdv1 "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	// poolBackendLabel marks a pool created for a subnet of the external
+	// backend. Such a pool is deleted once its namespace is gone, and its
+	// subnet handed back to the backend.
+	poolBackendLabel = "ipam.example.com/backend"
+	// poolBackendTenantLabel records the tenant a backend subnet was
+	// allocated for, which outlives the pool's assignments
+	poolBackendTenantLabel = "ipam.example.com/backend-tenant"
+)
+
+// calicoBackend is the default backend: it hands out the IPPools labeled
+// available within the namespace's pools, as selectAvailableSubnet ranks
+// them. The pool is still labeled available when returned; the caller locks
+// and assigns it, and hands it back by relabeling it.
+type calicoBackend struct {
+	a *AdmissionController
+	// pools, tenant and selectors are those of the request, so that a pool
+	// taken by a concurrent request is not selected again
+	pools     []crdv1.IPPool
+	tenant    string
+	selectors []labels.Selector
+}
+
+func (b *calicoBackend) AllocateSubnet(_ context.Context, _ backend.Request) (backend.Subnet, error) {
+	name := b.a.selectAvailableSubnet(b.pools, b.tenant, b.selectors)
+	for _, pool := range b.pools {
+		if pool.Name == name {
+			return backend.Subnet{CIDR: pool.Spec.CIDR, Zone: normalizeLabels(pool.ObjectMeta.Labels)["location"], Pool: name}, nil
+		}
+	}
+	return backend.Subnet{}, backend.ErrExhausted
+}
+
+func (b *calicoBackend) ReleaseSubnet(context.Context, backend.Subnet) error {
+	return nil
+}
+
+func (b *calicoBackend) ListFree(ctx context.Context, zone string) ([]backend.Subnet, error) {
+	pools := b.pools
+	if pools == nil {
+		ipPools, err := b.a.listPools(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("could not list IP pools: %v", err)
+		}
+		pools = ipPools.Items
+	}
+	var free []backend.Subnet
+	for _, pool := range pools {
+		poolLabels := normalizeLabels(pool.ObjectMeta.Labels)
+		if poolLabels["status"] != "available" || poolCordoned(poolLabels) || (zone != "" && poolLabels["location"] != zone) {
+			continue
+		}
+		free = append(free, backend.Subnet{CIDR: pool.Spec.CIDR, Zone: poolLabels["location"], Pool: pool.Name})
+	}
+	return free, nil
+}
+
+// IPAMBackend returns the source of namespace subnets: the external backend
+// when one is configured, the Calico-native one otherwise.
+func (a *AdmissionController) IPAMBackend() backend.IPAMBackend {
+	if a.Backend != nil {
+		return a.Backend
+	}
+	return &calicoBackend{a: a}
+}
+
+// allocateSubnet returns an available pool for the namespace from the
+// backend, or "" when the backend has no subnet left. A subnet of the
+// external backend gets a pool of its own, unless a pool created for an
+// earlier request that was then denied is still available.
+func (a *AdmissionController) allocateSubnet(ctx context.Context, namespace, tenant string, selectors []labels.Selector, pools []crdv1.IPPool) (string, error) {
+	if a.Backend == nil {
+		subnet, err := (&calicoBackend{a: a, pools: pools, tenant: tenant, selectors: selectors}).AllocateSubnet(ctx, backend.Request{})
+		if errors.Is(err, backend.ErrExhausted) {
+			return "", nil
+		}
+		return subnet.Pool, err
+	}
+
+	for _, pool := range pools {
+		poolLabels := normalizeLabels(pool.ObjectMeta.Labels)
+		if poolLabels[poolBackendLabel] != "" && poolLabels[poolBackendTenantLabel] == tenant && poolLabels["location"] == a.Config.Location &&
+			poolLabels["status"] == "available" && !poolCordoned(poolLabels) {
+			a.Logger.Info("Reusing available pool of external backend subnet", zap.String("poolName", pool.Name))
+			return pool.Name, nil
+		}
+	}
+
+	req := backend.Request{Namespace: namespace, Tenant: tenant, Zone: a.Config.Location}
+	if t, _ := a.tenantPolicy(tenant); t.DefaultPrefixLength > 0 {
+		req.PrefixLength = t.DefaultPrefixLength
+	}
+	if isDryRun(ctx) {
+		// Nothing is reserved: the first free subnet is what would be
+		free, err := a.Backend.ListFree(ctx, req.Zone)
+		if err != nil {
+			return "", fmt.Errorf("could not list free subnets of the IPAM backend: %v", err)
+		}
+		if len(free) == 0 {
+			return "", nil
+		}
+		name := backendPoolName(free[0].CIDR)
+		recordCarved(ctx, name, free[0].CIDR)
+		return name, nil
+	}
+
+	// A subnet may already have a pool, e.g. when the backend lost track of
+	// it; that pool is someone else's, so allocate another one
+	for attempt := 1; ; attempt++ {
+		subnet, err := a.Backend.AllocateSubnet(ctx, req)
+		if errors.Is(err, backend.ErrExhausted) {
+			return "", nil
+		}
+		if err != nil {
+			return "", fmt.Errorf("could not allocate a subnet from the IPAM backend: %v", err)
+		}
+		name, err := a.createBackendPool(ctx, tenant, subnet)
+		if apierrors.IsAlreadyExists(err) && attempt < maxAllocationAttempts {
+			a.Logger.Warn("IPAM backend subnet already has a pool, allocating another", zap.String("cidr", subnet.CIDR))
+			continue
+		}
+		if err != nil {
+			if releaseErr := a.Backend.ReleaseSubnet(ctx, subnet); releaseErr != nil {
+				a.Logger.Error("could not hand subnet back to the IPAM backend", zap.String("cidr", subnet.CIDR), zap.Error(releaseErr))
+			}
+			return "", err
+		}
+		return name, nil
+	}
+}
+
+// createBackendPool creates an available pool for a subnet of the external
+// backend.
+func (a *AdmissionController) createBackendPool(ctx context.Context, tenant string, subnet backend.Subnet) (string, error) {
+	zone := subnet.Zone
+	if zone == "" {
+		zone = a.Config.Location
+	}
+	pool := &crdv1.IPPool{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: backendPoolName(subnet.CIDR),
+			Labels: map[string]string{
+				"location":       zone,
+				"status":         "available",
+				poolBackendLabel: "external",
+			},
+		},
+		Spec: crdv1.IPPoolSpec{
+			CIDR:         subnet.CIDR,
+			NodeSelector: "all()",
+		},
+	}
+	if tenant != "" {
+		pool.Labels[poolBackendTenantLabel] = tenant
+	}
+	applyPoolTemplate(&pool.Spec, a.Config.PoolTemplateFor(zone))
+	created, err := a.Clientset.ProjectcalicoV3().IPPools().Create(ctx, pool, metav1.CreateOptions{FieldManager: fieldManager})
+	if apierrors.IsAlreadyExists(err) {
+		return "", err
+	}
+	if err != nil {
+		return "", fmt.Errorf("could not create IP pool for IPAM backend subnet: %v", err)
+	}
+	a.Logger.Info("Created IP pool for IPAM backend subnet",
+		zap.String("tenant", tenant), zap.String("poolName", created.Name), zap.String("cidr", subnet.CIDR))
+	return created.Name, nil
+}
+
+// releaseBackendSubnet hands the subnet of a deleted backend pool back to the
+// external backend.
+func (a *AdmissionController) releaseBackendSubnet(ctx context.Context, pool *crdv1.IPPool) error {
+	if a.Backend == nil {
+		return fmt.Errorf("no IPAM backend is configured")
+	}
+	return a.Backend.ReleaseSubnet(ctx, backend.Subnet{CIDR: pool.Spec.CIDR, Zone: normalizeLabels(pool.ObjectMeta.Labels)["location"]})
+}
+
+// backendPoolName builds a DNS-1123 pool name such as ipam-10-12-0-64-26.
+func backendPoolName(subnet string) string {
+	return "ipam-" + strings.NewReplacer(".", "-", "/", "-", ":", "-").Replace(strings.ToLower(subnet))
+}
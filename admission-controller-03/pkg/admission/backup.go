@@ -0,0 +1,305 @@
+package admission
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"go.uber.org/zap"
+
+	"admission-controller-03/pkg/allocation"
+	"admission-controller-03/pkg/cni"
+
+	crdv1 "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+)
+
+// BackupVersion is the format version of a Backup. Restores refuse any
+// other version.
+const BackupVersion = "ipam.example.com/backup/v1"
+
+// AdminRestore is the audited operation of a restore.
+const AdminRestore = "RESTORE"
+
+// namespaceStateAnnotations are the namespace annotations that record the
+// namespace's assignment, and so are backed up.
+var namespaceStateAnnotations = []string{
+	ipv4PoolsAnnotation,
+	CIDRAnnotation,
+	requestAnnotation,
+	claimAnnotation,
+	PolicyVersionAnnotation,
+	WebhookVersionAnnotation,
+	cni.CiliumPoolAnnotation,
+	EgressPoolAnnotation,
+	EgressCIDRAnnotation,
+	egressSelectorAnnotation,
+}
+
+// Backup is a snapshot of the allocation state: every pool with its labels
+// and annotations, the assignment annotations of every namespace holding a
+// pool, and the allocation records.
+type Backup struct {
+	Version     string                        `json:"version"`
+	CreatedAt   time.Time                     `json:"createdAt"`
+	Pools       []BackupPool                  `json:"pools"`
+	Namespaces  []BackupNamespace             `json:"namespaces"`
+	Allocations []allocation.IPPoolAllocation `json:"allocations,omitempty"`
+}
+
+// BackupPool is a pool as backed up. The spec is kept so that a pool missing
+// from the restored cluster can be recreated.
+type BackupPool struct {
+	Name        string            `json:"name"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Spec        crdv1.IPPoolSpec  `json:"spec"`
+}
+
+// BackupNamespace is a namespace's assignment annotations.
+type BackupNamespace struct {
+	Name        string            `json:"name"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+// Restore outcomes of an object.
+const (
+	RestoreCreated   = "created"
+	RestoreUpdated   = "updated"
+	RestoreUnchanged = "unchanged"
+	RestoreSkipped   = "skipped"
+)
+
+// RestoreResult is what a restore did with one object of the backup.
+type RestoreResult struct {
+	Kind   string
+	Name   string
+	Action string
+	Detail string
+}
+
+// ExportState snapshots the allocation state. Allocation records are left
+// out when the IPPoolAllocation CRD is not installed.
+func (a *AdmissionController) ExportState(ctx context.Context) (*Backup, error) {
+	backup := &Backup{Version: BackupVersion, CreatedAt: time.Now().UTC()}
+
+	ipPools, err := a.CalicoReader.ProjectcalicoV3().IPPools().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("could not list IP pools: %v", err)
+	}
+	for _, pool := range ipPools.Items {
+		backup.Pools = append(backup.Pools, BackupPool{
+			Name:        pool.Name,
+			Labels:      pool.Labels,
+			Annotations: pool.Annotations,
+			Spec:        pool.Spec,
+		})
+	}
+	sort.Slice(backup.Pools, func(i, j int) bool { return backup.Pools[i].Name < backup.Pools[j].Name })
+
+	nsList, err := a.K8sReader.CoreV1().Namespaces().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("could not list namespaces: %v", err)
+	}
+	for _, ns := range nsList.Items {
+		annotations := map[string]string{}
+		for _, key := range namespaceStateAnnotations {
+			if value, ok := ns.Annotations[key]; ok {
+				annotations[key] = value
+			}
+		}
+		if annotations[ipv4PoolsAnnotation] == "" && annotations[claimAnnotation] == "" {
+			continue
+		}
+		backup.Namespaces = append(backup.Namespaces, BackupNamespace{Name: ns.Name, Annotations: annotations})
+	}
+	sort.Slice(backup.Namespaces, func(i, j int) bool { return backup.Namespaces[i].Name < backup.Namespaces[j].Name })
+
+	if a.DynamicReader != nil {
+		list, err := a.DynamicReader.Resource(allocation.Resource).List(ctx, metav1.ListOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return nil, fmt.Errorf("could not list IP pool allocations: %v", err)
+		}
+		if err == nil {
+			for i := range list.Items {
+				record, err := allocation.FromUnstructured(&list.Items[i])
+				if err != nil {
+					return nil, err
+				}
+				// Only what recreates the record; the rest is the
+				// cluster's
+				record.ObjectMeta = metav1.ObjectMeta{Name: record.Name, Labels: record.Labels, Annotations: record.Annotations}
+				backup.Allocations = append(backup.Allocations, *record)
+			}
+			sort.Slice(backup.Allocations, func(i, j int) bool { return backup.Allocations[i].Name < backup.Allocations[j].Name })
+		}
+	}
+	return backup, nil
+}
+
+// RestoreState writes a backup into the cluster, e.g. a rebuilt one, so that
+// namespaces keep their pools. Missing pools are recreated and existing ones
+// get the backed-up labels and annotations; a pool whose CIDR differs from
+// the backup's is left alone. Namespaces are not created: the assignment
+// annotations are restored on the namespaces that exist, unless one holds a
+// different pool by now. Create the namespaces first, or import again once
+// they exist; a pool bound to a namespace that never appears is released by
+// the drift audit once it enforces repairs. Restoring is idempotent. actor is
+// the user the restore is audited under.
+func (a *AdmissionController) RestoreState(ctx context.Context, backup *Backup, actor string) ([]RestoreResult, error) {
+	results, err := a.restoreState(ctx, backup)
+	changed := 0
+	for _, result := range results {
+		if result.Action == RestoreCreated || result.Action == RestoreUpdated {
+			changed++
+		}
+	}
+	a.auditAdmin(AdminRestore, "", "", actor, fmt.Sprintf("backup of %s, %d objects changed", backup.CreatedAt.Format(time.RFC3339), changed), err)
+	if err == nil {
+		a.Logger.Info("Restored allocation state", zap.Time("backup", backup.CreatedAt), zap.Int("changed", changed), zap.String("user", actor))
+	}
+	return results, err
+}
+
+func (a *AdmissionController) restoreState(ctx context.Context, backup *Backup) ([]RestoreResult, error) {
+	if backup.Version != BackupVersion {
+		return nil, fmt.Errorf("unsupported backup version %q, want %q", backup.Version, BackupVersion)
+	}
+	var results []RestoreResult
+	for i := range backup.Pools {
+		result, err := a.restorePool(ctx, &backup.Pools[i])
+		if err != nil {
+			return results, err
+		}
+		results = append(results, result)
+	}
+	for i := range backup.Namespaces {
+		result, err := a.restoreNamespace(ctx, &backup.Namespaces[i])
+		if err != nil {
+			return results, err
+		}
+		results = append(results, result)
+	}
+	for i := range backup.Allocations {
+		result, err := a.restoreAllocation(ctx, &backup.Allocations[i])
+		if err != nil {
+			return results, err
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+func (a *AdmissionController) restorePool(ctx context.Context, backed *BackupPool) (RestoreResult, error) {
+	result := RestoreResult{Kind: "IPPool", Name: backed.Name}
+	existing, err := a.CalicoReader.ProjectcalicoV3().IPPools().Get(ctx, backed.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		pool := &crdv1.IPPool{
+			ObjectMeta: metav1.ObjectMeta{Name: backed.Name, Labels: backed.Labels, Annotations: backed.Annotations},
+			Spec:       backed.Spec,
+		}
+		if _, err := a.Clientset.ProjectcalicoV3().IPPools().Create(ctx, pool, metav1.CreateOptions{FieldManager: fieldManager}); err != nil {
+			return result, fmt.Errorf("could not create IP pool %s: %v", backed.Name, err)
+		}
+		result.Action = RestoreCreated
+		return result, nil
+	}
+	if err != nil {
+		return result, fmt.Errorf("could not get IP pool: %v", err)
+	}
+	if existing.Spec.CIDR != backed.Spec.CIDR {
+		result.Action = RestoreSkipped
+		result.Detail = fmt.Sprintf("CIDR is %s, the backup's %s", existing.Spec.CIDR, backed.Spec.CIDR)
+		return result, nil
+	}
+
+	result.Action = RestoreUnchanged
+	err = a.updateIPPool(ctx, backed.Name, func(ipPool *crdv1.IPPool) error {
+		annotations := map[string]string{}
+		for key, value := range ipPool.ObjectMeta.Annotations {
+			annotations[key] = value
+		}
+		for key, value := range backed.Annotations {
+			annotations[key] = value
+		}
+		if equality.Semantic.DeepEqual(normalizeLabels(ipPool.ObjectMeta.Labels), normalizeLabels(backed.Labels)) &&
+			equality.Semantic.DeepEqual(ipPool.ObjectMeta.Annotations, annotations) {
+			return nil
+		}
+		ipPool.ObjectMeta.Labels = backed.Labels
+		ipPool.ObjectMeta.Annotations = annotations
+		result.Action = RestoreUpdated
+		return nil
+	})
+	return result, err
+}
+
+func (a *AdmissionController) restoreNamespace(ctx context.Context, backed *BackupNamespace) (RestoreResult, error) {
+	result := RestoreResult{Kind: "Namespace", Name: backed.Name}
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		ns, err := a.K8sReader.CoreV1().Namespaces().Get(ctx, backed.Name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			result.Action, result.Detail = RestoreSkipped, "namespace does not exist"
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("could not get namespace: %v", err)
+		}
+		if held := ns.Annotations[ipv4PoolsAnnotation]; held != "" && held != backed.Annotations[ipv4PoolsAnnotation] {
+			result.Action, result.Detail = RestoreSkipped, fmt.Sprintf("namespace holds IP pools %s by now", held)
+			return nil
+		}
+		changed := false
+		if ns.Annotations == nil {
+			ns.Annotations = map[string]string{}
+		}
+		for key, value := range backed.Annotations {
+			if ns.Annotations[key] != value {
+				ns.Annotations[key] = value
+				changed = true
+			}
+		}
+		if !changed {
+			result.Action = RestoreUnchanged
+			return nil
+		}
+		if _, err := a.K8sClientset.CoreV1().Namespaces().Update(ctx, ns, metav1.UpdateOptions{FieldManager: fieldManager}); err != nil {
+			return err
+		}
+		result.Action = RestoreUpdated
+		return nil
+	})
+	if err != nil {
+		return result, fmt.Errorf("could not restore namespace %s: %v", backed.Name, err)
+	}
+	return result, nil
+}
+
+func (a *AdmissionController) restoreAllocation(ctx context.Context, record *allocation.IPPoolAllocation) (RestoreResult, error) {
+	result := RestoreResult{Kind: allocation.Kind, Name: record.Name}
+	if a.DynamicClient == nil {
+		result.Action, result.Detail = RestoreSkipped, "allocation records are not enabled"
+		return result, nil
+	}
+	restored := *record
+	object, err := allocation.ToUnstructured(&restored)
+	if err != nil {
+		return result, err
+	}
+	_, err = a.DynamicClient.Resource(allocation.Resource).Create(ctx, object, metav1.CreateOptions{FieldManager: fieldManager})
+	switch {
+	case apierrors.IsAlreadyExists(err):
+		result.Action = RestoreUnchanged
+	case apierrors.IsNotFound(err):
+		result.Action, result.Detail = RestoreSkipped, "the IPPoolAllocation CRD is not installed"
+	case err != nil:
+		return result, fmt.Errorf("could not create IPPoolAllocation %s: %v", record.Name, err)
+	default:
+		result.Action = RestoreCreated
+	}
+	return result, nil
+}
@@ -0,0 +1,220 @@
+package admission
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"admission-controller-03/pkg/config"
+
+	crdv1 "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
+	"github.com/projectcalico/api/pkg/lib/numorstring"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+const (
+	// bgpConfigurationName is Calico's cluster-wide BGPConfiguration.
+	bgpConfigurationName = "default"
+	// advertisedAnnotation on the BGPConfiguration lists the CIDRs the
+	// controller added, so that entries added by hand are left alone.
+	advertisedAnnotation = "ipam.example.com/advertised"
+	// managedByLabel marks the BGPPeers the controller maintains.
+	managedByLabel = "app.kubernetes.io/managed-by"
+	managedBy      = "ipam-webhook"
+)
+
+// bgpRequest is the only request of the BGP reconciler: every pool change
+// recomputes the whole advertisement.
+var bgpRequest = reconcile.Request{NamespacedName: types.NamespacedName{Name: bgpConfigurationName}}
+
+// bgpReconciler advertises the CIDRs of assigned pools through the default
+// BGPConfiguration and keeps the configured BGP peers.
+type bgpReconciler struct {
+	a *AdmissionController
+	// cache is the manager's informer cache
+	cache client.Reader
+}
+
+// SetupBGPController registers the BGP reconciler with the manager when BGP
+// advertisement is configured.
+func (a *AdmissionController) SetupBGPController(mgr manager.Manager) error {
+	if a.Config.BGP == nil {
+		return nil
+	}
+	all := handler.EnqueueRequestsFromMapFunc(func(context.Context, client.Object) []reconcile.Request {
+		return []reconcile.Request{bgpRequest}
+	})
+	return builder.ControllerManagedBy(mgr).
+		Named("bgp").
+		Watches(&crdv1.IPPool{}, all).
+		Watches(&crdv1.BGPConfiguration{}, all).
+		Watches(&crdv1.BGPPeer{}, all).
+		Complete(&bgpReconciler{a: a, cache: mgr.GetCache()})
+}
+
+func (r *bgpReconciler) Reconcile(ctx context.Context, _ reconcile.Request) (reconcile.Result, error) {
+	var pools crdv1.IPPoolList
+	if err := r.cache.List(ctx, &pools); err != nil {
+		return reconcile.Result{}, fmt.Errorf("could not list IP pools: %v", err)
+	}
+	var assigned []string
+	for _, pool := range pools.Items {
+		if normalizeLabels(pool.ObjectMeta.Labels)["status"] == "used" {
+			assigned = append(assigned, pool.Spec.CIDR)
+		}
+	}
+	slices.Sort(assigned)
+
+	return reconcile.Result{}, errors.Join(r.advertise(ctx, assigned), r.ensurePeers(ctx))
+}
+
+// advertise sets the controller's CIDRs in the configured list of the default
+// BGPConfiguration: the assigned CIDRs are added, the ones it added before and
+// that are no longer assigned are removed.
+func (r *bgpReconciler) advertise(ctx context.Context, assigned []string) error {
+	var existing crdv1.BGPConfiguration
+	err := r.cache.Get(ctx, types.NamespacedName{Name: bgpConfigurationName}, &existing)
+	if apierrors.IsNotFound(err) {
+		if len(assigned) == 0 {
+			return nil
+		}
+		bgp := &crdv1.BGPConfiguration{ObjectMeta: metav1.ObjectMeta{Name: bgpConfigurationName}}
+		setAdvertised(bgp, r.a.Config.BGP.Advertise, assigned, nil)
+		if _, err := r.a.Clientset.ProjectcalicoV3().BGPConfigurations().Create(ctx, bgp, metav1.CreateOptions{FieldManager: fieldManager}); err != nil {
+			return fmt.Errorf("could not create BGP configuration: %v", err)
+		}
+		r.a.Logger.Info("Advertising assigned pools", zap.Strings("cidrs", assigned))
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not get BGP configuration: %v", err)
+	}
+
+	var previous []string
+	if raw := existing.Annotations[advertisedAnnotation]; raw != "" {
+		previous = strings.Split(raw, ",")
+	}
+	if slices.Equal(previous, assigned) && slices.Equal(advertisedCIDRs(&existing, r.a.Config.BGP.Advertise, previous), previous) {
+		return nil
+	}
+	bgp := existing.DeepCopy()
+	setAdvertised(bgp, r.a.Config.BGP.Advertise, assigned, previous)
+	// Carries the cached resourceVersion; a conflict is requeued
+	if _, err := r.a.Clientset.ProjectcalicoV3().BGPConfigurations().Update(ctx, bgp, metav1.UpdateOptions{FieldManager: fieldManager}); err != nil {
+		return fmt.Errorf("could not update BGP configuration: %v", err)
+	}
+	r.a.Logger.Info("Advertising assigned pools", zap.Strings("cidrs", assigned), zap.Strings("previously", previous))
+	return nil
+}
+
+// advertisedCIDRs returns the entries of the configured list that are among
+// cidrs, in the order of cidrs.
+func advertisedCIDRs(bgp *crdv1.BGPConfiguration, list string, cidrs []string) []string {
+	present := map[string]bool{}
+	if list == config.BGPAdvertiseExternalIPs {
+		for _, block := range bgp.Spec.ServiceExternalIPs {
+			present[block.CIDR] = true
+		}
+	} else {
+		for _, block := range bgp.Spec.ServiceLoadBalancerIPs {
+			present[block.CIDR] = true
+		}
+	}
+	var found []string
+	for _, c := range cidrs {
+		if present[c] {
+			found = append(found, c)
+		}
+	}
+	return found
+}
+
+// setAdvertised replaces the previous CIDRs of the controller by the assigned
+// ones in the configured list, keeping entries added by hand, and records the
+// assigned CIDRs in the annotation.
+func setAdvertised(bgp *crdv1.BGPConfiguration, list string, assigned, previous []string) {
+	keep := func(c string) bool { return !slices.Contains(previous, c) && !slices.Contains(assigned, c) }
+	if list == config.BGPAdvertiseExternalIPs {
+		blocks := slices.DeleteFunc(bgp.Spec.ServiceExternalIPs, func(b crdv1.ServiceExternalIPBlock) bool { return !keep(b.CIDR) })
+		for _, c := range assigned {
+			blocks = append(blocks, crdv1.ServiceExternalIPBlock{CIDR: c})
+		}
+		bgp.Spec.ServiceExternalIPs = blocks
+	} else {
+		blocks := slices.DeleteFunc(bgp.Spec.ServiceLoadBalancerIPs, func(b crdv1.ServiceLoadBalancerIPBlock) bool { return !keep(b.CIDR) })
+		for _, c := range assigned {
+			blocks = append(blocks, crdv1.ServiceLoadBalancerIPBlock{CIDR: c})
+		}
+		bgp.Spec.ServiceLoadBalancerIPs = blocks
+	}
+	if bgp.Annotations == nil {
+		bgp.Annotations = map[string]string{}
+	}
+	bgp.Annotations[advertisedAnnotation] = strings.Join(assigned, ",")
+}
+
+// ensurePeers creates or updates the configured BGP peers and deletes the
+// ones the controller created that are no longer configured.
+func (r *bgpReconciler) ensurePeers(ctx context.Context) error {
+	var peers crdv1.BGPPeerList
+	if err := r.cache.List(ctx, &peers, client.MatchingLabels{managedByLabel: managedBy}); err != nil {
+		return fmt.Errorf("could not list BGP peers: %v", err)
+	}
+	existing := make(map[string]crdv1.BGPPeer, len(peers.Items))
+	for _, peer := range peers.Items {
+		existing[peer.Name] = peer
+	}
+
+	var errs []error
+	for _, p := range r.a.Config.BGP.Peers {
+		want := crdv1.BGPPeerSpec{
+			PeerIP:       p.PeerIP,
+			ASNumber:     numorstring.ASNumber(p.ASNumber),
+			NodeSelector: p.NodeSelector,
+		}
+		peer, found := existing[p.Name]
+		delete(existing, p.Name)
+		var err error
+		switch {
+		case !found:
+			// A peer of that name not labeled as ours is created by hand and
+			// makes the create fail, which is reported rather than overwritten
+			created := &crdv1.BGPPeer{
+				ObjectMeta: metav1.ObjectMeta{Name: p.Name, Labels: map[string]string{managedByLabel: managedBy}},
+				Spec:       want,
+			}
+			_, err = r.a.Clientset.ProjectcalicoV3().BGPPeers().Create(ctx, created, metav1.CreateOptions{FieldManager: fieldManager})
+		case peer.Spec.PeerIP != want.PeerIP || peer.Spec.ASNumber != want.ASNumber || peer.Spec.NodeSelector != want.NodeSelector:
+			updated := peer.DeepCopy()
+			updated.Spec.PeerIP, updated.Spec.ASNumber, updated.Spec.NodeSelector = want.PeerIP, want.ASNumber, want.NodeSelector
+			_, err = r.a.Clientset.ProjectcalicoV3().BGPPeers().Update(ctx, updated, metav1.UpdateOptions{FieldManager: fieldManager})
+		default:
+			continue
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("could not write BGP peer %s: %v", p.Name, err))
+			continue
+		}
+		r.a.Logger.Info("Wrote BGP peer", zap.String("peer", p.Name), zap.String("peerIP", p.PeerIP))
+	}
+	for name := range existing {
+		err := r.a.Clientset.ProjectcalicoV3().BGPPeers().Delete(ctx, name, metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			errs = append(errs, fmt.Errorf("could not delete BGP peer %s: %v", name, err))
+			continue
+		}
+		r.a.Logger.Info("Deleted BGP peer no longer configured", zap.String("peer", name))
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,225 @@
+package admission
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+
+	"admission-controller-03/pkg/notify"
+
+	crdv1 "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// requestAnnotation records on a namespace the UID of the admission
+	// request that created it, which is also the pool's poolRequestLabel
+	requestAnnotation = "ipam.example.com/request-uid"
+	// poolNamespaceLabel records on a pool the namespace it is bound to
+	poolNamespaceLabel = "ipam.example.com/namespace"
+	// poolAssignedAtLabel records when a pool was assigned, in Unix seconds
+	// since label values cannot hold an RFC 3339 timestamp
+	poolAssignedAtLabel = "ipam.example.com/assigned-at"
+	// expiryNoticeAnnotation records on a pending pool that its owner was
+	// told the reservation expires soon
+	expiryNoticeAnnotation = "ipam.example.com/expiry-notice-sent"
+)
+
+// reservationAnnotations are carried by a pending pool only, to tell the owner
+// of a namespace that was never created that its reservation expires.
+var reservationAnnotations = []string{notify.OwnerContactAnnotation, notify.OwnerLocaleAnnotation, expiryNoticeAnnotation}
+
+// errReservationChanged aborts a rollback when the pool is no longer pending.
+var errReservationChanged = errors.New("pool is no longer pending")
+
+// RunPoolBinder periodically confirms the pools reserved at admission. A pool
+// is reserved as pending because the namespace creation can still fail after
+// the webhook allowed it; once the namespace exists the pool is marked used,
+// and a reservation whose namespace never appeared within the reservation TTL
+// is handed back; its owner, when known, is told once half the TTL has passed.
+// The assignment is keyed on the request UID, carried on both
+// the pool label and the namespace annotation, as a namespace created with
+// generateName has no name at admission time; its name is filled in here.
+func (a *AdmissionController) RunPoolBinder(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := a.bindPools(ctx); err != nil {
+			a.Logger.Error("could not bind pools to namespaces", zap.Error(err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (a *AdmissionController) bindPools(ctx context.Context) error {
+	ipPools, err := a.CalicoReader.ProjectcalicoV3().IPPools().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("could not list IP pools: %v", err)
+	}
+
+	// Pending pools, and used pools assigned before reservations existed
+	// that still lack their namespace name
+	unbound := map[string]crdv1.IPPool{}
+	for _, pool := range ipPools.Items {
+		poolLabels := normalizeLabels(pool.ObjectMeta.Labels)
+		uid := poolLabels[poolRequestLabel]
+		if uid == "" {
+			continue
+		}
+		if poolLabels["status"] == "pending" || (poolLabels["status"] == "used" && poolLabels[poolNamespaceLabel] == "") {
+			unbound[uid] = pool
+		}
+	}
+	if len(unbound) == 0 {
+		return nil
+	}
+
+	nsList, err := a.K8sReader.CoreV1().Namespaces().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("could not list namespaces: %v", err)
+	}
+	for _, ns := range nsList.Items {
+		uid := ns.Annotations[requestAnnotation]
+		pool, ok := unbound[uid]
+		if !ok {
+			continue
+		}
+		delete(unbound, uid)
+		err := a.updateIPPool(ctx, pool.Name, func(ipPool *crdv1.IPPool) error {
+			labels := normalizeLabels(ipPool.ObjectMeta.Labels)
+			labels["status"] = "used"
+			labels[poolNamespaceLabel] = ns.Name
+			ipPool.ObjectMeta.Labels = labels
+			for _, key := range reservationAnnotations {
+				delete(ipPool.ObjectMeta.Annotations, key)
+			}
+			return nil
+		})
+		if err != nil {
+			a.Logger.Error("could not bind pool to namespace", zap.String("poolName", pool.Name), zap.String("namespace", ns.Name), zap.Error(err))
+			continue
+		}
+		a.Logger.Info("Bound pool to namespace", zap.String("poolName", pool.Name), zap.String("namespace", ns.Name))
+		if ns.GenerateName != "" {
+			// Its PoolAssigned event could not be posted at admission time
+			a.Recorder.Eventf(&ns, corev1.EventTypeNormal, reasonPoolAssigned, "Assigned IP pool %s", pool.Name)
+		}
+	}
+
+	ttl := time.Duration(a.Config.ReservationTTLSeconds) * time.Second
+	for _, pool := range unbound {
+		if normalizeLabels(pool.ObjectMeta.Labels)["status"] != "pending" {
+			continue
+		}
+		_, reservedAt := poolOwner(pool)
+		if reservedAt.IsZero() || time.Since(reservedAt) >= ttl {
+			a.rollBackReservation(ctx, pool.Name)
+			continue
+		}
+		if time.Since(reservedAt) >= ttl/2 {
+			a.notifyExpiringReservation(ctx, pool, reservedAt.Add(ttl))
+		}
+	}
+	return nil
+}
+
+// reservationContact returns the owner annotations of a namespace under
+// admission for its pending pool to carry, or nil when there is no one to
+// tell. A namespace without a name yet could not be named in the notice.
+func reservationContact(ns *corev1.Namespace) map[string]string {
+	contact := ns.Annotations[notify.OwnerContactAnnotation]
+	if ns.Name == "" || contact == "" {
+		return nil
+	}
+	annotations := map[string]string{notify.OwnerContactAnnotation: contact}
+	if locale := ns.Annotations[notify.OwnerLocaleAnnotation]; locale != "" {
+		annotations[notify.OwnerLocaleAnnotation] = locale
+	}
+	return annotations
+}
+
+// notifyExpiringReservation tells the owner of a pending pool, once, that its
+// namespace still does not exist and the reservation expires. The pool is
+// marked before the owner is told so a concurrent binder does not send the
+// notice again.
+func (a *AdmissionController) notifyExpiringReservation(ctx context.Context, pool crdv1.IPPool, expires time.Time) {
+	if _, sent := pool.ObjectMeta.Annotations[expiryNoticeAnnotation]; sent {
+		return
+	}
+	poolLabels := normalizeLabels(pool.ObjectMeta.Labels)
+	msg, ok := a.ownerMessage(poolLabels[poolNamespaceLabel], pool.ObjectMeta.Annotations, notify.EventTTLExpiring, pool.Name, pool.Spec.CIDR, poolLabels[poolTenantLabel])
+	if !ok || msg.Namespace == "" {
+		return
+	}
+	err := a.updateIPPool(ctx, pool.Name, func(ipPool *crdv1.IPPool) error {
+		if normalizeLabels(ipPool.ObjectMeta.Labels)["status"] != "pending" {
+			return errReservationChanged
+		}
+		if _, sent := ipPool.ObjectMeta.Annotations[expiryNoticeAnnotation]; sent {
+			return errReservationChanged
+		}
+		if ipPool.ObjectMeta.Annotations == nil {
+			ipPool.ObjectMeta.Annotations = map[string]string{}
+		}
+		ipPool.ObjectMeta.Annotations[expiryNoticeAnnotation] = time.Now().UTC().Format(time.RFC3339)
+		return nil
+	})
+	if errors.Is(err, errReservationChanged) {
+		return
+	}
+	if err != nil {
+		a.Logger.Error("could not mark pool reservation expiry notice", zap.String("poolName", pool.Name), zap.Error(err))
+		return
+	}
+	msg.Expires = expires
+	a.sendOwnerMessage(msg)
+}
+
+// rollBackReservation hands a pending pool whose namespace never appeared back
+// into circulation, unless it was confirmed in the meantime.
+func (a *AdmissionController) rollBackReservation(ctx context.Context, poolName string) {
+	err := a.updateIPPool(ctx, poolName, func(ipPool *crdv1.IPPool) error {
+		labels := normalizeLabels(ipPool.ObjectMeta.Labels)
+		if labels["status"] != "pending" {
+			return errReservationChanged
+		}
+		labels["status"] = "available"
+		for _, key := range ownershipLabels {
+			delete(labels, key)
+		}
+		ipPool.ObjectMeta.Labels = labels
+		for _, key := range reservationAnnotations {
+			delete(ipPool.ObjectMeta.Annotations, key)
+		}
+		return nil
+	})
+	if errors.Is(err, errReservationChanged) {
+		return
+	}
+	if err != nil {
+		a.Logger.Error("could not roll back expired pool reservation", zap.String("poolName", poolName), zap.Error(err))
+		return
+	}
+	a.Logger.Warn("Rolled back pool reservation, its namespace was never created", zap.String("poolName", poolName))
+}
+
+// poolOwner returns the namespace a pool is bound to and when it was assigned.
+// Either is zero when the pool does not record it.
+func poolOwner(pool crdv1.IPPool) (string, time.Time) {
+	poolLabels := normalizeLabels(pool.ObjectMeta.Labels)
+	var assignedAt time.Time
+	if seconds, err := strconv.ParseInt(poolLabels[poolAssignedAtLabel], 10, 64); err == nil {
+		assignedAt = time.Unix(seconds, 0)
+	}
+	return poolLabels[poolNamespaceLabel], assignedAt
+}
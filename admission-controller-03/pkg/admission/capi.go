@@ -0,0 +1,258 @@
+package admission
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"go.uber.org/zap"
+
+	"admission-controller-03/pkg/cidr"
+	"admission-controller-03/pkg/config"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+const (
+	// ClusterPodCIDRAnnotation and ClusterServiceCIDRAnnotation record on a
+	// Cluster API Cluster the CIDRs allocated to it. They are the ledger of
+	// the allocations: a CIDR is free again once no Cluster records it.
+	ClusterPodCIDRAnnotation     = "ipam.example.com/pod-cidr"
+	ClusterServiceCIDRAnnotation = "ipam.example.com/service-cidr"
+	// clusterConfigMapSuffix names the ConfigMap of a Cluster's CIDRs.
+	clusterConfigMapSuffix = "-ipam"
+	// clusterRetryInterval is how long a Cluster left without CIDRs waits
+	// for master pools to be added or freed.
+	clusterRetryInterval = time.Minute
+)
+
+// Event reasons of workload clusters.
+const (
+	reasonClusterCIDRsAllocated = "ClusterCIDRsAllocated"
+	reasonClusterCIDRsExhausted = "ClusterCIDRsExhausted"
+)
+
+var clusterGVK = schema.GroupVersionKind{Group: "cluster.x-k8s.io", Version: "v1beta1", Kind: "Cluster"}
+
+var clusterResource = schema.GroupVersionResource{Group: "cluster.x-k8s.io", Version: "v1beta1", Resource: "clusters"}
+
+// clusterReconciler allocates a pod and a service CIDR to every Cluster API
+// workload cluster, from master pools of this cluster that are never split
+// into pools of its own. The CIDRs of a workload cluster do not overlap each
+// other, any IPPool, or the CIDRs of any other workload cluster.
+type clusterReconciler struct {
+	a *AdmissionController
+	// cache is the manager's informer cache
+	cache client.Reader
+}
+
+// SetupClusterAPIController registers the Cluster reconciler with the
+// manager when it is configured. The Cluster API CRDs must be installed.
+func (a *AdmissionController) SetupClusterAPIController(mgr manager.Manager) error {
+	if a.Config.ClusterAPI == nil {
+		return nil
+	}
+	cluster := &unstructured.Unstructured{}
+	cluster.SetGroupVersionKind(clusterGVK)
+	return builder.ControllerManagedBy(mgr).
+		Named("clusterapi").
+		For(cluster).
+		Complete(&clusterReconciler{a: a, cache: mgr.GetCache()})
+}
+
+func (r *clusterReconciler) Reconcile(ctx context.Context, req reconcile.Request) (reconcile.Result, error) {
+	cluster := &unstructured.Unstructured{}
+	cluster.SetGroupVersionKind(clusterGVK)
+	if err := r.cache.Get(ctx, req.NamespacedName, cluster); err != nil {
+		// The CIDRs of a deleted Cluster are free with it
+		return reconcile.Result{}, client.IgnoreNotFound(err)
+	}
+	if cluster.GetDeletionTimestamp() != nil {
+		return reconcile.Result{}, nil
+	}
+	capi := r.a.Config.ClusterAPI
+
+	podCIDR, serviceCIDR := cluster.GetAnnotations()[ClusterPodCIDRAnnotation], cluster.GetAnnotations()[ClusterServiceCIDRAnnotation]
+	if podCIDR == "" || serviceCIDR == "" {
+		if capi.Output != config.ClusterAPIOutputConfigMap && clusterHasOwnCIDRs(cluster) {
+			r.a.Logger.Debug("Cluster brings CIDRs of its own, leaving it", zap.String("namespace", cluster.GetNamespace()), zap.String("cluster", cluster.GetName()))
+			return reconcile.Result{}, nil
+		}
+		var err error
+		podCIDR, serviceCIDR, err = r.allocate(ctx, cluster)
+		if errors.Is(err, cidr.ErrExhausted) {
+			r.a.Recorder.Eventf(cluster, corev1.EventTypeWarning, reasonClusterCIDRsExhausted,
+				"No /%d pod and /%d service CIDR is left in the master pools", capi.PodPrefixLength, capi.ServicePrefixLength)
+			return reconcile.Result{RequeueAfter: clusterRetryInterval}, nil
+		}
+		if err != nil {
+			return reconcile.Result{}, err
+		}
+		if err := r.record(ctx, cluster, podCIDR, serviceCIDR); err != nil {
+			return reconcile.Result{}, err
+		}
+		r.a.Logger.Info("Allocated workload cluster CIDRs", zap.String("namespace", cluster.GetNamespace()), zap.String("cluster", cluster.GetName()),
+			zap.String("podCIDR", podCIDR), zap.String("serviceCIDR", serviceCIDR))
+		r.a.Recorder.Eventf(cluster, corev1.EventTypeNormal, reasonClusterCIDRsAllocated, "Allocated pod CIDR %s and service CIDR %s", podCIDR, serviceCIDR)
+	}
+
+	if capi.Output == config.ClusterAPIOutputConfigMap {
+		// Rewritten on every pass, in case it was edited or deleted by hand
+		return reconcile.Result{}, r.writeConfigMap(ctx, cluster, podCIDR, serviceCIDR)
+	}
+	return reconcile.Result{}, nil
+}
+
+// clusterHasOwnCIDRs reports whether the Cluster's spec declares pod or
+// service CIDRs not allocated by the webhook.
+func clusterHasOwnCIDRs(cluster *unstructured.Unstructured) bool {
+	pods, _, _ := unstructured.NestedStringSlice(cluster.Object, "spec", "clusterNetwork", "pods", "cidrBlocks")
+	services, _, _ := unstructured.NestedStringSlice(cluster.Object, "spec", "clusterNetwork", "services", "cidrBlocks")
+	return len(pods) > 0 || len(services) > 0
+}
+
+// allocate carves the CIDRs of a Cluster from the first master pools, in
+// address order, with room left. Clusters are reconciled one at a time, so
+// the CIDRs recorded on the others are current.
+func (r *clusterReconciler) allocate(ctx context.Context, cluster *unstructured.Unstructured) (string, string, error) {
+	capi := r.a.Config.ClusterAPI
+	ipPools, err := r.a.listPools(ctx)
+	if err != nil {
+		return "", "", fmt.Errorf("could not list IP pools: %v", err)
+	}
+	clusters := &unstructured.UnstructuredList{}
+	clusters.SetGroupVersionKind(clusterGVK.GroupVersion().WithKind(clusterGVK.Kind + "List"))
+	if err := r.cache.List(ctx, clusters); err != nil {
+		return "", "", fmt.Errorf("could not list clusters: %v", err)
+	}
+
+	// Validated with the config
+	selector, _ := labels.Parse(capi.PoolSelector)
+	var masters, used []string
+	for _, pool := range ipPools.Items {
+		if selector.Matches(labels.Set(pool.Labels)) {
+			masters = append(masters, pool.Spec.CIDR)
+			continue
+		}
+		used = append(used, pool.Spec.CIDR)
+	}
+	for _, other := range clusters.Items {
+		if other.GetUID() == cluster.GetUID() {
+			continue
+		}
+		for _, key := range []string{ClusterPodCIDRAnnotation, ClusterServiceCIDRAnnotation} {
+			if value := other.GetAnnotations()[key]; value != "" {
+				used = append(used, value)
+			}
+		}
+	}
+	sort.Slice(masters, func(i, j int) bool { return cidr.Compare(masters[i], masters[j]) < 0 })
+
+	podCIDR, err := nextFreeIn(masters, capi.PodPrefixLength, used)
+	if err != nil {
+		return "", "", err
+	}
+	serviceCIDR, err := nextFreeIn(masters, capi.ServicePrefixLength, append(used, podCIDR))
+	if err != nil {
+		return "", "", err
+	}
+	return podCIDR, serviceCIDR, nil
+}
+
+// nextFreeIn returns the first free subnet of the parents, in order. Parents
+// too small for the prefix length, or not IPv4, are skipped.
+func nextFreeIn(parents []string, prefixLen int, used []string) (string, error) {
+	for _, parent := range parents {
+		if subnet, err := cidr.NextFree(parent, prefixLen, used); err == nil {
+			return subnet, nil
+		}
+	}
+	return "", cidr.ErrExhausted
+}
+
+// record writes the CIDRs to the Cluster's annotations and, with the spec
+// output, to its clusterNetwork, in a single patch, so that a Cluster never
+// gets CIDRs the ledger does not hold.
+func (r *clusterReconciler) record(ctx context.Context, cluster *unstructured.Unstructured, podCIDR, serviceCIDR string) error {
+	patch := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{
+				ClusterPodCIDRAnnotation:     podCIDR,
+				ClusterServiceCIDRAnnotation: serviceCIDR,
+			},
+		},
+	}
+	if r.a.Config.ClusterAPI.Output != config.ClusterAPIOutputConfigMap {
+		patch["spec"] = map[string]interface{}{
+			"clusterNetwork": map[string]interface{}{
+				"pods":     map[string]interface{}{"cidrBlocks": []string{podCIDR}},
+				"services": map[string]interface{}{"cidrBlocks": []string{serviceCIDR}},
+			},
+		}
+	}
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return fmt.Errorf("could not encode cluster patch: %v", err)
+	}
+	_, err = r.a.DynamicClient.Resource(clusterResource).Namespace(cluster.GetNamespace()).
+		Patch(ctx, cluster.GetName(), types.MergePatchType, data, metav1.PatchOptions{FieldManager: fieldManager})
+	if err != nil {
+		return fmt.Errorf("could not update cluster %s/%s: %v", cluster.GetNamespace(), cluster.GetName(), err)
+	}
+	return nil
+}
+
+// writeConfigMap creates or updates the ConfigMap of a Cluster's CIDRs. It is
+// owned by the Cluster and garbage collected along with it.
+func (r *clusterReconciler) writeConfigMap(ctx context.Context, cluster *unstructured.Unstructured, podCIDR, serviceCIDR string) error {
+	desired := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      cluster.GetName() + clusterConfigMapSuffix,
+			Namespace: cluster.GetNamespace(),
+			OwnerReferences: []metav1.OwnerReference{{
+				APIVersion: clusterGVK.GroupVersion().String(),
+				Kind:       clusterGVK.Kind,
+				Name:       cluster.GetName(),
+				UID:        cluster.GetUID(),
+			}},
+		},
+		Data: map[string]string{
+			"podCIDR":     podCIDR,
+			"serviceCIDR": serviceCIDR,
+		},
+	}
+	configMaps := r.a.K8sClientset.CoreV1().ConfigMaps(cluster.GetNamespace())
+	existing, err := configMaps.Get(ctx, desired.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = configMaps.Create(ctx, desired, metav1.CreateOptions{FieldManager: fieldManager})
+		if err != nil {
+			return fmt.Errorf("could not create ConfigMap %s/%s: %v", desired.Namespace, desired.Name, err)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not get ConfigMap %s/%s: %v", desired.Namespace, desired.Name, err)
+	}
+	if existing.Data["podCIDR"] == podCIDR && existing.Data["serviceCIDR"] == serviceCIDR {
+		return nil
+	}
+	existing.Data = desired.Data
+	existing.OwnerReferences = desired.OwnerReferences
+	if _, err := configMaps.Update(ctx, existing, metav1.UpdateOptions{FieldManager: fieldManager}); err != nil {
+		return fmt.Errorf("could not update ConfigMap %s/%s: %v", desired.Namespace, desired.Name, err)
+	}
+	return nil
+}
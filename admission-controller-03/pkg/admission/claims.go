@@ -0,0 +1,247 @@
+package admission
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+
+	"admission-controller-03/pkg/allocation"
+	"admission-controller-03/pkg/claim"
+	"admission-controller-03/pkg/config"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// claimAnnotation records on a namespace the PoolClaim filed for it at
+// admission, so the binder finds namespaces created with generateName.
+const claimAnnotation = "ipam.example.com/pool-claim"
+
+// claimsPools reports whether namespace creation files a PoolClaim instead of
+// assigning a pool synchronously.
+func (a *AdmissionController) claimsPools() bool {
+	return a.Config.AssignmentMode == config.AssignmentModeClaim && a.DynamicClient != nil && a.DynamicReader != nil
+}
+
+// handleNamespaceClaim admits a namespace creation with a PoolClaim filed for
+// it; RunClaimBinder assigns the pool once the namespace exists. The claim is
+// named like the request's allocation, so a retried request finds the claim of
+// its first attempt.
+func (a *AdmissionController) handleNamespaceClaim(ctx context.Context, w http.ResponseWriter, req *admissionv1.AdmissionRequest, admissionResponse *admissionv1.AdmissionResponse, ns *corev1.Namespace, tenant string) {
+	name := namespaceName(req, ns)
+	claimName := allocation.Name(ns.Name, ns.GenerateName, req.UID)
+
+	annotations := map[string]string{claimAnnotation: claimName}
+	patchBytes, err := namespacePatch(ns, annotations, nil)
+	if err != nil {
+		a.Logger.Error("could not marshal patch", zap.Error(err))
+		a.writeInternalError(w, admissionResponse, "could not marshal patch: %v", err)
+		return
+	}
+	if err := verifyPatch(req.Object.Raw, patchBytes, annotations, nil); err != nil {
+		a.Logger.Error("patch verification failed", zap.ByteString("patch", patchBytes), zap.Error(err))
+		a.writeInternalError(w, admissionResponse, "patch verification failed: %v", err)
+		return
+	}
+	pt := admissionv1.PatchTypeJSONPatch
+	admissionResponse.Patch = patchBytes
+	admissionResponse.PatchType = &pt
+	addWarning(admissionResponse, "IP pool requested by PoolClaim %s; pods created before it is bound get addresses from the default pools", claimName)
+
+	if isDryRun(ctx) {
+		a.Logger.Info("Dry run, not filing pool claim", zap.String("namespace", name), zap.String("claim", claimName))
+		a.writeAdmissionResponse(w, admissionResponse)
+		return
+	}
+	object, err := claim.ToUnstructured(&claim.PoolClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   claimName,
+			Labels: map[string]string{poolRequestLabel: string(req.UID)},
+		},
+		Spec: claim.Spec{
+			Namespace:  ns.Name,
+			RequestUID: req.UID,
+			Tenant:     tenant,
+		},
+		Status: claim.Status{Phase: claim.PhasePending},
+	})
+	if err == nil {
+		_, err = a.DynamicClient.Resource(claim.Resource).Create(ctx, object, metav1.CreateOptions{FieldManager: fieldManager})
+		if apierrors.IsAlreadyExists(err) {
+			err = nil
+		}
+	}
+	if err != nil {
+		a.Logger.Error("could not file pool claim", zap.String("claim", claimName), zap.Error(err))
+		a.deny(w, req, admissionResponse, denial(statusInternalError, "could not file PoolClaim %s: %v", claimName, err), nil)
+		return
+	}
+	a.Logger.Info("Filed pool claim for namespace", zap.String("namespace", name), zap.String("claim", claimName))
+	a.writeAdmissionResponse(w, admissionResponse)
+}
+
+// verifyClaim checks that the PoolClaim named in the namespace's claim
+// annotation was filed by the mutating webhook for this request.
+func (a *AdmissionController) verifyClaim(ctx context.Context, ns *corev1.Namespace, uid types.UID) error {
+	if !a.claimsPools() {
+		return errors.New("pool claims are not enabled")
+	}
+	// A dry run filed nothing
+	if isDryRun(ctx) {
+		return nil
+	}
+	name := ns.Annotations[claimAnnotation]
+	object, err := a.DynamicReader.Resource(claim.Resource).Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return fmt.Errorf("PoolClaim %s does not exist", name)
+	}
+	if err != nil {
+		return fmt.Errorf("could not get PoolClaim %s: %v", name, err)
+	}
+	if object.GetLabels()[poolRequestLabel] != string(uid) {
+		return fmt.Errorf("PoolClaim %s was not filed for this namespace", name)
+	}
+	return nil
+}
+
+// RunClaimBinder periodically binds pending PoolClaims to pools once their
+// namespace exists, and marks claims whose namespace never appeared as Lost.
+// Bound claims are owned by their namespace and deleted along with it.
+func (a *AdmissionController) RunClaimBinder(ctx context.Context, interval time.Duration) {
+	if !a.claimsPools() {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := a.bindClaims(ctx); err != nil {
+			a.Logger.Error("could not bind pool claims", zap.Error(err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (a *AdmissionController) bindClaims(ctx context.Context) error {
+	claims, err := a.DynamicReader.Resource(claim.Resource).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("could not list pool claims: %v", err)
+	}
+	if len(claims.Items) == 0 {
+		return nil
+	}
+	nsList, err := a.K8sReader.CoreV1().Namespaces().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("could not list namespaces: %v", err)
+	}
+	namespaces := make(map[string]*corev1.Namespace, len(nsList.Items))
+	for i := range nsList.Items {
+		if name := nsList.Items[i].Annotations[claimAnnotation]; name != "" {
+			namespaces[name] = &nsList.Items[i]
+		}
+	}
+
+	for i := range claims.Items {
+		c, err := claim.FromUnstructured(&claims.Items[i])
+		if err != nil {
+			a.Logger.Error("could not decode pool claim", zap.Error(err))
+			continue
+		}
+		switch c.Status.Phase {
+		case claim.PhaseBound:
+			continue
+		case claim.PhaseLost:
+			if time.Since(c.CreationTimestamp.Time) > allocationRetention {
+				err := a.DynamicClient.Resource(claim.Resource).Delete(ctx, c.Name, metav1.DeleteOptions{})
+				if err != nil && !apierrors.IsNotFound(err) {
+					a.Logger.Error("could not delete lost pool claim", zap.String("claim", c.Name), zap.Error(err))
+				}
+			}
+			continue
+		}
+		if !a.bindClaim(ctx, c, namespaces[c.Name]) {
+			continue
+		}
+		if err := a.updateClaim(ctx, c); err != nil {
+			a.Logger.Error("could not update pool claim", zap.String("claim", c.Name), zap.Error(err))
+			continue
+		}
+		a.Logger.Info("Pool claim changed phase", zap.String("claim", c.Name),
+			zap.String("poolName", c.Status.Pool), zap.String("phase", string(c.Status.Phase)))
+	}
+	return nil
+}
+
+// bindClaim assigns a pool to the namespace of a pending claim and reports
+// whether the claim changed. A claim whose namespace has not appeared within
+// the reservation TTL, e.g. because another webhook denied the creation, is
+// lost.
+func (a *AdmissionController) bindClaim(ctx context.Context, c *claim.PoolClaim, ns *corev1.Namespace) bool {
+	if ns == nil || ns.DeletionTimestamp != nil {
+		ttl := time.Duration(a.Config.ReservationTTLSeconds) * time.Second
+		if ns == nil && time.Since(c.CreationTimestamp.Time) < ttl {
+			return false
+		}
+		c.Status.Phase = claim.PhaseLost
+		c.Status.Message = "the namespace was not created, or was deleted before the claim was bound"
+		return true
+	}
+
+	// Assigned meanwhile, e.g. by an annotation editor
+	var poolName, poolCIDR string
+	var assigned []string
+	if err := json.Unmarshal([]byte(ns.Annotations[ipv4PoolsAnnotation]), &assigned); err == nil && len(assigned) > 0 {
+		poolName, poolCIDR = assigned[0], ns.Annotations[CIDRAnnotation]
+	} else {
+		var err error
+		poolName, poolCIDR, err = a.assignExistingNamespace(ctx, ns, c.Spec.RequestUID, "claim/"+c.Name)
+		if errors.Is(err, errPoolLocked) {
+			// Retried next interval
+			return false
+		}
+		if err != nil {
+			a.Logger.Error("could not bind pool claim", zap.String("claim", c.Name), zap.String("namespace", ns.Name), zap.Error(err))
+			message := err.Error()
+			if c.Status.Message == message {
+				return false
+			}
+			c.Status.Message = message
+			return true
+		}
+		a.Recorder.Eventf(ns, corev1.EventTypeNormal, reasonPoolAssigned, "Assigned IP pool %s (%s), bound to PoolClaim %s", poolName, poolCIDR, c.Name)
+	}
+
+	c.Spec.Namespace = ns.Name
+	c.Status.Phase, c.Status.Pool, c.Status.CIDR, c.Status.Message = claim.PhaseBound, poolName, poolCIDR, ""
+	// Garbage collected along with the namespace
+	c.OwnerReferences = []metav1.OwnerReference{{
+		APIVersion: "v1",
+		Kind:       "Namespace",
+		Name:       ns.Name,
+		UID:        ns.UID,
+	}}
+	return true
+}
+
+// updateClaim writes a claim back. It carries the resourceVersion it was read
+// at; a conflict is retried on the next pass.
+func (a *AdmissionController) updateClaim(ctx context.Context, c *claim.PoolClaim) error {
+	object, err := claim.ToUnstructured(c)
+	if err != nil {
+		return err
+	}
+	_, err = a.DynamicClient.Resource(claim.Resource).Update(ctx, object, metav1.UpdateOptions{FieldManager: fieldManager})
+	return err
+}
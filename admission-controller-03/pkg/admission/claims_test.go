@@ -0,0 +1,190 @@
+package admission
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	jsonpatch "gopkg.in/evanphx/json-patch.v4"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8sruntime "k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+
+	"admission-controller-03/pkg/claim"
+	"admission-controller-03/pkg/config"
+)
+
+// newClaimController returns a pool controller in the claim assignment mode,
+// filing PoolClaims through a fake dynamic client.
+func newClaimController(n int, objects ...k8sruntime.Object) (*AdmissionController, *dynamicfake.FakeDynamicClient) {
+	a, _, _ := newPoolController(n)
+	a.Config.AssignmentMode = config.AssignmentModeClaim
+	dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(k8sruntime.NewScheme(),
+		map[schema.GroupVersionResource]string{claim.Resource: claim.Kind + "List"}, objects...)
+	a.DynamicClient, a.DynamicReader = dynamicClient, dynamicClient
+	return a, dynamicClient
+}
+
+// validate sends a namespace review through the validating handler.
+func validate(t *testing.T, a *AdmissionController, uid types.UID, ns *corev1.Namespace) *admissionv1.AdmissionResponse {
+	t.Helper()
+	body, err := reviewBody(uid, admissionv1.Create, ns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	a.HandleValidation(w, httptest.NewRequest(http.MethodPost, "/validate", body))
+	var out admissionv1.AdmissionReview
+	if err := json.Unmarshal(w.Body.Bytes(), &out); err != nil || out.Response == nil {
+		t.Fatalf("response is not an AdmissionReview: %v", err)
+	}
+	return out.Response
+}
+
+func TestValidateClaimedNamespace(t *testing.T) {
+	a, _ := newClaimController(1)
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a"}}
+	resp := admit(t, a, "uid-1", admissionv1.Create, ns)
+	if !resp.Allowed || resp.Patch == nil {
+		t.Fatalf("claim not filed: allowed=%v %v", resp.Allowed, resp.Result)
+	}
+	raw, err := json.Marshal(ns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	patch, err := jsonpatch.DecodePatch(resp.Patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if raw, err = patch.Apply(raw); err != nil {
+		t.Fatal(err)
+	}
+	var patched corev1.Namespace
+	if err := json.Unmarshal(raw, &patched); err != nil {
+		t.Fatal(err)
+	}
+
+	if resp := validate(t, a, "uid-1", &patched); !resp.Allowed {
+		t.Errorf("namespace with its own claim denied: %v", resp.Result)
+	}
+	// The same annotation set by another request
+	if resp := validate(t, a, "uid-2", &patched); resp.Allowed || resp.Result == nil || resp.Result.Reason != statusProtectedAnnotation {
+		t.Errorf("namespace with another request's claim: allowed=%v %v", resp.Allowed, resp.Result)
+	}
+	// A claim that was never filed
+	forged := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-b", Annotations: map[string]string{claimAnnotation: "team-b-x"}}}
+	if resp := validate(t, a, "uid-3", forged); resp.Allowed || resp.Result == nil || resp.Result.Reason != statusProtectedAnnotation {
+		t.Errorf("namespace with a missing claim: allowed=%v %v", resp.Allowed, resp.Result)
+	}
+}
+
+// fileClaim returns a pending claim created age ago, as the mutating webhook
+// files it.
+func fileClaim(t *testing.T, name string, age time.Duration) k8sruntime.Object {
+	t.Helper()
+	object, err := claim.ToUnstructured(&claim.PoolClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              name,
+			Labels:            map[string]string{poolRequestLabel: "uid-1"},
+			CreationTimestamp: metav1.NewTime(time.Now().Add(-age)),
+		},
+		Spec:   claim.Spec{Namespace: "team-a", RequestUID: "uid-1"},
+		Status: claim.Status{Phase: claim.PhasePending},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return object
+}
+
+func getClaim(t *testing.T, client *dynamicfake.FakeDynamicClient, name string) *claim.PoolClaim {
+	t.Helper()
+	object, err := client.Resource(claim.Resource).Get(context.Background(), name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := claim.FromUnstructured(object)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestBindClaims(t *testing.T) {
+	ttl := time.Duration(config.Default().ReservationTTLSeconds) * time.Second
+	tests := []struct {
+		name      string
+		age       time.Duration
+		namespace bool
+		wantPhase claim.Phase
+	}{
+		{name: "namespace created", age: time.Second, namespace: true, wantPhase: claim.PhaseBound},
+		{name: "namespace not created yet", age: time.Second, wantPhase: claim.PhasePending},
+		{name: "namespace never created", age: ttl + time.Minute, wantPhase: claim.PhaseLost},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, dynamicClient := newClaimController(1, fileClaim(t, "team-a-claim", tt.age))
+			if tt.namespace {
+				ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a", UID: "ns-uid", Annotations: map[string]string{claimAnnotation: "team-a-claim"}}}
+				if _, err := a.K8sClientset.CoreV1().Namespaces().Create(context.Background(), ns, metav1.CreateOptions{}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := a.bindClaims(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			c := getClaim(t, dynamicClient, "team-a-claim")
+			if c.Status.Phase != tt.wantPhase {
+				t.Fatalf("claim is %s (%s), want %s", c.Status.Phase, c.Status.Message, tt.wantPhase)
+			}
+			pool, err := a.CalicoReader.ProjectcalicoV3().IPPools().Get(context.Background(), "pool-0", metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantPhase != claim.PhaseBound {
+				if pool.Labels["status"] != "available" {
+					t.Errorf("pool of an unbound claim is %s", pool.Labels["status"])
+				}
+				return
+			}
+
+			if c.Status.Pool != "pool-0" || c.Status.CIDR != "10.0.0.0/26" {
+				t.Errorf("claim bound to %s (%s)", c.Status.Pool, c.Status.CIDR)
+			}
+			if len(c.OwnerReferences) != 1 || c.OwnerReferences[0].UID != "ns-uid" {
+				t.Errorf("bound claim is owned by %v, want the namespace", c.OwnerReferences)
+			}
+			if pool.Labels["status"] != "used" || pool.Labels[poolNamespaceLabel] != "team-a" {
+				t.Errorf("pool of the bound claim has labels %v", pool.Labels)
+			}
+			ns, err := a.K8sReader.CoreV1().Namespaces().Get(context.Background(), "team-a", metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ns.Annotations[ipv4PoolsAnnotation] != `["pool-0"]` || !hasReleaseFinalizer(ns) {
+				t.Errorf("namespace of the bound claim has annotations %v, finalizers %v", ns.Annotations, ns.Finalizers)
+			}
+
+			// Bound claims are left alone
+			dynamicClient.ClearActions()
+			if err := a.bindClaims(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			for _, action := range dynamicClient.Actions() {
+				if action.GetVerb() == "update" {
+					t.Errorf("bound claim updated again")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package admission
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+
+	"admission-controller-03/pkg/config"
+
+	crdv1 "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ownershipLabels are dropped when a pool goes back into circulation.
+var ownershipLabels = []string{poolTenantLabel, poolRequestLabel, poolNamespaceLabel, poolAssignedAtLabel, externalOwnerLabel}
+
+// releasePool applies the cleanup policy to the pool of a deleted namespace.
+// Only child pools the controller created are subject to the policy; static
+// pools are always recycled. A pool under someone else's IP reservation is not
+// released at all.
+func (a *AdmissionController) releasePool(ctx context.Context, pool *crdv1.IPPool, namespace string) error {
+	if err := a.releaseReservations(ctx, pool); err != nil {
+		return err
+	}
+	if err := a.cniPlugin().RemovePool(ctx, pool.Name); err != nil {
+		return err
+	}
+	poolLabels := normalizeLabels(pool.ObjectMeta.Labels)
+	policy := config.CleanupRecycle
+	if team := poolLabels[poolTeamLabel]; team != "" {
+		policy = a.cleanupPolicyFor(team)
+	}
+	if poolLabels[poolBackendLabel] != "" {
+		// The subnet goes back to the external backend with the pool
+		policy = config.CleanupDelete
+	}
+
+	switch policy {
+	case config.CleanupRetain:
+		a.Logger.Info("Retaining IP pool of deleted namespace", zap.String("poolName", pool.Name), zap.String("namespace", namespace))
+		return a.updateIPPoolLabels(ctx, pool.Name, "retained", nil, nil)
+	case config.CleanupDelete:
+		// Pods, and so their addresses, outlive the DELETE admission; the
+		// pool is only deleted by RunPoolCleanup once the namespace is gone
+		a.Logger.Info("Scheduling IP pool of deleted namespace for deletion", zap.String("poolName", pool.Name), zap.String("namespace", namespace))
+		return a.updateIPPoolLabels(ctx, pool.Name, "deleting", map[string]string{poolNamespaceLabel: namespace}, nil)
+	default:
+		// Update the IP pool label to "available" and drop the tenant ownership
+		return a.updateIPPoolLabels(ctx, pool.Name, "available", nil, ownershipLabels)
+	}
+}
+
+// RunPoolCleanup periodically deletes pools scheduled for deletion whose
+// namespace no longer exists, i.e. whose addresses have all been released.
+func (a *AdmissionController) RunPoolCleanup(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := a.cleanupPools(ctx); err != nil {
+			a.Logger.Error("could not clean up IP pools", zap.Error(err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (a *AdmissionController) cleanupPools(ctx context.Context) error {
+	ipPools, err := a.CalicoReader.ProjectcalicoV3().IPPools().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("could not list IP pools: %v", err)
+	}
+
+	for _, pool := range ipPools.Items {
+		poolLabels := normalizeLabels(pool.ObjectMeta.Labels)
+		if poolLabels["status"] != "deleting" {
+			continue
+		}
+		namespace := poolLabels[poolNamespaceLabel]
+		_, err := a.K8sReader.CoreV1().Namespaces().Get(ctx, namespace, metav1.GetOptions{})
+		if err == nil {
+			continue
+		}
+		if !apierrors.IsNotFound(err) {
+			a.Logger.Error("could not check namespace of pool scheduled for deletion", zap.String("poolName", pool.Name), zap.Error(err))
+			continue
+		}
+
+		if poolLabels[poolBackendLabel] != "" {
+			if err := a.releaseBackendSubnet(ctx, &pool); err != nil {
+				a.Logger.Error("could not release subnet to the IPAM backend", zap.String("poolName", pool.Name), zap.Error(err))
+				continue
+			}
+		}
+		if err := a.Clientset.ProjectcalicoV3().IPPools().Delete(ctx, pool.Name, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+			a.Logger.Error("could not delete IP pool", zap.String("poolName", pool.Name), zap.Error(err))
+			continue
+		}
+		a.Logger.Info("Deleted IP pool of deleted namespace", zap.String("poolName", pool.Name), zap.String("namespace", namespace))
+	}
+	return nil
+}
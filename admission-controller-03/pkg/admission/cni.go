@@ -0,0 +1,45 @@
+package admission
+
+import (
+	"context"
+	"fmt"
+
+	"admission-controller-03/pkg/cni"
+
+	crdv1 "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
+)
+
+// cniPlugin returns the CNI namespace subnets are applied to: the configured
+// one, Calico otherwise.
+func (a *AdmissionController) cniPlugin() cni.Plugin {
+	if a.CNI != nil {
+		return a.CNI
+	}
+	return cni.Calico{}
+}
+
+// cniPools resolves the CIDRs of a namespace's pools, in assignment order.
+func (a *AdmissionController) cniPools(ctx context.Context, poolNames []string, pools []crdv1.IPPool) ([]cni.Pool, error) {
+	resolved := make([]cni.Pool, 0, len(poolNames))
+	for _, name := range poolNames {
+		poolCIDR, err := a.poolCIDR(ctx, name, pools)
+		if err != nil {
+			return nil, err
+		}
+		resolved = append(resolved, cni.Pool{Name: name, CIDR: poolCIDR})
+	}
+	return resolved, nil
+}
+
+// applyCNI has the CNI serve the namespace's pools and adds the annotations
+// selecting them to annotations.
+func (a *AdmissionController) applyCNI(ctx context.Context, annotations map[string]string, pools []cni.Pool) error {
+	plugin := a.cniPlugin()
+	if err := plugin.EnsurePools(ctx, pools); err != nil {
+		return fmt.Errorf("could not apply IP pools to %s: %v", plugin.Name(), err)
+	}
+	for key, value := range plugin.NamespaceAnnotations(pools) {
+		annotations[key] = value
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package admission
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"go.uber.org/zap"
+
+	"admission-controller-03/pkg/allocation"
+	allocationv1beta1 "admission-controller-03/pkg/allocation/v1beta1"
+	"admission-controller-03/pkg/tenant"
+	tenantv1beta1 "admission-controller-03/pkg/tenant/v1beta1"
+
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// ConversionPath serves the CRD conversion webhook.
+const ConversionPath = "/convert"
+
+// maxConversionBytes bounds the body of a ConversionReview, which carries
+// every object of a list request.
+const maxConversionBytes = 64 << 20
+
+// converters convert the objects of each CRD kind between its versions.
+var converters = map[string]func(*unstructured.Unstructured, string) (*unstructured.Unstructured, error){
+	allocation.Kind: allocationv1beta1.Convert,
+	tenant.Kind:     tenantv1beta1.Convert,
+}
+
+// HandleConversion converts IPPoolAllocations and Tenants between v1alpha1
+// and v1beta1 for the API server. One object that cannot be converted fails
+// the whole review, as the API server requires.
+func (a *AdmissionController) HandleConversion(w http.ResponseWriter, r *http.Request) {
+	var review apiextensionsv1.ConversionReview
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxConversionBytes)).Decode(&review); err != nil || review.Request == nil {
+		a.Logger.Warn("Rejecting malformed conversion review", zap.Error(err))
+		http.Error(w, "malformed conversion review", http.StatusBadRequest)
+		return
+	}
+	req := review.Request
+	response := &apiextensionsv1.ConversionResponse{UID: req.UID, Result: metav1.Status{Status: metav1.StatusSuccess}}
+	for _, raw := range req.Objects {
+		converted, err := convertObject(raw.Raw, req.DesiredAPIVersion)
+		if err != nil {
+			a.Logger.Error("could not convert object", zap.String("desiredAPIVersion", req.DesiredAPIVersion), zap.Error(err))
+			response.ConvertedObjects = nil
+			response.Result = metav1.Status{Status: metav1.StatusFailure, Message: err.Error()}
+			break
+		}
+		response.ConvertedObjects = append(response.ConvertedObjects, runtime.RawExtension{Raw: converted})
+	}
+
+	body, err := json.Marshal(apiextensionsv1.ConversionReview{TypeMeta: review.TypeMeta, Response: response})
+	if err != nil {
+		a.Logger.Error("could not encode conversion response", zap.Error(err))
+		http.Error(w, fmt.Sprintf("could not encode response: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	if _, err := w.Write(body); err != nil {
+		a.Logger.Error("could not write conversion response", zap.Error(err))
+	}
+}
+
+// convertObject converts one encoded object to the desired group version.
+func convertObject(raw []byte, desiredAPIVersion string) ([]byte, error) {
+	var object unstructured.Unstructured
+	if err := object.UnmarshalJSON(raw); err != nil {
+		return nil, fmt.Errorf("could not decode object: %v", err)
+	}
+	gvk := object.GroupVersionKind()
+	convert, ok := converters[gvk.Kind]
+	if !ok || gvk.Group != allocation.Group {
+		return nil, fmt.Errorf("cannot convert %s", gvk)
+	}
+	desired, err := schema.ParseGroupVersion(desiredAPIVersion)
+	if err != nil {
+		return nil, fmt.Errorf("invalid desired API version: %v", err)
+	}
+	if desired.Group != gvk.Group {
+		return nil, fmt.Errorf("cannot convert %s to group %s", gvk, desired.Group)
+	}
+	converted, err := convert(&object, desired.Version)
+	if err != nil {
+		return nil, err
+	}
+	converted.SetAPIVersion(desiredAPIVersion)
+	converted.SetKind(gvk.Kind)
+	return converted.MarshalJSON()
+}
+
+// conversionWebhook returns the conversion settings of the CRDs: the service
+// and CA bundle of the named MutatingWebhookConfiguration's first webhook,
+// with the conversion path.
+func (a *AdmissionController) conversionWebhook(ctx context.Context, webhookConfigName string) (map[string]interface{}, error) {
+	webhookConfig, err := a.K8sReader.AdmissionregistrationV1().MutatingWebhookConfigurations().Get(ctx, webhookConfigName, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("could not get mutating webhook configuration: %v", err)
+	}
+	for _, webhook := range webhookConfig.Webhooks {
+		service := webhook.ClientConfig.Service
+		if service == nil {
+			continue
+		}
+		serviceRef := map[string]interface{}{
+			"namespace": service.Namespace,
+			"name":      service.Name,
+			"path":      ConversionPath,
+		}
+		if service.Port != nil {
+			serviceRef["port"] = int64(*service.Port)
+		}
+		clientConfig := map[string]interface{}{"service": serviceRef}
+		if len(webhook.ClientConfig.CABundle) > 0 {
+			clientConfig["caBundle"] = base64.StdEncoding.EncodeToString(webhook.ClientConfig.CABundle)
+		}
+		return map[string]interface{}{
+			"strategy": string(apiextensionsv1.WebhookConverter),
+			"webhook": map[string]interface{}{
+				"clientConfig":             clientConfig,
+				"conversionReviewVersions": []interface{}{"v1"},
+			},
+		}, nil
+	}
+	return nil, fmt.Errorf("mutating webhook configuration %s has no webhook with a service", webhookConfigName)
+}
+
+// serveConvertedVersions turns on the conversion webhook of a CRD with more
+// than one version and serves all of them. Without a webhook the versions
+// other than the storage version stay off.
+func serveConvertedVersions(crd *unstructured.Unstructured, conversion map[string]interface{}) error {
+	versions, _, err := unstructured.NestedSlice(crd.Object, "spec", "versions")
+	if err != nil || len(versions) < 2 || conversion == nil {
+		return err
+	}
+	for _, version := range versions {
+		if v, ok := version.(map[string]interface{}); ok {
+			v["served"] = true
+		}
+	}
+	if err := unstructured.SetNestedSlice(crd.Object, versions, "spec", "versions"); err != nil {
+		return err
+	}
+	return unstructured.SetNestedMap(crd.Object, conversion, "spec", "conversion")
+}
@@ -0,0 +1,58 @@
+package admission
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"admission-common/admissionreview"
+	"admission-controller-03/pkg/allocation"
+
+	admissionv1 "k8s.io/api/admission/v1"
+)
+
+// HandleDefaulting fills in the fields of an IPPoolAllocation written without
+// them, such as one restored from a backup or created by hand: the zone is the
+// webhook's location and, with hierarchical allocation, the prefix length is
+// the tenant's. Register it for v1alpha1 with matchPolicy Equivalent, the API
+// server converts v1beta1 requests.
+func (a *AdmissionController) HandleDefaulting(w http.ResponseWriter, r *http.Request) {
+	admissionReviewReq, err := decodeAdmissionReview(w, r)
+	if err != nil {
+		a.writeMalformedReview(w, admissionReviewReq, err)
+		return
+	}
+	req := admissionReviewReq.Request
+	admissionResponse := admissionreview.NewResponse(req)
+	if req.Kind.Kind != allocation.Kind || (req.Operation != admissionv1.Create && req.Operation != admissionv1.Update) {
+		a.writeAdmissionResponse(w, admissionResponse)
+		return
+	}
+	if req.Kind.Version != allocation.Version {
+		addWarning(admissionResponse, "%s %s is not defaulted, register the defaulting webhook for %s", req.Kind.Kind, req.Kind.Version, allocation.Version)
+		a.writeAdmissionResponse(w, admissionResponse)
+		return
+	}
+	var record allocation.IPPoolAllocation
+	if err := json.Unmarshal(req.Object.Raw, &record); err != nil {
+		a.denyMalformedObject(w, admissionResponse, "object", err)
+		return
+	}
+
+	var patch []patchOperation
+	if record.Spec.Zone == "" && a.Config.Location != "" {
+		patch = append(patch, patchOperation{Op: "add", Path: "/spec/zone", Value: a.Config.Location})
+	}
+	if record.Spec.PrefixLength == 0 && a.Config.Hierarchy != nil && record.Spec.Tenant != "" {
+		patch = append(patch, patchOperation{Op: "add", Path: "/spec/prefixLength", Value: a.namespacePrefixLength(record.Spec.Tenant)})
+	}
+	if len(patch) > 0 {
+		patchBytes, err := json.Marshal(patch)
+		if err != nil {
+			a.writeInternalError(w, admissionResponse, "could not marshal patch: %v", err)
+			return
+		}
+		patchType := admissionv1.PatchTypeJSONPatch
+		admissionResponse.Patch, admissionResponse.PatchType = patchBytes, &patchType
+	}
+	a.writeAdmissionResponse(w, admissionResponse)
+}
@@ -0,0 +1,84 @@
+package admission
+
+import (
+	"fmt"
+	"net/http"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Stable reasons for denied requests, so automation can act on a denial
+// without parsing its message. Each is always paired with the same code.
+const (
+	statusUnsupportedKind        metav1.StatusReason = "UnsupportedKind"
+	statusTenantUnresolved       metav1.StatusReason = "TenantUnresolved"
+	statusPoolListFailed         metav1.StatusReason = "PoolListFailed"
+	statusPoolCIDRUnresolved     metav1.StatusReason = "PoolCIDRUnresolved"
+	statusPoolUpdateFailed       metav1.StatusReason = "PoolUpdateFailed"
+	statusQuotaExceeded          metav1.StatusReason = "QuotaExceeded"
+	statusAggregateAllocFailed   metav1.StatusReason = "AggregateAllocationFailed"
+	statusBackendAllocFailed     metav1.StatusReason = "BackendAllocationFailed"
+	statusPoolsExhausted         metav1.StatusReason = "PoolsExhausted"
+	statusInvalidPoolAnnotation  metav1.StatusReason = "InvalidPoolAnnotation"
+	statusPoolNotAllowed         metav1.StatusReason = "PoolNotAllowed"
+	statusPoolUnavailable        metav1.StatusReason = "PoolUnavailable"
+	statusPoolNotFound           metav1.StatusReason = "PoolNotFound"
+	statusProtectedAnnotation    metav1.StatusReason = "ProtectedAnnotation"
+	statusPoolContention         metav1.StatusReason = "PoolContention"
+	statusPoolInUse              metav1.StatusReason = "PoolInUse"
+	statusPoolCIDROverlap        metav1.StatusReason = "PoolCIDROverlap"
+	statusMalformedRequest       metav1.StatusReason = "MalformedRequest"
+	statusInternalError          metav1.StatusReason = "InternalError"
+	statusAllocationRecordFailed metav1.StatusReason = "AllocationRecordFailed"
+	statusCNIPoolFailed          metav1.StatusReason = "CNIPoolFailed"
+	statusServiceIPsExhausted    metav1.StatusReason = "ServiceIPsExhausted"
+	statusServiceIPAllocFailed   metav1.StatusReason = "ServiceIPAllocationFailed"
+	statusServiceIPNotAllowed    metav1.StatusReason = "ServiceIPNotAllowed"
+	statusServiceIPInUse         metav1.StatusReason = "ServiceIPInUse"
+	statusInvalidPoolPinning     metav1.StatusReason = "InvalidPoolPinning"
+	statusPoolClassNotAllowed    metav1.StatusReason = "PoolClassNotAllowed"
+	statusPolicyDenied           metav1.StatusReason = "PolicyDenied"
+	statusPolicyFailed           metav1.StatusReason = "PolicyEvaluationFailed"
+)
+
+var denialCodes = map[metav1.StatusReason]int32{
+	statusUnsupportedKind:        http.StatusUnprocessableEntity,
+	statusTenantUnresolved:       http.StatusInternalServerError,
+	statusPoolListFailed:         http.StatusServiceUnavailable,
+	statusPoolCIDRUnresolved:     http.StatusInternalServerError,
+	statusPoolUpdateFailed:       http.StatusServiceUnavailable,
+	statusQuotaExceeded:          http.StatusForbidden,
+	statusAggregateAllocFailed:   http.StatusInsufficientStorage,
+	statusBackendAllocFailed:     http.StatusServiceUnavailable,
+	statusPoolsExhausted:         http.StatusInsufficientStorage,
+	statusInvalidPoolAnnotation:  http.StatusUnprocessableEntity,
+	statusPoolNotAllowed:         http.StatusForbidden,
+	statusPoolUnavailable:        http.StatusConflict,
+	statusPoolNotFound:           http.StatusNotFound,
+	statusProtectedAnnotation:    http.StatusForbidden,
+	statusPoolContention:         http.StatusConflict,
+	statusPoolInUse:              http.StatusConflict,
+	statusPoolCIDROverlap:        http.StatusConflict,
+	statusMalformedRequest:       http.StatusBadRequest,
+	statusInternalError:          http.StatusInternalServerError,
+	statusAllocationRecordFailed: http.StatusServiceUnavailable,
+	statusCNIPoolFailed:          http.StatusServiceUnavailable,
+	statusServiceIPsExhausted:    http.StatusInsufficientStorage,
+	statusServiceIPAllocFailed:   http.StatusServiceUnavailable,
+	statusServiceIPNotAllowed:    http.StatusForbidden,
+	statusServiceIPInUse:         http.StatusConflict,
+	statusInvalidPoolPinning:     http.StatusUnprocessableEntity,
+	statusPoolClassNotAllowed:    http.StatusForbidden,
+	statusPolicyDenied:           http.StatusForbidden,
+	statusPolicyFailed:           http.StatusServiceUnavailable,
+}
+
+// denial builds the status a request is denied with.
+func denial(reason metav1.StatusReason, format string, args ...interface{}) *metav1.Status {
+	return &metav1.Status{
+		Status:  metav1.StatusFailure,
+		Reason:  reason,
+		Code:    denialCodes[reason],
+		Message: fmt.Sprintf(format, args...),
+	}
+}
@@ -0,0 +1,210 @@
+package admission
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"reflect"
+
+	"go.uber.org/zap"
+
+	"admission-controller-03/pkg/cidr"
+
+	crdv1 "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// dnsEndpointName names the DNSEndpoint holding the records of a namespace's
+// subnets, in the namespace itself.
+const dnsEndpointName = "ipam-subnets"
+
+var dnsEndpointGVK = schema.GroupVersionKind{Group: "externaldns.k8s.io", Version: "v1alpha1", Kind: "DNSEndpoint"}
+
+var dnsEndpointResource = schema.GroupVersionResource{Group: "externaldns.k8s.io", Version: "v1alpha1", Resource: "dnsendpoints"}
+
+// dnsReconciler keeps a DNSEndpoint in every namespace holding pools, with
+// the records of the pools' subnets, for external-dns to publish. It is owned
+// by the namespace, so the records are withdrawn along with it; a namespace
+// that no longer holds pools has it deleted.
+type dnsReconciler struct {
+	a *AdmissionController
+	// cache is the manager's informer cache
+	cache client.Reader
+}
+
+// SetupDNSController registers the DNS reconciler with the manager when it is
+// configured. The external-dns DNSEndpoint CRD must be installed. A
+// DNSEndpoint edited or deleted by hand is restored.
+func (a *AdmissionController) SetupDNSController(mgr manager.Manager) error {
+	if a.Config.DNS == nil {
+		return nil
+	}
+	endpoint := &unstructured.Unstructured{}
+	endpoint.SetGroupVersionKind(dnsEndpointGVK)
+	return builder.ControllerManagedBy(mgr).
+		Named("dns").
+		For(&corev1.Namespace{}).
+		Owns(endpoint).
+		Complete(&dnsReconciler{a: a, cache: mgr.GetCache()})
+}
+
+func (r *dnsReconciler) Reconcile(ctx context.Context, req reconcile.Request) (reconcile.Result, error) {
+	var ns corev1.Namespace
+	if err := r.cache.Get(ctx, req.NamespacedName, &ns); err != nil {
+		return reconcile.Result{}, client.IgnoreNotFound(err)
+	}
+	if ns.DeletionTimestamp != nil {
+		// Garbage collected with the namespace
+		return reconcile.Result{}, nil
+	}
+
+	var names []string
+	if annotation := ns.Annotations[ipv4PoolsAnnotation]; annotation != "" {
+		if err := json.Unmarshal([]byte(annotation), &names); err != nil {
+			// Rejected at admission; nothing to publish until fixed
+			r.a.Logger.Warn("Failed to decode IP pool annotation", zap.String("namespace", ns.Name), zap.Error(err))
+			return reconcile.Result{}, nil
+		}
+	}
+	var endpoints []interface{}
+	for _, name := range names {
+		var pool crdv1.IPPool
+		err := r.cache.Get(ctx, types.NamespacedName{Name: name}, &pool)
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return reconcile.Result{}, fmt.Errorf("could not get IP pool %s: %v", name, err)
+		}
+		endpoints = append(endpoints, r.poolRecords(&ns, &pool)...)
+	}
+
+	existing := &unstructured.Unstructured{}
+	existing.SetGroupVersionKind(dnsEndpointGVK)
+	err := r.cache.Get(ctx, types.NamespacedName{Namespace: ns.Name, Name: dnsEndpointName}, existing)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return reconcile.Result{}, fmt.Errorf("could not get DNSEndpoint: %v", err)
+	}
+	found := err == nil
+	if found && existing.GetLabels()[managedByLabel] != managedBy {
+		r.a.Logger.Warn("DNSEndpoint of the namespace's subnets is someone else's, leaving it", zap.String("namespace", ns.Name))
+		return reconcile.Result{}, nil
+	}
+
+	endpointsClient := r.a.DynamicClient.Resource(dnsEndpointResource).Namespace(ns.Name)
+	if len(endpoints) == 0 {
+		if !found {
+			return reconcile.Result{}, nil
+		}
+		err := endpointsClient.Delete(ctx, dnsEndpointName, metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return reconcile.Result{}, fmt.Errorf("could not delete DNSEndpoint: %v", err)
+		}
+		r.a.Logger.Info("Withdrew DNS records of released subnets", zap.String("namespace", ns.Name))
+		return reconcile.Result{}, nil
+	}
+	if current, _, _ := unstructured.NestedSlice(existing.Object, "spec", "endpoints"); found && reflect.DeepEqual(current, endpoints) {
+		return reconcile.Result{}, nil
+	}
+
+	desired := &unstructured.Unstructured{Object: map[string]interface{}{
+		"spec": map[string]interface{}{"endpoints": endpoints},
+	}}
+	desired.SetGroupVersionKind(dnsEndpointGVK)
+	desired.SetName(dnsEndpointName)
+	desired.SetNamespace(ns.Name)
+	desired.SetLabels(map[string]string{managedByLabel: managedBy})
+	desired.SetOwnerReferences([]metav1.OwnerReference{{
+		APIVersion: "v1",
+		Kind:       "Namespace",
+		Name:       ns.Name,
+		UID:        ns.UID,
+		Controller: ptr.To(true),
+	}})
+	if _, err := endpointsClient.Apply(ctx, dnsEndpointName, desired, metav1.ApplyOptions{FieldManager: fieldManager, Force: true}); err != nil {
+		return reconcile.Result{}, fmt.Errorf("could not apply DNSEndpoint: %v", err)
+	}
+	r.a.Logger.Info("Published DNS records of assigned subnets", zap.String("namespace", ns.Name), zap.Strings("pools", names), zap.Int("records", len(endpoints)))
+	return reconcile.Result{}, nil
+}
+
+// poolRecords returns the DNSEndpoint endpoints of a pool's subnet: its TXT
+// inventory record and the delegation of its reverse zones.
+func (r *dnsReconciler) poolRecords(ns *corev1.Namespace, pool *crdv1.IPPool) []interface{} {
+	d := r.a.Config.DNS
+	var records []interface{}
+	record := func(name, recordType string, targets ...string) {
+		endpoint := map[string]interface{}{
+			"dnsName":    name,
+			"recordType": recordType,
+			"targets":    toInterfaces(targets),
+		}
+		if d.TTLSeconds > 0 {
+			endpoint["recordTTL"] = int64(d.TTLSeconds)
+		}
+		records = append(records, endpoint)
+	}
+
+	if d.InventoryDomain != "" {
+		record(pool.Name+"."+d.InventoryDomain, "TXT",
+			fmt.Sprintf("cidr=%s namespace=%s tenant=%s", pool.Spec.CIDR, ns.Name, ns.Labels[r.a.Config.TenantLabel]))
+	}
+	if len(d.ReverseNameservers) == 0 {
+		return records
+	}
+	prefix, err := netip.ParsePrefix(pool.Spec.CIDR)
+	if err != nil || !prefix.Addr().Is4() || prefix.Bits() == 0 {
+		r.a.Logger.Warn("Reverse zone of subnet is not delegated, only IPv4 subnets are", zap.String("poolName", pool.Name), zap.String("cidr", pool.Spec.CIDR))
+		return records
+	}
+	prefix = prefix.Masked()
+	if prefix.Bits() <= 24 {
+		// Delegate every octet-aligned zone the subnet spans, e.g. the 16
+		// /24 zones of a /20
+		zoneBits := (prefix.Bits() + 7) / 8 * 8
+		zones, _ := cidr.Subnets(prefix.String(), zoneBits, 1<<(zoneBits-prefix.Bits()))
+		for _, zone := range zones {
+			record(reverseZone(netip.MustParsePrefix(zone)), "NS", d.ReverseNameservers...)
+		}
+		return records
+	}
+	// RFC 2317: the /24 zone holding the subnet points every address of it
+	// to a zone of its own, e.g. 5.64-26.2.0.192.in-addr.arpa
+	octets := prefix.Addr().As4()
+	zone := fmt.Sprintf("%d-%d.%d.%d.%d.in-addr.arpa", octets[3], prefix.Bits(), octets[2], octets[1], octets[0])
+	record(zone, "NS", d.ReverseNameservers...)
+	for i := 0; i < 1<<(32-prefix.Bits()); i++ {
+		host := int(octets[3]) + i
+		record(fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa", host, octets[2], octets[1], octets[0]), "CNAME", fmt.Sprintf("%d.%s", host, zone))
+	}
+	return records
+}
+
+// reverseZone returns the in-addr.arpa name of an octet-aligned IPv4 prefix.
+func reverseZone(prefix netip.Prefix) string {
+	octets := prefix.Addr().As4()
+	name := "in-addr.arpa"
+	for i := 0; i < prefix.Bits()/8; i++ {
+		name = fmt.Sprintf("%d.%s", octets[i], name)
+	}
+	return name
+}
+
+func toInterfaces(values []string) []interface{} {
+	out := make([]interface{}, len(values))
+	for i, v := range values {
+		out[i] = v
+	}
+	return out
+}
@@ -0,0 +1,41 @@
+// Package admission implements the namespace IP pool webhook and the loops
+// that keep pool labels and namespace annotations consistent.
+//
+// # Running several replicas
+//
+// Any number of replicas can serve admission requests at once. Allocation
+// state lives in the cluster only: a pool's status and ownership labels, the
+// namespace's ipv4pools and request-uid annotations, and the team aggregates
+// annotation on the master pool, and, with RecordAllocations, the
+// IPPoolAllocation of every assignment. A replica keeps nothing in memory that a
+// later request depends on, so requests, including the API server's retries
+// of one request, may land on any replica. Concurrent writers meet as follows:
+//
+//   - Two requests selecting the same pool: the per-pool Lease admits one of
+//     them; the other selects another pool, up to maxAllocationAttempts times,
+//     and is then denied with PoolContention. A pool the user requested is
+//     denied with PoolUnavailable straight away.
+//   - Pool label updates carry the resourceVersion they were computed from.
+//     A conflict re-reads the pool and re-applies the change, unless the pool
+//     was claimed by someone else meanwhile, which aborts the assignment.
+//   - Two replicas carving the same child pool of a team aggregate: the
+//     create of the loser fails with AlreadyExists and it carves the next
+//     subnet. Carving a team aggregate is a conditional update of the master
+//     pool; the loser re-reads it and uses the winner's aggregate if it was
+//     carved for the same tenant.
+//   - A retried request finds the pool its first attempt claimed through the
+//     request UID label, whichever replica served the first attempt.
+//
+// The background loops (binder, GC, deferred assignment, claim binder,
+// allocation controller, cleanup, growth, autoscaler, exhaustion watch and
+// drift audit) run on the leader only, see AddLeaderLoops, as do the release,
+// splitter, network policy, BGP and reservation reconcilers. They tolerate a
+// leadership change mid-pass for the same reasons.
+//
+// Every replica reads the Tenant resources itself, see RunTenantSync; until a
+// change has reached all of them, replicas may resolve a tenant differently.
+//
+// Per-replica, best-effort state remains: the startup scan progress behind
+// readiness, queued events, the consecutive allocation failure count and alert
+// cooldowns, so an alert may fire once per replica.
+package admission
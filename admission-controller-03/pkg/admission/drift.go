@@ -0,0 +1,210 @@
+package admission
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+
+	crdv1 "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Kinds of drift between namespace annotations and pool labels.
+const (
+	driftUndecodableAnnotation = "undecodable-annotation"
+	driftMissingPool           = "missing-pool"
+	driftReferencedNotUsed     = "referenced-not-used"
+	driftForeignOwner          = "foreign-owner"
+	driftUnreferencedPool      = "unreferenced-pool"
+	driftDanglingOwner         = "dangling-owner"
+)
+
+// driftKinds are always exported, even when zero, so that an alert on drift
+// resolves once it is gone.
+var driftKinds = []string{
+	driftUndecodableAnnotation,
+	driftMissingPool,
+	driftReferencedNotUsed,
+	driftForeignOwner,
+	driftUnreferencedPool,
+	driftDanglingOwner,
+}
+
+var (
+	driftDiscrepancies = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ipam_drift_discrepancies",
+		Help: "Discrepancies between namespace annotations and IP pool labels found by the last drift audit, by kind.",
+	}, []string{"kind"})
+	driftRepairs = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ipam_drift_repairs_total",
+		Help: "Discrepancies repaired by the drift audit in enforce mode, by kind.",
+	}, []string{"kind"})
+)
+
+// DriftCollectors returns the drift audit metrics for registration.
+func DriftCollectors() []prometheus.Collector {
+	return []prometheus.Collector{driftDiscrepancies, driftRepairs}
+}
+
+// RunDriftAudit periodically repeats the startup consistency checks. Every
+// discrepancy is logged, counted and, where a namespace is involved, posted
+// as an event on it. In enforce mode the discrepancies the startup scan can
+// repair are repaired as well; in report mode nothing is changed, so
+// operators can observe before letting the webhook fix pools.
+func (a *AdmissionController) RunDriftAudit(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := a.auditDrift(ctx); err != nil {
+			a.Logger.Error("could not audit pool drift", zap.Error(err))
+		}
+	}
+}
+
+// Drift is a discrepancy between namespace annotations and pool labels.
+type Drift struct {
+	Kind string `json:"kind"`
+	// Namespace is empty for discrepancies of a pool no namespace
+	// references.
+	Namespace string `json:"namespace,omitempty"`
+	Pool      string `json:"pool,omitempty"`
+	Detail    string `json:"detail"`
+
+	ns   *corev1.Namespace
+	pool *crdv1.IPPool
+}
+
+// DetectDrift runs the drift audit's checks without reporting or repairing
+// anything, for the audit and for operators.
+func (a *AdmissionController) DetectDrift(ctx context.Context) ([]Drift, error) {
+	ipPools, err := a.CalicoReader.ProjectcalicoV3().IPPools().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("could not list IP pools: %v", err)
+	}
+	nsList, err := a.K8sReader.CoreV1().Namespaces().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("could not list namespaces: %v", err)
+	}
+
+	pools := map[string]*crdv1.IPPool{}
+	for i := range ipPools.Items {
+		pools[ipPools.Items[i].Name] = &ipPools.Items[i]
+	}
+	var drifts []Drift
+	referenced := map[string]bool{}
+
+	for i := range nsList.Items {
+		ns := &nsList.Items[i]
+		annotation := ns.Annotations[ipv4PoolsAnnotation]
+		if annotation == "" {
+			continue
+		}
+		var names []string
+		if err := json.Unmarshal([]byte(annotation), &names); err != nil {
+			drifts = append(drifts, Drift{Kind: driftUndecodableAnnotation, Namespace: ns.Name, ns: ns,
+				Detail: fmt.Sprintf("IP pool annotation %q could not be decoded", annotation)})
+			continue
+		}
+		for _, poolName := range names {
+			referenced[poolName] = true
+			pool, ok := pools[poolName]
+			if !ok {
+				drifts = append(drifts, Drift{Kind: driftMissingPool, Namespace: ns.Name, Pool: poolName, ns: ns,
+					Detail: fmt.Sprintf("IP pool %s does not exist", poolName)})
+				continue
+			}
+			if status := normalizeLabels(pool.ObjectMeta.Labels)["status"]; status != "used" && status != "pending" {
+				drifts = append(drifts, Drift{Kind: driftReferencedNotUsed, Namespace: ns.Name, Pool: poolName, ns: ns, pool: pool,
+					Detail: fmt.Sprintf("IP pool %s is marked %s, not used", poolName, status)})
+			}
+			if owner, _ := poolOwner(*pool); owner != "" && owner != ns.Name {
+				drifts = append(drifts, Drift{Kind: driftForeignOwner, Namespace: ns.Name, Pool: poolName, ns: ns, pool: pool,
+					Detail: fmt.Sprintf("IP pool %s is bound to namespace %s", poolName, owner)})
+			}
+		}
+	}
+
+	ttl := time.Duration(a.Config.ReservationTTLSeconds) * time.Second
+	for i := range ipPools.Items {
+		pool := &ipPools.Items[i]
+		if referenced[pool.Name] {
+			continue
+		}
+		switch normalizeLabels(pool.ObjectMeta.Labels)["status"] {
+		case "available":
+			if dangling := danglingOwnerLabels(*pool); len(dangling) > 0 {
+				drifts = append(drifts, Drift{Kind: driftDanglingOwner, Pool: pool.Name, pool: pool,
+					Detail: fmt.Sprintf("available IP pool carries owner labels %s", strings.Join(dangling, ", "))})
+			}
+		case "used":
+			owner, assignedAt := poolOwner(*pool)
+			// Growth marks the pool used before the namespace references it
+			if !assignedAt.IsZero() && time.Since(assignedAt) < ttl {
+				continue
+			}
+			drifts = append(drifts, Drift{Kind: driftUnreferencedPool, Pool: pool.Name, pool: pool,
+				Detail: fmt.Sprintf("IP pool is marked used by namespace %q but no namespace references it", owner)})
+		}
+	}
+	return drifts, nil
+}
+
+func (a *AdmissionController) auditDrift(ctx context.Context) error {
+	drifts, err := a.DetectDrift(ctx)
+	if err != nil {
+		return err
+	}
+	found := map[string]int{}
+	for _, drift := range drifts {
+		found[drift.Kind]++
+		if drift.ns != nil {
+			a.reportDrift(drift.ns, drift.Kind, "%s", drift.Detail)
+		}
+		switch drift.Kind {
+		case driftReferencedNotUsed:
+			if normalizeLabels(drift.pool.ObjectMeta.Labels)["status"] == "available" && a.repairReferencedPool(ctx, *drift.ns, drift.Pool) {
+				driftRepairs.WithLabelValues(driftReferencedNotUsed).Inc()
+			}
+		case driftDanglingOwner:
+			a.Logger.Warn("Drift: available pool carries owner labels",
+				zap.String("poolName", drift.Pool), zap.Strings("labels", danglingOwnerLabels(*drift.pool)))
+			if a.repairDanglingOwner(ctx, *drift.pool) {
+				driftRepairs.WithLabelValues(driftDanglingOwner).Inc()
+			}
+		case driftUnreferencedPool:
+			owner, assignedAt := poolOwner(*drift.pool)
+			a.Logger.Warn("Drift: pool marked used but no namespace references it",
+				zap.String("poolName", drift.Pool), zap.String("owner", owner), zap.Time("assignedAt", assignedAt))
+			if a.repairUnreferencedPool(ctx, *drift.pool) {
+				driftRepairs.WithLabelValues(driftUnreferencedPool).Inc()
+			}
+		}
+	}
+
+	for _, kind := range driftKinds {
+		driftDiscrepancies.WithLabelValues(kind).Set(float64(found[kind]))
+	}
+	return nil
+}
+
+// reportDrift logs a discrepancy of a namespace and posts it as an event.
+func (a *AdmissionController) reportDrift(ns *corev1.Namespace, kind, format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	a.Logger.Warn("Drift detected", zap.String("namespace", ns.Name), zap.String("kind", kind), zap.String("detail", message))
+	a.Recorder.Eventf(ns, corev1.EventTypeWarning, reasonDriftDetected, "Drift (%s): %s", kind, message)
+}
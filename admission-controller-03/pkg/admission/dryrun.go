@@ -0,0 +1,46 @@
+package admission
+
+import (
+	"context"
+	"sync"
+)
+
+type dryRunKey struct{}
+
+// dryRunState remembers the child pools a dry-run request would have created,
+// so the rest of the request can resolve their CIDRs without them existing.
+type dryRunState struct {
+	mu     sync.Mutex
+	carved map[string]string
+}
+
+// withDryRun marks the request as dry-run: it computes the same response but
+// must not write anything to the cluster or notify anyone.
+func withDryRun(ctx context.Context) context.Context {
+	return context.WithValue(ctx, dryRunKey{}, &dryRunState{carved: map[string]string{}})
+}
+
+func isDryRun(ctx context.Context) bool {
+	_, ok := ctx.Value(dryRunKey{}).(*dryRunState)
+	return ok
+}
+
+// recordCarved remembers a child pool a dry-run request would have created.
+func recordCarved(ctx context.Context, poolName, cidr string) {
+	if state, ok := ctx.Value(dryRunKey{}).(*dryRunState); ok {
+		state.mu.Lock()
+		defer state.mu.Unlock()
+		state.carved[poolName] = cidr
+	}
+}
+
+func carvedCIDR(ctx context.Context, poolName string) (string, bool) {
+	state, ok := ctx.Value(dryRunKey{}).(*dryRunState)
+	if !ok {
+		return "", false
+	}
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	cidr, ok := state.carved[poolName]
+	return cidr, ok
+}
@@ -0,0 +1,210 @@
+package admission
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+
+	crdv1 "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// egressRole is the role label value of the pools egress gateway
+	// addresses are reserved from. A /32 pool reserves a single address.
+	egressRole = "egress-gateway"
+	// poolEgressNamespaceLabel and poolEgressAssignedAtLabel record on an
+	// egress pool the namespace holding it and since when. They are apart
+	// from the labels of pod pools, so that nothing treating pod pools ever
+	// mistakes an egress pool for one.
+	poolEgressNamespaceLabel  = "ipam.example.com/egress-namespace"
+	poolEgressAssignedAtLabel = "ipam.example.com/egress-assigned-at"
+	// EgressPoolAnnotation and EgressCIDRAnnotation expose a namespace's
+	// egress pool and its subnet, e.g. to be allowed through firewalls.
+	EgressPoolAnnotation = "ipam.example.com/egress-pool"
+	EgressCIDRAnnotation = "ipam.example.com/egress-cidr"
+	// egressSelectorAnnotation selects the egress gateways a namespace's
+	// traffic leaves through: those labeled with its egress pool, deployed
+	// in the namespace with their addresses drawn from that pool.
+	egressSelectorAnnotation = "egress.projectcalico.org/selector"
+)
+
+// Event reasons of egress pools.
+const (
+	reasonEgressPoolAssigned  = "EgressPoolAssigned"
+	reasonEgressPoolExhausted = "EgressPoolExhausted"
+)
+
+// errEgressPoolLost is returned when an egress pool was taken between
+// selection and assignment.
+var errEgressPoolLost = errors.New("egress pool was taken concurrently")
+
+// RunEgressAssignment periodically reserves an egress pool for every
+// namespace holding a pod pool, and releases the egress pools of namespaces
+// that are gone.
+func (a *AdmissionController) RunEgressAssignment(ctx context.Context, interval time.Duration) {
+	if a.Config.Egress == nil {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := a.assignEgressPools(ctx); err != nil {
+			a.Logger.Error("could not assign egress pools", zap.Error(err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (a *AdmissionController) assignEgressPools(ctx context.Context) error {
+	ipPools, err := a.CalicoReader.ProjectcalicoV3().IPPools().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("could not list IP pools: %v", err)
+	}
+	nsList, err := a.K8sReader.CoreV1().Namespaces().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("could not list namespaces: %v", err)
+	}
+
+	existing := map[string]bool{}
+	for _, ns := range nsList.Items {
+		existing[ns.Name] = true
+	}
+	held := map[string]string{}
+	var pools []crdv1.IPPool
+	for _, pool := range ipPools.Items {
+		poolLabels := normalizeLabels(pool.ObjectMeta.Labels)
+		if poolLabels[masterRoleLabel] != egressRole || poolLabels["location"] != a.Config.Location {
+			continue
+		}
+		owner := poolLabels[poolEgressNamespaceLabel]
+		if owner != "" && !existing[owner] {
+			// Its gateways went with the namespace
+			if err := a.releaseEgressPool(ctx, pool.Name, owner); err != nil {
+				a.Logger.Error("could not release egress pool", zap.String("poolName", pool.Name), zap.String("namespace", owner), zap.Error(err))
+				continue
+			}
+			delete(pool.Labels, poolEgressNamespaceLabel)
+			owner = ""
+		}
+		if owner != "" {
+			held[owner] = pool.Name
+		}
+		pools = append(pools, pool)
+	}
+	sort.Slice(pools, func(i, j int) bool { return pools[i].Name < pools[j].Name })
+
+	for i := range nsList.Items {
+		ns := &nsList.Items[i]
+		if ns.DeletionTimestamp != nil || ns.Annotations[ipv4PoolsAnnotation] == "" || a.Config.IsExempt(ns.Name, ns.Labels) {
+			continue
+		}
+		tenant := ns.Labels[a.Config.TenantLabel]
+		if tenants := a.Config.Egress.Tenants; len(tenants) > 0 && !slices.Contains(tenants, tenant) {
+			continue
+		}
+		if poolName, ok := held[ns.Name]; ok {
+			if ns.Annotations[EgressPoolAnnotation] != poolName {
+				// The namespace update after the last assignment failed
+				if err := a.annotateEgressPool(ctx, ns, pools, poolName); err != nil {
+					a.Logger.Error("could not annotate egress pool", zap.String("namespace", ns.Name), zap.Error(err))
+				}
+			}
+			continue
+		}
+		if err := a.assignEgressPool(ctx, ns, tenant, pools); err != nil {
+			a.Logger.Error("could not assign egress pool", zap.String("namespace", ns.Name), zap.Error(err))
+		}
+	}
+	return nil
+}
+
+// assignEgressPool reserves the first free egress pool the namespace's
+// tenant may use: one labeled with the tenant, or with no tenant at all.
+func (a *AdmissionController) assignEgressPool(ctx context.Context, ns *corev1.Namespace, tenant string, pools []crdv1.IPPool) error {
+	for i := range pools {
+		poolLabels := normalizeLabels(pools[i].ObjectMeta.Labels)
+		if poolLabels[poolEgressNamespaceLabel] != "" || poolCordoned(poolLabels) {
+			continue
+		}
+		if owner := poolLabels[poolTenantLabel]; owner != "" && owner != tenant {
+			continue
+		}
+		err := a.updateIPPool(ctx, pools[i].Name, func(ipPool *crdv1.IPPool) error {
+			if normalizeLabels(ipPool.ObjectMeta.Labels)[poolEgressNamespaceLabel] != "" {
+				return errEgressPoolLost
+			}
+			ipPool.Labels[poolEgressNamespaceLabel] = ns.Name
+			ipPool.Labels[poolEgressAssignedAtLabel] = strconv.FormatInt(time.Now().Unix(), 10)
+			return nil
+		})
+		if errors.Is(err, errEgressPoolLost) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		pools[i].Labels[poolEgressNamespaceLabel] = ns.Name
+		a.Logger.Info("Assigned egress pool", zap.String("namespace", ns.Name), zap.String("poolName", pools[i].Name))
+		return a.annotateEgressPool(ctx, ns, pools, pools[i].Name)
+	}
+	a.Recorder.Eventf(ns, corev1.EventTypeWarning, reasonEgressPoolExhausted, "No egress pool is left for tenant %q", tenant)
+	return nil
+}
+
+// annotateEgressPool records the namespace's egress pool on it and points
+// its egress traffic at the pool's gateways.
+func (a *AdmissionController) annotateEgressPool(ctx context.Context, ns *corev1.Namespace, pools []crdv1.IPPool, poolName string) error {
+	poolCIDR, err := a.poolCIDR(ctx, poolName, pools)
+	if err != nil {
+		return err
+	}
+	annotations := map[string]string{
+		EgressPoolAnnotation:     poolName,
+		EgressCIDRAnnotation:     poolCIDR,
+		egressSelectorAnnotation: fmt.Sprintf("%s == '%s'", EgressPoolAnnotation, poolName),
+	}
+	patch, err := json.Marshal(map[string]interface{}{"metadata": map[string]interface{}{"annotations": annotations}})
+	if err != nil {
+		return fmt.Errorf("could not encode namespace patch: %v", err)
+	}
+	if _, err := a.K8sClientset.CoreV1().Namespaces().Patch(ctx, ns.Name, types.MergePatchType, patch, metav1.PatchOptions{FieldManager: fieldManager}); err != nil {
+		return fmt.Errorf("could not update namespace: %v", err)
+	}
+	a.Recorder.Eventf(ns, corev1.EventTypeNormal, reasonEgressPoolAssigned, "Assigned egress pool %s (%s)", poolName, poolCIDR)
+	return nil
+}
+
+// releaseEgressPool hands the egress pool of a deleted namespace back.
+func (a *AdmissionController) releaseEgressPool(ctx context.Context, poolName, namespace string) error {
+	err := a.updateIPPool(ctx, poolName, func(ipPool *crdv1.IPPool) error {
+		if normalizeLabels(ipPool.ObjectMeta.Labels)[poolEgressNamespaceLabel] != namespace {
+			return errEgressPoolLost
+		}
+		delete(ipPool.Labels, poolEgressNamespaceLabel)
+		delete(ipPool.Labels, poolEgressAssignedAtLabel)
+		return nil
+	})
+	if errors.Is(err, errEgressPoolLost) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	a.Logger.Info("Released egress pool of deleted namespace", zap.String("poolName", poolName), zap.String("namespace", namespace))
+	return nil
+}
@@ -0,0 +1,116 @@
+package admission
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	eventComponent = "ipam-admission-controller"
+	// createdEventTimeout bounds how long an event about a namespace that is
+	// still being admitted waits for the namespace to be committed
+	createdEventTimeout = 30 * time.Second
+	pendingEventsSize   = 1024
+)
+
+// Event reasons posted on namespaces.
+const (
+	reasonPoolAssigned      = "PoolAssigned"
+	reasonPoolReleased      = "PoolReleased"
+	reasonPoolExhausted     = "PoolExhausted"
+	reasonReleaseBlocked    = "ReleaseBlocked"
+	reasonPoolGrown         = "PoolGrown"
+	reasonPoolGrowthBlocked = "PoolGrowthBlocked"
+	reasonDriftDetected     = "DriftDetected"
+)
+
+// newEventRecorder returns a recorder posting events through the given client
+// together with its broadcaster, which must be shut down to stop it.
+func newEventRecorder(client kubernetes.Interface) (record.EventBroadcaster, record.EventRecorder) {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events("")})
+	return broadcaster, broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: eventComponent})
+}
+
+// Shutdown stops posting events.
+func (a *AdmissionController) Shutdown() {
+	if a.broadcaster != nil {
+		a.broadcaster.Shutdown()
+	}
+}
+
+// pendingEvent is an event waiting for its namespace to be committed.
+type pendingEvent struct {
+	namespace string
+	eventType string
+	reason    string
+	message   string
+	deadline  time.Time
+}
+
+// recordEventOnceCreated queues an event on a namespace that is still being
+// admitted. kubectl describe matches events by UID, which the namespace only
+// gets once the API server commits it, so RunEventPoster posts the event when
+// the namespace appears. Namespaces created with generateName have no name yet
+// and get their event from RunPoolBinder instead.
+func (a *AdmissionController) recordEventOnceCreated(name, eventType, reason, messageFmt string, args ...interface{}) {
+	if name == "" {
+		return
+	}
+	event := pendingEvent{
+		namespace: name,
+		eventType: eventType,
+		reason:    reason,
+		message:   fmt.Sprintf(messageFmt, args...),
+		deadline:  time.Now().Add(createdEventTimeout),
+	}
+	select {
+	case a.pendingEvents <- event:
+	default:
+		a.Logger.Warn("Event queue full, dropping event", zap.String("namespace", name), zap.String("reason", reason))
+	}
+}
+
+// RunEventPoster posts queued events once their namespace exists, dropping
+// those whose namespace does not appear in time, e.g. because another
+// webhook denied it.
+func (a *AdmissionController) RunEventPoster(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	var waiting []pendingEvent
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-a.pendingEvents:
+			waiting = append(waiting, event)
+			continue
+		case <-ticker.C:
+		}
+
+		remaining := waiting[:0]
+		for _, event := range waiting {
+			ns, err := a.K8sReader.CoreV1().Namespaces().Get(ctx, event.namespace, metav1.GetOptions{})
+			if err == nil {
+				a.Recorder.Event(ns, event.eventType, event.reason, event.message)
+				continue
+			}
+			if time.Now().After(event.deadline) {
+				a.Logger.Warn("Namespace did not appear, dropping event", zap.String("namespace", event.namespace), zap.String("reason", event.reason))
+				continue
+			}
+			remaining = append(remaining, event)
+		}
+		waiting = remaining
+	}
+}
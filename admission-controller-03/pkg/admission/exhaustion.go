@@ -0,0 +1,83 @@
+package admission
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"go.uber.org/zap"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	reasonPoolsLow       = "AvailablePoolsLow"
+	reasonPoolsRecovered = "AvailablePoolsRecovered"
+)
+
+// RunExhaustionWatch periodically counts the available pools per zone and
+// warns, once per crossing, when a zone drops below its threshold, so more
+// pools can be provisioned before namespace creation starts failing.
+func (a *AdmissionController) RunExhaustionWatch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	low := map[string]bool{}
+	for {
+		if err := a.checkExhaustion(ctx, low); err != nil {
+			a.Logger.Error("could not check pool exhaustion", zap.Error(err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (a *AdmissionController) checkExhaustion(ctx context.Context, low map[string]bool) error {
+	ipPools, err := a.CalicoReader.ProjectcalicoV3().IPPools().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("could not list IP pools: %v", err)
+	}
+
+	available := map[string]int{}
+	// The event is anchored on a real pool of the zone, as zones have no
+	// object of their own
+	anchors := map[string][]string{}
+	for _, pool := range ipPools.Items {
+		poolLabels := normalizeLabels(pool.ObjectMeta.Labels)
+		zone := poolLabels["location"]
+		if poolLabels["status"] == "available" && !poolCordoned(poolLabels) {
+			available[zone]++
+		}
+		anchors[zone] = append(anchors[zone], pool.Name)
+	}
+
+	for zone, names := range anchors {
+		threshold := a.Config.LowPoolThresholdFor(zone)
+		if threshold <= 0 {
+			continue
+		}
+		sort.Strings(names)
+		anchor := &corev1.ObjectReference{APIVersion: "projectcalico.org/v3", Kind: "IPPool", Name: names[0]}
+
+		isLow := available[zone] < threshold
+		switch {
+		case isLow && !low[zone]:
+			a.Logger.Warn("Available pools in zone below threshold",
+				zap.String("zone", zone), zap.Int("available", available[zone]), zap.Int("threshold", threshold))
+			a.Recorder.Eventf(anchor, corev1.EventTypeWarning, reasonPoolsLow,
+				"Zone %s has %d available IP pools, below the threshold of %d", zone, available[zone], threshold)
+		case !isLow && low[zone]:
+			a.Logger.Info("Available pools in zone recovered",
+				zap.String("zone", zone), zap.Int("available", available[zone]), zap.Int("threshold", threshold))
+			a.Recorder.Eventf(anchor, corev1.EventTypeNormal, reasonPoolsRecovered,
+				"Zone %s has %d available IP pools again", zone, available[zone])
+		}
+		low[zone] = isLow
+	}
+	return nil
+}
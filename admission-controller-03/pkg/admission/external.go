@@ -0,0 +1,387 @@
+package admission
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"admission-controller-03/pkg/allocator"
+	"admission-controller-03/pkg/config"
+
+	crdv1 "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+const (
+	// externalOwnerLabel names the consumer outside Kubernetes holding a pool
+	// allocated through the allocation service.
+	externalOwnerLabel = "ipam.example.com/external-owner"
+	// statusExternal marks pools held by external consumers. The binder, GC
+	// and drift audit only look after pools of namespaces and leave them
+	// alone.
+	statusExternal = "external"
+	// grpcShutdownTimeout bounds how long calls in flight may take to finish
+	// on shutdown.
+	grpcShutdownTimeout = 10 * time.Second
+)
+
+// AllocatorServer returns the allocation service, which hands pools to
+// consumers outside Kubernetes with the same selection, tenant policy and
+// locking as namespace admission.
+func (a *AdmissionController) AllocatorServer() allocator.AllocatorServer {
+	return &allocatorServer{a: a}
+}
+
+type allocatorServer struct {
+	allocator.UnimplementedAllocatorServer
+	a *AdmissionController
+}
+
+func (s *allocatorServer) Allocate(ctx context.Context, req *allocator.AllocateRequest) (*allocator.Allocation, error) {
+	a := s.a
+	if err := validConsumer(req.Consumer); err != nil {
+		return nil, err
+	}
+	// Read live, the cache may not have seen an allocation just made
+	held, err := a.externalPools(ctx, req.Consumer)
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "could not list IP pools: %v", err)
+	}
+	if len(held) > 0 {
+		return externalAllocation(&held[0]), nil
+	}
+
+	ipPools, err := a.listPools(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "could not list IP pools: %v", err)
+	}
+	selectors, err := a.tenantSelectors(req.Tenant)
+	if err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "could not resolve pools for tenant %s: %v", req.Tenant, err)
+	}
+	if t, _ := a.tenantPolicy(req.Tenant); t.MaxPools > 0 && a.Config.QuotaMode != config.QuotaModeWarn {
+		if held := countTenantPools(ipPools.Items, req.Tenant); held >= t.MaxPools {
+			return nil, status.Errorf(codes.ResourceExhausted, "tenant %s holds %d of its %d allowed IP pools", req.Tenant, held, t.MaxPools)
+		}
+	}
+
+	owner := map[string]string{
+		externalOwnerLabel:  req.Consumer,
+		poolAssignedAtLabel: strconv.FormatInt(time.Now().Unix(), 10),
+	}
+	if req.Tenant != "" {
+		owner[poolTenantLabel] = req.Tenant
+	}
+	candidates := ipPools.Items
+	for attempt := 1; ; attempt++ {
+		var poolName string
+		if a.Config.Hierarchy != nil && req.Tenant != "" {
+			poolName, err = a.allocateFromHierarchy(ctx, req.Tenant, candidates)
+			if err != nil {
+				return nil, status.Errorf(codes.Internal, "could not allocate from team aggregate: %v", err)
+			}
+		} else {
+			poolName = a.selectAvailableSubnet(candidates, req.Tenant, selectors)
+		}
+		if poolName == "" {
+			return nil, status.Errorf(codes.ResourceExhausted, "no available IP pool for tenant %q", req.Tenant)
+		}
+
+		err = a.takeExternalPool(ctx, poolName, owner)
+		if err == nil {
+			pool, err := a.CalicoReader.ProjectcalicoV3().IPPools().Get(ctx, poolName, metav1.GetOptions{})
+			if err != nil {
+				return nil, status.Errorf(codes.Unavailable, "could not get IP pool: %v", err)
+			}
+			a.Logger.Info("Allocated IP pool to external consumer", zap.String("consumer", req.Consumer),
+				zap.String("poolName", poolName), zap.String("cidr", pool.Spec.CIDR), zap.String("tenant", req.Tenant))
+			return externalAllocation(pool), nil
+		}
+		switch {
+		case !errors.Is(err, errPoolLocked):
+			return nil, status.Errorf(codes.Internal, "could not assign IP pool %s: %v", poolName, err)
+		case attempt == maxAllocationAttempts:
+			return nil, status.Errorf(codes.Aborted, "gave up after %d IP pools were taken by concurrent requests, retry", attempt)
+		}
+		a.Logger.Info("Selected pool is taken by a concurrent request, selecting another", zap.String("poolName", poolName))
+		candidates = withoutPool(candidates, poolName)
+	}
+}
+
+// takeExternalPool locks, confirms and assigns a selected pool.
+func (a *AdmissionController) takeExternalPool(ctx context.Context, poolName string, owner map[string]string) error {
+	lease, err := a.lockPool(ctx, poolName, owner[externalOwnerLabel])
+	if err != nil {
+		return err
+	}
+	defer a.unlockPool(ctx, lease)
+	if err := a.confirmPoolAvailable(ctx, poolName); err != nil {
+		return err
+	}
+	return a.assignPool(ctx, poolName, statusExternal, owner, nil)
+}
+
+func (s *allocatorServer) Release(ctx context.Context, req *allocator.ReleaseRequest) (*allocator.ReleaseResponse, error) {
+	a := s.a
+	if err := validConsumer(req.Consumer); err != nil {
+		return nil, err
+	}
+	held, err := a.externalPools(ctx, req.Consumer)
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "could not list IP pools: %v", err)
+	}
+	if len(held) == 0 {
+		return nil, status.Errorf(codes.NotFound, "consumer %s holds no IP pool", req.Consumer)
+	}
+	pool := held[0]
+	err = a.updateIPPool(ctx, pool.Name, func(ipPool *crdv1.IPPool) error {
+		labels := normalizeLabels(ipPool.ObjectMeta.Labels)
+		if labels["status"] != statusExternal || labels[externalOwnerLabel] != req.Consumer {
+			return errPoolLocked
+		}
+		labels["status"] = "available"
+		for _, key := range ownershipLabels {
+			delete(labels, key)
+		}
+		ipPool.ObjectMeta.Labels = labels
+		return nil
+	})
+	if errors.Is(err, errPoolLocked) {
+		return nil, status.Errorf(codes.Aborted, "IP pool %s changed owner while being released", pool.Name)
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "could not release IP pool %s: %v", pool.Name, err)
+	}
+	a.Logger.Info("Released IP pool of external consumer", zap.String("consumer", req.Consumer), zap.String("poolName", pool.Name))
+	return &allocator.ReleaseResponse{Pool: pool.Name}, nil
+}
+
+func (s *allocatorServer) Query(ctx context.Context, req *allocator.QueryRequest) (*allocator.QueryResponse, error) {
+	ipPools, err := s.a.listPools(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "could not list IP pools: %v", err)
+	}
+	response := &allocator.QueryResponse{}
+	for i := range ipPools.Items {
+		if alloc := externalAllocation(&ipPools.Items[i]); alloc != nil && matchesQuery(alloc, req) {
+			response.Allocations = append(response.Allocations, alloc)
+		}
+	}
+	return response, nil
+}
+
+// ListFree lists the available pools, as the Calico-native backend sees them.
+func (s *allocatorServer) ListFree(ctx context.Context, req *allocator.ListFreeRequest) (*allocator.ListFreeResponse, error) {
+	free, err := (&calicoBackend{a: s.a}).ListFree(ctx, req.Zone)
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "%v", err)
+	}
+	response := &allocator.ListFreeResponse{}
+	for _, subnet := range free {
+		response.Pools = append(response.Pools, &allocator.FreePool{Pool: subnet.Pool, Cidr: subnet.CIDR, Zone: subnet.Zone})
+	}
+	return response, nil
+}
+
+// Watch sends the current allocations, then every change, until the client
+// goes away. The pool watch is re-established, and what was missed meanwhile
+// sent, whenever the API server closes it.
+func (s *allocatorServer) Watch(req *allocator.QueryRequest, stream allocator.Allocator_WatchServer) error {
+	a := s.a
+	ctx := stream.Context()
+	known := map[string]*allocator.Allocation{}
+	for {
+		list, err := a.CalicoReader.ProjectcalicoV3().IPPools().List(ctx, metav1.ListOptions{LabelSelector: externalOwnerLabel})
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return status.Errorf(codes.Unavailable, "could not list IP pools: %v", err)
+		}
+		current := map[string]bool{}
+		for i := range list.Items {
+			current[list.Items[i].Name] = true
+			if err := sendChange(stream, known, list.Items[i].Name, externalAllocation(&list.Items[i]), req); err != nil {
+				return err
+			}
+		}
+		for poolName := range known {
+			if !current[poolName] {
+				if err := sendChange(stream, known, poolName, nil, req); err != nil {
+					return err
+				}
+			}
+		}
+
+		w, err := a.CalicoReader.ProjectcalicoV3().IPPools().Watch(ctx, metav1.ListOptions{LabelSelector: externalOwnerLabel, ResourceVersion: list.ResourceVersion})
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return status.Errorf(codes.Unavailable, "could not watch IP pools: %v", err)
+		}
+		err = func() error {
+			defer w.Stop()
+			for event := range w.ResultChan() {
+				pool, ok := event.Object.(*crdv1.IPPool)
+				if !ok {
+					// An error event, relisted
+					return nil
+				}
+				alloc := externalAllocation(pool)
+				if event.Type == watch.Deleted {
+					alloc = nil
+				}
+				if err := sendChange(stream, known, pool.Name, alloc, req); err != nil {
+					return err
+				}
+			}
+			return nil
+		}()
+		if err != nil || ctx.Err() != nil {
+			return err
+		}
+	}
+}
+
+// sendChange sends the event that takes a pool from its last sent allocation
+// to alloc, nil once released, if any.
+func sendChange(stream allocator.Allocator_WatchServer, known map[string]*allocator.Allocation, poolName string, alloc *allocator.Allocation, req *allocator.QueryRequest) error {
+	if alloc != nil && !matchesQuery(alloc, req) {
+		alloc = nil
+	}
+	prev, sent := known[poolName]
+	switch {
+	case alloc != nil && (!sent || prev.Consumer != alloc.Consumer || prev.Cidr != alloc.Cidr || prev.Tenant != alloc.Tenant):
+		known[poolName] = alloc
+		return stream.Send(&allocator.WatchEvent{Type: allocator.WatchEvent_ALLOCATED, Allocation: alloc})
+	case alloc == nil && sent:
+		delete(known, poolName)
+		return stream.Send(&allocator.WatchEvent{Type: allocator.WatchEvent_RELEASED, Allocation: prev})
+	}
+	return nil
+}
+
+// externalPools lists the pools a consumer holds from the API server.
+func (a *AdmissionController) externalPools(ctx context.Context, consumer string) ([]crdv1.IPPool, error) {
+	list, err := a.CalicoReader.ProjectcalicoV3().IPPools().List(ctx, metav1.ListOptions{LabelSelector: externalOwnerLabel + "=" + consumer})
+	if err != nil {
+		return nil, err
+	}
+	var held []crdv1.IPPool
+	for _, pool := range list.Items {
+		if normalizeLabels(pool.ObjectMeta.Labels)["status"] == statusExternal {
+			held = append(held, pool)
+		}
+	}
+	return held, nil
+}
+
+// externalAllocation returns the allocation of a pool held by an external
+// consumer, or nil.
+func externalAllocation(pool *crdv1.IPPool) *allocator.Allocation {
+	poolLabels := normalizeLabels(pool.ObjectMeta.Labels)
+	consumer := poolLabels[externalOwnerLabel]
+	if consumer == "" || poolLabels["status"] != statusExternal {
+		return nil
+	}
+	alloc := &allocator.Allocation{
+		Consumer: consumer,
+		Pool:     pool.Name,
+		Cidr:     pool.Spec.CIDR,
+		Zone:     poolLabels["location"],
+		Tenant:   poolLabels[poolTenantLabel],
+	}
+	if seconds, err := strconv.ParseInt(poolLabels[poolAssignedAtLabel], 10, 64); err == nil {
+		alloc.AssignedAt = timestamppb.New(time.Unix(seconds, 0))
+	}
+	return alloc
+}
+
+func matchesQuery(alloc *allocator.Allocation, req *allocator.QueryRequest) bool {
+	return (req.Consumer == "" || alloc.Consumer == req.Consumer) && (req.Tenant == "" || alloc.Tenant == req.Tenant)
+}
+
+func validConsumer(consumer string) error {
+	if consumer == "" {
+		return status.Error(codes.InvalidArgument, "consumer is required")
+	}
+	if errs := validation.IsValidLabelValue(consumer); len(errs) > 0 {
+		return status.Errorf(codes.InvalidArgument, "invalid consumer %q: %s", consumer, strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// AuthenticateUnary and AuthenticateStream require the API token as a bearer
+// token in the call's authorization metadata, except for health checks.
+func (a *AdmissionController) AuthenticateUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if isHealthCheck(info.FullMethod) {
+		return handler(ctx, req)
+	}
+	if err := a.authenticateCall(ctx); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (a *AdmissionController) AuthenticateStream(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if isHealthCheck(info.FullMethod) {
+		return handler(srv, stream)
+	}
+	if err := a.authenticateCall(stream.Context()); err != nil {
+		return err
+	}
+	return handler(srv, stream)
+}
+
+func (a *AdmissionController) authenticateCall(ctx context.Context) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, value := range md.Get("authorization") {
+		token, ok := strings.CutPrefix(value, "Bearer ")
+		if ok && a.APIToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(a.APIToken)) == 1 {
+			return nil
+		}
+	}
+	return status.Error(codes.Unauthenticated, "unauthorized")
+}
+
+// ServeGRPC serves the gRPC server on addr until ctx is done, then lets the
+// calls in flight finish.
+func (a *AdmissionController) ServeGRPC(ctx context.Context, server *grpc.Server, addr string) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		a.Logger.Error("could not listen for gRPC", zap.String("addr", addr), zap.Error(err))
+		return
+	}
+	go func() {
+		<-ctx.Done()
+		// Watches only end when their client goes away
+		stopped := make(chan struct{})
+		go func() {
+			server.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-time.After(grpcShutdownTimeout):
+			server.Stop()
+		}
+	}()
+	a.Logger.Info("Serving gRPC allocation service", zap.String("addr", addr))
+	if err := server.Serve(listener); err != nil {
+		a.Logger.Error("gRPC server stopped", zap.Error(err))
+	}
+}
@@ -0,0 +1,46 @@
+package admission
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+
+	"admission-controller-03/pkg/allocator"
+)
+
+func TestAllocatorService(t *testing.T) {
+	a, _, _ := newPoolController(1)
+	listener := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	allocator.RegisterAllocatorServer(server, a.AllocatorServer())
+	go server.Serve(listener)
+	defer server.Stop()
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := allocator.NewAllocatorClient(conn)
+
+	alloc, err := client.Allocate(context.Background(), &allocator.AllocateRequest{Consumer: "vm-provisioner.vm-42"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alloc.Pool != "pool-0" || alloc.Cidr != "10.0.0.0/26" || alloc.AssignedAt == nil {
+		t.Errorf("allocated %v", alloc)
+	}
+	held, err := client.Query(context.Background(), &allocator.QueryRequest{Consumer: "vm-provisioner.vm-42"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(held.Allocations) != 1 || held.Allocations[0].Pool != "pool-0" {
+		t.Errorf("queried %v", held.Allocations)
+	}
+}
@@ -0,0 +1,283 @@
+package admission
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"admission-controller-03/pkg/allocation"
+	"admission-controller-03/pkg/cni"
+	"admission-controller-03/pkg/sink"
+	"admission-controller-03/pkg/version"
+
+	crdv1 "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// deferredAnnotation marks a namespace admitted without a pool because of an
+// internal error; RunDeferredAssignment assigns it one later.
+const deferredAnnotation = "ipam.example.com/assignment-deferred"
+
+// Failure policies, per operation.
+const (
+	FailClosed = "closed"
+	FailOpen   = "open"
+)
+
+// internalReasons are denials caused by the webhook or the API it depends on
+// failing, as opposed to a policy decision. Only these are subject to the
+// failure policy.
+var internalReasons = map[metav1.StatusReason]bool{
+	statusTenantUnresolved:       true,
+	statusPoolListFailed:         true,
+	statusPoolCIDRUnresolved:     true,
+	statusPoolUpdateFailed:       true,
+	statusAggregateAllocFailed:   true,
+	statusBackendAllocFailed:     true,
+	statusInternalError:          true,
+	statusAllocationRecordFailed: true,
+	statusCNIPoolFailed:          true,
+	statusServiceIPAllocFailed:   true,
+	statusPolicyFailed:           true,
+}
+
+// ParseFailurePolicy parses a comma-separated list such as
+// "CREATE=open,DELETE=closed" into the operations that fail open. Operations
+// not listed fail closed.
+func ParseFailurePolicy(s string) (map[admissionv1.Operation]bool, error) {
+	failOpen := map[admissionv1.Operation]bool{}
+	if strings.TrimSpace(s) == "" {
+		return failOpen, nil
+	}
+	for _, entry := range strings.Split(s, ",") {
+		operation, mode, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid failure policy %q: want OPERATION=%s|%s", entry, FailOpen, FailClosed)
+		}
+		switch op := admissionv1.Operation(strings.ToUpper(operation)); op {
+		case admissionv1.Create, admissionv1.Update, admissionv1.Delete, admissionv1.Connect:
+			switch mode {
+			case FailOpen:
+				failOpen[op] = true
+			case FailClosed:
+				failOpen[op] = false
+			default:
+				return nil, fmt.Errorf("invalid failure policy %q for %s: must be %q or %q", mode, op, FailOpen, FailClosed)
+			}
+		default:
+			return nil, fmt.Errorf("invalid failure policy operation %q", operation)
+		}
+	}
+	return failOpen, nil
+}
+
+// deny answers a request with the given denial. An internal error on an
+// operation configured to fail open is admitted with a warning instead;
+// onFailOpen, if set, may amend that response, e.g. to queue the work for
+// later.
+func (a *AdmissionController) deny(w http.ResponseWriter, req *admissionv1.AdmissionRequest, admissionResponse *admissionv1.AdmissionResponse, status *metav1.Status, onFailOpen func(*admissionv1.AdmissionResponse) error) {
+	if internalReasons[status.Reason] && a.FailOpen[req.Operation] {
+		a.Logger.Warn("Internal error, failing open", zap.String("operation", string(req.Operation)),
+			zap.String("name", req.Name), zap.String("reason", string(status.Reason)), zap.String("message", status.Message))
+		warnings := admissionResponse.Warnings
+		addWarning(admissionResponse, "admitted despite an internal error of the IP pool webhook: %s", status.Message)
+		var err error
+		if onFailOpen != nil {
+			err = onFailOpen(admissionResponse)
+		}
+		if err == nil {
+			admissionResponse.Allowed = true
+			admissionResponse.Result = nil
+			a.writeAdmissionResponse(w, admissionResponse)
+			return
+		}
+		a.Logger.Error("could not fail open, denying", zap.Error(err))
+		admissionResponse.Warnings = warnings
+	}
+	admissionResponse.Allowed = false
+	admissionResponse.Result = status
+	a.writeAdmissionResponse(w, admissionResponse)
+}
+
+// deferAssignment returns an onFailOpen hook that admits the namespace with
+// the deferred annotation, so a pool is assigned once the error clears.
+func deferAssignment(req *admissionv1.AdmissionRequest, ns *corev1.Namespace) func(*admissionv1.AdmissionResponse) error {
+	return func(admissionResponse *admissionv1.AdmissionResponse) error {
+		annotations := map[string]string{deferredAnnotation: time.Now().UTC().Format(time.RFC3339)}
+		patchBytes, err := namespacePatch(ns, annotations, nil)
+		if err != nil {
+			return fmt.Errorf("could not marshal patch: %v", err)
+		}
+		if err := verifyPatch(req.Object.Raw, patchBytes, annotations, nil); err != nil {
+			return fmt.Errorf("patch verification failed: %v", err)
+		}
+		pt := admissionv1.PatchTypeJSONPatch
+		admissionResponse.Patch = patchBytes
+		admissionResponse.PatchType = &pt
+		addWarning(admissionResponse, "no IP pool was assigned yet; pods created before one is assigned get addresses from the default pools")
+		return nil
+	}
+}
+
+// RunDeferredAssignment periodically assigns a pool to the namespaces that
+// were admitted without one because creation failed open.
+func (a *AdmissionController) RunDeferredAssignment(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := a.assignDeferred(ctx); err != nil {
+			a.Logger.Error("could not assign deferred namespaces", zap.Error(err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (a *AdmissionController) assignDeferred(ctx context.Context) error {
+	nsList, err := a.K8sReader.CoreV1().Namespaces().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("could not list namespaces: %v", err)
+	}
+	for i := range nsList.Items {
+		ns := &nsList.Items[i]
+		if _, deferred := ns.Annotations[deferredAnnotation]; !deferred || ns.DeletionTimestamp != nil {
+			continue
+		}
+		if ns.Annotations[skipAnnotation] == "true" || a.Config.IsExempt(ns.Name, ns.Labels) {
+			continue
+		}
+		if err := a.assignDeferredNamespace(ctx, ns); err != nil {
+			a.Logger.Error("could not assign pool to deferred namespace", zap.String("namespace", ns.Name), zap.Error(err))
+		}
+	}
+	return nil
+}
+
+// assignDeferredNamespace assigns a pool to a namespace admitted without one.
+func (a *AdmissionController) assignDeferredNamespace(ctx context.Context, ns *corev1.Namespace) error {
+	// Assigned meanwhile, e.g. by an annotation editor
+	if ns.Annotations[ipv4PoolsAnnotation] != "" {
+		delete(ns.Annotations, deferredAnnotation)
+		_, err := a.K8sClientset.CoreV1().Namespaces().Update(ctx, ns, metav1.UpdateOptions{})
+		return err
+	}
+
+	delete(ns.Annotations, deferredAnnotation)
+	poolName, poolCIDR, err := a.assignExistingNamespace(ctx, ns, ns.UID, "deferred/"+ns.Name)
+	if errors.Is(err, errPoolLocked) {
+		// Retried next interval
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	a.Logger.Info("Assigned pool to deferred namespace", zap.String("namespace", ns.Name), zap.String("poolName", poolName))
+	a.Recorder.Eventf(ns, corev1.EventTypeNormal, reasonPoolAssigned, "Assigned IP pool %s (%s), deferred by an earlier internal error", poolName, poolCIDR)
+	return nil
+}
+
+// assignExistingNamespace assigns a pool to a namespace that exists without
+// one and writes the annotations and release finalizer the admission would
+// have written, along with any other change the caller made to ns. The assignment is keyed on uid like
+// one made at admission. It returns errPoolLocked when the selected pool is
+// being assigned concurrently.
+func (a *AdmissionController) assignExistingNamespace(ctx context.Context, ns *corev1.Namespace, uid types.UID, holder string) (string, string, error) {
+	ipPools, err := a.CalicoReader.ProjectcalicoV3().IPPools().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return "", "", fmt.Errorf("could not list IP pools: %v", err)
+	}
+	tenant := ns.Labels[a.Config.TenantLabel]
+	selectors, err := a.tenantSelectors(tenant)
+	if err != nil {
+		return "", "", err
+	}
+	// Warnings have no admission response to go to, they are logged
+	poolName, denied := a.selectPoolForNamespace(ctx, ns, tenant, selectors, ipPools.Items, &admissionv1.AdmissionResponse{})
+	if denied == nil {
+		poolName, denied = a.checkPolicy(ctx, ns, tenant, poolName, false, ipPools.Items)
+	}
+	if denied != nil {
+		return "", "", errors.New(denied.Message)
+	}
+	poolCIDR, err := a.assignNamespacePool(ctx, ns, uid, holder, tenant, poolName, ipPools.Items)
+	return poolName, poolCIDR, err
+}
+
+// assignNamespacePool assigns the selected pool to an existing namespace and
+// writes the namespace's annotations, see assignExistingNamespace. It returns
+// the pool's CIDR.
+func (a *AdmissionController) assignNamespacePool(ctx context.Context, ns *corev1.Namespace, uid types.UID, holder, tenant, poolName string, pools []crdv1.IPPool) (string, error) {
+	lease, err := a.lockPool(ctx, poolName, holder)
+	if err != nil {
+		return "", err
+	}
+	defer a.unlockPool(ctx, lease)
+
+	owner := map[string]string{
+		poolNamespaceLabel:  ns.Name,
+		poolRequestLabel:    string(uid),
+		poolAssignedAtLabel: strconv.FormatInt(time.Now().Unix(), 10),
+	}
+	if tenant != "" {
+		owner[poolTenantLabel] = tenant
+	}
+	poolCIDR, err := a.poolCIDR(ctx, poolName, pools)
+	if err != nil {
+		return "", err
+	}
+	// The namespace exists, there is nothing to confirm
+	if err := a.recordAllocation(ctx, ns, uid, tenant, poolName, poolCIDR, pools, allocation.PhaseBound); err != nil {
+		return "", err
+	}
+	if err := a.assignPool(ctx, poolName, "used", owner, nil); err != nil {
+		a.failAllocation(ctx, ns, uid, fmt.Sprintf("could not assign IP pool %s: %v", poolName, err))
+		return "", err
+	}
+
+	annotation, err := json.Marshal([]string{poolName})
+	if err != nil {
+		return "", fmt.Errorf("could not encode IP pool annotation: %v", err)
+	}
+	if ns.Annotations == nil {
+		ns.Annotations = map[string]string{}
+	}
+	if err := a.applyCNI(ctx, ns.Annotations, []cni.Pool{{Name: poolName, CIDR: poolCIDR}}); err != nil {
+		if releaseErr := a.updateIPPoolLabels(ctx, poolName, "available", nil, ownershipLabels); releaseErr != nil {
+			a.Logger.Error("could not release pool after failed CNI update", zap.String("poolName", poolName), zap.Error(releaseErr))
+		}
+		a.failAllocation(ctx, ns, uid, err.Error())
+		return "", err
+	}
+	ns.Annotations[ipv4PoolsAnnotation] = string(annotation)
+	ns.Annotations[PolicyVersionAnnotation] = a.Config.Hash()
+	ns.Annotations[WebhookVersionAnnotation] = version.Version
+	ns.Annotations[CIDRAnnotation] = poolCIDR
+	ns.Annotations[requestAnnotation] = string(uid)
+	if !hasReleaseFinalizer(ns) {
+		ns.Finalizers = append(ns.Finalizers, releaseFinalizer)
+	}
+	if _, err := a.K8sClientset.CoreV1().Namespaces().Update(ctx, ns, metav1.UpdateOptions{}); err != nil {
+		// Hand the pool back rather than leak it
+		if releaseErr := a.updateIPPoolLabels(ctx, poolName, "available", nil, ownershipLabels); releaseErr != nil {
+			a.Logger.Error("could not release pool after failed namespace update", zap.String("poolName", poolName), zap.Error(releaseErr))
+		}
+		a.failAllocation(ctx, ns, uid, fmt.Sprintf("could not update namespace: %v", err))
+		return "", fmt.Errorf("could not update namespace: %v", err)
+	}
+	a.publishAllocation(sink.EventAssigned, ns.Name, poolName, poolCIDR, tenant)
+	return poolCIDR, nil
+}
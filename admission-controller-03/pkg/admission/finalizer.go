@@ -0,0 +1,270 @@
+package admission
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// releaseFinalizer holds a namespace with assigned pools in Terminating until
+// its pools have been released.
+const releaseFinalizer = "ipam.example.com/release-protection"
+
+// reasonTerminationStuck is posted once on a namespace held by the release
+// finalizer for longer than the stuck threshold.
+const reasonTerminationStuck = "TerminationStuck"
+
+// workloadEndpoints are served by the Calico API server, read-only.
+var workloadEndpoints = schema.GroupVersionResource{Group: "projectcalico.org", Version: "v3", Resource: "workloadendpoints"}
+
+// releaseReconciler releases the pools of terminating namespaces. DELETE
+// admission is best-effort, it is skipped whenever the webhook is down and
+// failurePolicy is Ignore, so a namespace with pools is given a finalizer and
+// only let go once its pools are released. The finalizer is set along with
+// the pool, in the admission patch or the update of an existing namespace;
+// only namespaces assigned before the finalizer existed are given it here.
+//
+// A terminating namespace is first drained: its pools are only released once
+// its workload endpoints are gone, so that the next owner of a pool is never
+// handed addresses still in use. Only then are the pools released and the
+// finalizer removed. See TerminationCollectors for the metrics of both stages.
+type releaseReconciler struct {
+	a *AdmissionController
+	// namespaces is the manager's informer cache
+	namespaces client.Reader
+	// retryAfter is how long a failed release, or a namespace still
+	// draining, waits before it is looked at again
+	retryAfter time.Duration
+	// stuckAfter is how long a namespace may be held before it is reported
+	// as stuck; zero never reports
+	stuckAfter time.Duration
+}
+
+// SetupReleaseController registers the release reconciler with the manager.
+// It is woken by namespace events, so a deletion is not held for longer than
+// its release takes; a failed release is retried after retryAfter.
+func (a *AdmissionController) SetupReleaseController(mgr manager.Manager, retryAfter, stuckAfter time.Duration) error {
+	return builder.ControllerManagedBy(mgr).
+		Named("release").
+		For(&corev1.Namespace{}).
+		Complete(&releaseReconciler{a: a, namespaces: mgr.GetCache(), retryAfter: retryAfter, stuckAfter: stuckAfter})
+}
+
+func (r *releaseReconciler) Reconcile(ctx context.Context, req reconcile.Request) (reconcile.Result, error) {
+	var ns corev1.Namespace
+	if err := r.namespaces.Get(ctx, req.NamespacedName, &ns); err != nil {
+		if apierrors.IsNotFound(err) {
+			terminations.done(req.Name, false)
+		}
+		return reconcile.Result{}, client.IgnoreNotFound(err)
+	}
+	if ns.DeletionTimestamp != nil {
+		if !hasReleaseFinalizer(&ns) {
+			// Removed by hand, or by a previous pass
+			terminations.done(ns.Name, false)
+			return reconcile.Result{}, nil
+		}
+		return r.finalize(ctx, &ns), nil
+	}
+	// Only namespaces the webhook assigned, not hand-annotated ones
+	if ns.Annotations[requestAnnotation] == "" || ns.Annotations[ipv4PoolsAnnotation] == "" || hasReleaseFinalizer(&ns) {
+		return reconcile.Result{}, nil
+	}
+	if err := r.a.addReleaseFinalizer(ctx, ns.Name); err != nil {
+		r.a.Logger.Error("could not add release finalizer", zap.String("namespace", ns.Name), zap.Error(err))
+		return reconcile.Result{RequeueAfter: r.retryAfter}, nil
+	}
+	return reconcile.Result{}, nil
+}
+
+// finalize drains a terminating namespace, then releases its pools and
+// removes the finalizer.
+func (r *releaseReconciler) finalize(ctx context.Context, ns *corev1.Namespace) reconcile.Result {
+	endpoints, err := r.a.namespaceEndpoints(ctx, ns.Name)
+	if err != nil {
+		r.track(ns, terminationDraining)
+		r.a.Logger.Error("could not count workload endpoints of terminating namespace", zap.String("namespace", ns.Name), zap.Error(err))
+		return reconcile.Result{RequeueAfter: r.retryAfter}
+	}
+	if endpoints > 0 {
+		r.track(ns, terminationDraining)
+		r.a.Logger.Info("Waiting for workload endpoints to drain before releasing IP pools", zap.String("namespace", ns.Name), zap.Int("endpoints", endpoints))
+		return reconcile.Result{RequeueAfter: r.retryAfter}
+	}
+
+	r.track(ns, terminationReleasing)
+	if err := r.a.finalizeNamespace(ctx, ns); err != nil {
+		r.a.Logger.Error("could not finalize namespace", zap.String("namespace", ns.Name), zap.Error(err))
+		return reconcile.Result{RequeueAfter: r.retryAfter}
+	}
+	terminations.done(ns.Name, true)
+	return reconcile.Result{}
+}
+
+// track records the stage of a terminating namespace and reports it once it
+// has been held for longer than stuckAfter.
+func (r *releaseReconciler) track(ns *corev1.Namespace, stage string) {
+	held := time.Since(ns.DeletionTimestamp.Time)
+	if !terminations.hold(ns.Name, stage, ns.DeletionTimestamp.Time, r.stuckAfter) {
+		return
+	}
+	r.a.Logger.Warn("Namespace termination is stuck on the release finalizer", zap.String("namespace", ns.Name),
+		zap.String("stage", stage), zap.Duration("held", held))
+	r.a.Recorder.Eventf(ns, corev1.EventTypeWarning, reasonTerminationStuck,
+		"Namespace has been held for %s while %s its IP pools", held.Round(time.Second), stageDescriptions[stage])
+}
+
+var stageDescriptions = map[string]string{
+	terminationDraining:  "waiting for workload endpoints to drain before releasing",
+	terminationReleasing: "releasing",
+}
+
+// namespaceEndpoints counts the workload endpoints left in a namespace. Where
+// the Calico API server does not serve them, or the read identity may not list
+// them, the pods holding an address stand in: each has one endpoint.
+func (a *AdmissionController) namespaceEndpoints(ctx context.Context, namespace string) (int, error) {
+	if a.DynamicReader != nil {
+		list, err := a.DynamicReader.Resource(workloadEndpoints).Namespace(namespace).List(ctx, metav1.ListOptions{})
+		if err == nil {
+			return len(list.Items), nil
+		}
+		if !apierrors.IsNotFound(err) && !apierrors.IsForbidden(err) {
+			return 0, fmt.Errorf("could not list workload endpoints: %v", err)
+		}
+	}
+	pods, err := a.K8sReader.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return 0, fmt.Errorf("could not list pods: %v", err)
+	}
+	endpoints := 0
+	for _, pod := range pods.Items {
+		finished := pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed
+		if pod.Status.PodIP != "" && !pod.Spec.HostNetwork && !finished {
+			endpoints++
+		}
+	}
+	return endpoints, nil
+}
+
+// finalizeNamespace releases the pools of a terminating namespace and then
+// removes the finalizer. The finalizer stays when a release fails, so the
+// release is retried on the next pass.
+func (a *AdmissionController) finalizeNamespace(ctx context.Context, ns *corev1.Namespace) error {
+	var ipPools []string
+	if annotation := ns.Annotations[ipv4PoolsAnnotation]; annotation != "" {
+		if err := json.Unmarshal([]byte(annotation), &ipPools); err != nil {
+			// Nothing can be released, holding the namespace would not help
+			a.Logger.Error("Failed to decode IP pool annotation", zap.String("namespace", ns.Name), zap.String("annotation", annotation), zap.Error(err))
+			ipPools = nil
+		}
+	}
+
+	pending, err := a.unreleasedPools(ctx, ns, ipPools)
+	if err != nil {
+		return err
+	}
+	a.Logger.Info("Releasing IP pools of terminating namespace", zap.String("namespace", ns.Name), zap.Strings("pools", pending))
+	if err := a.releaseNamespacePools(ctx, ns, pending); err != nil {
+		return err
+	}
+	if err := a.deleteNetworkPolicy(ctx, ns.Name); err != nil {
+		return err
+	}
+	return a.removeReleaseFinalizer(ctx, ns.Name)
+}
+
+// unreleasedPools drops the pools an earlier pass already released for this
+// namespace, so that retrying after a failure does not report them as
+// blocked.
+func (a *AdmissionController) unreleasedPools(ctx context.Context, ns *corev1.Namespace, ipPools []string) ([]string, error) {
+	var pending []string
+	for _, poolName := range ipPools {
+		pool, err := a.CalicoReader.ProjectcalicoV3().IPPools().Get(ctx, poolName, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not get IP pool: %v", err)
+		}
+		poolLabels := normalizeLabels(pool.ObjectMeta.Labels)
+		switch poolLabels["status"] {
+		case "available":
+			if poolLabels[poolNamespaceLabel] == "" {
+				continue
+			}
+		case "retained", "deleting":
+			if poolLabels[poolNamespaceLabel] == ns.Name {
+				continue
+			}
+		}
+		pending = append(pending, poolName)
+	}
+	return pending, nil
+}
+
+func (a *AdmissionController) addReleaseFinalizer(ctx context.Context, name string) error {
+	return a.updateNamespaceFinalizers(ctx, name, func(ns *corev1.Namespace) bool {
+		if ns.DeletionTimestamp != nil || hasReleaseFinalizer(ns) {
+			return false
+		}
+		ns.Finalizers = append(ns.Finalizers, releaseFinalizer)
+		return true
+	})
+}
+
+func (a *AdmissionController) removeReleaseFinalizer(ctx context.Context, name string) error {
+	return a.updateNamespaceFinalizers(ctx, name, func(ns *corev1.Namespace) bool {
+		var kept []string
+		for _, finalizer := range ns.Finalizers {
+			if finalizer != releaseFinalizer {
+				kept = append(kept, finalizer)
+			}
+		}
+		if len(kept) == len(ns.Finalizers) {
+			return false
+		}
+		ns.Finalizers = kept
+		return true
+	})
+}
+
+// updateNamespaceFinalizers applies mutate to the current namespace and
+// writes it back if it reports a change, retrying on conflict.
+func (a *AdmissionController) updateNamespaceFinalizers(ctx context.Context, name string, mutate func(*corev1.Namespace) bool) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		ns, err := a.K8sReader.CoreV1().Namespaces().Get(ctx, name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("could not get namespace: %w", err)
+		}
+		if !mutate(ns) {
+			return nil
+		}
+		_, err = a.K8sClientset.CoreV1().Namespaces().Update(ctx, ns, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+func hasReleaseFinalizer(ns *corev1.Namespace) bool {
+	for _, finalizer := range ns.Finalizers {
+		if finalizer == releaseFinalizer {
+			return true
+		}
+	}
+	return false
+}
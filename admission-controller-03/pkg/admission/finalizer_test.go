@@ -0,0 +1,126 @@
+package admission
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	jsonpatch "gopkg.in/evanphx/json-patch.v4"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestAdmissionAddsReleaseFinalizer(t *testing.T) {
+	a, _, _ := newPoolController(1)
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "web", Finalizers: []string{"example.com/other"}}}
+	resp := admit(t, a, "uid-1", admissionv1.Create, ns)
+	if !resp.Allowed || resp.Patch == nil {
+		t.Fatalf("no pool assigned: allowed=%v %v", resp.Allowed, resp.Result)
+	}
+	raw, err := json.Marshal(ns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	patch, err := jsonpatch.DecodePatch(resp.Patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if raw, err = patch.Apply(raw); err != nil {
+		t.Fatal(err)
+	}
+	var patched corev1.Namespace
+	if err := json.Unmarshal(raw, &patched); err != nil {
+		t.Fatal(err)
+	}
+	if !hasReleaseFinalizer(&patched) || len(patched.Finalizers) != 2 {
+		t.Errorf("admitted namespace has finalizers %v", patched.Finalizers)
+	}
+}
+
+func TestAssignExistingNamespaceAddsReleaseFinalizer(t *testing.T) {
+	a, _, k8sClient := newPoolController(1)
+	a.Recorder = &record.FakeRecorder{}
+	ns, err := k8sClient.CoreV1().Namespaces().Create(context.Background(), &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "web", UID: "uid-1"}}, metav1.CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := a.assignExistingNamespace(context.Background(), ns, ns.UID, "deferred/web"); err != nil {
+		t.Fatal(err)
+	}
+	got, err := k8sClient.CoreV1().Namespaces().Get(context.Background(), "web", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hasReleaseFinalizer(got) || got.Annotations[ipv4PoolsAnnotation] == "" {
+		t.Errorf("assigned namespace has finalizers %v, annotations %v", got.Finalizers, got.Annotations)
+	}
+}
+
+func TestFinalizeDrainsBeforeRelease(t *testing.T) {
+	a, calicoClient, k8sClient := newPoolController(1)
+	ctx := context.Background()
+	ns, err := k8sClient.CoreV1().Namespaces().Create(ctx, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "web", UID: "uid-1"}}, metav1.CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := a.assignExistingNamespace(ctx, ns, ns.UID, "deferred/web"); err != nil {
+		t.Fatal(err)
+	}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "web"},
+		Status:     corev1.PodStatus{Phase: corev1.PodRunning, PodIP: "10.0.0.5"},
+	}
+	if _, err := k8sClient.CoreV1().Pods("web").Create(ctx, pod, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if ns, err = k8sClient.CoreV1().Namespaces().Get(ctx, "web", metav1.GetOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	deleted := metav1.Now()
+	ns.DeletionTimestamp = &deleted
+	r := &releaseReconciler{a: a, retryAfter: time.Second}
+
+	poolStatus := func() string {
+		t.Helper()
+		pool, err := calicoClient.ProjectcalicoV3().IPPools().Get(ctx, "pool-0", metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pool.Labels["status"]
+	}
+	finalizerKept := func() bool {
+		t.Helper()
+		got, err := k8sClient.CoreV1().Namespaces().Get(ctx, "web", metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return hasReleaseFinalizer(got)
+	}
+
+	if result := r.finalize(ctx, ns); result.RequeueAfter != r.retryAfter {
+		t.Errorf("namespace with a running pod not requeued: %+v", result)
+	}
+	if status := poolStatus(); status != "used" {
+		t.Errorf("pool released while a pod holds an address: %s", status)
+	}
+	if !finalizerKept() {
+		t.Errorf("finalizer removed while a pod holds an address")
+	}
+
+	if err := k8sClient.CoreV1().Pods("web").Delete(ctx, "app", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if result := r.finalize(ctx, ns); result.RequeueAfter != 0 {
+		t.Errorf("drained namespace requeued: %+v", result)
+	}
+	if status := poolStatus(); status != "available" {
+		t.Errorf("pool of the drained namespace is %s", status)
+	}
+	if finalizerKept() {
+		t.Errorf("finalizer kept on the drained namespace")
+	}
+}
@@ -0,0 +1,180 @@
+package admission
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+
+	"admission-controller-03/pkg/sink"
+
+	crdv1 "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// quarantineReasonAnnotation on a quarantined pool says why it was taken out
+// of circulation. It is left behind when an operator puts the pool back.
+const quarantineReasonAnnotation = "ipam.example.com/quarantine-reason"
+
+// Garbage collector counters.
+var (
+	gcPoolsReclaimed = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ipam_gc_pools_reclaimed_total",
+		Help: "Leaked IP pools released by the garbage collector because their namespace no longer exists.",
+	})
+	gcPoolsQuarantined = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ipam_gc_pools_quarantined_total",
+		Help: "IP pools taken out of circulation by the garbage collector because their state is contradictory.",
+	})
+	gcRunErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ipam_gc_run_errors_total",
+		Help: "Garbage collector passes that failed before checking every pool.",
+	})
+)
+
+// GCCollectors returns the garbage collector counters for registration.
+func GCCollectors() []prometheus.Collector {
+	return []prometheus.Collector{gcPoolsReclaimed, gcPoolsQuarantined, gcRunErrors}
+}
+
+// RunPoolGC periodically frees pools whose owning namespace no longer exists,
+// which the release finalizer and DELETE admission both miss when the namespace
+// was deleted while the webhook was down or before the finalizer was added.
+// Pools whose state contradicts itself are quarantined rather than guessed at.
+// In report-only drift mode nothing is changed, see RunDriftAudit.
+func (a *AdmissionController) RunPoolGC(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := a.collectPools(ctx); err != nil {
+			gcRunErrors.Inc()
+			a.Logger.Error("could not garbage collect IP pools", zap.Error(err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (a *AdmissionController) collectPools(ctx context.Context) error {
+	ipPools, err := a.CalicoReader.ProjectcalicoV3().IPPools().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("could not list IP pools: %v", err)
+	}
+	// Paged like the startup scan, a single list of every namespace is too
+	// large for the API server in big clusters
+	existing := map[string]bool{}
+	referencedBy := map[string][]string{}
+	opts := metav1.ListOptions{Limit: scanPageSize}
+	for {
+		nsList, err := a.K8sReader.CoreV1().Namespaces().List(ctx, opts)
+		if err != nil {
+			return fmt.Errorf("could not list namespaces: %v", err)
+		}
+		for _, ns := range nsList.Items {
+			existing[ns.Name] = true
+			var pools []string
+			if err := json.Unmarshal([]byte(ns.Annotations[ipv4PoolsAnnotation]), &pools); err != nil {
+				continue
+			}
+			for _, pool := range pools {
+				referencedBy[pool] = append(referencedBy[pool], ns.Name)
+			}
+		}
+		if nsList.Continue == "" {
+			break
+		}
+		opts.Continue = nsList.Continue
+	}
+
+	ttl := time.Duration(a.Config.ReservationTTLSeconds) * time.Second
+	for _, pool := range ipPools.Items {
+		poolLabels := normalizeLabels(pool.ObjectMeta.Labels)
+		if status := poolLabels["status"]; status != "used" && status != "pending" {
+			continue
+		}
+		owner, assignedAt := poolOwner(pool)
+		// Reservations and growth in flight have no namespace reference yet
+		if !assignedAt.IsZero() && time.Since(assignedAt) < ttl {
+			continue
+		}
+
+		switch namespaces := referencedBy[pool.Name]; {
+		case len(namespaces) > 1:
+			a.quarantinePool(ctx, pool, fmt.Sprintf("referenced by namespaces %v", namespaces))
+		case len(namespaces) == 1 && owner != "" && namespaces[0] != owner:
+			a.quarantinePool(ctx, pool, fmt.Sprintf("bound to namespace %s but referenced by %s", owner, namespaces[0]))
+		case owner != "" && !existing[owner]:
+			a.reclaimPool(ctx, pool, owner)
+		}
+	}
+	return nil
+}
+
+// reclaimPool releases a pool whose namespace is gone under the cleanup
+// policy, as if its deletion had been admitted.
+func (a *AdmissionController) reclaimPool(ctx context.Context, pool crdv1.IPPool, namespace string) {
+	// The list may be stale, the namespace could have been created since
+	_, err := a.K8sReader.CoreV1().Namespaces().Get(ctx, namespace, metav1.GetOptions{})
+	if err == nil {
+		return
+	}
+	if !apierrors.IsNotFound(err) {
+		a.Logger.Error("could not check namespace of leaked pool", zap.String("poolName", pool.Name), zap.Error(err))
+		return
+	}
+
+	if !a.enforceDrift() {
+		a.Logger.Warn("Leaked IP pool left in place, drift is only reported", zap.String("poolName", pool.Name), zap.String("namespace", namespace))
+		return
+	}
+	if err := a.releasePool(ctx, &pool, namespace); err != nil {
+		a.Logger.Error("could not reclaim leaked IP pool", zap.String("poolName", pool.Name), zap.Error(err))
+		return
+	}
+	gcPoolsReclaimed.Inc()
+	a.Logger.Warn("Reclaimed IP pool of deleted namespace", zap.String("poolName", pool.Name), zap.String("namespace", namespace))
+	a.publishAllocation(sink.EventReleased, namespace, pool.Name, pool.Spec.CIDR, normalizeLabels(pool.ObjectMeta.Labels)[poolTenantLabel])
+}
+
+// quarantinePool takes a pool out of circulation, keeping its labels for an
+// operator to inspect. The pool's addresses keep working.
+func (a *AdmissionController) quarantinePool(ctx context.Context, pool crdv1.IPPool, reason string) {
+	if !a.enforceDrift() {
+		a.Logger.Warn("IP pool with contradictory state left in circulation, drift is only reported", zap.String("poolName", pool.Name), zap.String("reason", reason))
+		return
+	}
+	err := a.updateIPPool(ctx, pool.Name, func(ipPool *crdv1.IPPool) error {
+		labels := normalizeLabels(ipPool.ObjectMeta.Labels)
+		if labels["status"] != "used" && labels["status"] != "pending" {
+			return errDriftResolved
+		}
+		labels["status"] = "quarantined"
+		ipPool.ObjectMeta.Labels = labels
+		if ipPool.Annotations == nil {
+			ipPool.Annotations = map[string]string{}
+		}
+		ipPool.Annotations[quarantineReasonAnnotation] = reason
+		return nil
+	})
+	if errors.Is(err, errDriftResolved) {
+		return
+	}
+	if err != nil {
+		a.Logger.Error("could not quarantine IP pool", zap.String("poolName", pool.Name), zap.Error(err))
+		return
+	}
+	gcPoolsQuarantined.Inc()
+	a.Logger.Warn("Quarantined IP pool with contradictory state", zap.String("poolName", pool.Name), zap.String("reason", reason))
+}
@@ -0,0 +1,59 @@
+package admission
+
+import (
+	"context"
+	"testing"
+
+	"go.uber.org/zap"
+
+	crdv1 "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
+	calicofake "github.com/projectcalico/api/pkg/client/clientset_generated/clientset/fake"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8sruntime "k8s.io/apimachinery/pkg/runtime"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"admission-controller-03/pkg/config"
+)
+
+func TestCollectPoolsPagesNamespaces(t *testing.T) {
+	pool := &crdv1.IPPool{
+		ObjectMeta: metav1.ObjectMeta{Name: "pool-0", Labels: map[string]string{"status": "used", poolNamespaceLabel: "web"}},
+		Spec:       crdv1.IPPoolSpec{CIDR: "10.0.0.0/26"},
+	}
+	// Both namespaces reference the pool, one on each page. The fake client
+	// does not record the continue token, the pages are served in order.
+	pages := []*corev1.NamespaceList{
+		{
+			ListMeta: metav1.ListMeta{Continue: "page-2"},
+			Items:    []corev1.Namespace{{ObjectMeta: metav1.ObjectMeta{Name: "web", Annotations: map[string]string{ipv4PoolsAnnotation: `["pool-0"]`}}}},
+		},
+		{
+			Items: []corev1.Namespace{{ObjectMeta: metav1.ObjectMeta{Name: "api", Annotations: map[string]string{ipv4PoolsAnnotation: `["pool-0"]`}}}},
+		},
+	}
+	k8sClient := k8sfake.NewSimpleClientset()
+	k8sClient.PrependReactor("list", "namespaces", func(k8stesting.Action) (bool, k8sruntime.Object, error) {
+		if len(pages) == 0 {
+			t.Fatal("namespaces listed past the last page")
+		}
+		page := pages[0]
+		pages = pages[1:]
+		return true, page, nil
+	})
+	calicoClient := calicofake.NewSimpleClientset(pool)
+	a := NewAdmissionControllerFromClients(zap.NewNop(), config.Default(), calicoClient, k8sClient)
+	a.Shutdown()
+
+	if err := a.collectPools(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	got, err := calicoClient.ProjectcalicoV3().IPPools().Get(context.Background(), "pool-0", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Labels["status"] != "quarantined" {
+		t.Errorf("pool referenced from two pages has status %s", got.Labels["status"])
+	}
+}
@@ -0,0 +1,170 @@
+package admission
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+
+	"admission-controller-03/pkg/sink"
+
+	crdv1 "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// RunPoolGrowth periodically checks the address utilization of every namespace
+// and assigns it an additional pool once usage crosses the configured
+// threshold, so that tenants do not run out of addresses silently.
+func (a *AdmissionController) RunPoolGrowth(ctx context.Context, interval time.Duration) {
+	if a.Config.Growth == nil {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := a.growPools(ctx); err != nil {
+			a.Logger.Error("could not check pool utilization", zap.Error(err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (a *AdmissionController) growPools(ctx context.Context) error {
+	ipPools, err := a.CalicoReader.ProjectcalicoV3().IPPools().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("could not list IP pools: %v", err)
+	}
+	usage, err := a.poolUtilization(ctx, ipPools.Items)
+	if err != nil {
+		return err
+	}
+
+	// A namespace's utilization is that of all of its pools together
+	perNamespace := map[string]Utilization{}
+	for _, pool := range ipPools.Items {
+		poolLabels := normalizeLabels(pool.ObjectMeta.Labels)
+		owner := poolLabels[poolNamespaceLabel]
+		if poolLabels["status"] != "used" || owner == "" {
+			continue
+		}
+		total := perNamespace[owner]
+		total.Allocated += usage[pool.Name].Allocated
+		total.Capacity += usage[pool.Name].Capacity
+		perNamespace[owner] = total
+	}
+
+	for namespace, u := range perNamespace {
+		if u.Ratio() < a.Config.Growth.Threshold {
+			continue
+		}
+		if err := a.growNamespace(ctx, namespace, u, ipPools.Items); err != nil {
+			a.Logger.Error("could not grow namespace allocation", zap.String("namespace", namespace), zap.Error(err))
+		}
+	}
+	return nil
+}
+
+// growNamespace assigns one more pool to a namespace and appends it to the
+// namespace's ipv4pools annotation.
+func (a *AdmissionController) growNamespace(ctx context.Context, namespace string, u Utilization, pools []crdv1.IPPool) error {
+	ns, err := a.K8sReader.CoreV1().Namespaces().Get(ctx, namespace, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("could not get namespace: %v", err)
+	}
+	var assigned []string
+	if err := json.Unmarshal([]byte(ns.Annotations[ipv4PoolsAnnotation]), &assigned); err != nil {
+		return fmt.Errorf("could not decode IP pool annotation: %v", err)
+	}
+	if maxPools := a.Config.Growth.MaxPoolsPerNamespace; maxPools > 0 && len(assigned) >= maxPools {
+		a.Logger.Warn("Namespace utilization is high but it already holds its maximum pools",
+			zap.String("namespace", namespace), zap.Float64("utilization", u.Ratio()), zap.Int("pools", len(assigned)))
+		return nil
+	}
+
+	tenant := ns.Labels[a.Config.TenantLabel]
+	selectors, err := a.tenantSelectors(tenant)
+	if err != nil {
+		return err
+	}
+	// Quota warnings have no admission response to go to, they are logged
+	poolName, denial := a.selectPoolForNamespace(ctx, ns, tenant, selectors, pools, &admissionv1.AdmissionResponse{})
+	if denial != nil {
+		a.Recorder.Eventf(ns, corev1.EventTypeWarning, reasonPoolGrowthBlocked,
+			"Address utilization is %.0f%% but no additional IP pool could be assigned: %s", u.Ratio()*100, denial.Message)
+		return nil
+	}
+
+	// A concurrent admission has the pool; growth is retried next interval
+	lease, err := a.lockPool(ctx, poolName, "growth/"+namespace)
+	if errors.Is(err, errPoolLocked) {
+		a.Logger.Info("Pool selected for growth is taken by a concurrent request", zap.String("namespace", namespace), zap.String("poolName", poolName))
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer a.unlockPool(ctx, lease)
+
+	owner := map[string]string{
+		poolNamespaceLabel:  namespace,
+		poolAssignedAtLabel: strconv.FormatInt(time.Now().Unix(), 10),
+	}
+	if tenant != "" {
+		owner[poolTenantLabel] = tenant
+	}
+	// The namespace exists, there is nothing to confirm
+	if err := a.assignPool(ctx, poolName, "used", owner, nil); err != nil {
+		return err
+	}
+	poolCIDR, err := a.poolCIDR(ctx, poolName, pools)
+	if err != nil {
+		return err
+	}
+
+	assigned = append(assigned, poolName)
+	annotation, err := json.Marshal(assigned)
+	if err != nil {
+		return fmt.Errorf("could not encode IP pool annotation: %v", err)
+	}
+	cniPools, err := a.cniPools(ctx, assigned, pools)
+	if err == nil {
+		err = a.applyCNI(ctx, ns.Annotations, cniPools)
+	}
+	if err != nil {
+		if releaseErr := a.updateIPPoolLabels(ctx, poolName, "available", nil, ownershipLabels); releaseErr != nil {
+			a.Logger.Error("could not release pool after failed CNI update", zap.String("poolName", poolName), zap.Error(releaseErr))
+		}
+		return err
+	}
+	ns.Annotations[ipv4PoolsAnnotation] = string(annotation)
+	cidrs := poolCIDR
+	if existing := ns.Annotations[CIDRAnnotation]; existing != "" {
+		cidrs = existing + "," + poolCIDR
+	}
+	ns.Annotations[CIDRAnnotation] = cidrs
+	if _, err := a.K8sClientset.CoreV1().Namespaces().Update(ctx, ns, metav1.UpdateOptions{}); err != nil {
+		// Hand the pool back rather than leak it
+		if releaseErr := a.updateIPPoolLabels(ctx, poolName, "available", nil, ownershipLabels); releaseErr != nil {
+			a.Logger.Error("could not release pool after failed namespace update", zap.String("poolName", poolName), zap.Error(releaseErr))
+		}
+		return fmt.Errorf("could not update namespace: %v", err)
+	}
+
+	a.Logger.Info("Grew namespace allocation",
+		zap.String("namespace", namespace), zap.String("poolName", poolName), zap.Float64("utilization", u.Ratio()))
+	a.Recorder.Eventf(ns, corev1.EventTypeNormal, reasonPoolGrown,
+		"Address utilization reached %.0f%%, assigned additional IP pool %s", u.Ratio()*100, poolName)
+	a.publishAllocation(sink.EventAssigned, namespace, poolName, poolCIDR, tenant)
+	return nil
+}
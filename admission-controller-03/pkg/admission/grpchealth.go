@@ -0,0 +1,65 @@
+package admission
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+
+	"admission-controller-03/pkg/allocator"
+)
+
+// grpcHealthInterval is how often the gRPC health status is brought in line
+// with readiness.
+const grpcHealthInterval = 5 * time.Second
+
+// RegisterGRPCHealth registers the grpc.health.v1 service, which load
+// balancers and mesh sidecars probe without a token. It reports the server,
+// "", and the allocation service NOT_SERVING until RunGRPCHealth finds the
+// webhook ready.
+func RegisterGRPCHealth(server *grpc.Server) *health.Server {
+	h := health.NewServer()
+	h.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	h.SetServingStatus(allocator.ServiceName, healthpb.HealthCheckResponse_NOT_SERVING)
+	healthpb.RegisterHealthServer(server, h)
+	return h
+}
+
+// RunGRPCHealth reports SERVING while ReadyCheck, the condition of the HTTP
+// /readyz, passes. Once ctx is done it reports NOT_SERVING for good, so that
+// clients move away while the calls in flight finish.
+func (a *AdmissionController) RunGRPCHealth(ctx context.Context, h *health.Server) {
+	ticker := time.NewTicker(grpcHealthInterval)
+	defer ticker.Stop()
+	serving := false
+	for {
+		err := a.ReadyCheck(nil)
+		if ready := err == nil; ready != serving {
+			status := healthpb.HealthCheckResponse_NOT_SERVING
+			if ready {
+				status = healthpb.HealthCheckResponse_SERVING
+			}
+			a.Logger.Info("gRPC health changed", zap.String("status", status.String()), zap.Error(err))
+			h.SetServingStatus("", status)
+			h.SetServingStatus(allocator.ServiceName, status)
+			serving = ready
+		}
+
+		select {
+		case <-ctx.Done():
+			h.Shutdown()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// isHealthCheck reports whether a call is to the health service, which needs
+// no token.
+func isHealthCheck(fullMethod string) bool {
+	return strings.HasPrefix(fullMethod, "/"+healthpb.Health_ServiceDesc.ServiceName+"/")
+}
@@ -0,0 +1,209 @@
+package admission
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"admission-controller-03/pkg/cidr"
+	"admission-controller-03/pkg/config"
+
+	crdv1 "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	// teamAggregatesAnnotation on the master pool maps tenants to the
+	// aggregate CIDR carved out for them
+	teamAggregatesAnnotation = "ipam.example.com/team-aggregates"
+	// poolTeamLabel marks a child pool as part of a tenant's aggregate
+	poolTeamLabel = "ipam.example.com/team"
+)
+
+// allocateFromHierarchy returns a pool for the tenant: a released child pool of
+// its aggregate if there is one, otherwise a newly created child pool carved
+// from the aggregate. The returned pool is still labeled available.
+func (a *AdmissionController) allocateFromHierarchy(ctx context.Context, tenant string, pools []crdv1.IPPool) (string, error) {
+	var released []crdv1.IPPool
+	for _, pool := range pools {
+		poolLabels := normalizeLabels(pool.ObjectMeta.Labels)
+		if poolLabels[poolTeamLabel] == tenant && poolLabels["status"] == "available" && !poolCordoned(poolLabels) && a.inLocalRegion(pool.Spec.CIDR) {
+			released = append(released, pool)
+		}
+	}
+	if len(released) > 0 {
+		pool := a.rankPools(released)[0]
+		a.Logger.Info("Reusing released child pool of team aggregate", zap.String("tenant", tenant), zap.String("poolName", pool.Name))
+		return pool.Name, nil
+	}
+	name, _, err := a.carveChildPool(ctx, tenant, pools)
+	return name, err
+}
+
+// carveChildPool creates an available child pool carved from the tenant's
+// aggregate, carving the aggregate first if need be, and returns its name and
+// CIDR.
+func (a *AdmissionController) carveChildPool(ctx context.Context, tenant string, pools []crdv1.IPPool) (string, string, error) {
+	aggregate, err := a.teamAggregate(ctx, tenant)
+	if err != nil {
+		return "", "", err
+	}
+
+	used := make([]string, 0, len(pools))
+	for _, pool := range pools {
+		if pool.Name != a.Config.Hierarchy.MasterPool {
+			used = append(used, pool.Spec.CIDR)
+		}
+	}
+	// Another replica may carve the same subnet first; that pool is its to
+	// assign, so carve past it
+	for attempt := 1; ; attempt++ {
+		child, err := cidr.NextFree(aggregate, a.namespacePrefixLength(tenant), used)
+		if err != nil {
+			return "", "", fmt.Errorf("could not carve namespace subnet from aggregate %s: %v", aggregate, err)
+		}
+		name, err := a.createChildPool(ctx, tenant, aggregate, child)
+		if apierrors.IsAlreadyExists(err) && attempt < maxAllocationAttempts {
+			a.Logger.Info("Child pool was carved concurrently, carving the next subnet", zap.String("tenant", tenant), zap.String("cidr", child))
+			used = append(used, child)
+			continue
+		}
+		return name, child, err
+	}
+}
+
+// createChildPool creates an available child pool for the subnet.
+func (a *AdmissionController) createChildPool(ctx context.Context, tenant, aggregate, child string) (string, error) {
+	pool := &crdv1.IPPool{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: childPoolName(tenant, child),
+			Labels: map[string]string{
+				"location":      a.Config.Location,
+				"status":        "available",
+				poolTeamLabel:   tenant,
+				poolParentLabel: a.Config.Hierarchy.MasterPool,
+			},
+		},
+		Spec: crdv1.IPPoolSpec{
+			CIDR:         child,
+			NodeSelector: "all()",
+		},
+	}
+	applyPoolTemplate(&pool.Spec, a.Config.PoolTemplateFor(a.Config.Location))
+	if isDryRun(ctx) {
+		recordCarved(ctx, pool.Name, child)
+		return pool.Name, nil
+	}
+	created, err := a.Clientset.ProjectcalicoV3().IPPools().Create(ctx, pool, metav1.CreateOptions{FieldManager: fieldManager})
+	if apierrors.IsAlreadyExists(err) {
+		return "", err
+	}
+	if err != nil {
+		return "", fmt.Errorf("could not create child IP pool: %v", err)
+	}
+	a.Logger.Info("Created child pool in team aggregate",
+		zap.String("tenant", tenant), zap.String("aggregate", aggregate),
+		zap.String("poolName", created.Name), zap.String("cidr", child))
+	return created.Name, nil
+}
+
+// teamAggregate returns the tenant's aggregate CIDR, carving and recording a
+// new one on the master pool on first use. The update relies on the master
+// pool's resourceVersion, so concurrent carves cannot hand out the same range;
+// the loser of a conflict re-reads the master pool, where it may find the
+// tenant's aggregate already carved by the winner.
+func (a *AdmissionController) teamAggregate(ctx context.Context, tenant string) (string, error) {
+	var aggregate string
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		var err error
+		aggregate, err = a.carveTeamAggregate(ctx, tenant)
+		return err
+	})
+	return aggregate, err
+}
+
+func (a *AdmissionController) carveTeamAggregate(ctx context.Context, tenant string) (string, error) {
+	master, err := a.Clientset.ProjectcalicoV3().IPPools().Get(ctx, a.Config.Hierarchy.MasterPool, metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("could not get master IP pool: %v", err)
+	}
+
+	aggregates := map[string]string{}
+	if raw := master.Annotations[teamAggregatesAnnotation]; raw != "" {
+		if err := json.Unmarshal([]byte(raw), &aggregates); err != nil {
+			return "", fmt.Errorf("could not decode team aggregates on master pool: %v", err)
+		}
+	}
+	if aggregate, ok := aggregates[tenant]; ok {
+		return aggregate, nil
+	}
+
+	taken := make([]string, 0, len(aggregates))
+	for _, aggregate := range aggregates {
+		taken = append(taken, aggregate)
+	}
+	parent := a.regionCarveParent(master.Spec.CIDR)
+	aggregate, err := cidr.NextFree(parent, a.Config.Hierarchy.TeamPrefixLength, taken)
+	if err != nil {
+		return "", fmt.Errorf("could not carve team aggregate from %s: %v", parent, err)
+	}
+	aggregates[tenant] = aggregate
+
+	raw, err := json.Marshal(aggregates)
+	if err != nil {
+		return "", fmt.Errorf("could not encode team aggregates: %v", err)
+	}
+	updated := master.DeepCopy()
+	if updated.Annotations == nil {
+		updated.Annotations = map[string]string{}
+	}
+	updated.Annotations[teamAggregatesAnnotation] = string(raw)
+	if isDryRun(ctx) {
+		return aggregate, nil
+	}
+	if err := a.patchIPPool(ctx, master, updated); err != nil {
+		if apierrors.IsConflict(err) {
+			return "", err
+		}
+		return "", fmt.Errorf("could not record team aggregate on master pool: %v", err)
+	}
+	a.Logger.Info("Carved team aggregate from master pool", zap.String("tenant", tenant), zap.String("aggregate", aggregate))
+	return aggregate, nil
+}
+
+// childPoolName builds a DNS-1123 pool name such as team-a-10-12-0-64-26.
+func childPoolName(tenant, subnet string) string {
+	replacer := strings.NewReplacer(".", "-", "/", "-", "_", "-")
+	return strings.ToLower(replacer.Replace(tenant + "-" + subnet))
+}
+
+// carvedFromHierarchy reports whether a pool is a child pool carved from the
+// hierarchy's master, even one whose team label was removed by hand.
+func (a *AdmissionController) carvedFromHierarchy(poolLabels map[string]string) bool {
+	return a.Config.Hierarchy != nil && poolLabels[poolParentLabel] == a.Config.Hierarchy.MasterPool
+}
+
+// applyPoolTemplate copies the configured spec fields onto a pool that is about
+// to be created; unset template fields keep Calico's defaults.
+func applyPoolTemplate(spec *crdv1.IPPoolSpec, t config.PoolTemplate) {
+	spec.IPIPMode = crdv1.IPIPMode(t.IPIPMode)
+	spec.VXLANMode = crdv1.VXLANMode(t.VXLANMode)
+	if t.NATOutgoing != nil {
+		spec.NATOutgoing = *t.NATOutgoing
+	}
+	spec.BlockSize = t.BlockSize
+	if t.NodeSelector != "" {
+		spec.NodeSelector = t.NodeSelector
+	}
+	if t.DisableBGPExport != nil {
+		spec.DisableBGPExport = *t.DisableBGPExport
+	}
+	for _, use := range t.AllowedUses {
+		spec.AllowedUses = append(spec.AllowedUses, crdv1.IPPoolAllowedUse(use))
+	}
+}
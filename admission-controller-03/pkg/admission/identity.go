@@ -0,0 +1,257 @@
+package admission
+
+import (
+	"context"
+	"fmt"
+
+	"go.uber.org/zap"
+
+	"admission-controller-03/pkg/config"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+type permission struct {
+	verb     string
+	group    string
+	resource string
+}
+
+func (p permission) String() string {
+	if p.group == "" {
+		return p.verb + " " + p.resource
+	}
+	return p.verb + " " + p.resource + "." + p.group
+}
+
+var (
+	readPermissions = []permission{
+		{"list", "projectcalico.org", "ippools"},
+		{"get", "projectcalico.org", "ippools"},
+		{"list", "", "namespaces"},
+		{"get", "", "namespaces"},
+		{"list", "crd.projectcalico.org", "ipamblocks"},
+	}
+	writePermissions = []permission{
+		{"get", "projectcalico.org", "ippools"},
+		{"patch", "projectcalico.org", "ippools"},
+		{"create", "projectcalico.org", "ippools"},
+		{"delete", "projectcalico.org", "ippools"},
+		{"create", "", "events"},
+		{"patch", "", "events"},
+		{"update", "", "namespaces"},
+	}
+	// leasePermissions are checked in the lease namespace only, so a
+	// namespaced Role is enough.
+	leasePermissions = []permission{
+		{"create", "coordination.k8s.io", "leases"},
+		{"get", "coordination.k8s.io", "leases"},
+		{"update", "coordination.k8s.io", "leases"},
+		{"delete", "coordination.k8s.io", "leases"},
+	}
+	// allocationPermissions are checked only when assignments are recorded
+	// as IPPoolAllocations; the read identity lists them.
+	allocationPermissions = []permission{
+		{"create", "ipam.example.com", "ippoolallocations"},
+		{"update", "ipam.example.com", "ippoolallocations"},
+		{"delete", "ipam.example.com", "ippoolallocations"},
+	}
+	// claimPermissions are checked only in the claim assignment mode; the
+	// read identity lists the claims.
+	claimPermissions = []permission{
+		{"create", "ipam.example.com", "poolclaims"},
+		{"update", "ipam.example.com", "poolclaims"},
+		{"delete", "ipam.example.com", "poolclaims"},
+	}
+	// forbiddenReadPermissions must be denied to the read identity, otherwise
+	// a compromised read path could relabel pools.
+	forbiddenReadPermissions = []permission{
+		{"update", "projectcalico.org", "ippools"},
+		{"patch", "projectcalico.org", "ippools"},
+		{"create", "projectcalico.org", "ippools"},
+		{"delete", "projectcalico.org", "ippools"},
+	}
+)
+
+// VerifyIdentities checks with SelfSubjectAccessReviews that the read identity
+// can do everything the list/get paths need and nothing more, and that the
+// write identity can perform the pool mutations.
+func (a *AdmissionController) VerifyIdentities(ctx context.Context) error {
+	for _, p := range readPermissions {
+		if allowed, err := canI(ctx, a.K8sReader, p); err != nil {
+			return err
+		} else if !allowed {
+			return fmt.Errorf("read identity is missing permission to %s", p)
+		}
+	}
+	for _, p := range writePermissions {
+		if allowed, err := canI(ctx, a.K8sClientset, p); err != nil {
+			return err
+		} else if !allowed {
+			return fmt.Errorf("write identity is missing permission to %s", p)
+		}
+	}
+	if a.LeaseNamespace != "" {
+		for _, p := range leasePermissions {
+			if allowed, err := canIIn(ctx, a.K8sClientset, p, a.LeaseNamespace); err != nil {
+				return err
+			} else if !allowed {
+				return fmt.Errorf("write identity is missing permission to %s in namespace %s", p, a.LeaseNamespace)
+			}
+		}
+	}
+	if a.RecordAllocations {
+		if allowed, err := canI(ctx, a.K8sReader, permission{"list", "ipam.example.com", "ippoolallocations"}); err != nil {
+			return err
+		} else if !allowed {
+			return fmt.Errorf("read identity is missing permission to list ippoolallocations.ipam.example.com")
+		}
+		for _, p := range allocationPermissions {
+			if allowed, err := canI(ctx, a.K8sClientset, p); err != nil {
+				return err
+			} else if !allowed {
+				return fmt.Errorf("write identity is missing permission to %s", p)
+			}
+		}
+	}
+	if a.claimsPools() {
+		if allowed, err := canI(ctx, a.K8sReader, permission{"list", "ipam.example.com", "poolclaims"}); err != nil {
+			return err
+		} else if !allowed {
+			return fmt.Errorf("read identity is missing permission to list poolclaims.ipam.example.com")
+		}
+		for _, p := range claimPermissions {
+			if allowed, err := canI(ctx, a.K8sClientset, p); err != nil {
+				return err
+			} else if !allowed {
+				return fmt.Errorf("write identity is missing permission to %s", p)
+			}
+		}
+	}
+	if t := a.Config.NetworkPolicy; t != nil {
+		resource := "networkpolicies"
+		if t.Scope == config.NetworkPolicyGlobal {
+			resource = "globalnetworkpolicies"
+		}
+		if allowed, err := canI(ctx, a.K8sReader, permission{"watch", "projectcalico.org", resource}); err != nil {
+			return err
+		} else if !allowed {
+			return fmt.Errorf("read identity is missing permission to watch %s.projectcalico.org", resource)
+		}
+		for _, verb := range []string{"create", "update", "delete"} {
+			p := permission{verb, "projectcalico.org", resource}
+			if allowed, err := canI(ctx, a.K8sClientset, p); err != nil {
+				return err
+			} else if !allowed {
+				return fmt.Errorf("write identity is missing permission to %s", p)
+			}
+		}
+	}
+	if a.Config.BGP != nil {
+		for _, resource := range []string{"bgpconfigurations", "bgppeers"} {
+			if allowed, err := canI(ctx, a.K8sReader, permission{"watch", "projectcalico.org", resource}); err != nil {
+				return err
+			} else if !allowed {
+				return fmt.Errorf("read identity is missing permission to watch %s.projectcalico.org", resource)
+			}
+			for _, verb := range []string{"create", "update", "delete"} {
+				p := permission{verb, "projectcalico.org", resource}
+				if allowed, err := canI(ctx, a.K8sClientset, p); err != nil {
+					return err
+				} else if !allowed {
+					return fmt.Errorf("write identity is missing permission to %s", p)
+				}
+			}
+		}
+	}
+	// Reservations are kept for every assigned pool with reserved ranges.
+	// Required when the config file reserves ranges; otherwise only Tenant
+	// resources may, and without the permissions their ranges are not kept
+	if err := a.verifyReservationPermissions(ctx); err != nil {
+		if a.Config.DeclaresReservations() {
+			return err
+		}
+		a.Logger.Warn("IP reservations are not kept, ranges reserved by Tenant resources are ignored", zap.Error(err))
+		a.skipReservations = true
+	}
+	// Termination waits for workload endpoints to drain, counting pods where
+	// the endpoints cannot be listed
+	if allowed, err := canI(ctx, a.K8sReader, permission{"list", "projectcalico.org", "workloadendpoints"}); err == nil && !allowed {
+		a.Logger.Warn("Read identity cannot list workloadendpoints.projectcalico.org, pods are counted while namespaces drain")
+		if allowed, err := canI(ctx, a.K8sReader, permission{"list", "", "pods"}); err != nil {
+			return err
+		} else if !allowed {
+			return fmt.Errorf("read identity is missing permission to list pods")
+		}
+	}
+	// Optional: without it only the config file's tenants apply
+	if allowed, err := canI(ctx, a.K8sReader, permission{"list", "ipam.example.com", "tenants"}); err == nil && !allowed {
+		a.Logger.Warn("Read identity cannot list tenants.ipam.example.com, Tenant resources are ignored")
+	}
+	for _, p := range forbiddenReadPermissions {
+		allowed, err := canI(ctx, a.K8sReader, p)
+		if err != nil {
+			return err
+		}
+		if allowed {
+			a.Logger.Warn("Read identity holds a write permission, least privilege is not enforced", zap.String("permission", p.String()))
+		}
+	}
+	a.Logger.Info("Verified read and write identity permissions")
+
+	// Our own namespace updates must pass the protected annotation check
+	review, err := a.K8sClientset.AuthenticationV1().SelfSubjectReviews().Create(ctx, &authenticationv1.SelfSubjectReview{}, metav1.CreateOptions{})
+	if err != nil {
+		a.Logger.Warn("could not resolve write identity, add it to annotationEditors so pool growth can update namespaces", zap.Error(err))
+		return nil
+	}
+	a.WriteUser = review.Status.UserInfo.Username
+	return nil
+}
+
+func (a *AdmissionController) verifyReservationPermissions(ctx context.Context) error {
+	for _, verb := range []string{"list", "watch"} {
+		p := permission{verb, "projectcalico.org", "ipreservations"}
+		if allowed, err := canI(ctx, a.K8sReader, p); err != nil {
+			return err
+		} else if !allowed {
+			return fmt.Errorf("read identity is missing permission to %s", p)
+		}
+	}
+	for _, verb := range []string{"create", "update", "delete"} {
+		p := permission{verb, "projectcalico.org", "ipreservations"}
+		if allowed, err := canI(ctx, a.K8sClientset, p); err != nil {
+			return err
+		} else if !allowed {
+			return fmt.Errorf("write identity is missing permission to %s", p)
+		}
+	}
+	return nil
+}
+
+func canI(ctx context.Context, client kubernetes.Interface, p permission) (bool, error) {
+	return canIIn(ctx, client, p, "")
+}
+
+// canIIn reviews a permission within a namespace, or cluster-wide when
+// namespace is empty.
+func canIIn(ctx context.Context, client kubernetes.Interface, p permission, namespace string) (bool, error) {
+	review := &authorizationv1.SelfSubjectAccessReview{
+		Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Namespace: namespace,
+				Verb:      p.verb,
+				Group:     p.group,
+				Resource:  p.resource,
+			},
+		},
+	}
+	result, err := client.AuthorizationV1().SelfSubjectAccessReviews().Create(ctx, review, metav1.CreateOptions{})
+	if err != nil {
+		return false, fmt.Errorf("could not review permission to %s: %v", p, err)
+	}
+	return result.Status.Allowed, nil
+}
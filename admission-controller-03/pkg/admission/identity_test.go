@@ -0,0 +1,50 @@
+package admission
+
+import (
+	"context"
+	"testing"
+
+	"go.uber.org/zap"
+
+	calicofake "github.com/projectcalico/api/pkg/client/clientset_generated/clientset/fake"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	k8sruntime "k8s.io/apimachinery/pkg/runtime"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"admission-controller-03/pkg/config"
+)
+
+func TestVerifyIdentitiesReservations(t *testing.T) {
+	tests := []struct {
+		name         string
+		reservations []config.ReservedRange
+		wantErr      bool
+	}{
+		{name: "no ranges reserved"},
+		{name: "ranges reserved", reservations: []config.ReservedRange{{Position: config.ReservedFirst, PrefixLength: 30}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Every permission is granted but those on IP reservations
+			k8sClient := k8sfake.NewSimpleClientset()
+			k8sClient.PrependReactor("create", "selfsubjectaccessreviews", func(action k8stesting.Action) (bool, k8sruntime.Object, error) {
+				review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SelfSubjectAccessReview)
+				review.Status.Allowed = review.Spec.ResourceAttributes.Resource != "ipreservations"
+				return true, review, nil
+			})
+			cfg := config.Default()
+			cfg.Reservations = tt.reservations
+			a := NewAdmissionControllerFromClients(zap.NewNop(), cfg, calicofake.NewSimpleClientset(), k8sClient)
+			a.Shutdown()
+
+			err := a.VerifyIdentities(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("VerifyIdentities() = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !a.skipReservations {
+				t.Error("reservations are kept without the permissions")
+			}
+		})
+	}
+}
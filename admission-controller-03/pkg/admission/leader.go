@@ -0,0 +1,63 @@
+package admission
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+const (
+	// leaderLeaseName is the Lease, in LeaseNamespace, held by the replica
+	// running the background loops.
+	leaderLeaseName = "ipam-webhook-leader"
+
+	leaderLeaseDuration = 15 * time.Second
+	leaderRenewDeadline = 10 * time.Second
+	leaderRetryPeriod   = 2 * time.Second
+)
+
+var isLeader = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "ipam_leader",
+	Help: "1 while this replica holds the leader lease and runs the background loops.",
+})
+
+// LeaderCollectors returns the leader election gauge for registration.
+func LeaderCollectors() []prometheus.Collector {
+	return []prometheus.Collector{isLeader}
+}
+
+// leaderGauge is a leader-only runnable that keeps isLeader up to date. The
+// manager exits when leadership is lost, so the gauge only ever drops on
+// shutdown.
+type leaderGauge struct {
+	logger *zap.Logger
+}
+
+func (g leaderGauge) Start(ctx context.Context) error {
+	g.logger.Info("Became leader, starting background loops")
+	isLeader.Set(1)
+	<-ctx.Done()
+	isLeader.Set(0)
+	return nil
+}
+
+func (leaderGauge) NeedLeaderElection() bool {
+	return true
+}
+
+// leading reports whether this replica holds the leader lease, or runs
+// without leader election and has started. A controller that is not run by a
+// manager is alone and leads.
+func (a *AdmissionController) leading() bool {
+	if a.elected == nil {
+		return true
+	}
+	select {
+	case <-a.elected:
+		return true
+	default:
+		return false
+	}
+}
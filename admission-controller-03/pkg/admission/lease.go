@@ -0,0 +1,145 @@
+package admission
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+
+	crdv1 "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// allocationLeaseSeconds bounds how long a crashed webhook can keep a
+	// pool locked; an assignment takes well under a second.
+	allocationLeaseSeconds = 30
+	// maxAllocationAttempts caps how many pools one request tries before
+	// giving up on contention.
+	maxAllocationAttempts = 5
+	// ServiceAccountNamespaceFile holds the namespace of the pod's own
+	// service account, the default home of the allocation leases.
+	ServiceAccountNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+)
+
+// errPoolLocked means another request holds the pool's allocation lease, or
+// took the pool between selection and locking.
+var errPoolLocked = errors.New("pool is being assigned by another request")
+
+// allocationLeaseName is deterministic, so two requests locking the same pool
+// race on creating the same object and exactly one of them wins.
+func allocationLeaseName(poolName string) string {
+	return "ipam-pool-" + poolName
+}
+
+// lockPool serializes assignments of a pool across requests and replicas with
+// a coordination Lease named after the pool. Once locked it re-reads the pool
+// and only keeps the lock if the pool is still available, or already claimed
+// by holder. It returns errPoolLocked when the pool is taken. Without a lease
+// namespace, or for a dry run, locking is skipped and it returns a nil lease.
+func (a *AdmissionController) lockPool(ctx context.Context, poolName, holder string) (*coordinationv1.Lease, error) {
+	if a.LeaseNamespace == "" || isDryRun(ctx) {
+		return nil, nil
+	}
+	lease, err := a.acquireAllocationLease(ctx, poolName, holder)
+	if err != nil {
+		return nil, err
+	}
+
+	pool, err := a.Clientset.ProjectcalicoV3().IPPools().Get(ctx, poolName, metav1.GetOptions{})
+	if err != nil {
+		a.unlockPool(ctx, lease)
+		return nil, fmt.Errorf("could not get IP pool: %v", err)
+	}
+	poolLabels := normalizeLabels(pool.ObjectMeta.Labels)
+	if poolLabels["status"] != "available" && poolLabels[poolRequestLabel] != holder {
+		a.unlockPool(ctx, lease)
+		allocationsLost.Inc()
+		return nil, errPoolLocked
+	}
+	return lease, nil
+}
+
+func (a *AdmissionController) acquireAllocationLease(ctx context.Context, poolName, holder string) (*coordinationv1.Lease, error) {
+	leases := a.K8sClientset.CoordinationV1().Leases(a.LeaseNamespace)
+	now := metav1.NewMicroTime(time.Now())
+	duration := int32(allocationLeaseSeconds)
+	spec := coordinationv1.LeaseSpec{
+		HolderIdentity:       &holder,
+		LeaseDurationSeconds: &duration,
+		AcquireTime:          &now,
+		RenewTime:            &now,
+	}
+
+	lease, err := leases.Create(ctx, &coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{Name: allocationLeaseName(poolName), Namespace: a.LeaseNamespace},
+		Spec:       spec,
+	}, metav1.CreateOptions{})
+	if err == nil {
+		return lease, nil
+	}
+	if !apierrors.IsAlreadyExists(err) {
+		return nil, fmt.Errorf("could not create allocation lease: %v", err)
+	}
+
+	existing, err := leases.Get(ctx, allocationLeaseName(poolName), metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("could not get allocation lease: %v", err)
+	}
+	// A retry of the same request resumes its own lock
+	if existing.Spec.HolderIdentity != nil && *existing.Spec.HolderIdentity == holder {
+		return existing, nil
+	}
+	if !leaseExpired(existing, now.Time) {
+		return nil, errPoolLocked
+	}
+
+	// The holder crashed or never released it; take it over. A concurrent
+	// takeover makes this update conflict, and the other request wins.
+	a.Logger.Warn("Taking over expired allocation lease", zap.String("poolName", poolName), zap.Stringp("holder", existing.Spec.HolderIdentity))
+	existing.Spec = spec
+	lease, err = leases.Update(ctx, existing, metav1.UpdateOptions{})
+	if apierrors.IsConflict(err) {
+		return nil, errPoolLocked
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not take over allocation lease: %v", err)
+	}
+	return lease, nil
+}
+
+func leaseExpired(lease *coordinationv1.Lease, now time.Time) bool {
+	if lease.Spec.RenewTime == nil || lease.Spec.LeaseDurationSeconds == nil {
+		return true
+	}
+	return now.After(lease.Spec.RenewTime.Add(time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second))
+}
+
+// unlockPool deletes the lease, unless it was taken over in the meantime.
+// Failures are only logged: the lease expires on its own.
+func (a *AdmissionController) unlockPool(ctx context.Context, lease *coordinationv1.Lease) {
+	if lease == nil {
+		return
+	}
+	err := a.K8sClientset.CoordinationV1().Leases(lease.Namespace).Delete(context.WithoutCancel(ctx), lease.Name, metav1.DeleteOptions{
+		Preconditions: &metav1.Preconditions{UID: &lease.UID, ResourceVersion: &lease.ResourceVersion},
+	})
+	if err != nil && !apierrors.IsNotFound(err) && !apierrors.IsConflict(err) {
+		a.Logger.Warn("could not release allocation lease", zap.String("lease", lease.Name), zap.Error(err))
+	}
+}
+
+// withoutPool returns the pools other than poolName.
+func withoutPool(pools []crdv1.IPPool, poolName string) []crdv1.IPPool {
+	remaining := make([]crdv1.IPPool, 0, len(pools))
+	for _, pool := range pools {
+		if pool.Name != poolName {
+			remaining = append(remaining, pool)
+		}
+	}
+	return remaining
+}
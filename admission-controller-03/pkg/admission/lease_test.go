@@ -0,0 +1,162 @@
+package admission
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8sruntime "k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+const leaseNamespace = "ipam-system"
+
+// allocationLease returns the lease of pool-0 held by holder, renewed age
+// ago.
+func allocationLease(holder string, age time.Duration) *coordinationv1.Lease {
+	renewed := metav1.NewMicroTime(time.Now().Add(-age))
+	duration := int32(allocationLeaseSeconds)
+	return &coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{Name: allocationLeaseName("pool-0"), Namespace: leaseNamespace, ResourceVersion: "1"},
+		Spec: coordinationv1.LeaseSpec{
+			HolderIdentity:       &holder,
+			LeaseDurationSeconds: &duration,
+			AcquireTime:          &renewed,
+			RenewTime:            &renewed,
+		},
+	}
+}
+
+func leaseHolder(t *testing.T, k8sClient *k8sfake.Clientset) string {
+	t.Helper()
+	lease, err := k8sClient.CoordinationV1().Leases(leaseNamespace).Get(context.Background(), allocationLeaseName("pool-0"), metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return ""
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *lease.Spec.HolderIdentity
+}
+
+func TestAcquireAllocationLease(t *testing.T) {
+	conflict := func(k8stesting.Action) (bool, k8sruntime.Object, error) {
+		return true, nil, apierrors.NewConflict(schema.GroupResource{Group: "coordination.k8s.io", Resource: "leases"}, allocationLeaseName("pool-0"), errors.New("modified"))
+	}
+	tests := []struct {
+		name     string
+		existing *coordinationv1.Lease
+		// onUpdate, when set, answers the takeover update
+		onUpdate   k8stesting.ReactionFunc
+		wantErr    error
+		wantHolder string
+	}{
+		{name: "unlocked", wantHolder: "uid-me"},
+		{name: "resumed by the same holder", existing: allocationLease("uid-me", time.Second), wantHolder: "uid-me"},
+		{name: "held by another request", existing: allocationLease("uid-other", time.Second), wantErr: errPoolLocked, wantHolder: "uid-other"},
+		{name: "expired", existing: allocationLease("uid-other", time.Minute), wantHolder: "uid-me"},
+		{name: "expired, taken over concurrently", existing: allocationLease("uid-other", time.Minute), onUpdate: conflict, wantErr: errPoolLocked, wantHolder: "uid-other"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, _, k8sClient := newPoolController(1)
+			if tt.existing != nil {
+				if err := k8sClient.Tracker().Add(tt.existing); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.onUpdate != nil {
+				k8sClient.PrependReactor("update", "leases", tt.onUpdate)
+			}
+
+			lease, err := a.acquireAllocationLease(context.Background(), "pool-0", "uid-me")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("acquireAllocationLease() = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && *lease.Spec.HolderIdentity != "uid-me" {
+				t.Errorf("returned a lease held by %s", *lease.Spec.HolderIdentity)
+			}
+			if holder := leaseHolder(t, k8sClient); holder != tt.wantHolder {
+				t.Errorf("lease held by %q, want %q", holder, tt.wantHolder)
+			}
+		})
+	}
+}
+
+func TestLockPoolRechecksPool(t *testing.T) {
+	tests := []struct {
+		name    string
+		labels  map[string]string
+		wantErr error
+	}{
+		{name: "available", labels: map[string]string{"status": "available"}},
+		{name: "claimed by the holder", labels: map[string]string{"status": "pending", poolRequestLabel: "uid-me"}},
+		{name: "taken since selection", labels: map[string]string{"status": "pending", poolRequestLabel: "uid-other"}, wantErr: errPoolLocked},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, calicoClient, k8sClient := newPoolController(1)
+			pool, err := calicoClient.ProjectcalicoV3().IPPools().Get(context.Background(), "pool-0", metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			pool.Labels = tt.labels
+			if _, err := calicoClient.ProjectcalicoV3().IPPools().Update(context.Background(), pool, metav1.UpdateOptions{}); err != nil {
+				t.Fatal(err)
+			}
+
+			lease, err := a.lockPool(context.Background(), "pool-0", "uid-me")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("lockPool() = %v, want %v", err, tt.wantErr)
+			}
+			holder := leaseHolder(t, k8sClient)
+			if err != nil {
+				if holder != "" {
+					t.Errorf("the lease of a taken pool is kept by %s", holder)
+				}
+				return
+			}
+			if holder != "uid-me" {
+				t.Errorf("lease held by %q", holder)
+			}
+			a.unlockPool(context.Background(), lease)
+			if holder := leaseHolder(t, k8sClient); holder != "" {
+				t.Errorf("unlocked lease still held by %s", holder)
+			}
+		})
+	}
+}
+
+func TestUnlockPoolKeepsTakenOverLease(t *testing.T) {
+	a, _, k8sClient := newPoolController(1)
+	stale := allocationLease("uid-me", time.Minute)
+	takenOver := allocationLease("uid-other", 0)
+	takenOver.ResourceVersion = "2"
+	if err := k8sClient.Tracker().Add(takenOver); err != nil {
+		t.Fatal(err)
+	}
+	// The fake client ignores preconditions, the API server enforces them
+	var preconditions *metav1.Preconditions
+	k8sClient.PrependReactor("delete", "leases", func(action k8stesting.Action) (bool, k8sruntime.Object, error) {
+		preconditions = action.(k8stesting.DeleteActionImpl).DeleteOptions.Preconditions
+		if preconditions == nil || preconditions.ResourceVersion == nil || *preconditions.ResourceVersion != takenOver.ResourceVersion {
+			return true, nil, apierrors.NewConflict(schema.GroupResource{Group: "coordination.k8s.io", Resource: "leases"}, takenOver.Name, errors.New("precondition failed"))
+		}
+		return false, nil, nil
+	})
+
+	a.unlockPool(context.Background(), stale)
+	if preconditions == nil || preconditions.UID == nil {
+		t.Errorf("lease deleted without preconditions: %+v", preconditions)
+	}
+	if holder := leaseHolder(t, k8sClient); holder != "uid-other" {
+		t.Errorf("lease held by %q after unlocking a stale copy, want uid-other", holder)
+	}
+}
+
@@ -0,0 +1,170 @@
+package admission
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	crdv1 "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
+)
+
+// ManagerOptions returns the options of the controller-runtime manager the
+// webhook runs in. With leaderElect, the leader-only loops, see Loop, run on
+// the replica holding the leader Lease in LeaseNamespace, which is taken
+// through the write identity; every replica keeps serving admission requests.
+// Metrics are served next to the webhook, not by the manager.
+func (a *AdmissionController) ManagerOptions(leaderElect bool) manager.Options {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = crdv1.AddToScheme(scheme)
+	leaseDuration, renewDeadline, retryPeriod := leaderLeaseDuration, leaderRenewDeadline, leaderRetryPeriod
+	return manager.Options{
+		Scheme:                        scheme,
+		Metrics:                       metricsserver.Options{BindAddress: "0"},
+		LeaderElection:                leaderElect,
+		LeaderElectionID:              leaderLeaseName,
+		LeaderElectionNamespace:       a.LeaseNamespace,
+		LeaderElectionConfig:          a.WriteConfig,
+		LeaderElectionReleaseOnCancel: true,
+		LeaseDuration:                 &leaseDuration,
+		RenewDeadline:                 &renewDeadline,
+		RetryPeriod:                   &retryPeriod,
+	}
+}
+
+// Loops are the settings of the reconcilers and background loops SetupManager
+// adds; see the Run* loop of each for what a zero interval does.
+type Loops struct {
+	ReleaseRetry       time.Duration
+	ReleaseStuckAfter  time.Duration
+	Bind               time.Duration
+	GC                 time.Duration
+	DeferredAssignment time.Duration
+	ClaimBind          time.Duration
+	Allocation         time.Duration
+	Cleanup            time.Duration
+	Growth             time.Duration
+	Autoscale          time.Duration
+	Exhaustion         time.Duration
+	DriftAudit         time.Duration
+	ServiceIPSweep     time.Duration
+	Egress             time.Duration
+	TenantSync         time.Duration
+	ScanWorkers        int
+	ScanTimeout        time.Duration
+}
+
+// SetupManager registers the reconcilers with the manager, and adds the
+// leader-only loops and those every replica runs, including the startup
+// scan.
+func (a *AdmissionController) SetupManager(mgr manager.Manager, l Loops) error {
+	a.elected = mgr.Elected()
+	setups := []struct {
+		name  string
+		setup func(manager.Manager) error
+	}{
+		{"IP pool cache", a.SetupPoolCache},
+		{"release controller", func(mgr manager.Manager) error {
+			return a.SetupReleaseController(mgr, l.ReleaseRetry, l.ReleaseStuckAfter)
+		}},
+		{"pool splitter", a.SetupPoolSplitter},
+		{"network policy controller", a.SetupPolicyController},
+		{"BGP controller", a.SetupBGPController},
+		{"IP reservation controller", a.SetupReservationController},
+		{"DNS controller", a.SetupDNSController},
+		{"Cluster API controller", a.SetupClusterAPIController},
+	}
+	for _, s := range setups {
+		if err := s.setup(mgr); err != nil {
+			return fmt.Errorf("could not set up %s: %v", s.name, err)
+		}
+	}
+
+	err := a.AddLeaderLoops(mgr,
+		func(ctx context.Context) { a.RunPoolBinder(ctx, l.Bind) },
+		func(ctx context.Context) { a.RunPoolGC(ctx, l.GC) },
+		func(ctx context.Context) { a.RunDeferredAssignment(ctx, l.DeferredAssignment) },
+		func(ctx context.Context) { a.RunClaimBinder(ctx, l.ClaimBind) },
+		func(ctx context.Context) { a.RunAllocationController(ctx, l.Allocation) },
+		func(ctx context.Context) { a.RunPoolCleanup(ctx, l.Cleanup) },
+		func(ctx context.Context) { a.RunPoolGrowth(ctx, l.Growth) },
+		func(ctx context.Context) { a.RunPoolAutoscaler(ctx, l.Autoscale) },
+		func(ctx context.Context) { a.RunExhaustionWatch(ctx, l.Exhaustion) },
+		func(ctx context.Context) { a.RunDriftAudit(ctx, l.DriftAudit) },
+		func(ctx context.Context) { a.RunServiceIPSweep(ctx, l.ServiceIPSweep) },
+		func(ctx context.Context) { a.RunEgressAssignment(ctx, l.Egress) },
+	)
+	if err != nil {
+		return fmt.Errorf("could not add background loops: %v", err)
+	}
+	// Events are queued by the admission path, so every replica posts its own,
+	// and every replica resolves tenants. Every replica scans too, as its
+	// readiness waits for the scan; only the leader repairs what it finds
+	err = a.AddLoops(mgr,
+		a.RunEventPoster,
+		func(ctx context.Context) { a.RunTenantSync(ctx, l.TenantSync) },
+		func(ctx context.Context) { a.RunStartupScan(ctx, l.ScanWorkers, l.ScanTimeout) },
+	)
+	if err != nil {
+		return fmt.Errorf("could not add background loops: %v", err)
+	}
+	return nil
+}
+
+// AddLeaderLoops adds loops that run on one replica at a time, so that the
+// binder, GC, growth and drift loops of several replicas do not race each
+// other. A loop must stop when its context is cancelled.
+func (a *AdmissionController) AddLeaderLoops(mgr manager.Manager, loops ...func(ctx context.Context)) error {
+	if err := mgr.Add(leaderGauge{logger: a.Logger}); err != nil {
+		return err
+	}
+	return addLoops(mgr, true, loops)
+}
+
+// AddLoops adds loops that run on every replica.
+func (a *AdmissionController) AddLoops(mgr manager.Manager, loops ...func(ctx context.Context)) error {
+	return addLoops(mgr, false, loops)
+}
+
+func addLoops(mgr manager.Manager, leaderOnly bool, loops []func(ctx context.Context)) error {
+	for _, run := range loops {
+		if err := mgr.Add(loop{run: run, leaderOnly: leaderOnly}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loop adapts a Run* loop to a manager runnable.
+type loop struct {
+	run        func(ctx context.Context)
+	leaderOnly bool
+}
+
+func (l loop) Start(ctx context.Context) error {
+	l.run(ctx)
+	return nil
+}
+
+func (l loop) NeedLeaderElection() bool {
+	return l.leaderOnly
+}
+
+// ReadyCheck is the manager's readiness check: ready once the startup scan
+// is done and, in strict mode, the live webhook configuration checks out.
+// HandleReadyz serves the same answer with details.
+func (a *AdmissionController) ReadyCheck(_ *http.Request) error {
+	if !a.Scan.Ready() {
+		return errors.New("startup scan in progress")
+	}
+	if a.Strict {
+		return a.WebhookCheck.Err()
+	}
+	return nil
+}
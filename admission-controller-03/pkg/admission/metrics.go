@@ -0,0 +1,132 @@
+package admission
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const metricsScrapeTimeout = 10 * time.Second
+
+// inventoryStatuses are always exported per zone, even when zero, so that
+// dashboards and alerts do not see series appear and vanish.
+var inventoryStatuses = []string{"available", "pending", "used", "quarantined", statusExternal}
+
+var (
+	zonePoolsDesc = prometheus.NewDesc("ipam_zone_pools",
+		"Number of IP pools in a zone.", []string{"zone"}, nil)
+	poolsDesc = prometheus.NewDesc("ipam_pools",
+		"Number of IP pools in a zone by status label.", []string{"zone", "status"}, nil)
+	zoneLowDesc = prometheus.NewDesc("ipam_zone_pools_low",
+		"1 while a zone has fewer available pools than its early-warning threshold.", []string{"zone"}, nil)
+	zoneThresholdDesc = prometheus.NewDesc("ipam_zone_pools_low_threshold",
+		"Early-warning threshold of available pools in a zone.", []string{"zone"}, nil)
+	poolAllocatedDesc = prometheus.NewDesc("ipam_pool_allocated_addresses",
+		"Addresses of the pool allocated by Calico IPAM.", []string{"zone", "pool"}, nil)
+	poolCapacityDesc = prometheus.NewDesc("ipam_pool_capacity_addresses",
+		"Addresses in the pool's CIDR.", []string{"zone", "pool"}, nil)
+	poolUtilizationDesc = prometheus.NewDesc("ipam_pool_utilization_ratio",
+		"Fraction of the pool's addresses allocated by Calico IPAM.", []string{"zone", "pool"}, nil)
+)
+
+// Allocation race counters, to tune concurrency settings from real data.
+var (
+	poolUpdateConflicts = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ipam_pool_update_conflicts_total",
+		Help: "IP pool updates rejected because the pool changed since it was read.",
+	})
+	poolUpdateRetries = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ipam_pool_update_retries_total",
+		Help: "IP pool updates retried after a conflict.",
+	})
+	allocationsLost = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ipam_pool_allocations_lost_total",
+		Help: "Pool assignments that failed because a concurrent writer changed the pool first.",
+	})
+)
+
+// AllocationCollectors returns the allocation race counters for registration.
+func AllocationCollectors() []prometheus.Collector {
+	return []prometheus.Collector{poolUpdateConflicts, poolUpdateRetries, allocationsLost}
+}
+
+// PoolCollector exports the pool inventory and utilization. Pools are read on
+// every scrape, so the numbers are never staler than the scrape interval.
+type PoolCollector struct {
+	controller *AdmissionController
+}
+
+// NewPoolCollector returns a collector for the controller's pools.
+func (a *AdmissionController) NewPoolCollector() *PoolCollector {
+	return &PoolCollector{controller: a}
+}
+
+func (c *PoolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- zonePoolsDesc
+	ch <- poolsDesc
+	ch <- zoneLowDesc
+	ch <- zoneThresholdDesc
+	ch <- poolAllocatedDesc
+	ch <- poolCapacityDesc
+	ch <- poolUtilizationDesc
+}
+
+func (c *PoolCollector) Collect(ch chan<- prometheus.Metric) {
+	a := c.controller
+	ctx, cancel := context.WithTimeout(context.Background(), metricsScrapeTimeout)
+	defer cancel()
+
+	ipPools, err := a.CalicoReader.ProjectcalicoV3().IPPools().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		a.Logger.Error("could not list IP pools for metrics", zap.Error(err))
+		ch <- prometheus.NewInvalidMetric(zonePoolsDesc, err)
+		return
+	}
+
+	zones := map[string]map[string]int{}
+	poolZones := map[string]string{}
+	for _, pool := range ipPools.Items {
+		poolLabels := normalizeLabels(pool.ObjectMeta.Labels)
+		zone := poolLabels["location"]
+		if zones[zone] == nil {
+			zones[zone] = map[string]int{}
+			for _, status := range inventoryStatuses {
+				zones[zone][status] = 0
+			}
+		}
+		zones[zone][poolLabels["status"]]++
+		poolZones[pool.Name] = zone
+	}
+	for zone, statuses := range zones {
+		total := 0
+		for status, count := range statuses {
+			total += count
+			ch <- prometheus.MustNewConstMetric(poolsDesc, prometheus.GaugeValue, float64(count), zone, status)
+		}
+		ch <- prometheus.MustNewConstMetric(zonePoolsDesc, prometheus.GaugeValue, float64(total), zone)
+		if threshold := a.Config.LowPoolThresholdFor(zone); threshold > 0 {
+			low := 0.0
+			if statuses["available"] < threshold {
+				low = 1
+			}
+			ch <- prometheus.MustNewConstMetric(zoneLowDesc, prometheus.GaugeValue, low, zone)
+			ch <- prometheus.MustNewConstMetric(zoneThresholdDesc, prometheus.GaugeValue, float64(threshold), zone)
+		}
+	}
+
+	usage, err := a.poolUtilization(ctx, ipPools.Items)
+	if err != nil {
+		a.Logger.Warn("could not read pool utilization for metrics", zap.Error(err))
+		return
+	}
+	for name, u := range usage {
+		zone := poolZones[name]
+		ch <- prometheus.MustNewConstMetric(poolAllocatedDesc, prometheus.GaugeValue, float64(u.Allocated), zone, name)
+		ch <- prometheus.MustNewConstMetric(poolCapacityDesc, prometheus.GaugeValue, float64(u.Capacity), zone, name)
+		ch <- prometheus.MustNewConstMetric(poolUtilizationDesc, prometheus.GaugeValue, u.Ratio(), zone, name)
+	}
+}
@@ -0,0 +1,238 @@
+package admission
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"go.uber.org/zap"
+
+	"admission-controller-03/pkg/config"
+
+	crdv1 "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// namespacedPolicyName is the isolation NetworkPolicy in a namespace; the
+// GlobalNetworkPolicy of a namespace is named by globalPolicyName.
+const namespacedPolicyName = "ipam-isolation"
+
+func globalPolicyName(namespace string) string {
+	return "ipam-isolation-" + namespace
+}
+
+// policyReconciler keeps the isolation policy of every namespace with an
+// assigned pool in line with its pools' CIDRs and the configured template.
+type policyReconciler struct {
+	a *AdmissionController
+	// cache is the manager's informer cache
+	cache client.Reader
+}
+
+// SetupPolicyController registers the policy reconciler with the manager when
+// a policy template is configured. A policy edited or deleted by hand is
+// restored.
+func (a *AdmissionController) SetupPolicyController(mgr manager.Manager) error {
+	t := a.Config.NetworkPolicy
+	if t == nil {
+		return nil
+	}
+	b := builder.ControllerManagedBy(mgr).
+		Named("network-policy").
+		For(&corev1.Namespace{})
+	if t.Scope == config.NetworkPolicyGlobal {
+		b = b.Watches(&crdv1.GlobalNetworkPolicy{}, handler.EnqueueRequestsFromMapFunc(func(_ context.Context, o client.Object) []reconcile.Request {
+			if namespace := o.GetLabels()[poolNamespaceLabel]; namespace != "" {
+				return []reconcile.Request{{NamespacedName: types.NamespacedName{Name: namespace}}}
+			}
+			return nil
+		}))
+	} else {
+		b = b.Watches(&crdv1.NetworkPolicy{}, handler.EnqueueRequestsFromMapFunc(func(_ context.Context, o client.Object) []reconcile.Request {
+			if o.GetName() == namespacedPolicyName {
+				return []reconcile.Request{{NamespacedName: types.NamespacedName{Name: o.GetNamespace()}}}
+			}
+			return nil
+		}))
+	}
+	return b.Complete(&policyReconciler{a: a, cache: mgr.GetCache()})
+}
+
+func (r *policyReconciler) Reconcile(ctx context.Context, req reconcile.Request) (reconcile.Result, error) {
+	var ns corev1.Namespace
+	if err := r.cache.Get(ctx, req.NamespacedName, &ns); err != nil {
+		if apierrors.IsNotFound(err) && r.a.Config.NetworkPolicy.Scope == config.NetworkPolicyGlobal {
+			// Normally deleted on release already
+			return reconcile.Result{}, r.deleteIfExists(ctx, req.Name)
+		}
+		return reconcile.Result{}, client.IgnoreNotFound(err)
+	}
+	if ns.DeletionTimestamp != nil {
+		// Deleted on release, once the pools are free
+		return reconcile.Result{}, nil
+	}
+
+	nets, err := r.namespaceNets(ctx, &ns)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+	if len(nets) == 0 {
+		return reconcile.Result{}, r.deleteIfExists(ctx, ns.Name)
+	}
+	return reconcile.Result{}, r.ensurePolicy(ctx, ns.Name, nets)
+}
+
+// namespaceNets returns the CIDRs of the pools assigned to the namespace.
+func (r *policyReconciler) namespaceNets(ctx context.Context, ns *corev1.Namespace) ([]string, error) {
+	var names []string
+	if annotation := ns.Annotations[ipv4PoolsAnnotation]; annotation != "" {
+		if err := json.Unmarshal([]byte(annotation), &names); err != nil {
+			// Rejected at admission; nothing to isolate against until fixed
+			r.a.Logger.Warn("Failed to decode IP pool annotation", zap.String("namespace", ns.Name), zap.Error(err))
+			return nil, nil
+		}
+	}
+	var nets []string
+	for _, name := range names {
+		var pool crdv1.IPPool
+		err := r.cache.Get(ctx, types.NamespacedName{Name: name}, &pool)
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not get IP pool %s: %v", name, err)
+		}
+		nets = append(nets, pool.Spec.CIDR)
+	}
+	return nets, nil
+}
+
+// policySpec builds the rules of the template: traffic is only allowed
+// between the namespace's CIDRs and the template's extra peers.
+func policySpec(t *config.NetworkPolicy, nets []string) (policyTypes []crdv1.PolicyType, ingress, egress []crdv1.Rule) {
+	peers := append(append([]string{}, nets...), t.AllowNets...)
+	directions := t.Types
+	if len(directions) == 0 {
+		directions = []string{"Ingress", "Egress"}
+	}
+	for _, direction := range directions {
+		policyTypes = append(policyTypes, crdv1.PolicyType(direction))
+		switch crdv1.PolicyType(direction) {
+		case crdv1.PolicyTypeIngress:
+			ingress = []crdv1.Rule{{Action: crdv1.Allow, Source: crdv1.EntityRule{Nets: peers}}}
+		case crdv1.PolicyTypeEgress:
+			egress = []crdv1.Rule{{Action: crdv1.Allow, Destination: crdv1.EntityRule{Nets: peers}}}
+		}
+	}
+	return policyTypes, ingress, egress
+}
+
+// ensurePolicy creates or updates the namespace's policy.
+func (r *policyReconciler) ensurePolicy(ctx context.Context, namespace string, nets []string) error {
+	t := r.a.Config.NetworkPolicy
+	policyTypes, ingress, egress := policySpec(t, nets)
+	labels := map[string]string{poolNamespaceLabel: namespace}
+
+	if t.Scope == config.NetworkPolicyGlobal {
+		want := crdv1.GlobalNetworkPolicySpec{
+			Order:    t.Order,
+			Selector: fmt.Sprintf("projectcalico.org/namespace == '%s'", namespace),
+			Types:    policyTypes,
+			Ingress:  ingress,
+			Egress:   egress,
+		}
+		var existing crdv1.GlobalNetworkPolicy
+		err := r.cache.Get(ctx, types.NamespacedName{Name: globalPolicyName(namespace)}, &existing)
+		switch {
+		case apierrors.IsNotFound(err):
+			policy := &crdv1.GlobalNetworkPolicy{ObjectMeta: metav1.ObjectMeta{Name: globalPolicyName(namespace), Labels: labels}, Spec: want}
+			_, err = r.a.Clientset.ProjectcalicoV3().GlobalNetworkPolicies().Create(ctx, policy, metav1.CreateOptions{FieldManager: fieldManager})
+		case err != nil:
+			return fmt.Errorf("could not get network policy: %v", err)
+		case equality.Semantic.DeepEqual(existing.Spec, want) && existing.Labels[poolNamespaceLabel] == namespace:
+			return nil
+		default:
+			policy := existing.DeepCopy()
+			policy.Labels, policy.Spec = labels, want
+			_, err = r.a.Clientset.ProjectcalicoV3().GlobalNetworkPolicies().Update(ctx, policy, metav1.UpdateOptions{FieldManager: fieldManager})
+		}
+		if err != nil {
+			return fmt.Errorf("could not write network policy for namespace %s: %v", namespace, err)
+		}
+	} else {
+		want := crdv1.NetworkPolicySpec{
+			Order:    t.Order,
+			Selector: "all()",
+			Types:    policyTypes,
+			Ingress:  ingress,
+			Egress:   egress,
+		}
+		var existing crdv1.NetworkPolicy
+		err := r.cache.Get(ctx, types.NamespacedName{Namespace: namespace, Name: namespacedPolicyName}, &existing)
+		switch {
+		case apierrors.IsNotFound(err):
+			policy := &crdv1.NetworkPolicy{ObjectMeta: metav1.ObjectMeta{Name: namespacedPolicyName, Namespace: namespace, Labels: labels}, Spec: want}
+			_, err = r.a.Clientset.ProjectcalicoV3().NetworkPolicies(namespace).Create(ctx, policy, metav1.CreateOptions{FieldManager: fieldManager})
+		case err != nil:
+			return fmt.Errorf("could not get network policy: %v", err)
+		case equality.Semantic.DeepEqual(existing.Spec, want) && existing.Labels[poolNamespaceLabel] == namespace:
+			return nil
+		default:
+			policy := existing.DeepCopy()
+			policy.Labels, policy.Spec = labels, want
+			_, err = r.a.Clientset.ProjectcalicoV3().NetworkPolicies(namespace).Update(ctx, policy, metav1.UpdateOptions{FieldManager: fieldManager})
+		}
+		if err != nil {
+			return fmt.Errorf("could not write network policy for namespace %s: %v", namespace, err)
+		}
+	}
+	r.a.Logger.Info("Wrote network policy for namespace", zap.String("namespace", namespace), zap.Strings("nets", nets))
+	return nil
+}
+
+// deleteIfExists deletes the namespace's policy if the cache has it, sparing
+// the API a delete for every namespace without pools.
+func (r *policyReconciler) deleteIfExists(ctx context.Context, namespace string) error {
+	var policy client.Object = &crdv1.NetworkPolicy{}
+	key := types.NamespacedName{Namespace: namespace, Name: namespacedPolicyName}
+	if r.a.Config.NetworkPolicy.Scope == config.NetworkPolicyGlobal {
+		policy, key = &crdv1.GlobalNetworkPolicy{}, types.NamespacedName{Name: globalPolicyName(namespace)}
+	}
+	if err := r.cache.Get(ctx, key, policy); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	return r.a.deleteNetworkPolicy(ctx, namespace)
+}
+
+// deleteNetworkPolicy deletes the isolation policy of a namespace whose pools
+// were released. A namespaced policy goes with its namespace, only one that
+// outlived its pools is deleted here.
+func (a *AdmissionController) deleteNetworkPolicy(ctx context.Context, namespace string) error {
+	t := a.Config.NetworkPolicy
+	if t == nil {
+		return nil
+	}
+	var err error
+	if t.Scope == config.NetworkPolicyGlobal {
+		err = a.Clientset.ProjectcalicoV3().GlobalNetworkPolicies().Delete(ctx, globalPolicyName(namespace), metav1.DeleteOptions{})
+	} else {
+		err = a.Clientset.ProjectcalicoV3().NetworkPolicies(namespace).Delete(ctx, namespacedPolicyName, metav1.DeleteOptions{})
+	}
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not delete network policy of namespace %s: %v", namespace, err)
+	}
+	a.Logger.Info("Deleted network policy of released namespace", zap.String("namespace", namespace))
+	return nil
+}
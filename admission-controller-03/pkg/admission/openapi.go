@@ -0,0 +1,235 @@
+package admission
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	"admission-controller-03/pkg/allocation"
+	"admission-controller-03/pkg/version"
+)
+
+// OpenAPIPath serves the OpenAPI v3 document of the allocations API and the
+// admin verbs.
+const OpenAPIPath = "/openapi.json"
+
+// HandleOpenAPI serves the OpenAPI document. It needs no token, so that
+// gateways and SDK generators can fetch it, but is off with the API.
+func (a *AdmissionController) HandleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	if !a.apiEnabled() {
+		http.Error(w, "the API is not enabled", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	a.writeJSON(w, OpenAPIDocument())
+}
+
+// OpenAPIDocument returns the OpenAPI v3 document of the API. The schemas are
+// generated from the response types, so they cannot drift from what is
+// served.
+func OpenAPIDocument() map[string]interface{} {
+	schemas := componentSchemas(map[string]reflect.Type{
+		"Allocation":     reflect.TypeOf(Allocation{}),
+		"AllocationList": reflect.TypeOf(AllocationList{}),
+		"Pool":           reflect.TypeOf(Pool{}),
+		"PoolList":       reflect.TypeOf(PoolList{}),
+		"PoolAction":     reflect.TypeOf(PoolAction{}),
+	})
+	// The fields with a closed set of values
+	property := func(schema, name string) map[string]interface{} {
+		return schemas[schema].(map[string]interface{})["properties"].(map[string]interface{})[name].(map[string]interface{})
+	}
+	property("Allocation", "phase")["enum"] = []allocation.Phase{
+		allocation.PhasePending, allocation.PhaseBound, allocation.PhaseQuarantined, allocation.PhaseReleased, allocation.PhaseFailed,
+	}
+	property("PoolAction", "action")["enum"] = []string{"cordon", "uncordon", "release"}
+
+	errorResponse := func(description string) map[string]interface{} {
+		return map[string]interface{}{
+			"description": description,
+			"content":     map[string]interface{}{"text/plain": map[string]interface{}{"schema": map[string]interface{}{"type": "string"}}},
+		}
+	}
+	jsonResponse := func(description, schema string) map[string]interface{} {
+		return map[string]interface{}{
+			"description": description,
+			"content": map[string]interface{}{"application/json": map[string]interface{}{
+				"schema": map[string]interface{}{"$ref": "#/components/schemas/" + schema},
+			}},
+		}
+	}
+	pathParameter := func(name, description string) map[string]interface{} {
+		return map[string]interface{}{"name": name, "in": "path", "required": true, "description": description, "schema": map[string]interface{}{"type": "string"}}
+	}
+	// The allocations are also served in the export formats
+	allocationsResponse := func(description string) map[string]interface{} {
+		response := jsonResponse(description, "AllocationList")
+		content := response["content"].(map[string]interface{})
+		content["text/csv"] = map[string]interface{}{"schema": map[string]interface{}{"type": "string"}}
+		content["text/plain"] = map[string]interface{}{"schema": map[string]interface{}{"type": "string"}}
+		return response
+	}
+	formatParameter := map[string]interface{}{
+		"name": "format", "in": "query", "required": false,
+		"description": "json, csv with a row of namespace, cidr, tenant, zone and assigned_at per allocation, or textfile for the node-exporter textfile collector.",
+		"schema":      map[string]interface{}{"type": "string", "enum": []string{"json", ExportCSV, ExportTextfile}, "default": "json"},
+	}
+	poolVerb := func(operationID, summary string, parameters ...map[string]interface{}) map[string]interface{} {
+		return map[string]interface{}{"post": map[string]interface{}{
+			"operationId": operationID,
+			"summary":     summary,
+			"tags":        []string{"pools"},
+			"parameters":  append([]map[string]interface{}{pathParameter("pool", "Name of the IP pool.")}, parameters...),
+			"responses": map[string]interface{}{
+				"200": jsonResponse("The verb was applied.", "PoolAction"),
+				"401": errorResponse("The bearer token is missing or wrong."),
+				"403": errorResponse("The user may not apply the verb to the pool."),
+				"404": errorResponse("The pool does not exist."),
+				"409": errorResponse("The verb was refused for the state of the pool."),
+				"500": errorResponse("The verb failed."),
+			},
+		}}
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":       "IPAM webhook API",
+			"description": "The IP pools the webhook manages and assigned to namespaces, and the admin verbs on pools.",
+			"version":     version.Version,
+		},
+		"security": []map[string]interface{}{{"bearerAuth": []string{}}},
+		"paths": map[string]interface{}{
+			AllocationsPath: map[string]interface{}{"get": map[string]interface{}{
+				"operationId": "listAllocations",
+				"summary":     "List the pools held by a namespace or by a request whose namespace is pending, ordered by namespace and pool.",
+				"tags":        []string{"allocations"},
+				"parameters":  []map[string]interface{}{formatParameter},
+				"responses": map[string]interface{}{
+					"200": allocationsResponse("Every allocation."),
+					"400": errorResponse("The format is unknown."),
+					"401": errorResponse("The bearer token is missing or wrong."),
+					"403": errorResponse("The user may not list allocations."),
+					"500": errorResponse("The pools could not be listed."),
+				},
+			}},
+			AllocationsPath + "/{namespace}": map[string]interface{}{"get": map[string]interface{}{
+				"operationId": "getNamespaceAllocations",
+				"summary":     "List the pools a namespace holds.",
+				"tags":        []string{"allocations"},
+				"parameters":  []map[string]interface{}{pathParameter("namespace", "Name of the namespace."), formatParameter},
+				"responses": map[string]interface{}{
+					"200": allocationsResponse("The namespace's allocations."),
+					"400": errorResponse("The format is unknown."),
+					"401": errorResponse("The bearer token is missing or wrong."),
+					"403": errorResponse("The user may not get the namespace's allocations."),
+					"404": errorResponse("The namespace holds no IP pool."),
+					"500": errorResponse("The pools could not be listed."),
+				},
+			}},
+			PoolsPath: map[string]interface{}{"get": map[string]interface{}{
+				"operationId": "listPools",
+				"summary":     "List every pool, ordered by zone and name, with the current warnings.",
+				"tags":        []string{"pools"},
+				"responses": map[string]interface{}{
+					"200": jsonResponse("The pool inventory.", "PoolList"),
+					"401": errorResponse("The bearer token is missing or wrong."),
+					"403": errorResponse("The user may not list pools."),
+					"500": errorResponse("The pools could not be listed."),
+				},
+			}},
+			PoolsPath + "/{pool}/cordon":   poolVerb("cordonPool", "Never assign the pool again, keeping it bound."),
+			PoolsPath + "/{pool}/uncordon": poolVerb("uncordonPool", "Make a cordoned pool assignable again."),
+			PoolsPath + "/{pool}/release": poolVerb("releasePool", "Release a taken pool no namespace references.", map[string]interface{}{
+				"name": "override", "in": "query", "required": false,
+				"description": "Release even if Calico IPAM still has addresses allocated from the pool.",
+				"schema":      map[string]interface{}{"type": "boolean", "default": false},
+			}),
+		},
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"securitySchemes": map[string]interface{}{
+				"bearerAuth": map[string]interface{}{
+					"type": "http", "scheme": "bearer",
+					"description": "The static API token or, with api.kubernetesAuth, a Kubernetes token such as a service account's, whose user RBAC must allow the call.",
+				},
+			},
+		},
+	}
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// componentSchemas returns the JSON schemas of the named types. A field of one
+// of the types refers to its component rather than repeating it.
+func componentSchemas(types map[string]reflect.Type) map[string]interface{} {
+	refs := map[reflect.Type]string{}
+	for name, t := range types {
+		refs[t] = "#/components/schemas/" + name
+	}
+	schemas := map[string]interface{}{}
+	for name, t := range types {
+		schemas[name] = structSchema(t, refs)
+	}
+	return schemas
+}
+
+// schemaOf returns the JSON schema of a type as encoding/json encodes it.
+func schemaOf(t reflect.Type, refs map[reflect.Type]string) map[string]interface{} {
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if ref, ok := refs[t]; ok {
+		return map[string]interface{}{"$ref": ref}
+	}
+	switch {
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t.Kind() == reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case t.Kind() == reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case t.Kind() == reflect.Float32 || t.Kind() == reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case t.Kind() == reflect.Slice:
+		return map[string]interface{}{"type": "array", "items": schemaOf(t.Elem(), refs)}
+	case t.Kind() == reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaOf(t.Elem(), refs)}
+	case t.Kind() == reflect.Struct:
+		return structSchema(t, refs)
+	}
+	return map[string]interface{}{}
+}
+
+// structSchema returns the object schema of a struct. Fields without
+// omitempty are required.
+func structSchema(t reflect.Type, refs map[reflect.Type]string) map[string]interface{} {
+	properties := map[string]interface{}{}
+	required := []string{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, options, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if !field.IsExported() || name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = schemaOf(field.Type, refs)
+		if !strings.Contains(options, "omitempty") {
+			required = append(required, name)
+		}
+	}
+	schema := map[string]interface{}{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
@@ -0,0 +1,63 @@
+package admission
+
+import (
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+
+	"admission-controller-03/pkg/notify"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const notifyTimeout = 30 * time.Second
+
+// notifyOwner tells the owner named in the namespace's contact annotation about
+// an event on its pool. name is the namespace's name as far as it is known.
+// Delivery happens in the background so a slow mail server or chat API never
+// holds up admission; failures are only logged.
+func (a *AdmissionController) notifyOwner(name string, ns *corev1.Namespace, event notify.Event, poolName, poolCIDR, tenant string) {
+	if msg, ok := a.ownerMessage(name, ns.Annotations, event, poolName, poolCIDR, tenant); ok {
+		a.sendOwnerMessage(msg)
+	}
+}
+
+// ownerMessage builds the message for the owner named in the contact
+// annotation, which a pending pool carries too while its namespace does not
+// exist yet. It reports false when there is no one to tell.
+func (a *AdmissionController) ownerMessage(name string, annotations map[string]string, event notify.Event, poolName, poolCIDR, tenant string) (notify.Message, bool) {
+	if a.Notifier == nil {
+		return notify.Message{}, false
+	}
+	value, ok := annotations[notify.OwnerContactAnnotation]
+	if !ok || value == "" {
+		return notify.Message{}, false
+	}
+	contact, err := notify.ParseContact(value)
+	if err != nil {
+		a.Logger.Warn("could not parse owner contact", zap.String("namespace", name), zap.Error(err))
+		return notify.Message{}, false
+	}
+
+	return notify.Message{
+		Event:     event,
+		Namespace: name,
+		Pool:      poolName,
+		CIDR:      poolCIDR,
+		Tenant:    tenant,
+		Contact:   contact,
+		Locale:    annotations[notify.OwnerLocaleAnnotation],
+	}, true
+}
+
+// sendOwnerMessage delivers msg in the background.
+func (a *AdmissionController) sendOwnerMessage(msg notify.Message) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+		defer cancel()
+		if err := a.Notifier.Notify(ctx, msg); err != nil {
+			a.Logger.Warn("could not notify namespace owner", zap.String("namespace", msg.Namespace), zap.Error(err))
+		}
+	}()
+}
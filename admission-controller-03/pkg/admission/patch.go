@@ -0,0 +1,217 @@
+package admission
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"go.uber.org/zap"
+	jsonpatch "gopkg.in/evanphx/json-patch.v4"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+)
+
+// patchOperation is one JSON Patch operation. Its fields always marshal in
+// the conventional op, path, value order.
+type patchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// namespacePatch returns the canonical patch setting annotations on ns: the
+// annotations map first when the namespace has none, then one add per
+// annotation in key order, then one add per finalizer ns does not carry yet.
+// The same inputs always give byte-identical output, so audited patches can
+// be compared directly.
+func namespacePatch(ns *corev1.Namespace, annotations map[string]string, finalizers []string) ([]byte, error) {
+	var patch []patchOperation
+	if ns.Annotations == nil {
+		// Only create the annotations map when the manifest has none, adding
+		// it unconditionally would replace the user's annotations
+		patch = append(patch, patchOperation{Op: "add", Path: "/metadata/annotations", Value: map[string]string{}})
+	}
+
+	keys := make([]string, 0, len(annotations))
+	for key := range annotations {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		patch = append(patch, patchOperation{Op: "add", Path: annotationPath(key), Value: annotations[key]})
+	}
+
+	added := len(ns.Finalizers)
+	for _, finalizer := range missingFinalizers(ns.Finalizers, finalizers) {
+		if added == 0 {
+			patch = append(patch, patchOperation{Op: "add", Path: "/metadata/finalizers", Value: []string{finalizer}})
+		} else {
+			patch = append(patch, patchOperation{Op: "add", Path: "/metadata/finalizers/-", Value: finalizer})
+		}
+		added++
+	}
+	return json.Marshal(patch)
+}
+
+// missingFinalizers returns the finalizers that existing does not hold yet.
+func missingFinalizers(existing, finalizers []string) []string {
+	var missing []string
+	for _, finalizer := range finalizers {
+		held := false
+		for _, e := range existing {
+			held = held || e == finalizer
+		}
+		for _, m := range missing {
+			held = held || m == finalizer
+		}
+		if !held {
+			missing = append(missing, finalizer)
+		}
+	}
+	return missing
+}
+
+// annotationPath escapes an annotation key into a JSON pointer (RFC 6901).
+func annotationPath(key string) string {
+	return "/metadata/annotations/" + strings.NewReplacer("~", "~0", "/", "~1").Replace(key)
+}
+
+// verifyPatch applies the patch to the original namespace in memory and
+// confirms the result carries the wanted annotations and finalizers and is
+// otherwise unchanged, so a wrong patch is caught before the API server
+// applies it.
+func verifyPatch(original, patch []byte, annotations map[string]string, finalizers []string) error {
+	decoded, err := jsonpatch.DecodePatch(patch)
+	if err != nil {
+		return fmt.Errorf("could not decode patch: %v", err)
+	}
+	patched, err := decoded.Apply(original)
+	if err != nil {
+		return fmt.Errorf("could not apply patch: %v", err)
+	}
+
+	var before, after corev1.Namespace
+	if err := json.Unmarshal(original, &before); err != nil {
+		return fmt.Errorf("could not decode original namespace: %v", err)
+	}
+	if err := json.Unmarshal(patched, &after); err != nil {
+		return fmt.Errorf("could not decode patched namespace: %v", err)
+	}
+
+	for key, value := range annotations {
+		if after.Annotations[key] != value {
+			return fmt.Errorf("patched annotation %s is %q, want %q", key, after.Annotations[key], value)
+		}
+	}
+	for key, value := range before.Annotations {
+		if _, set := annotations[key]; !set && after.Annotations[key] != value {
+			return fmt.Errorf("patch changed unrelated annotation %s", key)
+		}
+	}
+	if len(after.Annotations) != len(before.Annotations)+countNew(before.Annotations, annotations) {
+		return fmt.Errorf("patch added unexpected annotations")
+	}
+
+	wantFinalizers := append(append([]string{}, before.Finalizers...), missingFinalizers(before.Finalizers, finalizers)...)
+	if !equality.Semantic.DeepEqual(after.Finalizers, wantFinalizers) {
+		return fmt.Errorf("patched finalizers are %v, want %v", after.Finalizers, wantFinalizers)
+	}
+
+	after.Annotations = before.Annotations
+	after.Finalizers = before.Finalizers
+	if !equality.Semantic.DeepEqual(before, after) {
+		return fmt.Errorf("patch changed fields other than annotations")
+	}
+	return nil
+}
+
+// countNew counts the annotations that are not already present.
+func countNew(existing, annotations map[string]string) int {
+	count := 0
+	for key := range annotations {
+		if _, ok := existing[key]; !ok {
+			count++
+		}
+	}
+	return count
+}
+
+// metadataChange is one label or annotation the patch adds, changes or
+// removes. Before or After is nil when the key is absent on that side.
+type metadataChange struct {
+	Field  string  `json:"field"`
+	Before *string `json:"before"`
+	After  *string `json:"after"`
+}
+
+// logPatchDiff logs, at debug level, the namespace labels and annotations
+// before the mutation and as they will be once the patch is applied, so a
+// misbehaving patch is diagnosable from the logs alone.
+func (a *AdmissionController) logPatchDiff(name string, original, patch []byte) {
+	if !a.Logger.Core().Enabled(zap.DebugLevel) {
+		return
+	}
+	decoded, err := jsonpatch.DecodePatch(patch)
+	if err != nil {
+		a.Logger.Debug("could not decode patch for diff", zap.Error(err))
+		return
+	}
+	patched, err := decoded.Apply(original)
+	if err != nil {
+		a.Logger.Debug("could not apply patch for diff", zap.Error(err))
+		return
+	}
+	var before, after corev1.Namespace
+	if err := json.Unmarshal(original, &before); err != nil {
+		a.Logger.Debug("could not decode original namespace for diff", zap.Error(err))
+		return
+	}
+	if err := json.Unmarshal(patched, &after); err != nil {
+		a.Logger.Debug("could not decode patched namespace for diff", zap.Error(err))
+		return
+	}
+
+	changes := diffMetadata("metadata.labels", before.Labels, after.Labels)
+	changes = append(changes, diffMetadata("metadata.annotations", before.Annotations, after.Annotations)...)
+	a.Logger.Debug("Patch diff",
+		zap.String("namespace", name),
+		zap.Any("labelsBefore", before.Labels),
+		zap.Any("annotationsBefore", before.Annotations),
+		zap.Any("labelsAfter", after.Labels),
+		zap.Any("annotationsAfter", after.Annotations),
+		zap.Any("changes", changes))
+}
+
+// diffMetadata lists the keys whose values differ between two maps, in
+// sorted order.
+func diffMetadata(field string, before, after map[string]string) []metadataChange {
+	keys := make([]string, 0, len(before)+len(after))
+	for key := range before {
+		keys = append(keys, key)
+	}
+	for key := range after {
+		if _, ok := before[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var changes []metadataChange
+	for _, key := range keys {
+		oldValue, hadOld := before[key]
+		newValue, hasNew := after[key]
+		if hadOld == hasNew && oldValue == newValue {
+			continue
+		}
+		change := metadataChange{Field: fmt.Sprintf("%s[%s]", field, key)}
+		if hadOld {
+			change.Before = &oldValue
+		}
+		if hasNew {
+			change.After = &newValue
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
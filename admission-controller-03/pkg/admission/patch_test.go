@@ -0,0 +1,119 @@
+package admission
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files of the tests")
+
+// golden compares got with testdata/name.golden, or rewrites the file with
+// -update.
+func golden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name+".golden")
+	if *update {
+		if err := os.WriteFile(path, append(got, '\n'), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, bytes.TrimSuffix(want, []byte("\n"))) {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+var patchCases = []struct {
+	name        string
+	existing    map[string]string
+	finalizers  []string
+	annotations map[string]string
+	add         []string
+}{
+	{
+		name:        "nil-annotations",
+		annotations: map[string]string{ipv4PoolsAnnotation: `["pool-a"]`},
+	},
+	{
+		name:     "existing-annotations",
+		existing: map[string]string{"owner": "team-a", ipv4PoolsAnnotation: `["stale"]`},
+		annotations: map[string]string{
+			ipv4PoolsAnnotation: `["pool-a"]`,
+			requestAnnotation:   "uid-1",
+		},
+	},
+	{
+		name:        "finalizers",
+		finalizers:  []string{"example.com/other"},
+		annotations: map[string]string{ipv4PoolsAnnotation: `["pool-a"]`},
+		add:         []string{releaseFinalizer, "example.com/other"},
+	},
+	{
+		name:        "new-finalizers",
+		annotations: map[string]string{ipv4PoolsAnnotation: `["pool-a"]`},
+		add:         []string{releaseFinalizer},
+	},
+	{
+		name:     "escaped-keys",
+		existing: map[string]string{"owner": "team-a"},
+		annotations: map[string]string{
+			"example.com/a~b": "tilde",
+			"example.com/c/d": "slash",
+			"~/":              "both",
+		},
+	},
+}
+
+func TestNamespacePatch(t *testing.T) {
+	for _, tc := range patchCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "ns", Annotations: tc.existing, Finalizers: tc.finalizers}}
+			patch, err := namespacePatch(ns, tc.annotations, tc.add)
+			if err != nil {
+				t.Fatal(err)
+			}
+			golden(t, "patch-"+tc.name, patch)
+
+			original, err := json.Marshal(ns)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := verifyPatch(original, patch, tc.annotations, tc.add); err != nil {
+				t.Errorf("verifyPatch rejected the canonical patch: %v", err)
+			}
+		})
+	}
+}
+
+func TestVerifyPatchRejects(t *testing.T) {
+	original := []byte(`{"metadata":{"name":"ns","labels":{"team":"a"},"annotations":{"owner":"team-a"}}}`)
+	want := map[string]string{ipv4PoolsAnnotation: `["pool-a"]`}
+	for name, patch := range map[string]string{
+		"not a patch":         `{}`,
+		"unappliable":         `[{"op":"replace","path":"/metadata/missing/key","value":"x"}]`,
+		"wrong value":         `[{"op":"add","path":"/metadata/annotations/cni.projectcalico.org~1ipv4pools","value":"[\"pool-b\"]"}]`,
+		"unescaped key":       `[{"op":"add","path":"/metadata/annotations/cni.projectcalico.org/ipv4pools","value":"[\"pool-a\"]"}]`,
+		"replaced map":        `[{"op":"add","path":"/metadata/annotations","value":{"cni.projectcalico.org/ipv4pools":"[\"pool-a\"]"}}]`,
+		"changed annotation":  `[{"op":"add","path":"/metadata/annotations/cni.projectcalico.org~1ipv4pools","value":"[\"pool-a\"]"},{"op":"replace","path":"/metadata/annotations/owner","value":"team-b"}]`,
+		"extra annotation":    `[{"op":"add","path":"/metadata/annotations/cni.projectcalico.org~1ipv4pools","value":"[\"pool-a\"]"},{"op":"add","path":"/metadata/annotations/extra","value":"x"}]`,
+		"added finalizer":     `[{"op":"add","path":"/metadata/annotations/cni.projectcalico.org~1ipv4pools","value":"[\"pool-a\"]"},{"op":"add","path":"/metadata/finalizers","value":["x"]}]`,
+		"changed other field": `[{"op":"add","path":"/metadata/annotations/cni.projectcalico.org~1ipv4pools","value":"[\"pool-a\"]"},{"op":"remove","path":"/metadata/labels/team"}]`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			if err := verifyPatch(original, []byte(patch), want, nil); err == nil {
+				t.Error("verifyPatch accepted a wrong patch")
+			}
+		})
+	}
+}
@@ -0,0 +1,242 @@
+package admission
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+
+	"go.uber.org/zap"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// poolPinningLabel on a pod asks for its namespace's pools to be stamped on
+// it as its own ipv4pools annotation, so that a workload stays on the pools
+// it was created with, e.g. when the namespace grows, without naming them.
+// The value picks the pools: all of them, or the first or last assigned.
+const poolPinningLabel = "ipam.example.com/pool-pinning"
+
+// Values of poolPinningLabel.
+const (
+	poolPinningAll   = "all"
+	poolPinningFirst = "first"
+	poolPinningLast  = "last"
+)
+
+// PoolClassAnnotation on a pod, or on the Deployment or ReplicaSet owning
+// it, requests the pools of a configured pool class, e.g. "dmz", instead of
+// the namespace's own.
+const PoolClassAnnotation = "ipam.example.com/pool-class"
+
+// handlePodCreation stamps an ipv4pools annotation on a pod that asks for one:
+// the pools of its pool class, or its namespace's pools when it carries
+// poolPinningLabel. Other pods, and pinned pods with an ipv4pools annotation
+// of their own, are admitted untouched. Pods get a webhook rule of their own,
+// which should select them by poolPinningLabel with an objectSelector unless
+// pool classes are configured, so that no other pod creation waits on the
+// webhook. With pool classes configured, an ipv4pools annotation of the pod's
+// own may only name its namespace's pools and those of its tenant's allowed
+// classes.
+func (a *AdmissionController) handlePodCreation(ctx context.Context, w http.ResponseWriter, req *admissionv1.AdmissionRequest, admissionResponse *admissionv1.AdmissionResponse) {
+	var pod corev1.Pod
+	if err := json.Unmarshal(req.Object.Raw, &pod); err != nil {
+		a.denyMalformedObject(w, admissionResponse, "pod", err)
+		return
+	}
+	class, err := a.podPoolClass(ctx, req.Namespace, &pod)
+	if err != nil {
+		a.Logger.Error("could not resolve pool class of pod", zap.String("namespace", req.Namespace), zap.Error(err))
+		a.deny(w, req, admissionResponse, denial(statusInternalError, "could not resolve pool class: %v", err), nil)
+		return
+	}
+	pinning, pinned := pod.Labels[poolPinningLabel]
+	_, ownPools := pod.Annotations[ipv4PoolsAnnotation]
+	if class == "" && ownPools && len(a.Config.PoolClasses) > 0 {
+		a.checkPodPools(ctx, w, req, admissionResponse, &pod)
+		return
+	}
+	if class == "" && (!pinned || ownPools) {
+		a.writeAdmissionResponse(w, admissionResponse)
+		return
+	}
+	if class != "" && ownPools {
+		a.deny(w, req, admissionResponse, denial(statusPoolClassNotAllowed, "Pool class %q cannot be combined with an %s annotation.", class, ipv4PoolsAnnotation), nil)
+		return
+	}
+	if class == "" && pinning != poolPinningAll && pinning != poolPinningFirst && pinning != poolPinningLast {
+		a.deny(w, req, admissionResponse, denial(statusInvalidPoolPinning, "invalid %s label %q: must be %s, %s or %s", poolPinningLabel, pinning, poolPinningAll, poolPinningFirst, poolPinningLast), nil)
+		return
+	}
+
+	ns, err := a.K8sReader.CoreV1().Namespaces().Get(ctx, req.Namespace, metav1.GetOptions{})
+	if err != nil {
+		a.Logger.Error("could not fetch namespace of pod", zap.String("namespace", req.Namespace), zap.Error(err))
+		a.deny(w, req, admissionResponse, denial(statusInternalError, "could not fetch namespace: %v", err), nil)
+		return
+	}
+
+	var pools []string
+	if class != "" {
+		if pinned {
+			addWarning(admissionResponse, "the %s label is ignored for a pod requesting pool class %q", poolPinningLabel, class)
+		}
+		var denied *metav1.Status
+		if pools, denied = a.poolClassPools(ctx, ns.Labels[a.Config.TenantLabel], class); denied != nil {
+			a.deny(w, req, admissionResponse, denied, nil)
+			return
+		}
+	} else {
+		if annotation := ns.Annotations[ipv4PoolsAnnotation]; annotation != "" {
+			if err := json.Unmarshal([]byte(annotation), &pools); err != nil {
+				a.writeInternalError(w, admissionResponse, "could not decode IP pool annotation of namespace %s: %v", ns.Name, err)
+				return
+			}
+		}
+		if len(pools) == 0 {
+			addWarning(admissionResponse, "namespace %s holds no IP pool, the pod was not pinned", ns.Name)
+			a.writeAdmissionResponse(w, admissionResponse)
+			return
+		}
+		switch pinning {
+		case poolPinningFirst:
+			pools = pools[:1]
+		case poolPinningLast:
+			pools = pools[len(pools)-1:]
+		}
+	}
+
+	annotation, err := json.Marshal(pools)
+	if err != nil {
+		a.writeInternalError(w, admissionResponse, "could not encode IP pool annotation: %v", err)
+		return
+	}
+	var patch []patchOperation
+	if pod.Annotations == nil {
+		patch = append(patch, patchOperation{Op: "add", Path: "/metadata/annotations", Value: map[string]string{}})
+	}
+	patch = append(patch, patchOperation{Op: "add", Path: annotationPath(ipv4PoolsAnnotation), Value: string(annotation)})
+	patchBytes, err := json.Marshal(patch)
+	if err != nil {
+		a.writeInternalError(w, admissionResponse, "could not marshal patch: %v", err)
+		return
+	}
+	admissionResponse.Patch = patchBytes
+	admissionResponse.PatchType = func() *admissionv1.PatchType {
+		pt := admissionv1.PatchTypeJSONPatch
+		return &pt
+	}()
+	name := pod.Name
+	if name == "" {
+		name = pod.GenerateName + "*"
+	}
+	a.Logger.Debug("Stamped IP pools on pod", zap.String("namespace", req.Namespace), zap.String("pod", name),
+		zap.String("poolClass", class), zap.Strings("pools", pools))
+	a.writeAdmissionResponse(w, admissionResponse)
+}
+
+// checkPodPools denies a pod whose own ipv4pools annotation names a pool
+// that is neither its namespace's nor one of its tenant's allowed pool
+// classes. Pods of exempt namespaces are admitted untouched.
+func (a *AdmissionController) checkPodPools(ctx context.Context, w http.ResponseWriter, req *admissionv1.AdmissionRequest, admissionResponse *admissionv1.AdmissionResponse, pod *corev1.Pod) {
+	var requested []string
+	if err := json.Unmarshal([]byte(pod.Annotations[ipv4PoolsAnnotation]), &requested); err != nil {
+		a.deny(w, req, admissionResponse, denial(statusInvalidPoolAnnotation, "invalid %s annotation: %v", ipv4PoolsAnnotation, err), nil)
+		return
+	}
+	ns, err := a.K8sReader.CoreV1().Namespaces().Get(ctx, req.Namespace, metav1.GetOptions{})
+	if err != nil {
+		a.Logger.Error("could not fetch namespace of pod", zap.String("namespace", req.Namespace), zap.Error(err))
+		a.deny(w, req, admissionResponse, denial(statusInternalError, "could not fetch namespace: %v", err), nil)
+		return
+	}
+	if a.Config.IsExempt(ns.Name, ns.Labels) {
+		a.writeAdmissionResponse(w, admissionResponse)
+		return
+	}
+
+	var allowed []string
+	if annotation := ns.Annotations[ipv4PoolsAnnotation]; annotation != "" {
+		if err := json.Unmarshal([]byte(annotation), &allowed); err != nil {
+			a.writeInternalError(w, admissionResponse, "could not decode IP pool annotation of namespace %s: %v", ns.Name, err)
+			return
+		}
+	}
+	tenant := ns.Labels[a.Config.TenantLabel]
+	t, _ := a.tenantPolicy(tenant)
+	for _, class := range t.AllowedPoolClasses {
+		pools, denied := a.poolClassPools(ctx, tenant, class)
+		if denied != nil && denied.Reason != statusPoolsExhausted && denied.Reason != statusPoolClassNotAllowed {
+			a.deny(w, req, admissionResponse, denied, nil)
+			return
+		}
+		allowed = append(allowed, pools...)
+	}
+	for _, pool := range requested {
+		if !slices.Contains(allowed, pool) {
+			a.Logger.Warn("Denying pod naming a pool outside its namespace and pool classes",
+				zap.String("namespace", req.Namespace), zap.String("pod", pod.Name), zap.String("poolName", pool))
+			a.deny(w, req, admissionResponse, denial(statusPoolNotAllowed, "Pool %s is neither a pool of namespace %s nor of a pool class tenant %q is allowed.", pool, ns.Name, tenant), nil)
+			return
+		}
+	}
+	a.writeAdmissionResponse(w, admissionResponse)
+}
+
+// podPoolClass returns the pool class the pod requests, from its own
+// annotation or else from the ReplicaSet owning it, which carries the
+// annotations of its Deployment. Without configured pool classes nothing is
+// looked up.
+func (a *AdmissionController) podPoolClass(ctx context.Context, namespace string, pod *corev1.Pod) (string, error) {
+	if len(a.Config.PoolClasses) == 0 {
+		return "", nil
+	}
+	if class := pod.Annotations[PoolClassAnnotation]; class != "" {
+		return class, nil
+	}
+	owner := metav1.GetControllerOf(pod)
+	if owner == nil || owner.Kind != "ReplicaSet" || owner.APIVersion != "apps/v1" {
+		return "", nil
+	}
+	rs, err := a.K8sReader.AppsV1().ReplicaSets(namespace).Get(ctx, owner.Name, metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("could not get ReplicaSet %s: %v", owner.Name, err)
+	}
+	return rs.Annotations[PoolClassAnnotation], nil
+}
+
+// poolClassPools returns the pools of a class in this zone, by name, or the
+// status to deny the pod with when the class is unknown, not allowed for the
+// tenant, or has no pool.
+func (a *AdmissionController) poolClassPools(ctx context.Context, tenant, class string) ([]string, *metav1.Status) {
+	poolClass, ok := a.Config.PoolClasses[class]
+	if !ok {
+		return nil, denial(statusPoolClassNotAllowed, "Unknown pool class %q.", class)
+	}
+	if t, _ := a.tenantPolicy(tenant); !slices.Contains(t.AllowedPoolClasses, class) {
+		return nil, denial(statusPoolClassNotAllowed, "Tenant %q is not allowed pool class %q.", tenant, class)
+	}
+	// Validated with the config
+	selector, _ := labels.Parse(poolClass.PoolSelector)
+	ipPools, err := a.listPools(ctx)
+	if err != nil {
+		return nil, denial(statusPoolListFailed, "could not list IP pools: %v", err)
+	}
+	var pools []string
+	for _, pool := range ipPools.Items {
+		poolLabels := normalizeLabels(pool.ObjectMeta.Labels)
+		if selector.Matches(labels.Set(pool.ObjectMeta.Labels)) && poolLabels["location"] == a.Config.Location && !poolCordoned(poolLabels) {
+			pools = append(pools, pool.Name)
+		}
+	}
+	if len(pools) == 0 {
+		return nil, denial(statusPoolsExhausted, "Pool class %q has no IP pool in zone %s.", class, a.Config.Location)
+	}
+	sort.Strings(pools)
+	return pools, nil
+}
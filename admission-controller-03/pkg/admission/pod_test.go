@@ -0,0 +1,101 @@
+package admission
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.uber.org/zap"
+
+	crdv1 "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
+	calicofake "github.com/projectcalico/api/pkg/client/clientset_generated/clientset/fake"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8sruntime "k8s.io/apimachinery/pkg/runtime"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+
+	"admission-controller-03/pkg/config"
+)
+
+func TestPodOwnPools(t *testing.T) {
+	pools := []k8sruntime.Object{
+		&crdv1.IPPool{ObjectMeta: metav1.ObjectMeta{Name: "dmz-1", Labels: map[string]string{"location": "zone-lhr", "class": "dmz"}}},
+		&crdv1.IPPool{ObjectMeta: metav1.ObjectMeta{Name: "pci-1", Labels: map[string]string{"location": "zone-lhr", "class": "pci"}}},
+		&crdv1.IPPool{ObjectMeta: metav1.ObjectMeta{Name: "team-b-1", Labels: map[string]string{"location": "zone-lhr", "status": "used"}}},
+	}
+	namespaces := []k8sruntime.Object{
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+			Name:        "web",
+			Labels:      map[string]string{"tenant": "team-a"},
+			Annotations: map[string]string{ipv4PoolsAnnotation: `["web-1"]`},
+		}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "kube-system"}},
+	}
+	cfg := config.Default()
+	cfg.Operations["Pod"] = []string{"CREATE"}
+	cfg.PoolClasses = map[string]config.PoolClass{"dmz": {PoolSelector: "class == dmz"}, "pci": {PoolSelector: "class == pci"}}
+	cfg.Tenants = map[string]config.Tenant{"team-a": {AllowedPoolClasses: []string{"dmz"}}}
+	a := NewAdmissionControllerFromClients(zap.NewNop(), cfg, calicofake.NewSimpleClientset(pools...), k8sfake.NewSimpleClientset(namespaces...))
+	a.Shutdown()
+	a.Recorder = &record.FakeRecorder{}
+
+	tests := []struct {
+		name       string
+		namespace  string
+		pools      string
+		wantReason metav1.StatusReason
+	}{
+		{name: "namespace pool", namespace: "web", pools: `["web-1"]`},
+		{name: "allowed class pool", namespace: "web", pools: `["web-1","dmz-1"]`},
+		{name: "class not allowed", namespace: "web", pools: `["pci-1"]`, wantReason: statusPoolNotAllowed},
+		{name: "other namespace's pool", namespace: "web", pools: `["team-b-1"]`, wantReason: statusPoolNotAllowed},
+		{name: "malformed annotation", namespace: "web", pools: `web-1`, wantReason: statusInvalidPoolAnnotation},
+		{name: "exempt namespace", namespace: "kube-system", pools: `["team-b-1"]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw, err := json.Marshal(&corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+				Name:        "pod",
+				Namespace:   tt.namespace,
+				Annotations: map[string]string{ipv4PoolsAnnotation: tt.pools},
+			}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := json.Marshal(admissionv1.AdmissionReview{
+				TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+				Request: &admissionv1.AdmissionRequest{
+					UID:       "uid-pod",
+					Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+					Namespace: tt.namespace,
+					Name:      "pod",
+					Operation: admissionv1.Create,
+					Object:    k8sruntime.RawExtension{Raw: raw},
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := httptest.NewRecorder()
+			a.HandleAdmissionReview(w, httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader(body)))
+			var out admissionv1.AdmissionReview
+			if err := json.Unmarshal(w.Body.Bytes(), &out); err != nil || out.Response == nil {
+				t.Fatalf("response is not an AdmissionReview: %v", err)
+			}
+			resp := out.Response
+			if tt.wantReason == "" {
+				if !resp.Allowed {
+					t.Errorf("denied: %v", resp.Result)
+				}
+				return
+			}
+			if resp.Allowed || resp.Result == nil || resp.Result.Reason != tt.wantReason {
+				t.Errorf("got allowed=%v %v, want %s", resp.Allowed, resp.Result, tt.wantReason)
+			}
+		})
+	}
+}
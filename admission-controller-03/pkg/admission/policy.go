@@ -0,0 +1,69 @@
+package admission
+
+import (
+	"context"
+
+	"go.uber.org/zap"
+
+	"admission-controller-03/pkg/policy"
+
+	crdv1 "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// checkPolicy has the configured OPA policy decide on the pool selected for
+// a namespace, before it is locked and assigned. It returns the pool to
+// assign, which the policy may have overridden, or the status to deny the
+// request with. An overriding pool must be one of the listed pools, available
+// in this zone and not cordoned; whether it suits the namespace is up to the
+// policy.
+func (a *AdmissionController) checkPolicy(ctx context.Context, ns *corev1.Namespace, tenant, poolName string, requested bool, pools []crdv1.IPPool) (string, *metav1.Status) {
+	if a.Policy == nil {
+		return poolName, nil
+	}
+	poolCIDR, err := a.poolCIDR(ctx, poolName, pools)
+	if err != nil {
+		return "", denial(statusPoolCIDRUnresolved, "could not resolve CIDR of IP pool %s: %v", poolName, err)
+	}
+	name := namespaceName(&admissionv1.AdmissionRequest{}, ns)
+	decision, err := a.Policy.Evaluate(ctx, policy.Input{
+		Namespace:       name,
+		NamespaceLabels: ns.Labels,
+		Tenant:          tenant,
+		Pool:            poolName,
+		CIDR:            poolCIDR,
+		Zone:            a.Config.Location,
+		Requested:       requested,
+	})
+	if err != nil {
+		a.Logger.Error("could not evaluate allocation policy", zap.String("poolName", poolName), zap.Error(err))
+		return "", denial(statusPolicyFailed, "could not evaluate allocation policy: %v", err)
+	}
+	if !decision.Allow {
+		a.Logger.Info("Allocation policy denied the assignment", zap.String("namespace", name), zap.String("poolName", poolName), zap.String("reason", decision.Reason))
+		if decision.Reason == "" {
+			return "", denial(statusPolicyDenied, "Assigning IP pool %s is denied by the allocation policy.", poolName)
+		}
+		return "", denial(statusPolicyDenied, "Assigning IP pool %s is denied by the allocation policy: %s", poolName, decision.Reason)
+	}
+	if decision.Pool == "" || decision.Pool == poolName {
+		return poolName, nil
+	}
+
+	for _, pool := range pools {
+		if pool.Name != decision.Pool {
+			continue
+		}
+		poolLabels := normalizeLabels(pool.ObjectMeta.Labels)
+		if poolLabels["status"] != "available" || poolLabels["location"] != a.Config.Location || poolCordoned(poolLabels) {
+			break
+		}
+		a.Logger.Info("Allocation policy overrode the selected pool", zap.String("namespace", name),
+			zap.String("selected", poolName), zap.String("poolName", decision.Pool), zap.String("reason", decision.Reason))
+		return decision.Pool, nil
+	}
+	a.Logger.Error("Allocation policy overrode the selected pool with an unassignable one", zap.String("namespace", name), zap.String("poolName", decision.Pool))
+	return "", denial(statusPolicyFailed, "The allocation policy chose IP pool %s, which is not available in zone %s.", decision.Pool, a.Config.Location)
+}
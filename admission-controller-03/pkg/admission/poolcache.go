@@ -0,0 +1,113 @@
+package admission
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	crdv1 "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+)
+
+// poolZoneStatusIndex indexes the cached pools by zone and status label.
+const poolZoneStatusIndex = "ipam.example.com/zone-status"
+
+func poolZoneStatus(zone, status string) string {
+	return zone + "/" + status
+}
+
+// SetupPoolCache makes namespace admission select pools from the manager's
+// informer cache, which every replica runs, rather than list them from the
+// API server on every CREATE. The cache may lag a concurrent assignment by
+// another replica: a selected pool is confirmed against the API server before
+// it is taken, and the label update is conditional on the pool being
+// unchanged since, see assignPool.
+func (a *AdmissionController) SetupPoolCache(mgr manager.Manager) error {
+	err := mgr.GetFieldIndexer().IndexField(context.Background(), &crdv1.IPPool{}, poolZoneStatusIndex, func(o client.Object) []string {
+		poolLabels := normalizeLabels(o.GetLabels())
+		return []string{poolZoneStatus(poolLabels["location"], poolLabels["status"])}
+	})
+	if err != nil {
+		return fmt.Errorf("could not index IP pools: %v", err)
+	}
+	a.PoolCache = mgr.GetCache()
+	return nil
+}
+
+// listPools lists the pools from the cache, or from the API server when there
+// is none yet.
+func (a *AdmissionController) listPools(ctx context.Context) (*crdv1.IPPoolList, error) {
+	if pools, cached, err := a.cachedPools(ctx); cached {
+		return pools, err
+	}
+	return a.CalicoReader.ProjectcalicoV3().IPPools().List(ctx, metav1.ListOptions{})
+}
+
+// poolsIn lists the pools of a zone with the given status.
+func (a *AdmissionController) poolsIn(ctx context.Context, zone, status string) ([]crdv1.IPPool, error) {
+	if pools, cached, err := a.cachedPools(ctx, client.MatchingFields{poolZoneStatusIndex: poolZoneStatus(zone, status)}); cached {
+		if err != nil {
+			return nil, err
+		}
+		return pools.Items, nil
+	}
+	pools, err := a.CalicoReader.ProjectcalicoV3().IPPools().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	var matching []crdv1.IPPool
+	for _, pool := range pools.Items {
+		poolLabels := normalizeLabels(pool.ObjectMeta.Labels)
+		if poolLabels["location"] == zone && poolLabels["status"] == status {
+			matching = append(matching, pool)
+		}
+	}
+	return matching, nil
+}
+
+// cachedPools lists the pools from the cache. It reports false when there is
+// no cache, or the manager has not started it yet: the webhook server starts
+// first.
+func (a *AdmissionController) cachedPools(ctx context.Context, opts ...client.ListOption) (*crdv1.IPPoolList, bool, error) {
+	if a.PoolCache == nil {
+		return nil, false, nil
+	}
+	var pools crdv1.IPPoolList
+	err := a.PoolCache.List(ctx, &pools, opts...)
+	var notStarted *cache.ErrCacheNotStarted
+	if errors.As(err, &notStarted) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, true, fmt.Errorf("could not list cached IP pools: %v", err)
+	}
+	return &pools, true, nil
+}
+
+// confirmPoolAvailable reads a pool selected from the cache from the API
+// server and returns errPoolLocked when it was taken, or deleted, in the
+// meantime. Without a cache the selection is already live.
+func (a *AdmissionController) confirmPoolAvailable(ctx context.Context, poolName string) error {
+	if a.PoolCache == nil {
+		return nil
+	}
+	if _, carved := carvedCIDR(ctx, poolName); carved {
+		// Only exists in this dry run
+		return nil
+	}
+	pool, err := a.CalicoReader.ProjectcalicoV3().IPPools().Get(ctx, poolName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return errPoolLocked
+	}
+	if err != nil {
+		return fmt.Errorf("could not get IP pool: %v", err)
+	}
+	if poolLabels := normalizeLabels(pool.ObjectMeta.Labels); poolLabels["status"] != "available" || poolCordoned(poolLabels) {
+		return errPoolLocked
+	}
+	return nil
+}
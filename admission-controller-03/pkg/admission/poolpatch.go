@@ -0,0 +1,56 @@
+package admission
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	jsonpatch "gopkg.in/evanphx/json-patch.v4"
+
+	crdv1 "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// fieldManager identifies the webhook's writes in managedFields.
+const fieldManager = "ipam-webhook"
+
+// patchIPPool writes only the fields that differ between original and
+// modified as a merge patch, so fields other controllers manage on the pool
+// are never clobbered. The patch carries the original resourceVersion: if the
+// pool changed since it was read the API server rejects it with a conflict,
+// exactly like an Update would.
+func (a *AdmissionController) patchIPPool(ctx context.Context, original, modified *crdv1.IPPool) error {
+	before, err := json.Marshal(original)
+	if err != nil {
+		return fmt.Errorf("could not encode IP pool: %v", err)
+	}
+	after, err := json.Marshal(modified)
+	if err != nil {
+		return fmt.Errorf("could not encode IP pool: %v", err)
+	}
+	patch, err := jsonpatch.CreateMergePatch(before, after)
+	if err != nil {
+		return fmt.Errorf("could not build IP pool patch: %v", err)
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal(patch, &fields); err != nil {
+		return fmt.Errorf("could not decode IP pool patch: %v", err)
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	metadata, _ := fields["metadata"].(map[string]interface{})
+	if metadata == nil {
+		metadata = map[string]interface{}{}
+		fields["metadata"] = metadata
+	}
+	metadata["resourceVersion"] = original.ResourceVersion
+	if patch, err = json.Marshal(fields); err != nil {
+		return fmt.Errorf("could not encode IP pool patch: %v", err)
+	}
+
+	_, err = a.Clientset.ProjectcalicoV3().IPPools().Patch(ctx, original.Name, types.MergePatchType, patch, metav1.PatchOptions{FieldManager: fieldManager})
+	return err
+}
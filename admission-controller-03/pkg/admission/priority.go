@@ -0,0 +1,65 @@
+package admission
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	"go.uber.org/zap"
+
+	"admission-controller-03/pkg/cidr"
+	"admission-controller-03/pkg/config"
+
+	crdv1 "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
+)
+
+// poolPriorityLabel lets operators prefer some pools over others, e.g. pools
+// on newer hardware. Higher values are tried first; missing means 0.
+const poolPriorityLabel = "ipam.example.com/priority"
+
+func poolPriority(pool crdv1.IPPool) int {
+	value, ok := normalizeLabels(pool.ObjectMeta.Labels)[poolPriorityLabel]
+	if !ok {
+		return 0
+	}
+	priority, err := strconv.Atoi(value)
+	if err != nil {
+		return 0
+	}
+	return priority
+}
+
+// rankPools orders candidate pools by priority, then by the configured
+// strategy, with the pool name as the final deterministic tie-breaker. The
+// applied ordering is logged as an explain trace at debug level.
+func (a *AdmissionController) rankPools(pools []crdv1.IPPool) []crdv1.IPPool {
+	ranked := make([]crdv1.IPPool, len(pools))
+	copy(ranked, pools)
+
+	sort.SliceStable(ranked, func(i, j int) bool {
+		pi, pj := poolPriority(ranked[i]), poolPriority(ranked[j])
+		if pi != pj {
+			return pi > pj
+		}
+		if a.Config.Strategy == config.StrategyLowestCIDR {
+			if c := cidr.Compare(ranked[i].Spec.CIDR, ranked[j].Spec.CIDR); c != 0 {
+				return c < 0
+			}
+		}
+		return ranked[i].Name < ranked[j].Name
+	})
+
+	// Every admission ranks the whole candidate list, so the trace is only
+	// built at debug level
+	if !a.Logger.Core().Enabled(zap.DebugLevel) {
+		return ranked
+	}
+	trace := make([]string, 0, len(ranked))
+	for _, pool := range ranked {
+		trace = append(trace, fmt.Sprintf("%s(priority=%d,cidr=%s)", pool.Name, poolPriority(pool), pool.Spec.CIDR))
+	}
+	a.Logger.Debug("Explain: candidate pool ordering",
+		zap.String("strategy", a.Config.Strategy),
+		zap.Strings("order", trace))
+	return ranked
+}
@@ -0,0 +1,71 @@
+package admission
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+
+	"go.uber.org/zap"
+
+	"admission-controller-03/pkg/cni"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// protectedAnnotations are written by the webhook at creation and may
+// afterwards only be changed by the configured annotation editors.
+var protectedAnnotations = []string{
+	ipv4PoolsAnnotation,
+	PolicyVersionAnnotation,
+	WebhookVersionAnnotation,
+	CIDRAnnotation,
+	requestAnnotation,
+	claimAnnotation,
+	cni.CiliumPoolAnnotation,
+	EgressPoolAnnotation,
+	EgressCIDRAnnotation,
+	egressSelectorAnnotation,
+}
+
+// handleNamespaceUpdate denies updates that add, change or remove a protected
+// annotation, unless they come from an allowed user or group, or from our own
+// write identity.
+func (a *AdmissionController) handleNamespaceUpdate(w http.ResponseWriter, req *admissionv1.AdmissionRequest, admissionResponse *admissionv1.AdmissionResponse) {
+	var oldNs, newNs corev1.Namespace
+	if err := json.Unmarshal(req.OldObject.Raw, &oldNs); err != nil {
+		a.denyMalformedObject(w, admissionResponse, "old namespace", err)
+		return
+	}
+	if err := json.Unmarshal(req.Object.Raw, &newNs); err != nil {
+		a.denyMalformedObject(w, admissionResponse, "namespace", err)
+		return
+	}
+
+	changed := changedAnnotations(oldNs.Annotations, newNs.Annotations)
+	if len(changed) == 0 || a.isAnnotationEditor(req) {
+		a.writeAdmissionResponse(w, admissionResponse)
+		return
+	}
+
+	a.Logger.Warn("Denying change to protected namespace annotations",
+		zap.String("namespace", req.Name), zap.String("user", req.UserInfo.Username), zap.Strings("annotations", changed))
+	admissionResponse.Allowed = false
+	admissionResponse.Result = denial(statusProtectedAnnotation, "The annotations %v are managed by the IP pool webhook and cannot be changed by %s.", changed, req.UserInfo.Username)
+	a.writeAdmissionResponse(w, admissionResponse)
+}
+
+// changedAnnotations returns the protected annotations whose presence or
+// value differs between two annotation sets, in sorted order.
+func changedAnnotations(before, after map[string]string) []string {
+	var changed []string
+	for _, key := range protectedAnnotations {
+		oldValue, hadOld := before[key]
+		newValue, hasNew := after[key]
+		if hadOld != hasNew || oldValue != newValue {
+			changed = append(changed, key)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
@@ -0,0 +1,172 @@
+package admission
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+
+	"admission-controller-03/pkg/config"
+
+	crdv1 "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// errDriftResolved aborts a repair when the pool changed since it was found
+// drifted, i.e. someone else already put it right.
+var errDriftResolved = errors.New("pool no longer drifted")
+
+// repairUnreferencedPool releases a pool marked used that no namespace
+// references. The owning namespace is re-read first: the scan lists pools
+// before namespaces, so a pool grown in between is referenced by now. Pools
+// assigned within the reservation TTL are left for RunPoolBinder.
+func (a *AdmissionController) repairUnreferencedPool(ctx context.Context, pool crdv1.IPPool) bool {
+	if !a.enforceDrift() {
+		return false
+	}
+	owner, assignedAt := poolOwner(pool)
+	if owner == "" {
+		// Nothing to check the pool against, an operator has to decide
+		return false
+	}
+	if !assignedAt.IsZero() && time.Since(assignedAt) < time.Duration(a.Config.ReservationTTLSeconds)*time.Second {
+		return false
+	}
+	ns, err := a.K8sReader.CoreV1().Namespaces().Get(ctx, owner, metav1.GetOptions{})
+	switch {
+	case apierrors.IsNotFound(err):
+	case err != nil:
+		a.Logger.Error("could not check owner of unreferenced pool", zap.String("poolName", pool.Name), zap.Error(err))
+		return false
+	case referencesPool(ns, pool.Name):
+		return false
+	}
+
+	err = a.updateIPPool(ctx, pool.Name, func(ipPool *crdv1.IPPool) error {
+		labels := normalizeLabels(ipPool.ObjectMeta.Labels)
+		if labels["status"] != "used" || labels[poolNamespaceLabel] != owner {
+			return errDriftResolved
+		}
+		labels["status"] = "available"
+		for _, key := range ownershipLabels {
+			delete(labels, key)
+		}
+		ipPool.ObjectMeta.Labels = labels
+		return nil
+	})
+	if errors.Is(err, errDriftResolved) {
+		return false
+	}
+	if err != nil {
+		a.Logger.Error("could not release unreferenced pool", zap.String("poolName", pool.Name), zap.Error(err))
+		return false
+	}
+	a.Logger.Warn("Repaired drift: released pool no namespace references",
+		zap.String("poolName", pool.Name), zap.String("owner", owner), zap.Time("assignedAt", assignedAt))
+	return true
+}
+
+// repairReferencedPool claims an available pool for the namespace that
+// references it, so that it is not handed out a second time. Only namespaces
+// the webhook assigned are trusted with this; a hand-written annotation is
+// merely reported.
+func (a *AdmissionController) repairReferencedPool(ctx context.Context, ns corev1.Namespace, poolName string) bool {
+	if !a.enforceDrift() || ns.Annotations[requestAnnotation] == "" || ns.DeletionTimestamp != nil {
+		return false
+	}
+	lease, err := a.lockPool(ctx, poolName, "reconcile/"+ns.Name)
+	if errors.Is(err, errPoolLocked) {
+		return false
+	}
+	if err != nil {
+		a.Logger.Error("could not lock pool for repair", zap.String("poolName", poolName), zap.Error(err))
+		return false
+	}
+	defer a.unlockPool(ctx, lease)
+
+	owner := map[string]string{
+		poolNamespaceLabel:  ns.Name,
+		poolRequestLabel:    ns.Annotations[requestAnnotation],
+		poolAssignedAtLabel: strconv.FormatInt(time.Now().Unix(), 10),
+	}
+	if tenant := ns.Labels[a.Config.TenantLabel]; tenant != "" {
+		owner[poolTenantLabel] = tenant
+	}
+	if err := a.assignPool(ctx, poolName, "used", owner, nil); err != nil {
+		if !errors.Is(err, errPoolLocked) {
+			a.Logger.Error("could not claim referenced pool", zap.String("namespace", ns.Name), zap.String("poolName", poolName), zap.Error(err))
+		}
+		return false
+	}
+	a.Logger.Warn("Repaired drift: claimed available pool the namespace references",
+		zap.String("namespace", ns.Name), zap.String("poolName", poolName))
+	return true
+}
+
+// repairDanglingOwner drops ownership labels left on an available pool, which
+// would otherwise make it look bound in listings and to verifyPoolOwner.
+func (a *AdmissionController) repairDanglingOwner(ctx context.Context, pool crdv1.IPPool) bool {
+	dangling := danglingOwnerLabels(pool)
+	if !a.enforceDrift() || len(dangling) == 0 {
+		return false
+	}
+
+	err := a.updateIPPool(ctx, pool.Name, func(ipPool *crdv1.IPPool) error {
+		labels := normalizeLabels(ipPool.ObjectMeta.Labels)
+		if labels["status"] != "available" {
+			return errDriftResolved
+		}
+		for _, key := range ownershipLabels {
+			delete(labels, key)
+		}
+		ipPool.ObjectMeta.Labels = labels
+		return nil
+	})
+	if errors.Is(err, errDriftResolved) {
+		return false
+	}
+	if err != nil {
+		a.Logger.Error("could not drop dangling owner labels", zap.String("poolName", pool.Name), zap.Error(err))
+		return false
+	}
+	a.Logger.Warn("Repaired drift: dropped owner labels from available pool",
+		zap.String("poolName", pool.Name), zap.Strings("labels", dangling))
+	return true
+}
+
+// danglingOwnerLabels returns the ownership labels set on a pool.
+func danglingOwnerLabels(pool crdv1.IPPool) []string {
+	var dangling []string
+	poolLabels := normalizeLabels(pool.ObjectMeta.Labels)
+	for _, key := range ownershipLabels {
+		if _, ok := poolLabels[key]; ok {
+			dangling = append(dangling, key)
+		}
+	}
+	return dangling
+}
+
+// enforceDrift reports whether drift is repaired, rather than only reported.
+func (a *AdmissionController) enforceDrift() bool {
+	return a.Config.DriftMode != config.DriftModeReport
+}
+
+// referencesPool reports whether the namespace's ipv4pools annotation names
+// the pool.
+func referencesPool(ns *corev1.Namespace, poolName string) bool {
+	var pools []string
+	if err := json.Unmarshal([]byte(ns.Annotations[ipv4PoolsAnnotation]), &pools); err != nil {
+		return false
+	}
+	for _, pool := range pools {
+		if pool == poolName {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,90 @@
+package admission
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"go.uber.org/zap"
+
+	"admission-controller-03/pkg/cidr"
+	"admission-controller-03/pkg/region"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// inLocalRegion reports whether a pool may be allocated by this region. Pools
+// outside the shared supernet are local to the cluster and always allowed.
+// Pools a peer region reports are refused even inside the local range: two
+// regions with diverging member lists would otherwise both hand them out.
+func (a *AdmissionController) inLocalRegion(poolCIDR string) bool {
+	r := a.Config.Region
+	if r == nil || !cidr.Contains(r.Supernet, poolCIDR) {
+		return true
+	}
+	localRange, err := r.Range()
+	if err != nil || !cidr.Contains(localRange, poolCIDR) {
+		return false
+	}
+	if a.RegionState != nil {
+		if peer, ok := a.RegionState.Claimed(r.Name, poolCIDR); ok {
+			a.Logger.Warn("Refusing pool a peer region reports",
+				zap.String("cidr", poolCIDR), zap.String("region", peer.Region), zap.String("peerPool", peer.Pool))
+			return false
+		}
+	}
+	return true
+}
+
+// HandleRegionSync serves the region state to peers allowed to get
+// regions.ipam.example.com.
+func (a *AdmissionController) HandleRegionSync(syncer *region.Syncer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := a.authorizeAPI(w, r, apiAccess{resource: apiResourceRegions, verb: "get"}); !ok {
+			return
+		}
+		syncer.HandleSync(w, r)
+	}
+}
+
+// regionCarveParent narrows a parent CIDR that spans the shared supernet down
+// to this region's range, so aggregates are only carved where we own space.
+func (a *AdmissionController) regionCarveParent(parent string) string {
+	r := a.Config.Region
+	if r == nil {
+		return parent
+	}
+	localRange, err := r.Range()
+	if err != nil || !cidr.Contains(parent, localRange) {
+		return parent
+	}
+	return localRange
+}
+
+// RegionEntries reports the pools this region owns, for anti-entropy sync
+// with the other regions.
+func (a *AdmissionController) RegionEntries(ctx context.Context) ([]region.Entry, error) {
+	localRange, err := a.Config.Region.Range()
+	if err != nil {
+		return nil, err
+	}
+	ipPools, err := a.CalicoReader.ProjectcalicoV3().IPPools().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("could not list IP pools: %v", err)
+	}
+
+	var entries []region.Entry
+	for _, pool := range ipPools.Items {
+		if !cidr.Contains(localRange, pool.Spec.CIDR) {
+			continue
+		}
+		poolLabels := normalizeLabels(pool.ObjectMeta.Labels)
+		entries = append(entries, region.Entry{
+			CIDR:   pool.Spec.CIDR,
+			Pool:   pool.Name,
+			Status: poolLabels["status"],
+			Tenant: poolLabels[poolTenantLabel],
+		})
+	}
+	return entries, nil
+}
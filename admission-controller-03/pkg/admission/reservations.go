@@ -0,0 +1,220 @@
+package admission
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"admission-controller-03/pkg/cidr"
+	"admission-controller-03/pkg/config"
+
+	crdv1 "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// reservationReconciler keeps an IPReservation, named after the pool, for
+// every assigned pool with reserved ranges: the global ones and those of the
+// namespace's tenant. Reservations are deleted when their pool is released.
+type reservationReconciler struct {
+	a *AdmissionController
+	// cache is the manager's informer cache
+	cache client.Reader
+}
+
+// SetupReservationController registers the reservation reconciler with the
+// manager. Tenant resources may declare ranges at any time, so it runs even
+// when the config file declares none, unless the identities lack the
+// IPReservation permissions. A reservation edited or deleted by hand is
+// restored.
+func (a *AdmissionController) SetupReservationController(mgr manager.Manager) error {
+	if a.skipReservations {
+		return nil
+	}
+	return builder.ControllerManagedBy(mgr).
+		Named("reservation").
+		For(&corev1.Namespace{}).
+		Watches(&crdv1.IPReservation{}, handler.EnqueueRequestsFromMapFunc(func(_ context.Context, o client.Object) []reconcile.Request {
+			if namespace := o.GetLabels()[poolNamespaceLabel]; namespace != "" {
+				return []reconcile.Request{{NamespacedName: types.NamespacedName{Name: namespace}}}
+			}
+			return nil
+		})).
+		Complete(&reservationReconciler{a: a, cache: mgr.GetCache()})
+}
+
+func (r *reservationReconciler) Reconcile(ctx context.Context, req reconcile.Request) (reconcile.Result, error) {
+	var ns corev1.Namespace
+	if err := r.cache.Get(ctx, req.NamespacedName, &ns); err != nil {
+		return reconcile.Result{}, client.IgnoreNotFound(err)
+	}
+	if ns.DeletionTimestamp != nil {
+		// Deleted on release, once the pools are free
+		return reconcile.Result{}, nil
+	}
+
+	var names []string
+	if annotation := ns.Annotations[ipv4PoolsAnnotation]; annotation != "" {
+		if err := json.Unmarshal([]byte(annotation), &names); err != nil {
+			// Rejected at admission; nothing to reserve in until fixed
+			r.a.Logger.Warn("Failed to decode IP pool annotation", zap.String("namespace", ns.Name), zap.Error(err))
+			return reconcile.Result{}, nil
+		}
+	}
+	tenant, _ := r.a.tenantPolicy(ns.Labels[r.a.Config.TenantLabel])
+	ranges := append(append([]config.ReservedRange{}, r.a.Config.Reservations...), tenant.Reservations...)
+
+	var errs []error
+	for _, name := range names {
+		var pool crdv1.IPPool
+		err := r.cache.Get(ctx, types.NamespacedName{Name: name}, &pool)
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return reconcile.Result{}, fmt.Errorf("could not get IP pool %s: %v", name, err)
+		}
+		errs = append(errs, r.ensureReservation(ctx, ns.Name, &pool, reservedCIDRs(pool.Spec.CIDR, ranges)))
+	}
+
+	// Reservations of pools the namespace no longer holds
+	var reservations crdv1.IPReservationList
+	if err := r.cache.List(ctx, &reservations, client.MatchingLabels{poolNamespaceLabel: ns.Name, managedByLabel: managedBy}); err != nil {
+		return reconcile.Result{}, fmt.Errorf("could not list IP reservations: %v", err)
+	}
+	for _, reservation := range reservations.Items {
+		if !slices.Contains(names, reservation.Labels[allocationPoolLabel]) {
+			errs = append(errs, r.a.deleteReservation(ctx, reservation.Name))
+		}
+	}
+	return reconcile.Result{}, errors.Join(errs...)
+}
+
+// reservedCIDRs returns the ranges that fit in the pool, without duplicates.
+func reservedCIDRs(poolCIDR string, ranges []config.ReservedRange) []string {
+	var reserved []string
+	for _, r := range ranges {
+		subnet, err := cidr.Edge(poolCIDR, r.PrefixLength, r.Position == config.ReservedLast)
+		if err != nil {
+			// The pool is not larger than the range
+			continue
+		}
+		if !slices.Contains(reserved, subnet) {
+			reserved = append(reserved, subnet)
+		}
+	}
+	return reserved
+}
+
+// ensureReservation creates, updates or deletes the pool's reservation so it
+// holds exactly the reserved CIDRs.
+func (r *reservationReconciler) ensureReservation(ctx context.Context, namespace string, pool *crdv1.IPPool, reserved []string) error {
+	var existing crdv1.IPReservation
+	err := r.cache.Get(ctx, types.NamespacedName{Name: pool.Name}, &existing)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("could not get IP reservation: %v", err)
+	}
+	found := err == nil
+	if found && existing.Labels[managedByLabel] != managedBy {
+		r.a.Logger.Warn("IP reservation named after an assigned pool is someone else's, leaving it", zap.String("reservation", existing.Name))
+		return nil
+	}
+	if len(reserved) == 0 {
+		if found {
+			return r.a.deleteReservation(ctx, pool.Name)
+		}
+		return nil
+	}
+
+	labels := map[string]string{poolNamespaceLabel: namespace, allocationPoolLabel: pool.Name, managedByLabel: managedBy}
+	switch {
+	case !found:
+		reservation := &crdv1.IPReservation{
+			ObjectMeta: metav1.ObjectMeta{Name: pool.Name, Labels: labels},
+			Spec:       crdv1.IPReservationSpec{ReservedCIDRs: reserved},
+		}
+		_, err = r.a.Clientset.ProjectcalicoV3().IPReservations().Create(ctx, reservation, metav1.CreateOptions{FieldManager: fieldManager})
+	case slices.Equal(existing.Spec.ReservedCIDRs, reserved) && existing.Labels[poolNamespaceLabel] == namespace && existing.Labels[allocationPoolLabel] == pool.Name:
+		return nil
+	default:
+		reservation := existing.DeepCopy()
+		reservation.Labels, reservation.Spec.ReservedCIDRs = labels, reserved
+		_, err = r.a.Clientset.ProjectcalicoV3().IPReservations().Update(ctx, reservation, metav1.UpdateOptions{FieldManager: fieldManager})
+	}
+	if err != nil {
+		return fmt.Errorf("could not write IP reservation %s: %v", pool.Name, err)
+	}
+	r.a.Logger.Info("Wrote IP reservation of assigned pool", zap.String("namespace", namespace),
+		zap.String("poolName", pool.Name), zap.Strings("reserved", reserved))
+	return nil
+}
+
+func (a *AdmissionController) deleteReservation(ctx context.Context, name string) error {
+	err := a.Clientset.ProjectcalicoV3().IPReservations().Delete(ctx, name, metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("could not delete IP reservation %s: %v", name, err)
+	}
+	return nil
+}
+
+// releaseReservations deletes the reservation the controller keeps for a pool
+// that is being released. The release is refused while reservations made by
+// anyone else cover part of the pool: its next owner would be handed
+// addresses that were set aside. Without the IPReservation permissions
+// nothing is checked.
+func (a *AdmissionController) releaseReservations(ctx context.Context, pool *crdv1.IPPool) error {
+	if a.skipReservations {
+		return nil
+	}
+	reservations, err := a.CalicoReader.ProjectcalicoV3().IPReservations().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("could not list IP reservations: %v", err)
+	}
+	var ours, blocking []string
+	for _, reservation := range reservations.Items {
+		if reservation.Labels[managedByLabel] == managedBy {
+			if reservation.Labels[allocationPoolLabel] == pool.Name {
+				ours = append(ours, reservation.Name)
+			}
+			continue
+		}
+		for _, reserved := range reservation.Spec.ReservedCIDRs {
+			if overlapsPool(pool.Spec.CIDR, reserved) {
+				blocking = append(blocking, reservation.Name)
+				break
+			}
+		}
+	}
+	if len(blocking) > 0 {
+		return fmt.Errorf("IP pool %s is covered by IP reservations %s, delete them first", pool.Name, strings.Join(blocking, ", "))
+	}
+	for _, name := range ours {
+		if err := a.deleteReservation(ctx, name); err != nil {
+			return err
+		}
+		a.Logger.Info("Deleted IP reservation of released pool", zap.String("reservation", name), zap.String("poolName", pool.Name))
+	}
+	return nil
+}
+
+// overlapsPool reports whether a reserved CIDR or address lies in the pool.
+func overlapsPool(poolCIDR, reserved string) bool {
+	if addr, err := netip.ParseAddr(reserved); err == nil {
+		reserved = netip.PrefixFrom(addr, addr.BitLen()).String()
+	}
+	overlaps, err := cidr.Overlaps(poolCIDR, reserved)
+	return err == nil && overlaps
+}
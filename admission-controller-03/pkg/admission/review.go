@@ -0,0 +1,84 @@
+package admission
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"go.uber.org/zap"
+
+	"admission-common/admissionreview"
+
+	admissionv1 "k8s.io/api/admission/v1"
+)
+
+// maxReviewBytes bounds the body of an AdmissionReview. It holds the object
+// and, on updates, the old object, each at most etcd's 1.5 MiB request limit.
+const maxReviewBytes = 7 << 20
+
+// decodeAdmissionReview reads an AdmissionReview and checks that it carries
+// everything the handlers dereference. Unknown fields are ignored, so reviews
+// from newer API servers still decode.
+func decodeAdmissionReview(w http.ResponseWriter, r *http.Request) (*admissionv1.AdmissionReview, error) {
+	var review admissionv1.AdmissionReview
+	body := http.MaxBytesReader(w, r.Body, maxReviewBytes)
+	if err := json.NewDecoder(body).Decode(&review); err != nil {
+		var tooLarge *http.MaxBytesError
+		switch {
+		case errors.As(err, &tooLarge):
+			return nil, fmt.Errorf("admission review exceeds %d bytes", tooLarge.Limit)
+		case errors.Is(err, io.EOF):
+			return nil, errors.New("empty admission review")
+		}
+		return nil, fmt.Errorf("could not decode request: %v", err)
+	}
+	req := review.Request
+	switch {
+	case req == nil:
+		return nil, errors.New("admission review has no request")
+	case req.UID == "":
+		return &review, errors.New("admission request has no uid")
+	case req.Kind.Kind == "":
+		return &review, errors.New("admission request has no kind")
+	case req.Operation == "":
+		return &review, errors.New("admission request has no operation")
+	}
+	return &review, nil
+}
+
+// writeMalformedReview answers a review that could not be decoded with a
+// well-formed AdmissionReview and status 400. The request UID is echoed when
+// the review got far enough to carry one.
+func (a *AdmissionController) writeMalformedReview(w http.ResponseWriter, review *admissionv1.AdmissionReview, err error) {
+	var req *admissionv1.AdmissionRequest
+	if review != nil {
+		req = review.Request
+	}
+	admissionResponse := admissionreview.NewResponse(req)
+	a.Logger.Warn("Rejecting malformed admission review", zap.String("uid", string(admissionResponse.UID)), zap.Error(err))
+	admissionResponse.Allowed = false
+	admissionResponse.Result = denial(statusMalformedRequest, "%v", err)
+	a.writeAdmissionResponseStatus(w, admissionResponse, http.StatusBadRequest)
+}
+
+// writeInternalError answers with status 500, which the API server treats as
+// a failed call under the webhook's failurePolicy, and a denial in a
+// well-formed envelope for anyone reading the body.
+func (a *AdmissionController) writeInternalError(w http.ResponseWriter, admissionResponse *admissionv1.AdmissionResponse, format string, args ...interface{}) {
+	admissionResponse.Allowed = false
+	admissionResponse.Patch = nil
+	admissionResponse.PatchType = nil
+	admissionResponse.Result = denial(statusInternalError, format, args...)
+	a.writeAdmissionResponseStatus(w, admissionResponse, http.StatusInternalServerError)
+}
+
+// denyMalformedObject denies a well-formed review whose object or old object
+// could not be decoded.
+func (a *AdmissionController) denyMalformedObject(w http.ResponseWriter, admissionResponse *admissionv1.AdmissionResponse, object string, err error) {
+	a.Logger.Error("could not decode admission object", zap.String("object", object), zap.Error(err))
+	admissionResponse.Allowed = false
+	admissionResponse.Result = denial(statusMalformedRequest, "could not decode %s: %v", object, err)
+	a.writeAdmissionResponse(w, admissionResponse)
+}
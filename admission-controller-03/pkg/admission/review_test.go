@@ -0,0 +1,107 @@
+package admission
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+
+	calicofake "github.com/projectcalico/api/pkg/client/clientset_generated/clientset/fake"
+	admissionv1 "k8s.io/api/admission/v1"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+
+	"admission-controller-03/pkg/config"
+)
+
+// malformedPayloads are reviews that once crashed or confused a handler. Each
+// maps to the UID the response must echo.
+var malformedPayloads = map[string]string{
+	``:                         "",
+	`null`:                     "",
+	`[]`:                       "",
+	`{}`:                       "",
+	`{"request":`:              "",
+	`{"request":null}`:         "",
+	`{"request":{}}`:           "",
+	`{"request":{"uid":"m1"}}`: "m1",
+	`{"request":{"uid":"m2","kind":{"kind":"Namespace"}}}`:                                                "m2",
+	`{"request":{"uid":"m3","kind":{"kind":"Namespace"},"operation":"CREATE"}}`:                           "m3",
+	`{"request":{"uid":"m4","kind":{"kind":"Namespace"},"operation":"CREATE","object":"oops"}}`:           "m4",
+	`{"request":{"uid":"m5","kind":{"kind":"Namespace"},"operation":"UPDATE","object":{},"oldObject":7}}`: "m5",
+}
+
+func newTestController() *AdmissionController {
+	a := NewAdmissionControllerFromClients(zap.NewNop(), config.Default(), calicofake.NewSimpleClientset(), k8sfake.NewSimpleClientset())
+	a.Shutdown()
+	a.Recorder = &record.FakeRecorder{}
+	return a
+}
+
+// checkDenial checks that a response is a well-formed, denying AdmissionReview
+// echoing the UID.
+func checkDenial(body []byte, uid string) error {
+	var out admissionv1.AdmissionReview
+	switch err := json.Unmarshal(body, &out); {
+	case err != nil:
+		return errors.New("response is not an AdmissionReview: " + err.Error())
+	case out.APIVersion != "admission.k8s.io/v1" || out.Kind != "AdmissionReview":
+		return errors.New("response has type " + out.APIVersion + "/" + out.Kind)
+	case out.Response == nil:
+		return errors.New("empty response")
+	case out.Response.Allowed:
+		return errors.New("allowed")
+	case string(out.Response.UID) != uid:
+		return errors.New("response UID " + string(out.Response.UID) + ", want " + uid)
+	}
+	return nil
+}
+
+func TestMalformedReviews(t *testing.T) {
+	a := newTestController()
+	handlers := map[string]http.HandlerFunc{
+		"mutate":   a.HandleAdmissionReview,
+		"validate": a.HandleValidation,
+	}
+	for name, handler := range handlers {
+		for payload, uid := range malformedPayloads {
+			t.Run(name+"/"+payload, func(t *testing.T) {
+				w := httptest.NewRecorder()
+				handler(w, httptest.NewRequest(http.MethodPost, "/"+name, strings.NewReader(payload)))
+				if err := checkDenial(w.Body.Bytes(), uid); err != nil {
+					t.Error(err)
+				}
+			})
+		}
+	}
+}
+
+func FuzzDecodeAdmissionReview(f *testing.F) {
+	for payload := range malformedPayloads {
+		f.Add([]byte(payload))
+	}
+	f.Add([]byte(`{"request":{"uid":"ok","kind":{"kind":"Namespace"},"operation":"CREATE","object":{}}}`))
+	a := newTestController()
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		w := httptest.NewRecorder()
+		review, err := decodeAdmissionReview(w, httptest.NewRequest(http.MethodPost, "/mutate", strings.NewReader(string(payload))))
+		if err == nil {
+			if review == nil || review.Request == nil || review.Request.UID == "" || review.Request.Kind.Kind == "" || review.Request.Operation == "" {
+				t.Fatalf("incomplete review %q decoded without error", payload)
+			}
+			return
+		}
+		a.writeMalformedReview(w, review, err)
+		uid := ""
+		if review != nil && review.Request != nil {
+			uid = string(review.Request.UID)
+		}
+		if err := checkDenial(w.Body.Bytes(), uid); err != nil {
+			t.Fatalf("malformed review %q: %v", payload, err)
+		}
+	})
+}
@@ -0,0 +1,38 @@
+package admission
+
+import (
+	"go.uber.org/zap"
+
+	"admission-controller-03/pkg/rules"
+
+	crdv1 "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// selectionCandidates returns the pools satisfying the selection rules for
+// the namespace. Pools that are not available are kept as they are; the
+// rules only decide between the pools that could be selected.
+func (a *AdmissionController) selectionCandidates(ns *corev1.Namespace, pools []crdv1.IPPool) []crdv1.IPPool {
+	if a.SelectionRules == nil {
+		return pools
+	}
+	name := namespaceName(&admissionv1.AdmissionRequest{}, ns)
+	namespace := rules.Namespace{Name: name, Labels: ns.Labels, Annotations: ns.Annotations}
+	candidates := make([]crdv1.IPPool, 0, len(pools))
+	for _, pool := range pools {
+		if normalizeLabels(pool.ObjectMeta.Labels)["status"] != "available" {
+			candidates = append(candidates, pool)
+			continue
+		}
+		matched, rule, err := a.SelectionRules.Match(namespace, rules.Pool{Name: pool.Name, CIDR: pool.Spec.CIDR, Labels: pool.Labels})
+		if err != nil {
+			a.Logger.Debug("Selection rule failed to evaluate, pool not selected", zap.String("namespace", name), zap.String("poolName", pool.Name),
+				zap.String("rule", rule), zap.Error(err))
+		}
+		if matched {
+			candidates = append(candidates, pool)
+		}
+	}
+	return candidates
+}
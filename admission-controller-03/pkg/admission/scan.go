@@ -0,0 +1,304 @@
+package admission
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	scanPageSize       = 500
+	scanProgressPeriod = 10 * time.Second
+)
+
+// scanRetryPeriod spaces the attempts of a startup scan that failed, for
+// example because the API server could not list namespaces.
+var scanRetryPeriod = 30 * time.Second
+
+// ScanProgress is the externally visible state of the startup scan.
+type ScanProgress struct {
+	Started   time.Time `json:"started"`
+	Total     int       `json:"total"`
+	Scanned   int       `json:"scanned"`
+	Drift     int       `json:"drift"`
+	Repaired  int       `json:"repaired"`
+	Done      bool      `json:"done"`
+	Partial   bool      `json:"partial"`
+	LastError string    `json:"lastError,omitempty"`
+}
+
+// ScanStatus tracks the progress of the startup consistency scan so that
+// readiness can be reported while the scan is still running.
+type ScanStatus struct {
+	mu       sync.RWMutex
+	progress ScanProgress
+}
+
+// Ready reports whether the webhook should receive traffic: either the scan
+// finished, or it ran past its duration cap and continues in the background.
+func (s *ScanStatus) Ready() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.progress.Done || s.progress.Partial
+}
+
+// Progress returns a copy of the current scan progress.
+func (s *ScanStatus) Progress() ScanProgress {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.progress
+}
+
+func (s *ScanStatus) update(fn func(p *ScanProgress)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fn(&s.progress)
+}
+
+// RunStartupScan walks every namespace and IP pool once and repairs drift
+// between namespace annotations and pool status labels, logging every
+// correction; drift it cannot safely repair, or any drift in report-only
+// mode, is logged only. Every replica scans, as readiness waits for the scan,
+// but only the leader repairs; the others report, and leave their drift to
+// the leader's drift audit. Namespaces are checked by a bounded pool of
+// workers. Once maxDuration elapses the scan is reported as partially ready
+// and the remainder keeps running in the background. A scan that fails is
+// retried until it completes, and is never reported done before then.
+func (a *AdmissionController) RunStartupScan(ctx context.Context, workers int, maxDuration time.Duration) {
+	if workers < 1 {
+		workers = 1
+	}
+	a.Scan.update(func(p *ScanProgress) { p.Started = time.Now() })
+
+	if maxDuration > 0 {
+		timer := time.AfterFunc(maxDuration, func() {
+			if a.Scan.Ready() {
+				return
+			}
+			a.Scan.update(func(p *ScanProgress) { p.Partial = true })
+			progress := a.Scan.Progress()
+			a.Logger.Warn("Startup scan exceeded its duration cap, continuing in background",
+				zap.Duration("maxDuration", maxDuration),
+				zap.Int("scanned", progress.Scanned),
+				zap.Int("total", progress.Total))
+		})
+		defer timer.Stop()
+	}
+
+	for {
+		err := a.scan(ctx, workers)
+		if err == nil {
+			break
+		}
+		a.Logger.Error("Startup scan failed, retrying",
+			zap.Error(err), zap.Duration("retryIn", scanRetryPeriod))
+		// The next attempt counts every namespace again
+		a.Scan.update(func(p *ScanProgress) {
+			p.LastError = err.Error()
+			p.Total, p.Scanned, p.Drift, p.Repaired = 0, 0, 0, 0
+		})
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(scanRetryPeriod):
+		}
+	}
+
+	a.Scan.update(func(p *ScanProgress) {
+		p.Done = true
+		p.LastError = ""
+	})
+	progress := a.Scan.Progress()
+	a.Logger.Info("Startup scan finished",
+		zap.Int("scanned", progress.Scanned),
+		zap.Int("drift", progress.Drift),
+		zap.Int("repaired", progress.Repaired),
+		zap.Duration("elapsed", time.Since(progress.Started)))
+}
+
+func (a *AdmissionController) scan(ctx context.Context, workers int) error {
+	ipPools, err := a.CalicoReader.ProjectcalicoV3().IPPools().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("could not list IP pools: %v", err)
+	}
+
+	var (
+		refMu      sync.Mutex
+		referenced = make(map[string]string)
+	)
+
+	jobs := make(chan corev1.Namespace, workers*2)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ns := range jobs {
+				pools := a.checkNamespace(ctx, ns)
+				refMu.Lock()
+				for _, pool := range pools {
+					referenced[pool] = ns.Name
+				}
+				refMu.Unlock()
+				a.Scan.update(func(p *ScanProgress) { p.Scanned++ })
+			}
+		}()
+	}
+
+	stopProgress := make(chan struct{})
+	go a.logScanProgress(stopProgress)
+
+	listErr := a.feedNamespaces(ctx, jobs)
+	close(jobs)
+	wg.Wait()
+	close(stopProgress)
+	if listErr != nil {
+		return listErr
+	}
+
+	for _, pool := range ipPools.Items {
+		switch normalizeLabels(pool.ObjectMeta.Labels)["status"] {
+		case "available":
+			if _, ok := referenced[pool.Name]; !ok && len(danglingOwnerLabels(pool)) > 0 {
+				a.Logger.Warn("Drift: available pool carries owner labels",
+					zap.String("poolName", pool.Name), zap.Strings("labels", danglingOwnerLabels(pool)))
+				a.Scan.update(func(p *ScanProgress) { p.Drift++ })
+				if a.leading() && a.repairDanglingOwner(ctx, pool) {
+					a.Scan.update(func(p *ScanProgress) { p.Repaired++ })
+				}
+			}
+		case "used":
+			if _, ok := referenced[pool.Name]; !ok {
+				owner, assignedAt := poolOwner(pool)
+				a.Logger.Warn("Drift: pool marked used but no namespace references it",
+					zap.String("poolName", pool.Name), zap.String("owner", owner), zap.Time("assignedAt", assignedAt))
+				a.Scan.update(func(p *ScanProgress) { p.Drift++ })
+				if a.leading() && a.repairUnreferencedPool(ctx, pool) {
+					a.Scan.update(func(p *ScanProgress) { p.Repaired++ })
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// feedNamespaces pages through namespaces so that large clusters are never
+// held in memory as a single list.
+func (a *AdmissionController) feedNamespaces(ctx context.Context, jobs chan<- corev1.Namespace) error {
+	opts := metav1.ListOptions{Limit: scanPageSize}
+	for {
+		nsList, err := a.K8sReader.CoreV1().Namespaces().List(ctx, opts)
+		if err != nil {
+			return fmt.Errorf("could not list namespaces: %v", err)
+		}
+		a.Scan.update(func(p *ScanProgress) {
+			p.Total += len(nsList.Items)
+		})
+		for _, ns := range nsList.Items {
+			select {
+			case jobs <- ns:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		if nsList.Continue == "" {
+			return nil
+		}
+		opts.Continue = nsList.Continue
+	}
+}
+
+// checkNamespace verifies that every pool a namespace references exists, is
+// marked used and is not bound to another namespace, and returns the
+// referenced pool names.
+func (a *AdmissionController) checkNamespace(ctx context.Context, ns corev1.Namespace) []string {
+	annotation, found := ns.Annotations[ipv4PoolsAnnotation]
+	if !found || annotation == "" {
+		return nil
+	}
+
+	var pools []string
+	if err := json.Unmarshal([]byte(annotation), &pools); err != nil {
+		a.Logger.Warn("Drift: namespace has an undecodable IP pool annotation",
+			zap.String("namespace", ns.Name), zap.String("annotation", annotation))
+		a.Scan.update(func(p *ScanProgress) { p.Drift++ })
+		return nil
+	}
+
+	for _, poolName := range pools {
+		pool, err := a.CalicoReader.ProjectcalicoV3().IPPools().Get(ctx, poolName, metav1.GetOptions{})
+		if err != nil {
+			a.Logger.Warn("Drift: namespace references a pool that could not be fetched",
+				zap.String("namespace", ns.Name), zap.String("poolName", poolName), zap.Error(err))
+			a.Scan.update(func(p *ScanProgress) { p.Drift++ })
+			continue
+		}
+		if status := normalizeLabels(pool.ObjectMeta.Labels)["status"]; status != "used" && status != "pending" {
+			a.Logger.Warn("Drift: namespace references a pool not marked used",
+				zap.String("namespace", ns.Name), zap.String("poolName", poolName), zap.String("status", status))
+			a.Scan.update(func(p *ScanProgress) { p.Drift++ })
+			if status == "available" {
+				if a.leading() && a.repairReferencedPool(ctx, ns, poolName) {
+					a.Scan.update(func(p *ScanProgress) { p.Repaired++ })
+				}
+			}
+		}
+		if owner, _ := poolOwner(*pool); owner != "" && owner != ns.Name {
+			a.Logger.Warn("Drift: namespace references a pool owned by another namespace",
+				zap.String("namespace", ns.Name), zap.String("poolName", poolName), zap.String("owner", owner))
+			a.Scan.update(func(p *ScanProgress) { p.Drift++ })
+		}
+	}
+	return pools
+}
+
+func (a *AdmissionController) logScanProgress(stop <-chan struct{}) {
+	ticker := time.NewTicker(scanProgressPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			progress := a.Scan.Progress()
+			a.Logger.Info("Startup scan progress",
+				zap.Int("scanned", progress.Scanned),
+				zap.Int("total", progress.Total),
+				zap.Int("drift", progress.Drift))
+		}
+	}
+}
+
+// HandleReadyz reports ready once the startup scan is done or has run past its
+// duration cap, and, in strict mode, the live webhook configuration only routes
+// requests we handle. The body always carries the current scan progress.
+func (a *AdmissionController) HandleReadyz(w http.ResponseWriter, r *http.Request) {
+	readiness := struct {
+		Scan          ScanProgress `json:"scan"`
+		WebhookConfig string       `json:"webhookConfig,omitempty"`
+	}{Scan: a.Scan.Progress()}
+
+	ready := a.Scan.Ready()
+	if a.Strict {
+		if err := a.WebhookCheck.Err(); err != nil {
+			readiness.WebhookConfig = err.Error()
+			ready = false
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(&readiness); err != nil {
+		a.Logger.Error("could not encode readiness response", zap.Error(err))
+	}
+}
@@ -0,0 +1,98 @@
+package admission
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	crdv1 "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
+	calicofake "github.com/projectcalico/api/pkg/client/clientset_generated/clientset/fake"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8sruntime "k8s.io/apimachinery/pkg/runtime"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"admission-controller-03/pkg/config"
+)
+
+func TestStartupScanRetries(t *testing.T) {
+	defer func(period time.Duration) { scanRetryPeriod = period }(scanRetryPeriod)
+	scanRetryPeriod = 10 * time.Millisecond
+
+	k8sClient := k8sfake.NewSimpleClientset(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "web"}})
+	failures := 2
+	k8sClient.PrependReactor("list", "namespaces", func(k8stesting.Action) (bool, k8sruntime.Object, error) {
+		if failures == 0 {
+			return false, nil, nil
+		}
+		failures--
+		return true, nil, errors.New("apiserver unavailable")
+	})
+	a := NewAdmissionControllerFromClients(zap.NewNop(), config.Default(), calicofake.NewSimpleClientset(), k8sClient)
+	a.Shutdown()
+
+	a.RunStartupScan(context.Background(), 1, 0)
+	progress := a.Scan.Progress()
+	if !progress.Done || progress.LastError != "" || progress.Scanned != 1 || progress.Total != 1 {
+		t.Errorf("after the retries the scan progress is %+v", progress)
+	}
+}
+
+func TestStartupScanNotReadyOnFailure(t *testing.T) {
+	k8sClient := k8sfake.NewSimpleClientset()
+	k8sClient.PrependReactor("list", "namespaces", func(k8stesting.Action) (bool, k8sruntime.Object, error) {
+		return true, nil, errors.New("apiserver unavailable")
+	})
+	a := NewAdmissionControllerFromClients(zap.NewNop(), config.Default(), calicofake.NewSimpleClientset(), k8sClient)
+	a.Shutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	a.RunStartupScan(ctx, 1, 0)
+	if a.Scan.Ready() {
+		t.Errorf("a failing scan reports ready: %+v", a.Scan.Progress())
+	}
+	if a.Scan.Progress().LastError == "" {
+		t.Error("the scan failure is not reported")
+	}
+}
+
+func TestStartupScanRepairsOnLeaderOnly(t *testing.T) {
+	for _, leader := range []bool{false, true} {
+		t.Run(fmt.Sprintf("leader=%v", leader), func(t *testing.T) {
+			// The namespace references an available pool
+			ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+				Name:        "web",
+				Annotations: map[string]string{ipv4PoolsAnnotation: `["pool-0"]`, requestAnnotation: "uid-1"},
+			}}
+			pool := &crdv1.IPPool{
+				ObjectMeta: metav1.ObjectMeta{Name: "pool-0", Labels: map[string]string{"location": "zone-lhr", "status": "available"}},
+				Spec:       crdv1.IPPoolSpec{CIDR: "10.0.0.0/26"},
+			}
+			calicoClient := calicofake.NewSimpleClientset(pool)
+			a := NewAdmissionControllerFromClients(zap.NewNop(), config.Default(), calicoClient, k8sfake.NewSimpleClientset(ns))
+			a.Shutdown()
+			elected := make(chan struct{})
+			if leader {
+				close(elected)
+			}
+			a.elected = elected
+
+			a.RunStartupScan(context.Background(), 1, 0)
+			progress := a.Scan.Progress()
+			repaired, err := calicoClient.ProjectcalicoV3().IPPools().Get(context.Background(), "pool-0", metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			status := repaired.Labels["status"]
+			if progress.Drift != 1 || (progress.Repaired == 1) != leader || (status == "used") != leader {
+				t.Errorf("scan progress %+v, pool status %s", progress, status)
+			}
+		})
+	}
+}
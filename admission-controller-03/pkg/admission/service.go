@@ -0,0 +1,536 @@
+package admission
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"slices"
+	"sort"
+	"time"
+
+	"go.uber.org/zap"
+
+	"admission-controller-03/pkg/audit"
+	"admission-controller-03/pkg/cidr"
+	"admission-controller-03/pkg/config"
+
+	crdv1 "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// serviceLBRole is the role label value of the pools Service load
+	// balancer addresses are allocated from.
+	serviceLBRole = "service-lb"
+	// serviceIPsAnnotation records on a service-lb pool which Service holds
+	// each of its addresses, see serviceIPs.
+	serviceIPsAnnotation = "ipam.example.com/service-ips"
+	// calicoLoadBalancerIPsAnnotation requests specific addresses from
+	// Calico's load balancer IPAM.
+	calicoLoadBalancerIPsAnnotation = "projectcalico.org/loadBalancerIPs"
+)
+
+var (
+	// errServiceIPsExhausted is returned when no service-lb pool of the
+	// tenant has an address left.
+	errServiceIPsExhausted = errors.New("no service load balancer address left")
+	// errServiceIPNotAllowed and errServiceIPInUse reject an address a
+	// Service asks for itself.
+	errServiceIPNotAllowed = errors.New("load balancer address not allowed")
+	errServiceIPInUse      = errors.New("load balancer address in use")
+)
+
+// serviceIP is the holder of an address of a service-lb pool. AssignedAt lets
+// RunServiceIPSweep tell an address whose Service is still being created from
+// one whose creation failed.
+type serviceIP struct {
+	Service    string `json:"service"`
+	AssignedAt int64  `json:"assignedAt"`
+}
+
+// serviceIPs decodes the addresses held in a service-lb pool, keyed by
+// address.
+func serviceIPs(pool *crdv1.IPPool) (map[string]serviceIP, error) {
+	held := map[string]serviceIP{}
+	if raw := pool.Annotations[serviceIPsAnnotation]; raw != "" {
+		if err := json.Unmarshal([]byte(raw), &held); err != nil {
+			return nil, fmt.Errorf("could not decode %s annotation of IP pool %s: %v", serviceIPsAnnotation, pool.Name, err)
+		}
+	}
+	return held, nil
+}
+
+func setServiceIPs(pool *crdv1.IPPool, held map[string]serviceIP) error {
+	if len(held) == 0 {
+		delete(pool.Annotations, serviceIPsAnnotation)
+		return nil
+	}
+	raw, err := json.Marshal(held)
+	if err != nil {
+		return fmt.Errorf("could not encode %s annotation: %v", serviceIPsAnnotation, err)
+	}
+	if pool.Annotations == nil {
+		pool.Annotations = map[string]string{}
+	}
+	pool.Annotations[serviceIPsAnnotation] = string(raw)
+	return nil
+}
+
+// handleServiceCreation allocates the address of a Service of type
+// LoadBalancer from the service-lb pools of its namespace's tenant. Services
+// of other types are admitted untouched.
+func (a *AdmissionController) handleServiceCreation(ctx context.Context, w http.ResponseWriter, req *admissionv1.AdmissionRequest, admissionResponse *admissionv1.AdmissionResponse) {
+	var svc corev1.Service
+	if err := json.Unmarshal(req.Object.Raw, &svc); err != nil {
+		a.denyMalformedObject(w, admissionResponse, "service", err)
+		return
+	}
+	if svc.Spec.Type != corev1.ServiceTypeLoadBalancer || a.Config.ServiceLoadBalancer == nil {
+		a.writeAdmissionResponse(w, admissionResponse)
+		return
+	}
+	a.admitLoadBalancer(ctx, w, req, admissionResponse, &svc)
+}
+
+// handleServiceUpdate treats a Service turned into a LoadBalancer like a
+// created one, and releases the address of one that no longer is. A
+// LoadBalancer asking for other addresses than before is checked again.
+func (a *AdmissionController) handleServiceUpdate(ctx context.Context, w http.ResponseWriter, req *admissionv1.AdmissionRequest, admissionResponse *admissionv1.AdmissionResponse) {
+	var oldSvc, svc corev1.Service
+	if err := json.Unmarshal(req.OldObject.Raw, &oldSvc); err != nil {
+		a.denyMalformedObject(w, admissionResponse, "old service", err)
+		return
+	}
+	if err := json.Unmarshal(req.Object.Raw, &svc); err != nil {
+		a.denyMalformedObject(w, admissionResponse, "service", err)
+		return
+	}
+	if a.Config.ServiceLoadBalancer == nil {
+		a.writeAdmissionResponse(w, admissionResponse)
+		return
+	}
+
+	wasLB := oldSvc.Spec.Type == corev1.ServiceTypeLoadBalancer
+	switch {
+	case svc.Spec.Type == corev1.ServiceTypeLoadBalancer:
+		ip, ips := svc.Spec.LoadBalancerIP, svc.Annotations[calicoLoadBalancerIPsAnnotation]
+		if wasLB && (ip != "" || ips != "") && ip == oldSvc.Spec.LoadBalancerIP && ips == oldSvc.Annotations[calicoLoadBalancerIPsAnnotation] {
+			// Checked when it was last set
+			a.writeAdmissionResponse(w, admissionResponse)
+			return
+		}
+		a.admitLoadBalancer(ctx, w, req, admissionResponse, &svc)
+	case wasLB:
+		a.handleServiceDeletion(ctx, w, req, admissionResponse)
+	default:
+		a.writeAdmissionResponse(w, admissionResponse)
+	}
+}
+
+// admitLoadBalancer allocates the address of a LoadBalancer Service, or
+// checks the addresses it asks for itself: they must be in the service-lb
+// pools of its namespace's tenant and not held by another Service. Addresses
+// it held before and no longer asks for are released.
+func (a *AdmissionController) admitLoadBalancer(ctx context.Context, w http.ResponseWriter, req *admissionv1.AdmissionRequest, admissionResponse *admissionv1.AdmissionResponse, svc *corev1.Service) {
+	requested, err := requestedServiceIPs(svc)
+	if err != nil {
+		a.deny(w, req, admissionResponse, denial(statusServiceIPNotAllowed, "%v", err), nil)
+		return
+	}
+	if svc.Name == "" {
+		// The address could not be released by name
+		if len(requested) > 0 {
+			a.deny(w, req, admissionResponse, denial(statusServiceIPNotAllowed, "Services created with generateName cannot ask for a load balancer address."), nil)
+			return
+		}
+		addWarning(admissionResponse, "no load balancer address was allocated: Services created with generateName are not supported")
+		a.writeAdmissionResponse(w, admissionResponse)
+		return
+	}
+
+	ns, err := a.K8sReader.CoreV1().Namespaces().Get(ctx, req.Namespace, metav1.GetOptions{})
+	if err != nil {
+		a.Logger.Error("could not fetch namespace of service", zap.String("namespace", req.Namespace), zap.Error(err))
+		a.deny(w, req, admissionResponse, denial(statusInternalError, "could not fetch namespace: %v", err), nil)
+		return
+	}
+	if a.Config.IsExempt(ns.Name, ns.Labels) {
+		a.writeAdmissionResponse(w, admissionResponse)
+		return
+	}
+	tenant := ns.Labels[a.Config.TenantLabel]
+	service := req.Namespace + "/" + svc.Name
+	if len(requested) > 0 {
+		err := a.claimServiceIPs(ctx, tenant, service, requested)
+		switch {
+		case errors.Is(err, errServiceIPNotAllowed):
+			a.deny(w, req, admissionResponse, denial(statusServiceIPNotAllowed, "%v", err), nil)
+		case errors.Is(err, errServiceIPInUse):
+			a.deny(w, req, admissionResponse, denial(statusServiceIPInUse, "%v", err), nil)
+		case err != nil:
+			a.Logger.Error("could not record service load balancer address", zap.String("service", service), zap.Error(err))
+			a.deny(w, req, admissionResponse, denial(statusServiceIPAllocFailed, "could not record load balancer address: %v", err), nil)
+		default:
+			a.Logger.Info("Service holds the load balancer addresses it asks for", zap.String("service", service), zap.Strings("addresses", requested))
+			a.writeAdmissionResponse(w, admissionResponse)
+		}
+		return
+	}
+
+	address, poolName, err := a.allocateServiceIP(ctx, tenant, service)
+	if errors.Is(err, errServiceIPsExhausted) {
+		a.Logger.Warn("No service load balancer address left", zap.String("tenant", tenant), zap.String("service", service))
+		a.deny(w, req, admissionResponse, denial(statusServiceIPsExhausted, "No load balancer address is left in the %s pools of tenant %q.", serviceLBRole, tenant), nil)
+		return
+	}
+	if err != nil {
+		a.Logger.Error("could not allocate service load balancer address", zap.String("service", service), zap.Error(err))
+		a.deny(w, req, admissionResponse, denial(statusServiceIPAllocFailed, "could not allocate load balancer address: %v", err), nil)
+		return
+	}
+	audit.FromContext(ctx).Pool = poolName
+
+	patch := []patchOperation{{Op: "add", Path: "/spec/loadBalancerIP", Value: address}}
+	if a.Config.ServiceLoadBalancer.Field == config.ServiceLBFieldCalico {
+		patch = nil
+		if svc.Annotations == nil {
+			patch = append(patch, patchOperation{Op: "add", Path: "/metadata/annotations", Value: map[string]string{}})
+		}
+		patch = append(patch, patchOperation{Op: "add", Path: annotationPath(calicoLoadBalancerIPsAnnotation), Value: fmt.Sprintf(`["%s"]`, address)})
+	}
+	patchBytes, err := json.Marshal(patch)
+	if err != nil {
+		a.writeInternalError(w, admissionResponse, "could not marshal patch: %v", err)
+		return
+	}
+	admissionResponse.Patch = patchBytes
+	admissionResponse.PatchType = func() *admissionv1.PatchType {
+		pt := admissionv1.PatchTypeJSONPatch
+		return &pt
+	}()
+	a.Logger.Info("Allocated service load balancer address",
+		zap.String("service", service), zap.String("poolName", poolName), zap.String("address", address))
+	a.writeAdmissionResponse(w, admissionResponse)
+}
+
+// handleServiceDeletion releases the load balancer address of a deleted
+// Service.
+func (a *AdmissionController) handleServiceDeletion(ctx context.Context, w http.ResponseWriter, req *admissionv1.AdmissionRequest, admissionResponse *admissionv1.AdmissionResponse) {
+	service := req.Namespace + "/" + req.Name
+	if isDryRun(ctx) {
+		a.Logger.Info("Dry run, not releasing service load balancer address", zap.String("service", service))
+		a.writeAdmissionResponse(w, admissionResponse)
+		return
+	}
+	if err := a.releaseServiceIPs(ctx, service); err != nil {
+		// Admitted all the same: the sweep releases it once the Service is gone
+		a.Logger.Error("could not release service load balancer address", zap.String("service", service), zap.Error(err))
+		addWarning(admissionResponse, "the load balancer address of %s is released later: %v", service, err)
+	}
+	a.writeAdmissionResponse(w, admissionResponse)
+}
+
+// requestedServiceIPs returns the addresses a Service asks for itself, in
+// spec.loadBalancerIP or Calico's loadBalancerIPs annotation.
+func requestedServiceIPs(svc *corev1.Service) ([]string, error) {
+	var requested []string
+	if svc.Spec.LoadBalancerIP != "" {
+		requested = append(requested, svc.Spec.LoadBalancerIP)
+	}
+	if raw := svc.Annotations[calicoLoadBalancerIPsAnnotation]; raw != "" {
+		var addresses []string
+		if err := json.Unmarshal([]byte(raw), &addresses); err != nil {
+			return nil, fmt.Errorf("invalid %s annotation: %v", calicoLoadBalancerIPsAnnotation, err)
+		}
+		for _, address := range addresses {
+			if !slices.Contains(requested, address) {
+				requested = append(requested, address)
+			}
+		}
+	}
+	for _, address := range requested {
+		if _, err := netip.ParseAddr(address); err != nil {
+			return nil, fmt.Errorf("invalid load balancer address %q", address)
+		}
+	}
+	return requested, nil
+}
+
+// claimServiceIPs records the addresses as held by the service, once each is
+// found in a service-lb pool of the tenant and held by no other Service.
+// Addresses the service held before and no longer asks for are released. A
+// dry run only checks.
+func (a *AdmissionController) claimServiceIPs(ctx context.Context, tenant, service string, addresses []string) error {
+	pools, err := a.serviceLBPools(ctx, tenant)
+	if err != nil {
+		return err
+	}
+	byPool := map[string][]string{}
+	for _, address := range addresses {
+		var poolName string
+		for _, pool := range pools {
+			if !cidr.Contains(pool.Spec.CIDR, address+"/32") {
+				continue
+			}
+			held, err := serviceIPs(&pool)
+			if err != nil {
+				return err
+			}
+			if holder, ok := held[address]; ok && holder.Service != service {
+				return fmt.Errorf("%w: %s is held by %s", errServiceIPInUse, address, holder.Service)
+			}
+			poolName = pool.Name
+			break
+		}
+		if poolName == "" {
+			return fmt.Errorf("%w: %s is not in a %s pool of tenant %q", errServiceIPNotAllowed, address, serviceLBRole, tenant)
+		}
+		byPool[poolName] = append(byPool[poolName], address)
+	}
+	if isDryRun(ctx) {
+		return nil
+	}
+
+	for poolName, claimed := range byPool {
+		err := a.updateIPPool(ctx, poolName, func(ipPool *crdv1.IPPool) error {
+			held, err := serviceIPs(ipPool)
+			if err != nil {
+				return err
+			}
+			for _, address := range claimed {
+				holder, ok := held[address]
+				if ok && holder.Service != service {
+					return fmt.Errorf("%w: %s is held by %s", errServiceIPInUse, address, holder.Service)
+				}
+				if !ok {
+					held[address] = serviceIP{Service: service, AssignedAt: time.Now().Unix()}
+				}
+			}
+			return setServiceIPs(ipPool, held)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return a.releaseServiceIPsExcept(ctx, service, addresses)
+}
+
+// serviceLBPools returns the service-lb pools of the tenant in this zone, by
+// name.
+func (a *AdmissionController) serviceLBPools(ctx context.Context, tenant string) ([]crdv1.IPPool, error) {
+	ipPools, err := a.CalicoReader.ProjectcalicoV3().IPPools().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("could not list IP pools: %v", err)
+	}
+	var pools []crdv1.IPPool
+	for _, pool := range ipPools.Items {
+		poolLabels := normalizeLabels(pool.ObjectMeta.Labels)
+		if poolLabels[masterRoleLabel] != serviceLBRole || poolLabels[poolTenantLabel] != tenant ||
+			poolLabels["location"] != a.Config.Location || poolCordoned(poolLabels) {
+			continue
+		}
+		pools = append(pools, pool)
+	}
+	sort.Slice(pools, func(i, j int) bool { return pools[i].Name < pools[j].Name })
+	return pools, nil
+}
+
+// allocateServiceIP records the first free address of the tenant's
+// service-lb pools as held by the service, and returns it with its pool. An
+// address the service already holds, from an earlier attempt of the same
+// request, is returned again. A dry run records nothing.
+func (a *AdmissionController) allocateServiceIP(ctx context.Context, tenant, service string) (string, string, error) {
+	pools, err := a.serviceLBPools(ctx, tenant)
+	if err != nil {
+		return "", "", err
+	}
+	for _, pool := range pools {
+		held, err := serviceIPs(&pool)
+		if err != nil {
+			return "", "", err
+		}
+		for address, holder := range held {
+			if holder.Service == service {
+				return address, pool.Name, nil
+			}
+		}
+	}
+
+	for _, pool := range pools {
+		if isDryRun(ctx) {
+			held, err := serviceIPs(&pool)
+			if err != nil {
+				return "", "", err
+			}
+			if address, ok := freeServiceIP(pool.Spec.CIDR, held); ok {
+				return address, pool.Name, nil
+			}
+			continue
+		}
+		var address string
+		err := a.updateIPPool(ctx, pool.Name, func(ipPool *crdv1.IPPool) error {
+			held, err := serviceIPs(ipPool)
+			if err != nil {
+				return err
+			}
+			free, ok := freeServiceIP(ipPool.Spec.CIDR, held)
+			if !ok {
+				return errServiceIPsExhausted
+			}
+			address = free
+			held[address] = serviceIP{Service: service, AssignedAt: time.Now().Unix()}
+			return setServiceIPs(ipPool, held)
+		})
+		if errors.Is(err, errServiceIPsExhausted) {
+			continue
+		}
+		if err != nil {
+			return "", "", err
+		}
+		return address, pool.Name, nil
+	}
+	return "", "", errServiceIPsExhausted
+}
+
+// freeServiceIP returns the first address of the pool's CIDR that no Service
+// holds, leaving out the network and broadcast addresses.
+func freeServiceIP(poolCIDR string, held map[string]serviceIP) (string, bool) {
+	prefix, err := netip.ParsePrefix(poolCIDR)
+	if err != nil {
+		return "", false
+	}
+	used := make([]string, 0, len(held)+2)
+	for address := range held {
+		used = append(used, address+"/32")
+	}
+	if prefix.Bits() < 31 {
+		for _, last := range []bool{false, true} {
+			if edge, err := cidr.Edge(poolCIDR, 32, last); err == nil {
+				used = append(used, edge)
+			}
+		}
+	}
+	free, err := cidr.NextFree(poolCIDR, 32, used)
+	if err != nil {
+		return "", false
+	}
+	return netip.MustParsePrefix(free).Addr().String(), true
+}
+
+// releaseServiceIPs drops the addresses the service holds from every
+// service-lb pool.
+func (a *AdmissionController) releaseServiceIPs(ctx context.Context, service string) error {
+	return a.releaseServiceIPsExcept(ctx, service, nil)
+}
+
+// releaseServiceIPsExcept drops the addresses the service holds, but for the
+// ones it keeps, from every service-lb pool.
+func (a *AdmissionController) releaseServiceIPsExcept(ctx context.Context, service string, keep []string) error {
+	ipPools, err := a.CalicoReader.ProjectcalicoV3().IPPools().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("could not list IP pools: %v", err)
+	}
+	for _, pool := range ipPools.Items {
+		if normalizeLabels(pool.ObjectMeta.Labels)[masterRoleLabel] != serviceLBRole {
+			continue
+		}
+		held, err := serviceIPs(&pool)
+		if err != nil {
+			return err
+		}
+		if !holdsServiceIP(held, service, keep) {
+			continue
+		}
+		err = a.updateIPPool(ctx, pool.Name, func(ipPool *crdv1.IPPool) error {
+			held, err := serviceIPs(ipPool)
+			if err != nil {
+				return err
+			}
+			for address, holder := range held {
+				if holder.Service == service && !slices.Contains(keep, address) {
+					delete(held, address)
+					a.Logger.Info("Released service load balancer address",
+						zap.String("service", service), zap.String("poolName", ipPool.Name), zap.String("address", address))
+				}
+			}
+			return setServiceIPs(ipPool, held)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func holdsServiceIP(held map[string]serviceIP, service string, keep []string) bool {
+	for address, holder := range held {
+		if holder.Service == service && !slices.Contains(keep, address) {
+			return true
+		}
+	}
+	return false
+}
+
+// RunServiceIPSweep periodically releases the load balancer addresses whose
+// Service does not exist: its creation failed after admission, or its
+// deletion was not seen. Addresses younger than the reservation TTL are kept,
+// as their Service may still be on its way.
+func (a *AdmissionController) RunServiceIPSweep(ctx context.Context, interval time.Duration) {
+	if a.Config.ServiceLoadBalancer == nil {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := a.sweepServiceIPs(ctx); err != nil {
+			a.Logger.Error("could not sweep service load balancer addresses", zap.Error(err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (a *AdmissionController) sweepServiceIPs(ctx context.Context) error {
+	ipPools, err := a.CalicoReader.ProjectcalicoV3().IPPools().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("could not list IP pools: %v", err)
+	}
+	services, err := a.K8sReader.CoreV1().Services(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("could not list services: %v", err)
+	}
+	exists := map[string]bool{}
+	for _, svc := range services.Items {
+		exists[svc.Namespace+"/"+svc.Name] = true
+	}
+
+	ttl := time.Duration(a.Config.ReservationTTLSeconds) * time.Second
+	for _, pool := range ipPools.Items {
+		if normalizeLabels(pool.ObjectMeta.Labels)[masterRoleLabel] != serviceLBRole {
+			continue
+		}
+		held, err := serviceIPs(&pool)
+		if err != nil {
+			a.Logger.Error("could not sweep service load balancer addresses", zap.String("poolName", pool.Name), zap.Error(err))
+			continue
+		}
+		for _, holder := range held {
+			if exists[holder.Service] || time.Since(time.Unix(holder.AssignedAt, 0)) < ttl {
+				continue
+			}
+			if err := a.releaseServiceIPs(ctx, holder.Service); err != nil {
+				a.Logger.Error("could not release address of missing service", zap.String("service", holder.Service), zap.Error(err))
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+package admission
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.uber.org/zap"
+
+	crdv1 "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
+	calicofake "github.com/projectcalico/api/pkg/client/clientset_generated/clientset/fake"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8sruntime "k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+
+	"admission-controller-03/pkg/config"
+)
+
+// newServiceController returns a controller whose tenant team-a has the
+// service-lb pool 192.0.2.0/28, of which 192.0.2.5 is held by web/other.
+func newServiceController() (*AdmissionController, *calicofake.Clientset) {
+	pool := &crdv1.IPPool{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "lb-a",
+			Labels: map[string]string{
+				"location":      "zone-lhr",
+				masterRoleLabel: serviceLBRole,
+				poolTenantLabel: "team-a",
+			},
+			Annotations: map[string]string{serviceIPsAnnotation: `{"192.0.2.5":{"service":"web/other","assignedAt":1}}`},
+		},
+		Spec: crdv1.IPPoolSpec{CIDR: "192.0.2.0/28"},
+	}
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "web", Labels: map[string]string{"tenant": "team-a"}}}
+	calicoClient := calicofake.NewSimpleClientset(pool)
+	cfg := config.Default()
+	cfg.ServiceLoadBalancer = &config.ServiceLoadBalancer{}
+	a := NewAdmissionControllerFromClients(zap.NewNop(), cfg, calicoClient, k8sfake.NewSimpleClientset(ns))
+	a.Shutdown()
+	a.Recorder = &record.FakeRecorder{}
+	return a, calicoClient
+}
+
+// admitService sends a Service review through the mutating handler.
+func admitService(t *testing.T, a *AdmissionController, operation admissionv1.Operation, svc, oldSvc *corev1.Service) *admissionv1.AdmissionResponse {
+	t.Helper()
+	request := &admissionv1.AdmissionRequest{
+		UID:       types.UID("uid-" + svc.Name),
+		Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Service"},
+		Namespace: "web",
+		Name:      svc.Name,
+		Operation: operation,
+	}
+	for raw, obj := range map[*k8sruntime.RawExtension]*corev1.Service{&request.Object: svc, &request.OldObject: oldSvc} {
+		if obj == nil {
+			continue
+		}
+		encoded, err := json.Marshal(obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw.Raw = encoded
+	}
+	body, err := json.Marshal(admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+		Request:  request,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	a.HandleAdmissionReview(w, httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader(body)))
+	var out admissionv1.AdmissionReview
+	if err := json.Unmarshal(w.Body.Bytes(), &out); err != nil || out.Response == nil {
+		t.Fatalf("response is not an AdmissionReview: %v", err)
+	}
+	return out.Response
+}
+
+func loadBalancer(name, address string, annotations map[string]string) *corev1.Service {
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "web", Annotations: annotations},
+		Spec:       corev1.ServiceSpec{Type: corev1.ServiceTypeLoadBalancer, LoadBalancerIP: address},
+	}
+}
+
+// heldServiceIPs returns the holders of the addresses of the lb-a pool.
+func heldServiceIPs(t *testing.T, calicoClient *calicofake.Clientset) map[string]serviceIP {
+	t.Helper()
+	pool, err := calicoClient.ProjectcalicoV3().IPPools().Get(context.Background(), "lb-a", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	held, err := serviceIPs(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return held
+}
+
+func TestServiceRequestsAddress(t *testing.T) {
+	tests := []struct {
+		name       string
+		svc        *corev1.Service
+		wantReason metav1.StatusReason
+		wantHolder string
+	}{
+		{name: "free address", svc: loadBalancer("a", "192.0.2.3", nil), wantHolder: "web/a"},
+		{
+			name:       "free address by annotation",
+			svc:        loadBalancer("b", "", map[string]string{calicoLoadBalancerIPsAnnotation: `["192.0.2.3"]`}),
+			wantHolder: "web/b",
+		},
+		{name: "address held by another service", svc: loadBalancer("c", "192.0.2.5", nil), wantReason: statusServiceIPInUse},
+		{name: "address outside the tenant's pools", svc: loadBalancer("d", "198.51.100.1", nil), wantReason: statusServiceIPNotAllowed},
+		{
+			name:       "malformed annotation",
+			svc:        loadBalancer("e", "", map[string]string{calicoLoadBalancerIPsAnnotation: "192.0.2.3"}),
+			wantReason: statusServiceIPNotAllowed,
+		},
+		{name: "not an address", svc: loadBalancer("f", "lb.example.com", nil), wantReason: statusServiceIPNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, calicoClient := newServiceController()
+			a.Config.Operations["Service"] = []string{"CREATE"}
+			resp := admitService(t, a, admissionv1.Create, tt.svc, nil)
+			if tt.wantReason != "" {
+				if resp.Allowed || resp.Result == nil || resp.Result.Reason != tt.wantReason {
+					t.Fatalf("got allowed=%v %v, want %s", resp.Allowed, resp.Result, tt.wantReason)
+				}
+				return
+			}
+			if !resp.Allowed {
+				t.Fatalf("denied: %v", resp.Result)
+			}
+			if holder := heldServiceIPs(t, calicoClient)["192.0.2.3"].Service; holder != tt.wantHolder {
+				t.Errorf("192.0.2.3 is held by %q, want %q", holder, tt.wantHolder)
+			}
+		})
+	}
+}
+
+func TestServiceTypeUpdate(t *testing.T) {
+	a, calicoClient := newServiceController()
+	a.Config.Operations["Service"] = []string{"CREATE", "UPDATE", "DELETE"}
+	clusterIP := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "web"},
+		Spec:       corev1.ServiceSpec{Type: corev1.ServiceTypeClusterIP},
+	}
+
+	// Turned into a LoadBalancer, the Service gets an address
+	resp := admitService(t, a, admissionv1.Update, loadBalancer("api", "", nil), clusterIP)
+	if !resp.Allowed || resp.Patch == nil {
+		t.Fatalf("conversion to LoadBalancer: allowed=%v %v, patch %s", resp.Allowed, resp.Result, resp.Patch)
+	}
+	var address string
+	for ip, holder := range heldServiceIPs(t, calicoClient) {
+		if holder.Service == "web/api" {
+			address = ip
+		}
+	}
+	if address == "" || !bytes.Contains(resp.Patch, []byte(address)) {
+		t.Fatalf("patch %s does not set the held address %q", resp.Patch, address)
+	}
+
+	// Moving to another address releases the first one
+	resp = admitService(t, a, admissionv1.Update, loadBalancer("api", "192.0.2.9", nil), loadBalancer("api", address, nil))
+	if !resp.Allowed {
+		t.Fatalf("change of address denied: %v", resp.Result)
+	}
+	held := heldServiceIPs(t, calicoClient)
+	if _, ok := held[address]; ok || held["192.0.2.9"].Service != "web/api" {
+		t.Fatalf("after the change of address the pool holds %v", held)
+	}
+
+	// Turned back into a ClusterIP, it releases its address
+	resp = admitService(t, a, admissionv1.Update, clusterIP, loadBalancer("api", "192.0.2.9", nil))
+	if !resp.Allowed {
+		t.Fatalf("conversion to ClusterIP denied: %v", resp.Result)
+	}
+	if holder, ok := heldServiceIPs(t, calicoClient)["192.0.2.9"]; ok {
+		t.Errorf("192.0.2.9 is still held by %s", holder.Service)
+	}
+}
@@ -0,0 +1,38 @@
+package admission
+
+import (
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+
+	"admission-controller-03/pkg/sink"
+)
+
+const sinkTimeout = 30 * time.Second
+
+// publishAllocation streams an assignment or release to the configured sink.
+// Like owner notifications it happens in the background, so a slow broker
+// never holds up admission; failures are only logged.
+func (a *AdmissionController) publishAllocation(event sink.Event, namespace, poolName, poolCIDR, tenant string) {
+	if a.Sink == nil {
+		return
+	}
+	record := sink.Record{
+		Event:     event,
+		Namespace: namespace,
+		Pool:      poolName,
+		CIDR:      poolCIDR,
+		Tenant:    tenant,
+		Time:      time.Now().UTC(),
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), sinkTimeout)
+		defer cancel()
+		if err := a.Sink.Publish(ctx, record); err != nil {
+			a.Logger.Warn("could not publish allocation record",
+				zap.String("event", string(record.Event)), zap.String("namespace", record.Namespace), zap.String("poolName", record.Pool), zap.Error(err))
+		}
+	}()
+}
@@ -0,0 +1,342 @@
+//go:build soak
+
+package admission
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/goleak"
+	"go.uber.org/zap"
+	jsonpatch "gopkg.in/evanphx/json-patch.v4"
+
+	crdv1 "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/rest"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/envtest"
+
+	"admission-controller-03/pkg/config"
+)
+
+var (
+	soakDuration           = flag.Duration("soak.duration", 10*time.Minute, "how long to run the synthetic load")
+	soakWarmup             = flag.Duration("soak.warmup", 30*time.Second, "time before the goroutine and heap baselines are taken")
+	soakConcurrency        = flag.Int("soak.concurrency", 8, "number of concurrent synthetic clients")
+	soakSampleEvery        = flag.Duration("soak.sample-interval", 5*time.Second, "how often goroutines and heap are sampled")
+	soakMaxGoroutineGrowth = flag.Int("soak.max-goroutine-growth", 50, "allowed goroutine growth over the baseline")
+	soakMaxHeapGrowthMB    = flag.Int("soak.max-heap-growth-mb", 64, "allowed heap growth over the baseline in MiB")
+	soakRetryEvery         = flag.Int("soak.retry-every", 10, "every Nth namespace is created through an abandoned attempt plus retries, like API server timeouts (0 disables)")
+)
+
+// TestSoak runs the webhook as cmd/main.go does, with its manager,
+// reconcilers, informers and background loops, against a control plane
+// started by envtest, under synthetic load for an extended period. It fails
+// if goroutine counts or heap usage keep growing, goroutines leak on
+// shutdown, or retried requests are not handled idempotently.
+//
+//	KUBEBUILDER_ASSETS=$(setup-envtest use -p path) go test -tags soak -run TestSoak -timeout 0 ./pkg/admission -soak.duration 30m -soak.concurrency 16
+func TestSoak(t *testing.T) {
+	if os.Getenv("KUBEBUILDER_ASSETS") == "" {
+		t.Skip("KUBEBUILDER_ASSETS is not set, see setup-envtest")
+	}
+	ignore := goleak.IgnoreCurrent()
+
+	env := &envtest.Environment{
+		CRDDirectoryPaths:     []string{"testdata/crd", "../tenant/crd.yaml", "../claim/crd.yaml", "../allocation/crd.yaml"},
+		ErrorIfCRDPathMissing: true,
+	}
+	restConfig, err := env.Start()
+	if err != nil {
+		t.Fatalf("could not start control plane: %v", err)
+	}
+	err = soak(t, restConfig)
+	if stopErr := env.Stop(); stopErr != nil {
+		t.Errorf("could not stop control plane: %v", stopErr)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Connections to the stopped control plane are torn down asynchronously
+	err = goleak.Find(ignore,
+		goleak.IgnoreTopFunction("net/http.(*persistConn).readLoop"),
+		goleak.IgnoreTopFunction("net/http.(*persistConn).writeLoop"),
+	)
+	if err != nil {
+		t.Fatalf("goroutines leaked after shutdown: %v", err)
+	}
+}
+
+func soak(t *testing.T, restConfig *rest.Config) error {
+	a, err := NewAdmissionControllerForConfig(zap.NewNop(), config.Default(), restConfig, Identities{})
+	if err != nil {
+		return err
+	}
+	defer a.Shutdown()
+	a.LeaseNamespace = "ipam-system"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, err = a.K8sClientset.CoreV1().Namespaces().Create(ctx, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: a.LeaseNamespace}}, metav1.CreateOptions{})
+	if err != nil {
+		return fmt.Errorf("could not create lease namespace: %v", err)
+	}
+	for i := 0; i < *soakConcurrency*4; i++ {
+		_, err := a.Clientset.ProjectcalicoV3().IPPools().Create(ctx, &crdv1.IPPool{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   fmt.Sprintf("soak-pool-%d", i),
+				Labels: map[string]string{"location": "zone-lhr", "status": "available"},
+			},
+			Spec: crdv1.IPPoolSpec{CIDR: fmt.Sprintf("10.%d.%d.0/26", i/256, i%256)},
+		}, metav1.CreateOptions{})
+		if err != nil {
+			return fmt.Errorf("could not create IP pool: %v", err)
+		}
+	}
+
+	mgr, err := ctrl.NewManager(a.ReadConfig, a.ManagerOptions(true))
+	if err != nil {
+		return fmt.Errorf("could not create controller manager: %v", err)
+	}
+	// Short intervals, so that every loop runs many times under the load
+	err = a.SetupManager(mgr, Loops{
+		ReleaseRetry:       time.Second,
+		ReleaseStuckAfter:  time.Minute,
+		Bind:               time.Second,
+		GC:                 5 * time.Second,
+		DeferredAssignment: time.Second,
+		ClaimBind:          time.Second,
+		Allocation:         time.Second,
+		Cleanup:            time.Second,
+		Growth:             5 * time.Second,
+		Autoscale:          5 * time.Second,
+		Exhaustion:         time.Second,
+		DriftAudit:         5 * time.Second,
+		ServiceIPSweep:     time.Second,
+		Egress:             5 * time.Second,
+		TenantSync:         time.Second,
+		ScanWorkers:        4,
+		ScanTimeout:        time.Second,
+	})
+	if err != nil {
+		return err
+	}
+	var manager sync.WaitGroup
+	managerErr := make(chan error, 1)
+	manager.Add(1)
+	go func() {
+		defer manager.Done()
+		managerErr <- mgr.Start(ctx)
+	}()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/mutate", a.HandleAdmissionReview)
+	mux.HandleFunc("/validate", a.HandleValidation)
+	mux.HandleFunc("/readyz", a.HandleReadyz)
+	server := httptest.NewServer(mux)
+
+	deadline := time.Now().Add(*soakDuration)
+	var (
+		load       sync.WaitGroup
+		failureMu  sync.Mutex
+		retryError error
+	)
+	for worker := 0; worker < *soakConcurrency; worker++ {
+		load.Add(1)
+		go func(worker int) {
+			defer load.Done()
+			for i := 0; time.Now().Before(deadline); i++ {
+				name := fmt.Sprintf("soak-%d-%d", worker, i)
+				retry := *soakRetryEvery > 0 && i%*soakRetryEvery == 0
+				err := namespaceLifecycle(ctx, a, server, name, retry)
+				if errors.Is(err, errRetryBroken) {
+					failureMu.Lock()
+					retryError = err
+					failureMu.Unlock()
+				} else if err != nil {
+					t.Log("Load error:", err)
+				}
+			}
+		}(worker)
+	}
+
+	failure := sample(t, deadline)
+
+	load.Wait()
+	server.Close()
+	server.Client().CloseIdleConnections()
+	cancel()
+	manager.Wait()
+	if err := <-managerErr; err != nil {
+		return fmt.Errorf("controller manager stopped: %v", err)
+	}
+	if failure != nil {
+		return failure
+	}
+	return retryError
+}
+
+// sample watches goroutines and heap until the deadline and reports the first
+// sample that exceeded the allowed growth over the post-warmup baseline.
+func sample(t *testing.T, deadline time.Time) error {
+	time.Sleep(*soakWarmup)
+	baseGoroutines, baseHeap := measure()
+	t.Logf("Baseline: %d goroutines, %d KiB heap", baseGoroutines, baseHeap>>10)
+
+	maxHeapGrowth := uint64(*soakMaxHeapGrowthMB) << 20
+	ticker := time.NewTicker(*soakSampleEvery)
+	defer ticker.Stop()
+	for time.Now().Before(deadline) {
+		<-ticker.C
+		goroutines, heap := measure()
+		t.Logf("Sample: %d goroutines, %d KiB heap", goroutines, heap>>10)
+		if goroutines > baseGoroutines+*soakMaxGoroutineGrowth {
+			return fmt.Errorf("goroutines grew from %d to %d", baseGoroutines, goroutines)
+		}
+		if heap > baseHeap+maxHeapGrowth {
+			return fmt.Errorf("heap grew from %d KiB to %d KiB", baseHeap>>10, heap>>10)
+		}
+	}
+	return nil
+}
+
+func measure() (int, uint64) {
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return runtime.NumGoroutine(), stats.HeapAlloc
+}
+
+// errRetryBroken marks a retried request that was not handled idempotently.
+var errRetryBroken = errors.New("retried request not idempotent")
+
+// namespaceLifecycle creates a namespace through the webhook and then in the
+// API server with the webhook's patch applied, then deletes it through the
+// webhook again and has it released by the release reconciler. With retry
+// set, the create is first abandoned mid-flight and then sent twice with the
+// same UID; every attempt must resolve to a single claimed pool.
+func namespaceLifecycle(ctx context.Context, a *AdmissionController, server *httptest.Server, name string, retry bool) error {
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name}}
+	uid := types.UID(name + "-" + string(admissionv1.Create))
+	if retry {
+		abandon(server, uid, ns)
+	}
+	createResp, err := postReview(server.Client(), server.URL, uid, admissionv1.Create, ns)
+	if err != nil {
+		return err
+	}
+	if !createResp.Allowed {
+		return nil
+	}
+	pools := patchedPools(createResp.Patch)
+
+	if retry {
+		again, err := postReview(server.Client(), server.URL, uid, admissionv1.Create, ns)
+		if err != nil {
+			return err
+		}
+		if got := patchedPools(again.Patch); got != pools {
+			return fmt.Errorf("%w: %s got %s then %s", errRetryBroken, name, pools, got)
+		}
+		claims, err := a.CalicoReader.ProjectcalicoV3().IPPools().List(ctx, metav1.ListOptions{LabelSelector: poolRequestLabel + "=" + string(uid)})
+		if err != nil {
+			return err
+		}
+		if len(claims.Items) != 1 {
+			return fmt.Errorf("%w: %s claimed %d pools", errRetryBroken, name, len(claims.Items))
+		}
+	}
+
+	// Persist the namespace the way the API server would, with the patch
+	raw, err := json.Marshal(ns)
+	if err != nil {
+		return err
+	}
+	patch, err := jsonpatch.DecodePatch(createResp.Patch)
+	if err != nil {
+		return fmt.Errorf("could not decode patch: %v", err)
+	}
+	if raw, err = patch.Apply(raw); err != nil {
+		return fmt.Errorf("could not apply patch: %v", err)
+	}
+	var created corev1.Namespace
+	if err := json.Unmarshal(raw, &created); err != nil {
+		return err
+	}
+	if _, err := a.K8sClientset.CoreV1().Namespaces().Create(ctx, &created, metav1.CreateOptions{}); err != nil {
+		return fmt.Errorf("could not persist namespace: %v", err)
+	}
+
+	deleteUID := types.UID(name + "-" + string(admissionv1.Delete))
+	if _, err := postReview(server.Client(), server.URL, deleteUID, admissionv1.Delete, &created); err != nil {
+		return err
+	}
+	if err := a.K8sClientset.CoreV1().Namespaces().Delete(ctx, name, metav1.DeleteOptions{}); err != nil {
+		return fmt.Errorf("could not delete namespace: %v", err)
+	}
+	// A test control plane has no namespace controller, finalize in its
+	// place; the release finalizer still holds the namespace until released
+	terminating, err := a.K8sClientset.CoreV1().Namespaces().Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	terminating.Spec.Finalizers = nil
+	if _, err := a.K8sClientset.CoreV1().Namespaces().Finalize(ctx, terminating, metav1.UpdateOptions{}); err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("could not finalize namespace: %v", err)
+	}
+
+	resp, err := server.Client().Get(server.URL + "/readyz")
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	return resp.Body.Close()
+}
+
+// abandon sends a review and gives up on it almost immediately, like an API
+// server hitting its webhook timeout, then waits for the server side to settle.
+func abandon(server *httptest.Server, uid types.UID, ns *corev1.Namespace) {
+	client := &http.Client{Transport: server.Client().Transport, Timeout: time.Millisecond}
+	postReview(client, server.URL, uid, admissionv1.Create, ns)
+	time.Sleep(20 * time.Millisecond)
+}
+
+func postReview(client *http.Client, url string, uid types.UID, operation admissionv1.Operation, ns *corev1.Namespace) (*admissionv1.AdmissionResponse, error) {
+	body, err := reviewBody(uid, operation, ns)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Post(url+"/mutate", "application/json", body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var out admissionv1.AdmissionReview
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, fmt.Errorf("could not decode %s response: %v", operation, err)
+	}
+	if out.Response == nil {
+		return nil, fmt.Errorf("empty %s response", operation)
+	}
+	return out.Response, nil
+}
@@ -0,0 +1,212 @@
+package admission
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.uber.org/zap"
+
+	"admission-common/pools"
+	"admission-controller-03/pkg/cidr"
+	"admission-controller-03/pkg/config"
+
+	crdv1 "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+const (
+	// masterRoleLabel marks an IPPool as a master the splitter keeps split
+	// into child pools.
+	masterRoleLabel = "role"
+	masterRole      = "master"
+	// poolParentLabel records on a child pool the master it was split from.
+	poolParentLabel = pools.ParentLabel
+)
+
+// splitterReconciler keeps the configured child pools of every master pool
+// in existence, with their CIDRs, labels and pool template. Children are
+// created available; their status and ownership labels are left to the
+// allocation path.
+type splitterReconciler struct {
+	a *AdmissionController
+	// pools is the manager's informer cache
+	pools client.Reader
+}
+
+// SetupPoolSplitter registers the splitter with the manager when it is
+// configured. A master is reconciled when it or one of its children changes,
+// so a deleted child is recreated straight away.
+func (a *AdmissionController) SetupPoolSplitter(mgr manager.Manager) error {
+	if a.Config.Splitter == nil {
+		return nil
+	}
+	isMaster := predicate.NewPredicateFuncs(func(o client.Object) bool {
+		return o.GetLabels()[masterRoleLabel] == masterRole
+	})
+	parentOf := handler.EnqueueRequestsFromMapFunc(func(_ context.Context, o client.Object) []reconcile.Request {
+		parent := o.GetLabels()[poolParentLabel]
+		if parent == "" {
+			return nil
+		}
+		return []reconcile.Request{{NamespacedName: types.NamespacedName{Name: parent}}}
+	})
+	return builder.ControllerManagedBy(mgr).
+		Named("splitter").
+		For(&crdv1.IPPool{}, builder.WithPredicates(isMaster)).
+		Watches(&crdv1.IPPool{}, parentOf).
+		Complete(&splitterReconciler{a: a, pools: mgr.GetCache()})
+}
+
+func (r *splitterReconciler) Reconcile(ctx context.Context, req reconcile.Request) (reconcile.Result, error) {
+	var master crdv1.IPPool
+	if err := r.pools.Get(ctx, req.NamespacedName, &master); err != nil {
+		// The children of a deleted master are kept, they may be assigned
+		return reconcile.Result{}, client.IgnoreNotFound(err)
+	}
+	if master.Labels[masterRoleLabel] != masterRole || master.DeletionTimestamp != nil {
+		return reconcile.Result{}, nil
+	}
+	if h := r.a.Config.Hierarchy; h != nil && master.Name == h.MasterPool {
+		r.a.Logger.Warn("Master pool of the hierarchy is carved per tenant, not split", zap.String("poolName", master.Name))
+		return reconcile.Result{}, nil
+	}
+
+	s := r.a.Config.Splitter
+	max := s.MaxChildren
+	if max == 0 {
+		max = config.MaxSplitChildren
+	}
+	desired, err := cidr.Subnets(master.Spec.CIDR, s.ChildPrefixLength, max)
+	if err != nil {
+		// Retrying will not help until the master or the config changes
+		r.a.Logger.Error("could not split master pool", zap.String("poolName", master.Name), zap.Error(err))
+		return reconcile.Result{}, nil
+	}
+
+	var children crdv1.IPPoolList
+	if err := r.pools.List(ctx, &children, client.MatchingLabels{poolParentLabel: master.Name}); err != nil {
+		return reconcile.Result{}, fmt.Errorf("could not list child pools: %v", err)
+	}
+	existing := make(map[string]crdv1.IPPool, len(children.Items))
+	for _, child := range children.Items {
+		existing[child.Spec.CIDR] = child
+	}
+
+	location := normalizeLabels(master.Labels)["location"]
+	if location == "" {
+		location = r.a.Config.Location
+	}
+	labels := map[string]string{poolParentLabel: master.Name, "location": location}
+	for key, value := range s.Labels {
+		labels[key] = value
+	}
+	template := r.a.Config.PoolTemplateFor(location)
+
+	var errs []error
+	for _, subnet := range desired {
+		child, exists := existing[subnet]
+		delete(existing, subnet)
+		if !exists {
+			errs = append(errs, r.createChild(ctx, master.Name, subnet, labels, template))
+			continue
+		}
+		if childDrifted(child, labels, template) {
+			errs = append(errs, r.restoreChild(ctx, child.Name, labels, template))
+		}
+	}
+	for _, stray := range existing {
+		// It may be assigned; resizing a master is left to the operator
+		r.a.Logger.Warn("Child pool is outside the configured split of its master, leaving it",
+			zap.String("poolName", stray.Name), zap.String("cidr", stray.Spec.CIDR), zap.String("master", master.Name))
+	}
+	return reconcile.Result{}, errors.Join(errs...)
+}
+
+// createChild creates an available child pool for the subnet.
+func (r *splitterReconciler) createChild(ctx context.Context, master, subnet string, labels map[string]string, template config.PoolTemplate) error {
+	pool := &crdv1.IPPool{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   childPoolName(master, subnet),
+			Labels: map[string]string{"status": "available"},
+		},
+		Spec: crdv1.IPPoolSpec{
+			CIDR:         subnet,
+			NodeSelector: "all()",
+		},
+	}
+	for key, value := range labels {
+		pool.Labels[key] = value
+	}
+	applyPoolTemplate(&pool.Spec, template)
+	_, err := r.a.Clientset.ProjectcalicoV3().IPPools().Create(ctx, pool, metav1.CreateOptions{FieldManager: fieldManager})
+	if apierrors.IsAlreadyExists(err) {
+		// A pool of that name without the parent label is someone else's
+		r.a.Logger.Warn("Child pool name is taken by another pool", zap.String("poolName", pool.Name), zap.String("master", master))
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not create child pool %s: %v", pool.Name, err)
+	}
+	r.a.Logger.Info("Created child pool of master pool", zap.String("master", master),
+		zap.String("poolName", pool.Name), zap.String("cidr", subnet))
+	return nil
+}
+
+// restoreChild puts the splitter's labels and the template fields back on a
+// child pool, leaving its status, ownership and node selector alone.
+func (r *splitterReconciler) restoreChild(ctx context.Context, name string, labels map[string]string, template config.PoolTemplate) error {
+	err := r.a.updateIPPool(ctx, name, func(ipPool *crdv1.IPPool) error {
+		poolLabels := normalizeLabels(ipPool.ObjectMeta.Labels)
+		for key, value := range labels {
+			poolLabels[key] = value
+		}
+		ipPool.ObjectMeta.Labels = poolLabels
+		applyTemplateModes(&ipPool.Spec, template)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("could not restore child pool %s: %v", name, err)
+	}
+	r.a.Logger.Info("Restored child pool to its template", zap.String("poolName", name))
+	return nil
+}
+
+// childDrifted reports whether a child pool lost one of the splitter's labels
+// or a template field that can be changed on an existing pool.
+func childDrifted(child crdv1.IPPool, labels map[string]string, template config.PoolTemplate) bool {
+	for key, value := range labels {
+		if child.Labels[key] != value {
+			return true
+		}
+	}
+	want := child.Spec
+	applyTemplateModes(&want, template)
+	return want.IPIPMode != child.Spec.IPIPMode || want.VXLANMode != child.Spec.VXLANMode ||
+		want.NATOutgoing != child.Spec.NATOutgoing || want.DisableBGPExport != child.Spec.DisableBGPExport
+}
+
+// applyTemplateModes sets the template fields Calico lets change on an
+// existing pool; unset template fields are left as they are.
+func applyTemplateModes(spec *crdv1.IPPoolSpec, t config.PoolTemplate) {
+	if t.IPIPMode != "" {
+		spec.IPIPMode = crdv1.IPIPMode(t.IPIPMode)
+	}
+	if t.VXLANMode != "" {
+		spec.VXLANMode = crdv1.VXLANMode(t.VXLANMode)
+	}
+	if t.NATOutgoing != nil {
+		spec.NATOutgoing = *t.NATOutgoing
+	}
+	if t.DisableBGPExport != nil {
+		spec.DisableBGPExport = *t.DisableBGPExport
+	}
+}
@@ -0,0 +1,104 @@
+package admission
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// handledResources maps the resources a webhook rule may route to us onto
+// their kinds.
+var handledResources = map[string]string{
+	"namespaces": "Namespace",
+	"services":   "Service",
+	"pods":       "Pod",
+}
+
+// handles reports whether the configured operations include the operation on
+// the kind.
+func (a *AdmissionController) handles(kind string, operation admissionv1.Operation) bool {
+	return a.Config.Handles(kind, string(operation))
+}
+
+// WebhookCheck holds the outcome of the last live webhook configuration check.
+type WebhookCheck struct {
+	mu  sync.RWMutex
+	err error
+}
+
+// Err returns the last misconfiguration found, or nil.
+func (c *WebhookCheck) Err() error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.err
+}
+
+func (c *WebhookCheck) set(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.err = err
+}
+
+// WatchWebhookConfiguration periodically verifies that the named
+// MutatingWebhookConfiguration only routes kinds and operations this webhook
+// handles. Any mismatch fails readiness until it is fixed.
+func (a *AdmissionController) WatchWebhookConfiguration(ctx context.Context, name string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		err := a.verifyWebhookConfiguration(ctx, name)
+		if err != nil {
+			a.Logger.Error("webhook configuration check failed", zap.String("name", name), zap.Error(err))
+		} else if a.WebhookCheck.Err() != nil {
+			a.Logger.Info("Webhook configuration check passed", zap.String("name", name))
+		}
+		a.WebhookCheck.set(err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (a *AdmissionController) verifyWebhookConfiguration(ctx context.Context, name string) error {
+	webhookConfig, err := a.K8sReader.AdmissionregistrationV1().MutatingWebhookConfigurations().Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("could not get mutating webhook configuration: %v", err)
+	}
+
+	for _, webhook := range webhookConfig.Webhooks {
+		for _, rule := range webhook.Rules {
+			if err := a.checkRule(rule); err != nil {
+				return fmt.Errorf("webhook %s: %v", webhook.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (a *AdmissionController) checkRule(rule admissionregistrationv1.RuleWithOperations) error {
+	for _, resource := range rule.Resources {
+		kind, ok := handledResources[resource]
+		if !ok {
+			return fmt.Errorf("routes resource %q which is not handled", resource)
+		}
+		for _, op := range rule.Operations {
+			if op == admissionregistrationv1.OperationAll {
+				return fmt.Errorf("routes all operations on %q but only %v are handled", resource, a.Config.Operations[kind])
+			}
+			if !a.handles(kind, admissionv1.Operation(op)) {
+				return fmt.Errorf("routes %s on %q which is not handled", op, resource)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package admission
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+
+	"admission-controller-03/pkg/config"
+	"admission-controller-03/pkg/tenant"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// RunTenantSync periodically reads the Tenant resources. It runs on every
+// replica, as admission resolves tenants against them. Without the CRD only
+// the tenants of the config file apply.
+func (a *AdmissionController) RunTenantSync(ctx context.Context, interval time.Duration) {
+	if a.DynamicReader == nil {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := a.syncTenants(ctx); err != nil {
+			a.Logger.Error("could not sync tenants", zap.Error(err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (a *AdmissionController) syncTenants(ctx context.Context) error {
+	list, err := a.DynamicReader.Resource(tenant.Resource).List(ctx, metav1.ListOptions{})
+	if apierrors.IsNotFound(err) {
+		a.tenants.Store(nil)
+		return nil
+	}
+	if err != nil {
+		// Keep resolving against the last synced tenants
+		return fmt.Errorf("could not list tenants: %v", err)
+	}
+	tenants := make(map[string]config.Tenant, len(list.Items))
+	for i := range list.Items {
+		t, err := tenant.FromUnstructured(&list.Items[i])
+		if err != nil {
+			// An invalid tenant falls back to the config file rather than
+			// resolving to no pools at all
+			a.Logger.Error("Ignoring invalid tenant", zap.String("tenant", list.Items[i].GetName()), zap.Error(err))
+			continue
+		}
+		if _, ok := a.Config.Tenants[t.Name]; ok {
+			a.Logger.Debug("Tenant resource overrides the config file", zap.String("tenant", t.Name))
+		}
+		tenants[t.Name] = t.Spec
+	}
+	a.tenants.Store(&tenants)
+	return nil
+}
+
+// tenantPolicy resolves a tenant label value, first against the Tenant
+// resources, then against the config file.
+func (a *AdmissionController) tenantPolicy(name string) (config.Tenant, bool) {
+	if name == "" {
+		return config.Tenant{}, false
+	}
+	if synced := a.tenants.Load(); synced != nil {
+		if t, ok := (*synced)[name]; ok {
+			return t, true
+		}
+	}
+	t, ok := a.Config.Tenants[name]
+	return t, ok
+}
+
+// tenantSelectors returns the parsed pool selectors of a tenant, or nil if
+// the tenant is not defined.
+func (a *AdmissionController) tenantSelectors(name string) ([]labels.Selector, error) {
+	t, ok := a.tenantPolicy(name)
+	if !ok {
+		return nil, nil
+	}
+	return t.Selectors(name)
+}
+
+// cleanupPolicyFor returns the cleanup policy of a tenant's child pools.
+func (a *AdmissionController) cleanupPolicyFor(name string) string {
+	if t, _ := a.tenantPolicy(name); t.CleanupPolicy != "" {
+		return t.CleanupPolicy
+	}
+	return a.Config.CleanupPolicy
+}
+
+// namespacePrefixLength returns the size of the child pools carved for a
+// tenant's namespaces. A tenant default that does not fit in the aggregate is
+// ignored.
+func (a *AdmissionController) namespacePrefixLength(name string) int {
+	h := a.Config.Hierarchy
+	if t, _ := a.tenantPolicy(name); t.DefaultPrefixLength >= h.TeamPrefixLength {
+		return t.DefaultPrefixLength
+	}
+	return h.NamespacePrefixLength
+}
@@ -0,0 +1,110 @@
+package admission
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Stages of a namespace held by the release finalizer.
+const (
+	// terminationDraining waits for the namespace's workload endpoints to be
+	// gone, so that no address of a pool is in use when it is released.
+	terminationDraining = "draining"
+	// terminationReleasing releases the pools and removes the finalizer.
+	terminationReleasing = "releasing"
+)
+
+var terminationStages = []string{terminationDraining, terminationReleasing}
+
+var (
+	terminationsDesc = prometheus.NewDesc("ipam_namespace_terminations",
+		"Terminating namespaces held by the release finalizer, by stage.", []string{"stage"}, nil)
+	terminationsStuckDesc = prometheus.NewDesc("ipam_namespace_terminations_stuck",
+		"Terminating namespaces held by the release finalizer for longer than the stuck threshold, by stage.", []string{"stage"}, nil)
+	terminationOldestDesc = prometheus.NewDesc("ipam_namespace_termination_oldest_seconds",
+		"Time the longest-held terminating namespace has been waiting for the release finalizer.", nil, nil)
+
+	terminationDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "ipam_namespace_termination_duration_seconds",
+		Help:    "Time from a namespace's deletion to the removal of its release finalizer.",
+		Buckets: []float64{1, 5, 15, 30, 60, 120, 300, 600, 1800, 3600},
+	})
+)
+
+// terminations tracks the namespaces the release reconciler holds. It is only
+// filled on the leader, which runs the reconciler.
+var terminations = &terminationTracker{held: map[string]*termination{}}
+
+// TerminationCollectors returns the release finalizer metrics for
+// registration.
+func TerminationCollectors() []prometheus.Collector {
+	return []prometheus.Collector{terminations, terminationDuration}
+}
+
+type termination struct {
+	stage string
+	// since is the namespace's deletion time
+	since time.Time
+	stuck bool
+}
+
+type terminationTracker struct {
+	mu   sync.Mutex
+	held map[string]*termination
+}
+
+// hold records the stage of a terminating namespace and reports whether it
+// has just become stuck, i.e. been held for longer than stuckAfter.
+func (t *terminationTracker) hold(namespace, stage string, since time.Time, stuckAfter time.Duration) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	held, ok := t.held[namespace]
+	if !ok {
+		held = &termination{since: since}
+		t.held[namespace] = held
+	}
+	held.stage = stage
+	if held.stuck || stuckAfter <= 0 || time.Since(since) < stuckAfter {
+		return false
+	}
+	held.stuck = true
+	return true
+}
+
+// done forgets a namespace whose finalizer is gone, recording how long it
+// was held when it was.
+func (t *terminationTracker) done(namespace string, released bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if held, ok := t.held[namespace]; ok && released {
+		terminationDuration.Observe(time.Since(held.since).Seconds())
+	}
+	delete(t.held, namespace)
+}
+
+func (t *terminationTracker) Describe(ch chan<- *prometheus.Desc) {
+	ch <- terminationsDesc
+	ch <- terminationsStuckDesc
+	ch <- terminationOldestDesc
+}
+
+func (t *terminationTracker) Collect(ch chan<- prometheus.Metric) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	counts, stuck := map[string]int{}, map[string]int{}
+	var oldest time.Duration
+	for _, held := range t.held {
+		counts[held.stage]++
+		if held.stuck {
+			stuck[held.stage]++
+		}
+		oldest = max(oldest, time.Since(held.since))
+	}
+	for _, stage := range terminationStages {
+		ch <- prometheus.MustNewConstMetric(terminationsDesc, prometheus.GaugeValue, float64(counts[stage]), stage)
+		ch <- prometheus.MustNewConstMetric(terminationsStuckDesc, prometheus.GaugeValue, float64(stuck[stage]), stage)
+	}
+	ch <- prometheus.MustNewConstMetric(terminationOldestDesc, prometheus.GaugeValue, oldest.Seconds())
+}
@@ -0,0 +1,24 @@
+package admission
+
+import (
+	"net/http"
+	"time"
+)
+
+// requestTimeout is the deadline for the API calls of one admission request.
+// The API server passes its webhook timeout as the timeout query parameter;
+// a tenth of it is kept back so the response still arrives in time. The
+// configured RequestTimeout caps it, and is used alone when the parameter is
+// missing. Zero means no deadline.
+func (a *AdmissionController) requestTimeout(r *http.Request) time.Duration {
+	timeout := a.RequestTimeout
+	if value := r.URL.Query().Get("timeout"); value != "" {
+		webhookTimeout, err := time.ParseDuration(value)
+		if err == nil && webhookTimeout > 0 {
+			if derived := webhookTimeout - webhookTimeout/10; timeout <= 0 || derived < timeout {
+				timeout = derived
+			}
+		}
+	}
+	return timeout
+}
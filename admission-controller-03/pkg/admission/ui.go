@@ -0,0 +1,48 @@
+package admission
+
+import (
+	_ "embed"
+	"net/http"
+	"strconv"
+
+	"go.uber.org/zap"
+)
+
+// UIPath serves the read-only dashboard.
+const UIPath = "/ui"
+
+// dashboard is a single page that renders the pools and allocations APIs:
+// pools per zone, utilization, recent assignments and current warnings.
+//
+//go:embed ui/index.html
+var dashboard []byte
+
+// HandleUI serves the dashboard. The page itself needs no token; it asks for
+// one and calls the API with it, so a user sees what the API allows them. It
+// is off with the API.
+func (a *AdmissionController) HandleUI(w http.ResponseWriter, r *http.Request) {
+	if !a.apiEnabled() {
+		http.Error(w, "the API is not enabled", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.URL.Path != UIPath && r.URL.Path != UIPath+"/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(len(dashboard)))
+	// The page only talks to the API it is served with
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; script-src 'unsafe-inline'; style-src 'unsafe-inline'; connect-src 'self'")
+	w.Header().Set("X-Frame-Options", "DENY")
+	if r.Method == http.MethodHead {
+		return
+	}
+	if _, err := w.Write(dashboard); err != nil {
+		a.Logger.Error("could not write dashboard", zap.Error(err))
+	}
+}
@@ -0,0 +1,80 @@
+package admission
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+
+	"admission-controller-03/pkg/cidr"
+
+	crdv1 "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// ipamBlocks are Calico's per-node address blocks. Only the backing CRD
+// exposes them, so they are read as unstructured objects.
+var ipamBlocks = schema.GroupVersionResource{Group: "crd.projectcalico.org", Version: "v1", Resource: "ipamblocks"}
+
+// Utilization is the address usage of one pool.
+type Utilization struct {
+	Allocated int
+	Capacity  int
+}
+
+// Ratio returns the used fraction of the pool's addresses.
+func (u Utilization) Ratio() float64 {
+	if u.Capacity == 0 {
+		return 0
+	}
+	return float64(u.Allocated) / float64(u.Capacity)
+}
+
+// poolUtilization sums the allocated addresses of every IPAM block inside each
+// pool, keyed by pool name. A block inside nested pools, such as a child pool
+// and the master it was carved from, counts for the innermost one.
+func (a *AdmissionController) poolUtilization(ctx context.Context, pools []crdv1.IPPool) (map[string]Utilization, error) {
+	if a.DynamicReader == nil {
+		return nil, fmt.Errorf("no dynamic client to read IPAM blocks with")
+	}
+	blocks, err := a.DynamicReader.Resource(ipamBlocks).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("could not list IPAM blocks: %v", err)
+	}
+
+	usage := make(map[string]Utilization, len(pools))
+	bits := make(map[string]int, len(pools))
+	for _, pool := range pools {
+		prefix, err := netip.ParsePrefix(pool.Spec.CIDR)
+		if err != nil || !prefix.Addr().Is4() {
+			continue
+		}
+		usage[pool.Name] = Utilization{Capacity: 1 << (32 - prefix.Bits())}
+		bits[pool.Name] = prefix.Bits()
+	}
+
+	for _, block := range blocks.Items {
+		blockCIDR, _, _ := unstructured.NestedString(block.Object, "spec", "cidr")
+		allocations, _, _ := unstructured.NestedSlice(block.Object, "spec", "allocations")
+		allocated := 0
+		for _, allocation := range allocations {
+			if allocation != nil {
+				allocated++
+			}
+		}
+		innermost := ""
+		for _, pool := range pools {
+			if _, ok := usage[pool.Name]; ok && cidr.Contains(pool.Spec.CIDR, blockCIDR) &&
+				(innermost == "" || bits[pool.Name] > bits[innermost]) {
+				innermost = pool.Name
+			}
+		}
+		if innermost != "" {
+			u := usage[innermost]
+			u.Allocated += allocated
+			usage[innermost] = u
+		}
+	}
+	return usage, nil
+}
@@ -0,0 +1,296 @@
+package admission
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+
+	"admission-common/admissionreview"
+	"admission-controller-03/pkg/audit"
+	"admission-controller-03/pkg/cidr"
+
+	crdv1 "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// HandleValidation serves the validating webhook for namespaces and IP pools.
+// It runs after every mutating webhook and sees the final object, so it is the
+// place to deny what the mutating webhook must not be relied on to catch: it
+// does not see requests while it is down with failurePolicy Ignore, nor exempt
+// or skipped namespaces.
+func (a *AdmissionController) HandleValidation(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	ctx, span := tracer.Start(r.Context(), "HandleValidation")
+	defer span.End()
+	if timeout := a.requestTimeout(r); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	admissionReviewReq, err := decodeAdmissionReview(w, r)
+	if err != nil {
+		a.writeMalformedReview(w, admissionReviewReq, err)
+		return
+	}
+	req := admissionReviewReq.Request
+	admissionResponse := admissionreview.NewResponse(req)
+
+	record := newAuditRecord(req, start)
+	ctx = audit.NewContext(ctx, record)
+	sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+	w = sw
+	defer func() { a.writeAudit(record, admissionResponse, sw.status, start) }()
+	if req.DryRun != nil && *req.DryRun {
+		ctx = withDryRun(ctx)
+		record.DryRun = true
+	}
+
+	if a.isCritical(req) {
+		a.writeAdmissionResponse(w, admissionResponse)
+		return
+	}
+
+	if req.Kind.Kind == "Namespace" {
+		switch req.Operation {
+		case admissionv1.Create:
+			a.validateNamespaceCreation(ctx, w, req, admissionResponse)
+			return
+		case admissionv1.Update:
+			// Exempt namespaces too: an exemption label must not open the
+			// annotations up to their owners
+			a.handleNamespaceUpdate(w, req, admissionResponse)
+			return
+		}
+	}
+	// Both the aggregated API and the CRDs backing it, which can be deleted
+	// directly
+	if req.Kind.Kind == "IPPool" {
+		switch req.Operation {
+		case admissionv1.Create, admissionv1.Update:
+			a.validateIPPool(ctx, w, req, admissionResponse)
+			return
+		case admissionv1.Delete:
+			a.validateIPPoolDeletion(ctx, w, req, admissionResponse)
+			return
+		}
+	}
+
+	a.writeAdmissionResponse(w, admissionResponse)
+}
+
+// validateNamespaceCreation denies a new namespace that carries protected
+// annotations the mutating webhook did not write. The webhook reserves every
+// pool it writes into the annotation for the request, so a namespace whose
+// pools are not reserved under its request-uid annotation was annotated by
+// the user, e.g. while the mutating webhook was unavailable or skipped it. In
+// the claim assignment mode the namespace only carries the claim annotation,
+// and its PoolClaim must have been filed for the request instead.
+func (a *AdmissionController) validateNamespaceCreation(ctx context.Context, w http.ResponseWriter, req *admissionv1.AdmissionRequest, admissionResponse *admissionv1.AdmissionResponse) {
+	var ns corev1.Namespace
+	if err := json.Unmarshal(req.Object.Raw, &ns); err != nil {
+		a.denyMalformedObject(w, admissionResponse, "namespace", err)
+		return
+	}
+
+	present := changedAnnotations(nil, ns.Annotations)
+	if len(present) == 0 || a.isAnnotationEditor(req) {
+		a.writeAdmissionResponse(w, admissionResponse)
+		return
+	}
+
+	var err error
+	if len(present) == 1 && present[0] == claimAnnotation {
+		err = a.verifyClaim(ctx, &ns, req.UID)
+	} else {
+		err = a.verifyReservedPools(ctx, &ns)
+	}
+	if err == nil {
+		a.writeAdmissionResponse(w, admissionResponse)
+		return
+	}
+	a.Logger.Warn("Denying namespace with protected annotations not written by the webhook",
+		zap.String("namespace", ns.Name), zap.String("user", req.UserInfo.Username), zap.Strings("annotations", present), zap.Error(err))
+	admissionResponse.Allowed = false
+	admissionResponse.Result = denial(statusProtectedAnnotation, "The annotations %v are managed by the IP pool webhook and cannot be set by %s: %v.", present, req.UserInfo.Username, err)
+	a.writeAdmissionResponse(w, admissionResponse)
+}
+
+// verifyReservedPools checks that every pool in the namespace's ipv4pools
+// annotation was reserved by the mutating webhook for this namespace.
+func (a *AdmissionController) verifyReservedPools(ctx context.Context, ns *corev1.Namespace) error {
+	uid := ns.Annotations[requestAnnotation]
+	if uid == "" {
+		return fmt.Errorf("annotation %s is missing", requestAnnotation)
+	}
+	var pools []string
+	if err := json.Unmarshal([]byte(ns.Annotations[ipv4PoolsAnnotation]), &pools); err != nil {
+		return fmt.Errorf("could not decode IP pool annotation: %v", err)
+	}
+	// A dry run reserved nothing
+	if isDryRun(ctx) {
+		return nil
+	}
+	for _, poolName := range pools {
+		pool, err := a.CalicoReader.ProjectcalicoV3().IPPools().Get(ctx, poolName, metav1.GetOptions{})
+		if err != nil {
+			return fmt.Errorf("could not get IP pool %s: %v", poolName, err)
+		}
+		poolLabels := normalizeLabels(pool.ObjectMeta.Labels)
+		if poolLabels["status"] != "pending" || poolLabels[poolRequestLabel] != uid {
+			return fmt.Errorf("IP pool %s is not reserved for this namespace", poolName)
+		}
+	}
+	return nil
+}
+
+// validateIPPool rejects a pool whose CIDR overlaps another pool, other than
+// a master pool and the child pools carved or split from it, and warns
+// about missing labels the allocator depends on.
+func (a *AdmissionController) validateIPPool(ctx context.Context, w http.ResponseWriter, req *admissionv1.AdmissionRequest, admissionResponse *admissionv1.AdmissionResponse) {
+	var pool, oldPool crdv1.IPPool
+	if err := json.Unmarshal(req.Object.Raw, &pool); err != nil {
+		a.denyMalformedObject(w, admissionResponse, "IP pool", err)
+		return
+	}
+	if req.Operation == admissionv1.Update {
+		if err := json.Unmarshal(req.OldObject.Raw, &oldPool); err != nil {
+			a.denyMalformedObject(w, admissionResponse, "old IP pool", err)
+			return
+		}
+	}
+
+	master := a.Config.Hierarchy != nil && pool.Name == a.Config.Hierarchy.MasterPool
+	if !master {
+		poolLabels := normalizeLabels(pool.ObjectMeta.Labels)
+		for _, label := range []string{"location", "status"} {
+			if poolLabels[label] == "" {
+				addWarning(admissionResponse, "IP pool %s has no %s label, the allocator will not consider it", pool.Name, label)
+			}
+		}
+	}
+
+	// Relabeling, which the webhook itself does all the time, needs no check
+	if req.Operation == admissionv1.Update && pool.Spec.CIDR == oldPool.Spec.CIDR {
+		a.writeAdmissionResponse(w, admissionResponse)
+		return
+	}
+	overlapping, err := a.overlappingPool(ctx, &pool)
+	if err != nil {
+		a.Logger.Error("could not check IP pool for overlaps", zap.String("poolName", pool.Name), zap.Error(err))
+		a.deny(w, req, admissionResponse, denial(statusInternalError, "could not check IP pool for overlaps: %v", err), nil)
+		return
+	}
+	if overlapping != nil {
+		a.Logger.Warn("Denying IP pool overlapping an existing pool",
+			zap.String("poolName", pool.Name), zap.String("cidr", pool.Spec.CIDR), zap.String("overlaps", overlapping.Name))
+		admissionResponse.Allowed = false
+		admissionResponse.Result = denial(statusPoolCIDROverlap, "IP pool %s (%s) overlaps IP pool %s (%s).", pool.Name, pool.Spec.CIDR, overlapping.Name, overlapping.Spec.CIDR)
+	}
+	a.writeAdmissionResponse(w, admissionResponse)
+}
+
+// overlappingPool returns an existing pool whose CIDR overlaps the pool's, or
+// nil. Nesting inside a master pool is how the hierarchy and the splitter
+// work and is not an overlap; an unparsable CIDR is left for Calico's own
+// validation.
+func (a *AdmissionController) overlappingPool(ctx context.Context, pool *crdv1.IPPool) (*crdv1.IPPool, error) {
+	ipPools, err := a.CalicoReader.ProjectcalicoV3().IPPools().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("could not list IP pools: %v", err)
+	}
+	for i := range ipPools.Items {
+		existing := &ipPools.Items[i]
+		if existing.Name == pool.Name {
+			continue
+		}
+		if nested(existing, pool) && (a.isMasterOf(existing, pool) || a.isMasterOf(pool, existing)) {
+			continue
+		}
+		overlaps, err := cidr.Overlaps(pool.Spec.CIDR, existing.Spec.CIDR)
+		if err != nil {
+			continue
+		}
+		if overlaps {
+			return existing, nil
+		}
+	}
+	return nil, nil
+}
+
+// nested reports whether one of the pools contains the other.
+func nested(a, b *crdv1.IPPool) bool {
+	return cidr.Contains(a.Spec.CIDR, b.Spec.CIDR) || cidr.Contains(b.Spec.CIDR, a.Spec.CIDR)
+}
+
+// isMasterOf reports whether child pools may be nested in master: it is the
+// hierarchy's master pool, a master the splitter splits, or the parent the
+// child names.
+func (a *AdmissionController) isMasterOf(master, child *crdv1.IPPool) bool {
+	if a.Config.Hierarchy != nil && master.Name == a.Config.Hierarchy.MasterPool {
+		return true
+	}
+	return master.Labels[masterRoleLabel] == masterRole || child.Labels[poolParentLabel] == master.Name
+}
+
+// validateIPPoolDeletion denies deleting a pool that is in use: marked used
+// or pending, or bound to a namespace that still exists. Pools are deleted
+// deliberately by first relabeling them, which RunPoolCleanup does for pools
+// of deleted namespaces under the delete cleanup policy.
+func (a *AdmissionController) validateIPPoolDeletion(ctx context.Context, w http.ResponseWriter, req *admissionv1.AdmissionRequest, admissionResponse *admissionv1.AdmissionResponse) {
+	var pool crdv1.IPPool
+	if err := json.Unmarshal(req.OldObject.Raw, &pool); err != nil {
+		a.denyMalformedObject(w, admissionResponse, "IP pool", err)
+		return
+	}
+
+	reason, err := a.poolInUse(ctx, &pool)
+	if err != nil {
+		a.Logger.Error("could not check whether IP pool is in use", zap.String("poolName", pool.Name), zap.Error(err))
+		a.deny(w, req, admissionResponse, denial(statusInternalError, "could not check whether IP pool is in use: %v", err), nil)
+		return
+	}
+	if reason == "" {
+		a.writeAdmissionResponse(w, admissionResponse)
+		return
+	}
+	a.Logger.Warn("Denying deletion of IP pool in use",
+		zap.String("poolName", pool.Name), zap.String("user", req.UserInfo.Username), zap.String("reason", reason))
+	admissionResponse.Allowed = false
+	admissionResponse.Result = denial(statusPoolInUse, "IP pool %s is in use (%s) and cannot be deleted; release it or relabel it first.", pool.Name, reason)
+	a.writeAdmissionResponse(w, admissionResponse)
+}
+
+// poolInUse returns why a pool must not be deleted, or "" if it may be.
+func (a *AdmissionController) poolInUse(ctx context.Context, pool *crdv1.IPPool) (string, error) {
+	poolLabels := normalizeLabels(pool.ObjectMeta.Labels)
+	if status := poolLabels["status"]; status == "used" || status == "pending" {
+		return fmt.Sprintf("marked %s", status), nil
+	}
+	owner := poolLabels[poolNamespaceLabel]
+	if owner == "" {
+		return "", nil
+	}
+	_, err := a.K8sReader.CoreV1().Namespaces().Get(ctx, owner, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("could not get namespace %s: %v", owner, err)
+	}
+	return fmt.Sprintf("bound to namespace %s", owner), nil
+}
+
+// isAnnotationEditor reports whether the request comes from a configured
+// annotation editor or from our own write identity.
+func (a *AdmissionController) isAnnotationEditor(req *admissionv1.AdmissionRequest) bool {
+	return a.Config.AnnotationEditors.Allows(req.UserInfo.Username, req.UserInfo.Groups) ||
+		(a.WriteUser != "" && req.UserInfo.Username == a.WriteUser)
+}
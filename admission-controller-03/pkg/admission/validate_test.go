@@ -0,0 +1,98 @@
+package admission
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.uber.org/zap"
+
+	crdv1 "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
+	calicofake "github.com/projectcalico/api/pkg/client/clientset_generated/clientset/fake"
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8sruntime "k8s.io/apimachinery/pkg/runtime"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+
+	"admission-controller-03/pkg/config"
+)
+
+func TestValidateIPPoolOverlap(t *testing.T) {
+	existing := []k8sruntime.Object{
+		&crdv1.IPPool{
+			ObjectMeta: metav1.ObjectMeta{Name: "master", Labels: map[string]string{masterRoleLabel: masterRole}},
+			Spec:       crdv1.IPPoolSpec{CIDR: "10.0.0.0/16"},
+		},
+		&crdv1.IPPool{
+			ObjectMeta: metav1.ObjectMeta{Name: "master-10-0-0-0-24", Labels: map[string]string{poolParentLabel: "master"}},
+			Spec:       crdv1.IPPoolSpec{CIDR: "10.0.0.0/24"},
+		},
+		&crdv1.IPPool{
+			ObjectMeta: metav1.ObjectMeta{Name: "static"},
+			Spec:       crdv1.IPPoolSpec{CIDR: "192.168.0.0/24"},
+		},
+	}
+	a := NewAdmissionControllerFromClients(zap.NewNop(), config.Default(), calicofake.NewSimpleClientset(existing...), k8sfake.NewSimpleClientset())
+	a.Shutdown()
+	a.Recorder = &record.FakeRecorder{}
+
+	tests := []struct {
+		name    string
+		pool    *crdv1.IPPool
+		allowed bool
+	}{
+		{
+			name:    "child split from a master",
+			pool:    &crdv1.IPPool{ObjectMeta: metav1.ObjectMeta{Name: "master-10-0-1-0-24", Labels: map[string]string{poolParentLabel: "master"}}, Spec: crdv1.IPPoolSpec{CIDR: "10.0.1.0/24"}},
+			allowed: true,
+		},
+		{
+			name: "child overlapping a sibling",
+			pool: &crdv1.IPPool{ObjectMeta: metav1.ObjectMeta{Name: "master-10-0-0-0-25", Labels: map[string]string{poolParentLabel: "master"}}, Spec: crdv1.IPPoolSpec{CIDR: "10.0.0.0/25"}},
+		},
+		{
+			name: "pool nested in a static pool",
+			pool: &crdv1.IPPool{ObjectMeta: metav1.ObjectMeta{Name: "inner"}, Spec: crdv1.IPPoolSpec{CIDR: "192.168.0.0/26"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw, err := json.Marshal(tt.pool)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := json.Marshal(admissionv1.AdmissionReview{
+				TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+				Request: &admissionv1.AdmissionRequest{
+					UID:       "uid-pool",
+					Kind:      metav1.GroupVersionKind{Group: "projectcalico.org", Version: "v3", Kind: "IPPool"},
+					Name:      tt.pool.Name,
+					Operation: admissionv1.Create,
+					Object:    k8sruntime.RawExtension{Raw: raw},
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := httptest.NewRecorder()
+			a.HandleValidation(w, httptest.NewRequest(http.MethodPost, "/validate", bytes.NewReader(body)))
+			var out admissionv1.AdmissionReview
+			if err := json.Unmarshal(w.Body.Bytes(), &out); err != nil || out.Response == nil {
+				t.Fatalf("response is not an AdmissionReview: %v", err)
+			}
+			resp := out.Response
+			if tt.allowed {
+				if !resp.Allowed {
+					t.Errorf("denied: %v", resp.Result)
+				}
+				return
+			}
+			if resp.Allowed || resp.Result == nil || resp.Result.Reason != statusPoolCIDROverlap {
+				t.Errorf("got allowed=%v %v, want %s", resp.Allowed, resp.Result, statusPoolCIDROverlap)
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package admission
+
+import (
+	"context"
+	"fmt"
+
+	"go.uber.org/zap"
+
+	crdv1 "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
+	admissionv1 "k8s.io/api/admission/v1"
+)
+
+// quotaWarningRatio is the share of a tenant's pool quota above which an
+// assignment warns that the quota is nearly used up.
+const quotaWarningRatio = 0.9
+
+// addWarning appends a non-fatal condition to the response, which kubectl
+// prints inline to the user. A condition met again while retrying selection
+// is only reported once.
+func addWarning(admissionResponse *admissionv1.AdmissionResponse, format string, args ...interface{}) {
+	warning := fmt.Sprintf(format, args...)
+	for _, existing := range admissionResponse.Warnings {
+		if existing == warning {
+			return
+		}
+	}
+	admissionResponse.Warnings = append(admissionResponse.Warnings, warning)
+}
+
+// assignmentWarnings warns when assigning poolName leaves the tenant close to
+// its pool quota, or leaves the pool's zone below its low pool threshold.
+// pools is the list the pool was selected from.
+func (a *AdmissionController) assignmentWarnings(ctx context.Context, admissionResponse *admissionv1.AdmissionResponse, poolName, tenant string, pools []crdv1.IPPool) {
+	if t, _ := a.tenantPolicy(tenant); t.MaxPools > 0 {
+		maxPools := t.MaxPools
+		held := countTenantPools(pools, tenant) + 1
+		// At or over the quota is already reported when the pool is selected
+		if held < maxPools && float64(held) >= quotaWarningRatio*float64(maxPools) {
+			addWarning(admissionResponse, "tenant %s now holds %d of its %d allowed IP pools", tenant, held, maxPools)
+		}
+	}
+
+	zone := a.Config.Location
+	for _, pool := range pools {
+		if pool.Name == poolName {
+			zone = normalizeLabels(pool.ObjectMeta.Labels)["location"]
+			break
+		}
+	}
+	threshold := a.Config.LowPoolThresholdFor(zone)
+	if threshold <= 0 {
+		return
+	}
+	zonePools, err := a.poolsIn(ctx, zone, "available")
+	if err != nil {
+		a.Logger.Warn("Failed to count available pools in zone", zap.String("zone", zone), zap.Error(err))
+		return
+	}
+	available := 0
+	for _, pool := range withoutPool(zonePools, poolName) {
+		if !poolCordoned(normalizeLabels(pool.ObjectMeta.Labels)) {
+			available++
+		}
+	}
+	if available < threshold {
+		addWarning(admissionResponse, "zone %s has %d available IP pools left, below the threshold of %d", zone, available, threshold)
+	}
+}
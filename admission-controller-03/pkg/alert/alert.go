@@ -0,0 +1,140 @@
+package alert
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Kind names a condition operators are alerted about.
+type Kind string
+
+const (
+	KindPoolExhausted     Kind = "pool-exhausted"
+	KindAllocationFailing Kind = "allocation-failing"
+	KindReleaseBlocked    Kind = "release-blocked"
+)
+
+const (
+	// DefaultCooldown is how long alerts of the same kind and key are held
+	// back after one was sent.
+	DefaultCooldown = 15 * time.Minute
+	sendTimeout     = 10 * time.Second
+)
+
+// Alert is the payload posted to a generic webhook.
+type Alert struct {
+	Kind       Kind      `json:"kind"`
+	Key        string    `json:"key"`
+	Message    string    `json:"message"`
+	Suppressed int       `json:"suppressed"`
+	Time       time.Time `json:"time"`
+}
+
+// Alerter posts alerts to a Slack incoming webhook and/or a generic HTTP
+// endpoint. Alerts of the same kind and key are rate limited: after one is
+// sent, repeats are only counted until the cooldown has passed, and the next
+// alert reports how many were suppressed.
+type Alerter struct {
+	SlackWebhookURL string
+	WebhookURL      string
+	Cooldown        time.Duration
+	Client          *http.Client
+	Logger          *zap.Logger
+
+	mu         sync.Mutex
+	last       map[string]time.Time
+	suppressed map[string]int
+}
+
+// Fire sends an alert in the background unless it is rate limited. It never
+// blocks the caller.
+func (a *Alerter) Fire(kind Kind, key, format string, args ...interface{}) {
+	if a == nil {
+		return
+	}
+	alert := Alert{Kind: kind, Key: key, Message: fmt.Sprintf(format, args...), Time: time.Now().UTC()}
+	if !a.allow(&alert) {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+		defer cancel()
+		if err := a.send(ctx, alert); err != nil {
+			a.Logger.Warn("could not send alert", zap.String("kind", string(kind)), zap.String("key", key), zap.Error(err))
+		}
+	}()
+}
+
+func (a *Alerter) allow(alert *Alert) bool {
+	cooldown := a.Cooldown
+	if cooldown <= 0 {
+		cooldown = DefaultCooldown
+	}
+	id := string(alert.Kind) + "/" + alert.Key
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.last == nil {
+		a.last = map[string]time.Time{}
+		a.suppressed = map[string]int{}
+	}
+	if last, ok := a.last[id]; ok && alert.Time.Sub(last) < cooldown {
+		a.suppressed[id]++
+		return false
+	}
+	a.last[id] = alert.Time
+	alert.Suppressed = a.suppressed[id]
+	delete(a.suppressed, id)
+	return true
+}
+
+func (a *Alerter) send(ctx context.Context, alert Alert) error {
+	if a.SlackWebhookURL != "" {
+		text := fmt.Sprintf(":rotating_light: *%s* %s", alert.Kind, alert.Message)
+		if alert.Suppressed > 0 {
+			text += fmt.Sprintf(" (%d similar alerts suppressed)", alert.Suppressed)
+		}
+		if err := a.post(ctx, a.SlackWebhookURL, map[string]string{"text": text}); err != nil {
+			return fmt.Errorf("could not post to Slack: %v", err)
+		}
+	}
+	if a.WebhookURL != "" {
+		if err := a.post(ctx, a.WebhookURL, alert); err != nil {
+			return fmt.Errorf("could not post to webhook: %v", err)
+		}
+	}
+	return nil
+}
+
+func (a *Alerter) post(ctx context.Context, url string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := a.Client
+	if client == nil {
+		client = &http.Client{Timeout: sendTimeout}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
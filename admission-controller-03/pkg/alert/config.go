@@ -0,0 +1,30 @@
+package alert
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"admission-controller-03/pkg/config"
+)
+
+// New builds an alerter from the config, reading the Slack webhook URL from
+// its mounted file as it carries a secret.
+func New(logger *zap.Logger, cfg *config.Alerts) (*Alerter, error) {
+	alerter := &Alerter{
+		WebhookURL: cfg.WebhookURL,
+		Cooldown:   time.Duration(cfg.CooldownSeconds) * time.Second,
+		Logger:     logger,
+	}
+	if cfg.SlackWebhookURLFile != "" {
+		url, err := os.ReadFile(cfg.SlackWebhookURLFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read Slack webhook URL: %v", err)
+		}
+		alerter.SlackWebhookURL = strings.TrimSpace(string(url))
+	}
+	return alerter, nil
+}
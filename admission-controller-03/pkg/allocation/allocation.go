@@ -0,0 +1,148 @@
+// Package allocation defines the IPPoolAllocation resource, the record of one
+// IP pool assignment. There is no generated client; the types convert to and
+// from the unstructured objects the dynamic client works with.
+package allocation
+
+import (
+	_ "embed"
+	"fmt"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	Group   = "ipam.example.com"
+	Version = "v1alpha1"
+	Kind    = "IPPoolAllocation"
+)
+
+// Resource is the IPPoolAllocation resource, cluster scoped.
+var Resource = schema.GroupVersionResource{Group: Group, Version: Version, Resource: "ippoolallocations"}
+
+//go:embed crd.yaml
+var crdManifest []byte
+
+// CRD returns the CustomResourceDefinition of IPPoolAllocation.
+func CRD() (*unstructured.Unstructured, error) {
+	var object map[string]interface{}
+	if err := yaml.Unmarshal(crdManifest, &object); err != nil {
+		return nil, fmt.Errorf("could not decode CRD manifest: %v", err)
+	}
+	return &unstructured.Unstructured{Object: object}, nil
+}
+
+// Phase is where an allocation is in its lifecycle.
+type Phase string
+
+const (
+	// PhasePending: the pool is reserved, the namespace does not exist yet.
+	PhasePending Phase = "Pending"
+	// PhaseBound: the namespace exists and holds the pool.
+	PhaseBound Phase = "Bound"
+	// PhaseQuarantined: the pool was taken out of circulation because its
+	// state contradicts itself; an operator has to look at it.
+	PhaseQuarantined Phase = "Quarantined"
+	// PhaseReleased: the pool went back into circulation. Released
+	// allocations are kept for a while as history.
+	PhaseReleased Phase = "Released"
+	// PhaseFailed: the pool was never held, the assignment failed or its
+	// reservation lapsed. Failed allocations are kept like released ones.
+	PhaseFailed Phase = "Failed"
+)
+
+const (
+	// ConditionReserved is True while the pool carries the allocation's
+	// request, whatever the namespace's state.
+	ConditionReserved = "Reserved"
+	// ConditionReady is True while the allocation's namespace holds the pool.
+	ConditionReady = "Ready"
+	// ConditionQuarantined is True while the pool is quarantined.
+	ConditionQuarantined = "Quarantined"
+)
+
+// IPPoolAllocation records that a pool was assigned to a namespace.
+type IPPoolAllocation struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   Spec   `json:"spec"`
+	Status Status `json:"status,omitempty"`
+}
+
+// Spec is what was asked for.
+type Spec struct {
+	// Namespace is empty until a namespace created with generateName exists.
+	Namespace  string    `json:"namespace,omitempty"`
+	RequestUID types.UID `json:"requestUID"`
+	Tenant     string    `json:"tenant,omitempty"`
+	// PrefixLength is the requested pool size, 0 for any.
+	PrefixLength int    `json:"prefixLength,omitempty"`
+	Zone         string `json:"zone,omitempty"`
+}
+
+// Status is what was assigned.
+type Status struct {
+	Pool  string `json:"pool,omitempty"`
+	CIDR  string `json:"cidr,omitempty"`
+	Phase Phase  `json:"phase,omitempty"`
+	// Reason and Message say why the allocation is in its phase.
+	Reason  string `json:"reason,omitempty"`
+	Message string `json:"message,omitempty"`
+	// LastPhaseTransitionTime is when the allocation entered its phase.
+	LastPhaseTransitionTime *metav1.Time       `json:"lastPhaseTransitionTime,omitempty"`
+	ReleasedAt              *metav1.Time       `json:"releasedAt,omitempty"`
+	Conditions              []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// Finished reports whether the allocation reached a phase it never leaves.
+func (s *Status) Finished() bool {
+	return s.Phase == PhaseReleased || s.Phase == PhaseFailed
+}
+
+// Name returns the name of the allocation made by a request. It is unique per
+// request, so a retried request finds its allocation and a namespace
+// recreated under the same name gets a new one.
+func Name(namespace, generateName string, uid types.UID) string {
+	prefix := namespace
+	if prefix == "" {
+		prefix = strings.TrimSuffix(generateName, "-")
+	}
+	suffix := strings.ReplaceAll(string(uid), "-", "")
+	if len(suffix) > 8 {
+		suffix = suffix[:8]
+	}
+	// Object names are at most 253 characters
+	if max := 253 - len(suffix) - 1; len(prefix) > max {
+		prefix = prefix[:max]
+	}
+	if prefix == "" {
+		return suffix
+	}
+	return prefix + "-" + suffix
+}
+
+// ToUnstructured converts an allocation for the dynamic client.
+func ToUnstructured(a *IPPoolAllocation) (*unstructured.Unstructured, error) {
+	a.APIVersion = Group + "/" + Version
+	a.Kind = Kind
+	object, err := runtime.DefaultUnstructuredConverter.ToUnstructured(a)
+	if err != nil {
+		return nil, fmt.Errorf("could not convert IPPoolAllocation %s: %v", a.Name, err)
+	}
+	return &unstructured.Unstructured{Object: object}, nil
+}
+
+// FromUnstructured converts an object read through the dynamic client.
+func FromUnstructured(u *unstructured.Unstructured) (*IPPoolAllocation, error) {
+	var a IPPoolAllocation
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, &a); err != nil {
+		return nil, fmt.Errorf("could not convert IPPoolAllocation %s: %v", u.GetName(), err)
+	}
+	return &a, nil
+}
@@ -0,0 +1,144 @@
+// Package v1beta1 defines version v1beta1 of IPPoolAllocation and its
+// conversion from and to v1alpha1, the storage version. v1beta1 groups what
+// was asked for under spec.requirements and drops status.releasedAt, which
+// status.lastPhaseTransitionTime of a Released allocation replaces.
+package v1beta1
+
+import (
+	"fmt"
+
+	"admission-controller-03/pkg/allocation"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const Version = "v1beta1"
+
+// IPPoolAllocation records that a pool was assigned to a namespace.
+type IPPoolAllocation struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   Spec   `json:"spec"`
+	Status Status `json:"status,omitempty"`
+}
+
+// Spec is what was asked for.
+type Spec struct {
+	// Namespace is empty until a namespace created with generateName exists.
+	Namespace    string       `json:"namespace,omitempty"`
+	RequestUID   types.UID    `json:"requestUID"`
+	Tenant       string       `json:"tenant,omitempty"`
+	Requirements Requirements `json:"requirements,omitempty"`
+}
+
+// Requirements constrain the pool that may be assigned.
+type Requirements struct {
+	// PrefixLength is the requested pool size, 0 for any.
+	PrefixLength int    `json:"prefixLength,omitempty"`
+	Zone         string `json:"zone,omitempty"`
+}
+
+// Status is what was assigned.
+type Status struct {
+	Pool                    string             `json:"pool,omitempty"`
+	CIDR                    string             `json:"cidr,omitempty"`
+	Phase                   allocation.Phase   `json:"phase,omitempty"`
+	Reason                  string             `json:"reason,omitempty"`
+	Message                 string             `json:"message,omitempty"`
+	LastPhaseTransitionTime *metav1.Time       `json:"lastPhaseTransitionTime,omitempty"`
+	Conditions              []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// FromV1alpha1 converts a v1alpha1 allocation. Allocations released before
+// the phase transition time was recorded take it from their release time.
+func FromV1alpha1(in *allocation.IPPoolAllocation) *IPPoolAllocation {
+	out := &IPPoolAllocation{
+		TypeMeta:   metav1.TypeMeta{APIVersion: allocation.Group + "/" + Version, Kind: allocation.Kind},
+		ObjectMeta: in.ObjectMeta,
+		Spec: Spec{
+			Namespace:  in.Spec.Namespace,
+			RequestUID: in.Spec.RequestUID,
+			Tenant:     in.Spec.Tenant,
+			Requirements: Requirements{
+				PrefixLength: in.Spec.PrefixLength,
+				Zone:         in.Spec.Zone,
+			},
+		},
+		Status: Status{
+			Pool:                    in.Status.Pool,
+			CIDR:                    in.Status.CIDR,
+			Phase:                   in.Status.Phase,
+			Reason:                  in.Status.Reason,
+			Message:                 in.Status.Message,
+			LastPhaseTransitionTime: in.Status.LastPhaseTransitionTime,
+			Conditions:              in.Status.Conditions,
+		},
+	}
+	if out.Status.LastPhaseTransitionTime == nil && in.Status.Phase == allocation.PhaseReleased {
+		out.Status.LastPhaseTransitionTime = in.Status.ReleasedAt
+	}
+	return out
+}
+
+// ToV1alpha1 converts to a v1alpha1 allocation.
+func ToV1alpha1(in *IPPoolAllocation) *allocation.IPPoolAllocation {
+	out := &allocation.IPPoolAllocation{
+		TypeMeta:   metav1.TypeMeta{APIVersion: allocation.Group + "/" + allocation.Version, Kind: allocation.Kind},
+		ObjectMeta: in.ObjectMeta,
+		Spec: allocation.Spec{
+			Namespace:    in.Spec.Namespace,
+			RequestUID:   in.Spec.RequestUID,
+			Tenant:       in.Spec.Tenant,
+			PrefixLength: in.Spec.Requirements.PrefixLength,
+			Zone:         in.Spec.Requirements.Zone,
+		},
+		Status: allocation.Status{
+			Pool:                    in.Status.Pool,
+			CIDR:                    in.Status.CIDR,
+			Phase:                   in.Status.Phase,
+			Reason:                  in.Status.Reason,
+			Message:                 in.Status.Message,
+			LastPhaseTransitionTime: in.Status.LastPhaseTransitionTime,
+			Conditions:              in.Status.Conditions,
+		},
+	}
+	if in.Status.Phase == allocation.PhaseReleased {
+		out.Status.ReleasedAt = in.Status.LastPhaseTransitionTime
+	}
+	return out
+}
+
+// Convert converts an IPPoolAllocation of either version to the given
+// version.
+func Convert(in *unstructured.Unstructured, toVersion string) (*unstructured.Unstructured, error) {
+	from := in.GroupVersionKind().Version
+	if from == toVersion {
+		return in, nil
+	}
+	var out interface{}
+	switch {
+	case from == allocation.Version && toVersion == Version:
+		old, err := allocation.FromUnstructured(in)
+		if err != nil {
+			return nil, err
+		}
+		out = FromV1alpha1(old)
+	case from == Version && toVersion == allocation.Version:
+		var beta IPPoolAllocation
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(in.Object, &beta); err != nil {
+			return nil, fmt.Errorf("could not convert IPPoolAllocation %s: %v", in.GetName(), err)
+		}
+		out = ToV1alpha1(&beta)
+	default:
+		return nil, fmt.Errorf("cannot convert IPPoolAllocation from %s to %s", from, toVersion)
+	}
+	object, err := runtime.DefaultUnstructuredConverter.ToUnstructured(out)
+	if err != nil {
+		return nil, fmt.Errorf("could not convert IPPoolAllocation %s: %v", in.GetName(), err)
+	}
+	return &unstructured.Unstructured{Object: object}, nil
+}
@@ -0,0 +1,30 @@
+// Package allocator defines the gRPC allocation service through which systems
+// outside Kubernetes, such as VM provisioning and firewall automation, reserve
+// subnets from the same pools the webhook hands to namespaces. The webhooks of
+// a fleet of clusters sharing a supernet reserve theirs through it too, see
+// backend.Central.
+//
+// The service is defined in allocator.proto; clients in other languages
+// generate their stubs from it.
+package allocator
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative allocator.proto
+
+import (
+	"context"
+)
+
+// ServiceName is the full name of the allocation service.
+const ServiceName = "ipam.v1.Allocator"
+
+// TokenCredentials sends the API token with every call. They require a TLS
+// connection.
+type TokenCredentials string
+
+func (t TokenCredentials) GetRequestMetadata(context.Context, ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + string(t)}, nil
+}
+
+func (TokenCredentials) RequireTransportSecurity() bool {
+	return true
+}
@@ -0,0 +1,133 @@
+package apimetrics
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	clientmetrics "k8s.io/client-go/tools/metrics"
+)
+
+var (
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "ipam_api_request_duration_seconds",
+		Help:    "Latency of Kubernetes and Calico API requests by verb and resource.",
+		Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+	}, []string{"api", "verb", "resource"})
+	requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ipam_api_requests_total",
+		Help: "Kubernetes and Calico API requests by verb, resource and status code; code is \"error\" when no response was received.",
+	}, []string{"api", "verb", "resource", "code"})
+	throttleDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "ipam_api_rate_limiter_duration_seconds",
+		Help:    "Time API requests spent waiting on the client-side rate limiter.",
+		Buckets: []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+	}, []string{"api", "verb", "resource"})
+)
+
+// Register registers the API client metrics with reg and hooks the client-go
+// rate limiter so throttled requests are measured.
+func Register(reg prometheus.Registerer) error {
+	for _, c := range []prometheus.Collector{requestDuration, requests, throttleDuration} {
+		if err := reg.Register(c); err != nil {
+			return err
+		}
+	}
+	clientmetrics.Register(clientmetrics.RegisterOpts{RateLimiterLatency: rateLimiterLatency{}})
+	return nil
+}
+
+// NewTransport measures the latency and outcome of every request sent through
+// rt. It is meant for rest.Config.Wrap.
+func NewTransport(rt http.RoundTripper) http.RoundTripper {
+	return &transport{next: rt}
+}
+
+type transport struct {
+	next http.RoundTripper
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	api, resource, named := parsePath(req.URL.Path)
+	verb := requestVerb(req.Method, named, req.URL.Query().Get("watch") == "true")
+	// Watches stay open for their whole lifetime, their latency is meaningless
+	if verb != "watch" {
+		requestDuration.WithLabelValues(api, verb, resource).Observe(time.Since(start).Seconds())
+	}
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	requests.WithLabelValues(api, verb, resource, code).Inc()
+	return resp, err
+}
+
+type rateLimiterLatency struct{}
+
+func (rateLimiterLatency) Observe(_ context.Context, method string, u url.URL, latency time.Duration) {
+	api, resource, named := parsePath(u.Path)
+	throttleDuration.WithLabelValues(api, requestVerb(method, named, u.Query().Get("watch") == "true"), resource).Observe(latency.Seconds())
+}
+
+// requestVerb maps an HTTP method onto the Kubernetes API verb.
+func requestVerb(method string, named, watch bool) string {
+	switch method {
+	case http.MethodGet:
+		switch {
+		case watch:
+			return "watch"
+		case named:
+			return "get"
+		default:
+			return "list"
+		}
+	case http.MethodPost:
+		return "create"
+	case http.MethodPut:
+		return "update"
+	case http.MethodPatch:
+		return "patch"
+	case http.MethodDelete:
+		return "delete"
+	}
+	return strings.ToLower(method)
+}
+
+// parsePath extracts the API (calico or kubernetes) and the resource, with
+// its subresource if any, from a request path, and reports whether it names
+// a single object. Object names never end up in labels.
+func parsePath(path string) (api, resource string, named bool) {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	api = "kubernetes"
+	switch {
+	case len(segments) >= 2 && segments[0] == "api":
+		segments = segments[2:]
+	case len(segments) >= 3 && segments[0] == "apis":
+		if strings.HasSuffix(segments[1], "projectcalico.org") {
+			api = "calico"
+		}
+		segments = segments[3:]
+	default:
+		return api, "other", false
+	}
+	// A namespace prefix, unless the path is about the namespace itself
+	if len(segments) >= 3 && segments[0] == "namespaces" {
+		segments = segments[2:]
+	}
+	switch len(segments) {
+	case 0:
+		return api, "discovery", false
+	case 1:
+		return api, segments[0], false
+	case 2:
+		return api, segments[0], true
+	default:
+		return api, segments[0] + "/" + segments[2], true
+	}
+}
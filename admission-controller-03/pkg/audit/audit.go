@@ -0,0 +1,100 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Record is one admission decision.
+type Record struct {
+	Time      time.Time       `json:"time"`
+	UID       string          `json:"uid"`
+	Kind      string          `json:"kind"`
+	Operation string          `json:"operation"`
+	Namespace string          `json:"namespace"`
+	User      string          `json:"user"`
+	DryRun    bool            `json:"dryRun,omitempty"`
+	Pool      string          `json:"pool,omitempty"`
+	Patch     json.RawMessage `json:"patch,omitempty"`
+	Decision  string          `json:"decision"`
+	Reason    string          `json:"reason,omitempty"`
+	Code      string          `json:"code,omitempty"`
+	Warnings  []string        `json:"warnings,omitempty"`
+	LatencyMS float64         `json:"latencyMs"`
+}
+
+const (
+	DecisionAllowed = "allowed"
+	DecisionDenied  = "denied"
+	DecisionError   = "error"
+)
+
+// Log appends records as JSON lines. Writes are serialized, and synced to disk
+// when the log is a file, so a record is durable once Write returns.
+type Log struct {
+	mu   sync.Mutex
+	w    io.Writer
+	file *os.File
+}
+
+// Open appends to the file at path, or writes to stdout when path is "-".
+func Open(path string) (*Log, error) {
+	if path == "-" {
+		return &Log{w: os.Stdout}, nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		return nil, fmt.Errorf("could not open audit log: %v", err)
+	}
+	return &Log{w: f, file: f}, nil
+}
+
+// Write appends a record.
+func (l *Log) Write(record *Record) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("could not encode audit record: %v", err)
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.w.Write(line); err != nil {
+		return fmt.Errorf("could not write audit record: %v", err)
+	}
+	if l.file != nil {
+		if err := l.file.Sync(); err != nil {
+			return fmt.Errorf("could not sync audit log: %v", err)
+		}
+	}
+	return nil
+}
+
+// Close closes the underlying file, if any.
+func (l *Log) Close() error {
+	if l.file != nil {
+		return l.file.Close()
+	}
+	return nil
+}
+
+type contextKey struct{}
+
+// NewContext returns a context carrying the record of the request in flight,
+// so that handlers deep in the call chain can add to it.
+func NewContext(ctx context.Context, record *Record) context.Context {
+	return context.WithValue(ctx, contextKey{}, record)
+}
+
+// FromContext returns the record carried by ctx, or a throwaway one.
+func FromContext(ctx context.Context) *Record {
+	if record, ok := ctx.Value(contextKey{}).(*Record); ok {
+		return record
+	}
+	return &Record{}
+}
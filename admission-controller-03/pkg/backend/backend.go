@@ -0,0 +1,48 @@
+// Package backend defines the source of the subnets handed to namespaces. The
+// default, Calico-native backend hands out IPPools labeled available; an
+// external IPAM backend allocates subnets for which the webhook creates the
+// IPPools itself.
+package backend
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrExhausted is returned by AllocateSubnet when no subnet is free.
+var ErrExhausted = errors.New("no free subnet")
+
+// Request describes the subnet wanted for a namespace.
+type Request struct {
+	// Namespace is the name of the namespace, or its generateName prefix
+	// followed by "*" while it has none.
+	Namespace string
+	Tenant    string
+	Zone      string
+	// PrefixLength is the tenant's default prefix length, zero for the
+	// backend's own default.
+	PrefixLength int
+}
+
+// Subnet is a subnet of a backend.
+type Subnet struct {
+	CIDR string
+	Zone string
+	// Pool names the IPPool already serving the subnet. Only the
+	// Calico-native backend sets it; the webhook creates the pool of an
+	// external backend's subnet.
+	Pool string
+}
+
+// IPAMBackend allocates and releases namespace subnets.
+type IPAMBackend interface {
+	// AllocateSubnet reserves a subnet for the request, or returns
+	// ErrExhausted.
+	AllocateSubnet(ctx context.Context, req Request) (Subnet, error)
+	// ReleaseSubnet hands a subnet back once its pool is gone. Releasing a
+	// subnet that is not allocated is not an error.
+	ReleaseSubnet(ctx context.Context, subnet Subnet) error
+	// ListFree returns the subnets of a zone that AllocateSubnet may hand
+	// out, every zone's when zone is empty.
+	ListFree(ctx context.Context, zone string) ([]Subnet, error)
+}
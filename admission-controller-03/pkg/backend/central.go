@@ -0,0 +1,80 @@
+package backend
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"admission-controller-03/pkg/allocator"
+)
+
+// Central allocates namespace subnets from the allocation service of a
+// central webhook, which hands the pools of a supernet shared by a fleet of
+// clusters to every cluster's webhook as an external consumer. As the
+// central webhook holds every assignment of the fleet, no two clusters are
+// ever handed overlapping subnets; each cluster still creates the IPPools and
+// annotates its namespaces itself.
+//
+// The central webhook selects pools by its own config: tenants must be
+// configured alike on both sides, and zones are the central webhook's.
+type Central struct {
+	Client allocator.AllocatorClient
+	// Cluster names this cluster in the consumers of its allocations.
+	Cluster string
+}
+
+// AllocateSubnet reserves a pool of the central webhook. Every allocation is
+// a consumer of its own, named after the cluster, so that a subnet is never
+// handed back to a namespace whose earlier pool is still being released.
+func (c *Central) AllocateSubnet(ctx context.Context, req Request) (Subnet, error) {
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return Subnet{}, err
+	}
+	alloc, err := c.Client.Allocate(ctx, &allocator.AllocateRequest{
+		Consumer: c.Cluster + "." + hex.EncodeToString(suffix),
+		Tenant:   req.Tenant,
+	})
+	if status.Code(err) == codes.ResourceExhausted {
+		return Subnet{}, ErrExhausted
+	}
+	if err != nil {
+		return Subnet{}, fmt.Errorf("could not allocate from the central allocator: %v", err)
+	}
+	return Subnet{CIDR: alloc.Cidr, Zone: alloc.Zone}, nil
+}
+
+// ReleaseSubnet hands back the pool of the subnet held by this cluster.
+func (c *Central) ReleaseSubnet(ctx context.Context, subnet Subnet) error {
+	held, err := c.Client.Query(ctx, &allocator.QueryRequest{})
+	if err != nil {
+		return fmt.Errorf("could not query the central allocator: %v", err)
+	}
+	for _, alloc := range held.Allocations {
+		if alloc.Cidr != subnet.CIDR || !strings.HasPrefix(alloc.Consumer, c.Cluster+".") {
+			continue
+		}
+		_, err := c.Client.Release(ctx, &allocator.ReleaseRequest{Consumer: alloc.Consumer})
+		if err != nil && status.Code(err) != codes.NotFound {
+			return fmt.Errorf("could not release %s to the central allocator: %v", subnet.CIDR, err)
+		}
+	}
+	return nil
+}
+
+func (c *Central) ListFree(ctx context.Context, zone string) ([]Subnet, error) {
+	response, err := c.Client.ListFree(ctx, &allocator.ListFreeRequest{Zone: zone})
+	if err != nil {
+		return nil, fmt.Errorf("could not list free pools of the central allocator: %v", err)
+	}
+	free := make([]Subnet, 0, len(response.Pools))
+	for _, pool := range response.Pools {
+		free = append(free, Subnet{CIDR: pool.Cidr, Zone: pool.Zone})
+	}
+	return free, nil
+}
@@ -0,0 +1,89 @@
+package backend
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+
+	"admission-controller-03/pkg/allocator"
+	"admission-controller-03/pkg/config"
+)
+
+// New builds the external backend configured in cfg, whose subnets are in
+// zone, reading any credentials from their mounted files.
+func New(cfg *config.Backend, zone string) (IPAMBackend, error) {
+	if n := cfg.NetBox; n != nil {
+		token, err := os.ReadFile(n.TokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read NetBox token: %v", err)
+		}
+		return &NetBox{
+			URL:          n.URL,
+			Token:        strings.TrimSpace(string(token)),
+			ParentPrefix: n.ParentPrefix,
+			PrefixLength: n.PrefixLength,
+			Zone:         zone,
+			TenantSlugs:  n.TenantSlugs,
+		}, nil
+	}
+	if ib := cfg.Infoblox; ib != nil {
+		username, err := os.ReadFile(filepath.Join(ib.CredentialsDir, "username"))
+		if err != nil {
+			return nil, fmt.Errorf("could not read Infoblox username: %v", err)
+		}
+		password, err := os.ReadFile(filepath.Join(ib.CredentialsDir, "password"))
+		if err != nil {
+			return nil, fmt.Errorf("could not read Infoblox password: %v", err)
+		}
+		backend := &Infoblox{
+			URL:                ib.URL,
+			Username:           strings.TrimSpace(string(username)),
+			Password:           strings.TrimSpace(string(password)),
+			NetworkView:        ib.NetworkView,
+			Container:          ib.Container,
+			PrefixLength:       ib.PrefixLength,
+			NamespaceAttribute: ib.NamespaceAttribute,
+			TenantAttribute:    ib.TenantAttribute,
+			Zone:               zone,
+		}
+		if backend.NamespaceAttribute == "" {
+			backend.NamespaceAttribute = "Namespace"
+		}
+		if backend.TenantAttribute == "" {
+			backend.TenantAttribute = "Tenant"
+		}
+		return backend, nil
+	}
+	if c := cfg.Central; c != nil {
+		token, err := os.ReadFile(c.TokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read central allocator token: %v", err)
+		}
+		tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+		if c.CAFile != "" {
+			pem, err := os.ReadFile(c.CAFile)
+			if err != nil {
+				return nil, fmt.Errorf("could not read central allocator CA file: %v", err)
+			}
+			tlsConfig.RootCAs = x509.NewCertPool()
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificate found in central allocator CA file %s", c.CAFile)
+			}
+		}
+		conn, err := grpc.NewClient(c.Address,
+			grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)),
+			grpc.WithPerRPCCredentials(allocator.TokenCredentials(strings.TrimSpace(string(token)))),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("could not connect to the central allocator: %v", err)
+		}
+		return &Central{Client: allocator.NewAllocatorClient(conn), Cluster: c.Cluster}, nil
+	}
+	return NewMock(zone, cfg.Mock.Subnets), nil
+}
@@ -0,0 +1,261 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	infobloxTimeout = 10 * time.Second
+	// infobloxListFreeLimit caps the networks ListFree asks WAPI for.
+	infobloxListFreeLimit = 100
+)
+
+// infobloxBackoff spaces the retries of WAPI calls that failed with a
+// network error or an error WAPI may not repeat.
+var infobloxBackoff = wait.Backoff{Steps: 4, Duration: 500 * time.Millisecond, Factor: 2, Jitter: 0.1}
+
+// Infoblox allocates namespace subnets as networks in an Infoblox network
+// container, through the WAPI: a subnet is the container's next available
+// network, created with extensible attributes naming the namespace and
+// tenant, and releasing it deletes the network.
+type Infoblox struct {
+	// URL is the base URL of the WAPI, with its version, e.g.
+	// https://infoblox.example.com/wapi/v2.12.
+	URL      string
+	Username string
+	Password string
+	// NetworkView is the network view of the container, "default" when
+	// empty.
+	NetworkView string
+	// Container is the CIDR of the network container subnets are allocated
+	// from.
+	Container string
+	// PrefixLength is that of the allocated subnets, unless the request has
+	// one.
+	PrefixLength int
+	// NamespaceAttribute and TenantAttribute are the extensible attributes,
+	// defined in Infoblox, that record a network's namespace and tenant.
+	// Only networks carrying NamespaceAttribute are ever deleted.
+	NamespaceAttribute string
+	TenantAttribute    string
+	// Zone is the zone of every subnet.
+	Zone   string
+	Client *http.Client
+
+	mu           sync.Mutex
+	containerRef string
+}
+
+type infobloxNetwork struct {
+	Ref     string                            `json:"_ref"`
+	Network string                            `json:"network"`
+	Attrs   map[string]map[string]interface{} `json:"extattrs"`
+}
+
+// infobloxError is an unexpected WAPI response.
+type infobloxError struct {
+	status int
+	body   string
+}
+
+func (e *infobloxError) Error() string {
+	return fmt.Sprintf("Infoblox WAPI answered %d: %s", e.status, e.body)
+}
+
+// retriable reports whether a failed WAPI call may succeed when retried. A
+// POST may have created a network before failing, so it is only retried when
+// WAPI did not process it.
+func (e *infobloxError) retriable(method string) bool {
+	if method == http.MethodPost {
+		return e.status == http.StatusTooManyRequests || e.status == http.StatusServiceUnavailable
+	}
+	return e.status == http.StatusTooManyRequests || e.status >= 500
+}
+
+func (ib *Infoblox) AllocateSubnet(ctx context.Context, req Request) (Subnet, error) {
+	prefixLength := ib.PrefixLength
+	if req.PrefixLength > 0 {
+		prefixLength = req.PrefixLength
+	}
+	attrs := map[string]map[string]string{ib.NamespaceAttribute: {"value": req.Namespace}}
+	if req.Tenant != "" {
+		attrs[ib.TenantAttribute] = map[string]string{"value": req.Tenant}
+	}
+	body := map[string]interface{}{
+		"network":      fmt.Sprintf("func:nextavailablenetwork:%s,%s,%d", ib.Container, ib.networkView(), prefixLength),
+		"network_view": ib.networkView(),
+		"comment":      "Allocated by the IPAM webhook for namespace " + req.Namespace,
+		"extattrs":     attrs,
+	}
+	var created infobloxNetwork
+	err := ib.do(ctx, http.MethodPost, "/network?_return_fields=network,extattrs", body, &created)
+	// WAPI answers 400 with "Cannot find 1 available network" when the
+	// container is full
+	var wapiErr *infobloxError
+	if errors.As(err, &wapiErr) && wapiErr.status == http.StatusBadRequest && strings.Contains(wapiErr.body, "available network") {
+		return Subnet{}, ErrExhausted
+	}
+	if err != nil {
+		return Subnet{}, fmt.Errorf("could not allocate network from container %s: %v", ib.Container, err)
+	}
+	return Subnet{CIDR: created.Network, Zone: ib.Zone}, nil
+}
+
+// ReleaseSubnet deletes the network of the subnet, if the webhook created it.
+func (ib *Infoblox) ReleaseSubnet(ctx context.Context, subnet Subnet) error {
+	query := url.Values{
+		"network":        {subnet.CIDR},
+		"network_view":   {ib.networkView()},
+		"_return_fields": {"network,extattrs"},
+	}
+	var networks []infobloxNetwork
+	if err := ib.do(ctx, http.MethodGet, "/network?"+query.Encode(), nil, &networks); err != nil {
+		return fmt.Errorf("could not look up network %s: %v", subnet.CIDR, err)
+	}
+	for _, network := range networks {
+		if _, ours := network.Attrs[ib.NamespaceAttribute]; !ours {
+			continue
+		}
+		err := ib.do(ctx, http.MethodDelete, "/"+network.Ref, nil, nil)
+		var wapiErr *infobloxError
+		if errors.As(err, &wapiErr) && wapiErr.status == http.StatusNotFound {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("could not delete network %s: %v", subnet.CIDR, err)
+		}
+	}
+	return nil
+}
+
+// ListFree returns the container's next available networks of the configured
+// length, at most infobloxListFreeLimit of them.
+func (ib *Infoblox) ListFree(ctx context.Context, zone string) ([]Subnet, error) {
+	if zone != "" && zone != ib.Zone {
+		return nil, nil
+	}
+	ref, err := ib.container(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var result struct {
+		Networks []string `json:"networks"`
+	}
+	body := map[string]interface{}{"cidr": ib.PrefixLength, "num": infobloxListFreeLimit}
+	err = ib.do(ctx, http.MethodPost, "/"+ref+"?_function=next_available_network", body, &result)
+	var wapiErr *infobloxError
+	if errors.As(err, &wapiErr) && wapiErr.status == http.StatusBadRequest && strings.Contains(wapiErr.body, "available network") {
+		// WAPI returns none when fewer networks than asked for are left;
+		// report the one the next allocation would get
+		body["num"] = 1
+		err = ib.do(ctx, http.MethodPost, "/"+ref+"?_function=next_available_network", body, &result)
+		if errors.As(err, &wapiErr) && wapiErr.status == http.StatusBadRequest && strings.Contains(wapiErr.body, "available network") {
+			return nil, nil
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not list available networks of container %s: %v", ib.Container, err)
+	}
+	free := make([]Subnet, 0, len(result.Networks))
+	for _, network := range result.Networks {
+		free = append(free, Subnet{CIDR: network, Zone: ib.Zone})
+	}
+	return free, nil
+}
+
+// container returns the WAPI reference of the network container, looked up
+// once.
+func (ib *Infoblox) container(ctx context.Context) (string, error) {
+	ib.mu.Lock()
+	defer ib.mu.Unlock()
+	if ib.containerRef != "" {
+		return ib.containerRef, nil
+	}
+	query := url.Values{"network": {ib.Container}, "network_view": {ib.networkView()}}
+	var containers []infobloxNetwork
+	if err := ib.do(ctx, http.MethodGet, "/networkcontainer?"+query.Encode(), nil, &containers); err != nil {
+		return "", fmt.Errorf("could not look up network container %s: %v", ib.Container, err)
+	}
+	if len(containers) != 1 {
+		return "", fmt.Errorf("found %d network containers %s, want exactly one", len(containers), ib.Container)
+	}
+	ib.containerRef = containers[0].Ref
+	return ib.containerRef, nil
+}
+
+func (ib *Infoblox) networkView() string {
+	if ib.NetworkView == "" {
+		return "default"
+	}
+	return ib.NetworkView
+}
+
+// do calls the WAPI, encoding in as the request body and decoding the
+// response into out, when they are set. Failed calls are retried with
+// backoff, see infobloxError.retriable.
+func (ib *Infoblox) do(ctx context.Context, method, path string, in, out interface{}) error {
+	var payload []byte
+	if in != nil {
+		var err error
+		if payload, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+	client := ib.Client
+	if client == nil {
+		client = &http.Client{Timeout: infobloxTimeout}
+	}
+
+	var respBody []byte
+	err := retry.OnError(infobloxBackoff, func(err error) bool {
+		var wapiErr *infobloxError
+		if errors.As(err, &wapiErr) {
+			return wapiErr.retriable(method)
+		}
+		return ctx.Err() == nil && method != http.MethodPost
+	}, func() error {
+		req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(ib.URL, "/")+path, bytes.NewReader(payload))
+		if err != nil {
+			return err
+		}
+		req.SetBasicAuth(ib.Username, ib.Password)
+		req.Header.Set("Accept", "application/json")
+		if in != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+			return &infobloxError{status: resp.StatusCode, body: strings.TrimSpace(string(message))}
+		}
+		respBody, err = io.ReadAll(resp.Body)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if out == nil || len(respBody) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(respBody, out); err != nil {
+		return fmt.Errorf("could not decode WAPI response: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,222 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	"admission-controller-03/pkg/cidr"
+)
+
+// fakeInfoblox serves the network and network container objects of the WAPI
+// for a /24 container.
+type fakeInfoblox struct {
+	t      *testing.T
+	mu     sync.Mutex
+	nextID int
+	// networks are the networks in the container by reference
+	networks map[string]infobloxNetwork
+	// unavailable fails that many calls with 503 Service Unavailable
+	unavailable int
+}
+
+const (
+	infobloxContainer    = "10.20.0.0/24"
+	infobloxContainerRef = "networkcontainer/ZG5zLm5ldHdvcmtfY29udGFpbmVy:default"
+)
+
+func newFakeInfoblox(t *testing.T, networks ...infobloxNetwork) (*Infoblox, *fakeInfoblox) {
+	backoff := infobloxBackoff
+	infobloxBackoff = wait.Backoff{Steps: 4, Duration: time.Millisecond}
+	t.Cleanup(func() { infobloxBackoff = backoff })
+
+	f := &fakeInfoblox{t: t, networks: map[string]infobloxNetwork{}}
+	for _, network := range networks {
+		f.networks[network.Ref] = network
+	}
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+	return &Infoblox{
+		URL:                server.URL + "/wapi/v2.12",
+		Username:           "ipam",
+		Password:           "secret",
+		Container:          infobloxContainer,
+		PrefixLength:       26,
+		NamespaceAttribute: "K8sNamespace",
+		TenantAttribute:    "Tenant",
+		Zone:               "zone-lhr",
+		Client:             server.Client(),
+	}, f
+}
+
+// next returns up to num free networks of the prefix length.
+func (f *fakeInfoblox) next(prefixLength, num int) []string {
+	var used, free []string
+	for _, network := range f.networks {
+		used = append(used, network.Network)
+	}
+	for len(free) < num {
+		network, err := cidr.NextFree(infobloxContainer, prefixLength, used)
+		if err != nil {
+			break
+		}
+		free = append(free, network)
+		used = append(used, network)
+	}
+	return free
+}
+
+func (f *fakeInfoblox) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if username, password, _ := r.BasicAuth(); username != "ipam" || password != "secret" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if f.unavailable > 0 {
+		f.unavailable--
+		http.Error(w, "busy", http.StatusServiceUnavailable)
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/wapi/v2.12/")
+	query := r.URL.Query()
+	switch {
+	case r.Method == http.MethodGet && path == "networkcontainer":
+		containers := []infobloxNetwork{}
+		if query.Get("network") == infobloxContainer && query.Get("network_view") == "default" {
+			containers = append(containers, infobloxNetwork{Ref: infobloxContainerRef, Network: infobloxContainer})
+		}
+		json.NewEncoder(w).Encode(containers)
+	case r.Method == http.MethodPost && path == infobloxContainerRef && query.Get("_function") == "next_available_network":
+		var body struct {
+			CIDR int `json:"cidr"`
+			Num  int `json:"num"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		free := f.next(body.CIDR, body.Num)
+		if len(free) < body.Num {
+			http.Error(w, fmt.Sprintf(`{"Error": "AdmConDataError: None (IBDataConflictError: IB.Data.Conflict:Cannot find %d available network(s) in this network container)"}`, body.Num), http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string][]string{"networks": free})
+	case r.Method == http.MethodPost && path == "network":
+		var body struct {
+			Network string                            `json:"network"`
+			Attrs   map[string]map[string]interface{} `json:"extattrs"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var container, view string
+		var prefixLength int
+		if _, err := fmt.Sscanf(strings.ReplaceAll(body.Network, ",", " "), "func:nextavailablenetwork:%s %s %d", &container, &view, &prefixLength); err != nil || container != infobloxContainer {
+			http.Error(w, fmt.Sprintf("bad network %q", body.Network), http.StatusBadRequest)
+			return
+		}
+		free := f.next(prefixLength, 1)
+		if len(free) == 0 {
+			http.Error(w, `{"Error": "AdmConDataError: None (IBDataConflictError: IB.Data.Conflict:Cannot find 1 available network in this network container)"}`, http.StatusBadRequest)
+			return
+		}
+		f.nextID++
+		network := infobloxNetwork{Ref: fmt.Sprintf("network/ZG5zLm5ldHdvcmsk%d:default", f.nextID), Network: free[0], Attrs: body.Attrs}
+		f.networks[network.Ref] = network
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(network)
+	case r.Method == http.MethodGet && path == "network":
+		networks := []infobloxNetwork{}
+		for _, network := range f.networks {
+			if network.Network == query.Get("network") {
+				networks = append(networks, network)
+			}
+		}
+		json.NewEncoder(w).Encode(networks)
+	case r.Method == http.MethodDelete && strings.HasPrefix(path, "network/"):
+		if _, ok := f.networks[path]; !ok {
+			http.NotFound(w, r)
+			return
+		}
+		delete(f.networks, path)
+		json.NewEncoder(w).Encode(path)
+	default:
+		f.t.Errorf("unexpected WAPI call %s %s", r.Method, r.URL)
+		http.NotFound(w, r)
+	}
+}
+
+func TestInfobloxAllocateSubnet(t *testing.T) {
+	ib, f := newFakeInfoblox(t)
+	for i := 0; i < 4; i++ {
+		subnet, err := ib.AllocateSubnet(context.Background(), Request{Namespace: "web", Tenant: "team-a"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := fmt.Sprintf("10.20.0.%d/26", i*64); subnet.CIDR != want || subnet.Zone != "zone-lhr" {
+			t.Errorf("allocated %+v, want %s", subnet, want)
+		}
+	}
+	if _, err := ib.AllocateSubnet(context.Background(), Request{Namespace: "web"}); !errors.Is(err, ErrExhausted) {
+		t.Errorf("allocating from a full container = %v, want ErrExhausted", err)
+	}
+	for _, network := range f.networks {
+		if network.Attrs["K8sNamespace"]["value"] != "web" || network.Attrs["Tenant"]["value"] != "team-a" {
+			t.Errorf("network %s has extensible attributes %v", network.Network, network.Attrs)
+		}
+	}
+}
+
+func TestInfobloxReleaseSubnet(t *testing.T) {
+	manual := infobloxNetwork{Ref: "network/ZG5zLm5ldHdvcmskMA:default", Network: "10.20.0.0/26"}
+	ib, f := newFakeInfoblox(t, manual)
+	subnet, err := ib.AllocateSubnet(context.Background(), Request{Namespace: "web"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subnet.CIDR != "10.20.0.64/26" {
+		t.Fatalf("allocated %s over a manual network", subnet.CIDR)
+	}
+
+	// The lookup is retried while WAPI is unavailable
+	f.unavailable = 2
+	for _, network := range []string{manual.Network, subnet.CIDR, "10.20.0.128/26"} {
+		if err := ib.ReleaseSubnet(context.Background(), Subnet{CIDR: network}); err != nil {
+			t.Errorf("releasing %s: %v", network, err)
+		}
+	}
+	if _, ok := f.networks[manual.Ref]; len(f.networks) != 1 || !ok {
+		t.Errorf("networks left after release: %v, want only the manual one", f.networks)
+	}
+}
+
+func TestInfobloxListFree(t *testing.T) {
+	ib, _ := newFakeInfoblox(t, infobloxNetwork{Ref: "network/ZG5zLm5ldHdvcmskMA:default", Network: "10.20.0.64/26"})
+	free, err := ib.ListFree(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, subnet := range free {
+		got = append(got, subnet.CIDR)
+	}
+	// Fewer than infobloxListFreeLimit are left, so only the next one is
+	// reported
+	if want := "10.20.0.0/26"; strings.Join(got, " ") != want {
+		t.Errorf("free subnets %v, want %s", got, want)
+	}
+	if free, err := ib.ListFree(context.Background(), "zone-fra"); err != nil || len(free) != 0 {
+		t.Errorf("free subnets of another zone: %v, %v", free, err)
+	}
+}
@@ -0,0 +1,58 @@
+package backend
+
+import (
+	"context"
+	"sync"
+)
+
+// Mock is the reference external backend: it hands out a fixed list of
+// subnets, in order, and keeps its allocations in memory only. It is meant
+// for development and for testing the webhook against an external backend,
+// not for production.
+type Mock struct {
+	mu      sync.Mutex
+	subnets []Subnet
+	owners  map[string]string
+}
+
+// NewMock returns a backend handing out subnets, all in zone.
+func NewMock(zone string, subnets []string) *Mock {
+	m := &Mock{owners: map[string]string{}}
+	for _, cidr := range subnets {
+		m.subnets = append(m.subnets, Subnet{CIDR: cidr, Zone: zone})
+	}
+	return m
+}
+
+// AllocateSubnet returns the first free subnet of the zone. The request's
+// prefix length is ignored.
+func (m *Mock) AllocateSubnet(_ context.Context, req Request) (Subnet, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, subnet := range m.subnets {
+		if _, taken := m.owners[subnet.CIDR]; !taken && (req.Zone == "" || subnet.Zone == req.Zone) {
+			m.owners[subnet.CIDR] = req.Namespace
+			return subnet, nil
+		}
+	}
+	return Subnet{}, ErrExhausted
+}
+
+func (m *Mock) ReleaseSubnet(_ context.Context, subnet Subnet) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.owners, subnet.CIDR)
+	return nil
+}
+
+func (m *Mock) ListFree(_ context.Context, zone string) ([]Subnet, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var free []Subnet
+	for _, subnet := range m.subnets {
+		if _, taken := m.owners[subnet.CIDR]; !taken && (zone == "" || subnet.Zone == zone) {
+			free = append(free, subnet)
+		}
+	}
+	return free, nil
+}
@@ -0,0 +1,214 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"admission-controller-03/pkg/cidr"
+)
+
+const (
+	netBoxTimeout = 10 * time.Second
+	// netBoxListFreeLimit caps the subnets ListFree carves out of the
+	// parent prefix's available ranges.
+	netBoxListFreeLimit = 1024
+	// netBoxDescription marks the prefixes the webhook allocated, so that
+	// ReleaseSubnet never deletes one created by hand.
+	netBoxDescription = "Allocated by the IPAM webhook"
+)
+
+// NetBox allocates namespace subnets as child prefixes of a parent prefix in
+// NetBox, which stays the source of truth for the address plan: a subnet is
+// the next available prefix of the parent, and releasing it deletes the
+// child prefix.
+type NetBox struct {
+	// URL is the base URL of NetBox, e.g. https://netbox.example.com.
+	URL   string
+	Token string
+	// ParentPrefix is the CIDR of the prefix subnets are allocated from.
+	ParentPrefix string
+	// PrefixLength is that of the allocated subnets, unless the request has
+	// one.
+	PrefixLength int
+	// Zone is the zone of every subnet.
+	Zone string
+	// TenantSlugs assigns each prefix to the NetBox tenant whose slug is the
+	// namespace's tenant.
+	TenantSlugs bool
+	Client      *http.Client
+
+	mu       sync.Mutex
+	parentID int
+}
+
+type netBoxPrefix struct {
+	ID          int    `json:"id"`
+	Prefix      string `json:"prefix"`
+	Description string `json:"description"`
+}
+
+// netBoxError is an unexpected NetBox response.
+type netBoxError struct {
+	status int
+	body   string
+}
+
+func (e *netBoxError) Error() string {
+	return fmt.Sprintf("NetBox answered %d: %s", e.status, e.body)
+}
+
+func (n *NetBox) AllocateSubnet(ctx context.Context, req Request) (Subnet, error) {
+	parentID, err := n.parent(ctx)
+	if err != nil {
+		return Subnet{}, err
+	}
+	prefixLength := n.PrefixLength
+	if req.PrefixLength > 0 {
+		prefixLength = req.PrefixLength
+	}
+	body := map[string]interface{}{
+		"prefix_length": prefixLength,
+		"status":        "active",
+		"description":   fmt.Sprintf("%s for namespace %s", netBoxDescription, req.Namespace),
+	}
+	if n.TenantSlugs && req.Tenant != "" {
+		body["tenant"] = map[string]string{"slug": req.Tenant}
+	}
+	var created netBoxPrefix
+	err = n.do(ctx, http.MethodPost, fmt.Sprintf("/api/ipam/prefixes/%d/available-prefixes/", parentID), body, &created)
+	// NetBox answers 409 Conflict when no prefix of the length is left
+	if e, ok := err.(*netBoxError); ok && e.status == http.StatusConflict {
+		return Subnet{}, ErrExhausted
+	}
+	if err != nil {
+		return Subnet{}, fmt.Errorf("could not allocate prefix from %s: %v", n.ParentPrefix, err)
+	}
+	return Subnet{CIDR: created.Prefix, Zone: n.Zone}, nil
+}
+
+// ReleaseSubnet deletes the child prefix of the subnet, if the webhook
+// allocated it.
+func (n *NetBox) ReleaseSubnet(ctx context.Context, subnet Subnet) error {
+	query := url.Values{"prefix": {subnet.CIDR}, "within": {n.ParentPrefix}}
+	var list struct {
+		Results []netBoxPrefix `json:"results"`
+	}
+	if err := n.do(ctx, http.MethodGet, "/api/ipam/prefixes/?"+query.Encode(), nil, &list); err != nil {
+		return fmt.Errorf("could not look up prefix %s: %v", subnet.CIDR, err)
+	}
+	for _, prefix := range list.Results {
+		if prefix.Prefix != subnet.CIDR || !strings.HasPrefix(prefix.Description, netBoxDescription) {
+			continue
+		}
+		err := n.do(ctx, http.MethodDelete, fmt.Sprintf("/api/ipam/prefixes/%d/", prefix.ID), nil, nil)
+		if e, ok := err.(*netBoxError); ok && e.status == http.StatusNotFound {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("could not delete prefix %s: %v", subnet.CIDR, err)
+		}
+	}
+	return nil
+}
+
+// ListFree returns the subnets of the configured length in the parent
+// prefix's available ranges, at most netBoxListFreeLimit of them.
+func (n *NetBox) ListFree(ctx context.Context, zone string) ([]Subnet, error) {
+	if zone != "" && zone != n.Zone {
+		return nil, nil
+	}
+	parentID, err := n.parent(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var available []netBoxPrefix
+	if err := n.do(ctx, http.MethodGet, fmt.Sprintf("/api/ipam/prefixes/%d/available-prefixes/", parentID), nil, &available); err != nil {
+		return nil, fmt.Errorf("could not list available prefixes of %s: %v", n.ParentPrefix, err)
+	}
+	var free []Subnet
+	for _, prefix := range available {
+		subnets, err := cidr.Subnets(prefix.Prefix, n.PrefixLength, netBoxListFreeLimit-len(free))
+		if err != nil {
+			// A range smaller than the prefix length, or an IPv6 one
+			continue
+		}
+		for _, subnet := range subnets {
+			free = append(free, Subnet{CIDR: subnet, Zone: n.Zone})
+		}
+		if len(free) >= netBoxListFreeLimit {
+			break
+		}
+	}
+	return free, nil
+}
+
+// parent returns the NetBox ID of the parent prefix, looked up once.
+func (n *NetBox) parent(ctx context.Context) (int, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.parentID != 0 {
+		return n.parentID, nil
+	}
+	var list struct {
+		Results []netBoxPrefix `json:"results"`
+	}
+	if err := n.do(ctx, http.MethodGet, "/api/ipam/prefixes/?"+url.Values{"prefix": {n.ParentPrefix}}.Encode(), nil, &list); err != nil {
+		return 0, fmt.Errorf("could not look up parent prefix %s: %v", n.ParentPrefix, err)
+	}
+	if len(list.Results) != 1 {
+		return 0, fmt.Errorf("found %d NetBox prefixes %s, want exactly one parent prefix", len(list.Results), n.ParentPrefix)
+	}
+	n.parentID = list.Results[0].ID
+	return n.parentID, nil
+}
+
+// do calls the NetBox REST API, encoding in as the request body and decoding
+// the response into out, when they are set.
+func (n *NetBox) do(ctx context.Context, method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		payload, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(n.URL, "/")+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Authorization", "Token "+n.Token)
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	client := n.Client
+	if client == nil {
+		client = &http.Client{Timeout: netBoxTimeout}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return &netBoxError{status: resp.StatusCode, body: strings.TrimSpace(string(message))}
+	}
+	if out == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("could not decode NetBox response: %v", err)
+	}
+	return nil
+}
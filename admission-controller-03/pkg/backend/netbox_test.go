@@ -0,0 +1,181 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"admission-controller-03/pkg/cidr"
+)
+
+// fakeNetBox serves the prefixes endpoints of the NetBox REST API for a /24
+// parent prefix with ID 1.
+type fakeNetBox struct {
+	t      *testing.T
+	mu     sync.Mutex
+	nextID int
+	// prefixes are the child prefixes by ID
+	prefixes map[int]netBoxPrefix
+	tenants  []string
+}
+
+const netBoxParent = "10.10.0.0/24"
+
+func newFakeNetBox(t *testing.T, prefixes ...netBoxPrefix) (*NetBox, *fakeNetBox) {
+	f := &fakeNetBox{t: t, nextID: 100, prefixes: map[int]netBoxPrefix{}}
+	for _, prefix := range prefixes {
+		f.prefixes[prefix.ID] = prefix
+	}
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+	return &NetBox{URL: server.URL, Token: "secret", ParentPrefix: netBoxParent, PrefixLength: 26, Zone: "zone-lhr", TenantSlugs: true, Client: server.Client()}, f
+}
+
+func (f *fakeNetBox) used() []string {
+	var used []string
+	for _, prefix := range f.prefixes {
+		used = append(used, prefix.Prefix)
+	}
+	return used
+}
+
+func (f *fakeNetBox) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if r.Header.Get("Authorization") != "Token secret" {
+		http.Error(w, "unauthorized", http.StatusForbidden)
+		return
+	}
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/api/ipam/prefixes/":
+		results := []netBoxPrefix{}
+		query := r.URL.Query()
+		if query.Get("within") == "" {
+			if query.Get("prefix") == netBoxParent {
+				results = append(results, netBoxPrefix{ID: 1, Prefix: netBoxParent})
+			}
+		} else {
+			for _, prefix := range f.prefixes {
+				if prefix.Prefix == query.Get("prefix") {
+					results = append(results, prefix)
+				}
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"results": results})
+	case r.URL.Path == "/api/ipam/prefixes/1/available-prefixes/" && r.Method == http.MethodGet:
+		// Every free /26 as its own range
+		available := []netBoxPrefix{}
+		used := f.used()
+		for {
+			free, err := cidr.NextFree(netBoxParent, 26, used)
+			if err != nil {
+				break
+			}
+			available = append(available, netBoxPrefix{Prefix: free})
+			used = append(used, free)
+		}
+		json.NewEncoder(w).Encode(available)
+	case r.URL.Path == "/api/ipam/prefixes/1/available-prefixes/" && r.Method == http.MethodPost:
+		var body struct {
+			PrefixLength int               `json:"prefix_length"`
+			Description  string            `json:"description"`
+			Tenant       map[string]string `json:"tenant"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		free, err := cidr.NextFree(netBoxParent, body.PrefixLength, f.used())
+		if err != nil {
+			http.Error(w, `{"detail": "Insufficient space is available to accommodate the requested prefix size(s)"}`, http.StatusConflict)
+			return
+		}
+		f.nextID++
+		prefix := netBoxPrefix{ID: f.nextID, Prefix: free, Description: body.Description}
+		f.prefixes[prefix.ID] = prefix
+		f.tenants = append(f.tenants, body.Tenant["slug"])
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(prefix)
+	case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, "/api/ipam/prefixes/"):
+		id, err := strconv.Atoi(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/ipam/prefixes/"), "/"))
+		if _, ok := f.prefixes[id]; err != nil || !ok {
+			http.NotFound(w, r)
+			return
+		}
+		delete(f.prefixes, id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		f.t.Errorf("unexpected NetBox call %s %s", r.Method, r.URL)
+		http.NotFound(w, r)
+	}
+}
+
+func TestNetBoxAllocateSubnet(t *testing.T) {
+	n, f := newFakeNetBox(t)
+	for i := 0; i < 4; i++ {
+		subnet, err := n.AllocateSubnet(context.Background(), Request{Namespace: "web", Tenant: "team-a"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := fmt.Sprintf("10.10.0.%d/26", i*64); subnet.CIDR != want || subnet.Zone != "zone-lhr" {
+			t.Errorf("allocated %+v, want %s", subnet, want)
+		}
+	}
+	if _, err := n.AllocateSubnet(context.Background(), Request{Namespace: "web"}); !errors.Is(err, ErrExhausted) {
+		t.Errorf("allocating from a full parent = %v, want ErrExhausted", err)
+	}
+	if f.tenants[0] != "team-a" {
+		t.Errorf("prefix assigned to tenant %q", f.tenants[0])
+	}
+	for _, prefix := range f.prefixes {
+		if !strings.HasPrefix(prefix.Description, netBoxDescription) {
+			t.Errorf("prefix %s has description %q", prefix.Prefix, prefix.Description)
+		}
+	}
+}
+
+func TestNetBoxReleaseSubnet(t *testing.T) {
+	manual := netBoxPrefix{ID: 7, Prefix: "10.10.0.0/26", Description: "Reserved for the load balancers"}
+	n, f := newFakeNetBox(t, manual)
+	subnet, err := n.AllocateSubnet(context.Background(), Request{Namespace: "web"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subnet.CIDR != "10.10.0.64/26" {
+		t.Fatalf("allocated %s over a manual prefix", subnet.CIDR)
+	}
+
+	for _, prefix := range []string{manual.Prefix, subnet.CIDR, "10.10.0.128/26"} {
+		if err := n.ReleaseSubnet(context.Background(), Subnet{CIDR: prefix}); err != nil {
+			t.Errorf("releasing %s: %v", prefix, err)
+		}
+	}
+	if len(f.prefixes) != 1 || f.prefixes[manual.ID] != manual {
+		t.Errorf("prefixes left after release: %v, want only the manual one", f.prefixes)
+	}
+}
+
+func TestNetBoxListFree(t *testing.T) {
+	n, _ := newFakeNetBox(t, netBoxPrefix{ID: 7, Prefix: "10.10.0.64/26"})
+	free, err := n.ListFree(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, subnet := range free {
+		got = append(got, subnet.CIDR)
+	}
+	if want := "10.10.0.0/26 10.10.0.128/26 10.10.0.192/26"; strings.Join(got, " ") != want {
+		t.Errorf("free subnets %v, want %s", got, want)
+	}
+	if free, err := n.ListFree(context.Background(), "zone-fra"); err != nil || len(free) != 0 {
+		t.Errorf("free subnets of another zone: %v, %v", free, err)
+	}
+}
@@ -0,0 +1,190 @@
+package certs
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+var (
+	expiryDesc = prometheus.NewDesc("ipam_webhook_certificate_expiry_timestamp_seconds",
+		"Unix time at which the serving certificate expires.", []string{"subject"}, nil)
+	warningDesc = prometheus.NewDesc("ipam_webhook_certificate_expiry_warning",
+		"1 while the serving certificate expires within the warning window.", nil, nil)
+)
+
+// Reloader serves the webhook certificate, reloading it when the mounted
+// files change, e.g. after cert-manager rotates the secret, or re-issuing it
+// from Vault before it expires. Every (re)load is parsed so that the expiry
+// can be exported and warned about long before the API server starts failing
+// TLS handshakes.
+type Reloader struct {
+	certPath   string
+	keyPath    string
+	vault      *VaultIssuer
+	warnWithin time.Duration
+	logger     *zap.Logger
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	notBefore time.Time
+	notAfter  time.Time
+	subject   string
+	modTime   time.Time
+}
+
+// NewReloader loads the key pair once and fails if it is unusable.
+func NewReloader(certPath, keyPath string, warnWithin time.Duration, logger *zap.Logger) (*Reloader, error) {
+	r := &Reloader{certPath: certPath, keyPath: keyPath, warnWithin: warnWithin, logger: logger}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *Reloader) load() error {
+	info, err := os.Stat(r.certPath)
+	if err != nil {
+		return fmt.Errorf("could not stat certificate: %v", err)
+	}
+	cert, err := tls.LoadX509KeyPair(r.certPath, r.keyPath)
+	if err != nil {
+		return fmt.Errorf("could not load key pair: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("could not parse certificate: %v", err)
+	}
+	cert.Leaf = leaf
+	r.set(&cert, info.ModTime())
+	return nil
+}
+
+// NewVaultReloader issues a first certificate from Vault and fails if it
+// cannot.
+func NewVaultReloader(ctx context.Context, issuer *VaultIssuer, warnWithin time.Duration, logger *zap.Logger) (*Reloader, error) {
+	r := &Reloader{vault: issuer, warnWithin: warnWithin, logger: logger}
+	cert, err := issuer.Issue(ctx)
+	if err != nil {
+		return nil, err
+	}
+	r.set(&cert, time.Time{})
+	return r, nil
+}
+
+// set serves a new certificate, whose Leaf is parsed.
+func (r *Reloader) set(cert *tls.Certificate, modTime time.Time) {
+	r.mu.Lock()
+	r.cert = cert
+	r.notBefore = cert.Leaf.NotBefore
+	r.notAfter = cert.Leaf.NotAfter
+	r.subject = cert.Leaf.Subject.String()
+	r.modTime = modTime
+	r.mu.Unlock()
+
+	r.logger.Info("Loaded serving certificate", zap.String("subject", cert.Leaf.Subject.String()), zap.Time("notAfter", cert.Leaf.NotAfter))
+	r.checkExpiry()
+}
+
+// Run polls the certificate file and reloads it when it changes, or re-issues
+// a Vault certificate once the configured fraction of its lifetime has passed,
+// retrying on every tick until Vault issues one. The expiry check runs on
+// every tick so the warning repeats until the cert is renewed.
+func (r *Reloader) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if r.vault != nil {
+			r.renew(ctx)
+			continue
+		}
+		info, err := os.Stat(r.certPath)
+		if err != nil {
+			r.logger.Error("could not stat certificate", zap.Error(err))
+			continue
+		}
+		r.mu.RLock()
+		changed := !info.ModTime().Equal(r.modTime)
+		r.mu.RUnlock()
+		if changed {
+			if err := r.load(); err != nil {
+				// Keep serving the previous certificate
+				r.logger.Error("could not reload certificate", zap.Error(err))
+			}
+			continue
+		}
+		r.checkExpiry()
+	}
+}
+
+// renew re-issues the Vault certificate when it is due.
+func (r *Reloader) renew(ctx context.Context) {
+	r.mu.RLock()
+	lifetime := r.notAfter.Sub(r.notBefore)
+	renewAt := r.notBefore.Add(time.Duration(float64(lifetime) * r.vault.Options.RenewFraction))
+	r.mu.RUnlock()
+	if time.Now().Before(renewAt) {
+		r.checkExpiry()
+		return
+	}
+	cert, err := r.vault.Issue(ctx)
+	if err != nil {
+		// Keep serving the previous certificate
+		r.logger.Error("could not re-issue serving certificate from Vault", zap.Error(err))
+		r.checkExpiry()
+		return
+	}
+	r.set(&cert, time.Time{})
+}
+
+func (r *Reloader) checkExpiry() {
+	r.mu.RLock()
+	notAfter, subject := r.notAfter, r.subject
+	r.mu.RUnlock()
+
+	remaining := time.Until(notAfter)
+	switch {
+	case remaining <= 0:
+		r.logger.Error("serving certificate has expired", zap.String("subject", subject), zap.Time("notAfter", notAfter))
+	case remaining <= r.warnWithin:
+		r.logger.Warn("Serving certificate expires soon", zap.String("subject", subject), zap.Time("notAfter", notAfter), zap.Duration("remaining", remaining))
+	}
+}
+
+// GetCertificate is the tls.Config hook serving the current certificate.
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+func (r *Reloader) Describe(ch chan<- *prometheus.Desc) {
+	ch <- expiryDesc
+	ch <- warningDesc
+}
+
+func (r *Reloader) Collect(ch chan<- prometheus.Metric) {
+	r.mu.RLock()
+	notAfter, subject := r.notAfter, r.subject
+	r.mu.RUnlock()
+
+	ch <- prometheus.MustNewConstMetric(expiryDesc, prometheus.GaugeValue, float64(notAfter.Unix()), subject)
+	warning := 0.0
+	if time.Until(notAfter) <= r.warnWithin {
+		warning = 1
+	}
+	ch <- prometheus.MustNewConstMetric(warningDesc, prometheus.GaugeValue, warning)
+}
@@ -0,0 +1,195 @@
+package certs
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	vaultTimeout = 10 * time.Second
+	// defaultServiceAccountTokenFile is the pod's own service account token,
+	// presented to Vault's Kubernetes auth method.
+	defaultServiceAccountTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+)
+
+// VaultOptions are the settings of the Vault PKI issuer, exposed as command
+// line flags. The issuer is off without an address.
+type VaultOptions struct {
+	Addr string
+	// CAFile verifies Vault's own serving certificate; the system roots are
+	// used when empty.
+	CAFile string
+	// AuthPath is the mount path of the Kubernetes auth method, AuthRole the
+	// Vault role the pod's service account logs in as.
+	AuthPath  string
+	AuthRole  string
+	TokenFile string
+	// PKIPath is the mount path of the PKI secrets engine, PKIRole the role
+	// certificates are issued by.
+	PKIPath    string
+	PKIRole    string
+	CommonName string
+	// AltNames are further DNS names of the certificate, comma separated.
+	AltNames string
+	TTL      time.Duration
+	// RenewFraction is the fraction of a certificate's lifetime after which
+	// it is re-issued.
+	RenewFraction float64
+}
+
+// RegisterFlags binds the Vault options to flags on fs.
+func (o *VaultOptions) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.Addr, "vault-addr", "", "address of Vault, e.g. https://vault.example.com:8200, to issue the serving certificate from its PKI engine instead of loading it from the mounted Secret (empty disables)")
+	fs.StringVar(&o.CAFile, "vault-ca-file", "", "CA bundle verifying Vault's serving certificate (defaults to the system roots)")
+	fs.StringVar(&o.AuthPath, "vault-auth-path", "kubernetes", "mount path of Vault's Kubernetes auth method")
+	fs.StringVar(&o.AuthRole, "vault-auth-role", "", "Vault role the pod's service account logs in as")
+	fs.StringVar(&o.TokenFile, "vault-token-file", defaultServiceAccountTokenFile, "service account token presented to Vault's Kubernetes auth method")
+	fs.StringVar(&o.PKIPath, "vault-pki-path", "pki", "mount path of Vault's PKI secrets engine")
+	fs.StringVar(&o.PKIRole, "vault-pki-role", "", "PKI role the serving certificate is issued by")
+	fs.StringVar(&o.CommonName, "vault-common-name", "", "common name of the serving certificate, the webhook service's DNS name, e.g. ipam-webhook.ipam-system.svc")
+	fs.StringVar(&o.AltNames, "vault-alt-names", "", "further DNS names of the serving certificate, comma separated")
+	fs.DurationVar(&o.TTL, "vault-ttl", 0, "lifetime requested for the serving certificate (0 uses the PKI role's default)")
+	fs.Float64Var(&o.RenewFraction, "vault-renew-fraction", 2.0/3, "fraction of the serving certificate's lifetime after which it is re-issued")
+}
+
+// Enabled reports whether the serving certificate is issued by Vault.
+func (o *VaultOptions) Enabled() bool {
+	return o.Addr != ""
+}
+
+// Validate checks the options of an enabled issuer.
+func (o *VaultOptions) Validate() error {
+	if o.AuthRole == "" || o.PKIRole == "" || o.CommonName == "" {
+		return fmt.Errorf("--vault-auth-role, --vault-pki-role and --vault-common-name are required with --vault-addr")
+	}
+	if o.RenewFraction <= 0 || o.RenewFraction >= 1 {
+		return fmt.Errorf("invalid --vault-renew-fraction %v: must be in (0, 1)", o.RenewFraction)
+	}
+	return nil
+}
+
+// VaultIssuer issues serving certificates from Vault's PKI secrets engine,
+// logging in with the Kubernetes auth method before every issue, so that an
+// expired Vault token never gets in the way of a renewal.
+type VaultIssuer struct {
+	Options VaultOptions
+	Client  *http.Client
+}
+
+// NewVaultIssuer returns an issuer for the options, trusting their CA file.
+func NewVaultIssuer(o VaultOptions) (*VaultIssuer, error) {
+	client := &http.Client{Timeout: vaultTimeout}
+	if o.CAFile != "" {
+		pem, err := os.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read Vault CA file: %v", err)
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in Vault CA file %s", o.CAFile)
+		}
+		client.Transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12}}
+	}
+	return &VaultIssuer{Options: o, Client: client}, nil
+}
+
+// Issue logs in to Vault and issues a new key pair.
+func (v *VaultIssuer) Issue(ctx context.Context) (tls.Certificate, error) {
+	jwt, err := os.ReadFile(v.Options.TokenFile)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("could not read service account token: %v", err)
+	}
+	var login struct {
+		Auth struct {
+			ClientToken string `json:"client_token"`
+		} `json:"auth"`
+	}
+	err = v.do(ctx, "", "/v1/auth/"+strings.Trim(v.Options.AuthPath, "/")+"/login", map[string]string{
+		"role": v.Options.AuthRole,
+		"jwt":  strings.TrimSpace(string(jwt)),
+	}, &login)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("could not log in to Vault: %v", err)
+	}
+
+	request := map[string]string{"common_name": v.Options.CommonName}
+	if v.Options.AltNames != "" {
+		request["alt_names"] = v.Options.AltNames
+	}
+	if v.Options.TTL > 0 {
+		request["ttl"] = v.Options.TTL.String()
+	}
+	var issued struct {
+		Data struct {
+			Certificate string   `json:"certificate"`
+			PrivateKey  string   `json:"private_key"`
+			CAChain     []string `json:"ca_chain"`
+		} `json:"data"`
+	}
+	err = v.do(ctx, login.Auth.ClientToken, "/v1/"+strings.Trim(v.Options.PKIPath, "/")+"/issue/"+v.Options.PKIRole, request, &issued)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("could not issue certificate: %v", err)
+	}
+
+	// Serve the intermediates with the leaf, so the API server only needs
+	// the root in the webhook's caBundle
+	chain := issued.Data.Certificate + "\n"
+	for _, ca := range issued.Data.CAChain {
+		chain += ca + "\n"
+	}
+	cert, err := tls.X509KeyPair([]byte(chain), []byte(issued.Data.PrivateKey))
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("could not load issued key pair: %v", err)
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("could not parse issued certificate: %v", err)
+	}
+	return cert, nil
+}
+
+// do calls the Vault HTTP API with token, when set, encoding in as the
+// request body and decoding the response into out.
+func (v *VaultIssuer) do(ctx context.Context, token, path string, in, out interface{}) error {
+	payload, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(v.Options.Addr, "/")+path, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	resp, err := v.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var failure struct {
+			Errors []string `json:"errors"`
+		}
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		if json.Unmarshal(body, &failure) == nil && len(failure.Errors) > 0 {
+			return fmt.Errorf("Vault answered %d: %s", resp.StatusCode, strings.Join(failure.Errors, "; "))
+		}
+		return fmt.Errorf("Vault answered %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("could not decode Vault response: %v", err)
+	}
+	return nil
+}
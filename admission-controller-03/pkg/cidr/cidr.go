@@ -0,0 +1,187 @@
+package cidr
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+)
+
+// ErrExhausted is returned when a parent CIDR has no free subnet left.
+var ErrExhausted = errors.New("no free subnet left in parent CIDR")
+
+// NextFree returns the first IPv4 subnet of length prefixLen inside parent
+// that does not overlap any of the used CIDRs. Unparsable used entries are
+// ignored.
+func NextFree(parent string, prefixLen int, used []string) (string, error) {
+	parentPrefix, err := netip.ParsePrefix(parent)
+	if err != nil {
+		return "", fmt.Errorf("invalid parent CIDR %q: %v", parent, err)
+	}
+	parentPrefix = parentPrefix.Masked()
+	if !parentPrefix.Addr().Is4() {
+		return "", fmt.Errorf("parent CIDR %q is not IPv4", parent)
+	}
+	if prefixLen < parentPrefix.Bits() || prefixLen > 32 {
+		return "", fmt.Errorf("prefix length /%d does not fit in %s", prefixLen, parentPrefix)
+	}
+
+	usedPrefixes := make([]netip.Prefix, 0, len(used))
+	for _, u := range used {
+		p, err := netip.ParsePrefix(u)
+		if err != nil {
+			continue
+		}
+		usedPrefixes = append(usedPrefixes, p.Masked())
+	}
+
+	start := uint64(toUint32(parentPrefix.Addr()))
+	end := start + uint64(1)<<(32-parentPrefix.Bits())
+	size := uint64(1) << (32 - prefixLen)
+	for addr := start; addr+size <= end; addr += size {
+		candidate := netip.PrefixFrom(fromUint32(uint32(addr)), prefixLen)
+		if !overlapsAny(candidate, usedPrefixes) {
+			return candidate.String(), nil
+		}
+	}
+	return "", ErrExhausted
+}
+
+// Subnets returns the first max IPv4 subnets of length prefixLen inside
+// parent, in address order.
+func Subnets(parent string, prefixLen, max int) ([]string, error) {
+	parentPrefix, err := netip.ParsePrefix(parent)
+	if err != nil {
+		return nil, fmt.Errorf("invalid parent CIDR %q: %v", parent, err)
+	}
+	parentPrefix = parentPrefix.Masked()
+	if !parentPrefix.Addr().Is4() {
+		return nil, fmt.Errorf("parent CIDR %q is not IPv4", parent)
+	}
+	if prefixLen < parentPrefix.Bits() || prefixLen > 32 {
+		return nil, fmt.Errorf("prefix length /%d does not fit in %s", prefixLen, parentPrefix)
+	}
+
+	var subnets []string
+	start := uint64(toUint32(parentPrefix.Addr()))
+	end := start + uint64(1)<<(32-parentPrefix.Bits())
+	size := uint64(1) << (32 - prefixLen)
+	for addr := start; addr+size <= end && len(subnets) < max; addr += size {
+		subnets = append(subnets, netip.PrefixFrom(fromUint32(uint32(addr)), prefixLen).String())
+	}
+	return subnets, nil
+}
+
+// Edge returns the subnet of the given prefix length at the start of parent,
+// or at its end when last is set. The subnet must be smaller than parent.
+func Edge(parent string, prefixLen int, last bool) (string, error) {
+	parentPrefix, err := netip.ParsePrefix(parent)
+	if err != nil {
+		return "", fmt.Errorf("invalid parent CIDR %q: %v", parent, err)
+	}
+	parentPrefix = parentPrefix.Masked()
+	if !parentPrefix.Addr().Is4() {
+		return "", fmt.Errorf("parent CIDR %q is not IPv4", parent)
+	}
+	if prefixLen <= parentPrefix.Bits() || prefixLen > 32 {
+		return "", fmt.Errorf("prefix length /%d does not fit in %s", prefixLen, parentPrefix)
+	}
+	start := uint64(toUint32(parentPrefix.Addr()))
+	if last {
+		start += uint64(1)<<(32-parentPrefix.Bits()) - uint64(1)<<(32-prefixLen)
+	}
+	return netip.PrefixFrom(fromUint32(uint32(start)), prefixLen).String(), nil
+}
+
+// Partition splits parent into the smallest power of two of equal subnets
+// that gives every one of parts a share and returns the subnet at index.
+// Shares beyond parts are left unassigned.
+func Partition(parent string, parts, index int) (string, error) {
+	parentPrefix, err := netip.ParsePrefix(parent)
+	if err != nil {
+		return "", fmt.Errorf("invalid parent CIDR %q: %v", parent, err)
+	}
+	parentPrefix = parentPrefix.Masked()
+	if !parentPrefix.Addr().Is4() {
+		return "", fmt.Errorf("parent CIDR %q is not IPv4", parent)
+	}
+	if parts < 1 || index < 0 || index >= parts {
+		return "", fmt.Errorf("invalid partition %d of %d", index, parts)
+	}
+
+	bits := 0
+	for 1<<bits < parts {
+		bits++
+	}
+	prefixLen := parentPrefix.Bits() + bits
+	if prefixLen > 32 {
+		return "", fmt.Errorf("%s is too small to split %d ways", parentPrefix, parts)
+	}
+	start := uint64(toUint32(parentPrefix.Addr())) + uint64(index)<<(32-prefixLen)
+	return netip.PrefixFrom(fromUint32(uint32(start)), prefixLen).String(), nil
+}
+
+// Contains reports whether child lies entirely inside parent.
+func Contains(parent, child string) bool {
+	parentPrefix, err := netip.ParsePrefix(parent)
+	if err != nil {
+		return false
+	}
+	childPrefix, err := netip.ParsePrefix(child)
+	if err != nil {
+		return false
+	}
+	return childPrefix.Bits() >= parentPrefix.Bits() && parentPrefix.Masked().Contains(childPrefix.Masked().Addr())
+}
+
+// Overlaps reports whether two CIDRs share any address.
+func Overlaps(a, b string) (bool, error) {
+	pa, err := netip.ParsePrefix(a)
+	if err != nil {
+		return false, fmt.Errorf("invalid CIDR %q: %v", a, err)
+	}
+	pb, err := netip.ParsePrefix(b)
+	if err != nil {
+		return false, fmt.Errorf("invalid CIDR %q: %v", b, err)
+	}
+	return pa.Overlaps(pb), nil
+}
+
+func overlapsAny(candidate netip.Prefix, used []netip.Prefix) bool {
+	for _, p := range used {
+		if candidate.Overlaps(p) {
+			return true
+		}
+	}
+	return false
+}
+
+func toUint32(addr netip.Addr) uint32 {
+	b := addr.As4()
+	return binary.BigEndian.Uint32(b[:])
+}
+
+func fromUint32(v uint32) netip.Addr {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	return netip.AddrFrom4(b)
+}
+
+// Compare orders two CIDRs by network address, then by prefix length.
+// Unparsable CIDRs sort after valid ones.
+func Compare(a, b string) int {
+	pa, errA := netip.ParsePrefix(a)
+	pb, errB := netip.ParsePrefix(b)
+	switch {
+	case errA != nil && errB != nil:
+		return 0
+	case errA != nil:
+		return 1
+	case errB != nil:
+		return -1
+	}
+	if c := pa.Masked().Addr().Compare(pb.Masked().Addr()); c != 0 {
+		return c
+	}
+	return pa.Bits() - pb.Bits()
+}
@@ -0,0 +1,81 @@
+package cidr
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestNextFree(t *testing.T) {
+	tests := []struct {
+		name      string
+		parent    string
+		prefixLen int
+		used      []string
+		want      string
+		wantErr   error
+	}{
+		{name: "empty parent", parent: "10.0.0.0/24", prefixLen: 26, want: "10.0.0.0/26"},
+		{name: "unmasked parent", parent: "10.0.0.77/24", prefixLen: 26, want: "10.0.0.0/26"},
+		{name: "skips used", parent: "10.0.0.0/24", prefixLen: 26, used: []string{"10.0.0.0/26", "10.0.0.64/26"}, want: "10.0.0.128/26"},
+		{name: "skips overlapping smaller", parent: "10.0.0.0/24", prefixLen: 26, used: []string{"10.0.0.8/29"}, want: "10.0.0.64/26"},
+		{name: "skips overlapping larger", parent: "10.0.0.0/23", prefixLen: 26, used: []string{"10.0.0.0/24"}, want: "10.0.1.0/26"},
+		{name: "ignores unparsable used", parent: "10.0.0.0/24", prefixLen: 26, used: []string{"oops"}, want: "10.0.0.0/26"},
+		{name: "whole parent", parent: "10.0.0.0/24", prefixLen: 24, want: "10.0.0.0/24"},
+		{name: "top of address space", parent: "255.255.255.0/24", prefixLen: 25, used: []string{"255.255.255.0/25"}, want: "255.255.255.128/25"},
+		{name: "exhausted", parent: "10.0.0.0/25", prefixLen: 26, used: []string{"10.0.0.0/26", "10.0.0.64/26"}, wantErr: ErrExhausted},
+		{name: "prefix too short", parent: "10.0.0.0/24", prefixLen: 23, wantErr: errAny},
+		{name: "prefix too long", parent: "10.0.0.0/24", prefixLen: 33, wantErr: errAny},
+		{name: "IPv6 parent", parent: "fd00::/64", prefixLen: 80, wantErr: errAny},
+		{name: "invalid parent", parent: "10.0.0.0", prefixLen: 26, wantErr: errAny},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NextFree(tt.parent, tt.prefixLen, tt.used)
+			checkResult(t, got, err, tt.want, tt.wantErr)
+		})
+	}
+}
+
+func TestPartition(t *testing.T) {
+	tests := []struct {
+		name         string
+		parent       string
+		parts, index int
+		want         string
+		wantErr      error
+	}{
+		{name: "single part", parent: "10.0.0.0/16", parts: 1, index: 0, want: "10.0.0.0/16"},
+		{name: "halves", parent: "10.0.0.0/16", parts: 2, index: 1, want: "10.0.128.0/17"},
+		{name: "rounds up to a power of two", parent: "10.0.0.0/16", parts: 3, index: 2, want: "10.0.128.0/18"},
+		{name: "unmasked parent", parent: "10.0.12.0/16", parts: 4, index: 3, want: "10.0.192.0/18"},
+		{name: "down to single addresses", parent: "10.0.0.0/30", parts: 4, index: 3, want: "10.0.0.3/32"},
+		{name: "too small", parent: "10.0.0.0/31", parts: 3, index: 0, wantErr: errAny},
+		{name: "index past parts", parent: "10.0.0.0/16", parts: 3, index: 3, wantErr: errAny},
+		{name: "negative index", parent: "10.0.0.0/16", parts: 3, index: -1, wantErr: errAny},
+		{name: "no parts", parent: "10.0.0.0/16", parts: 0, index: 0, wantErr: errAny},
+		{name: "IPv6 parent", parent: "fd00::/64", parts: 2, index: 0, wantErr: errAny},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Partition(tt.parent, tt.parts, tt.index)
+			checkResult(t, got, err, tt.want, tt.wantErr)
+		})
+	}
+}
+
+// errAny stands for any error in the test tables.
+var errAny = errors.New("any error")
+
+func checkResult(t *testing.T, got string, err error, want string, wantErr error) {
+	t.Helper()
+	switch {
+	case wantErr == nil && err != nil:
+		t.Fatalf("unexpected error: %v", err)
+	case wantErr == nil && got != want:
+		t.Fatalf("got %s, want %s", got, want)
+	case wantErr == errAny && err == nil:
+		t.Fatalf("got %s, want an error", got)
+	case wantErr != nil && wantErr != errAny && !errors.Is(err, wantErr):
+		t.Fatalf("got %s, %v, want %v", got, err, wantErr)
+	}
+}
@@ -0,0 +1,99 @@
+// Package claim defines the PoolClaim resource. Namespace creation files a
+// claim and a binder matches it to a pool later, the way a
+// PersistentVolumeClaim is bound to a volume, so slow pool provisioning stays
+// out of the admission path. There is no generated client; the types convert
+// to and from the unstructured objects the dynamic client works with.
+package claim
+
+import (
+	_ "embed"
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	Group   = "ipam.example.com"
+	Version = "v1alpha1"
+	Kind    = "PoolClaim"
+)
+
+// Resource is the PoolClaim resource. It is cluster scoped, as the claim is
+// filed before its namespace exists.
+var Resource = schema.GroupVersionResource{Group: Group, Version: Version, Resource: "poolclaims"}
+
+//go:embed crd.yaml
+var crdManifest []byte
+
+// CRD returns the CustomResourceDefinition of PoolClaim.
+func CRD() (*unstructured.Unstructured, error) {
+	var object map[string]interface{}
+	if err := yaml.Unmarshal(crdManifest, &object); err != nil {
+		return nil, fmt.Errorf("could not decode CRD manifest: %v", err)
+	}
+	return &unstructured.Unstructured{Object: object}, nil
+}
+
+// Phase is where a claim is in its lifecycle.
+type Phase string
+
+const (
+	// PhasePending: no pool is bound yet.
+	PhasePending Phase = "Pending"
+	// PhaseBound: the pool is assigned and the namespace annotated.
+	PhaseBound Phase = "Bound"
+	// PhaseLost: the namespace never appeared, or was deleted before the
+	// claim was bound.
+	PhaseLost Phase = "Lost"
+)
+
+// PoolClaim asks for a pool for one namespace.
+type PoolClaim struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   Spec   `json:"spec"`
+	Status Status `json:"status,omitempty"`
+}
+
+// Spec is what is asked for.
+type Spec struct {
+	// Namespace is empty until a namespace created with generateName exists.
+	Namespace  string    `json:"namespace,omitempty"`
+	RequestUID types.UID `json:"requestUID"`
+	Tenant     string    `json:"tenant,omitempty"`
+}
+
+// Status is what was bound.
+type Status struct {
+	Pool  string `json:"pool,omitempty"`
+	CIDR  string `json:"cidr,omitempty"`
+	Phase Phase  `json:"phase,omitempty"`
+	// Message says why a claim is not bound yet.
+	Message string `json:"message,omitempty"`
+}
+
+// ToUnstructured converts a claim for the dynamic client.
+func ToUnstructured(c *PoolClaim) (*unstructured.Unstructured, error) {
+	c.APIVersion = Group + "/" + Version
+	c.Kind = Kind
+	object, err := runtime.DefaultUnstructuredConverter.ToUnstructured(c)
+	if err != nil {
+		return nil, fmt.Errorf("could not convert PoolClaim %s: %v", c.Name, err)
+	}
+	return &unstructured.Unstructured{Object: object}, nil
+}
+
+// FromUnstructured converts an object read through the dynamic client.
+func FromUnstructured(u *unstructured.Unstructured) (*PoolClaim, error) {
+	var c PoolClaim
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, &c); err != nil {
+		return nil, fmt.Errorf("could not convert PoolClaim %s: %v", u.GetName(), err)
+	}
+	return &c, nil
+}
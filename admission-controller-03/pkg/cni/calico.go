@@ -0,0 +1,23 @@
+package cni
+
+import "context"
+
+// Calico is the default plugin. Calico reads the webhook's ipv4pools
+// annotation and serves the IPPools themselves, so there is nothing to add.
+type Calico struct{}
+
+func (Calico) Name() string {
+	return "calico"
+}
+
+func (Calico) NamespaceAnnotations([]Pool) map[string]string {
+	return nil
+}
+
+func (Calico) EnsurePools(context.Context, []Pool) error {
+	return nil
+}
+
+func (Calico) RemovePool(context.Context, string) error {
+	return nil
+}
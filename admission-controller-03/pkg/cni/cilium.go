@@ -0,0 +1,104 @@
+package cni
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+)
+
+// CiliumPoolAnnotation selects the CiliumPodIPPool a namespace's pods draw
+// their addresses from, with Cilium's multi-pool IPAM.
+const CiliumPoolAnnotation = "ipam.cilium.io/ip-pool"
+
+// DefaultCiliumMaskSize is the size of the blocks Cilium hands to nodes when
+// none is configured.
+const DefaultCiliumMaskSize = 27
+
+var ciliumPodIPPoolResource = schema.GroupVersionResource{Group: "cilium.io", Version: "v2alpha1", Resource: "ciliumpodippools"}
+
+// Cilium applies namespace subnets as CiliumPodIPPools. Cilium only takes
+// one pool per namespace, so a namespace gets a single CiliumPodIPPool, named
+// after its first pool, that holds the CIDRs of all of them. It is deleted
+// once that first pool is released.
+type Cilium struct {
+	// Client writes CiliumPodIPPools.
+	Client dynamic.Interface
+	// MaskSize is the prefix length of the blocks Cilium hands to nodes.
+	// A pool smaller than a block is handed out whole.
+	MaskSize int
+}
+
+func (c *Cilium) Name() string {
+	return "cilium"
+}
+
+func (c *Cilium) NamespaceAnnotations(pools []Pool) map[string]string {
+	if len(pools) == 0 {
+		return nil
+	}
+	return map[string]string{CiliumPoolAnnotation: pools[0].Name}
+}
+
+// EnsurePools creates the namespace's CiliumPodIPPool, or updates its CIDRs
+// when the namespace was given another pool.
+func (c *Cilium) EnsurePools(ctx context.Context, pools []Pool) error {
+	if len(pools) == 0 {
+		return nil
+	}
+	maskSize := c.MaskSize
+	cidrs := make([]interface{}, 0, len(pools))
+	for _, pool := range pools {
+		prefix, err := netip.ParsePrefix(pool.CIDR)
+		if err != nil {
+			return fmt.Errorf("invalid CIDR %q of IP pool %s: %v", pool.CIDR, pool.Name, err)
+		}
+		if !prefix.Addr().Is4() {
+			return fmt.Errorf("IP pool %s: only IPv4 pools are supported with Cilium", pool.Name)
+		}
+		if prefix.Bits() > maskSize {
+			maskSize = prefix.Bits()
+		}
+		cidrs = append(cidrs, pool.CIDR)
+	}
+	name := pools[0].Name
+	spec := map[string]interface{}{
+		"ipv4": map[string]interface{}{"cidrs": cidrs, "maskSize": int64(maskSize)},
+	}
+
+	client := c.Client.Resource(ciliumPodIPPoolResource)
+	existing, err := client.Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		pool := &unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": "cilium.io/v2alpha1",
+			"kind":       "CiliumPodIPPool",
+			"metadata":   map[string]interface{}{"name": name},
+			"spec":       spec,
+		}}
+		if _, err := client.Create(ctx, pool, metav1.CreateOptions{}); err != nil {
+			return fmt.Errorf("could not create CiliumPodIPPool %s: %v", name, err)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not get CiliumPodIPPool %s: %v", name, err)
+	}
+	existing.Object["spec"] = spec
+	if _, err := client.Update(ctx, existing, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("could not update CiliumPodIPPool %s: %v", name, err)
+	}
+	return nil
+}
+
+func (c *Cilium) RemovePool(ctx context.Context, name string) error {
+	err := c.Client.Resource(ciliumPodIPPoolResource).Delete(ctx, name, metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("could not delete CiliumPodIPPool %s: %v", name, err)
+	}
+	return nil
+}
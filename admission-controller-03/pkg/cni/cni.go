@@ -0,0 +1,29 @@
+// Package cni applies the subnets assigned to a namespace to the cluster's
+// CNI. The webhook keeps its assignments in Calico IPPools and the namespace's
+// ipv4pools annotation whatever the CNI; a Plugin points the namespace's pods
+// at those subnets in the CNI's own terms.
+package cni
+
+import "context"
+
+// Pool is a pool assigned to a namespace.
+type Pool struct {
+	Name string
+	CIDR string
+}
+
+// Plugin is the CNI a cluster runs.
+type Plugin interface {
+	// Name names the CNI in logs.
+	Name() string
+	// NamespaceAnnotations returns the annotations, beyond the webhook's
+	// own, that have the CNI give the namespace's pods addresses of its
+	// pools. pools are in assignment order.
+	NamespaceAnnotations(pools []Pool) map[string]string
+	// EnsurePools makes the CNI serve the addresses of the namespace's
+	// pools, before its annotations are applied.
+	EnsurePools(ctx context.Context, pools []Pool) error
+	// RemovePool undoes EnsurePools once the namespace holding the pool is
+	// gone. A pool the CNI knows nothing of is no error.
+	RemovePool(ctx context.Context, name string) error
+}
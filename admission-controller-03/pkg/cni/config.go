@@ -0,0 +1,20 @@
+package cni
+
+import (
+	"k8s.io/client-go/dynamic"
+
+	"admission-controller-03/pkg/config"
+)
+
+// New builds the plugin configured in cfg, writing CNI resources with
+// client. A nil cfg is Calico.
+func New(cfg *config.CNI, client dynamic.Interface) Plugin {
+	if cfg == nil || cfg.Cilium == nil {
+		return Calico{}
+	}
+	maskSize := cfg.Cilium.MaskSize
+	if maskSize == 0 {
+		maskSize = DefaultCiliumMaskSize
+	}
+	return &Cilium{Client: client, MaskSize: maskSize}
+}
@@ -0,0 +1,1336 @@
+package config
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os"
+	"slices"
+
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	"admission-controller-03/pkg/cidr"
+)
+
+// Config holds the allocation policy of the admission controller.
+type Config struct {
+	// Location is the value of the "location" label a pool needs to be
+	// selected for namespaces that do not belong to a configured tenant.
+	Location string `json:"location"`
+
+	// TenantLabel is the namespace label that names the owning tenant.
+	TenantLabel string `json:"tenantLabel"`
+
+	// Tenants maps a tenant label value to the pools that tenant may use.
+	Tenants map[string]Tenant `json:"tenants"`
+
+	// PoolClasses maps a pool class, e.g. "dmz", to the shared pools
+	// workloads requesting the class draw their addresses from. Tenants may
+	// only request the classes they are allowed.
+	PoolClasses map[string]PoolClass `json:"poolClasses,omitempty"`
+
+	// SelectionRules are CEL expressions over a namespace and a pool, each
+	// of which a pool must satisfy to be selected for the namespace.
+	SelectionRules []SelectionRule `json:"selectionRules,omitempty"`
+
+	// Strategy orders pools of equal priority: StrategyName picks them in
+	// name order, StrategyLowestCIDR packs allocations at the low end.
+	Strategy string `json:"strategy"`
+
+	// CleanupPolicy decides what happens to a child pool of a team aggregate
+	// when its namespace is deleted: CleanupRecycle, CleanupRetain or
+	// CleanupDelete. Tenants may override it.
+	CleanupPolicy string `json:"cleanupPolicy"`
+
+	// QuotaMode is either QuotaModeDeny or QuotaModeWarn and decides what
+	// happens when a tenant is at its MaxPools quota.
+	QuotaMode string `json:"quotaMode"`
+
+	// AssignmentMode is either AssignmentModeAdmission or AssignmentModeClaim
+	// and decides whether a pool is assigned while the namespace creation is
+	// admitted, or claimed then and bound asynchronously.
+	AssignmentMode string `json:"assignmentMode"`
+
+	// DriftMode is either DriftModeEnforce or DriftModeReport and decides
+	// whether drift between pools and namespaces is repaired or only
+	// reported through events and metrics.
+	DriftMode string `json:"driftMode"`
+
+	// Hierarchy, when set, carves a contiguous aggregate per tenant out of a
+	// master pool and creates namespace pools inside that aggregate.
+	Hierarchy *Hierarchy `json:"hierarchy,omitempty"`
+
+	// ExemptNamespaces are admitted untouched, without a pool assignment.
+	ExemptNamespaces Exemptions `json:"exemptNamespaces"`
+
+	// CriticalNamespaces are never mutated and never denied, whatever the
+	// request and whatever the webhook configuration routes to us, so that a
+	// scoping mistake cannot break cluster bootstrap or upgrades.
+	CriticalNamespaces Exemptions `json:"criticalNamespaces"`
+
+	// AnnotationEditors may change the ipam annotations of an existing
+	// namespace; everyone else is denied.
+	AnnotationEditors Editors `json:"annotationEditors"`
+
+	// Operations maps a kind to the operations the mutating webhook acts on,
+	// a subset of SupportedOperations. Other requests are admitted untouched
+	// with a warning, or denied in strict mode. Pools of namespaces deleted
+	// while DELETE is off are released by the release finalizer.
+	Operations map[string][]string `json:"operations"`
+
+	// PoolTemplate is the spec applied to every IPPool the controller
+	// creates; ZonePoolTemplates override it field by field per location.
+	PoolTemplate      PoolTemplate            `json:"poolTemplate"`
+	ZonePoolTemplates map[string]PoolTemplate `json:"zonePoolTemplates,omitempty"`
+
+	// Notifications, when set, tells the owners named in a namespace's
+	// owner-contact annotation about its pool assignment.
+	Notifications *Notifications `json:"notifications,omitempty"`
+
+	// LowPoolThreshold raises an early warning when a zone has fewer
+	// available pools than this. ZoneLowPoolThresholds override it per zone.
+	// Zero disables the warning.
+	LowPoolThreshold      int            `json:"lowPoolThreshold"`
+	ZoneLowPoolThresholds map[string]int `json:"zoneLowPoolThresholds,omitempty"`
+
+	// ReservationTTLSeconds is how long a pool reserved at admission stays
+	// pending before it is handed back, if its namespace never appeared,
+	// e.g. because another webhook denied the creation.
+	ReservationTTLSeconds int `json:"reservationTTLSeconds"`
+
+	// Growth, when set, assigns namespaces an additional pool once their
+	// address utilization crosses a threshold.
+	Growth *Growth `json:"growth,omitempty"`
+
+	// Reservations are ranges of every assigned pool kept out of Calico IPAM
+	// through an IPReservation, in addition to those of the pool's tenant.
+	Reservations []ReservedRange `json:"reservations,omitempty"`
+
+	// Autoscaling, when set with Hierarchy, carves another child pool for a
+	// tenant once the address utilization of its pools in the zone crosses
+	// a threshold.
+	Autoscaling *Autoscaling `json:"autoscaling,omitempty"`
+
+	// Splitter, when set, keeps every IPPool labeled role=master split into
+	// child pools, recreating any that are deleted.
+	Splitter *Splitter `json:"splitter,omitempty"`
+
+	// NetworkPolicy, when set, gives every namespace with an assigned pool a
+	// Calico policy that only allows traffic to and from its pools' CIDRs and
+	// the template's extra peers.
+	NetworkPolicy *NetworkPolicy `json:"networkPolicy,omitempty"`
+
+	// BGP, when set, advertises the CIDRs of assigned pools upstream through
+	// the default BGPConfiguration and keeps the configured BGP peers.
+	BGP *BGP `json:"bgp,omitempty"`
+
+	// Region, when set, splits a supernet shared with clusters in other
+	// regions into region-owned ranges. Pools of the supernet outside this
+	// region's range are never handed out here.
+	Region *Region `json:"region,omitempty"`
+
+	// Backend, when set, draws namespace subnets from an external IPAM
+	// instead of the IPPools labeled available, and creates a pool for each.
+	Backend *Backend `json:"backend,omitempty"`
+
+	// CNI, when set, selects the CNI namespace subnets are applied to.
+	// Calico is the default.
+	CNI *CNI `json:"cni,omitempty"`
+
+	// ServiceLoadBalancer, when set, allocates the address of every Service
+	// of type LoadBalancer from the pools labeled role=service-lb of its
+	// namespace's tenant. The Service kind must be in Operations, with UPDATE
+	// for Services changed to or from type LoadBalancer.
+	ServiceLoadBalancer *ServiceLoadBalancer `json:"serviceLoadBalancer,omitempty"`
+
+	// Egress, when set, reserves an egress gateway pool, one of the pools
+	// labeled role=egress-gateway, for every namespace holding a pod pool,
+	// and points the namespace's egress traffic at the gateways drawing
+	// their addresses from it.
+	Egress *Egress `json:"egress,omitempty"`
+
+	// DNS, when set, publishes DNS records for the subnets assigned to
+	// namespaces through external-dns.
+	DNS *DNS `json:"dns,omitempty"`
+
+	// ClusterAPI, when set, allocates a pod and a service CIDR for every
+	// Cluster API workload cluster managed from this cluster.
+	ClusterAPI *ClusterAPI `json:"clusterAPI,omitempty"`
+
+	// Sink, when set, publishes every pool assignment and release for
+	// downstream network inventory and SIEM systems.
+	Sink *Sink `json:"sink,omitempty"`
+
+	// Alerts, when set, tells operators about pool exhaustion, repeated
+	// allocation failures and blocked releases.
+	Alerts *Alerts `json:"alerts,omitempty"`
+
+	// Policy, when set, has an OPA policy decide on every namespace
+	// assignment before it is committed.
+	Policy *Policy `json:"policy,omitempty"`
+
+	// API, when set, serves the allocations API and the admin verbs to holders
+	// of its token or, with kubernetesAuth, to Kubernetes users RBAC allows.
+	API *API `json:"api,omitempty"`
+}
+
+// API configures the allocations API. At least one way of authenticating is
+// required.
+type API struct {
+	// TokenFile holds a static bearer token, which grants every call. The
+	// gRPC allocation service only accepts this token.
+	TokenFile string `json:"tokenFile,omitempty"`
+	// KubernetesAuth authenticates bearer tokens by TokenReview and
+	// authorizes every call by SubjectAccessReview, so that the API is
+	// gated by RBAC: get and list on allocations.ipam.example.com, list on
+	// ippools.ipam.example.com, and the verbs cordon, uncordon and release
+	// on ippools.ipam.example.com, with the pool as resource name, and get on
+	// regions.ipam.example.com for region peers. The read identity needs the
+	// system:auth-delegator ClusterRole.
+	KubernetesAuth bool `json:"kubernetesAuth,omitempty"`
+	// Audience, with KubernetesAuth, is the audience tokens must be issued
+	// for, e.g. through a projected service account token. Without it any
+	// token the API server accepts is accepted, including those meant for
+	// the API server itself.
+	Audience string `json:"audience,omitempty"`
+}
+
+// Alerts configures operator alerting. At least one destination is required.
+type Alerts struct {
+	// SlackWebhookURLFile holds the URL of a Slack incoming webhook.
+	SlackWebhookURLFile string `json:"slackWebhookURLFile,omitempty"`
+	// WebhookURL receives every alert as JSON.
+	WebhookURL string `json:"webhookURL,omitempty"`
+	// CooldownSeconds rate limits repeats of the same alert. Defaults to 15
+	// minutes.
+	CooldownSeconds int `json:"cooldownSeconds,omitempty"`
+}
+
+// Policy configures the OPA policy allocation decisions are checked against.
+// An OPA failure denies the request as an internal error, subject to the
+// failure policy.
+type Policy struct {
+	// URL is the policy's document in OPA's Data API, e.g.
+	// http://localhost:8181/v1/data/ipam/allocation.
+	URL string `json:"url"`
+	// TimeoutSeconds bounds one evaluation. Defaults to 2 seconds.
+	TimeoutSeconds int `json:"timeoutSeconds,omitempty"`
+}
+
+// Backend selects exactly one external IPAM backend.
+type Backend struct {
+	Mock     *MockBackend `json:"mock,omitempty"`
+	NetBox   *NetBox      `json:"netbox,omitempty"`
+	Infoblox *Infoblox    `json:"infoblox,omitempty"`
+	Central  *Central     `json:"central,omitempty"`
+}
+
+// CNI selects the CNI the cluster runs. Without Cilium it is Calico.
+type CNI struct {
+	Cilium *Cilium `json:"cilium,omitempty"`
+}
+
+// Cilium applies namespace subnets as CiliumPodIPPools, selected by the
+// namespace annotation of Cilium's multi-pool IPAM. The IPPools the webhook
+// allocates from are still Calico resources, so the projectcalico.org API
+// must be served.
+type Cilium struct {
+	// MaskSize is the prefix length of the blocks Cilium hands to nodes,
+	// /27 when zero.
+	MaskSize int `json:"maskSize,omitempty"`
+}
+
+// ServiceLoadBalancer configures the allocation of Service load balancer
+// addresses. Its pools are owned by a tenant through the
+// ipam.example.com/tenant label, or shared by namespaces without one when
+// unlabeled, and must not be labeled status=available, so that they are never
+// assigned to a namespace.
+type ServiceLoadBalancer struct {
+	// Field is where the address is written: ServiceLBFieldLoadBalancerIP,
+	// the default, or ServiceLBFieldCalico for Calico's load balancer IPAM.
+	Field string `json:"field,omitempty"`
+}
+
+const (
+	// ServiceLBFieldLoadBalancerIP writes the address to the Service's
+	// spec.loadBalancerIP.
+	ServiceLBFieldLoadBalancerIP = "loadBalancerIP"
+	// ServiceLBFieldCalico writes the address to the Service's
+	// projectcalico.org/loadBalancerIPs annotation.
+	ServiceLBFieldCalico = "calico"
+)
+
+// Egress configures the egress gateway pools of namespaces. A pool labeled
+// with a tenant through ipam.example.com/tenant is only reserved for that
+// tenant's namespaces, an unlabeled one for any. Egress pools must not be
+// labeled status=available, so that they are never assigned as pod pools.
+type Egress struct {
+	// Tenants limits egress pools to the namespaces of these tenants; every
+	// namespace gets one when empty.
+	Tenants []string `json:"tenants,omitempty"`
+}
+
+// DNS configures the records published for assigned subnets, as an
+// external-dns DNSEndpoint in each namespace holding pools. The records go
+// with the namespace or its pools. At least one kind of record is required.
+type DNS struct {
+	// InventoryDomain, when set, gets a TXT record per assigned pool,
+	// "<pool>.<inventoryDomain>", with its CIDR, namespace and tenant.
+	InventoryDomain string `json:"inventoryDomain,omitempty"`
+	// ReverseNameservers, when set, are delegated the reverse zones of the
+	// assigned subnets by NS records. Subnets longer than /24 are delegated
+	// as in RFC 2317, with a CNAME per address.
+	ReverseNameservers []string `json:"reverseNameservers,omitempty"`
+	// TTLSeconds of the records. Zero leaves the DNS provider's default.
+	TTLSeconds int `json:"ttlSeconds,omitempty"`
+}
+
+// ClusterAPI configures the CIDRs of workload clusters. They are carved from
+// master pools that no pool of this cluster is carved from, and stay
+// reserved until their Cluster is gone.
+type ClusterAPI struct {
+	// PoolSelector is an IPPool label selector picking the master pools,
+	// e.g. "ipam.example.com/workload-clusters == 'true'". They must not be
+	// labeled role=master or status=available.
+	PoolSelector string `json:"poolSelector"`
+	// PodPrefixLength and ServicePrefixLength are the sizes of the CIDRs,
+	// e.g. 16 and 20.
+	PodPrefixLength     int `json:"podPrefixLength"`
+	ServicePrefixLength int `json:"servicePrefixLength"`
+	// Output is where the CIDRs are written: ClusterAPIOutputSpec, the
+	// default, or ClusterAPIOutputConfigMap.
+	Output string `json:"output,omitempty"`
+}
+
+const (
+	// ClusterAPIOutputSpec writes the CIDRs to the Cluster's
+	// spec.clusterNetwork, unless it already has CIDRs of its own.
+	ClusterAPIOutputSpec = "spec"
+	// ClusterAPIOutputConfigMap writes them to a ConfigMap named after the
+	// Cluster with the suffix "-ipam", in its namespace, for the bootstrap
+	// to consume.
+	ClusterAPIOutputConfigMap = "configMap"
+)
+
+// MockBackend is the reference backend, handing out a fixed list of subnets
+// and keeping its allocations in memory.
+type MockBackend struct {
+	Subnets []string `json:"subnets"`
+}
+
+// NetBox allocates namespace subnets as child prefixes of a NetBox prefix.
+type NetBox struct {
+	// URL is the base URL of NetBox, e.g. https://netbox.example.com.
+	URL string `json:"url"`
+	// TokenFile holds a NetBox API token allowed to add and delete prefixes.
+	TokenFile string `json:"tokenFile"`
+	// ParentPrefix is the CIDR of the NetBox prefix subnets are allocated
+	// from.
+	ParentPrefix string `json:"parentPrefix"`
+	// PrefixLength is that of the subnets, unless the tenant has a
+	// defaultPrefixLength.
+	PrefixLength int `json:"prefixLength"`
+	// TenantSlugs assigns each prefix to the NetBox tenant whose slug is the
+	// namespace's tenant.
+	TenantSlugs bool `json:"tenantSlugs,omitempty"`
+}
+
+// Infoblox allocates namespace subnets as networks of an Infoblox network
+// container, through the WAPI.
+type Infoblox struct {
+	// URL is the base URL of the WAPI, with its version, e.g.
+	// https://infoblox.example.com/wapi/v2.12.
+	URL string `json:"url"`
+	// CredentialsDir is where the Secret holding the WAPI user's credentials
+	// is mounted, with the keys username and password.
+	CredentialsDir string `json:"credentialsDir"`
+	// NetworkView is that of the container, "default" when empty.
+	NetworkView string `json:"networkView,omitempty"`
+	// Container is the CIDR of the network container subnets are allocated
+	// from.
+	Container string `json:"container"`
+	// PrefixLength is that of the subnets, unless the tenant has a
+	// defaultPrefixLength.
+	PrefixLength int `json:"prefixLength"`
+	// NamespaceAttribute and TenantAttribute are the extensible attributes
+	// recording a network's namespace and tenant, "Namespace" and "Tenant"
+	// when empty. Both must be defined in Infoblox.
+	NamespaceAttribute string `json:"namespaceAttribute,omitempty"`
+	TenantAttribute    string `json:"tenantAttribute,omitempty"`
+}
+
+// Central allocates namespace subnets from the gRPC allocation service of a
+// central webhook shared by a fleet of clusters.
+type Central struct {
+	// Address is the central webhook's gRPC address, e.g.
+	// ipam.example.com:9443.
+	Address string `json:"address"`
+	// TokenFile holds the central webhook's API token.
+	TokenFile string `json:"tokenFile"`
+	// CAFile verifies the central webhook's certificate; the system roots
+	// are used when empty.
+	CAFile string `json:"caFile,omitempty"`
+	// Cluster names this cluster in the central webhook's allocations. It
+	// must be unique in the fleet.
+	Cluster string `json:"cluster"`
+}
+
+// Sink selects where allocation records go: an event stream, an HTTP API, or
+// several of them.
+type Sink struct {
+	Kafka *Kafka    `json:"kafka,omitempty"`
+	NATS  *NATS     `json:"nats,omitempty"`
+	HTTP  *HTTPSink `json:"http,omitempty"`
+}
+
+// Kafka publishes allocation records to a topic.
+type Kafka struct {
+	Brokers []string `json:"brokers"`
+	Topic   string   `json:"topic"`
+}
+
+// NATS publishes allocation records to a subject.
+type NATS struct {
+	URL             string `json:"url"`
+	Subject         string `json:"subject"`
+	CredentialsFile string `json:"credentialsFile,omitempty"`
+}
+
+// HTTPSink files allocation changes with an HTTP API, e.g. a CMDB record in
+// ServiceNow through an import set, whose coalesce field makes the release
+// update the record the assignment created.
+type HTTPSink struct {
+	// Requests maps an event, "assigned" or "released", to the request
+	// filed for it.
+	Requests map[string]HTTPSinkRequest `json:"requests"`
+	Headers  map[string]string          `json:"headers,omitempty"`
+	// Username and PasswordFile authenticate by basic auth, TokenFile holds
+	// a bearer token instead.
+	Username     string `json:"username,omitempty"`
+	PasswordFile string `json:"passwordFile,omitempty"`
+	TokenFile    string `json:"tokenFile,omitempty"`
+}
+
+// HTTPSinkRequest is the request filed for an event. URL and Body are Go
+// templates over the allocation record: .Event, .Namespace, .Pool, .CIDR,
+// .Tenant and .Time, with a json function quoting a value, e.g.
+// {"u_cidr": {{json .CIDR}}, "u_namespace": {{json .Namespace}}}.
+type HTTPSinkRequest struct {
+	// Method defaults to POST.
+	Method string `json:"method,omitempty"`
+	URL    string `json:"url"`
+	Body   string `json:"body"`
+}
+
+// Growth configures automatic allocation growth.
+type Growth struct {
+	// Threshold is the fraction of a namespace's addresses in use, e.g. 0.8,
+	// at which another pool is assigned.
+	Threshold float64 `json:"threshold"`
+	// MaxPoolsPerNamespace caps growth. Zero means unlimited.
+	MaxPoolsPerNamespace int `json:"maxPoolsPerNamespace"`
+}
+
+// Autoscaling configures the pool autoscaler.
+type Autoscaling struct {
+	// Threshold is the fraction of the addresses of a tenant's pools in the
+	// zone, e.g. 0.75, in use at which another child pool is carved.
+	Threshold float64 `json:"threshold"`
+	// MaxPools caps the child pools a tenant is scaled up to in the zone.
+	// Zero means only the tenant's aggregate limits it.
+	MaxPools int `json:"maxPools"`
+	// MaxAddresses caps the addresses of a tenant's pools in the zone the
+	// autoscaler grows it to. Zero means unlimited.
+	MaxAddresses int `json:"maxAddresses,omitempty"`
+}
+
+// Splitter configures the child pools of master pools. Children are created
+// with the pool template of the master's location.
+type Splitter struct {
+	// ChildPrefixLength is the size of each child pool, e.g. 26.
+	ChildPrefixLength int `json:"childPrefixLength"`
+	// MaxChildren caps the children of one master, lowest CIDRs first. Zero
+	// splits the whole master, up to MaxSplitChildren.
+	MaxChildren int `json:"maxChildren,omitempty"`
+	// Labels are set on every child pool.
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// NetworkPolicy is the template of the per-namespace isolation policy.
+type NetworkPolicy struct {
+	// Scope is NetworkPolicyGlobal for a GlobalNetworkPolicy per namespace,
+	// which namespace admins cannot edit, or NetworkPolicyNamespaced for a
+	// NetworkPolicy in the namespace.
+	Scope string `json:"scope"`
+	// Order of the policy; unset leaves Calico's default.
+	Order *float64 `json:"order,omitempty"`
+	// Types are the restricted directions, Ingress and/or Egress. Defaults to
+	// both.
+	Types []string `json:"types,omitempty"`
+	// AllowNets are further peers allowed in both directions, e.g. the
+	// service CIDR for cluster DNS.
+	AllowNets []string `json:"allowNets,omitempty"`
+}
+
+const (
+	NetworkPolicyGlobal     = "global"
+	NetworkPolicyNamespaced = "namespace"
+)
+
+// BGP configures the advertisement of assigned pools.
+type BGP struct {
+	// Advertise names the list of the default BGPConfiguration assigned
+	// CIDRs are added to: BGPAdvertiseExternalIPs or
+	// BGPAdvertiseLoadBalancerIPs.
+	Advertise string `json:"advertise"`
+	// Peers are BGPPeers created and kept in line with this config.
+	Peers []BGPPeer `json:"peers,omitempty"`
+}
+
+// BGPPeer is an upstream router, e.g. the top-of-rack switch of a zone.
+type BGPPeer struct {
+	Name     string `json:"name"`
+	PeerIP   string `json:"peerIP"`
+	ASNumber uint32 `json:"asNumber"`
+	// NodeSelector is a Calico selector of the nodes that peer with it;
+	// empty means all.
+	NodeSelector string `json:"nodeSelector,omitempty"`
+}
+
+const (
+	BGPAdvertiseExternalIPs     = "serviceExternalIPs"
+	BGPAdvertiseLoadBalancerIPs = "serviceLoadBalancerIPs"
+)
+
+// MaxSplitChildren is the most child pools a master is split into.
+const MaxSplitChildren = 4096
+
+// MaxCentralClusterLength caps the cluster name of backend.central, which
+// with a dot and 16 hex digits must fit a 63-character label value.
+const MaxCentralClusterLength = 46
+
+// Region places this cluster in an active-active multi-region deployment.
+type Region struct {
+	// Name is this cluster's region and must be one of Members.
+	Name string `json:"name"`
+	// Supernet is the CIDR shared by all regions.
+	Supernet string `json:"supernet"`
+	// Members lists every region sharing the supernet. All clusters must
+	// list them in the same order: the supernet is split in that order.
+	Members []string `json:"members"`
+	// Peers maps other regions to the base URL of their webhook, which
+	// assignments are pulled from during anti-entropy sync. The sync
+	// endpoint is served behind the API's authentication, so peers require
+	// api and TokenFile.
+	Peers map[string]string `json:"peers,omitempty"`
+	// TokenFile holds the bearer token sent to peers: their static API
+	// token, or a token Kubernetes authentication lets get
+	// regions.ipam.example.com.
+	TokenFile string `json:"tokenFile,omitempty"`
+}
+
+// Notifications configures the delivery channels and message templates for
+// namespace owner notifications.
+type Notifications struct {
+	// DefaultLocale is used when a namespace requests no locale, or one
+	// without a template. Defaults to "en".
+	DefaultLocale string `json:"defaultLocale,omitempty"`
+	// Templates override the built-in messages, keyed by locale and then by
+	// event ("assigned", "ttl-expiring", "forced-rotation").
+	Templates map[string]map[string]NotificationTemplate `json:"templates,omitempty"`
+	SMTP      *SMTP                                      `json:"smtp,omitempty"`
+	Slack     *Slack                                     `json:"slack,omitempty"`
+}
+
+// NotificationTemplate is a text/template subject and body.
+type NotificationTemplate struct {
+	Subject string `json:"subject"`
+	Body    string `json:"body"`
+}
+
+// SMTP delivers notifications to email contacts.
+type SMTP struct {
+	Addr         string `json:"addr"`
+	From         string `json:"from"`
+	Username     string `json:"username,omitempty"`
+	PasswordFile string `json:"passwordFile,omitempty"`
+}
+
+// Slack delivers notifications to Slack contacts through a bot token.
+type Slack struct {
+	TokenFile string `json:"tokenFile"`
+	APIURL    string `json:"apiURL,omitempty"`
+}
+
+// Exemptions selects namespaces by exact name or by label selector.
+type Exemptions struct {
+	Names     []string `json:"names"`
+	Selectors []string `json:"selectors"`
+}
+
+// Editors names users, e.g. system:serviceaccount:ipam:ipam-admin, and
+// groups.
+type Editors struct {
+	Users  []string `json:"users"`
+	Groups []string `json:"groups"`
+}
+
+// Allows reports whether the user, or any of its groups, is an editor.
+func (e Editors) Allows(user string, groups []string) bool {
+	for _, u := range e.Users {
+		if u == user {
+			return true
+		}
+	}
+	for _, g := range e.Groups {
+		for _, group := range groups {
+			if g == group {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// PoolTemplate holds the IPPool spec fields the controller sets on pools it
+// creates. Unset fields fall back to the global template, then to Calico's
+// defaults.
+type PoolTemplate struct {
+	IPIPMode         string   `json:"ipipMode,omitempty"`
+	VXLANMode        string   `json:"vxlanMode,omitempty"`
+	NATOutgoing      *bool    `json:"natOutgoing,omitempty"`
+	BlockSize        int      `json:"blockSize,omitempty"`
+	DisableBGPExport *bool    `json:"disableBGPExport,omitempty"`
+	AllowedUses      []string `json:"allowedUses,omitempty"`
+	// NodeSelector is a Calico selector, e.g.
+	// topology.kubernetes.io/zone == "zone-lhr", applied to the pools the
+	// controller creates, and again when they are assigned to a namespace.
+	// Static pools keep their own.
+	NodeSelector string `json:"nodeSelector,omitempty"`
+}
+
+// Hierarchy configures the master -> team -> namespace allocation model.
+type Hierarchy struct {
+	// MasterPool is the name of the IPPool that aggregates are carved from.
+	MasterPool string `json:"masterPool"`
+	// TeamPrefixLength is the size of each tenant's aggregate, e.g. 22.
+	TeamPrefixLength int `json:"teamPrefixLength"`
+	// NamespacePrefixLength is the size of each namespace pool, e.g. 26.
+	NamespacePrefixLength int `json:"namespacePrefixLength"`
+}
+
+// SupportedOperations lists every kind and operation the mutating webhook has
+// a handler for.
+var SupportedOperations = map[string][]string{
+	"Namespace": {"CREATE", "UPDATE", "DELETE"},
+	"Service":   {"CREATE", "UPDATE", "DELETE"},
+	"Pod":       {"CREATE"},
+}
+
+const (
+	QuotaModeDeny = "deny"
+	QuotaModeWarn = "warn"
+
+	AssignmentModeAdmission = "admission"
+	AssignmentModeClaim     = "claim"
+
+	DriftModeEnforce = "enforce"
+	DriftModeReport  = "report"
+
+	StrategyName       = "name"
+	StrategyLowestCIDR = "lowest-cidr"
+
+	// CleanupRecycle makes the pool available to the next namespace,
+	// CleanupRetain keeps it out of circulation with its ownership labels,
+	// CleanupDelete deletes the IPPool once its namespace is gone.
+	CleanupRecycle = "recycle"
+	CleanupRetain  = "retain"
+	CleanupDelete  = "delete"
+)
+
+// Tenant describes the pool group a tenant draws from.
+type Tenant struct {
+	// PoolSelectors are IPPool label selectors; a pool matching any of them
+	// belongs to the tenant.
+	PoolSelectors []string `json:"poolSelectors"`
+
+	// MaxPools caps the pools the tenant may hold across all of its
+	// namespaces. Zero means unlimited.
+	MaxPools int `json:"maxPools"`
+
+	// CleanupPolicy overrides the global cleanup policy for the tenant's
+	// child pools.
+	CleanupPolicy string `json:"cleanupPolicy,omitempty"`
+
+	// DefaultPrefixLength overrides hierarchy.namespacePrefixLength for the
+	// child pools carved for the tenant's namespaces.
+	DefaultPrefixLength int `json:"defaultPrefixLength,omitempty"`
+
+	// AllowedZones restricts the tenant to pools whose location label is one
+	// of them. Empty allows every zone.
+	AllowedZones []string `json:"allowedZones,omitempty"`
+
+	// Reservations are ranges of the tenant's assigned pools kept out of
+	// Calico IPAM, in addition to the global ones.
+	Reservations []ReservedRange `json:"reservations,omitempty"`
+
+	// AllowedPoolClasses are the pool classes the tenant's workloads may
+	// request.
+	AllowedPoolClasses []string `json:"allowedPoolClasses,omitempty"`
+}
+
+// PoolClass is a set of pools workloads of any allowed tenant share. Its
+// pools must not be labeled status=available, so that they are never
+// assigned to a namespace.
+type PoolClass struct {
+	// PoolSelector is an IPPool label selector picking the class's pools;
+	// only those in this zone are used.
+	PoolSelector string `json:"poolSelector"`
+}
+
+// SelectionRule is a CEL expression evaluating to a bool, over the variables
+// namespaceObject, with name, labels and annotations, and pool, with name,
+// cidr and labels; "namespace" is reserved in CEL, so the namespace is named
+// as in Kubernetes' own CEL policies. As every rule applies to every
+// namespace, a rule for some of them is written as an implication, e.g.
+// "namespaceObject.labels['env'] != 'prod' || pool.labels['tier'] == 'premium'".
+// A rule failing to evaluate, e.g. on a missing label, does not hold.
+type SelectionRule struct {
+	// Name identifies the rule in logs.
+	Name       string `json:"name"`
+	Expression string `json:"expression"`
+}
+
+// ReservedRange is a range at the start or end of a pool, e.g. for gateways
+// or load balancer addresses.
+type ReservedRange struct {
+	// Position is "first" for the start of the pool or "last" for its end.
+	Position string `json:"position"`
+	// PrefixLength is the size of the range, e.g. 30 for four addresses. A
+	// pool not larger than the range gets no reservation.
+	PrefixLength int `json:"prefixLength"`
+}
+
+const (
+	ReservedFirst = "first"
+	ReservedLast  = "last"
+)
+
+// Validate checks the range's fields.
+func (r ReservedRange) Validate() error {
+	if r.Position != ReservedFirst && r.Position != ReservedLast {
+		return fmt.Errorf("invalid reserved range position %q: must be %q or %q", r.Position, ReservedFirst, ReservedLast)
+	}
+	if r.PrefixLength < 1 || r.PrefixLength > 32 {
+		return fmt.Errorf("invalid reserved range prefix length /%d", r.PrefixLength)
+	}
+	return nil
+}
+
+// Selectors returns the tenant's parsed pool selectors, each narrowed to the
+// allowed zones.
+func (t Tenant) Selectors(name string) ([]labels.Selector, error) {
+	var zones labels.Requirements
+	if len(t.AllowedZones) > 0 {
+		zone, err := labels.NewRequirement("location", selection.In, t.AllowedZones)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowedZones %v for tenant %q: %v", t.AllowedZones, name, err)
+		}
+		zones = append(zones, *zone)
+	}
+	// Zones alone select every pool in them
+	if len(t.PoolSelectors) == 0 && len(zones) > 0 {
+		return []labels.Selector{labels.NewSelector().Add(zones...)}, nil
+	}
+	selectors := make([]labels.Selector, 0, len(t.PoolSelectors))
+	for _, s := range t.PoolSelectors {
+		selector, err := labels.Parse(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pool selector %q for tenant %q: %v", s, name, err)
+		}
+		selectors = append(selectors, selector.Add(zones...))
+	}
+	return selectors, nil
+}
+
+// Validate checks the tenant's cleanup policy, prefix length and selectors.
+func (t Tenant) Validate(name string) error {
+	if t.CleanupPolicy != "" && !validCleanupPolicy(t.CleanupPolicy) {
+		return fmt.Errorf("invalid cleanupPolicy %q for tenant %q", t.CleanupPolicy, name)
+	}
+	if t.DefaultPrefixLength < 0 || t.DefaultPrefixLength > 32 {
+		return fmt.Errorf("invalid defaultPrefixLength %d for tenant %q", t.DefaultPrefixLength, name)
+	}
+	for _, r := range t.Reservations {
+		if err := r.Validate(); err != nil {
+			return fmt.Errorf("tenant %q: %v", name, err)
+		}
+	}
+	_, err := t.Selectors(name)
+	return err
+}
+
+// Default returns the configuration used when no config file is given.
+func Default() *Config {
+	return &Config{
+		Location:       "zone-lhr",
+		TenantLabel:    "tenant",
+		Strategy:       StrategyName,
+		QuotaMode:      QuotaModeDeny,
+		AssignmentMode: AssignmentModeAdmission,
+		DriftMode:      DriftModeEnforce,
+		CleanupPolicy:  CleanupRecycle,
+		Operations: map[string][]string{
+			"Namespace": {"CREATE", "UPDATE", "DELETE"},
+		},
+		// Well past the longest chain of webhook timeouts a creation can sit in
+		ReservationTTLSeconds: 300,
+		ExemptNamespaces: Exemptions{
+			Names: []string{
+				"default",
+				"kube-system",
+				"kube-public",
+				"kube-node-lease",
+				"calico-system",
+				"calico-apiserver",
+				"tigera-operator",
+			},
+		},
+		CriticalNamespaces: Exemptions{
+			Names: []string{
+				"kube-system",
+				"kube-public",
+				"kube-node-lease",
+				"calico-system",
+				"calico-apiserver",
+				"tigera-operator",
+			},
+		},
+	}
+}
+
+// Load reads a JSON config file on top of the defaults. In strict mode unknown
+// fields are rejected instead of silently ignored.
+func Load(path string, strict bool) (*Config, error) {
+	cfg := Default()
+	if path == "" {
+		return cfg, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read config file: %v", err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if strict {
+		decoder.DisallowUnknownFields()
+	}
+	if err := decoder.Decode(cfg); err != nil {
+		return nil, fmt.Errorf("could not decode config file: %v", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Validate checks that every tenant and exemption selector parses and that
+// the strategy, quota mode, hierarchy and pool template settings are sane.
+func (c *Config) Validate() error {
+	if c.Strategy != StrategyName && c.Strategy != StrategyLowestCIDR {
+		return fmt.Errorf("invalid strategy %q: must be %q or %q", c.Strategy, StrategyName, StrategyLowestCIDR)
+	}
+	if c.QuotaMode != QuotaModeDeny && c.QuotaMode != QuotaModeWarn {
+		return fmt.Errorf("invalid quotaMode %q: must be %q or %q", c.QuotaMode, QuotaModeDeny, QuotaModeWarn)
+	}
+	if c.AssignmentMode != AssignmentModeAdmission && c.AssignmentMode != AssignmentModeClaim {
+		return fmt.Errorf("invalid assignmentMode %q: must be %q or %q", c.AssignmentMode, AssignmentModeAdmission, AssignmentModeClaim)
+	}
+	if c.DriftMode != DriftModeEnforce && c.DriftMode != DriftModeReport {
+		return fmt.Errorf("invalid driftMode %q: must be %q or %q", c.DriftMode, DriftModeEnforce, DriftModeReport)
+	}
+	for kind, operations := range c.Operations {
+		for _, op := range operations {
+			switch op {
+			case "CREATE", "UPDATE", "DELETE", "CONNECT":
+			default:
+				return fmt.Errorf("invalid operation %q for kind %q: must be CREATE, UPDATE, DELETE or CONNECT", op, kind)
+			}
+			if !slices.Contains(SupportedOperations[kind], op) {
+				return fmt.Errorf("invalid operation %s for kind %q: only %v are supported", op, kind, SupportedOperations[kind])
+			}
+		}
+	}
+	if !validCleanupPolicy(c.CleanupPolicy) {
+		return fmt.Errorf("invalid cleanupPolicy %q: must be %q, %q or %q", c.CleanupPolicy, CleanupRecycle, CleanupRetain, CleanupDelete)
+	}
+	for name, t := range c.Tenants {
+		if err := t.Validate(name); err != nil {
+			return err
+		}
+	}
+	if d := c.DNS; d != nil {
+		if d.InventoryDomain == "" && len(d.ReverseNameservers) == 0 {
+			return fmt.Errorf("dns: inventoryDomain or reverseNameservers is required")
+		}
+		if d.TTLSeconds < 0 {
+			return fmt.Errorf("invalid dns.ttlSeconds %d: must not be negative", d.TTLSeconds)
+		}
+	}
+	if capi := c.ClusterAPI; capi != nil {
+		if _, err := labels.Parse(capi.PoolSelector); err != nil || capi.PoolSelector == "" {
+			return fmt.Errorf("invalid clusterAPI.poolSelector %q: %v", capi.PoolSelector, err)
+		}
+		if capi.PodPrefixLength < 1 || capi.PodPrefixLength > 32 || capi.ServicePrefixLength < 1 || capi.ServicePrefixLength > 32 {
+			return fmt.Errorf("invalid clusterAPI prefix lengths /%d and /%d", capi.PodPrefixLength, capi.ServicePrefixLength)
+		}
+		if capi.Output != "" && capi.Output != ClusterAPIOutputSpec && capi.Output != ClusterAPIOutputConfigMap {
+			return fmt.Errorf("invalid clusterAPI.output %q: must be %q or %q", capi.Output, ClusterAPIOutputSpec, ClusterAPIOutputConfigMap)
+		}
+	}
+	for i, rule := range c.SelectionRules {
+		// Expressions are compiled at startup, see rules.New
+		if rule.Name == "" || rule.Expression == "" {
+			return fmt.Errorf("selectionRules[%d]: name and expression are required", i)
+		}
+	}
+	for name, class := range c.PoolClasses {
+		if class.PoolSelector == "" {
+			return fmt.Errorf("poolClasses.%s: poolSelector is required", name)
+		}
+		if _, err := labels.Parse(class.PoolSelector); err != nil {
+			return fmt.Errorf("invalid poolClasses.%s.poolSelector %q: %v", name, class.PoolSelector, err)
+		}
+	}
+	if h := c.Hierarchy; h != nil {
+		if h.MasterPool == "" {
+			return fmt.Errorf("hierarchy.masterPool is required")
+		}
+		if h.TeamPrefixLength < 1 || h.NamespacePrefixLength < h.TeamPrefixLength || h.NamespacePrefixLength > 32 {
+			return fmt.Errorf("invalid hierarchy prefix lengths /%d and /%d", h.TeamPrefixLength, h.NamespacePrefixLength)
+		}
+		for name, t := range c.Tenants {
+			if t.DefaultPrefixLength != 0 && t.DefaultPrefixLength < h.TeamPrefixLength {
+				return fmt.Errorf("invalid defaultPrefixLength /%d for tenant %q: larger than its /%d aggregate", t.DefaultPrefixLength, name, h.TeamPrefixLength)
+			}
+		}
+	}
+	for _, s := range c.ExemptNamespaces.Selectors {
+		if _, err := labels.Parse(s); err != nil {
+			return fmt.Errorf("invalid exemptNamespaces selector %q: %v", s, err)
+		}
+	}
+	for _, s := range c.CriticalNamespaces.Selectors {
+		if _, err := labels.Parse(s); err != nil {
+			return fmt.Errorf("invalid criticalNamespaces selector %q: %v", s, err)
+		}
+	}
+	if err := c.PoolTemplate.validate(); err != nil {
+		return fmt.Errorf("poolTemplate: %v", err)
+	}
+	for zone, t := range c.ZonePoolTemplates {
+		if err := t.validate(); err != nil {
+			return fmt.Errorf("zonePoolTemplates[%s]: %v", zone, err)
+		}
+	}
+	if c.ReservationTTLSeconds <= 0 {
+		return fmt.Errorf("invalid reservationTTLSeconds %d: must be positive", c.ReservationTTLSeconds)
+	}
+	if g := c.Growth; g != nil && (g.Threshold <= 0 || g.Threshold > 1) {
+		return fmt.Errorf("invalid growth.threshold %v: must be in (0, 1]", g.Threshold)
+	}
+	for _, r := range c.Reservations {
+		if err := r.Validate(); err != nil {
+			return err
+		}
+	}
+	if as := c.Autoscaling; as != nil {
+		if c.Hierarchy == nil {
+			return fmt.Errorf("autoscaling requires hierarchy, child pools are carved from tenant aggregates")
+		}
+		if as.Threshold <= 0 || as.Threshold > 1 {
+			return fmt.Errorf("invalid autoscaling.threshold %v: must be in (0, 1]", as.Threshold)
+		}
+		if as.MaxPools < 0 || as.MaxAddresses < 0 {
+			return fmt.Errorf("invalid autoscaling limits: maxPools and maxAddresses must not be negative")
+		}
+	}
+	if s := c.Splitter; s != nil {
+		if s.ChildPrefixLength < 1 || s.ChildPrefixLength > 32 {
+			return fmt.Errorf("invalid splitter.childPrefixLength /%d", s.ChildPrefixLength)
+		}
+		if s.MaxChildren < 0 || s.MaxChildren > MaxSplitChildren {
+			return fmt.Errorf("invalid splitter.maxChildren %d: must be between 0 and %d", s.MaxChildren, MaxSplitChildren)
+		}
+		for key := range s.Labels {
+			// The controller owns these
+			if key == "status" || key == "location" {
+				return fmt.Errorf("invalid splitter.labels: %q is set by the controller", key)
+			}
+		}
+	}
+	if p := c.NetworkPolicy; p != nil {
+		if p.Scope != NetworkPolicyGlobal && p.Scope != NetworkPolicyNamespaced {
+			return fmt.Errorf("invalid networkPolicy.scope %q: must be %q or %q", p.Scope, NetworkPolicyGlobal, NetworkPolicyNamespaced)
+		}
+		for _, t := range p.Types {
+			if t != "Ingress" && t != "Egress" {
+				return fmt.Errorf("invalid networkPolicy.types entry %q: must be Ingress or Egress", t)
+			}
+		}
+		for _, n := range p.AllowNets {
+			if _, err := netip.ParsePrefix(n); err != nil {
+				return fmt.Errorf("invalid networkPolicy.allowNets entry %q: %v", n, err)
+			}
+		}
+	}
+	if b := c.BGP; b != nil {
+		if b.Advertise != BGPAdvertiseExternalIPs && b.Advertise != BGPAdvertiseLoadBalancerIPs {
+			return fmt.Errorf("invalid bgp.advertise %q: must be %q or %q", b.Advertise, BGPAdvertiseExternalIPs, BGPAdvertiseLoadBalancerIPs)
+		}
+		for _, p := range b.Peers {
+			if p.Name == "" || p.ASNumber == 0 {
+				return fmt.Errorf("invalid bgp peer %q: name and asNumber are required", p.Name)
+			}
+			if _, err := netip.ParseAddr(p.PeerIP); err != nil {
+				return fmt.Errorf("invalid peerIP of bgp peer %q: %v", p.Name, err)
+			}
+		}
+	}
+	if r := c.Region; r != nil {
+		if _, err := r.Range(); err != nil {
+			return fmt.Errorf("region: %v", err)
+		}
+		if len(r.Peers) > 0 && (c.API == nil || r.TokenFile == "") {
+			return fmt.Errorf("region.peers require api and region.tokenFile")
+		}
+	}
+	if n := c.Notifications; n != nil {
+		if n.SMTP != nil && (n.SMTP.Addr == "" || n.SMTP.From == "") {
+			return fmt.Errorf("notifications.smtp: addr and from are required")
+		}
+		if n.Slack != nil && n.Slack.TokenFile == "" {
+			return fmt.Errorf("notifications.slack: tokenFile is required")
+		}
+	}
+	if len(c.Operations["Service"]) > 0 && c.ServiceLoadBalancer == nil {
+		return fmt.Errorf("operations on Service require serviceLoadBalancer")
+	}
+	if lb := c.ServiceLoadBalancer; lb != nil && lb.Field != "" && lb.Field != ServiceLBFieldLoadBalancerIP && lb.Field != ServiceLBFieldCalico {
+		return fmt.Errorf("invalid serviceLoadBalancer.field %q: must be %q or %q", lb.Field, ServiceLBFieldLoadBalancerIP, ServiceLBFieldCalico)
+	}
+	if cni := c.CNI; cni != nil && cni.Cilium != nil {
+		if m := cni.Cilium.MaskSize; m < 0 || m > 32 {
+			return fmt.Errorf("invalid cni.cilium.maskSize /%d", m)
+		}
+	}
+	if b := c.Backend; b != nil {
+		if c.Hierarchy != nil {
+			return fmt.Errorf("backend and hierarchy are exclusive, both are a source of namespace subnets")
+		}
+		set := 0
+		for _, backend := range []bool{b.Mock != nil, b.NetBox != nil, b.Infoblox != nil, b.Central != nil} {
+			if backend {
+				set++
+			}
+		}
+		if set != 1 {
+			return fmt.Errorf("backend: exactly one of mock, netbox, infoblox and central must be set")
+		}
+		if m := b.Mock; m != nil {
+			if len(m.Subnets) == 0 {
+				return fmt.Errorf("backend.mock: subnets are required")
+			}
+			for _, subnet := range m.Subnets {
+				if _, err := netip.ParsePrefix(subnet); err != nil {
+					return fmt.Errorf("invalid backend.mock.subnets entry %q: %v", subnet, err)
+				}
+			}
+		}
+		if n := b.NetBox; n != nil {
+			if n.URL == "" || n.TokenFile == "" {
+				return fmt.Errorf("backend.netbox: url and tokenFile are required")
+			}
+			parent, err := netip.ParsePrefix(n.ParentPrefix)
+			if err != nil {
+				return fmt.Errorf("invalid backend.netbox.parentPrefix %q: %v", n.ParentPrefix, err)
+			}
+			if n.PrefixLength <= parent.Bits() || n.PrefixLength > parent.Addr().BitLen() {
+				return fmt.Errorf("invalid backend.netbox.prefixLength /%d: must fit in %s", n.PrefixLength, n.ParentPrefix)
+			}
+		}
+		if ib := b.Infoblox; ib != nil {
+			if ib.URL == "" || ib.CredentialsDir == "" {
+				return fmt.Errorf("backend.infoblox: url and credentialsDir are required")
+			}
+			container, err := netip.ParsePrefix(ib.Container)
+			if err != nil {
+				return fmt.Errorf("invalid backend.infoblox.container %q: %v", ib.Container, err)
+			}
+			if ib.PrefixLength <= container.Bits() || ib.PrefixLength > container.Addr().BitLen() {
+				return fmt.Errorf("invalid backend.infoblox.prefixLength /%d: must fit in %s", ib.PrefixLength, ib.Container)
+			}
+		}
+		if c := b.Central; c != nil {
+			if c.Address == "" || c.TokenFile == "" {
+				return fmt.Errorf("backend.central: address and tokenFile are required")
+			}
+			if errs := validation.IsDNS1123Label(c.Cluster); len(errs) > 0 || len(c.Cluster) > MaxCentralClusterLength {
+				return fmt.Errorf("invalid backend.central.cluster %q: must be a DNS label of at most %d characters", c.Cluster, MaxCentralClusterLength)
+			}
+		}
+	}
+	if s := c.Sink; s != nil {
+		if s.Kafka == nil && s.NATS == nil && s.HTTP == nil {
+			return fmt.Errorf("sink: kafka, nats or http must be set")
+		}
+		if s.Kafka != nil && (len(s.Kafka.Brokers) == 0 || s.Kafka.Topic == "") {
+			return fmt.Errorf("sink.kafka: brokers and topic are required")
+		}
+		if s.NATS != nil && (s.NATS.URL == "" || s.NATS.Subject == "") {
+			return fmt.Errorf("sink.nats: url and subject are required")
+		}
+		if h := s.HTTP; h != nil {
+			if len(h.Requests) == 0 {
+				return fmt.Errorf("sink.http: requests are required")
+			}
+			for event, request := range h.Requests {
+				if event != "assigned" && event != "released" {
+					return fmt.Errorf("invalid sink.http.requests event %q: must be assigned or released", event)
+				}
+				if request.URL == "" {
+					return fmt.Errorf("sink.http.requests.%s: url is required", event)
+				}
+			}
+			if h.PasswordFile != "" && h.TokenFile != "" {
+				return fmt.Errorf("sink.http: passwordFile and tokenFile are exclusive")
+			}
+		}
+	}
+	if al := c.Alerts; al != nil {
+		if al.SlackWebhookURLFile == "" && al.WebhookURL == "" {
+			return fmt.Errorf("alerts: slackWebhookURLFile or webhookURL is required")
+		}
+		if al.CooldownSeconds < 0 {
+			return fmt.Errorf("invalid alerts.cooldownSeconds %d: must not be negative", al.CooldownSeconds)
+		}
+	}
+	if p := c.Policy; p != nil {
+		if p.URL == "" {
+			return fmt.Errorf("policy: url is required")
+		}
+		if p.TimeoutSeconds < 0 {
+			return fmt.Errorf("invalid policy.timeoutSeconds %d: must not be negative", p.TimeoutSeconds)
+		}
+	}
+	if c.API != nil && c.API.TokenFile == "" && !c.API.KubernetesAuth {
+		return fmt.Errorf("api: tokenFile or kubernetesAuth is required")
+	}
+	if c.API != nil && c.API.Audience != "" && !c.API.KubernetesAuth {
+		return fmt.Errorf("api.audience requires kubernetesAuth")
+	}
+	return nil
+}
+
+// LowPoolThresholdFor returns the early-warning threshold of a zone.
+func (c *Config) LowPoolThresholdFor(zone string) int {
+	if threshold, ok := c.ZoneLowPoolThresholds[zone]; ok {
+		return threshold
+	}
+	return c.LowPoolThreshold
+}
+
+// CleanupPolicyFor returns the cleanup policy of a tenant's child pools.
+func (c *Config) CleanupPolicyFor(tenant string) string {
+	if policy := c.Tenants[tenant].CleanupPolicy; policy != "" {
+		return policy
+	}
+	return c.CleanupPolicy
+}
+
+// DeclaresReservations reports whether the config file reserves ranges of
+// assigned pools, globally or for one of its tenants.
+func (c *Config) DeclaresReservations() bool {
+	if len(c.Reservations) > 0 {
+		return true
+	}
+	for _, t := range c.Tenants {
+		if len(t.Reservations) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Handles reports whether the mutating webhook is configured to act on the
+// operation on the kind.
+func (c *Config) Handles(kind, operation string) bool {
+	return slices.Contains(c.Operations[kind], operation)
+}
+
+func validCleanupPolicy(policy string) bool {
+	return policy == CleanupRecycle || policy == CleanupRetain || policy == CleanupDelete
+}
+
+// TenantSelectors returns the parsed pool selectors of a tenant, or nil if the
+// tenant is not configured.
+func (c *Config) TenantSelectors(tenant string) ([]labels.Selector, error) {
+	t, ok := c.Tenants[tenant]
+	if !ok {
+		return nil, nil
+	}
+	return t.Selectors(tenant)
+}
+
+// selectionPolicy is the part of the config that decides which pool a
+// namespace gets. Settings such as notifications, alerts or loop thresholds
+// do not make an assignment outdated, so they are left out of the Hash.
+type selectionPolicy struct {
+	Location         string               `json:"location"`
+	TenantLabel      string               `json:"tenantLabel"`
+	Tenants          map[string]Tenant    `json:"tenants"`
+	PoolClasses      map[string]PoolClass `json:"poolClasses,omitempty"`
+	SelectionRules   []SelectionRule      `json:"selectionRules,omitempty"`
+	Strategy         string               `json:"strategy"`
+	QuotaMode        string               `json:"quotaMode"`
+	Hierarchy        *Hierarchy           `json:"hierarchy,omitempty"`
+	ExemptNamespaces Exemptions           `json:"exemptNamespaces"`
+	Reservations     []ReservedRange      `json:"reservations,omitempty"`
+	Region           *Region              `json:"region,omitempty"`
+	Backend          *Backend             `json:"backend,omitempty"`
+	Policy           *Policy              `json:"policy,omitempty"`
+}
+
+// Hash returns a short, stable fingerprint of the selection policy.
+// Namespaces are stamped with it so that assignments made under an older
+// policy can be found.
+func (c *Config) Hash() string {
+	// encoding/json sorts map keys, so equal policies marshal identically
+	data, err := json.Marshal(selectionPolicy{
+		Location:         c.Location,
+		TenantLabel:      c.TenantLabel,
+		Tenants:          c.Tenants,
+		PoolClasses:      c.PoolClasses,
+		SelectionRules:   c.SelectionRules,
+		Strategy:         c.Strategy,
+		QuotaMode:        c.QuotaMode,
+		Hierarchy:        c.Hierarchy,
+		ExemptNamespaces: c.ExemptNamespaces,
+		Reservations:     c.Reservations,
+		Region:           c.Region.split(),
+		Backend:          c.Backend,
+		Policy:           c.Policy,
+	})
+	if err != nil {
+		return "unknown"
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// split returns the region without its peers, which only sync state and do
+// not change how the supernet is split.
+func (r *Region) split() *Region {
+	if r == nil {
+		return nil
+	}
+	return &Region{Name: r.Name, Supernet: r.Supernet, Members: r.Members}
+}
+
+// Range returns the part of the supernet this region allocates from.
+func (r *Region) Range() (string, error) {
+	for i, member := range r.Members {
+		if member == r.Name {
+			return cidr.Partition(r.Supernet, len(r.Members), i)
+		}
+	}
+	return "", fmt.Errorf("region %q is not listed in members", r.Name)
+}
+
+// IsExempt reports whether a namespace is exempt from pool assignment.
+func (c *Config) IsExempt(name string, nsLabels map[string]string) bool {
+	return c.ExemptNamespaces.Matches(name, nsLabels)
+}
+
+// IsCritical reports whether a namespace is cluster-critical.
+func (c *Config) IsCritical(name string, nsLabels map[string]string) bool {
+	return c.CriticalNamespaces.Matches(name, nsLabels)
+}
+
+// Matches reports whether a namespace is selected by name or by labels.
+func (e Exemptions) Matches(name string, nsLabels map[string]string) bool {
+	for _, exempt := range e.Names {
+		if exempt == name {
+			return true
+		}
+	}
+	for _, s := range e.Selectors {
+		selector, err := labels.Parse(s)
+		if err != nil {
+			continue
+		}
+		if selector.Matches(labels.Set(nsLabels)) {
+			return true
+		}
+	}
+	return false
+}
+
+// PoolTemplateFor returns the global pool template with the zone's overrides
+// applied on top.
+func (c *Config) PoolTemplateFor(zone string) PoolTemplate {
+	t := c.PoolTemplate
+	override, ok := c.ZonePoolTemplates[zone]
+	if !ok {
+		return t
+	}
+	if override.IPIPMode != "" {
+		t.IPIPMode = override.IPIPMode
+	}
+	if override.VXLANMode != "" {
+		t.VXLANMode = override.VXLANMode
+	}
+	if override.NATOutgoing != nil {
+		t.NATOutgoing = override.NATOutgoing
+	}
+	if override.BlockSize != 0 {
+		t.BlockSize = override.BlockSize
+	}
+	if override.DisableBGPExport != nil {
+		t.DisableBGPExport = override.DisableBGPExport
+	}
+	if override.AllowedUses != nil {
+		t.AllowedUses = override.AllowedUses
+	}
+	if override.NodeSelector != "" {
+		t.NodeSelector = override.NodeSelector
+	}
+	return t
+}
+
+func (t PoolTemplate) validate() error {
+	encapModes := map[string]bool{"": true, "Never": true, "Always": true, "CrossSubnet": true}
+	if !encapModes[t.IPIPMode] {
+		return fmt.Errorf("invalid ipipMode %q", t.IPIPMode)
+	}
+	if !encapModes[t.VXLANMode] {
+		return fmt.Errorf("invalid vxlanMode %q", t.VXLANMode)
+	}
+	if t.IPIPMode != "" && t.IPIPMode != "Never" && t.VXLANMode != "" && t.VXLANMode != "Never" {
+		return fmt.Errorf("ipipMode and vxlanMode cannot both be enabled")
+	}
+	if t.BlockSize != 0 && (t.BlockSize < 20 || t.BlockSize > 32) {
+		return fmt.Errorf("invalid blockSize %d: must be between 20 and 32", t.BlockSize)
+	}
+	for _, use := range t.AllowedUses {
+		if use != "Workload" && use != "Tunnel" {
+			return fmt.Errorf("invalid allowedUses entry %q", use)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(*Config)
+		wantErr string
+	}{
+		{name: "defaults", change: func(*Config) {}},
+		{name: "invalid strategy", change: func(c *Config) { c.Strategy = "random" }, wantErr: "invalid strategy"},
+		{name: "invalid quota mode", change: func(c *Config) { c.QuotaMode = "ignore" }, wantErr: "invalid quotaMode"},
+		{name: "unknown operation", change: func(c *Config) { c.Operations["Namespace"] = []string{"PATCH"} }, wantErr: "invalid operation"},
+		{name: "unsupported operation", change: func(c *Config) { c.Operations["Namespace"] = []string{"CONNECT"} }, wantErr: "only"},
+		{name: "invalid cleanup policy", change: func(c *Config) { c.CleanupPolicy = "shred" }, wantErr: "invalid cleanupPolicy"},
+		{
+			name:    "invalid tenant selector",
+			change:  func(c *Config) { c.Tenants = map[string]Tenant{"team-a": {PoolSelectors: []string{"team in (a"}}} },
+			wantErr: "team-a",
+		},
+		{
+			name: "hierarchy",
+			change: func(c *Config) {
+				c.Hierarchy = &Hierarchy{MasterPool: "master", TeamPrefixLength: 22, NamespacePrefixLength: 26}
+			},
+		},
+		{
+			name:    "hierarchy without master",
+			change:  func(c *Config) { c.Hierarchy = &Hierarchy{TeamPrefixLength: 22, NamespacePrefixLength: 26} },
+			wantErr: "hierarchy.masterPool is required",
+		},
+		{
+			name: "hierarchy namespace larger than team",
+			change: func(c *Config) {
+				c.Hierarchy = &Hierarchy{MasterPool: "master", TeamPrefixLength: 22, NamespacePrefixLength: 20}
+			},
+			wantErr: "invalid hierarchy prefix lengths",
+		},
+		{name: "invalid exemption selector", change: func(c *Config) { c.ExemptNamespaces.Selectors = []string{"=="} }, wantErr: "invalid exemptNamespaces selector"},
+		{name: "non-positive reservation TTL", change: func(c *Config) { c.ReservationTTLSeconds = 0 }, wantErr: "invalid reservationTTLSeconds"},
+		{name: "growth threshold above one", change: func(c *Config) { c.Growth = &Growth{Threshold: 1.5} }, wantErr: "invalid growth.threshold"},
+		{name: "autoscaling without hierarchy", change: func(c *Config) { c.Autoscaling = &Autoscaling{Threshold: 0.5} }, wantErr: "autoscaling requires hierarchy"},
+		{name: "splitter sets status", change: func(c *Config) {
+			c.Splitter = &Splitter{ChildPrefixLength: 26, Labels: map[string]string{"status": "x"}}
+		}, wantErr: "set by the controller"},
+		{name: "splitter child too long", change: func(c *Config) { c.Splitter = &Splitter{ChildPrefixLength: 33} }, wantErr: "invalid splitter.childPrefixLength"},
+		{name: "Service operations without load balancer", change: func(c *Config) { c.Operations["Service"] = []string{"CREATE"} }, wantErr: "require serviceLoadBalancer"},
+		{name: "policy without URL", change: func(c *Config) { c.Policy = &Policy{} }, wantErr: "policy: url is required"},
+		{name: "API without authentication", change: func(c *Config) { c.API = &API{} }, wantErr: "api: tokenFile or kubernetesAuth is required"},
+		{name: "API with Kubernetes authentication", change: func(c *Config) { c.API = &API{KubernetesAuth: true} }},
+		{name: "API audience without Kubernetes authentication", change: func(c *Config) { c.API = &API{TokenFile: "/token", Audience: "ipam"} }, wantErr: "api.audience requires kubernetesAuth"},
+		{name: "API audience", change: func(c *Config) { c.API = &API{KubernetesAuth: true, Audience: "ipam"} }},
+		{
+			name: "region peers without API",
+			change: func(c *Config) {
+				c.Region = &Region{Name: "eu", Supernet: "10.0.0.0/8", Members: []string{"eu", "us"}, Peers: map[string]string{"us": "https://us"}, TokenFile: "/token"}
+			},
+			wantErr: "region.peers require api",
+		},
+		{
+			name: "region peers",
+			change: func(c *Config) {
+				c.API = &API{KubernetesAuth: true}
+				c.Region = &Region{Name: "eu", Supernet: "10.0.0.0/8", Members: []string{"eu", "us"}, Peers: map[string]string{"us": "https://us"}, TokenFile: "/token"}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := Default()
+			tt.change(c)
+			err := c.Validate()
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case tt.wantErr != "" && err == nil:
+				t.Fatalf("got no error, want %q", tt.wantErr)
+			case tt.wantErr != "" && !strings.Contains(err.Error(), tt.wantErr):
+				t.Fatalf("got %q, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestHash(t *testing.T) {
+	base := Default().Hash()
+	tests := []struct {
+		name        string
+		change      func(*Config)
+		wantChanged bool
+	}{
+		{name: "strategy", change: func(c *Config) { c.Strategy = StrategyLowestCIDR }, wantChanged: true},
+		{name: "tenant selectors", change: func(c *Config) { c.Tenants = map[string]Tenant{"team-a": {PoolSelectors: []string{"team == a"}}} }, wantChanged: true},
+		{name: "exemptions", change: func(c *Config) { c.ExemptNamespaces.Names = append(c.ExemptNamespaces.Names, "tools") }, wantChanged: true},
+		{name: "notifications", change: func(c *Config) { c.Notifications = &Notifications{DefaultLocale: "de"} }},
+		{name: "low pool threshold", change: func(c *Config) { c.LowPoolThreshold++ }},
+		{name: "reservation TTL", change: func(c *Config) { c.ReservationTTLSeconds++ }},
+		{name: "API", change: func(c *Config) { c.API = &API{KubernetesAuth: true} }},
+		{name: "region", change: func(c *Config) {
+			c.Region = &Region{Name: "eu", Supernet: "10.0.0.0/8", Members: []string{"eu", "us"}}
+		}, wantChanged: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := Default()
+			tt.change(c)
+			if changed := c.Hash() != base; changed != tt.wantChanged {
+				t.Errorf("hash changed: %v, want %v", changed, tt.wantChanged)
+			}
+		})
+	}
+
+	withPeers := Default()
+	withPeers.Region = &Region{Name: "eu", Supernet: "10.0.0.0/8", Members: []string{"eu", "us"}}
+	before := withPeers.Hash()
+	withPeers.Region.Peers = map[string]string{"us": "https://us"}
+	withPeers.Region.TokenFile = "/token"
+	if withPeers.Hash() != before {
+		t.Error("region peers changed the hash")
+	}
+}
@@ -0,0 +1,57 @@
+package notify
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"admission-controller-03/pkg/config"
+)
+
+// New builds an owner notifier from the config, reading any credentials from
+// their mounted files. Every template is parsed up front so that a broken
+// override fails at startup rather than on the first assignment.
+func New(logger *zap.Logger, cfg *config.Notifications) (*OwnerNotifier, error) {
+	senders := map[string]Sender{}
+	if cfg.SMTP != nil {
+		sender := &SMTPSender{Addr: cfg.SMTP.Addr, From: cfg.SMTP.From, Username: cfg.SMTP.Username}
+		if cfg.SMTP.PasswordFile != "" {
+			password, err := os.ReadFile(cfg.SMTP.PasswordFile)
+			if err != nil {
+				return nil, fmt.Errorf("could not read SMTP password: %v", err)
+			}
+			sender.Password = strings.TrimSpace(string(password))
+		}
+		senders["email"] = sender
+	}
+	if cfg.Slack != nil {
+		token, err := os.ReadFile(cfg.Slack.TokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read Slack token: %v", err)
+		}
+		senders["slack"] = &SlackSender{Token: strings.TrimSpace(string(token)), APIURL: cfg.Slack.APIURL}
+	}
+
+	overrides := map[string]map[Event]Template{}
+	for locale, events := range cfg.Templates {
+		overrides[locale] = map[Event]Template{}
+		for event, t := range events {
+			overrides[locale][Event(event)] = Template{Subject: t.Subject, Body: t.Body}
+		}
+	}
+
+	n := NewOwnerNotifier(logger, cfg.DefaultLocale, overrides, senders)
+	for locale, events := range n.Templates {
+		for event, t := range events {
+			if _, err := render(t.Subject, Message{}); err != nil {
+				return nil, fmt.Errorf("invalid %s subject template for event %s: %v", locale, event, err)
+			}
+			if _, err := render(t.Body, Message{}); err != nil {
+				return nil, fmt.Errorf("invalid %s body template for event %s: %v", locale, event, err)
+			}
+		}
+	}
+	return n, nil
+}
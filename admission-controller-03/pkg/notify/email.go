@@ -0,0 +1,30 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	"net/smtp"
+	"strings"
+)
+
+// SMTPSender delivers notifications by email.
+type SMTPSender struct {
+	Addr     string
+	From     string
+	Username string
+	Password string
+}
+
+func (s *SMTPSender) Send(ctx context.Context, to Contact, subject, body string) error {
+	var auth smtp.Auth
+	if s.Username != "" {
+		host := s.Addr
+		if i := strings.LastIndex(host, ":"); i >= 0 {
+			host = host[:i]
+		}
+		auth = smtp.PlainAuth("", s.Username, s.Password, host)
+	}
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n%s\r\n",
+		s.From, to.Address, subject, body)
+	return smtp.SendMail(s.Addr, auth, s.From, []string{to.Address}, []byte(msg))
+}
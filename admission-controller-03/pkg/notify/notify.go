@@ -0,0 +1,171 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// OwnerContactAnnotation on a namespace names who to notify, either an
+	// email address or a Slack handle such as @jane or slack:#team-net.
+	OwnerContactAnnotation = "ipam.example.com/owner-contact"
+	// OwnerLocaleAnnotation selects the language of owner notifications.
+	OwnerLocaleAnnotation = "ipam.example.com/owner-locale"
+)
+
+// Event is the allocation lifecycle step a notification is about.
+type Event string
+
+const (
+	EventAssigned Event = "assigned"
+	// EventTTLExpiring is sent when half the reservation TTL of a pool
+	// reserved for a namespace has passed and the namespace still does not
+	// exist; the pool is handed back once the TTL expires.
+	EventTTLExpiring Event = "ttl-expiring"
+	// EventForcedRotation is sent when an operator cordons the pool a
+	// namespace holds, the first step of rotating it off a range being
+	// retired. The namespace keeps the pool until it is moved.
+	EventForcedRotation Event = "forced-rotation"
+)
+
+// Message carries everything a notification template may refer to.
+type Message struct {
+	Event     Event
+	Namespace string
+	Pool      string
+	CIDR      string
+	Tenant    string
+	Expires   time.Time
+	Contact   Contact
+	Locale    string
+}
+
+// Contact is a parsed owner contact.
+type Contact struct {
+	Kind    string // "email" or "slack"
+	Address string
+}
+
+// ParseContact accepts "jane@example.com", "mailto:jane@example.com",
+// "@jane", "slack:@jane" or "slack:#team-net".
+func ParseContact(value string) (Contact, error) {
+	value = strings.TrimSpace(value)
+	switch {
+	case strings.HasPrefix(value, "mailto:"):
+		return Contact{Kind: "email", Address: strings.TrimPrefix(value, "mailto:")}, nil
+	case strings.HasPrefix(value, "slack:"):
+		return Contact{Kind: "slack", Address: strings.TrimPrefix(value, "slack:")}, nil
+	case strings.HasPrefix(value, "@"):
+		return Contact{Kind: "slack", Address: value}, nil
+	case strings.Contains(value, "@"):
+		return Contact{Kind: "email", Address: value}, nil
+	}
+	return Contact{}, fmt.Errorf("unrecognised owner contact %q", value)
+}
+
+// Sender delivers a rendered notification to one kind of contact.
+type Sender interface {
+	Send(ctx context.Context, to Contact, subject, body string) error
+}
+
+// Template is the subject and body of one notification, in text/template
+// syntax over Message.
+type Template struct {
+	Subject string `json:"subject"`
+	Body    string `json:"body"`
+}
+
+// OwnerNotifier renders localized templates and routes the result to the
+// sender matching the owner's contact kind.
+type OwnerNotifier struct {
+	Senders       map[string]Sender
+	Templates     map[string]map[Event]Template
+	DefaultLocale string
+	Logger        *zap.Logger
+}
+
+// NewOwnerNotifier starts from the built-in templates and lays the given
+// overrides, keyed by locale and event, on top.
+func NewOwnerNotifier(logger *zap.Logger, defaultLocale string, overrides map[string]map[Event]Template, senders map[string]Sender) *OwnerNotifier {
+	templates := map[string]map[Event]Template{}
+	for locale, events := range defaultTemplates {
+		templates[locale] = map[Event]Template{}
+		for event, t := range events {
+			templates[locale][event] = t
+		}
+	}
+	for locale, events := range overrides {
+		if templates[locale] == nil {
+			templates[locale] = map[Event]Template{}
+		}
+		for event, t := range events {
+			templates[locale][event] = t
+		}
+	}
+	if defaultLocale == "" {
+		defaultLocale = "en"
+	}
+	return &OwnerNotifier{
+		Senders:       senders,
+		Templates:     templates,
+		DefaultLocale: defaultLocale,
+		Logger:        logger,
+	}
+}
+
+// Notify renders and sends a message to its owner contact.
+func (n *OwnerNotifier) Notify(ctx context.Context, msg Message) error {
+	sender, ok := n.Senders[msg.Contact.Kind]
+	if !ok {
+		return fmt.Errorf("no sender configured for %s contacts", msg.Contact.Kind)
+	}
+
+	t, ok := n.template(msg.Locale, msg.Event)
+	if !ok {
+		return fmt.Errorf("no template for event %s", msg.Event)
+	}
+	subject, err := render(t.Subject, msg)
+	if err != nil {
+		return fmt.Errorf("could not render subject: %v", err)
+	}
+	body, err := render(t.Body, msg)
+	if err != nil {
+		return fmt.Errorf("could not render body: %v", err)
+	}
+
+	if err := sender.Send(ctx, msg.Contact, subject, body); err != nil {
+		return fmt.Errorf("could not notify %s: %v", msg.Contact.Address, err)
+	}
+	n.Logger.Info("Notified namespace owner",
+		zap.String("event", string(msg.Event)),
+		zap.String("namespace", msg.Namespace),
+		zap.String("contact", msg.Contact.Address))
+	return nil
+}
+
+// template falls back from the requested locale to the default one.
+func (n *OwnerNotifier) template(locale string, event Event) (Template, bool) {
+	if t, ok := n.Templates[locale][event]; ok {
+		return t, true
+	}
+	t, ok := n.Templates[n.DefaultLocale][event]
+	return t, ok
+}
+
+func render(text string, msg Message) (string, error) {
+	t, err := template.New("notification").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, msg); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,63 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const slackPostMessageURL = "https://slack.com/api/chat.postMessage"
+
+// SlackSender delivers notifications to a Slack user or channel through the
+// chat.postMessage API.
+type SlackSender struct {
+	Token  string
+	APIURL string
+	Client *http.Client
+}
+
+func (s *SlackSender) Send(ctx context.Context, to Contact, subject, body string) error {
+	payload, err := json.Marshal(map[string]string{
+		"channel": to.Address,
+		"text":    fmt.Sprintf("*%s*\n%s", subject, body),
+	})
+	if err != nil {
+		return err
+	}
+
+	url := s.APIURL
+	if url == "" {
+		url = slackPostMessageURL
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	req.Header.Set("Authorization", "Bearer "+s.Token)
+
+	client := s.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		OK    bool   `json:"ok"`
+		Error string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("could not decode Slack response: %v", err)
+	}
+	if !result.OK {
+		return fmt.Errorf("slack API error: %s", result.Error)
+	}
+	return nil
+}
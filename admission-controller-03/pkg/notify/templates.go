@@ -0,0 +1,32 @@
+package notify
+
+var defaultTemplates = map[string]map[Event]Template{
+	"en": {
+		EventAssigned: {
+			Subject: "IP pool {{.Pool}} assigned to namespace {{.Namespace}}",
+			Body:    "Namespace {{.Namespace}} was assigned IP pool {{.Pool}}{{if .CIDR}} ({{.CIDR}}){{end}}.",
+		},
+		EventTTLExpiring: {
+			Subject: "IP pool reservation of namespace {{.Namespace}} expires soon",
+			Body:    "IP pool {{.Pool}} is reserved for namespace {{.Namespace}}, which has not been created. The reservation expires at {{.Expires.Format \"2006-01-02 15:04 MST\"}}.",
+		},
+		EventForcedRotation: {
+			Subject: "IP pool of namespace {{.Namespace}} is cordoned",
+			Body:    "IP pool {{.Pool}} of namespace {{.Namespace}} was cordoned ahead of retiring its range and is no longer assigned. The namespace keeps its addresses until it is moved to a new pool.",
+		},
+	},
+	"de": {
+		EventAssigned: {
+			Subject: "IP-Pool {{.Pool}} dem Namespace {{.Namespace}} zugewiesen",
+			Body:    "Dem Namespace {{.Namespace}} wurde der IP-Pool {{.Pool}}{{if .CIDR}} ({{.CIDR}}){{end}} zugewiesen.",
+		},
+		EventTTLExpiring: {
+			Subject: "IP-Pool-Reservierung des Namespace {{.Namespace}} läuft bald ab",
+			Body:    "Der IP-Pool {{.Pool}} ist für den Namespace {{.Namespace}} reserviert, der nicht angelegt wurde. Die Reservierung läuft am {{.Expires.Format \"02.01.2006 15:04 MST\"}} ab.",
+		},
+		EventForcedRotation: {
+			Subject: "IP-Pool des Namespace {{.Namespace}} ist gesperrt",
+			Body:    "Der IP-Pool {{.Pool}} des Namespace {{.Namespace}} wurde vor der Stilllegung seines Bereichs gesperrt und wird nicht mehr zugewiesen. Der Namespace behält seine Adressen, bis er in einen neuen Pool umgezogen wird.",
+		},
+	},
+}
@@ -0,0 +1,17 @@
+package policy
+
+import (
+	"net/http"
+	"time"
+
+	"admission-controller-03/pkg/config"
+)
+
+// New builds a policy client from the config.
+func New(cfg *config.Policy) *Client {
+	timeout := DefaultTimeout
+	if cfg.TimeoutSeconds > 0 {
+		timeout = time.Duration(cfg.TimeoutSeconds) * time.Second
+	}
+	return &Client{URL: cfg.URL, Client: &http.Client{Timeout: timeout}}
+}
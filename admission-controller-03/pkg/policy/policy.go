@@ -0,0 +1,86 @@
+package policy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DefaultTimeout bounds one evaluation. It runs on the admission path, so it
+// is kept well below the API server's webhook timeout.
+const DefaultTimeout = 2 * time.Second
+
+// Input is the candidate assignment a policy decides on, posted to OPA as
+// the input document.
+type Input struct {
+	Namespace       string            `json:"namespace"`
+	NamespaceLabels map[string]string `json:"namespaceLabels"`
+	Tenant          string            `json:"tenant"`
+	Pool            string            `json:"pool"`
+	CIDR            string            `json:"cidr"`
+	Zone            string            `json:"zone"`
+	// Requested is set when the namespace asked for the pool itself rather
+	// than having it selected.
+	Requested bool `json:"requested"`
+}
+
+// Decision is the verdict of a policy: the candidate is allowed as is,
+// allowed with another pool in its place, or denied.
+type Decision struct {
+	Allow bool `json:"allow"`
+	// Pool, when set on an allowed decision, overrides the candidate pool.
+	Pool string `json:"pool,omitempty"`
+	// Reason explains a denial to the user.
+	Reason string `json:"reason,omitempty"`
+}
+
+// Client evaluates a policy through OPA's Data API, e.g. of a sidecar at
+// http://localhost:8181/v1/data/ipam/allocation. The policy's document must
+// be an object with the fields of Decision; an undefined document is an
+// error, so that a policy that failed to load never allows by default.
+type Client struct {
+	URL    string
+	Client *http.Client
+}
+
+// Evaluate posts the input to OPA and returns its decision.
+func (c *Client) Evaluate(ctx context.Context, input Input) (Decision, error) {
+	body, err := json.Marshal(map[string]interface{}{"input": input})
+	if err != nil {
+		return Decision{}, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.URL, bytes.NewReader(body))
+	if err != nil {
+		return Decision{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := c.Client
+	if client == nil {
+		client = &http.Client{Timeout: DefaultTimeout}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return Decision{}, fmt.Errorf("could not query OPA: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return Decision{}, fmt.Errorf("OPA answered %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	var response struct {
+		Result *Decision `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return Decision{}, fmt.Errorf("could not decode OPA response: %v", err)
+	}
+	if response.Result == nil {
+		return Decision{}, fmt.Errorf("policy document at %s is undefined", c.URL)
+	}
+	return *response.Result, nil
+}
@@ -0,0 +1,117 @@
+package region
+
+import (
+	"sort"
+	"sync"
+
+	cidrpkg "admission-controller-03/pkg/cidr"
+)
+
+// Entry is one pool of the shared supernet as last reported by the region
+// that owns its range.
+type Entry struct {
+	CIDR    string `json:"cidr"`
+	Pool    string `json:"pool"`
+	Status  string `json:"status"`
+	Tenant  string `json:"tenant,omitempty"`
+	Region  string `json:"region"`
+	Version uint64 `json:"version"`
+	Deleted bool   `json:"deleted,omitempty"`
+}
+
+// State is a last-writer-wins map of entries keyed by CIDR. Only the owning
+// region ever bumps an entry's version, and regions own disjoint ranges, so
+// merges commute and every replica converges on the same view regardless of
+// the order syncs happen in.
+type State struct {
+	mu      sync.RWMutex
+	entries map[string]Entry
+}
+
+func NewState() *State {
+	return &State{entries: map[string]Entry{}}
+}
+
+// Observe records the current pools of the local region. Changed entries get
+// a new version; pools that disappeared are kept as tombstones so that the
+// deletion propagates.
+func (s *State) Observe(local string, current []Entry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	seen := map[string]bool{}
+	for _, e := range current {
+		seen[e.CIDR] = true
+		e.Region = local
+		old, ok := s.entries[e.CIDR]
+		if ok && old.Region == local && !old.Deleted && old.Pool == e.Pool && old.Status == e.Status && old.Tenant == e.Tenant {
+			continue
+		}
+		e.Version = old.Version + 1
+		s.entries[e.CIDR] = e
+	}
+	for key, old := range s.entries {
+		if old.Region == local && !old.Deleted && !seen[key] {
+			old.Deleted = true
+			old.Version++
+			s.entries[key] = old
+		}
+	}
+}
+
+// Merge folds entries received from a peer into the state and returns the
+// number that changed it.
+func (s *State) Merge(remote []Entry) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	changed := 0
+	for _, e := range remote {
+		old, ok := s.entries[e.CIDR]
+		if ok && !newer(e, old) {
+			continue
+		}
+		s.entries[e.CIDR] = e
+		changed++
+	}
+	return changed
+}
+
+// Snapshot returns all entries, tombstones included, ordered by CIDR.
+func (s *State) Snapshot() []Entry {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entries := make([]Entry, 0, len(s.entries))
+	for _, e := range s.entries {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].CIDR < entries[j].CIDR })
+	return entries
+}
+
+// Claimed returns an entry of another region than local, not deleted, that
+// overlaps the CIDR, if there is one.
+func (s *State) Claimed(local, cidr string) (Entry, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, e := range s.entries {
+		if e.Region == local || e.Deleted {
+			continue
+		}
+		if overlaps, err := cidrpkg.Overlaps(e.CIDR, cidr); err == nil && overlaps {
+			return e, true
+		}
+	}
+	return Entry{}, false
+}
+
+// newer orders two versions of an entry; the region name breaks ties so that
+// a misconfigured overlap still resolves the same way everywhere.
+func newer(a, b Entry) bool {
+	if a.Version != b.Version {
+		return a.Version > b.Version
+	}
+	return a.Region > b.Region
+}
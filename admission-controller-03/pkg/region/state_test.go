@@ -0,0 +1,153 @@
+package region
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestObserve(t *testing.T) {
+	tests := []struct {
+		name   string
+		rounds [][]Entry
+		want   []Entry
+	}{
+		{
+			name:   "new pools get the first version",
+			rounds: [][]Entry{{{CIDR: "10.0.0.0/26", Pool: "a", Status: "available"}}},
+			want:   []Entry{{CIDR: "10.0.0.0/26", Pool: "a", Status: "available", Region: "eu", Version: 1}},
+		},
+		{
+			name: "unchanged pools keep their version",
+			rounds: [][]Entry{
+				{{CIDR: "10.0.0.0/26", Pool: "a", Status: "available"}},
+				{{CIDR: "10.0.0.0/26", Pool: "a", Status: "available"}},
+			},
+			want: []Entry{{CIDR: "10.0.0.0/26", Pool: "a", Status: "available", Region: "eu", Version: 1}},
+		},
+		{
+			name: "changed pools get a new version",
+			rounds: [][]Entry{
+				{{CIDR: "10.0.0.0/26", Pool: "a", Status: "available"}},
+				{{CIDR: "10.0.0.0/26", Pool: "a", Status: "used", Tenant: "team-a"}},
+			},
+			want: []Entry{{CIDR: "10.0.0.0/26", Pool: "a", Status: "used", Tenant: "team-a", Region: "eu", Version: 2}},
+		},
+		{
+			name: "deleted pools become tombstones",
+			rounds: [][]Entry{
+				{{CIDR: "10.0.0.0/26", Pool: "a", Status: "available"}},
+				nil,
+				nil,
+			},
+			want: []Entry{{CIDR: "10.0.0.0/26", Pool: "a", Status: "available", Region: "eu", Version: 2, Deleted: true}},
+		},
+		{
+			name: "recreated pools outversion their tombstone",
+			rounds: [][]Entry{
+				{{CIDR: "10.0.0.0/26", Pool: "a", Status: "available"}},
+				nil,
+				{{CIDR: "10.0.0.0/26", Pool: "b", Status: "available"}},
+			},
+			want: []Entry{{CIDR: "10.0.0.0/26", Pool: "b", Status: "available", Region: "eu", Version: 3}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewState()
+			for _, current := range tt.rounds {
+				s.Observe("eu", current)
+			}
+			if got := s.Snapshot(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestObserveLeavesPeerEntries(t *testing.T) {
+	s := NewState()
+	peer := Entry{CIDR: "10.1.0.0/26", Pool: "p", Status: "used", Region: "us", Version: 4}
+	s.Merge([]Entry{peer})
+	s.Observe("eu", nil)
+	if got := s.Snapshot(); !reflect.DeepEqual(got, []Entry{peer}) {
+		t.Errorf("got %+v, want the peer's entry untouched", got)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	local := Entry{CIDR: "10.0.0.0/26", Pool: "a", Status: "used", Region: "eu", Version: 3}
+	tests := []struct {
+		name        string
+		remote      []Entry
+		wantChanged int
+		want        []Entry
+	}{
+		{name: "older version is ignored", remote: []Entry{{CIDR: local.CIDR, Pool: "x", Region: "eu", Version: 2}}, want: []Entry{local}},
+		{name: "same entry is ignored", remote: []Entry{local}, want: []Entry{local}},
+		{
+			name:        "newer version wins",
+			remote:      []Entry{{CIDR: local.CIDR, Pool: "a", Status: "available", Region: "eu", Version: 4}},
+			wantChanged: 1,
+			want:        []Entry{{CIDR: local.CIDR, Pool: "a", Status: "available", Region: "eu", Version: 4}},
+		},
+		{
+			name:        "region breaks version ties",
+			remote:      []Entry{{CIDR: local.CIDR, Pool: "b", Region: "us", Version: 3}},
+			wantChanged: 1,
+			want:        []Entry{{CIDR: local.CIDR, Pool: "b", Region: "us", Version: 3}},
+		},
+		{name: "losing region of a tie is ignored", remote: []Entry{{CIDR: local.CIDR, Pool: "b", Region: "ap", Version: 3}}, want: []Entry{local}},
+		{
+			name:        "new entries are added in CIDR order",
+			remote:      []Entry{{CIDR: "10.9.0.0/26", Region: "us", Version: 1}, {CIDR: "10.1.0.0/26", Region: "us", Version: 1}},
+			wantChanged: 2,
+			want:        []Entry{local, {CIDR: "10.1.0.0/26", Region: "us", Version: 1}, {CIDR: "10.9.0.0/26", Region: "us", Version: 1}},
+		},
+		{
+			name:        "tombstones propagate",
+			remote:      []Entry{{CIDR: local.CIDR, Pool: "a", Status: "used", Region: "eu", Version: 4, Deleted: true}},
+			wantChanged: 1,
+			want:        []Entry{{CIDR: local.CIDR, Pool: "a", Status: "used", Region: "eu", Version: 4, Deleted: true}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewState()
+			s.Merge([]Entry{local})
+			if changed := s.Merge(tt.remote); changed != tt.wantChanged {
+				t.Errorf("changed %d, want %d", changed, tt.wantChanged)
+			}
+			if got := s.Snapshot(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClaimed(t *testing.T) {
+	s := NewState()
+	s.Merge([]Entry{
+		{CIDR: "10.0.0.0/26", Pool: "eu-a", Region: "eu", Version: 1},
+		{CIDR: "10.1.0.0/26", Pool: "us-a", Region: "us", Version: 1},
+		{CIDR: "10.2.0.0/26", Pool: "us-b", Region: "us", Version: 2, Deleted: true},
+	})
+	tests := []struct {
+		cidr string
+		want string
+	}{
+		{cidr: "10.0.0.0/26"},
+		{cidr: "10.1.0.0/26", want: "us-a"},
+		{cidr: "10.1.0.0/24", want: "us-a"},
+		{cidr: "10.1.0.32/27", want: "us-a"},
+		{cidr: "10.2.0.0/26"},
+		{cidr: "10.3.0.0/26"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.cidr, func(t *testing.T) {
+			got, ok := s.Claimed("eu", tt.cidr)
+			if ok != (tt.want != "") || got.Pool != tt.want {
+				t.Errorf("got %q (%v), want %q", got.Pool, ok, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package region
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"admission-controller-03/pkg/cidr"
+)
+
+// SyncPath is where every region serves its state to its peers.
+const SyncPath = "/region/sync"
+
+// Syncer keeps a State up to date: it periodically observes the local pools
+// and pulls the state of every peer. Nothing on the admission hot path waits
+// for it; allocation consults the last merged State, and refuses local pools
+// that a peer reports.
+type Syncer struct {
+	Region string
+	// Range is the local region's part of the supernet.
+	Range  string
+	Peers  map[string]string
+	State  *State
+	Local  func(ctx context.Context) ([]Entry, error)
+	Client *http.Client
+	Logger *zap.Logger
+	// Token is the bearer token sent to peers, whose sync endpoint is
+	// authenticated like the rest of their API.
+	Token string
+}
+
+// Run syncs once per interval until ctx is done.
+func (s *Syncer) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		s.sync(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Syncer) sync(ctx context.Context) {
+	local, err := s.Local(ctx)
+	if err != nil {
+		s.Logger.Error("could not observe local pools for region sync", zap.Error(err))
+	} else {
+		s.State.Observe(s.Region, local)
+	}
+
+	for peer, url := range s.Peers {
+		remote, err := s.pull(ctx, url)
+		if err != nil {
+			s.Logger.Warn("could not pull region state", zap.String("peer", peer), zap.Error(err))
+			continue
+		}
+		for _, e := range remote {
+			if e.Region != s.Region && cidr.Contains(s.Range, e.CIDR) {
+				s.Logger.Warn("Region conflict: peer reports a pool inside the local range, it is not allocated here",
+					zap.String("peer", peer), zap.String("cidr", e.CIDR), zap.String("pool", e.Pool))
+			}
+		}
+		if changed := s.State.Merge(remote); changed > 0 {
+			s.Logger.Info("Merged region state", zap.String("peer", peer), zap.Int("changed", changed))
+		}
+	}
+}
+
+func (s *Syncer) pull(ctx context.Context, baseURL string) ([]Entry, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(baseURL, "/")+SyncPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	if s.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.Token)
+	}
+	client := s.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	var entries []Entry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, fmt.Errorf("could not decode region state: %v", err)
+	}
+	return entries, nil
+}
+
+// HandleSync serves the full state, so peers also learn about regions they
+// cannot reach directly. It does not authenticate the caller; serve it
+// behind the webhook's API authentication.
+func (s *Syncer) HandleSync(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.State.Snapshot()); err != nil {
+		s.Logger.Error("could not encode region state", zap.Error(err))
+	}
+}
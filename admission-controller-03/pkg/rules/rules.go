@@ -0,0 +1,103 @@
+package rules
+
+import (
+	"fmt"
+
+	"github.com/google/cel-go/cel"
+
+	"admission-controller-03/pkg/config"
+)
+
+// costLimit bounds the evaluation of one rule, which runs for every candidate
+// pool on the admission path.
+const costLimit = 100000
+
+// Namespace and Pool are what rules see of a namespace and a pool.
+type (
+	Namespace struct {
+		Name        string
+		Labels      map[string]string
+		Annotations map[string]string
+	}
+	Pool struct {
+		Name   string
+		CIDR   string
+		Labels map[string]string
+	}
+)
+
+type rule struct {
+	name    string
+	program cel.Program
+}
+
+// Rules are compiled selection rules, see config.SelectionRule.
+type Rules struct {
+	rules []rule
+}
+
+// New compiles the rules of the config, so that a broken expression fails at
+// startup rather than on the first selection.
+func New(cfg []config.SelectionRule) (*Rules, error) {
+	env, err := cel.NewEnv(
+		cel.Variable("namespaceObject", cel.MapType(cel.StringType, cel.DynType)),
+		cel.Variable("pool", cel.MapType(cel.StringType, cel.DynType)),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("could not create CEL environment: %v", err)
+	}
+	r := &Rules{}
+	for _, c := range cfg {
+		ast, issues := env.Compile(c.Expression)
+		if issues != nil && issues.Err() != nil {
+			return nil, fmt.Errorf("invalid selection rule %s: %v", c.Name, issues.Err())
+		}
+		if ast.OutputType() != cel.BoolType && ast.OutputType() != cel.DynType {
+			return nil, fmt.Errorf("invalid selection rule %s: evaluates to %s, not bool", c.Name, ast.OutputType())
+		}
+		program, err := env.Program(ast, cel.CostLimit(costLimit))
+		if err != nil {
+			return nil, fmt.Errorf("invalid selection rule %s: %v", c.Name, err)
+		}
+		r.rules = append(r.rules, rule{name: c.Name, program: program})
+	}
+	return r, nil
+}
+
+// Match reports whether the pool satisfies every rule for the namespace. When
+// it does not, it returns the name of the first rule that does not hold, and
+// the error it failed to evaluate with, if any.
+func (r *Rules) Match(ns Namespace, pool Pool) (bool, string, error) {
+	if r == nil {
+		return true, "", nil
+	}
+	vars := map[string]interface{}{
+		"namespaceObject": map[string]interface{}{
+			"name":        ns.Name,
+			"labels":      nonNil(ns.Labels),
+			"annotations": nonNil(ns.Annotations),
+		},
+		"pool": map[string]interface{}{
+			"name":   pool.Name,
+			"cidr":   pool.CIDR,
+			"labels": nonNil(pool.Labels),
+		},
+	}
+	for _, rule := range r.rules {
+		out, _, err := rule.program.Eval(vars)
+		if err != nil {
+			return false, rule.name, err
+		}
+		if holds, ok := out.Value().(bool); !ok || !holds {
+			return false, rule.name, nil
+		}
+	}
+	return true, "", nil
+}
+
+func nonNil(m map[string]string) map[string]string {
+	if m == nil {
+		return map[string]string{}
+	}
+	return m
+}
@@ -0,0 +1,65 @@
+package sink
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"admission-controller-03/pkg/config"
+)
+
+// New builds the sinks configured in cfg, publishing to all of them when
+// several are. Credentials are read from their mounted files, and templates
+// parsed up front, so that a broken one fails at startup.
+func New(cfg *config.Sink) (Sink, error) {
+	var sinks multiSink
+	if cfg.Kafka != nil {
+		sinks = append(sinks, NewKafkaSink(cfg.Kafka.Brokers, cfg.Kafka.Topic))
+	}
+	if cfg.NATS != nil {
+		s, err := NewNATSSink(cfg.NATS.URL, cfg.NATS.Subject, cfg.NATS.CredentialsFile)
+		if err != nil {
+			sinks.Close()
+			return nil, err
+		}
+		sinks = append(sinks, s)
+	}
+	if cfg.HTTP != nil {
+		s, err := newHTTPSink(cfg.HTTP)
+		if err != nil {
+			sinks.Close()
+			return nil, err
+		}
+		sinks = append(sinks, s)
+	}
+	if len(sinks) == 1 {
+		return sinks[0], nil
+	}
+	return sinks, nil
+}
+
+func newHTTPSink(cfg *config.HTTPSink) (*HTTPSink, error) {
+	s := &HTTPSink{Requests: map[Event]HTTPRequest{}, Headers: cfg.Headers, Username: cfg.Username}
+	for event, r := range cfg.Requests {
+		request, err := ParseHTTPRequest(Event(event), r.Method, r.URL, r.Body)
+		if err != nil {
+			return nil, err
+		}
+		s.Requests[Event(event)] = request
+	}
+	if cfg.PasswordFile != "" {
+		password, err := os.ReadFile(cfg.PasswordFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read HTTP sink password: %v", err)
+		}
+		s.Password = strings.TrimSpace(string(password))
+	}
+	if cfg.TokenFile != "" {
+		token, err := os.ReadFile(cfg.TokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read HTTP sink token: %v", err)
+		}
+		s.Token = strings.TrimSpace(string(token))
+	}
+	return s, nil
+}
@@ -0,0 +1,129 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	httpAttempts = 3
+	httpBackoff  = 2 * time.Second
+)
+
+// HTTPRequest is the request filed for one event. URL and Body are
+// text/template over Record, with a json function quoting a value, e.g.
+// {"u_cidr": {{json .CIDR}}}.
+type HTTPRequest struct {
+	Method string
+	URL    *template.Template
+	Body   *template.Template
+}
+
+// HTTPSink files every allocation change with an HTTP API, e.g. as a CMDB
+// record in ServiceNow. Requests failing with a server error are retried a
+// few times before the change is given up on.
+type HTTPSink struct {
+	// Requests maps an event to its request; events without one are not
+	// filed.
+	Requests map[Event]HTTPRequest
+	Headers  map[string]string
+	// Username and Password authenticate by basic auth, Token as a bearer
+	// token.
+	Username string
+	Password string
+	Token    string
+	Client   *http.Client
+}
+
+// ParseHTTPRequest parses the templates of a request.
+func ParseHTTPRequest(event Event, method, url, body string) (HTTPRequest, error) {
+	funcs := template.FuncMap{"json": func(v interface{}) (string, error) {
+		quoted, err := json.Marshal(v)
+		return string(quoted), err
+	}}
+	urlTemplate, err := template.New(string(event) + " url").Funcs(funcs).Parse(url)
+	if err != nil {
+		return HTTPRequest{}, fmt.Errorf("invalid url template for event %s: %v", event, err)
+	}
+	bodyTemplate, err := template.New(string(event) + " body").Funcs(funcs).Parse(body)
+	if err != nil {
+		return HTTPRequest{}, fmt.Errorf("invalid body template for event %s: %v", event, err)
+	}
+	if method == "" {
+		method = http.MethodPost
+	}
+	return HTTPRequest{Method: method, URL: urlTemplate, Body: bodyTemplate}, nil
+}
+
+func (s *HTTPSink) Publish(ctx context.Context, record Record) error {
+	request, ok := s.Requests[record.Event]
+	if !ok {
+		return nil
+	}
+	var url, body bytes.Buffer
+	if err := request.URL.Execute(&url, record); err != nil {
+		return fmt.Errorf("could not render url: %v", err)
+	}
+	if err := request.Body.Execute(&body, record); err != nil {
+		return fmt.Errorf("could not render body: %v", err)
+	}
+
+	var err error
+	for attempt := 1; ; attempt++ {
+		var retry bool
+		if retry, err = s.send(ctx, request.Method, strings.TrimSpace(url.String()), body.Bytes()); err == nil || !retry || attempt == httpAttempts {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(time.Duration(attempt) * httpBackoff):
+		}
+	}
+}
+
+// send makes one request, reporting whether a failure is worth retrying.
+func (s *HTTPSink) send(ctx context.Context, method, url string, body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	for key, value := range s.Headers {
+		req.Header.Set(key, value)
+	}
+	switch {
+	case s.Token != "":
+		req.Header.Set("Authorization", "Bearer "+s.Token)
+	case s.Username != "":
+		req.SetBasicAuth(s.Username, s.Password)
+	}
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return true, fmt.Errorf("could not file record: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests,
+			fmt.Errorf("filing record answered %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	return false, nil
+}
+
+func (s *HTTPSink) Close() error {
+	return nil
+}
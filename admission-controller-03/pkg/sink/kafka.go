@@ -0,0 +1,39 @@
+package sink
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// KafkaSink publishes records to a Kafka topic, keyed by namespace so the
+// records of one namespace stay ordered within a partition.
+type KafkaSink struct {
+	writer *kafka.Writer
+}
+
+// NewKafkaSink returns a sink writing to topic on the given brokers.
+func NewKafkaSink(brokers []string, topic string) *KafkaSink {
+	return &KafkaSink{writer: &kafka.Writer{
+		Addr:         kafka.TCP(brokers...),
+		Topic:        topic,
+		Balancer:     &kafka.Hash{},
+		RequiredAcks: kafka.RequireAll,
+	}}
+}
+
+func (s *KafkaSink) Publish(ctx context.Context, record Record) error {
+	payload, err := encode(record)
+	if err != nil {
+		return err
+	}
+	if err := s.writer.WriteMessages(ctx, kafka.Message{Key: []byte(record.Namespace), Value: payload}); err != nil {
+		return fmt.Errorf("could not publish to Kafka: %v", err)
+	}
+	return nil
+}
+
+func (s *KafkaSink) Close() error {
+	return s.writer.Close()
+}
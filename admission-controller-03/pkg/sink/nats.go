@@ -0,0 +1,49 @@
+package sink
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/nats-io/nats.go"
+)
+
+// NATSSink publishes records to a NATS subject.
+type NATSSink struct {
+	conn    *nats.Conn
+	subject string
+}
+
+// NewNATSSink connects to the NATS server at url, authenticating with the
+// credentials file when one is given.
+func NewNATSSink(url, subject, credentialsFile string) (*NATSSink, error) {
+	var opts []nats.Option
+	if credentialsFile != "" {
+		opts = append(opts, nats.UserCredentials(credentialsFile))
+	}
+	conn, err := nats.Connect(url, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to NATS: %v", err)
+	}
+	return &NATSSink{conn: conn, subject: subject}, nil
+}
+
+// Publish waits for the record to be flushed to the server, so a record is
+// only reported as published once the server has it.
+func (s *NATSSink) Publish(ctx context.Context, record Record) error {
+	payload, err := encode(record)
+	if err != nil {
+		return err
+	}
+	if err := s.conn.Publish(s.subject, payload); err != nil {
+		return fmt.Errorf("could not publish to NATS: %v", err)
+	}
+	if err := s.conn.FlushWithContext(ctx); err != nil {
+		return fmt.Errorf("could not flush to NATS: %v", err)
+	}
+	return nil
+}
+
+func (s *NATSSink) Close() error {
+	s.conn.Close()
+	return nil
+}
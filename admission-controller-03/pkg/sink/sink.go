@@ -0,0 +1,61 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Event names an allocation change.
+type Event string
+
+const (
+	EventAssigned Event = "assigned"
+	EventReleased Event = "released"
+)
+
+// Record is one allocation change, as published to downstream network
+// inventory and SIEM systems.
+type Record struct {
+	Event     Event     `json:"event"`
+	Namespace string    `json:"namespace"`
+	Pool      string    `json:"pool"`
+	CIDR      string    `json:"cidr,omitempty"`
+	Tenant    string    `json:"tenant,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+// Sink publishes allocation records.
+type Sink interface {
+	Publish(ctx context.Context, record Record) error
+	Close() error
+}
+
+// multiSink publishes every record to each of its sinks.
+type multiSink []Sink
+
+func (m multiSink) Publish(ctx context.Context, record Record) error {
+	var errs []error
+	for _, s := range m {
+		errs = append(errs, s.Publish(ctx, record))
+	}
+	return errors.Join(errs...)
+}
+
+func (m multiSink) Close() error {
+	var errs []error
+	for _, s := range m {
+		errs = append(errs, s.Close())
+	}
+	return errors.Join(errs...)
+}
+
+func encode(record Record) ([]byte, error) {
+	payload, err := json.Marshal(record)
+	if err != nil {
+		return nil, fmt.Errorf("could not encode allocation record: %v", err)
+	}
+	return payload, nil
+}
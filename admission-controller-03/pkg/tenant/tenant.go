@@ -0,0 +1,58 @@
+// Package tenant defines the Tenant resource, which carries a tenant's pool
+// policy in the cluster instead of the config file. There is no generated
+// client; the types convert from the unstructured objects the dynamic client
+// works with.
+package tenant
+
+import (
+	_ "embed"
+	"fmt"
+
+	"admission-controller-03/pkg/config"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/yaml"
+)
+
+const Kind = "Tenant"
+
+// Resource is the Tenant resource, cluster scoped. A tenant's name is the
+// value of the configured tenant label on its namespaces.
+var Resource = schema.GroupVersionResource{Group: "ipam.example.com", Version: "v1alpha1", Resource: "tenants"}
+
+//go:embed crd.yaml
+var crdManifest []byte
+
+// CRD returns the CustomResourceDefinition of Tenant.
+func CRD() (*unstructured.Unstructured, error) {
+	var object map[string]interface{}
+	if err := yaml.Unmarshal(crdManifest, &object); err != nil {
+		return nil, fmt.Errorf("could not decode CRD manifest: %v", err)
+	}
+	return &unstructured.Unstructured{Object: object}, nil
+}
+
+// Tenant is the pool policy of one tenant. Its spec has the fields of a
+// config file tenant.
+type Tenant struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec config.Tenant `json:"spec"`
+}
+
+// FromUnstructured converts and validates an object read through the dynamic
+// client.
+func FromUnstructured(u *unstructured.Unstructured) (*Tenant, error) {
+	var t Tenant
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, &t); err != nil {
+		return nil, fmt.Errorf("could not convert Tenant %s: %v", u.GetName(), err)
+	}
+	if err := t.Spec.Validate(t.Name); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
@@ -0,0 +1,109 @@
+// Package v1beta1 defines version v1beta1 of Tenant and its conversion from
+// and to v1alpha1, the storage version. v1beta1 moves the tenant's defaults
+// for its namespaces under spec.defaults.
+package v1beta1
+
+import (
+	"fmt"
+
+	"admission-controller-03/pkg/config"
+	"admission-controller-03/pkg/tenant"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+const Version = "v1beta1"
+
+// Tenant is the pool policy of one tenant.
+type Tenant struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec Spec `json:"spec"`
+}
+
+// Spec is the policy of the tenant's namespaces.
+type Spec struct {
+	PoolSelectors      []string               `json:"poolSelectors"`
+	MaxPools           int                    `json:"maxPools"`
+	CleanupPolicy      string                 `json:"cleanupPolicy,omitempty"`
+	AllowedZones       []string               `json:"allowedZones,omitempty"`
+	AllowedPoolClasses []string               `json:"allowedPoolClasses,omitempty"`
+	Reservations       []config.ReservedRange `json:"reservations,omitempty"`
+	Defaults           Defaults               `json:"defaults,omitempty"`
+}
+
+// Defaults apply to the tenant's namespaces unless they ask otherwise.
+type Defaults struct {
+	// PrefixLength is the size of the child pools carved for the tenant's
+	// namespaces.
+	PrefixLength int `json:"prefixLength,omitempty"`
+}
+
+// FromV1alpha1 converts a v1alpha1 tenant.
+func FromV1alpha1(in *tenant.Tenant) *Tenant {
+	return &Tenant{
+		TypeMeta:   metav1.TypeMeta{APIVersion: tenant.Resource.Group + "/" + Version, Kind: tenant.Kind},
+		ObjectMeta: in.ObjectMeta,
+		Spec: Spec{
+			PoolSelectors:      in.Spec.PoolSelectors,
+			MaxPools:           in.Spec.MaxPools,
+			CleanupPolicy:      in.Spec.CleanupPolicy,
+			AllowedZones:       in.Spec.AllowedZones,
+			AllowedPoolClasses: in.Spec.AllowedPoolClasses,
+			Reservations:       in.Spec.Reservations,
+			Defaults:           Defaults{PrefixLength: in.Spec.DefaultPrefixLength},
+		},
+	}
+}
+
+// ToV1alpha1 converts to a v1alpha1 tenant.
+func ToV1alpha1(in *Tenant) *tenant.Tenant {
+	return &tenant.Tenant{
+		TypeMeta:   metav1.TypeMeta{APIVersion: tenant.Resource.GroupVersion().String(), Kind: tenant.Kind},
+		ObjectMeta: in.ObjectMeta,
+		Spec: config.Tenant{
+			PoolSelectors:       in.Spec.PoolSelectors,
+			MaxPools:            in.Spec.MaxPools,
+			CleanupPolicy:       in.Spec.CleanupPolicy,
+			AllowedZones:        in.Spec.AllowedZones,
+			AllowedPoolClasses:  in.Spec.AllowedPoolClasses,
+			Reservations:        in.Spec.Reservations,
+			DefaultPrefixLength: in.Spec.Defaults.PrefixLength,
+		},
+	}
+}
+
+// Convert converts a Tenant of either version to the given version. Unlike
+// tenant.FromUnstructured it does not validate: an invalid tenant is stored
+// as it is and reported where it is used.
+func Convert(in *unstructured.Unstructured, toVersion string) (*unstructured.Unstructured, error) {
+	from := in.GroupVersionKind().Version
+	if from == toVersion {
+		return in, nil
+	}
+	var out interface{}
+	switch {
+	case from == tenant.Resource.Version && toVersion == Version:
+		var alpha tenant.Tenant
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(in.Object, &alpha); err != nil {
+			return nil, fmt.Errorf("could not convert Tenant %s: %v", in.GetName(), err)
+		}
+		out = FromV1alpha1(&alpha)
+	case from == Version && toVersion == tenant.Resource.Version:
+		var beta Tenant
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(in.Object, &beta); err != nil {
+			return nil, fmt.Errorf("could not convert Tenant %s: %v", in.GetName(), err)
+		}
+		out = ToV1alpha1(&beta)
+	default:
+		return nil, fmt.Errorf("cannot convert Tenant from %s to %s", from, toVersion)
+	}
+	object, err := runtime.DefaultUnstructuredConverter.ToUnstructured(out)
+	if err != nil {
+		return nil, fmt.Errorf("could not convert Tenant %s: %v", in.GetName(), err)
+	}
+	return &unstructured.Unstructured{Object: object}, nil
+}
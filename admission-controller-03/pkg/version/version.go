@@ -0,0 +1,5 @@
+package version
+
+// Version is the webhook build version, set at build time with
+// -ldflags "-X admission-controller-03/pkg/version.Version=<version>".
+var Version = "dev"